@@ -0,0 +1,147 @@
+// Package api holds the request and response shapes of the notification
+// backend's API and the opaque ID format, shared by both backends and usable
+// by Go callers of the notification backend. Package client calls the API
+// with them.
+//
+// The protobuf tags are the field numbers of notification.proto, used when a
+// request is sent as application/x-protobuf.
+package api
+
+// TokenRegistration is the body of POST /v1/register
+type TokenRegistration struct {
+	EncryptedData string `json:"encrypted_data" protobuf:"1"`
+	Platform      string `json:"platform" protobuf:"2"`
+	// EncryptedEmail is an optional hybrid-encrypted address for the email fallback
+	EncryptedEmail string `json:"encrypted_email,omitempty" protobuf:"3"`
+	// EncryptedPhone is an optional hybrid-encrypted E.164 number for the SMS fallback
+	EncryptedPhone string `json:"encrypted_phone,omitempty" protobuf:"4"`
+	// Channels are further ways to reach the device, tried in order when delivery fails
+	Channels []ChannelRegistration `json:"channels,omitempty" protobuf:"5"`
+	// FirebaseProject labels the --firebase-projects entry FCM tokens belong to; empty is --firebase-key
+	FirebaseProject string `json:"firebase_project,omitempty" protobuf:"6"`
+	// IntegrityToken is a Play Integrity token bound to EncryptedData, required for
+	// "android" registrations with --play-integrity-package
+	IntegrityToken string `json:"integrity_token,omitempty" protobuf:"7"`
+	// Challenge is a nonce from GET /v1/register/challenge, used as the AES-GCM
+	// additional data of EncryptedData; required with --require-challenge
+	Challenge string `json:"challenge,omitempty" protobuf:"8"`
+
+	// Optional device metadata, stored with the token for listings and stats
+	AppVersion  string `json:"app_version,omitempty" protobuf:"9"`
+	OSVersion   string `json:"os_version,omitempty" protobuf:"10"`
+	Locale      string `json:"locale,omitempty" protobuf:"11"`
+	DeviceModel string `json:"device_model,omitempty" protobuf:"12"`
+
+	// UserHash is a keyed hash of the app's user ID, so /v1/notify-user can
+	// reach all of a user's devices without the user ID ever reaching the backend
+	UserHash string `json:"user_hash,omitempty" protobuf:"13"`
+
+	// Timezone is the device's IANA time zone, e.g. "Europe/Zurich"
+	Timezone string `json:"timezone,omitempty" protobuf:"14"`
+	// QuietHours is a local-time window such as "22:00-07:00" during which
+	// non-critical notifications are held back; it needs Timezone
+	QuietHours string `json:"quiet_hours,omitempty" protobuf:"15"`
+}
+
+// ChannelRegistration is a failover channel of a TokenRegistration
+type ChannelRegistration struct {
+	Platform      string `json:"platform" protobuf:"1"`
+	EncryptedData string `json:"encrypted_data" protobuf:"2"`
+}
+
+// RegisterResponse answers a successful POST /v1/register
+type RegisterResponse struct {
+	Success     bool   `json:"success" protobuf:"1"`
+	Message     string `json:"message" protobuf:"2"`
+	TokenID     string `json:"token_id" protobuf:"3"`
+	Platform    string `json:"platform" protobuf:"4"`
+	TotalTokens int    `json:"total_tokens" protobuf:"5"`
+	// NotifySecret must accompany /v1/notify for this token; the server keeps only its hash
+	NotifySecret string `json:"notify_secret" protobuf:"6"`
+	// IssuedAt (Unix seconds) and TokenID are signed in Signature with the
+	// backend's key, see "Signed Responses" in the notification-backend README
+	IssuedAt  int64  `json:"issued_at" protobuf:"7"`
+	Signature string `json:"signature" protobuf:"8"`
+}
+
+// ChallengeResponse answers GET /v1/register/challenge
+type ChallengeResponse struct {
+	Success   bool   `json:"success" protobuf:"1"`
+	Challenge string `json:"challenge" protobuf:"2"`
+	ExpiresIn int    `json:"expires_in" protobuf:"3"` // seconds
+}
+
+// NotificationRequest is the body of POST /v1/notify, for one opaque ID
+type NotificationRequest struct {
+	TokenID       string            `json:"token_id" protobuf:"1"`                  // Opaque ID field (required)
+	PublicKeyHash string            `json:"public_key_hash,omitempty" protobuf:"2"` // must match the token's key when set
+	Title         string            `json:"title" protobuf:"3"`
+	Body          string            `json:"body" protobuf:"4"`
+	Critical      bool              `json:"critical,omitempty" protobuf:"5"`      // allows the SMS fallback
+	NotifySecret  string            `json:"notify_secret,omitempty" protobuf:"6"` // from the registration response
+	Template      string            `json:"template,omitempty" protobuf:"7"`      // named template instead of title and body
+	Variables     map[string]string `json:"variables,omitempty" protobuf:"8"`     // fills the template's placeholders
+	DryRun        bool              `json:"dry_run,omitempty" protobuf:"9"`       // check everything but deliver nothing
+}
+
+// NotifyResponse answers a successful POST /v1/notify
+type NotifyResponse struct {
+	Success bool   `json:"success" protobuf:"1"`
+	Message string `json:"message" protobuf:"2"`
+	DryRun  bool   `json:"dry_run,omitempty" protobuf:"3"` // nothing was delivered
+}
+
+// SendRequest is the body of POST /v1/send, a broadcast to every registration
+type SendRequest struct {
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Critical bool   `json:"critical,omitempty"` // allows the SMS fallback
+	Platform string `json:"platform,omitempty"` // only sends to registrations of this platform
+	// LocalTime such as "09:00" delivers at that wall-clock time in each registration's timezone
+	LocalTime string `json:"local_time,omitempty"`
+	// Experiment names a split send delivering Variants, in place of Title and Body
+	Experiment string                `json:"experiment,omitempty"`
+	Variants   []NotificationVariant `json:"variants,omitempty"`
+}
+
+// NotificationVariant is one bucket of a split send
+type NotificationVariant struct {
+	Name    string `json:"name"`
+	Percent int    `json:"percent"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+}
+
+// UserNotificationRequest is the body of POST /v1/notify-user, for all
+// devices registered with UserHash
+type UserNotificationRequest struct {
+	UserHash string `json:"user_hash"`
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Critical bool   `json:"critical,omitempty"` // allows the SMS fallback
+}
+
+// SendResponse answers a broadcast to several registrations, from
+// /v1/send and /v1/notify-user
+type SendResponse struct {
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	SentCount   int    `json:"sent_count"`
+	ErrorCount  int    `json:"error_count"`
+	TotalTokens int    `json:"total_tokens"`
+}
+
+// StatusResponse answers GET /v1/status
+type StatusResponse struct {
+	RegisteredTokens    int            `json:"registered_tokens"`
+	Platforms           map[string]int `json:"platforms"` // registrations by platform
+	FirebaseInitialized bool           `json:"firebase_initialized"`
+	FCMMocked           bool           `json:"fcm_mocked,omitempty"` // --mock-fcm: nothing is delivered
+	APIVersion          string         `json:"api_version"`
+	StorageType         string         `json:"storage_type"`
+	PublicKeyHash       string         `json:"public_key_hash"` // shortened, for display
+	SendsInFlight       int            `json:"sends_in_flight"`
+	SendsQueued         int            `json:"sends_queued"`
+	VAPIDPublicKey      string         `json:"vapid_public_key,omitempty"` // for Web Push subscriptions
+	PendingUploads      int            `json:"pending_uploads,omitempty"`  // registrations kept in file storage during an SOS outage
+}
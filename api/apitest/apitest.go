@@ -0,0 +1,143 @@
+// Package apitest holds the fixtures the backends' tests share: a checked-in
+// RSA key pair, opaque IDs and hybrid-encrypted tokens that come out the same
+// on every run. The keys are public, so they must never be deployed.
+package apitest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"math/rand/v2"
+	"sync"
+
+	"remote-notification/api"
+)
+
+// The notification backend's key pair in its file formats: PKCS#1 for the
+// private half, PKIX for the public half the clients embed
+var (
+	//go:embed private_key.pem
+	PrivateKeyPEM []byte
+	//go:embed public_key.pem
+	PublicKeyPEM []byte
+)
+
+// A second key pair, for tests of a token or signature made with the wrong key
+var (
+	//go:embed other_private_key.pem
+	OtherPrivateKeyPEM []byte
+	//go:embed other_public_key.pem
+	OtherPublicKeyPEM []byte
+)
+
+var (
+	privateKey      = sync.OnceValue(func() *rsa.PrivateKey { return mustParse(PrivateKeyPEM) })
+	otherPrivateKey = sync.OnceValue(func() *rsa.PrivateKey { return mustParse(OtherPrivateKeyPEM) })
+)
+
+func mustParse(data []byte) *rsa.PrivateKey {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		panic("apitest: no PEM block in a checked-in key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		panic(fmt.Sprintf("apitest: failed to parse a checked-in key: %v", err))
+	}
+	return key
+}
+
+// PrivateKey returns the test key pair. Callers share it, so must not modify it.
+func PrivateKey() *rsa.PrivateKey { return privateKey() }
+
+// PublicKey returns the public half of PrivateKey
+func PublicKey() *rsa.PublicKey { return &privateKey().PublicKey }
+
+// OtherPrivateKey returns the second test key pair
+func OtherPrivateKey() *rsa.PrivateKey { return otherPrivateKey() }
+
+// PublicKeyHash is what the app backend sends as public_key_hash for
+// PublicKeyPEM: the SHA-256 of the file, in hex
+func PublicKeyHash() string {
+	sum := sha256.Sum256(PublicKeyPEM)
+	return hex.EncodeToString(sum[:])
+}
+
+// OpaqueID returns the version 1 opaque ID numbered n. The same n always
+// gives the same ID, and different ones never collide.
+func OpaqueID(n int) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "apitest opaque ID %d", n))
+	return fmt.Sprintf("rn%d_%s", api.OpaqueIDVersion, api.OpaqueIDEncoding.EncodeToString(sum[:]))
+}
+
+// FCMToken returns the FCM registration token numbered n: an installation ID
+// and an "APA91b" token of realistic length, which api.ValidateFCMToken
+// accepts. The same n always gives the same token.
+func FCMToken(n int) string {
+	id := sha256.Sum256(fmt.Appendf(nil, "apitest installation ID %d", n))
+	stream := rand.NewChaCha8(sha256.Sum256(fmt.Appendf(nil, "apitest FCM token %d", n)))
+	token := make([]byte, 100)
+	stream.Read(token)
+	return base64.RawURLEncoding.EncodeToString(id[:16]) + ":APA91b" + base64.RawURLEncoding.EncodeToString(token)
+}
+
+// EncryptToken hybrid-encrypts token to PublicKey as the clients do, giving
+// the same encrypted_data for the same token every time
+func EncryptToken(token string) string {
+	return EncryptTokenTo(PublicKey(), token, nil)
+}
+
+// EncryptTokenTo hybrid-encrypts token to key, binding aad (nil for none)
+// into the GCM tag. The AES key, IV and RSA padding are drawn from a stream
+// seeded by the inputs, which is what makes the result reproducible.
+func EncryptTokenTo(key *rsa.PublicKey, token string, aad []byte) string {
+	seed := sha256.New()
+	seed.Write(key.N.Bytes())
+	fmt.Fprintf(seed, "\x00%d\x00%s\x00", len(token), token)
+	seed.Write(aad)
+	stream := rand.NewChaCha8([32]byte(seed.Sum(nil)))
+
+	aesKey := make([]byte, 32)
+	iv := make([]byte, 12)
+	stream.Read(aesKey)
+	stream.Read(iv)
+	block, _ := aes.NewCipher(aesKey)
+	gcm, _ := cipher.NewGCM(block)
+	encryptedKey := encryptPKCS1v15(stream, key, aesKey)
+
+	combined := append([]byte{}, iv...)
+	combined = binary.BigEndian.AppendUint32(combined, uint32(len(encryptedKey)))
+	combined = append(combined, encryptedKey...)
+	combined = gcm.Seal(combined, iv, []byte(token), aad)
+	return base64.StdEncoding.EncodeToString(combined)
+}
+
+// encryptPKCS1v15 is RSA PKCS #1 v1.5 encryption with the padding read from
+// stream. crypto/rsa always pads from its own source, so cannot be reproduced.
+func encryptPKCS1v15(stream *rand.ChaCha8, key *rsa.PublicKey, msg []byte) []byte {
+	k := key.Size()
+	// 0x00 0x02, at least 8 nonzero padding bytes, 0x00, the message
+	em := make([]byte, k)
+	em[1] = 2
+	padding := em[2 : k-len(msg)-1]
+	for i := range padding {
+		for padding[i] == 0 {
+			var b [1]byte
+			stream.Read(b[:])
+			padding[i] = b[0]
+		}
+	}
+	copy(em[k-len(msg):], msg)
+
+	c := new(big.Int).Exp(new(big.Int).SetBytes(em), big.NewInt(int64(key.E)), key.N)
+	return c.FillBytes(make([]byte, k))
+}
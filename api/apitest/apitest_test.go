@@ -0,0 +1,105 @@
+package apitest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"testing"
+
+	"remote-notification/api"
+)
+
+// decrypt undoes EncryptTokenTo the way the notification backend does
+func decrypt(t *testing.T, key *rsa.PrivateKey, encryptedData string, aad []byte) (string, error) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		t.Fatalf("Expected base64, got %v", err)
+	}
+	keyLength := int(binary.BigEndian.Uint32(raw[12:16]))
+	if keyLength != key.Size() {
+		t.Fatalf("Expected a %d byte encrypted key, got %d", key.Size(), keyLength)
+	}
+	aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, key, raw[16:16+keyLength])
+	if err != nil {
+		return "", err
+	}
+	block, _ := aes.NewCipher(aesKey)
+	gcm, _ := cipher.NewGCM(block)
+	token, err := gcm.Open(nil, raw[:12], raw[16+keyLength:], aad)
+	return string(token), err
+}
+
+func TestKeys(t *testing.T) {
+	if PrivateKey().Size() != 256 || OtherPrivateKey().Size() != 256 {
+		t.Errorf("Expected 2048-bit keys")
+	}
+	if PrivateKey().Equal(OtherPrivateKey()) {
+		t.Error("Expected two different key pairs")
+	}
+	for pub, priv := range map[string]*rsa.PrivateKey{string(PublicKeyPEM): PrivateKey(), string(OtherPublicKeyPEM): OtherPrivateKey()} {
+		block, _ := pem.Decode([]byte(pub))
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil || !priv.PublicKey.Equal(key) {
+			t.Errorf("Expected each public key file to hold its private key's half, got %v", err)
+		}
+	}
+	if len(PublicKeyHash()) != 64 {
+		t.Errorf("Expected a hex SHA-256, got %q", PublicKeyHash())
+	}
+}
+
+func TestOpaqueID(t *testing.T) {
+	seen := make(map[string]bool)
+	for n := range 100 {
+		id := OpaqueID(n)
+		if version, err := api.ParseOpaqueID(id); err != nil || version != api.OpaqueIDVersion {
+			t.Fatalf("Expected a version %d opaque ID, got %q: %v", api.OpaqueIDVersion, id, err)
+		}
+		if seen[id] {
+			t.Fatalf("Expected distinct IDs, got %q twice", id)
+		}
+		seen[id] = true
+		if OpaqueID(n) != id {
+			t.Fatalf("Expected OpaqueID(%d) to be reproducible", n)
+		}
+	}
+}
+
+func TestFCMToken(t *testing.T) {
+	if err := api.ValidateFCMToken(FCMToken(1)); err != nil {
+		t.Errorf("Expected a valid FCM token, got %v", err)
+	}
+	if FCMToken(1) != FCMToken(1) || FCMToken(1) == FCMToken(2) {
+		t.Error("Expected tokens reproducible and distinct")
+	}
+}
+
+func TestEncryptToken(t *testing.T) {
+	encrypted := EncryptToken("fcm-token-1")
+	if EncryptToken("fcm-token-1") != encrypted {
+		t.Error("Expected the same encrypted_data for the same token")
+	}
+	if EncryptToken("fcm-token-2") == encrypted {
+		t.Error("Expected another token to encrypt differently")
+	}
+	if token, err := decrypt(t, PrivateKey(), encrypted, nil); err != nil || token != "fcm-token-1" {
+		t.Errorf("Expected the token back, got %q, %v", token, err)
+	}
+	if _, err := decrypt(t, OtherPrivateKey(), encrypted, nil); err == nil {
+		t.Error("Expected the other key not to decrypt it")
+	}
+
+	withAAD := EncryptTokenTo(&OtherPrivateKey().PublicKey, "fcm-token-1", []byte("challenge"))
+	if token, err := decrypt(t, OtherPrivateKey(), withAAD, []byte("challenge")); err != nil || token != "fcm-token-1" {
+		t.Errorf("Expected the token back with its additional data, got %q, %v", token, err)
+	}
+	if _, err := decrypt(t, OtherPrivateKey(), withAAD, []byte("other")); err == nil {
+		t.Error("Expected other additional data to fail")
+	}
+}
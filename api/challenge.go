@@ -0,0 +1,23 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// A registration challenge is unpadded base64url of its expiry (8 bytes of
+// big-endian Unix seconds), 16 random bytes and their HMAC-SHA256. Only the
+// backend that issued it can check the HMAC; anyone can read the expiry.
+const challengeSize = 8 + 16 + 32
+
+// ChallengeExpiry returns when a challenge from GET /v1/register/challenge
+// expires, without checking that a backend issued it
+func ChallengeExpiry(challenge string) (time.Time, error) {
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(b) != challengeSize {
+		return time.Time{}, fmt.Errorf("malformed challenge")
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(b)), 0), nil
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestChallengeExpiry(t *testing.T) {
+	expires := time.Date(2026, 3, 1, 12, 5, 0, 0, time.UTC)
+	b := make([]byte, challengeSize)
+	binary.BigEndian.PutUint64(b, uint64(expires.Unix()))
+	if got, err := ChallengeExpiry(base64.RawURLEncoding.EncodeToString(b)); err != nil || !got.Equal(expires) {
+		t.Errorf("ChallengeExpiry = %v, %v; want %v", got, err, expires)
+	}
+	for _, challenge := range []string{"", "not base64!", base64.RawURLEncoding.EncodeToString(b[:challengeSize-1])} {
+		if _, err := ChallengeExpiry(challenge); err == nil {
+			t.Errorf("Expected %q to be rejected", challenge)
+		}
+	}
+}
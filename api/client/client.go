@@ -0,0 +1,261 @@
+// Package client calls the notification backend's API with the request and
+// response types of package api, so Go services need not write the JSON
+// plumbing themselves.
+//
+//	c := client.New("https://notify.example.com", os.Getenv("NOTIFICATION_API_KEY"))
+//	reg, err := c.Register(ctx, api.TokenRegistration{EncryptedData: data, Platform: "android"})
+//
+// Every call takes a context, which bounds it together with its retries.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"remote-notification/api"
+)
+
+const (
+	// DefaultRetries is how often New lets a client retry a status call
+	DefaultRetries = 2
+	// DefaultRetryBackoff is the delay before the first retry when
+	// Client.RetryBackoff is zero, doubled after each
+	DefaultRetryBackoff = 200 * time.Millisecond
+)
+
+// maxResponseSize bounds the response bodies read from the backend
+const maxResponseSize = 1 << 20
+
+// Client calls one notification backend. Its fields may be changed until the
+// first call; after that it is safe for concurrent use.
+type Client struct {
+	// BaseURL is the backend's address, such as "https://notify.example.com"
+	BaseURL string
+	// APIKey is sent as a Bearer token when set
+	APIKey string
+	// HTTPClient makes the calls; nil uses http.DefaultClient
+	HTTPClient *http.Client
+	// Retries is how often a status call is retried after a connection error
+	// or a 502, 503 or 504. Registrations and sends are never retried: they
+	// may have taken effect before the failure.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubled after each;
+	// zero is DefaultRetryBackoff
+	RetryBackoff time.Duration
+	// Prepare, when set, is called on every request before it is sent, for
+	// instance to add a request ID header
+	Prepare func(*http.Request)
+}
+
+// New returns a client for the backend at baseURL, authenticating with
+// apiKey unless it is empty
+func New(baseURL, apiKey string) *Client {
+	return &Client{BaseURL: baseURL, APIKey: apiKey, Retries: DefaultRetries}
+}
+
+// Error is an error answer of the backend
+type Error struct {
+	StatusCode int
+	// Code is the backend's error code, such as "TOKEN_NOT_FOUND"; it is empty
+	// when the backend answered in plain text, which is then the Message
+	Code    string
+	Message string
+	// RetryAfter is the backend's Retry-After, set when it was overloaded
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("backend returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// UnreachableError is a call that got no answer from the backend at all
+type UnreachableError struct {
+	Err error
+}
+
+func (e *UnreachableError) Error() string { return "backend unreachable: " + e.Err.Error() }
+
+func (e *UnreachableError) Unwrap() error { return e.Err }
+
+// Register registers an encrypted device token with POST /v1/register
+func (c *Client) Register(ctx context.Context, reg api.TokenRegistration) (*api.RegisterResponse, error) {
+	var resp api.RegisterResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/register", reg, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Challenge fetches a nonce for the next registration with
+// GET /v1/register/challenge
+func (c *Client) Challenge(ctx context.Context) (*api.ChallengeResponse, error) {
+	var resp api.ChallengeResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/register/challenge", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Notify sends a notification to one opaque ID with POST /v1/notify
+func (c *Client) Notify(ctx context.Context, notif api.NotificationRequest) (*api.NotifyResponse, error) {
+	var resp api.NotifyResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/notify", notif, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// NotifyUser sends a notification to all devices of a user with
+// POST /v1/notify-user
+func (c *Client) NotifyUser(ctx context.Context, notif api.UserNotificationRequest) (*api.SendResponse, error) {
+	var resp api.SendResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/notify-user", notif, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SendAll broadcasts a notification to every registration with POST /v1/send
+func (c *Client) SendAll(ctx context.Context, notif api.SendRequest) (*api.SendResponse, error) {
+	var resp api.SendResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/send", notif, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Status fetches the backend's GET /v1/status
+func (c *Client) Status(ctx context.Context) (*api.StatusResponse, error) {
+	var resp api.StatusResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/status", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// do makes a call, sending in as JSON unless it is nil and decoding the
+// answer into out
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var data []byte
+	if in != nil {
+		var err error
+		if data, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+	}
+
+	body, err := c.roundTrip(ctx, method, path, data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %v", err)
+	}
+	return nil
+}
+
+// roundTrip makes a call, retrying a GET as Retries allows, and returns the
+// body of a successful answer
+func (c *Client) roundTrip(ctx context.Context, method, path string, data []byte) ([]byte, error) {
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		body, err := c.attempt(ctx, method, path, data)
+		if method != http.MethodGet || attempt >= c.Retries || !shouldRetry(err) || ctx.Err() != nil {
+			return body, err
+		}
+
+		select {
+		case <-time.After(backoff << attempt):
+		case <-ctx.Done():
+			return nil, &UnreachableError{ctx.Err()}
+		}
+	}
+}
+
+// attempt makes one request and reads its answer
+func (c *Client) attempt(ctx context.Context, method, path string, data []byte) ([]byte, error) {
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL: %v", err)
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	if c.Prepare != nil {
+		c.Prepare(req)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, &UnreachableError{err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, &UnreachableError{fmt.Errorf("failed to read response body: %v", err)}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newError(resp, body)
+	}
+	return body, nil
+}
+
+// newError decodes the backend's error body. Older backends answered in
+// plain text, which is kept as the message.
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Message: string(body)}
+	var decoded struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &decoded) == nil && decoded.Code != "" {
+		e.Code, e.Message = decoded.Code, decoded.Message
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// shouldRetry reports whether a failed call may succeed if made again. An
+// untrusted certificate will not be trusted on the next try either.
+func shouldRetry(err error) bool {
+	var unreachable *UnreachableError
+	if errors.As(err, &unreachable) {
+		var certErr *tls.CertificateVerificationError
+		return !errors.As(err, &certErr)
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
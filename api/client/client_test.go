@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"remote-notification/api"
+)
+
+func TestClientCalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Request-ID") != "req-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/register":
+			var reg api.TokenRegistration
+			if err := json.NewDecoder(r.Body).Decode(&reg); err != nil || reg.Platform != "android" {
+				t.Errorf("register body %+v: %v", reg, err)
+			}
+			json.NewEncoder(w).Encode(api.RegisterResponse{Success: true, TokenID: "id-1", Platform: reg.Platform})
+		case "/v1/register/challenge":
+			json.NewEncoder(w).Encode(api.ChallengeResponse{Success: true, Challenge: "nonce", ExpiresIn: 300})
+		case "/v1/notify":
+			var notif api.NotificationRequest
+			json.NewDecoder(r.Body).Decode(&notif)
+			json.NewEncoder(w).Encode(api.NotifyResponse{Success: true, DryRun: notif.DryRun})
+		case "/v1/send", "/v1/notify-user":
+			json.NewEncoder(w).Encode(api.SendResponse{Success: true, SentCount: 2, TotalTokens: 3, ErrorCount: 1})
+		case "/v1/status":
+			json.NewEncoder(w).Encode(api.StatusResponse{RegisteredTokens: 3, Platforms: map[string]int{"android": 3}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL+"/", "secret")
+	c.Prepare = func(req *http.Request) { req.Header.Set("X-Request-ID", "req-1") }
+	ctx := context.Background()
+
+	reg, err := c.Register(ctx, api.TokenRegistration{EncryptedData: "data", Platform: "android"})
+	if err != nil || reg.TokenID != "id-1" {
+		t.Fatalf("Register = %+v, %v", reg, err)
+	}
+	challenge, err := c.Challenge(ctx)
+	if err != nil || challenge.Challenge != "nonce" || challenge.ExpiresIn != 300 {
+		t.Fatalf("Challenge = %+v, %v", challenge, err)
+	}
+	notified, err := c.Notify(ctx, api.NotificationRequest{TokenID: "id-1", Title: "t", Body: "b", DryRun: true})
+	if err != nil || !notified.DryRun {
+		t.Fatalf("Notify = %+v, %v", notified, err)
+	}
+	sent, err := c.SendAll(ctx, api.SendRequest{Title: "t", Body: "b"})
+	if err != nil || sent.SentCount != 2 || sent.ErrorCount != 1 {
+		t.Fatalf("SendAll = %+v, %v", sent, err)
+	}
+	sent, err = c.NotifyUser(ctx, api.UserNotificationRequest{UserHash: "h", Title: "t", Body: "b"})
+	if err != nil || sent.TotalTokens != 3 {
+		t.Fatalf("NotifyUser = %+v, %v", sent, err)
+	}
+	status, err := c.Status(ctx)
+	if err != nil || status.RegisteredTokens != 3 || status.Platforms["android"] != 3 {
+		t.Fatalf("Status = %+v, %v", status, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/v1/notify":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"code":"TOKEN_NOT_FOUND","message":"Token not found"}`))
+		case "/v1/send":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("overloaded"))
+		case "/v1/status":
+			if calls.Load() < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"registered_tokens":1}`))
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "")
+	c.RetryBackoff = time.Millisecond
+	ctx := context.Background()
+
+	var apiErr *Error
+	_, err := c.Notify(ctx, api.NotificationRequest{TokenID: "gone"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "TOKEN_NOT_FOUND" || apiErr.Message != "Token not found" {
+		t.Fatalf("Notify error = %v", err)
+	}
+
+	// A send is not retried, and plain text errors are kept as the message
+	calls.Store(0)
+	_, err = c.SendAll(ctx, api.SendRequest{Title: "t", Body: "b"})
+	if !errors.As(err, &apiErr) || apiErr.Code != "" || apiErr.Message != "overloaded" || apiErr.RetryAfter != 3*time.Second || calls.Load() != 1 {
+		t.Fatalf("SendAll error = %v after %d calls", err, calls.Load())
+	}
+
+	// A status call is retried until it succeeds
+	calls.Store(0)
+	status, err := c.Status(ctx)
+	if err != nil || status.RegisteredTokens != 1 || calls.Load() != 3 {
+		t.Fatalf("Status = %+v, %v after %d calls", status, err, calls.Load())
+	}
+
+	// ... but no more often than Retries allows
+	calls.Store(0)
+	c.Retries = 1
+	if _, err := c.Status(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Fatalf("Status error = %v after %d calls", err, calls.Load())
+	}
+
+	server.Close()
+	var unreachable *UnreachableError
+	if _, err := c.Register(ctx, api.TokenRegistration{}); !errors.As(err, &unreachable) {
+		t.Fatalf("Register on a closed server = %v, want an UnreachableError", err)
+	}
+}
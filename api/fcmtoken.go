@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FCM registration tokens are an installation ID, a colon and the token
+// proper, both base64url: "cWyQ...:APA91b...". Tokens from before
+// installation IDs are the bare "APA91b..." part. Google publishes no length;
+// the bounds are generous around the 150-200 characters seen in practice.
+const (
+	MinFCMTokenLength = 100
+	MaxFCMTokenLength = 1000
+)
+
+var (
+	fcmTokenFormat       = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}:[A-Za-z0-9_-]{64,}$`)
+	legacyFCMTokenFormat = regexp.MustCompile(`^APA91b[A-Za-z0-9_-]+$`)
+)
+
+// ValidateFCMToken checks that a device token has the shape of an FCM
+// registration token, so garbage is refused at registration rather than by
+// FCM at the first send. The errors never quote the token.
+func ValidateFCMToken(token string) error {
+	if len(token) < MinFCMTokenLength || len(token) > MaxFCMTokenLength {
+		return fmt.Errorf("FCM token of %d characters, expected %d to %d", len(token), MinFCMTokenLength, MaxFCMTokenLength)
+	}
+	if i := strings.IndexFunc(token, func(r rune) bool { return !isBase64URL(r) && r != ':' }); i >= 0 {
+		return fmt.Errorf("FCM token has a character FCM tokens never contain at position %d", i+1)
+	}
+	if !fcmTokenFormat.MatchString(token) && !legacyFCMTokenFormat.MatchString(token) {
+		return fmt.Errorf("FCM token is not an installation ID and a token separated by a colon")
+	}
+	return nil
+}
+
+func isBase64URL(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_'
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFCMToken(t *testing.T) {
+	installationID := "cWyQ3d8hRkKp0vXq1mZSbE"
+	payload := "APA91b" + strings.Repeat("Hq_7-Zk2", 17)
+	for _, token := range []string{
+		installationID + ":" + payload,
+		payload,
+		"loadtest:" + strings.Repeat("x", 160),
+	} {
+		if err := ValidateFCMToken(token); err != nil {
+			t.Errorf("Expected %.20q... to be accepted, got %v", token, err)
+		}
+	}
+
+	for name, token := range map[string]string{
+		"too short":        installationID + ":APA91bshort",
+		"too long":         installationID + ":" + strings.Repeat("A", MaxFCMTokenLength),
+		"space":            installationID + ": " + payload,
+		"standard base64":  installationID + ":" + payload[:60] + "+/" + payload[62:],
+		"newline":          installationID + ":" + payload + "\n",
+		"no colon":         "fcm-token-" + payload,
+		"two colons":       installationID + ":" + payload[:70] + ":" + payload[70:],
+		"short ID":         "abc:" + payload,
+		"empty token part": strings.Repeat("A", 120) + ":",
+		"JSON":             `{"token":"` + payload + `"}`,
+	} {
+		err := ValidateFCMToken(token)
+		if err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		} else if strings.Contains(err.Error(), payload[6:30]) {
+			t.Errorf("%s: expected the error not to quote the token, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module remote-notification/api
+
+go 1.24.5
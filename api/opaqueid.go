@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/base32"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Opaque IDs are "rn<version>_" and a lowercase base32 body. Version 1 is 32
+// random bytes. Parsers go by the prefix, never by length, so later versions
+// can change the body; bare 64-hex IDs from before the prefix stay valid.
+const (
+	OpaqueIDVersion   = 1
+	MaxOpaqueIDLength = 128
+)
+
+// OpaqueIDEncoding is unpadded lowercase base32, safe in URLs, topics and object keys
+var OpaqueIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+var (
+	opaqueIDFormat       = regexp.MustCompile(`^rn([1-9][0-9]{0,3})_([a-z2-7]+)$`)
+	legacyOpaqueIDFormat = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// ParseOpaqueID returns the format version of an opaque ID, 0 for a legacy
+// 64-hex ID. Versions newer than OpaqueIDVersion are accepted with any body,
+// so callers keep working while a newer backend starts issuing them.
+func ParseOpaqueID(id string) (int, error) {
+	if legacyOpaqueIDFormat.MatchString(id) {
+		return 0, nil
+	}
+	if len(id) > MaxOpaqueIDLength {
+		return 0, fmt.Errorf("opaque ID longer than %d characters", MaxOpaqueIDLength)
+	}
+	m := opaqueIDFormat.FindStringSubmatch(id)
+	if m == nil {
+		return 0, fmt.Errorf("malformed opaque ID")
+	}
+	version, _ := strconv.Atoi(m[1])
+	if version == 1 {
+		if b, err := OpaqueIDEncoding.DecodeString(m[2]); err != nil || len(b) != 32 {
+			return 0, fmt.Errorf("malformed version 1 opaque ID")
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOpaqueID(t *testing.T) {
+	valid := map[string]int{
+		"rn1_aaaqeayeaudaocajbifqydiob4ibceqtcqkrmfyydenbwha5dypq":         1,
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef": 0,
+		"rn7_anylengthbodyfromanewerbackend":                               7,
+	}
+	for id, want := range valid {
+		if got, err := ParseOpaqueID(id); err != nil || got != want {
+			t.Errorf("ParseOpaqueID(%q) = %d, %v; want version %d", id, got, err, want)
+		}
+	}
+	for _, id := range []string{"", "tokenid", "rn1_short", "RN1_aaaqeayeaudaocajbifqydiob4ibceqtcqkrmfyydenbwha5dypq", "rn0_abc", "rn2_../secret", "rn2_" + strings.Repeat("a", MaxOpaqueIDLength)} {
+		if _, err := ParseOpaqueID(id); err == nil {
+			t.Errorf("Expected %q to be rejected", id)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var adminsFile = flag.String("admins-file", "", "JSON file of the admin accounts and their roles (or ADMINS_FILE); once set, the web interface needs a login")
+
+// Role is what an admin account may do; each role includes those before it
+type Role string
+
+const (
+	RoleViewer Role = "viewer" // token counts, tokens, history
+	RoleSender Role = "sender" // sends and message templates
+	RoleAdmin  Role = "admin"  // token removal and admin accounts
+)
+
+var roleRanks = map[Role]int{RoleViewer: 1, RoleSender: 2, RoleAdmin: 3}
+
+// allows reports whether r includes the permissions of need
+func (r Role) allows(need Role) bool { return roleRanks[r] >= roleRanks[need] }
+
+const minAdminPasswordLength = 12
+
+// adminNamePattern is what an account may be called, e-mail addresses included
+var adminNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+var (
+	errAdminNotFound = errors.New("admin account not found")
+	errLastAdmin     = errors.New("the last account with the admin role cannot be removed or demoted")
+)
+
+// adminSaveError is a change to the accounts that could not be written
+type adminSaveError struct{ err error }
+
+func (e *adminSaveError) Error() string { return "failed to save admin accounts: " + e.err.Error() }
+
+// AdminAccount is one entry of --admins-file. The password is kept as a
+// bcrypt hash, so files can also be written with `htpasswd -nbB`; the API
+// key, being random, as its SHA-256.
+type AdminAccount struct {
+	Name         string `json:"-"`
+	Role         Role   `json:"role"`
+	PasswordHash string `json:"password_hash"`
+	APIKeyHash   string `json:"api_key_hash,omitempty"`
+}
+
+// apiKeyAccount is who a request bearing --admin-api-key acts as
+var apiKeyAccount = &AdminAccount{Name: "api-key", Role: RoleAdmin}
+
+// AdminStore keeps the admin accounts by name, persisted to a file
+type AdminStore struct {
+	mu       sync.Mutex
+	accounts map[string]*AdminAccount
+	file     string
+}
+
+// adminStore is nil when no --admins-file is set: the web interface is then
+// open to anyone who can reach it, as before accounts existed
+var adminStore *AdminStore
+
+// OpenAdminStore returns the accounts of path. A missing file starts with
+// none, leaving only --admin-api-key to create them.
+func OpenAdminStore(path string) (*AdminStore, error) {
+	s := &AdminStore{accounts: make(map[string]*AdminAccount), file: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admins file: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.accounts); err != nil {
+		return nil, fmt.Errorf("failed to parse admins file: %v", err)
+	}
+	for name, account := range s.accounts {
+		if _, ok := roleRanks[account.Role]; !ok {
+			return nil, fmt.Errorf("admin account %q has unknown role %q", name, account.Role)
+		}
+		if _, err := bcrypt.Cost([]byte(account.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("admin account %q has no bcrypt password hash: %v", name, err)
+		}
+		account.Name = name
+	}
+	return s, nil
+}
+
+// dummyPasswordHash is compared against for unknown names, so a login takes
+// as long whether or not the account exists
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("no such account"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Authenticate returns the account of name if password is its password
+func (s *AdminStore) Authenticate(name, password string) (*AdminAccount, bool) {
+	s.mu.Lock()
+	account, ok := s.accounts[name]
+	s.mu.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return account, true
+}
+
+// AuthenticateAPIKey returns the account whose API key is key
+func (s *AdminStore) AuthenticateAPIKey(key string) (*AdminAccount, bool) {
+	hash := apiKeyHash(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *AdminAccount
+	for _, account := range s.accounts {
+		if account.APIKeyHash != "" && subtle.ConstantTimeCompare([]byte(account.APIKeyHash), []byte(hash)) == 1 {
+			found = account
+		}
+	}
+	return found, found != nil
+}
+
+// IssueAPIKey gives the account of name a new API key, replacing any it had.
+// The key is returned once; only its hash is kept.
+func (s *AdminStore) IssueAPIKey(name string) (string, error) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	key := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[name]
+	if !ok {
+		return "", errAdminNotFound
+	}
+	updated := *account
+	updated.APIKeyHash = apiKeyHash(key)
+	s.accounts[name] = &updated
+	return key, s.save()
+}
+
+// RevokeAPIKey removes the API key of the account of name
+func (s *AdminStore) RevokeAPIKey(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[name]
+	if !ok {
+		return errAdminNotFound
+	}
+	updated := *account
+	updated.APIKeyHash = ""
+	s.accounts[name] = &updated
+	return s.save()
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// List returns every account, sorted by name
+func (s *AdminStore) List() []AdminAccount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := make([]AdminAccount, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, *account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts
+}
+
+// Put creates or updates an account. An empty password keeps the current
+// one, and is refused for a new account.
+func (s *AdminStore) Put(name string, role Role, password string) error {
+	if !adminNamePattern.MatchString(name) {
+		return fmt.Errorf("names are 1-64 letters, digits, '.', '@', '-' or '_'")
+	}
+	if _, ok := roleRanks[role]; !ok {
+		return fmt.Errorf("role must be viewer, sender or admin")
+	}
+	var hash []byte
+	if password != "" {
+		if len(password) < minAdminPasswordLength {
+			return fmt.Errorf("passwords need at least %d characters", minAdminPasswordLength)
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return fmt.Errorf("failed to hash password: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[name]
+	switch {
+	case !ok && hash == nil:
+		return fmt.Errorf("password is required for a new account")
+	case ok && account.Role == RoleAdmin && role != RoleAdmin && s.admins() == 1:
+		return errLastAdmin
+	}
+	updated := &AdminAccount{Name: name, Role: role}
+	if ok {
+		updated.PasswordHash, updated.APIKeyHash = account.PasswordHash, account.APIKeyHash
+	}
+	if hash != nil {
+		updated.PasswordHash = string(hash)
+	}
+	s.accounts[name] = updated
+	return s.save()
+}
+
+// Delete removes an account
+func (s *AdminStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[name]
+	if !ok {
+		return errAdminNotFound
+	}
+	if account.Role == RoleAdmin && s.admins() == 1 {
+		return errLastAdmin
+	}
+	delete(s.accounts, name)
+	return s.save()
+}
+
+// admins counts the accounts with the admin role. The caller holds s.mu.
+func (s *AdminStore) admins() int {
+	n := 0
+	for _, account := range s.accounts {
+		if account.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// save writes the accounts to their file through a temporary file like the
+// token store. The caller holds s.mu.
+func (s *AdminStore) save() error {
+	data, err := json.MarshalIndent(s.accounts, "", "  ")
+	if err != nil {
+		return &adminSaveError{err}
+	}
+	// Password hashes are in here
+	tempFile := s.file + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return &adminSaveError{err}
+	}
+	if err := os.Rename(tempFile, s.file); err != nil {
+		return &adminSaveError{err}
+	}
+	return nil
+}
+
+// setupAdmins loads the --admins-file flag or ADMINS_FILE, when set
+func setupAdmins(path string) error {
+	if path == "" {
+		path = os.Getenv("ADMINS_FILE")
+	}
+	if path == "" {
+		return nil
+	}
+	s, err := OpenAdminStore(path)
+	if err != nil {
+		return err
+	}
+	adminStore = s
+	if len(s.accounts) == 0 {
+		slog.Warn("No admin accounts yet; create them through /api/admins with --admin-api-key", "file", path)
+	}
+	slog.Info("Admin accounts loaded", "file", path, "accounts", len(s.accounts))
+	return nil
+}
+
+// checkAdmins is the --check-config report for the admins file
+func checkAdmins(path string) (string, error) {
+	s, err := OpenAdminStore(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d accounts, %d with the admin role, in %s", len(s.accounts), s.admins(), path), nil
+}
+
+type accountKey struct{}
+
+// accountFromContext returns the account a request was authenticated as, if any
+func accountFromContext(ctx context.Context) *AdminAccount {
+	account, _ := ctx.Value(accountKey{}).(*AdminAccount)
+	return account
+}
+
+// may reports whether the request's account has role. Anyone may everything
+// while no --admins-file is set.
+func may(r *http.Request, role Role) bool {
+	if adminStore == nil {
+		return true
+	}
+	account := accountFromContext(r.Context())
+	return account != nil && account.Role.allows(role)
+}
+
+// bearerAccount returns who the request's bearer key belongs to: the
+// --admin-api-key or the API key of an admin account, nil when it is wrong.
+// ok is false when the request bears no key.
+func bearerAccount(r *http.Request) (account *AdminAccount, ok bool) {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	if adminAPIKey != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(adminAPIKey)) == 1 {
+		return apiKeyAccount, true
+	}
+	if adminStore != nil {
+		if account, found := adminStore.AuthenticateAPIKey(presented); found {
+			return account, true
+		}
+	}
+	return nil, true
+}
+
+// authenticate returns who the request's credentials belong to: a bearer
+// key as bearerAccount takes, or the name and password of an admin account.
+// It returns nil when there are no credentials or they are wrong.
+func authenticate(r *http.Request) *AdminAccount {
+	if account, ok := bearerAccount(r); ok {
+		return account
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok || adminStore == nil {
+		return nil
+	}
+	account, ok := adminStore.Authenticate(name, password)
+	recordLogin(r, name, ok)
+	if !ok {
+		loggerFromContext(r.Context()).Warn("Rejected admin login", "admin", name)
+		return nil
+	}
+	return account
+}
+
+// withAccount continues a request as account, naming it in the request's log lines
+func withAccount(r *http.Request, account *AdminAccount) *http.Request {
+	ctx := withLogger(r.Context(), loggerFromContext(r.Context()).With("admin", account.Name))
+	return r.WithContext(context.WithValue(ctx, accountKey{}, account))
+}
+
+// requireRole guards a page or form of the web interface. With an admins
+// file set, browsers are asked to log in and the account needs role.
+func requireRole(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminStore == nil {
+			next(w, r)
+			return
+		}
+		account := authenticate(r)
+		if account == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="app-backend", charset="UTF-8"`)
+			writeError(w, ErrUnauthorized, "Log in with an admin account")
+			return
+		}
+		if !account.Role.allows(role) {
+			writeError(w, ErrForbidden, fmt.Sprintf("Needs the %s role", role))
+			return
+		}
+		next(w, withAccount(r, account))
+	}
+}
+
+// requireAPIRole guards the JSON API with --admin-api-key, which has every
+// role, or the API key of an admin account having role. Being scripted, it
+// takes a bearer key instead of the CSRF token of the forms, and never the
+// logins browsers keep for the web interface and send along on their own.
+func requireAPIRole(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminAPIKey == "" && adminStore == nil {
+			writeError(w, ErrEndpointDisabled, "API disabled; set --admin-api-key or --admins-file to enable it")
+			return
+		}
+		if err := checkOrigin(r); err != nil {
+			loggerFromContext(r.Context()).Warn("Rejected API request", "error", err)
+			writeError(w, ErrCSRFFailed, "Cross-origin API requests are not allowed")
+			return
+		}
+		account, _ := bearerAccount(r)
+		if account == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="app-backend"`)
+			writeError(w, ErrUnauthorized, "Missing or invalid API key")
+			return
+		}
+		if !account.Role.allows(role) {
+			writeError(w, ErrForbidden, fmt.Sprintf("Needs the %s role", role))
+			return
+		}
+		next(w, withAccount(r, account))
+	}
+}
+
+// AdminInfo is one account as listed by GET /api/admins, without its password
+type AdminInfo struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"role"`
+	APIKey bool   `json:"api_key,omitempty"` // whether it has an API key
+}
+
+// APIAdminsResponse is returned by GET /api/admins
+type APIAdminsResponse struct {
+	Success bool        `json:"success"`
+	Admins  []AdminInfo `json:"admins"`
+}
+
+// APIAdminRequest is the body of PUT /api/admins/{name}
+type APIAdminRequest struct {
+	Role     Role   `json:"role"`
+	Password string `json:"password,omitempty"` // required for a new account
+}
+
+// handleAPIAdmins lists the admin accounts
+func handleAPIAdmins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if adminStore == nil {
+		writeError(w, ErrEndpointDisabled, "No admin accounts; set --admins-file to enable them")
+		return
+	}
+	resp := APIAdminsResponse{Success: true, Admins: []AdminInfo{}}
+	for _, account := range adminStore.List() {
+		resp.Admins = append(resp.Admins, AdminInfo{Name: account.Name, Role: account.Role, APIKey: account.APIKeyHash != ""})
+	}
+	writeJSON(w, r, resp)
+}
+
+// handleAPIAdmin creates, updates or deletes one admin account
+func handleAPIAdmin(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if adminStore == nil {
+		writeError(w, ErrEndpointDisabled, "No admin accounts; set --admins-file to enable them")
+		return
+	}
+	name := r.PathValue("name")
+
+	var saveErr *adminSaveError
+	if r.Method == http.MethodDelete {
+		err := adminStore.Delete(name)
+		switch {
+		case errors.Is(err, errAdminNotFound):
+			writeError(w, ErrAdminNotFound, "Admin account not found")
+		case errors.As(err, &saveErr):
+			logger.Error("Failed to delete admin account", "name", name, "error", err)
+			writeError(w, ErrInternal, "Failed to save admin accounts")
+		case err != nil:
+			writeError(w, ErrInvalidRequest, err.Error())
+		default:
+			logger.Info("Admin account deleted", "name", name)
+			recordAudit(r, auditAdminDelete, name)
+			writeJSON(w, r, APIAdminsResponse{Success: true, Admins: []AdminInfo{}})
+		}
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var req APIAdminRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	if err := adminStore.Put(name, req.Role, req.Password); errors.As(err, &saveErr) {
+		logger.Error("Failed to save admin account", "name", name, "error", err)
+		writeError(w, ErrInternal, "Failed to save admin accounts")
+		return
+	} else if err != nil {
+		logger.Warn("Refused admin account", "name", name, "error", err)
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+	logger.Info("Admin account saved", "name", name, "role", req.Role, "password_changed", req.Password != "")
+	detail := fmt.Sprintf("%s as %s", name, req.Role)
+	if req.Password != "" {
+		detail += ", password set"
+	}
+	recordAudit(r, auditAdminSave, detail)
+	writeJSON(w, r, APIAdminsResponse{Success: true, Admins: []AdminInfo{{Name: name, Role: req.Role}}})
+}
+
+// APIAdminKeyResponse is returned by POST /api/admins/{name}/api-key
+type APIAdminKeyResponse struct {
+	Success bool   `json:"success"`
+	Name    string `json:"name"`
+	APIKey  string `json:"api_key"` // shown this once
+}
+
+// handleAPIAdminKey issues a new API key to one admin account, or revokes its key
+func handleAPIAdminKey(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if adminStore == nil {
+		writeError(w, ErrEndpointDisabled, "No admin accounts; set --admins-file to enable them")
+		return
+	}
+	name := r.PathValue("name")
+
+	var key string
+	var err error
+	if r.Method == http.MethodPost {
+		key, err = adminStore.IssueAPIKey(name)
+	} else {
+		err = adminStore.RevokeAPIKey(name)
+	}
+	var saveErr *adminSaveError
+	switch {
+	case errors.Is(err, errAdminNotFound):
+		writeError(w, ErrAdminNotFound, "Admin account not found")
+		return
+	case errors.As(err, &saveErr):
+		logger.Error("Failed to save admin API key", "name", name, "error", err)
+		writeError(w, ErrInternal, "Failed to save admin accounts")
+		return
+	case err != nil:
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	detail := name + ", key issued"
+	if key == "" {
+		detail = name + ", key revoked"
+	}
+	logger.Info("Admin API key changed", "name", name, "issued", key != "")
+	recordAudit(r, auditAdminAPIKey, detail)
+	writeJSON(w, r, APIAdminKeyResponse{Success: true, Name: name, APIKey: key})
+}
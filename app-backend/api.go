@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var adminAPIKeyFlag = flag.String("admin-api-key", "", "Bearer key for the /api/ endpoints (or ADMIN_API_KEY), acting with the admin role; empty leaves them to admin accounts, or disables them")
+
+// adminAPIKey is resolved from the flag or environment at startup
+var adminAPIKey string
+
+// setupAdminAPI resolves the key of the JSON API, preferring the flag
+func setupAdminAPI(key string) {
+	if key == "" {
+		key = os.Getenv("ADMIN_API_KEY")
+	}
+	adminAPIKey = key
+}
+
+// APISendRequest is the body of POST /api/send
+type APISendRequest struct {
+	Title     string            `json:"title,omitempty"` // defaults to "App Notification"
+	Message   string            `json:"message"`
+	Variables map[string]string `json:"variables,omitempty"` // values of the {{placeholders}}
+}
+
+// APISendResponse is returned by POST /api/send
+type APISendResponse struct {
+	Success bool `json:"success"` // at least one device was reached
+	sendResult
+	TotalTokens int `json:"total_tokens"`
+}
+
+// TokenInfo is one registration as listed by GET /api/tokens
+type TokenInfo struct {
+	TokenID      string    `json:"token_id"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// APITokensResponse is returned by GET /api/tokens
+type APITokensResponse struct {
+	Success bool        `json:"success"`
+	Count   int         `json:"count"` // on all pages
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Tokens  []TokenInfo `json:"tokens"`
+}
+
+// APIStatusResponse is returned by GET /api/status
+type APIStatusResponse struct {
+	Success    bool   `json:"success"`
+	Version    string `json:"version"`
+	TokenCount int    `json:"token_count"`
+	Persistent bool   `json:"persistent"`  // opaque IDs outlive a restart
+	Shared     bool   `json:"shared"`      // opaque IDs are shared between replicas
+	UserSends  bool   `json:"user_sends"`  // /send-user is enabled
+	RetryQueue int    `json:"retry_queue"` // registrations and notifications waiting for the backend
+
+	Backend         *BackendStatus `json:"backend,omitempty"`          // last check, absent before the first
+	BackendMismatch string         `json:"backend_mismatch,omitempty"` // why the counts differ
+
+	Backends []*BackendStatus `json:"backends,omitempty"` // every backend, when there are several
+}
+
+// writeJSON sends v as a 200 JSON response
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
+
+// handleAPISend is the JSON form of /send-all
+func handleAPISend(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var req APISendRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	if req.Message == "" {
+		writeError(w, ErrMissingField, "Message is required")
+		return
+	}
+	title, message, err := fillPlaceholders(req.Title, req.Message, func(name string) string { return req.Variables[name] })
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid message: "+err.Error())
+		return
+	}
+	title, ok := notificationTitle(title)
+	if !ok {
+		writeError(w, ErrInvalidRequest, titleTooLong)
+		return
+	}
+
+	tokenIDs := tokenStore.GetTokenIDs()
+	if len(tokenIDs) == 0 {
+		writeError(w, ErrNoTokens, "No tokens registered")
+		return
+	}
+	if !sendAllRunning.CompareAndSwap(false, true) {
+		writeError(w, ErrSendInProgress, "A send to all devices is already running")
+		return
+	}
+	defer sendAllRunning.Store(false)
+	recordAudit(r, auditSendAll, sendAuditDetail(title, message, len(tokenIDs)))
+	result := sendToAll(r.Context(), tokenIDs, title, message)
+	recordSend(r, "api", result.record(title, message, len(tokenIDs)))
+	logger.Info("API send finished", "sent", result.SentCount, "failed", result.ErrorCount, "removed", result.RemovedCount, "queued", result.QueuedCount)
+	writeJSON(w, r, APISendResponse{Success: result.SentCount > 0, sendResult: result, TotalTokens: len(tokenIDs)})
+}
+
+// handleAPITokens lists a page of the stored opaque IDs. They reveal nothing about the
+// devices, but the key still guards them as they are what sends address.
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	page, err := readTokenPage(r)
+	if err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, APITokensResponse{Success: true, Count: page.Total, Page: page.Page, PerPage: page.PerPage, Tokens: page.Tokens})
+}
+
+// handleAPIStatus reports what the home page shows
+func handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	status := APIStatusResponse{
+		Success:    true,
+		Version:    version,
+		TokenCount: tokenStore.Count(),
+		Persistent: tokenStore.file != "" || tokenStore.shared != nil,
+		Shared:     tokenStore.shared != nil,
+		UserSends:  userHashKey != "",
+		RetryQueue: retryQueue.Len(),
+		Backend:    backendStatus.latest(),
+	}
+	if status.Backend != nil {
+		status.BackendMismatch = status.Backend.Mismatch(tokenStore.CountOn(backends[0]))
+	}
+	if multipleBackends() {
+		status.Backends = backendStatus.all()
+	}
+	writeJSON(w, r, status)
+}
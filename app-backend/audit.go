@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var auditFile = flag.String("audit-file", "", "Append every admin action to this JSON lines file (or AUDIT_FILE); empty keeps the latest in memory only")
+
+const (
+	// maxAuditMemory is how many actions an audit log without a file keeps
+	maxAuditMemory = 10000
+	// loginAuditInterval is how long a login is remembered per account and
+	// client IP. Browsers send the password with every request, so only the
+	// first one in this time is recorded as a login.
+	loginAuditInterval = 12 * time.Hour
+)
+
+// Actions of the audit log
+const (
+	auditLogin             = "login"
+	auditLoginFailed       = "login_failed"
+	auditSendAll           = "send_all"
+	auditSendUser          = "send_user"
+	auditSendCSV           = "send_csv"
+	auditTokenDelete       = "token_delete"
+	auditTokensRemoveStale = "tokens_remove_stale"
+	auditTokensExport      = "tokens_export"
+	auditTemplateSave      = "template_save"
+	auditTemplateDelete    = "template_delete"
+	auditAdminSave         = "admin_save"
+	auditAdminDelete       = "admin_delete"
+	auditAdminAPIKey       = "admin_api_key"
+)
+
+// AuditEntry is one admin action. Admin is empty while no --admins-file is
+// set, and "api-key" for calls made with --admin-api-key.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Admin    string    `json:"admin"`
+	ClientIP string    `json:"client_ip"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// AuditLog is an append-only record of admin actions, as JSON lines in a
+// file, or in memory
+type AuditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	entries []AuditEntry // without a file only
+
+	logins map[string]time.Time // last login recorded, by account and client IP
+}
+
+var auditLog = &AuditLog{logins: make(map[string]time.Time)}
+
+// OpenAuditLog returns an audit log appending to path. Entries already in
+// the file are kept; it is created if missing.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	// Only appended to, never rewritten
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %v", err)
+	}
+	return &AuditLog{file: f, path: path, logins: make(map[string]time.Time)}, nil
+}
+
+// Add records an action. Failing to write it is logged, as the action has
+// already happened.
+func (a *AuditLog) Add(ctx context.Context, entry AuditEntry) {
+	loggerFromContext(ctx).Info("Admin action", "action", entry.Action, "admin", entry.Admin, "detail", entry.Detail)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		a.entries = append(a.entries, entry)
+		if len(a.entries) > maxAuditMemory {
+			a.entries = a.entries[len(a.entries)-maxAuditMemory:]
+		}
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		loggerFromContext(ctx).Error("Failed to marshal audit entry", "error", err)
+		return
+	}
+	// One write per entry, so lines never interleave
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		loggerFromContext(ctx).Error("Failed to write audit entry", "file", a.path, "error", err)
+	}
+}
+
+// All returns every recorded action, oldest first
+func (a *AuditLog) All() ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return append([]AuditEntry(nil), a.entries...), nil
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit file: %v", err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse audit file line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit file: %v", err)
+	}
+	return entries, nil
+}
+
+// Recent returns up to n actions, newest first
+func (a *AuditLog) Recent(n int) ([]AuditEntry, error) {
+	entries, err := a.All()
+	if err != nil {
+		return nil, err
+	}
+	recent := make([]AuditEntry, 0, min(n, len(entries)))
+	for i := len(entries) - 1; i >= 0 && len(recent) < n; i-- {
+		recent = append(recent, entries[i])
+	}
+	return recent, nil
+}
+
+// loginDue reports whether a login of name from ip should be recorded, and
+// remembers it as recorded
+func (a *AuditLog) loginDue(name, ip string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := name + "|" + ip
+	if last, ok := a.logins[key]; ok && now.Sub(last) < loginAuditInterval {
+		return false
+	}
+	a.logins[key] = now
+	return true
+}
+
+// setupAuditLog appends to the --audit-file flag or AUDIT_FILE, when set
+func setupAuditLog(path string) error {
+	if path == "" {
+		path = os.Getenv("AUDIT_FILE")
+	}
+	if path == "" {
+		return nil
+	}
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		return err
+	}
+	auditLog = a
+	return nil
+}
+
+// recordAudit adds an action taken through the request r to the audit log
+func recordAudit(r *http.Request, action, detail string) {
+	entry := AuditEntry{Time: time.Now().UTC(), Action: action, ClientIP: getClientIP(r), Detail: detail}
+	if account := accountFromContext(r.Context()); account != nil {
+		entry.Admin = account.Name
+	}
+	auditLog.Add(r.Context(), entry)
+}
+
+// recordLogin adds a login to the audit log, once per loginAuditInterval
+// for each account and client IP, and every failed one
+func recordLogin(r *http.Request, name string, ok bool) {
+	ip := getClientIP(r)
+	if ok && !auditLog.loginDue(name, ip, time.Now()) {
+		return
+	}
+	action := auditLogin
+	if !ok {
+		action = auditLoginFailed
+	}
+	auditLog.Add(r.Context(), AuditEntry{Time: time.Now().UTC(), Action: action, Admin: name, ClientIP: ip})
+}
+
+// APIAuditResponse is returned by GET /api/audit
+type APIAuditResponse struct {
+	Success bool         `json:"success"`
+	Count   int          `json:"count"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// handleAPIAudit lists the most recent admin actions, newest first
+func handleAPIAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	limit, ok := historyLimit(r)
+	if !ok {
+		writeError(w, ErrInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxHistory))
+		return
+	}
+	entries, err := auditLog.Recent(limit)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to read audit log", "error", err)
+		writeError(w, ErrInternal, "Failed to read audit log")
+		return
+	}
+	writeJSON(w, r, APIAuditResponse{Success: true, Count: len(entries), Entries: entries})
+}
+
+// csvCell keeps a value from being taken for a formula by spreadsheets
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeAuditCSV exports every admin action, oldest first
+func writeAuditCSV(w http.ResponseWriter, r *http.Request) {
+	entries, err := auditLog.All()
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to read audit log", "error", err)
+		writeError(w, ErrInternal, "Failed to read audit log")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "action", "admin", "client_ip", "detail"})
+	for _, e := range entries {
+		cw.Write([]string{e.Time.Format(time.RFC3339), e.Action, csvCell(e.Admin), e.ClientIP, csvCell(e.Detail)})
+	}
+	cw.Flush()
+}
+
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeAuditCSV(w, r)
+		return
+	}
+	limit, ok := historyLimit(r)
+	if !ok {
+		writeError(w, ErrInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxHistory))
+		return
+	}
+	entries, err := auditLog.Recent(limit)
+	if err != nil {
+		logger.Error("Failed to read audit log", "error", err)
+		writeError(w, ErrInternal, "Failed to read audit log")
+		return
+	}
+
+	t := pageTemplate(w, r, "audit")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, entries); err != nil {
+		logger.Error("Error executing template", "error", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	autocertDomain    = flag.String("autocert-domain", "", "Obtain and renew the TLS certificate for these comma-separated domains from Let's Encrypt (or AUTOCERT_DOMAIN) instead of using --cert and --key")
+	autocertCache     = flag.String("autocert-cache", "", "Directory keeping the ACME account key and certificates across restarts (or AUTOCERT_CACHE; default autocert-cache)")
+	autocertEmail     = flag.String("autocert-email", "", "Contact address given to the certificate authority for expiry and problem notices (or AUTOCERT_EMAIL)")
+	autocertHTTPAddr  = flag.String("autocert-http-addr", ":80", "Address answering ACME http-01 challenges and redirecting to https; empty relies on tls-alpn-01, which needs the server on port 443")
+	autocertDirectory = flag.String("autocert-directory", autocert.DefaultACMEDirectory, "ACME directory URL, e.g. Let's Encrypt staging for testing")
+)
+
+// autocertDomains returns the domains of --autocert-domain or
+// AUTOCERT_DOMAIN, or none when certificates come from files
+func autocertDomains(list string) ([]string, error) {
+	var domains []string
+	for _, domain := range strings.Split(cmp.Or(list, os.Getenv("AUTOCERT_DOMAIN")), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.ContainsAny(domain, ":/ ") {
+			return nil, fmt.Errorf("invalid autocert domain %q; give host names only", domain)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// openAutocertCache creates the cache directory of --autocert-cache or
+// AUTOCERT_CACHE and returns its path
+func openAutocertCache(cacheDir string) (string, error) {
+	cacheDir = cmp.Or(cacheDir, os.Getenv("AUTOCERT_CACHE"), "autocert-cache")
+	// The cache holds the account and certificate private keys
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create autocert cache: %v", err)
+	}
+	return cacheDir, nil
+}
+
+// checkAutocert is the --check-config report for ACME certificates: the
+// cache must be writable, since nothing can be obtained or renewed otherwise
+func checkAutocert(domains []string, cacheDir string) (string, error) {
+	cacheDir, err := openAutocertCache(cacheDir)
+	if err != nil {
+		return "", err
+	}
+	probe, err := os.CreateTemp(cacheDir, ".check-*")
+	if err != nil {
+		return "", fmt.Errorf("autocert cache not writable: %v", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return fmt.Sprintf("from ACME for %s, cached in %s", strings.Join(domains, ", "), cacheDir), nil
+}
+
+// setupAutocert returns the TLS configuration obtaining certificates for
+// domains, and starts the http-01 challenge listener. It returns nil when no
+// domain is set, leaving the server on --cert and --key.
+func setupAutocert(domains []string, cacheDir, email string) (*tls.Config, error) {
+	if len(domains) == 0 {
+		return nil, nil
+	}
+	cacheDir, err := openAutocertCache(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      cmp.Or(email, os.Getenv("AUTOCERT_EMAIL")),
+		Client:     &acme.Client{DirectoryURL: *autocertDirectory},
+	}
+	config := manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := manager.GetCertificate(hello)
+		// Clients asking for other names are refused quietly; failing to
+		// obtain or renew one of ours is what takes registration down
+		if err != nil && slices.Contains(domains, strings.ToLower(hello.ServerName)) {
+			slog.Error("Failed to obtain TLS certificate", "domain", hello.ServerName, "error", err)
+		}
+		return cert, err
+	}
+
+	if *autocertHTTPAddr != "" {
+		server := &http.Server{
+			Addr:              *autocertHTTPAddr,
+			Handler:           manager.HTTPHandler(nil),
+			ReadHeaderTimeout: *readHeaderTimeout,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				slog.Error("ACME challenge listener stopped", "addr", *autocertHTTPAddr, "error", err)
+			}
+		}()
+	}
+	slog.Info("TLS certificates from ACME", "domains", domains, "cache", cacheDir, "directory", *autocertDirectory, "http_addr", *autocertHTTPAddr)
+	return config, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"remote-notification/api/client"
+)
+
+var (
+	backendConnectTimeout = flag.Duration("backend-connect-timeout", 5*time.Second, "Timeout for connecting to the notification backend, TLS handshake included")
+	backendRetries        = flag.Int("backend-retries", 2, "How often an idempotent call to the notification backend is retried after a connection error or 502/503/504")
+	backendCAFile         = flag.String("backend-ca", "", "PEM file of CA certificates trusted for an https backend URL (or BACKEND_CA_FILE), in addition to the system roots")
+)
+
+const (
+	// backendMaxIdleConns keeps connections to the backend open between calls;
+	// the default of two per host would reconnect throughout a large send
+	backendMaxIdleConns    = 64
+	backendIdleConnTimeout = 90 * time.Second
+	backendKeepAlive       = 30 * time.Second
+	// backendRetryBackoff is the delay before the first retry, doubled after each
+	backendRetryBackoff = 200 * time.Millisecond
+)
+
+// newBackendTransport returns the connection pool for the notification
+// backend, trusting the CA certificates in caFile when it is set
+func newBackendTransport(caFile string) (*http.Transport, error) {
+	dialer := &net.Dialer{Timeout: *backendConnectTimeout, KeepAlive: backendKeepAlive}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          backendMaxIdleConns,
+		MaxIdleConnsPerHost:   backendMaxIdleConns,
+		IdleConnTimeout:       backendIdleConnTimeout,
+		TLSHandshakeTimeout:   *backendConnectTimeout,
+		ResponseHeaderTimeout: *backendTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if caFile == "" {
+		return transport, nil
+	}
+
+	pemData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backend CA file: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no PEM certificates in backend CA file %s", caFile)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return transport, nil
+}
+
+// backendAPI returns a client for notification backend b, calling through
+// backendClient and passing on the request ID of ctx. Only status calls are
+// retried: the retry queue takes registrations and sends.
+func backendAPI(ctx context.Context, b *notificationBackend) *client.Client {
+	c := client.New(b.baseURL(), b.apiKey())
+	c.HTTPClient, c.Retries, c.RetryBackoff = backendClient, max(0, *backendRetries), backendRetryBackoff
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		c.Prepare = func(req *http.Request) { req.Header.Set("X-Request-ID", requestID) }
+	}
+	return c
+}
+
+// backendCallError turns the client's errors into a backendError or
+// unreachableError, which the retry queue and metrics tell apart
+func backendCallError(err error) error {
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		code := ErrorCode(apiErr.Code)
+		if code == "" {
+			// Older backends answered in plain text
+			code = ErrBackendUnavailable
+		}
+		return &backendError{Status: apiErr.StatusCode, Code: code, Message: apiErr.Message}
+	}
+	var unreachable *client.UnreachableError
+	if errors.As(err, &unreachable) {
+		return &unreachableError{unreachable.Err}
+	}
+	return err
+}
+
+// setupBackendClient replaces backendClient with one using the
+// --backend-connect-timeout and --backend-ca flags
+func setupBackendClient(caFile string) error {
+	if caFile == "" {
+		caFile = os.Getenv("BACKEND_CA_FILE")
+	}
+	transport, err := newBackendTransport(caFile)
+	if err != nil {
+		return err
+	}
+	backendClient = &http.Client{
+		// Each attempt gets its own client span and latency sample
+		Transport: otelhttp.NewTransport(&metricsTransport{next: transport}),
+		// Callers bound their calls with --backend-timeout already; this
+		// catches any that forget
+		Timeout: *backendTimeout,
+	}
+	if caFile != "" {
+		slog.Info("Trusting extra CA certificates for the notification backend", "file", caFile)
+	}
+	return nil
+}
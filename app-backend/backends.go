@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+var backendsFile = flag.String("backends-file", "", "JSON file of several notification backends and the registrations each takes (or BACKENDS_FILE), instead of --backend-url")
+
+// defaultBackendName names the --backend-url backend, which is also where
+// opaque IDs stored without a backend were registered
+const defaultBackendName = "default"
+
+var backendNameFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// notificationBackend is one notification backend service. Registrations go
+// to a backend listing their tag, then to one listing their platform, then to
+// one without rules; an opaque ID is sent to through the backend that issued it.
+type notificationBackend struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`                 // empty for --backend-url
+	Platforms []string `json:"platforms,omitempty"` // registrations from these platforms
+	Tags      []string `json:"tags,omitempty"`      // registrations with one of these tags
+	APIKey    string   `json:"api_key,omitempty"`   // instead of --backend-api-key
+}
+
+// baseURL is where the backend's /v1 endpoints are
+func (b *notificationBackend) baseURL() string {
+	if b.URL == "" {
+		return *notificationBackendURL
+	}
+	return b.URL
+}
+
+// storedName is what opaque IDs from b are stored with: nothing while it
+// is the only backend
+func (b *notificationBackend) storedName() string {
+	if !multipleBackends() {
+		return ""
+	}
+	return b.Name
+}
+
+// apiKey is the bearer token of calls to the backend
+func (b *notificationBackend) apiKey() string {
+	if b.APIKey == "" {
+		return backendAPIKey
+	}
+	return b.APIKey
+}
+
+// backends are the configured notification backends; the first is the one
+// opaque IDs stored without a backend name belong to
+var backends = []*notificationBackend{{Name: defaultBackendName}}
+
+// roundRobin spreads registrations without a user over the candidates
+var roundRobin atomic.Uint64
+
+// multipleBackends reports whether --backends-file configured more than one
+func multipleBackends() bool { return len(backends) > 1 }
+
+// backendNamed returns the backend an opaque ID was stored with
+func backendNamed(name string) (*notificationBackend, error) {
+	if name == "" {
+		return backends[0], nil
+	}
+	for _, b := range backends {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("opaque ID belongs to backend %q, which is not configured", name)
+}
+
+// routeRegistration picks the backend for a new registration. Among several
+// that qualify, a user's registrations keep going to the same one, so their
+// devices share a backend, and the others take turns.
+func routeRegistration(reg TokenRegistration) (*notificationBackend, error) {
+	var candidates []*notificationBackend
+	if reg.Tag != "" {
+		candidates = filterBackends(func(b *notificationBackend) bool { return slices.Contains(b.Tags, reg.Tag) })
+	}
+	if len(candidates) == 0 {
+		candidates = filterBackends(func(b *notificationBackend) bool { return slices.Contains(b.Platforms, reg.Platform) })
+	}
+	if len(candidates) == 0 {
+		candidates = filterBackends(func(b *notificationBackend) bool { return len(b.Platforms) == 0 && len(b.Tags) == 0 })
+	}
+	switch {
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("no notification backend takes platform %q%s", reg.Platform, tagDetail(reg.Tag))
+	case len(candidates) == 1:
+		return candidates[0], nil
+	}
+	if hash := userHash(reg.UserID); hash != "" {
+		h := fnv.New64a()
+		h.Write([]byte(hash))
+		return candidates[h.Sum64()%uint64(len(candidates))], nil
+	}
+	return candidates[(roundRobin.Add(1)-1)%uint64(len(candidates))], nil
+}
+
+func filterBackends(match func(*notificationBackend) bool) []*notificationBackend {
+	var matched []*notificationBackend
+	for _, b := range backends {
+		if match(b) {
+			matched = append(matched, b)
+		}
+	}
+	return matched
+}
+
+func tagDetail(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return fmt.Sprintf(" or tag %q", tag)
+}
+
+// loadBackends reads and checks a --backends-file
+func loadBackends(path string) ([]*notificationBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backends file: %v", err)
+	}
+	var list []*notificationBackend
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse backends file: %v", err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("backends file %s lists no backends", path)
+	}
+	seen := make(map[string]bool, len(list))
+	for _, b := range list {
+		if !backendNameFormat.MatchString(b.Name) {
+			return nil, fmt.Errorf("backend name %q must be 1-32 lowercase letters, digits, '-' or '_'", b.Name)
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("backend %q is listed twice", b.Name)
+		}
+		seen[b.Name] = true
+		u, err := url.Parse(b.URL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("backend %q needs an http or https URL with a host, got %q", b.Name, b.URL)
+		}
+		b.URL = strings.TrimSuffix(b.URL, "/")
+	}
+	return list, nil
+}
+
+// setupBackends loads the --backends-file flag or BACKENDS_FILE, when set
+func setupBackends(path string) error {
+	if path == "" {
+		path = os.Getenv("BACKENDS_FILE")
+	}
+	if path == "" {
+		return nil
+	}
+	list, err := loadBackends(path)
+	if err != nil {
+		return err
+	}
+	backends = list
+	return nil
+}
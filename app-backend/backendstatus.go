@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var backendStatusInterval = flag.Duration("backend-status-interval", 30*time.Second, "How often to fetch the notification backend's /v1/status for the home page; 0 disables it")
+
+// BackendStatus is what the home page shows of a notification backend
+type BackendStatus struct {
+	Name                string    `json:"name"`
+	Healthy             bool      `json:"healthy"`
+	Error               string    `json:"error,omitempty"` // why the last check failed
+	RegisteredTokens    int       `json:"registered_tokens"`
+	StorageType         string    `json:"storage_type"`
+	FirebaseInitialized bool      `json:"firebase_initialized"`
+	SendsInFlight       int       `json:"sends_in_flight"`
+	SendsQueued         int       `json:"sends_queued"`
+	CheckedAt           time.Time `json:"checked_at"`
+}
+
+// Mismatch describes how the backend's registration count differs from the
+// count of opaque IDs here, or is empty when they agree
+func (s *BackendStatus) Mismatch(tokenCount int) string {
+	switch {
+	case !s.Healthy || s.RegisteredTokens == tokenCount:
+		return ""
+	case s.RegisteredTokens < tokenCount:
+		return fmt.Sprintf("The notification backend has %d registrations but this service has %d opaque IDs; sends to the missing ones will fail.",
+			s.RegisteredTokens, tokenCount)
+	default:
+		return fmt.Sprintf("The notification backend has %d registrations but this service has only %d opaque IDs; devices may have been forgotten here, or other apps share the backend.",
+			s.RegisteredTokens, tokenCount)
+	}
+}
+
+// fetchBackendStatus asks notification backend b for its /v1/status
+func fetchBackendStatus(ctx context.Context, b *notificationBackend) (*BackendStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, *backendTimeout)
+	defer cancel()
+
+	resp, err := backendAPI(ctx, b).Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BackendStatus{
+		Healthy:             true,
+		RegisteredTokens:    resp.RegisteredTokens,
+		StorageType:         resp.StorageType,
+		FirebaseInitialized: resp.FirebaseInitialized,
+		SendsInFlight:       resp.SendsInFlight,
+		SendsQueued:         resp.SendsQueued,
+	}, nil
+}
+
+// backendMonitor keeps the latest BackendStatus of every backend
+type backendMonitor struct {
+	mu       sync.Mutex
+	statuses map[string]*BackendStatus // by backend name, nil before the first check
+}
+
+var backendStatus = &backendMonitor{}
+
+// check fetches the status of every backend at once and stores the outcomes
+func (m *backendMonitor) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := fetchBackendStatus(ctx, b)
+			if err != nil {
+				slog.Warn("Notification backend status check failed", "backend", b.Name, "error", err)
+				status = &BackendStatus{Error: err.Error()}
+			}
+			status.Name, status.CheckedAt = b.Name, time.Now().UTC()
+			m.mu.Lock()
+			if m.statuses == nil {
+				m.statuses = make(map[string]*BackendStatus)
+			}
+			m.statuses[b.Name] = status
+			m.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// latest returns the outcome of the last check of the first backend, or nil
+// before the first one
+func (m *backendMonitor) latest() *BackendStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statuses[backends[0].Name]
+}
+
+// all returns the outcome of the last check of every backend checked yet, in
+// the order they are configured
+func (m *backendMonitor) all() []*BackendStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var statuses []*BackendStatus
+	for _, b := range backends {
+		if status, ok := m.statuses[b.Name]; ok {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// backendView is a backend's status as the home page shows it, next to the
+// opaque IDs here that it issued
+type backendView struct {
+	*BackendStatus
+	TokenCount int
+	Mismatch   string
+}
+
+// backendViews describes every backend checked yet
+func backendViews() []backendView {
+	var views []backendView
+	for _, status := range backendStatus.all() {
+		b, err := backendNamed(status.Name)
+		if err != nil {
+			continue
+		}
+		count := tokenStore.CountOn(b)
+		views = append(views, backendView{BackendStatus: status, TokenCount: count, Mismatch: status.Mismatch(count)})
+	}
+	return views
+}
+
+// startBackendMonitor checks the backend now and then every interval
+func startBackendMonitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			backendStatus.check(context.Background())
+			<-ticker.C
+		}
+	}()
+}
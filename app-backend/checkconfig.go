@@ -0,0 +1,133 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var checkConfig = flag.Bool("check-config", false, "Validate configuration (TLS certificate, public key, backend connectivity), print a report and exit")
+
+// configCheck is the outcome of a single preflight check
+type configCheck struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// runConfigChecks verifies everything the server needs before it can serve
+// traffic, including a live probe of the notification backend
+func runConfigChecks(ctx context.Context) []configCheck {
+	var checks []configCheck
+	add := func(name, detail string, err error) {
+		checks = append(checks, configCheck{Name: name, Detail: detail, Err: err})
+	}
+
+	domains, err := autocertDomains(*autocertDomain)
+	var detail string
+	if err == nil && len(domains) > 0 {
+		detail, err = checkAutocert(domains, *autocertCache)
+	} else if err == nil {
+		detail, err = checkTLSCertificate(*certFile, *keyFile, time.Now())
+	}
+	add("TLS certificate", detail, err)
+
+	detail, err = checkPublicKey(*publicKeyPath)
+	add("RSA public key", detail, err)
+
+	if path := cmp.Or(*backendsFile, os.Getenv("BACKENDS_FILE")); path != "" {
+		list, err := loadBackends(path)
+		add("Backends file", fmt.Sprintf("%d backends in %s", len(list), path), err)
+		if err == nil {
+			for _, b := range list {
+				add("Notification backend "+b.Name, b.baseURL(), probeBackend(ctx, b))
+			}
+		}
+	} else {
+		add("Notification backend", *notificationBackendURL, probeBackend(ctx, backends[0]))
+	}
+
+	if path := cmp.Or(*adminsFile, os.Getenv("ADMINS_FILE")); path != "" {
+		detail, err = checkAdmins(path)
+		add("Admin accounts", detail, err)
+	}
+
+	if rawURL := cmp.Or(*redisURL, os.Getenv("REDIS_URL")); rawURL != "" {
+		detail, err = checkRedis(ctx, rawURL)
+		add("Shared token store", detail, err)
+	}
+
+	if dir := cmp.Or(*templateDirFlag, os.Getenv("TEMPLATE_DIR")); dir != "" {
+		detail, err = checkTemplates(dir)
+		add("Page templates", detail, err)
+	}
+
+	return checks
+}
+
+// printConfigReport writes a human-readable report and reports whether all checks passed
+func printConfigReport(w io.Writer, checks []configCheck) bool {
+	ok := true
+	fmt.Fprintln(w, "Configuration check:")
+	for _, c := range checks {
+		if c.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "  [FAIL] %s: %v\n", c.Name, c.Err)
+			continue
+		}
+		fmt.Fprintf(w, "  [OK]   %s: %s\n", c.Name, c.Detail)
+	}
+	if ok {
+		fmt.Fprintln(w, "All checks passed")
+	} else {
+		fmt.Fprintln(w, "Configuration has problems")
+	}
+	return ok
+}
+
+// checkTLSCertificate loads the key pair and rejects certificates that are
+// not yet valid or already expired
+func checkTLSCertificate(certPath, keyPath string, now time.Time) (string, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	if now.Before(leaf.NotBefore) {
+		return "", fmt.Errorf("certificate not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return "", fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s, expires %s", leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02")), nil
+}
+
+// checkPublicKey verifies the public key file holds a parseable PEM public key
+func checkPublicKey(path string) (string, error) {
+	publicKeyPEM, err := readPublicKeyPEM(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := parsePublicKey(publicKeyPEM); err != nil {
+		return "", err
+	}
+	return "hash " + computePublicKeyHash(publicKeyPEM)[:16] + "...", nil
+}
+
+// probeBackend checks that notification backend b answers its status endpoint
+func probeBackend(ctx context.Context, b *notificationBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, *backendTimeout)
+	defer cancel()
+
+	_, err := backendAPI(ctx, b).Status(ctx)
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+var trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma-separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP name the client (or TRUSTED_PROXIES); other peers are their own client IP")
+
+// trustedProxies is set from --trusted-proxies; with none, forwarding
+// headers are ignored
+var trustedProxies []netip.Prefix
+
+// setupTrustedProxies parses --trusted-proxies or TRUSTED_PROXIES
+func setupTrustedProxies(list string) error {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(cmp.Or(list, os.Getenv("TRUSTED_PROXIES")), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return fmt.Errorf("invalid trusted proxy %q; give IPs or CIDR ranges", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+// isTrustedProxy reports whether ip is one of --trusted-proxies
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP returns the IP of the client that made the request. Only a
+// peer in --trusted-proxies is believed about who it forwards for: the
+// client is then the right-most X-Forwarded-For hop that is not a trusted
+// proxy itself, as the hops left of it are whatever the client wrote.
+func getClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && (i == 0 || !isTrustedProxy(hop)) {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return peer
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// The send forms carry a CSRF token that must match a cookie of the same
+// value (double submit). The __Host- prefix makes browsers refuse the cookie
+// unless it is Secure, host-only and for "/", so a sibling domain cannot
+// plant one; SameSite=Strict keeps it off cross-site requests altogether.
+const (
+	csrfCookieName = "__Host-csrf_token"
+	csrfFieldName  = "csrf_token"
+)
+
+// csrfToken returns the browser's CSRF token, issuing a cookie for a new one
+// when the request has none. Call it before writing the response body.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && len(c.Value) == 64 {
+		return c.Value
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF rejects form posts that come from another site or lack the
+// token matching their cookie
+func checkCSRF(r *http.Request) error {
+	// Checking the origin as well covers clients that drop the cookie's
+	// SameSite attribute
+	if err := checkOrigin(r); err != nil {
+		return err
+	}
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return fmt.Errorf("missing CSRF cookie")
+	}
+	if token := r.PostFormValue(csrfFieldName); subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) != 1 {
+		return fmt.Errorf("CSRF token does not match its cookie")
+	}
+	return nil
+}
+
+// checkOrigin rejects requests a browser sent from a page of another site;
+// browsers send Origin on every cross-origin POST
+func checkOrigin(r *http.Request) error {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return fmt.Errorf("cross-origin request from %q", origin)
+		}
+	}
+	return nil
+}
+
+// requireJSON refuses bodies of the JSON API not labelled application/json.
+// Pages of other sites can only post forms and text/plain without a CORS
+// preflight, so neither reaches a JSON handler.
+func requireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+				writeError(w, ErrUnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxCSVRows bounds a CSV send, which is answered once every row is sent
+	maxCSVRows = 1000
+	// maxCSVBytes bounds the uploaded CSV file
+	maxCSVBytes = 1 << 20
+)
+
+// csvRow is one notification of a CSV send, rendered from its row
+type csvRow struct {
+	line           int
+	tokenID        string
+	title, message string
+	err            string // why the row cannot be sent
+}
+
+// CSVRowResult is what became of one row of a CSV send
+type CSVRowResult struct {
+	Line    int    `json:"line"` // in the file, the header being line 1
+	TokenID string `json:"token_id"`
+	Status  string `json:"status"`          // sent, error, removed, queued or invalid
+	Error   string `json:"error,omitempty"` // why an invalid row was not sent
+}
+
+// parseCSVSend reads a CSV file with a token_id column and one column per
+// placeholder of title and message, and renders both for each row. Problems
+// with the file refuse the whole send; those of a row only skip it.
+func parseCSVSend(file io.Reader, title, message string) ([]csvRow, error) {
+	names, err := placeholders(title, message)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	// Spreadsheets like to start their exports with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	tokenColumn, ok := columns["token_id"]
+	if !ok {
+		return nil, fmt.Errorf("the CSV header needs a token_id column")
+	}
+	for _, name := range names {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("no CSV column for placeholder {{%s}}", name)
+		}
+	}
+
+	var rows []csvRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		if len(rows) == maxCSVRows {
+			return nil, fmt.Errorf("at most %d rows can be sent at once", maxCSVRows)
+		}
+		line, _ := reader.FieldPos(0)
+		row := csvRow{line: line, tokenID: strings.TrimSpace(record[tokenColumn])}
+		rows = append(rows, renderCSVRow(row, record, columns, title, message))
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the CSV file has no rows")
+	}
+	return rows, nil
+}
+
+// renderCSVRow fills the title and message of a row from its record
+func renderCSVRow(row csvRow, record []string, columns map[string]int, title, message string) csvRow {
+	if row.tokenID == "" {
+		row.err = "token_id is empty"
+		return row
+	}
+	if !tokenStore.Registered(row.tokenID) {
+		row.err = "opaque token ID not registered"
+		return row
+	}
+	rendered, message, err := fillPlaceholders(title, message, func(name string) string {
+		return strings.TrimSpace(record[columns[name]])
+	})
+	if err != nil {
+		row.err = err.Error()
+		return row
+	}
+	var ok bool
+	if row.title, ok = notificationTitle(rendered); !ok {
+		row.err = titleTooLong
+		return row
+	}
+	row.message = message
+	return row
+}
+
+// sendCSV sends each valid row's notification, --send-concurrency at a time
+func sendCSV(ctx context.Context, rows []csvRow) ([]CSVRowResult, sendResult) {
+	serverShutdown.sends.Add(1)
+	defer serverShutdown.sends.Done()
+
+	results := make([]CSVRowResult, len(rows))
+	var result sendResult
+	var mu sync.Mutex
+	forEachConcurrently(len(rows), func(i int) {
+		row := rows[i]
+		results[i] = CSVRowResult{Line: row.line, TokenID: row.tokenID, Status: "invalid", Error: row.err}
+		if row.err != "" {
+			mu.Lock()
+			result.ErrorCount++
+			mu.Unlock()
+			return
+		}
+		outcome := sendOne(ctx, row.tokenID, row.title, row.message)
+		results[i].Status = outcome.String()
+		mu.Lock()
+		result.add(outcome)
+		mu.Unlock()
+	})
+	return results, result
+}
+
+// readCSVSend reads the csv file, title and message of a CSV send's
+// multipart form, answering the request itself when they are unusable
+func readCSVSend(w http.ResponseWriter, r *http.Request, isForm bool) (string, string, []csvRow, bool) {
+	logger := loggerFromContext(r.Context())
+
+	// Room for the other fields besides the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxCSVBytes+64<<10)
+	if err := r.ParseMultipartForm(maxCSVBytes); err != nil {
+		logger.Warn("Error parsing CSV send form", "error", err)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, ErrPayloadTooLarge, fmt.Sprintf("The CSV file must be at most %d bytes", maxCSVBytes))
+		} else {
+			writeError(w, ErrInvalidRequest, "Expected a multipart form with a csv file")
+		}
+		return "", "", nil, false
+	}
+	defer r.MultipartForm.RemoveAll()
+	if isForm {
+		if err := checkCSRF(r); err != nil {
+			logger.Warn("Rejected send-csv form", "error", err)
+			writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+			return "", "", nil, false
+		}
+	}
+
+	title, message := r.FormValue("title"), r.FormValue("message")
+	if message == "" {
+		writeError(w, ErrMissingField, "Message is required")
+		return "", "", nil, false
+	}
+	file, _, err := r.FormFile("csv")
+	if err != nil {
+		writeError(w, ErrMissingField, "A csv file is required")
+		return "", "", nil, false
+	}
+	defer file.Close()
+	rows, err := parseCSVSend(file, title, message)
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid CSV send: "+err.Error())
+		return "", "", nil, false
+	}
+	return title, message, rows, true
+}
+
+// runCSVSend sends the rows of a CSV send made by r and records it
+func runCSVSend(r *http.Request, initiatedBy, title, message string, rows []csvRow) ([]CSVRowResult, sendResult) {
+	recordAudit(r, auditSendCSV, sendAuditDetail(title, message, len(rows)))
+	results, result := sendCSV(r.Context(), rows)
+
+	record := result.record(title, message, len(rows))
+	record.Target = "csv"
+	recordSend(r, initiatedBy, record)
+	loggerFromContext(r.Context()).Info("CSV send finished", "rows", len(rows), "sent", result.SentCount, "failed", result.ErrorCount, "removed", result.RemovedCount, "queued", result.QueuedCount)
+	return results, result
+}
+
+// handleSendCSV is the CSV send form of the home page, answered with a page
+// of per-row results
+func handleSendCSV(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	title, message, rows, ok := readCSVSend(w, r, true)
+	if !ok {
+		return
+	}
+	if !sendAllRunning.CompareAndSwap(false, true) {
+		writeError(w, ErrSendInProgress, "A send to many devices is already running")
+		return
+	}
+	defer sendAllRunning.Store(false)
+	results, result := runCSVSend(r, "form", title, message, rows)
+
+	t := pageTemplate(w, r, "csv")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		sendResult
+		Rows []CSVRowResult
+	}{result, results}
+	if err := t.Execute(w, data); err != nil {
+		logger.Error("Error executing template", "error", err)
+	}
+}
+
+// APISendCSVResponse is returned by POST /api/send-csv
+type APISendCSVResponse struct {
+	Success bool `json:"success"` // at least one device was reached
+	sendResult
+	InvalidCount int            `json:"invalid_count"` // rows not sent, counted in error_count too
+	TotalRows    int            `json:"total_rows"`
+	Rows         []CSVRowResult `json:"rows"`
+}
+
+// handleAPISendCSV is the JSON form of /send-csv
+func handleAPISendCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	title, message, rows, ok := readCSVSend(w, r, false)
+	if !ok {
+		return
+	}
+	if !sendAllRunning.CompareAndSwap(false, true) {
+		writeError(w, ErrSendInProgress, "A send to many devices is already running")
+		return
+	}
+	defer sendAllRunning.Store(false)
+	results, result := runCSVSend(r, "api", title, message, rows)
+
+	invalid := 0
+	for _, row := range results {
+		if row.Status == "invalid" {
+			invalid++
+		}
+	}
+	writeJSON(w, r, APISendCSVResponse{Success: result.SentCount > 0, sendResult: result, InvalidCount: invalid, TotalRows: len(rows), Rows: results})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var (
+	// Error reporting configuration
+	sentryDSN         = flag.String("sentry-dsn", "", "Sentry-compatible DSN for error reporting (or SENTRY_DSN); empty disables it")
+	sentryEnvironment = flag.String("sentry-environment", "production", "Environment name attached to reported errors")
+)
+
+// errorReportingEnabled records whether errors are being sent to Sentry
+var errorReportingEnabled bool
+
+// setupErrorReporting initializes the Sentry client when a DSN is configured.
+// Only messages and tags we set explicitly are sent; request bodies, headers
+// and client IPs are never attached. The returned function flushes pending
+// events before exit.
+func setupErrorReporting(dsn, environment string) (func(), error) {
+	if dsn == "" {
+		dsn = os.Getenv("SENTRY_DSN")
+	}
+	if dsn == "" {
+		return func() {}, nil
+	}
+
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		Environment:      environment,
+		Release:          "app-backend@" + version,
+		AttachStacktrace: true,
+		SendDefaultPII:   false,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize error reporting: %v", err)
+	}
+	errorReportingEnabled = true
+
+	return func() { sentry.Flush(2 * time.Second) }, nil
+}
+
+// reportFatal reports a startup failure and flushes, since fatal exits
+// without running deferred functions
+func reportFatal(msg string, args ...any) {
+	if !errorReportingEnabled {
+		return
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetTag("kind", "fatal")
+	hub.Scope().SetLevel(sentry.LevelFatal)
+
+	// Render the slog-style key/value pairs into the message
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	hub.CaptureMessage(b.String())
+	hub.Flush(2 * time.Second)
+}
+
+// serveWithRecovery runs a handler, turning a panic into a logged and reported
+// 500 instead of a stack trace on stderr and a dropped connection
+func serveWithRecovery(w *loggingResponseWriter, r *http.Request, next http.HandlerFunc) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			loggerFromContext(r.Context()).Error("Panic while handling request",
+				"panic", fmt.Sprint(rec),
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+			if errorReportingEnabled {
+				hub := sentry.CurrentHub().Clone()
+				hub.Scope().SetTag("kind", "panic")
+				hub.Scope().SetTag("path", r.URL.Path)
+				hub.Scope().SetTag("request_id", requestIDFromContext(r.Context()))
+				hub.RecoverWithContext(r.Context(), rec)
+			}
+			writeError(w, ErrInternal, "Internal server error")
+		}
+	}()
+	next(w, r)
+}
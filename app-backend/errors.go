@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable identifier returned in every error
+// response. Codes from the notification backend (e.g. DECRYPT_FAILED) are
+// passed through unchanged when they concern the client's request.
+type ErrorCode string
+
+const (
+	ErrMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrInvalidRequest       ErrorCode = "INVALID_REQUEST"        // body could not be read, or a field is invalid
+	ErrInvalidJSON          ErrorCode = "INVALID_JSON"           // body is not valid JSON
+	ErrMissingField         ErrorCode = "MISSING_FIELD"          // a required field is empty
+	ErrPayloadTooLarge      ErrorCode = "PAYLOAD_TOO_LARGE"      // body exceeds the size limit
+	ErrUnsupportedEncoding  ErrorCode = "UNSUPPORTED_ENCODING"   // Content-Encoding other than gzip
+	ErrUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE" // JSON API body without Content-Type application/json
+	ErrNoTokens             ErrorCode = "NO_TOKENS"              // send-all with nothing registered
+	ErrSendInProgress       ErrorCode = "SEND_IN_PROGRESS"       // send-all while another one runs
+	ErrEndpointDisabled     ErrorCode = "ENDPOINT_DISABLED"      // endpoint needs configuration to be enabled
+	ErrCSRFFailed           ErrorCode = "CSRF_FAILED"            // form post without a matching CSRF token
+	ErrUnauthorized         ErrorCode = "UNAUTHORIZED"           // missing or wrong API key or admin login
+	ErrForbidden            ErrorCode = "FORBIDDEN"              // the admin account's role does not allow this
+	ErrAdminNotFound        ErrorCode = "ADMIN_NOT_FOUND"        // no admin account of that name
+	ErrTemplateNotFound     ErrorCode = "TEMPLATE_NOT_FOUND"     // no message template of that name
+	ErrBackendUnavailable   ErrorCode = "BACKEND_UNAVAILABLE"    // notification backend failed or did not answer
+	ErrNoBackend            ErrorCode = "NO_BACKEND"             // no --backends-file backend takes the registration
+	ErrRateLimited          ErrorCode = "RATE_LIMITED"           // too many registrations from one client IP
+	ErrInternal             ErrorCode = "INTERNAL_ERROR"
+
+	// Backend codes meaning an opaque ID will never work again
+	ErrTokenNotFound     ErrorCode = "TOKEN_NOT_FOUND"
+	ErrTokenUnregistered ErrorCode = "TOKEN_UNREGISTERED"
+)
+
+// errorStatus maps this service's own codes to their HTTP status, keeping the
+// statuses these conditions returned before codes existed
+var errorStatus = map[ErrorCode]int{
+	ErrMethodNotAllowed:     http.StatusMethodNotAllowed,
+	ErrInvalidRequest:       http.StatusBadRequest,
+	ErrInvalidJSON:          http.StatusBadRequest,
+	ErrMissingField:         http.StatusBadRequest,
+	ErrPayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	ErrUnsupportedEncoding:  http.StatusUnsupportedMediaType,
+	ErrUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	ErrNoTokens:             http.StatusBadRequest,
+	ErrSendInProgress:       http.StatusConflict,
+	ErrEndpointDisabled:     http.StatusForbidden,
+	ErrCSRFFailed:           http.StatusForbidden,
+	ErrUnauthorized:         http.StatusUnauthorized,
+	ErrForbidden:            http.StatusForbidden,
+	ErrAdminNotFound:        http.StatusNotFound,
+	ErrTemplateNotFound:     http.StatusNotFound,
+	ErrBackendUnavailable:   http.StatusInternalServerError,
+	ErrNoBackend:            http.StatusBadRequest,
+	ErrRateLimited:          http.StatusTooManyRequests,
+	ErrInternal:             http.StatusInternalServerError,
+	ErrTokenNotFound:        http.StatusNotFound, // deleting an unknown opaque ID
+}
+
+// ErrorResponse is the JSON body of every error response, in both backends
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// writeError sends a JSON error response with the status belonging to code
+func writeError(w http.ResponseWriter, code ErrorCode, message string) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeErrorStatus(w, status, code, message)
+}
+
+// writeErrorStatus sends a JSON error response with an explicit status, used
+// when relaying an error from the notification backend
+func writeErrorStatus(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Success: false, Code: code, Message: message})
+}
+
+// readBodyError picks the code for a failed body read
+func readBodyError(err error) ErrorCode {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return ErrPayloadTooLarge
+	}
+	return ErrInvalidRequest
+}
+
+// backendError is a non-200 answer from the notification backend
+type backendError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("backend returned %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// isClientError reports whether the backend rejected the request itself
+// (so the code is worth relaying) rather than failing on its side
+func (e *backendError) isClientError() bool {
+	return e.Status >= 400 && e.Status < 500 && e.Status != http.StatusTooManyRequests
+}
+
+// isStaleToken reports whether the backend says the opaque ID is dead
+func isStaleToken(err error) bool {
+	var be *backendError
+	return errors.As(err, &be) && (be.Code == ErrTokenNotFound || be.Code == ErrTokenUnregistered)
+}
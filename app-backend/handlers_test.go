@@ -1,13 +1,49 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
 )
 
 func TestTokenStore(t *testing.T) {
@@ -24,9 +60,9 @@ func TestTokenStore(t *testing.T) {
 	}
 
 	// Test adding token IDs
-	store.AddTokenID("tokenid1")
-	store.AddTokenID("tokenid2")
-	store.AddTokenID("tokenid3")
+	store.AddTokenID("tokenid1", "")
+	store.AddTokenID("tokenid2", "")
+	store.AddTokenID("tokenid3", "")
 
 	if store.Count() != 3 {
 		t.Errorf("Expected count 3, got %d", store.Count())
@@ -38,7 +74,7 @@ func TestTokenStore(t *testing.T) {
 	}
 
 	// Test duplicate token IDs (should overwrite timestamp, not increase count)
-	store.AddTokenID("tokenid1")
+	store.AddTokenID("tokenid1", "")
 	if store.Count() != 3 {
 		t.Errorf("Expected count 3 after adding duplicate (map overwrites), got %d", store.Count())
 	}
@@ -55,7 +91,7 @@ func TestTokenStoreConcurrency(t *testing.T) {
 	for i := 0; i < numGoroutines; i++ {
 		go func(id int) {
 			for j := 0; j < tokensPerGoroutine; j++ {
-				store.AddTokenID(fmt.Sprintf("tokenid_%d_%d", id, j))
+				store.AddTokenID(fmt.Sprintf("tokenid_%d_%d", id, j), "")
 			}
 			done <- true
 		}(i)
@@ -77,9 +113,207 @@ func TestTokenStoreConcurrency(t *testing.T) {
 	}
 }
 
+func TestTokenStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := OpenTokenStore(path)
+	if err != nil || store.Count() != 0 {
+		t.Fatalf("Expected an empty store for a missing file, got %d %v", store.Count(), err)
+	}
+	store.AddTokenID("tokenid1", "secret1")
+	store.AddTokenID("tokenid2", "secret2")
+	store.RemoveTokenID("tokenid2")
+
+	// A restart sees the same IDs and secrets
+	reopened, err := OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("OpenTokenStore failed: %v", err)
+	}
+	if ids := reopened.GetTokenIDs(); len(ids) != 1 || ids[0] != "tokenid1" || reopened.NotifySecret("tokenid1") != "secret1" {
+		t.Errorf("Expected tokenid1 with its secret after reopening, got %v", ids)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the token file to be private, got %v %v", info.Mode(), err)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenTokenStore(path); err == nil {
+		t.Error("Expected a corrupt token file to be refused")
+	}
+}
+
+// fakeRedis answers the hash commands the shared token store uses and the
+// list commands of the send history, for one password (user:password for an
+// ACL user), and counts connections
+type fakeRedis struct {
+	mu    sync.Mutex
+	hash  map[string]string
+	list  []string
+	conns int
+}
+
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	fr := &fakeRedis{hash: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fr.mu.Lock()
+			fr.conns++
+			fr.mu.Unlock()
+			go fr.serve(conn, password)
+		}
+	}()
+	return fr, ln.Addr().String()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn, password string) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := password == ""
+	for {
+		req, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range req.([]any) {
+			args = append(args, a.(string))
+		}
+		fr.mu.Lock()
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			authed = strings.Join(args[1:], ":") == password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "PING":
+			reply = "+PONG\r\n"
+		case args[0] == "HSET":
+			fr.hash[args[2]] = args[3]
+			reply = ":1\r\n"
+		case args[0] == "HDEL":
+			delete(fr.hash, args[2])
+			reply = ":1\r\n"
+		case args[0] == "HLEN":
+			reply = fmt.Sprintf(":%d\r\n", len(fr.hash))
+		case args[0] == "HGETALL":
+			reply = fmt.Sprintf("*%d\r\n", 2*len(fr.hash))
+			for k, v := range fr.hash {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+			}
+		case args[0] == "LPUSH":
+			fr.list = append([]string{args[2]}, fr.list...)
+			reply = fmt.Sprintf(":%d\r\n", len(fr.list))
+		case args[0] == "LTRIM", args[0] == "LRANGE":
+			stop, _ := strconv.Atoi(args[3])
+			items := fr.list[:min(stop+1, len(fr.list))]
+			if args[0] == "LTRIM" {
+				fr.list = items
+				reply = "+OK\r\n"
+				break
+			}
+			reply = fmt.Sprintf("*%d\r\n", len(items))
+			for _, v := range items {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		fr.mu.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+func TestSharedTokenStore(t *testing.T) {
+	fr, addr := startFakeRedis(t, "s3cret")
+	replica := func(password string) (*TokenStore, error) {
+		client, err := newRedisClient("redis://:"+password+"@"+addr, time.Second)
+		if err != nil {
+			t.Fatalf("newRedisClient failed: %v", err)
+		}
+		return NewSharedTokenStore(context.Background(), &redisTokenIDs{client: client, key: "tokens"})
+	}
+	if _, err := replica("wrong"); err == nil {
+		t.Fatal("Expected a wrong password to be refused")
+	}
+	a, err := replica("s3cret")
+	if err != nil {
+		t.Fatalf("NewSharedTokenStore failed: %v", err)
+	}
+	b, _ := replica("s3cret")
+
+	// A registration through one replica can be sent to from the other
+	a.AddTokenID("tokenid1", "secret1")
+	if ids := b.GetTokenIDs(); len(ids) != 1 || ids[0] != "tokenid1" || b.NotifySecret("tokenid1") != "secret1" {
+		t.Errorf("Expected the other replica to see tokenid1, got %v", ids)
+	}
+	b.RemoveTokenID("tokenid1")
+	if a.Count() != 0 || len(a.GetTokenIDs()) != 0 {
+		t.Errorf("Expected the removal to reach the first replica, got %v", a.GetTokenIDs())
+	}
+
+	// A command on a lost connection falls back to the local copy, and the
+	// next one redials
+	a.AddTokenID("tokenid2", "")
+	a.shared.(*redisTokenIDs).client.conn.Close()
+	if n := a.Count(); n != 1 {
+		t.Errorf("Expected the local count, got %d", n)
+	}
+	if n := a.Count(); n != 1 {
+		t.Errorf("Expected the shared count after reconnecting, got %d", n)
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.conns != 4 {
+		t.Errorf("Expected connections for the refused replica, both others and the redial, got %d", fr.conns)
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	c, err := newRedisClient("rediss://:pw@cache.internal/2", time.Second)
+	if err != nil || c.addr != "cache.internal:6379" || c.username != "" || c.password != "pw" || c.db != 2 || c.tls == nil {
+		t.Errorf("Unexpected client %+v %v", c, err)
+	}
+
+	// An ACL user authenticates with its name and password
+	_, addr := startFakeRedis(t, "app:s3cret")
+	for rawURL, ok := range map[string]bool{
+		"redis://app:s3cret@" + addr:   true,
+		"redis://:s3cret@" + addr:      false,
+		"redis://other:s3cret@" + addr: false,
+	} {
+		c, err := newRedisClient(rawURL, time.Second)
+		if err != nil {
+			t.Fatalf("newRedisClient failed: %v", err)
+		}
+		if _, err := c.do(context.Background(), "PING"); (err == nil) != ok {
+			t.Errorf("%s: expected authenticated %v, got %v", rawURL, ok, err)
+		}
+	}
+	for _, bad := range []string{"http://cache:6379", "redis:///0", "redis://cache/x"} {
+		if _, err := newRedisClient(bad, time.Second); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
 func TestHandleRegister(t *testing.T) {
 	// Reset global token store
 	tokenStore = NewTokenStore()
+	retryQueue = &RetryQueue{}
 
 	// Note: These tests will fail without a running notification-backend
 	// since the app-backend now requires the backend to return an opaque ID
@@ -92,10 +326,10 @@ func TestHandleRegister(t *testing.T) {
 		expectedStatus int
 	}{
 		{
-			name:           "Valid registration (will fail due to no backend)",
+			name:           "Valid registration (queued for retry as there is no backend)",
 			method:         "POST",
 			body:           `{"encrypted_data":"test_encrypted_token","platform":"android"}`,
-			expectedStatus: http.StatusInternalServerError, // Changed expectation
+			expectedStatus: http.StatusAccepted,
 		},
 		{
 			name:           "Invalid method",
@@ -141,8 +375,8 @@ func TestHandleRegister(t *testing.T) {
 func TestHandleHome(t *testing.T) {
 	// Reset global token store
 	tokenStore = NewTokenStore()
-	tokenStore.AddTokenID("test_tokenid1")
-	tokenStore.AddTokenID("test_tokenid2")
+	tokenStore.AddTokenID("test_tokenid1", "")
+	tokenStore.AddTokenID("test_tokenid2", "")
 
 	req := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
@@ -180,13 +414,36 @@ func TestHandleSendAllInvalidMethod(t *testing.T) {
 	}
 }
 
+// testCSRFToken is the CSRF cookie of the browser in formRequest
+const testCSRFToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// formRequest posts a form the way the home page does, with its CSRF token
+func formRequest(path, form string) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form+"&"+csrfFieldName+"="+testCSRFToken))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	return req
+}
+
+// sendAll posts the send-all form and returns the progress of the send it
+// starts, once finished
+func sendAll(t *testing.T, form string) *sendProgress {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleSendAll(w, formRequest("/send-all", form))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("Expected a redirect home, got %d %q: %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	serverShutdown.sends.Wait()
+	send, _ := live.snapshot()
+	return send
+}
+
 func TestHandleSendAllNoTokens(t *testing.T) {
 	// Reset global token store to empty
 	tokenStore = NewTokenStore()
 
-	req := httptest.NewRequest("POST", "/send-all", nil)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Form = map[string][]string{"message": {"test message"}}
+	req := formRequest("/send-all", "message=test+message")
 
 	w := httptest.NewRecorder()
 
@@ -197,13 +454,58 @@ func TestHandleSendAllNoTokens(t *testing.T) {
 	}
 }
 
+func TestSendFormsNeedCSRFToken(t *testing.T) {
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("test_tokenid", "")
+
+	// The home page issues the cookie and puts its value in the forms
+	w := httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName || !cookies[0].Secure || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Expected a strict, secure CSRF cookie, got %+v", cookies)
+	}
+	if !strings.Contains(w.Body.String(), `name="csrf_token" value="`+cookies[0].Value+`"`) {
+		t.Error("Expected the form to carry the cookie's token")
+	}
+	// A returning browser keeps its token
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handleHome(w, req)
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Expected no new cookie for a browser that has one")
+	}
+
+	for name, req := range map[string]*http.Request{
+		"no cookie":   httptest.NewRequest("POST", "/send-all", strings.NewReader("message=hi&csrf_token="+testCSRFToken)),
+		"wrong token": formRequest("/send-all", "message=hi&csrf_token=forged"), // the first value counts
+		"no token": func() *http.Request {
+			req := httptest.NewRequest("POST", "/send-all", strings.NewReader("message=hi"))
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+			return req
+		}(),
+		"other origin": func() *http.Request {
+			req := formRequest("/send-all", "message=hi")
+			req.Header.Set("Origin", "https://attacker.example")
+			return req
+		}(),
+	} {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleSendAll(w, req)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "CSRF_FAILED") {
+			t.Errorf("%s: expected CSRF_FAILED, got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+}
+
 func TestHandleSendAllNoMessage(t *testing.T) {
 	// Reset global token store and add a token ID
 	tokenStore = NewTokenStore()
-	tokenStore.AddTokenID("test_tokenid")
+	tokenStore.AddTokenID("test_tokenid", "")
 
-	req := httptest.NewRequest("POST", "/send-all", nil)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req := formRequest("/send-all", "")
 
 	w := httptest.NewRecorder()
 
@@ -213,3 +515,2377 @@ func TestHandleSendAllNoMessage(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
 	}
 }
+
+func TestHandleSendAllDropsStaleTokens(t *testing.T) {
+	// The backend knows "live" and reports the other IDs with stable error codes
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.TokenID {
+		case "live":
+			w.Write([]byte(`{"success": true}`))
+		case "gone":
+			writeErrorStatus(w, http.StatusBadRequest, ErrTokenNotFound, "Token ID not found")
+		case "uninstalled":
+			writeErrorStatus(w, http.StatusInternalServerError, ErrTokenUnregistered, "Failed to send notification")
+		default:
+			writeErrorStatus(w, http.StatusInternalServerError, "FCM_UNAVAILABLE", "Failed to send notification")
+		}
+	}))
+	defer backend.Close()
+
+	originalURL := *notificationBackendURL
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL = originalURL }()
+
+	tokenStore = NewTokenStore()
+	retryQueue = &RetryQueue{}
+	for _, id := range []string{"live", "gone", "uninstalled", "flaky"} {
+		tokenStore.AddTokenID(id, "")
+	}
+
+	send := sendAll(t, "message=hi")
+	if send.SentCount != 1 || send.ErrorCount != 2 || send.RemovedCount != 2 || send.QueuedCount != 1 || !send.Done {
+		t.Errorf("Unexpected send result %+v", send)
+	}
+	// Only the ID the backend declared dead is dropped; transient failures are kept, and retried
+	ids := tokenStore.GetTokenIDs()
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "flaky,live" {
+		t.Errorf("Expected flaky and live to remain, got %v", ids)
+	}
+	if retryQueue.Len() != 1 {
+		t.Errorf("Expected the send to flaky queued, got %d queued", retryQueue.Len())
+	}
+}
+
+func TestSendAllInBackground(t *testing.T) {
+	// The backend holds every send until released, counting how many overlap
+	var inFlight, peak atomic.Int32
+	arrived, release := make(chan struct{}, 10), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for old := peak.Load(); n > old && !peak.CompareAndSwap(old, n); old = peak.Load() {
+		}
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+
+	originalURL, originalConcurrency, originalKey := *notificationBackendURL, *sendConcurrency, adminAPIKey
+	*notificationBackendURL, *sendConcurrency = backend.URL, 2
+	defer func() {
+		*notificationBackendURL, *sendConcurrency, adminAPIKey = originalURL, originalConcurrency, originalKey
+	}()
+	setupAdminAPI("admin")
+
+	tokenStore = NewTokenStore()
+	for _, id := range []string{"a", "b", "c"} {
+		tokenStore.AddTokenID(id, "")
+	}
+
+	w := httptest.NewRecorder()
+	handleSendAll(w, formRequest("/send-all", "message=hi"))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("Expected an immediate redirect home, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	<-arrived
+	<-arrived
+
+	// A double click, or a script, does not send everything twice
+	w = httptest.NewRecorder()
+	handleSendAll(w, formRequest("/send-all", "message=hi"))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), string(ErrSendInProgress)) {
+		t.Errorf("Expected SEND_IN_PROGRESS, got %d %s", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("POST", "/api/send", strings.NewReader(`{"message": "hi"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleSender, handleAPISend)(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected the API send refused while the form send runs, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "Sending: 0 of 3 done") {
+		t.Errorf("Expected the running send on the home page, got %s", body)
+	}
+
+	close(release)
+	serverShutdown.sends.Wait()
+	if got := peak.Load(); got != 2 {
+		t.Errorf("Expected two sends at a time, got %d", got)
+	}
+	w = httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "Last send: 3 of 3 done, 3 sent, 0 failed") {
+		t.Errorf("Expected the finished send on the home page, got %s", body)
+	}
+}
+
+func TestJSONAPI(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.TokenID == "gone" {
+			writeErrorStatus(w, http.StatusBadRequest, ErrTokenNotFound, "Token ID not found")
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL, originalKey := *notificationBackendURL, adminAPIKey
+	defer func() { *notificationBackendURL, adminAPIKey = originalURL, originalKey }()
+	*notificationBackendURL = backend.URL
+
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("live", "")
+	tokenStore.AddTokenID("gone", "")
+
+	call := func(handler http.HandlerFunc, method, body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		requireAPIRole(RoleAdmin, handler)(w, req)
+		return w
+	}
+
+	setupAdminAPI("")
+	if w := call(handleAPIStatus, "GET", "", "admin"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "ENDPOINT_DISABLED") {
+		t.Errorf("Expected the API disabled without a key, got %d %s", w.Code, w.Body.String())
+	}
+	setupAdminAPI("admin")
+	if w := call(handleAPIStatus, "GET", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong key, got %d", w.Code)
+	}
+
+	var status APIStatusResponse
+	json.Unmarshal(call(handleAPIStatus, "GET", "", "admin").Body.Bytes(), &status)
+	if !status.Success || status.TokenCount != 2 || status.Persistent {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	var tokens APITokensResponse
+	json.Unmarshal(call(handleAPITokens, "GET", "", "admin").Body.Bytes(), &tokens)
+	if tokens.Count != 2 || tokens.Tokens[0].TokenID != "live" || tokens.Tokens[0].RegisteredAt.IsZero() {
+		t.Errorf("Expected both IDs oldest first, got %+v", tokens)
+	}
+
+	if w := call(handleAPISend, "POST", `{}`, "admin"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected MISSING_FIELD without a message, got %d", w.Code)
+	}
+	w := call(handleAPISend, "POST", `{"message": "hi"}`, "admin")
+	var sent APISendResponse
+	json.Unmarshal(w.Body.Bytes(), &sent)
+	if !sent.Success || sent.SentCount != 1 || sent.ErrorCount != 1 || sent.RemovedCount != 1 || sent.TotalTokens != 2 {
+		t.Errorf("Unexpected send result %s", w.Body.String())
+	}
+	if tokenStore.Count() != 1 {
+		t.Errorf("Expected the stale ID dropped, got %v", tokenStore.GetTokenIDs())
+	}
+}
+
+// testTokenID is a well-formed version 1 opaque ID
+var testTokenID = apitest.OpaqueID(1)
+
+// useSigningKey trusts the shared test key pair as the backend's for the test
+func useSigningKey(t *testing.T) *rsa.PrivateKey {
+	key := apitest.PrivateKey()
+	original := publicKey
+	publicKey = &key.PublicKey
+	t.Cleanup(func() { publicKey = original })
+	return key
+}
+
+// signRegistration signs a registration the way the notification backend does
+func signRegistration(t *testing.T, key *rsa.PrivateKey, tokenID string, issuedAt int64) string {
+	digest := sha256.Sum256(fmt.Appendf(nil, "remote-notification registration v1\n%s\n%d", tokenID, issuedAt))
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestSendTitle(t *testing.T) {
+	var titles []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		titles = append(titles, req.Title)
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL, originalKey := *notificationBackendURL, adminAPIKey
+	defer func() { *notificationBackendURL, adminAPIKey = originalURL, originalKey }()
+	*notificationBackendURL = backend.URL
+	setupAdminAPI("admin")
+
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("tokenid", "")
+
+	sendAll(t, "message=hi&title=Order+shipped")
+	sendAll(t, "message=hi&title=+")
+	req := httptest.NewRequest("POST", "/api/send", strings.NewReader(`{"title": "From a script", "message": "hi"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	requireAPIRole(RoleSender, handleAPISend)(httptest.NewRecorder(), req)
+	if want := []string{"Order shipped", defaultTitle, "From a script"}; !slices.Equal(titles, want) {
+		t.Errorf("Expected titles %q, got %q", want, titles)
+	}
+
+	w := httptest.NewRecorder()
+	handleSendAll(w, formRequest("/send-all", "message=hi&title="+strings.Repeat("x", maxTitleLength+1)))
+	if w.Code != http.StatusBadRequest || len(titles) != 3 {
+		t.Errorf("Expected an overlong title refused, got %d", w.Code)
+	}
+}
+
+func TestSendHistory(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL, originalKey, originalHistory, originalProxies := *notificationBackendURL, adminAPIKey, sendHistory, trustedProxies
+	defer func() {
+		*notificationBackendURL, adminAPIKey, sendHistory, trustedProxies = originalURL, originalKey, originalHistory, originalProxies
+	}()
+	*notificationBackendURL = backend.URL
+	setupAdminAPI("admin")
+	setupTrustedProxies("192.0.2.1") // httptest's RemoteAddr
+
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := OpenSendHistory(path)
+	if err != nil {
+		t.Fatalf("OpenSendHistory failed: %v", err)
+	}
+	sendHistory = h
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("a", "")
+	tokenStore.AddTokenID("b", "")
+
+	req := formRequest("/send-all", "message=first")
+	req.Header.Set("X-Forwarded-For", "192.0.2.7")
+	handleSendAll(httptest.NewRecorder(), req)
+	serverShutdown.sends.Wait()
+	req = httptest.NewRequest("POST", "/api/send", strings.NewReader(`{"title": "T", "message": "second"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	requireAPIRole(RoleSender, handleAPISend)(httptest.NewRecorder(), req)
+
+	// A restart finds the sends again
+	reopened, err := OpenSendHistory(path)
+	if err != nil {
+		t.Fatalf("Reopening the history failed: %v", err)
+	}
+	records, _ := reopened.Recent(context.Background(), 10)
+	if len(records) != 2 || records[0].Message != "second" || records[0].InitiatedBy != "api" || records[0].Title != "T" {
+		t.Fatalf("Expected both sends newest first, got %+v", records)
+	}
+	if first := records[1]; first.InitiatedBy != "form" || first.ClientIP != "192.0.2.7" || first.TargetCount != 2 || first.SentCount != 2 || first.Title != defaultTitle {
+		t.Errorf("Unexpected record of the form send: %+v", first)
+	}
+
+	req = httptest.NewRequest("GET", "/api/history?limit=1", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	requireAPIRole(RoleViewer, handleAPIHistory)(w, req)
+	var resp APIHistoryResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Count != 1 || resp.Sends[0].Message != "second" {
+		t.Errorf("Expected only the newest send, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleHistory(w, httptest.NewRequest("GET", "/history?limit=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid limit refused, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleHistory(w, httptest.NewRequest("GET", "/history", nil))
+	if !strings.Contains(w.Body.String(), "second") || !strings.Contains(w.Body.String(), "192.0.2.7") {
+		t.Errorf("Expected the sends on the history page, got %s", w.Body.String())
+	}
+
+	h.file = "" // spare the disk a thousand rewrites
+	for i := 0; i < maxHistory; i++ {
+		h.Add(context.Background(), SendRecord{Message: "filler"})
+	}
+	if records, _ := h.Recent(context.Background(), 2*maxHistory); len(records) != maxHistory || records[len(records)-1].Message != "filler" {
+		t.Errorf("Expected the history capped at %d, got %d", maxHistory, len(records))
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	originalProxies := trustedProxies
+	defer func() { trustedProxies = originalProxies }()
+	if err := setupTrustedProxies("10.0.0.0/8, 192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remoteAddr, forwardedFor, realIP, want string
+	}{
+		// Anyone else's headers are their own invention
+		{"198.51.100.9:4711", "203.0.113.1", "203.0.113.2", "198.51.100.9"},
+		{"[2001:db8::1]:4711", "203.0.113.1", "", "2001:db8::1"},
+		// A trusted proxy names the peer it got the request from
+		{"192.0.2.1:1234", "203.0.113.1", "", "203.0.113.1"},
+		{"192.0.2.1:1234", "", "203.0.113.2", "203.0.113.2"},
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		// Hops a client prepends are skipped, and so are the trusted proxies
+		{"10.1.2.3:1234", "6.6.6.6, 203.0.113.1, 10.9.9.9", "", "203.0.113.1"},
+		{"10.1.2.3:1234", "10.5.5.5, 10.9.9.9", "", "10.5.5.5"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := getClientIP(req); got != tc.want {
+			t.Errorf("From %s forwarding %q: expected %s, got %s", tc.remoteAddr, tc.forwardedFor, tc.want, got)
+		}
+	}
+	if err := setupTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected an invalid range refused")
+	}
+
+	// A client making up a new address per registration still has one bucket
+	trustedProxies = nil
+	originalLimiter := registerLimiter
+	defer func() { registerLimiter = originalLimiter }()
+	registerLimiter = newRateLimiter(0.1, 1)
+	handler := limitRegistrations(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	for i, want := range []int{http.StatusTeapot, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/register", strings.NewReader("{}"))
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != want {
+			t.Errorf("Expected registration %d answered %d with a spoofed X-Forwarded-For, got %d", i, want, w.Code)
+		}
+	}
+}
+
+func TestSharedSendHistory(t *testing.T) {
+	_, addr := startFakeRedis(t, "")
+	client, err := newRedisClient("redis://"+addr, time.Second)
+	if err != nil {
+		t.Fatalf("newRedisClient failed: %v", err)
+	}
+	// Two replicas see each other's sends
+	a := &SendHistory{shared: &redisHistory{client: client, key: "history"}}
+	b := &SendHistory{shared: &redisHistory{client: client, key: "history"}}
+	a.Add(context.Background(), SendRecord{Message: "from a"})
+	b.Add(context.Background(), SendRecord{Message: "from b"})
+	records, err := a.Recent(context.Background(), 10)
+	if err != nil || len(records) != 2 || records[0].Message != "from b" {
+		t.Errorf("Expected both sends newest first, got %+v, %v", records, err)
+	}
+}
+
+func TestTokenManagement(t *testing.T) {
+	originalKey := adminAPIKey
+	defer func() { adminAPIKey = originalKey }()
+	setupAdminAPI("admin")
+
+	tokenStore = NewTokenStore()
+	for i := range 5 {
+		tokenStore.AddTokenID(fmt.Sprintf("token%d", i), "")
+	}
+	// token0 and token1 were registered long ago
+	for _, id := range []string{"token0", "token1"} {
+		stored := tokenStore.tokenIDs[id]
+		stored.registeredAt = time.Now().AddDate(0, 0, -100)
+		tokenStore.tokenIDs[id] = stored
+	}
+
+	w := httptest.NewRecorder()
+	handleTokens(w, httptest.NewRequest("GET", "/tokens?page=2&per_page=2", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "token2") || strings.Contains(body, "token0") || !strings.Contains(body, "Page 2 of 3") {
+		t.Errorf("Expected the second page of two IDs, got %d %s", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handleTokens(w, httptest.NewRequest("GET", "/tokens?per_page=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid per_page refused, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/tokens?page=3&per_page=2", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleViewer, handleAPITokens)(w, req)
+	var tokens APITokensResponse
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if tokens.Count != 5 || tokens.Page != 3 || len(tokens.Tokens) != 1 || tokens.Tokens[0].TokenID != "token4" {
+		t.Errorf("Expected the last page of one ID, got %s", w.Body.String())
+	}
+
+	// The export has every ID, oldest first
+	w = httptest.NewRecorder()
+	handleTokenExport(w, httptest.NewRequest("GET", "/tokens/export", nil))
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(rows) != 6 || rows[0][0] != "token_id" || rows[1][0] != "token0" || rows[5][0] != "token4" {
+		t.Fatalf("Expected a CSV row per ID after the header, got %v %v", rows, err)
+	}
+	if _, err := time.Parse(time.RFC3339, rows[1][1]); err != nil || !strings.Contains(w.Header().Get("Content-Disposition"), ".csv") {
+		t.Errorf("Expected RFC 3339 times in a CSV download, got %q and %q", rows[1][1], w.Header().Get("Content-Disposition"))
+	}
+	req = httptest.NewRequest("GET", "/api/tokens/export?format=json", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleViewer, handleTokenExport)(w, req)
+	var export APITokensExport
+	json.Unmarshal(w.Body.Bytes(), &export)
+	if export.Count != 5 || len(export.Tokens) != 5 || export.Tokens[4].TokenID != "token4" || export.ExportedAt.IsZero() {
+		t.Errorf("Expected every ID in the JSON export, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleTokenExport(w, httptest.NewRequest("GET", "/tokens/export?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown format refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleTokenDelete(w, formRequest("/tokens/delete", "token_id=token4"))
+	if w.Code != http.StatusSeeOther || tokenStore.Registered("token4") {
+		t.Errorf("Expected token4 deleted, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleTokenDelete(w, formRequest("/tokens/delete", "token_id=token4"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting an unknown ID to be a 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleTokenDelete(w, httptest.NewRequest("POST", "/tokens/delete", strings.NewReader("token_id=token3")))
+	if w.Code != http.StatusForbidden || !tokenStore.Registered("token3") {
+		t.Errorf("Expected a delete without the CSRF token refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleTokenRemoveStale(w, formRequest("/tokens/remove-stale", "older_than_days=30"))
+	if loc := w.Header().Get("Location"); loc != "/tokens?removed=2" || tokenStore.Registered("token0") || tokenStore.Count() != 2 {
+		t.Errorf("Expected the two old IDs removed, got %q and %d left", loc, tokenStore.Count())
+	}
+
+	req = httptest.NewRequest("POST", "/api/tokens/remove-stale", strings.NewReader(`{"older_than_days": 0}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleAdmin, handleAPIRemoveStale)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected older_than_days 0 refused, got %d", w.Code)
+	}
+	req = httptest.NewRequest("DELETE", "/api/tokens/token3", nil)
+	req.SetPathValue("id", "token3")
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleAdmin, handleAPIToken)(w, req)
+	if w.Code != http.StatusOK || tokenStore.Registered("token3") {
+		t.Errorf("Expected token3 deleted through the API, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLiveEvents(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL := *notificationBackendURL
+	defer func() { *notificationBackendURL = originalURL }()
+	*notificationBackendURL = backend.URL
+
+	tokenStore = NewTokenStore()
+	live = &liveUpdates{changed: make(chan struct{})}
+	// Through the middleware and compression, as in production
+	server := httptest.NewServer(gzipHandler(loggingMiddleware(handleEvents)))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open the stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+
+	// Setting Accept-Encoding ourselves turns off the client's transparent decompression
+	body, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzip stream: %v", err)
+	}
+
+	statuses := make(chan LiveStatus)
+	go func() {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var status LiveStatus
+				json.Unmarshal([]byte(data), &status)
+				statuses <- status
+			}
+		}
+	}()
+	next := func(until func(LiveStatus) bool) LiveStatus {
+		t.Helper()
+		for {
+			select {
+			case status := <-statuses:
+				if until(status) {
+					return status
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for an event")
+			}
+		}
+	}
+
+	next(func(s LiveStatus) bool { return s.TokenCount == 0 })
+	tokenStore.AddTokenID("a", "")
+	tokenStore.AddTokenID("b", "")
+	next(func(s LiveStatus) bool { return s.TokenCount == 2 })
+
+	sendToAll(context.Background(), tokenStore.GetTokenIDs(), defaultTitle, "hi")
+	status := next(func(s LiveStatus) bool { return s.Send != nil && s.Send.Done })
+	if status.Send.SentCount != 2 || status.Send.TotalTokens != 2 {
+		t.Errorf("Expected the finished send of two, got %+v", status.Send)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	// A slow backend, so the shutdown catches the send mid-way
+	notified := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{"success": true}`))
+		notified <- struct{}{}
+	}))
+	defer backend.Close()
+
+	originalURL, originalQueue, originalShutdown, originalConcurrency := *notificationBackendURL, retryQueue, serverShutdown, *sendConcurrency
+	*notificationBackendURL, retryQueue, serverShutdown, *sendConcurrency = backend.URL, &RetryQueue{}, newShutdownState(), 1
+	defer func() {
+		*notificationBackendURL, retryQueue, serverShutdown, *sendConcurrency = originalURL, originalQueue, originalShutdown, originalConcurrency
+	}()
+
+	tokenStore = NewTokenStore()
+	for i := range 10 {
+		tokenStore.AddTokenID(fmt.Sprintf("id%d", i), "")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send-all", handleSendAll)
+	mux.HandleFunc("/events", handleEvents)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newHTTPServer(mux)
+	go server.Serve(listener)
+	baseURL := "http://" + listener.Addr().String()
+
+	events, err := http.Get(baseURL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open the event stream: %v", err)
+	}
+	defer events.Body.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req := formRequest("/send-all", "message=hi")
+	req.URL, _ = url.Parse(baseURL + "/send-all")
+	req.RequestURI = ""
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	resp.Body.Close()
+	<-notified
+
+	// The send outlives its request, and the shutdown waits for it
+	shutdown(server, 150*time.Millisecond)
+	send, _ := live.snapshot()
+	if send == nil || send.SentCount == 0 || send.QueuedCount == 0 || send.SentCount+send.QueuedCount != 10 || send.QueuedCount != retryQueue.Len() {
+		t.Errorf("Expected the send split between sent and queued, got %+v with %d queued", send, retryQueue.Len())
+	}
+	// The event stream was closed rather than holding up the shutdown
+	if _, err := io.ReadAll(events.Body); err != nil {
+		t.Errorf("Expected the event stream to end cleanly, got %v", err)
+	}
+}
+
+func TestFillPlaceholders(t *testing.T) {
+	vars := map[string]string{"day": "Sunday", "hours": "2"}
+	variable := func(name string) string { return vars[name] }
+	title, message, err := fillPlaceholders("Maintenance {{day}}", "Down for {{ hours }}h on {{day}}", variable)
+	if err != nil || title != "Maintenance Sunday" || message != "Down for 2h on Sunday" {
+		t.Errorf("Unexpected fill %q %q %v", title, message, err)
+	}
+	if _, _, err := fillPlaceholders("", "Back at {{time}}", variable); err == nil {
+		t.Error("Expected a placeholder without a value refused")
+	}
+	if _, _, err := fillPlaceholders("", "Down {{day}", variable); err == nil {
+		t.Error("Expected a malformed placeholder refused")
+	}
+	if _, message, err := fillPlaceholders("", "No placeholders", variable); err != nil || message != "No placeholders" {
+		t.Errorf("Expected plain text unchanged, got %q %v", message, err)
+	}
+}
+
+func TestMessageTemplates(t *testing.T) {
+	var bodies []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		bodies = append(bodies, req.Title+"|"+req.Body)
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL, originalTemplates := *notificationBackendURL, messageTemplates
+	defer func() { *notificationBackendURL, messageTemplates = originalURL, originalTemplates }()
+	*notificationBackendURL = backend.URL
+
+	path := filepath.Join(t.TempDir(), "templates.json")
+	mt, err := OpenMessageTemplates(path)
+	if err != nil {
+		t.Fatalf("OpenMessageTemplates failed: %v", err)
+	}
+	messageTemplates = mt
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("tokenid", "")
+
+	w := httptest.NewRecorder()
+	handleSaveMessageTemplate(w, formRequest("/message-templates", "template_name=maintenance&title=Maintenance+{{day}}&message=Down+for+{{hours}}h"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the template saved, got %d %s", w.Code, w.Body.String())
+	}
+	for form, want := range map[string]int{
+		"template_name=bad+name&message=hi":   http.StatusBadRequest,
+		"template_name=broken&message={{oops": http.StatusBadRequest,
+	} {
+		w = httptest.NewRecorder()
+		handleSaveMessageTemplate(w, formRequest("/message-templates", form))
+		if w.Code != want {
+			t.Errorf("Expected %d for %q, got %d", want, form, w.Code)
+		}
+	}
+
+	// A restart finds the template again, and the home page offers it
+	reopened, err := OpenMessageTemplates(path)
+	if err != nil {
+		t.Fatalf("Reopening the templates failed: %v", err)
+	}
+	templates, _ := reopened.List(context.Background())
+	if len(templates) != 1 || templates[0].Message != "Down for {{hours}}h" || !slices.Equal(templates[0].Variables, []string{"day", "hours"}) {
+		t.Fatalf("Unexpected templates %+v", templates)
+	}
+	w = httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, `data-message="Down for {{hours}}h"`) || !strings.Contains(body, "day, hours") {
+		t.Errorf("Expected the template on the home page, got %s", body)
+	}
+
+	sendAll(t, "title=Maintenance+{{day}}&message=Down+for+{{hours}}h&var_day=Sunday&var_hours=2")
+	w = httptest.NewRecorder()
+	handleSendAll(w, formRequest("/send-all", "title=Maintenance+{{day}}&message=Down+for+{{hours}}h&var_day=Sunday"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a send with a placeholder left empty refused, got %d", w.Code)
+	}
+	if want := []string{"Maintenance Sunday|Down for 2h"}; !slices.Equal(bodies, want) {
+		t.Errorf("Expected %q sent, got %q", want, bodies)
+	}
+
+	w = httptest.NewRecorder()
+	handleDeleteMessageTemplate(w, formRequest("/message-templates/delete", "template_name=maintenance"))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Expected the template deleted, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleDeleteMessageTemplate(w, formRequest("/message-templates/delete", "template_name=maintenance"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting it again to be a 404, got %d", w.Code)
+	}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	key := useSigningKey(t)
+	now := time.Now().Unix()
+	signature := signRegistration(t, key, "tokenid", now)
+
+	if err := verifyRegistration("tokenid", now, signature); err != nil {
+		t.Errorf("Expected a fresh signature to verify, got %v", err)
+	}
+	if err := verifyRegistration("otherid", now, signature); err == nil {
+		t.Error("Expected a signature over another token ID to fail")
+	}
+	if err := verifyRegistration("tokenid", now, ""); err == nil {
+		t.Error("Expected an unsigned registration to fail")
+	}
+	old := now - int64(time.Hour.Seconds())
+	if err := verifyRegistration("tokenid", old, signRegistration(t, key, "tokenid", old)); err == nil {
+		t.Error("Expected an hour old registration to fail")
+	}
+	otherKey := apitest.OtherPrivateKey()
+	if err := verifyRegistration("tokenid", now, signRegistration(t, otherKey, "tokenid", now)); err == nil {
+		t.Error("Expected a signature by another key to fail")
+	}
+}
+
+func TestNotifySecretForwarded(t *testing.T) {
+	key := useSigningKey(t)
+	// The backend issues a secret on registration and insists on it for sends
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/register":
+			now := time.Now().Unix()
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": true, "token_id": testTokenID, "notify_secret": "s3cret",
+				"issued_at": now, "signature": signRegistration(t, key, testTokenID, now),
+			})
+		case "/v1/notify":
+			var req api.NotificationRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.NotifySecret != "s3cret" {
+				writeErrorStatus(w, http.StatusUnauthorized, "UNAUTHORIZED", "Missing or invalid notify secret")
+				return
+			}
+			w.Write([]byte(`{"success": true}`))
+		}
+	}))
+	defer backend.Close()
+
+	originalURL := *notificationBackendURL
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL = originalURL }()
+
+	tokenStore = NewTokenStore()
+	w := httptest.NewRecorder()
+	handleRegister(w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"encrypted_data": "abc", "platform": "android"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected registration to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if got := tokenStore.NotifySecret(testTokenID); got != "s3cret" {
+		t.Errorf("Expected the notify secret to be stored, got %q", got)
+	}
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Error("Expected the notify secret not to be passed on to the client")
+	}
+	var resp struct {
+		TokenID   string `json:"token_id"`
+		IssuedAt  int64  `json:"issued_at"`
+		Signature string `json:"signature"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if err := verifyRegistration(resp.TokenID, resp.IssuedAt, resp.Signature); err != nil {
+		t.Errorf("Expected the client to get a verifiable registration, got %v", err)
+	}
+
+	if send := sendAll(t, "message=hi"); send.SentCount != 1 || send.ErrorCount != 0 {
+		t.Errorf("Expected the send to carry the notify secret, got %+v", send)
+	}
+}
+
+func TestRegisterForwardsChallenge(t *testing.T) {
+	key := useSigningKey(t)
+	originalURL, originalQueue := *notificationBackendURL, retryQueue
+	defer func() { *notificationBackendURL, retryQueue = originalURL, originalQueue }()
+	retryQueue = &RetryQueue{}
+	tokenStore = NewTokenStore()
+
+	// Challenges are opaque here but for the expiry they lead with
+	challengeExpiring := func(in time.Duration) string {
+		b := make([]byte, 56)
+		binary.BigEndian.PutUint64(b, uint64(time.Now().Add(in).Unix()))
+		rand.Read(b[8:])
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	challenge := challengeExpiring(5 * time.Minute)
+	var registered api.TokenRegistration
+	var down atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/register/challenge":
+			json.NewEncoder(w).Encode(api.ChallengeResponse{Success: true, Challenge: challenge, ExpiresIn: 300})
+		case "/v1/register":
+			if down.Load() {
+				writeErrorStatus(w, http.StatusServiceUnavailable, "STORAGE_UNAVAILABLE", "Storage unavailable")
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&registered)
+			now := time.Now().Unix()
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": true, "token_id": testTokenID,
+				"issued_at": now, "signature": signRegistration(t, key, testTokenID, now),
+			})
+		}
+	}))
+	defer backend.Close()
+	*notificationBackendURL = backend.URL
+
+	w := httptest.NewRecorder()
+	handleRegisterChallenge(w, httptest.NewRequest("GET", "/register/challenge?platform=android", nil))
+	var issued api.ChallengeResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil || w.Code != http.StatusOK || issued.Challenge != challenge || issued.ExpiresIn != 300 {
+		t.Fatalf("Expected the backend's challenge relayed, got %d %s", w.Code, w.Body.String())
+	}
+
+	register := func(challenge string) *httptest.ResponseRecorder {
+		body := `{"encrypted_data": "abc", "platform": "android", "challenge": "` + challenge + `",
+			"integrity_token": "verdict", "app_version": "2.1.0", "os_version": "14", "locale": "de-CH", "device_model": "Pixel 8"}`
+		w := httptest.NewRecorder()
+		handleRegister(w, httptest.NewRequest("POST", "/register", strings.NewReader(body)))
+		return w
+	}
+	if w := register(challenge); w.Code != http.StatusOK {
+		t.Fatalf("Expected the registration to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	want := api.TokenRegistration{EncryptedData: "abc", Platform: "android", Challenge: challenge, IntegrityToken: "verdict",
+		AppVersion: "2.1.0", OSVersion: "14", Locale: "de-CH", DeviceModel: "Pixel 8"}
+	if !reflect.DeepEqual(registered, want) {
+		t.Errorf("Expected the challenge, integrity token and metadata forwarded, got %+v", registered)
+	}
+
+	// A queued registration is retried only while its challenge is accepted
+	down.Store(true)
+	if w := register(challenge); w.Code != http.StatusAccepted || retryQueue.Len() != 1 {
+		t.Fatalf("Expected the registration queued, got %d %s", w.Code, w.Body.String())
+	}
+	op := retryQueue.ops[0]
+	if expires, _ := api.ChallengeExpiry(challenge); !op.ChallengeExpires.Equal(expires) {
+		t.Errorf("Expected the queued registration to expire with its challenge at %v, got %v", expires, op.ChallengeExpires)
+	}
+	now := time.Now()
+	op.ChallengeExpires = now.Add(retryInitialBackoff + time.Second)
+	retryQueue.retry(context.Background(), op, now)
+	if retryQueue.Len() != 0 {
+		t.Errorf("Expected the registration dropped as its challenge expires before the next retry, got %d queued", retryQueue.Len())
+	}
+	if w := register(challengeExpiring(time.Second)); w.Code != http.StatusInternalServerError || retryQueue.Len() != 0 {
+		t.Errorf("Expected a challenge expiring before the first retry not queued, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendUserForwardsOnlyTheHash(t *testing.T) {
+	key := useSigningKey(t)
+	originalHashKey, originalAPIKey := userHashKey, backendAPIKey
+	defer func() { userHashKey, backendAPIKey = originalHashKey, originalAPIKey }()
+	setupUserHash("hash-secret", "backend-key")
+
+	var registered api.TokenRegistration
+	var registerBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v1/register":
+			registerBody = string(body)
+			json.Unmarshal(body, &registered)
+			now := time.Now().Unix()
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": true, "token_id": testTokenID,
+				"issued_at": now, "signature": signRegistration(t, key, testTokenID, now),
+			})
+		case "/v1/notify-user":
+			var req map[string]string
+			json.Unmarshal(body, &req)
+			if r.Header.Get("Authorization") != "Bearer backend-key" {
+				writeErrorStatus(w, http.StatusUnauthorized, "UNAUTHORIZED", "Missing or invalid API key")
+				return
+			}
+			if req["user_hash"] != registered.UserHash {
+				writeErrorStatus(w, http.StatusBadRequest, "NO_TOKENS", "No devices registered for this user")
+				return
+			}
+			w.Write([]byte(`{"success": true, "sent_count": 2, "error_count": 1, "total_tokens": 3}`))
+		}
+	}))
+	defer backend.Close()
+
+	originalURL := *notificationBackendURL
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL = originalURL }()
+
+	tokenStore = NewTokenStore()
+	w := httptest.NewRecorder()
+	handleRegister(w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"encrypted_data": "abc", "platform": "android", "user_id": "alice@example.com"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected registration to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(registerBody, "alice") || len(registered.UserHash) != 64 || registered.UserHash != userHash("alice@example.com") {
+		t.Errorf("Expected only the keyed hash to be forwarded, got %s", registerBody)
+	}
+	setupUserHash("another-secret", "backend-key")
+	if userHash("alice@example.com") == registered.UserHash {
+		t.Error("Expected the hash to depend on the key")
+	}
+	setupUserHash("hash-secret", "backend-key")
+
+	send := func(userID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleSendUser(w, formRequest("/send-user", "message=hi&user_id="+userID))
+		return w
+	}
+	if got := send("alice@example.com").Header().Get("Location"); got != "/?sent=2&errors=1&removed=0" {
+		t.Errorf("Expected one backend call covering the user's devices, got redirect %q", got)
+	}
+	if w := send("bob"); !strings.Contains(w.Body.String(), "NO_TOKENS") {
+		t.Errorf("Expected NO_TOKENS relayed for a user without devices, got %d %s", w.Code, w.Body.String())
+	}
+
+	setupUserHash("", "")
+	if w := send("alice@example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected /send-user disabled without a hash key, got %d", w.Code)
+	}
+}
+
+func TestParseOpaqueID(t *testing.T) {
+	tests := map[string]int{
+		testTokenID: 1,
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef": 0,
+		"rn7_anylengthbodyfromanewerbackend":                               7,
+	}
+	for id, want := range tests {
+		if got, err := api.ParseOpaqueID(id); err != nil || got != want {
+			t.Errorf("api.ParseOpaqueID(%q) = %d, %v; want version %d", id, got, err, want)
+		}
+	}
+	for _, id := range []string{"", "tokenid", "rn1_short", "RN1_" + testTokenID[4:], "rn0_abc", "rn2_../secret", "rn2_" + strings.Repeat("a", api.MaxOpaqueIDLength)} {
+		if _, err := api.ParseOpaqueID(id); err == nil {
+			t.Errorf("Expected %q to be rejected", id)
+		}
+	}
+}
+
+func TestHandleRegisterRelaysBackendErrorCode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeErrorStatus(w, http.StatusBadRequest, "DECRYPT_FAILED", "Invalid encrypted token")
+	}))
+	defer backend.Close()
+
+	originalURL := *notificationBackendURL
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL = originalURL }()
+
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(`{"encrypted_data": "abc", "platform": "android"}`))
+	w := httptest.NewRecorder()
+	handleRegister(w, req)
+
+	var resp ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Expected JSON error response: %v", err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Code != "DECRYPT_FAILED" {
+		t.Errorf("Expected relayed 400 DECRYPT_FAILED, got %d %+v", w.Code, resp)
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	key := useSigningKey(t)
+	// The backend fails on its side until it is brought up
+	var up atomic.Bool
+	var notified atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			writeErrorStatus(w, http.StatusServiceUnavailable, "FCM_UNAVAILABLE", "Failed to send notification")
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/register":
+			now := time.Now().Unix()
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": true, "token_id": testTokenID, "notify_secret": "s3cret",
+				"issued_at": now, "signature": signRegistration(t, key, testTokenID, now),
+			})
+		case "/v1/notify":
+			notified.Add(1)
+			w.Write([]byte(`{"success": true}`))
+		}
+	}))
+	defer backend.Close()
+
+	originalURL, originalQueue := *notificationBackendURL, retryQueue
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL, retryQueue = originalURL, originalQueue }()
+
+	path := filepath.Join(t.TempDir(), "retry-queue.json")
+	var err error
+	if retryQueue, err = OpenRetryQueue(path); err != nil {
+		t.Fatalf("Failed to open retry queue: %v", err)
+	}
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("existing", "")
+
+	w := httptest.NewRecorder()
+	handleRegister(w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"encrypted_data": "abc", "platform": "android", "user_id": "alice"}`)))
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"queued":true`) {
+		t.Errorf("Expected the registration queued, got %d %s", w.Code, w.Body.String())
+	}
+	if send := sendAll(t, "message=hi"); send.SentCount != 0 || send.ErrorCount != 0 || send.QueuedCount != 1 {
+		t.Errorf("Expected the send queued, got %+v", send)
+	}
+
+	// A restart picks the queue up again, without the raw user ID
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "alice") {
+		t.Error("Expected only the user hash in the retry queue file")
+	}
+	q, err := OpenRetryQueue(path)
+	if err != nil || q.Len() != 2 {
+		t.Fatalf("Expected two queued operations after reopening, got %d %v", q.Len(), err)
+	}
+
+	// Nothing is due before the first backoff, and another failure backs off further
+	now := time.Now()
+	if due := q.due(now); len(due) != 0 {
+		t.Errorf("Expected nothing due yet, got %d", len(due))
+	}
+	for _, op := range q.due(now.Add(retryInitialBackoff)) {
+		q.retry(context.Background(), op, now)
+		if op.Attempts != 2 || !op.NextAttempt.Equal(now.Add(2*retryInitialBackoff)) {
+			t.Errorf("Expected a second backoff, got attempt %d at %v", op.Attempts, op.NextAttempt)
+		}
+	}
+	if q.Len() != 2 {
+		t.Fatalf("Expected both operations still queued, got %d", q.Len())
+	}
+
+	up.Store(true)
+	for _, op := range q.due(now.Add(time.Hour)) {
+		q.retry(context.Background(), op, now)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expected the queue drained, got %d", q.Len())
+	}
+	if tokenStore.NotifySecret(testTokenID) != "s3cret" || notified.Load() != 1 {
+		t.Errorf("Expected the registration stored and the notification sent, got %d sends", notified.Load())
+	}
+
+	// Operations are dropped once they are too old, or the backend refuses them
+	up.Store(false)
+	q.Enqueue(&retryOp{Notify: &api.NotificationRequest{TokenID: "existing"}}, fmt.Errorf("unavailable"))
+	q.ops[0].QueuedAt = now.Add(-*retryMaxAge)
+	q.retry(context.Background(), q.ops[0], now)
+	if q.Len() != 0 {
+		t.Errorf("Expected an expired operation dropped, got %d queued", q.Len())
+	}
+	q.Enqueue(&retryOp{Notify: &api.NotificationRequest{TokenID: "existing"}}, fmt.Errorf("unavailable"))
+	q.finish(q.ops[0], &backendError{Status: http.StatusBadRequest, Code: ErrTokenNotFound}, now)
+	if q.Len() != 0 {
+		t.Errorf("Expected a refused operation dropped, got %d queued", q.Len())
+	}
+
+	if got := retryBackoff(100); got != retryMaxBackoff {
+		t.Errorf("Expected the backoff capped at %v, got %v", retryMaxBackoff, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/register" {
+			writeErrorStatus(w, http.StatusBadRequest, "DECRYPT_FAILED", "Invalid encrypted token")
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL := *notificationBackendURL
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL = originalURL }()
+
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("a", "")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", loggingMiddleware(handleRegister))
+	mux.HandleFunc("/send-all", loggingMiddleware(handleSendAll))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/register", strings.NewReader(`{"encrypted_data": "abc"}`)))
+	mux.ServeHTTP(httptest.NewRecorder(), formRequest("/send-all", "message=hi"))
+	serverShutdown.sends.Wait()
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE app_backend_registrations_total counter",
+		`app_backend_registrations_total{outcome="refused"} `,
+		`app_backend_forward_failures_total{call="register",reason="client"} `,
+		`app_backend_http_requests_total{route="/register",code="400"} `,
+		`app_backend_http_requests_total{route="/send-all",code="303"} `,
+		`app_backend_send_all_notifications_total{outcome="sent"} `,
+		`app_backend_backend_request_duration_seconds_bucket{path="/v1/notify",code="200",le="+Inf"} `,
+		"app_backend_send_all_duration_seconds_count ",
+		"app_backend_registered_tokens 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestLoggingMiddlewareRequestID(t *testing.T) {
+	var seen string
+	handler := loggingMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	})
+
+	// Caller-supplied IDs are kept so logs can be correlated across services
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if seen != "abc123" {
+		t.Errorf("Expected request ID %q in context, got %q", "abc123", seen)
+	}
+	if got := w.Header().Get("X-Request-ID"); got != "abc123" {
+		t.Errorf("Expected X-Request-ID response header %q, got %q", "abc123", got)
+	}
+
+	// Otherwise one is generated
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || w.Header().Get("X-Request-ID") != seen {
+		t.Errorf("Expected generated request ID to match header, got %q and %q", seen, w.Header().Get("X-Request-ID"))
+	}
+
+	// Requests refused before reaching a route are logged the same way
+	var logs bytes.Buffer
+	original := slog.Default()
+	defer slog.SetDefault(original)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	req = httptest.NewRequest("POST", "/register", strings.NewReader("{}"))
+	req.Header.Set("Content-Encoding", "br")
+	req.Header.Set("X-Request-ID", "def456")
+	gzipHandler(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+	var line map[string]any
+	json.Unmarshal(logs.Bytes(), &line)
+	if line["msg"] != "request" || line["request_id"] != "def456" || line["status_code"] != float64(http.StatusUnsupportedMediaType) {
+		t.Errorf("Expected a request log line for the refused request, got %s", logs.String())
+	}
+}
+
+func TestPanicRecoveredAsServerError(t *testing.T) {
+	handler := loggingMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 after panic, got %d", w.Code)
+	}
+}
+
+func TestSetupLoggingRejectsInvalidOptions(t *testing.T) {
+	if err := setupLogging(io.Discard, "verbose", "text", "standard"); err == nil {
+		t.Error("Expected error for invalid log level")
+	}
+	if err := setupLogging(io.Discard, "info", "xml", "standard"); err == nil {
+		t.Error("Expected error for invalid log format")
+	}
+	if err := setupLogging(io.Discard, "info", "text", "paranoid"); err == nil {
+		t.Error("Expected error for invalid log privacy")
+	}
+	if err := setupLogging(io.Discard, "debug", "json", "standard"); err != nil {
+		t.Errorf("Expected valid options to succeed, got %v", err)
+	}
+}
+
+func TestRotatingFileKeepsLoggingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	f, err := openRotatingFile(path, 20, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	// A directory at the backup name makes the rename fail
+	blocker := path + "." + now.Format("20060102-150405.000")
+	if err := os.MkdirAll(filepath.Join(blocker, "taken"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("0123456789\n"))
+	if n, err := f.Write([]byte("0123456789\n")); err == nil || n != 11 {
+		t.Errorf("Expected the rotation error with the line still written, got %d %v", n, err)
+	}
+	if current, _ := os.ReadFile(path); string(current) != "0123456789\n0123456789\n" {
+		t.Errorf("Expected both lines in the current file, got %q", current)
+	}
+
+	// Once the rename can succeed, the next write rotates
+	now = now.Add(time.Second)
+	if _, err := f.Write([]byte("x\n")); err != nil {
+		t.Errorf("Expected the retried rotation to succeed, got %v", err)
+	}
+	if current, _ := os.ReadFile(path); string(current) != "x\n" {
+		t.Errorf("Expected a fresh file after rotating, got %q", current)
+	}
+}
+
+func TestTracingSpanNamedAfterRoute(t *testing.T) {
+	originalProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(originalProvider)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	tracingHandler(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/tokens/secret-opaque-id", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "DELETE /api/tokens/{id}" {
+		t.Fatalf("Expected one span named after the route, got %v", spans)
+	}
+	var paths []string
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == semconv.URLPathKey {
+			paths = append(paths, attr.Value.AsString())
+		}
+	}
+	if len(paths) != 1 || paths[0] != "/api/tokens/{id}" {
+		t.Errorf("Expected the route recorded as the path, got %q", paths)
+	}
+}
+
+func TestBackendCallTimeout(t *testing.T) {
+	// A backend that never answers within the deadline
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}))
+	defer backend.Close()
+
+	originalURL, originalTimeout := *notificationBackendURL, *backendTimeout
+	*notificationBackendURL, *backendTimeout = backend.URL, 50*time.Millisecond
+	defer func() { *notificationBackendURL, *backendTimeout = originalURL, originalTimeout }()
+
+	start := time.Now()
+	err := sendNotificationToBackend(context.Background(), api.NotificationRequest{TokenID: "tokenid", Title: "t", Body: "b"})
+	if err == nil {
+		t.Fatal("Expected timeout error from hung backend")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected call to give up after the backend timeout, took %v", elapsed)
+	}
+}
+
+func TestCheckTLSCertificate(t *testing.T) {
+	// The checked-in development certificate
+	if _, err := checkTLSCertificate("cert.pem", "key.pem", time.Now()); err != nil && !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected development certificate to load, got %v", err)
+	}
+	if _, err := checkTLSCertificate("cert.pem", "key.pem", time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("Expected certificate to be reported as expired in the year 3000")
+	}
+	if _, err := checkTLSCertificate("missing.pem", "key.pem", time.Now()); err == nil {
+		t.Error("Expected missing certificate to fail")
+	}
+}
+
+func TestAutocert(t *testing.T) {
+	if config, err := setupAutocert(nil, "", ""); config != nil || err != nil {
+		t.Errorf("Expected files to stay in use without a domain, got %v %v", config, err)
+	}
+	domains, err := autocertDomains(" Push.Example.com, www.example.com,")
+	if err != nil || strings.Join(domains, ",") != "push.example.com,www.example.com" {
+		t.Errorf("Unexpected domains %v %v", domains, err)
+	}
+	if _, err := autocertDomains("https://push.example.com"); err == nil {
+		t.Error("Expected a URL refused as a domain")
+	}
+
+	originalHTTPAddr := *autocertHTTPAddr
+	*autocertHTTPAddr = ""
+	defer func() { *autocertHTTPAddr = originalHTTPAddr }()
+
+	cacheDir := filepath.Join(t.TempDir(), "autocert")
+	config, err := setupAutocert(domains, cacheDir, "")
+	if err != nil {
+		t.Fatalf("Failed to set up autocert: %v", err)
+	}
+	if info, err := os.Stat(cacheDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected a private cache directory, got %v %v", info, err)
+	}
+	if !slices.Contains(config.NextProtos, "acme-tls/1") {
+		t.Errorf("Expected tls-alpn-01 challenges answered, got %v", config.NextProtos)
+	}
+	// Other names are refused before the certificate authority is asked
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("Expected a certificate for another domain refused")
+	}
+	if detail, err := checkAutocert(domains, cacheDir); err != nil || !strings.Contains(detail, "push.example.com") {
+		t.Errorf("Expected the cache check to pass, got %q %v", detail, err)
+	}
+}
+
+func TestProbeBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"registered_tokens":0}`))
+	}))
+	defer backend.Close()
+
+	originalURL := *notificationBackendURL
+	defer func() { *notificationBackendURL = originalURL }()
+
+	*notificationBackendURL = backend.URL
+	if err := probeBackend(context.Background(), backends[0]); err != nil {
+		t.Errorf("Expected healthy backend probe to pass, got %v", err)
+	}
+
+	backend.Close()
+	if err := probeBackend(context.Background(), backends[0]); err == nil {
+		t.Error("Expected probe of stopped backend to fail")
+	}
+}
+
+func TestBackendClient(t *testing.T) {
+	// A backend that is overloaded for the first two calls of each kind
+	var statusCalls, notifyCalls atomic.Int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls := &notifyCalls
+		if r.URL.Path == "/v1/status" {
+			calls = &statusCalls
+		}
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+
+	originalURL, originalClient := *notificationBackendURL, backendClient
+	*notificationBackendURL = backend.URL
+	defer func() { *notificationBackendURL, backendClient = originalURL, originalClient }()
+
+	// The test server's certificate is trusted only through --backend-ca
+	if err := setupBackendClient(""); err != nil {
+		t.Fatalf("Failed to set up the backend client: %v", err)
+	}
+	if err := probeBackend(context.Background(), backends[0]); err == nil || !strings.Contains(err.Error(), "certificate") || statusCalls.Load() != 0 {
+		t.Errorf("Expected an untrusted backend certificate refused without retrying, got %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600)
+	if err := setupBackendClient(caFile); err != nil {
+		t.Fatalf("Failed to set up the backend client: %v", err)
+	}
+
+	// Status checks are retried through an overload, sends are left to the retry queue
+	statusCalls.Store(0)
+	if err := probeBackend(context.Background(), backends[0]); err != nil || statusCalls.Load() != 3 {
+		t.Errorf("Expected the probe to pass on the third try, got %v after %d calls", err, statusCalls.Load())
+	}
+	if err := sendNotificationToBackend(context.Background(), api.NotificationRequest{TokenID: "tokenid"}); err == nil || notifyCalls.Load() != 1 {
+		t.Errorf("Expected a send tried once, got %v after %d calls", err, notifyCalls.Load())
+	}
+
+	if err := setupBackendClient(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("Expected a missing CA file refused")
+	}
+	os.WriteFile(caFile, []byte("not a certificate"), 0600)
+	if err := setupBackendClient(caFile); err == nil {
+		t.Error("Expected a CA file without certificates refused")
+	}
+}
+
+func TestBackendStatusOnHomePage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"registered_tokens": 3, "storage_type": "file", "firebase_initialized": true, "sends_queued": 2}`))
+	}))
+	defer backend.Close()
+	originalURL, originalStatus := *notificationBackendURL, backendStatus
+	defer func() { *notificationBackendURL, backendStatus = originalURL, originalStatus }()
+	*notificationBackendURL = backend.URL
+	backendStatus = &backendMonitor{}
+
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("a", "")
+	tokenStore.AddTokenID("b", "")
+	tokenStore.AddTokenID("c", "")
+
+	w := httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(w.Body.String(), "Notification Backend") {
+		t.Error("Expected no backend section before the first check")
+	}
+
+	backendStatus.check(context.Background())
+	status := backendStatus.latest()
+	if !status.Healthy || status.RegisteredTokens != 3 || status.StorageType != "file" || status.SendsQueued != 2 {
+		t.Errorf("Unexpected backend status %+v", status)
+	}
+	if msg := status.Mismatch(3); msg != "" {
+		t.Errorf("Expected equal counts to agree, got %q", msg)
+	}
+	tokenStore.AddTokenID("d", "")
+	w = httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "<strong>3</strong> registrations in file storage") || !strings.Contains(body, "sends to the missing ones will fail") {
+		t.Errorf("Expected the backend status and a mismatch warning, got %s", body)
+	}
+
+	backend.Close()
+	backendStatus.check(context.Background())
+	if status := backendStatus.latest(); status.Healthy || status.Error == "" || status.Mismatch(4) != "" {
+		t.Errorf("Expected an unreachable backend reported, got %+v", status)
+	}
+	w = httptest.NewRecorder()
+	handleHome(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "Unreachable") {
+		t.Error("Expected the home page to show the backend unreachable")
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	req := httptest.NewRequest("GET", "/version", nil)
+	w := httptest.NewRecorder()
+
+	handleVersion(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var info VersionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode version response: %v", err)
+	}
+	if info.Version != version || info.GoVersion == "" {
+		t.Errorf("Unexpected version info: %+v", info)
+	}
+	if info.Features["auth"] == "" || info.Features["tracing"] == "" {
+		t.Errorf("Expected auth and tracing features to be reported, got %v", info.Features)
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	originalStore, originalKey := adminStore, adminAPIKey
+	defer func() { adminStore, adminAPIKey = originalStore, originalKey }()
+	setupAdminAPI("bootstrap")
+	path := filepath.Join(t.TempDir(), "admins.json")
+	if err := setupAdmins(path); err != nil {
+		t.Fatalf("setupAdmins failed: %v", err)
+	}
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("tokenid", "")
+
+	// The API key creates the first accounts
+	put := func(name, body string, as func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/admins/"+name, strings.NewReader(body))
+		req.SetPathValue("name", name)
+		as(req)
+		w := httptest.NewRecorder()
+		requireAPIRole(RoleAdmin, handleAPIAdmin)(w, req)
+		return w
+	}
+	byKey := func(r *http.Request) { r.Header.Set("Authorization", "Bearer bootstrap") }
+	as := func(name, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(name, password) }
+	}
+	for _, account := range []string{"alice:viewer", "bob:sender", "carol:admin"} {
+		name, role, _ := strings.Cut(account, ":")
+		if w := put(name, `{"role": "`+role+`", "password": "`+name+`-secret-pw"}`, byKey); w.Code != http.StatusOK {
+			t.Fatalf("Failed to create %s: %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	for body, why := range map[string]string{
+		`{"role": "viewer", "password": "short"}`:            "a short password",
+		`{"role": "owner", "password": "long-enough-pw"}`:    "an unknown role",
+		`{"role": "viewer"}`:                                 "a new account without a password",
+		`{"role": "viewer", "password": "long-enough-pw"} x`: "invalid JSON",
+	} {
+		if w := put("dave", body, byKey); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s refused, got %d", why, w.Code)
+		}
+	}
+
+	// The API takes the accounts' own API keys, never their logins
+	issue := func(name string) string {
+		req := httptest.NewRequest("POST", "/api/admins/"+name+"/api-key", nil)
+		req.SetPathValue("name", name)
+		byKey(req)
+		w := httptest.NewRecorder()
+		requireAPIRole(RoleAdmin, handleAPIAdminKey)(w, req)
+		var resp APIAdminKeyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || len(resp.APIKey) != 64 {
+			t.Fatalf("Failed to issue %s an API key: %d %s", name, w.Code, w.Body.String())
+		}
+		return resp.APIKey
+	}
+	keys := map[string]string{"bob": issue("bob"), "carol": issue("carol")}
+	withKey := func(name string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+keys[name]) }
+	}
+	if w := put("erin", `{"role": "viewer", "password": "long-enough-pw"}`, withKey("bob")); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a sender refused account management, got %d", w.Code)
+	}
+	if w := put("erin", `{"role": "viewer", "password": "long-enough-pw"}`, as("carol", "carol-secret-pw")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an admin login refused by the API, got %d", w.Code)
+	}
+
+	data, _ := os.ReadFile(path)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 || strings.Contains(string(data), "secret-pw") || strings.Contains(string(data), keys["carol"]) {
+		t.Errorf("Expected only password and key hashes, readable by the owner, got %v %s", err, data)
+	}
+
+	// Each role sees and may do what it includes
+	home := func(as func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		as(req)
+		w := httptest.NewRecorder()
+		requireRole(RoleViewer, handleHome)(w, req)
+		return w
+	}
+	if w := home(func(*http.Request) {}); w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("Expected a login prompt, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if w := home(as("alice", "wrong-password")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password refused, got %d", w.Code)
+	}
+	if body := home(as("alice", "alice-secret-pw")).Body.String(); !strings.Contains(body, "Signed in as <strong>alice</strong> (viewer)") || strings.Contains(body, `action="/preview"`) {
+		t.Errorf("Expected the viewer's home page without send forms, got %s", body)
+	}
+	if body := home(as("bob", "bob-secret-pw")).Body.String(); !strings.Contains(body, `action="/preview"`) {
+		t.Errorf("Expected the sender's home page with send forms, got %s", body)
+	}
+
+	req := formRequest("/send-all", "message=hi")
+	req.SetBasicAuth("alice", "alice-secret-pw")
+	w := httptest.NewRecorder()
+	requireRole(RoleSender, handleSendAll)(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), string(ErrForbidden)) {
+		t.Errorf("Expected a viewer refused sending, got %d %s", w.Code, w.Body.String())
+	}
+
+	tokens := func(name string) string {
+		req := httptest.NewRequest("GET", "/tokens", nil)
+		req.SetBasicAuth(name, name+"-secret-pw")
+		w := httptest.NewRecorder()
+		requireRole(RoleViewer, handleTokens)(w, req)
+		return w.Body.String()
+	}
+	if strings.Contains(tokens("bob"), "/tokens/delete") || !strings.Contains(tokens("carol"), "/tokens/delete") {
+		t.Error("Expected only the admin offered token removal")
+	}
+	for name, want := range map[string]int{"bob": http.StatusForbidden, "carol": http.StatusNotFound} {
+		req := httptest.NewRequest("DELETE", "/api/tokens/unknown", nil)
+		req.SetPathValue("id", "unknown")
+		withKey(name)(req)
+		w := httptest.NewRecorder()
+		requireAPIRole(RoleAdmin, handleAPIToken)(w, req)
+		if w.Code != want {
+			t.Errorf("Expected %d deleting a token as %s, got %d", want, name, w.Code)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/api/admins", nil)
+	withKey("carol")(req)
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleAdmin, handleAPIAdmins)(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `{"name":"alice","role":"viewer"}`) || !strings.Contains(body, `{"name":"carol","role":"admin","api_key":true}`) ||
+		strings.Contains(body, "password") || strings.Contains(body, "hash") {
+		t.Errorf("Unexpected admin list %s", body)
+	}
+
+	// Someone must stay able to manage accounts
+	if w := put("carol", `{"role": "sender"}`, byKey); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected demoting the last admin refused, got %d", w.Code)
+	}
+	remove := func(name string) int {
+		req := httptest.NewRequest("DELETE", "/api/admins/"+name, nil)
+		req.SetPathValue("name", name)
+		byKey(req)
+		w := httptest.NewRecorder()
+		requireAPIRole(RoleAdmin, handleAPIAdmin)(w, req)
+		return w.Code
+	}
+	if code := remove("carol"); code != http.StatusBadRequest {
+		t.Errorf("Expected removing the last admin refused, got %d", code)
+	}
+	if code := remove("alice"); code != http.StatusOK {
+		t.Errorf("Expected alice removed, got %d", code)
+	}
+	if code := remove("alice"); code != http.StatusNotFound {
+		t.Errorf("Expected ADMIN_NOT_FOUND, got %d", code)
+	}
+	// Keeping the password while changing the role
+	if w := put("bob", `{"role": "viewer"}`, byKey); w.Code != http.StatusOK {
+		t.Errorf("Expected bob's role changed, got %d %s", w.Code, w.Body.String())
+	}
+
+	reopened, err := OpenAdminStore(path)
+	if err != nil || len(reopened.List()) != 2 {
+		t.Fatalf("Expected two accounts after reopening, got %v %v", reopened, err)
+	}
+	if account, ok := reopened.Authenticate("bob", "bob-secret-pw"); !ok || account.Role != RoleViewer {
+		t.Errorf("Expected bob to log in as a viewer, got %+v %v", account, ok)
+	}
+	if account, ok := reopened.AuthenticateAPIKey(keys["bob"]); !ok || account.Name != "bob" {
+		t.Errorf("Expected bob's API key kept through the role change, got %+v %v", account, ok)
+	}
+
+	// A revoked key no longer works
+	req = httptest.NewRequest("DELETE", "/api/admins/bob/api-key", nil)
+	req.SetPathValue("name", "bob")
+	byKey(req)
+	w = httptest.NewRecorder()
+	requireAPIRole(RoleAdmin, handleAPIAdminKey)(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected bob's API key revoked, got %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := adminStore.AuthenticateAPIKey(keys["bob"]); ok {
+		t.Error("Expected the revoked key refused")
+	}
+	os.WriteFile(path, []byte(`{"mallory": {"role": "root", "password_hash": "x"}}`), 0600)
+	if _, err := OpenAdminStore(path); err == nil {
+		t.Error("Expected an unknown role refused")
+	}
+}
+
+func TestAPIRefusesBrowserForgery(t *testing.T) {
+	originalStore, originalKey := adminStore, adminAPIKey
+	defer func() { adminStore, adminAPIKey = originalStore, originalKey }()
+	setupAdminAPI("bootstrap")
+	adminStore = nil
+
+	handler := requireAPIRole(RoleSender, requireJSON(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, APISendResponse{Success: true})
+	}))
+	send := func(contentType, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "https://example.com/api/send", strings.NewReader(`{"title": "T", "message": "hi"}`))
+		req.Header.Set("Authorization", "Bearer bootstrap")
+		req.Header.Set("Content-Type", contentType)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// A form of another site can post JSON as text/plain, but not label it so
+	if w := send("text/plain", ""); w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), string(ErrUnsupportedMediaType)) {
+		t.Errorf("Expected a text/plain body refused, got %d %s", w.Code, w.Body.String())
+	}
+	if w := send("application/json", "https://evil.example"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), string(ErrCSRFFailed)) {
+		t.Errorf("Expected a cross-origin request refused, got %d %s", w.Code, w.Body.String())
+	}
+	if w := send("application/json; charset=utf-8", "https://example.com"); w.Code != http.StatusOK {
+		t.Errorf("Expected a same-origin JSON request sent, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL, originalStore, originalKey, originalAudit, originalHistory := *notificationBackendURL, adminStore, adminAPIKey, auditLog, sendHistory
+	defer func() {
+		*notificationBackendURL, adminStore, adminAPIKey, auditLog, sendHistory = originalURL, originalStore, originalKey, originalAudit, originalHistory
+	}()
+	*notificationBackendURL = backend.URL
+	sendHistory = &SendHistory{}
+	setupAdminAPI("bootstrap")
+
+	dir := t.TempDir()
+	if err := setupAdmins(filepath.Join(dir, "admins.json")); err != nil {
+		t.Fatal(err)
+	}
+	adminStore.Put("bob", RoleAdmin, "bob-secret-pw")
+	path := filepath.Join(dir, "audit.jsonl")
+	if err := setupAuditLog(path); err != nil {
+		t.Fatalf("setupAuditLog failed: %v", err)
+	}
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("tokenid", "")
+
+	// Browsers send the password every time; one login is recorded
+	for _, password := range []string{"bob-secret-pw", "bob-secret-pw", "wrong-password"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("bob", password)
+		requireRole(RoleViewer, handleHome)(httptest.NewRecorder(), req)
+	}
+	req := formRequest("/send-all", "title=%3DHYPERLINK(1)&message=hi")
+	req.SetBasicAuth("bob", "bob-secret-pw")
+	requireRole(RoleSender, handleSendAll)(httptest.NewRecorder(), req)
+	serverShutdown.sends.Wait()
+	req = httptest.NewRequest("DELETE", "/api/tokens/tokenid", nil)
+	req.SetPathValue("id", "tokenid")
+	req.Header.Set("Authorization", "Bearer bootstrap")
+	requireAPIRole(RoleAdmin, handleAPIToken)(httptest.NewRecorder(), req)
+
+	// The file is appended to across restarts
+	if err := setupAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := auditLog.All()
+	if err != nil {
+		t.Fatalf("Failed to read the audit log: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Action+" "+e.Admin+" "+e.Detail)
+	}
+	want := []string{"login bob ", "login_failed bob ", "send_all bob =HYPERLINK(1): hi (1 devices)", "token_delete api-key tokenid"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected audit entries %q, got %q", want, got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the audit file readable by the owner only, got %v", err)
+	}
+	if records, _ := sendHistory.Recent(context.Background(), 1); len(records) != 1 || records[0].Admin != "bob" {
+		t.Errorf("Expected the send history to name bob, got %+v", records)
+	}
+
+	req = httptest.NewRequest("GET", "/api/audit?limit=1", nil)
+	req.Header.Set("Authorization", "Bearer bootstrap")
+	w := httptest.NewRecorder()
+	requireAPIRole(RoleAdmin, handleAPIAudit)(w, req)
+	var resp APIAuditResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Count != 1 || resp.Entries[0].Action != auditTokenDelete || resp.Entries[0].ClientIP != "192.0.2.1" {
+		t.Errorf("Expected the newest entry, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handleAudit(w, httptest.NewRequest("GET", "/audit?format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Header().Get("Content-Type") != "text/csv; charset=utf-8" || len(lines) != 5 || lines[0] != "time,action,admin,client_ip,detail" ||
+		!strings.HasSuffix(lines[3], "send_all,bob,192.0.2.1,'=HYPERLINK(1): hi (1 devices)") {
+		t.Errorf("Unexpected CSV export %q", lines)
+	}
+	w = httptest.NewRecorder()
+	handleAudit(w, httptest.NewRequest("GET", "/audit", nil))
+	if body := w.Body.String(); !strings.Contains(body, `<td>login_failed</td>`) {
+		t.Errorf("Expected the audit page to list the failed login, got %s", body)
+	}
+}
+
+func TestSendCSV(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.TokenID == "gone" {
+			writeErrorStatus(w, http.StatusBadRequest, ErrTokenNotFound, "Token ID not found")
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, req.TokenID+" "+req.Title+"|"+req.Body)
+		mu.Unlock()
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer backend.Close()
+	originalURL, originalKey, originalHistory := *notificationBackendURL, adminAPIKey, sendHistory
+	defer func() { *notificationBackendURL, adminAPIKey, sendHistory = originalURL, originalKey, originalHistory }()
+	*notificationBackendURL = backend.URL
+	sendHistory = &SendHistory{}
+	setupAdminAPI("admin")
+
+	tokenStore = NewTokenStore()
+	for _, id := range []string{"a", "b", "gone"} {
+		tokenStore.AddTokenID(id, "")
+	}
+
+	// upload posts a CSV send as a multipart form, with the CSRF token for the form
+	upload := func(handler http.HandlerFunc, path, csvData string, fields ...string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for i := 0; i+1 < len(fields); i += 2 {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		part, _ := mw.CreateFormFile("csv", "send.csv")
+		part.Write([]byte(csvData))
+		mw.Close()
+		req := httptest.NewRequest("POST", path, &buf)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer admin")
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	const csvData = "\ufefftoken_id,name,order\na,Ann,42\nb,,7\nunknown,Xavier,1\ngone,Gus,9\n"
+	fields := []string{"title", "Hi {{name}}", "message", "Order {{order}} shipped"}
+
+	w := upload(requireAPIRole(RoleSender, handleAPISendCSV), "/api/send-csv", csvData, fields...)
+	var resp APISendCSVResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var rows []string
+	for _, row := range resp.Rows {
+		rows = append(rows, fmt.Sprintf("%d %s %s %s", row.Line, row.TokenID, row.Status, row.Error))
+	}
+	want := []string{"2 a sent ", "3 b invalid placeholder {{name}} needs a value", "4 unknown invalid opaque token ID not registered", "5 gone removed "}
+	if !slices.Equal(rows, want) {
+		t.Errorf("Expected rows %q, got %q", want, rows)
+	}
+	if !resp.Success || resp.SentCount != 1 || resp.ErrorCount != 3 || resp.RemovedCount != 1 || resp.InvalidCount != 2 || resp.TotalRows != 4 {
+		t.Errorf("Unexpected totals %s", w.Body.String())
+	}
+	if want := []string{"a Hi Ann|Order 42 shipped"}; !slices.Equal(bodies, want) {
+		t.Errorf("Expected %q sent, got %q", want, bodies)
+	}
+	if tokenStore.Registered("gone") {
+		t.Error("Expected the stale ID dropped")
+	}
+	if records, _ := sendHistory.Recent(context.Background(), 1); len(records) != 1 || records[0].Target != "csv" || records[0].TargetCount != 4 {
+		t.Errorf("Expected the CSV send in the history, got %+v", records)
+	}
+
+	// The form answers with a page of the rows, once its CSRF token matches
+	w = upload(handleSendCSV, "/send-csv", "token_id\na\n", "message", "hi", csrfFieldName, testCSRFToken)
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "<code>a</code>") || !strings.Contains(body, "1 sent") {
+		t.Errorf("Expected the results page, got %d %s", w.Code, body)
+	}
+	if w := upload(handleSendCSV, "/send-csv", "token_id\na\n", "message", "hi"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected CSRF_FAILED without the token, got %d", w.Code)
+	}
+
+	for why, csvData := range map[string]string{
+		"a missing placeholder column": "token_id,name\na,Ann\n",
+		"no token_id column":           "id,name,order\na,Ann,1\n",
+		"a header only":                "token_id,name,order\n",
+		"ragged rows":                  "token_id,name,order\na,Ann\n",
+		"too many rows":                "token_id,name,order\n" + strings.Repeat("a,Ann,1\n", maxCSVRows+1),
+	} {
+		if w := upload(requireAPIRole(RoleSender, handleAPISendCSV), "/api/send-csv", csvData, fields...); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s refused, got %d %s", why, w.Code, w.Body.String())
+		}
+	}
+	if w := upload(requireAPIRole(RoleSender, handleAPISendCSV), "/api/send-csv", strings.Repeat("x", maxCSVBytes+100<<10), fields...); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized file refused, got %d", w.Code)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	var mu sync.Mutex
+	var dryRuns, sends []string
+	oldBackend := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.TokenID == "gone":
+			writeErrorStatus(w, http.StatusBadRequest, ErrTokenNotFound, "Token ID not found")
+		case req.DryRun && !oldBackend:
+			dryRuns = append(dryRuns, req.TokenID+" "+req.Title+"|"+req.Body)
+			w.Write([]byte(`{"success": true, "message": "Dry run passed; nothing was sent", "dry_run": true}`))
+		default:
+			sends = append(sends, req.TokenID)
+			w.Write([]byte(`{"success": true, "message": "Notification sent successfully"}`))
+		}
+	}))
+	defer backend.Close()
+	originalURL, originalKey := *notificationBackendURL, adminAPIKey
+	defer func() { *notificationBackendURL, adminAPIKey = originalURL, originalKey }()
+	*notificationBackendURL = backend.URL
+	setupAdminAPI("admin")
+
+	tokenStore = NewTokenStore()
+	tokenStore.AddTokenID("gone", "")
+	tokenStore.AddTokenID("a", "secret-a")
+
+	if text, cut := trayText("Line one\n\nline   two", 40); text != "Line one line two" || cut {
+		t.Errorf("Expected the tray text on one line, got %q %v", text, cut)
+	}
+	if text, cut := trayText(strings.Repeat("é", 50), 40); text != strings.Repeat("é", 39)+"…" || !cut {
+		t.Errorf("Expected the tray text cut to 40 characters, got %q %v", text, cut)
+	}
+
+	// The form shows the notification and carries the text as typed to the send
+	w := httptest.NewRecorder()
+	handlePreview(w, formRequest("/preview", "title=Hello+{{name}}&message=Your+order+has+shipped&var_name=Ann"))
+	body := w.Body.String()
+	for _, want := range []string{
+		"Hello Ann",
+		"Dry run passed on <code>a</code>",
+		`action="/send-all"`,
+		`name="title" value="Hello {{name}}"`,
+		`name="var_name" value="Ann"`,
+		"Send to All 2 Devices</button>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the preview page to contain %q, got %s", want, body)
+		}
+	}
+	if len(dryRuns) != 1 || dryRuns[0] != "a Hello Ann|Your order has shipped" || len(sends) != 0 {
+		t.Errorf("Expected one dry run and no sends, got %v and %v", dryRuns, sends)
+	}
+	// A stale ID says nothing about the notification, so the next one is tried
+	if p := previewNotification(t.Context(), []string{"gone", "a"}, "t", "b"); p.DryRun != dryRunPassed || p.DryRunTokenID != "a" {
+		t.Errorf("Expected the dry run to move past the stale ID, got %+v", p)
+	}
+	if !tokenStore.Registered("gone") {
+		t.Error("Expected a preview to leave stale IDs to the real send")
+	}
+
+	preview := func(req APISendRequest) APIPreviewResponse {
+		t.Helper()
+		data, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		handleAPIPreview(w, httptest.NewRequest("POST", "/api/preview", bytes.NewReader(data)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the preview to succeed, got %d %s", w.Code, w.Body.String())
+		}
+		var resp APIPreviewResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+	resp := preview(APISendRequest{Title: "A rather long title that no tray shows whole", Message: "Short"})
+	if !resp.Sendable || !resp.Truncated || resp.DryRun != dryRunPassed || resp.TotalTokens != 2 || resp.MaxPayloadBytes != maxPayloadBytes {
+		t.Errorf("Unexpected preview: %+v", resp)
+	}
+	if resp := preview(APISendRequest{Message: strings.Repeat("x", maxPayloadBytes)}); resp.Sendable || !resp.PayloadTooLarge || resp.PayloadBytes <= maxPayloadBytes {
+		t.Errorf("Expected an oversized payload to be refused, got %+v", resp.NotificationPreview)
+	}
+
+	// A backend that ignores dry runs has delivered, and the preview says so
+	mu.Lock()
+	oldBackend = true
+	mu.Unlock()
+	if resp := preview(APISendRequest{Message: "hi"}); resp.Sendable || resp.DryRun != dryRunFailed || !resp.Delivered {
+		t.Errorf("Expected a backend without dry runs to be reported, got %+v", resp.NotificationPreview)
+	}
+
+	tokenStore = NewTokenStore()
+	if resp := preview(APISendRequest{Message: "hi"}); resp.Sendable || resp.DryRun != dryRunSkipped {
+		t.Errorf("Expected no dry run without devices, got %+v", resp.NotificationPreview)
+	}
+}
+
+func TestPairing(t *testing.T) {
+	// "hello" with mask 2, as other encoders draw it
+	want := []string{
+		"#######.......#######",
+		"#.....#..#.##.#.....#",
+		"#.###.#.#.###.#.###.#",
+		"#.###.#.#.#.#.#.###.#",
+		"#.###.#.#.#.#.#.###.#",
+		"#.....#.#..#..#.....#",
+		"#######.#.#.#.#######",
+		"........#.#..........",
+		"#.#####...##..#####..",
+		"###.#..#..#####..##.#",
+		".##.#.#.....#.##.###.",
+		"....##.#...####..##..",
+		".#.#..####..#..#....#",
+		"........###.#..#.#..#",
+		"#######..#.#.#..#.##.",
+		"#.....#.#.#....#####.",
+		"#.###.#.##.#.#..#..#.",
+		"#.###.#.##.#####.#...",
+		"#.###.#.#...#.##..#..",
+		"#.....#..#.####.###..",
+		"#######.#...#...#..#.",
+	}
+	q := newQRMatrix(1)
+	q.placeCodewords(qrCodewords(1, []byte("hello")))
+	q.applyMask(2)
+	q.drawFormat(2)
+	for y, row := range want {
+		for x, c := range row {
+			if q.modules[y][x] != (c == '#') {
+				t.Fatalf("Module %d,%d of the QR code differs", x, y)
+			}
+		}
+	}
+	for n, size := range map[int]int{14: 21, 15: 25, 213: 57} {
+		if code, err := encodeQR(bytes.Repeat([]byte("x"), n)); err != nil || code.Size != size {
+			t.Errorf("Expected %d bytes in a %d-module QR code, got %v", n, size, err)
+		}
+	}
+	if _, err := encodeQR(bytes.Repeat([]byte("x"), 214)); err == nil {
+		t.Error("Expected data beyond version 10 to be refused")
+	}
+
+	originalURL, originalHash := publicURL, publicKeyHash
+	defer func() { publicURL, publicKeyHash = originalURL, originalHash }()
+	publicKeyHash = strings.Repeat("ab", 32)
+
+	for rawURL, valid := range map[string]bool{
+		"https://demo.example.com/": true,
+		"http://10.0.0.5:8443":      true,
+		"ftp://demo.example.com":    false,
+		"demo.example.com":          false,
+	} {
+		publicURL = ""
+		if err := setupPairing(rawURL); (err == nil) != valid {
+			t.Errorf("Public URL %q: expected valid=%v, got %v", rawURL, valid, err)
+		}
+	}
+	if setupPairing("https://demo.example.com/"); publicURL != "https://demo.example.com" {
+		t.Errorf("Expected the public URL without a trailing slash, got %q", publicURL)
+	}
+
+	pair := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlePair(w, httptest.NewRequest("GET", "https://backend.example.com/pair"+query, nil))
+		return w
+	}
+	publicURL = ""
+	body := pair("").Body.String()
+	if !strings.Contains(body, "<code>https://backend.example.com/register</code>") || !strings.Contains(body, "<svg") || strings.Contains(body, publicKeyHash) {
+		t.Errorf("Expected the QR code of the registration URL at the address opened, got %s", body)
+	}
+	publicURL = "https://demo.example.com"
+	if body := pair("?key=1").Body.String(); !strings.Contains(body, "https://demo.example.com/register#public_key_hash="+publicKeyHash) {
+		t.Errorf("Expected the public URL with the key hash, got %s", body)
+	}
+	if w := pair("?format=svg"); w.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(w.Body.String(), "<svg") {
+		t.Errorf("Expected the QR code alone as SVG, got %q %s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	en := catalogs[defaultLanguage]
+	for code, c := range catalogs {
+		if c.Name == "" {
+			t.Errorf("Catalog %s has no language.name", code)
+		}
+		for key := range en.messages {
+			if _, ok := c.messages[key]; !ok {
+				t.Errorf("Catalog %s lacks %s", code, key)
+			}
+		}
+		for key := range c.messages {
+			if _, ok := en.messages[key]; !ok {
+				t.Errorf("Catalog %s has %s, which English does not", code, key)
+			}
+		}
+	}
+	// Every message the pages use is in the catalogs
+	used := regexp.MustCompile(`\{\{t(?:html)? "([^"]+)"`)
+	files, _ := fs.Glob(builtinTemplates, "templates/*.html")
+	for _, file := range files {
+		text, _ := builtinTemplates.ReadFile(file)
+		for _, m := range used.FindAllStringSubmatch(string(text), -1) {
+			if _, ok := en.messages[m[1]]; !ok {
+				t.Errorf("Templates use %s, which the catalogs lack", m[1])
+			}
+		}
+	}
+	for _, status := range []string{"sent", "error", "removed", "queued", "invalid"} {
+		if _, ok := en.messages["csv.status."+status]; !ok {
+			t.Errorf("Catalogs lack CSV status %s", status)
+		}
+	}
+
+	for header, want := range map[string]string{
+		"":                          "",
+		"fr-CH, fr;q=0.9, en;q=0.8": "fr",
+		"de-DE, en-US;q=0.7":        "en",
+		"en;q=0.5, fr;q=0.6":        "fr",
+		"de, *;q=0.5":               "",
+		"fr;q=bogus, en":            "en",
+	} {
+		if got := preferredLanguage(header); got != want {
+			t.Errorf("preferredLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+	if got := en.html("common.signedIn", "<b>", RoleViewer); got != "Signed in as <strong>&lt;b&gt;</strong> (viewer)" {
+		t.Errorf("Expected the arguments escaped and the markup kept, got %s", got)
+	}
+	if got := catalogs["fr"].text("no.such.key"); got != "no.such.key" {
+		t.Errorf("Expected a missing message to show its key, got %q", got)
+	}
+
+	home := func(url string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handleHome(w, r)
+		return w
+	}
+	w := home("/", http.Header{"Accept-Language": {"fr-FR,fr;q=0.9"}})
+	if body := w.Body.String(); !strings.Contains(body, `<html lang="fr">`) || !strings.Contains(body, "🔒 Confidentialité") || !strings.Contains(body, `<option value="fr" selected>Français</option>`) {
+		t.Errorf("Expected the home page in French, got %s", body)
+	}
+	if body := home("/", nil).Body.String(); !strings.Contains(body, `<html lang="en">`) || !strings.Contains(body, "🔒 Privacy Design") {
+		t.Errorf("Expected the home page in English by default, got %s", body)
+	}
+
+	// The selector's choice is remembered over the browser's
+	languageCookieOf := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == languageCookie {
+				return c
+			}
+		}
+		return nil
+	}
+	w = home("/?lang=fr", http.Header{"Accept-Language": {"en"}})
+	cookie := languageCookieOf(w)
+	if cookie == nil || cookie.Value != "fr" || !strings.Contains(w.Body.String(), `<html lang="fr">`) {
+		t.Fatalf("Expected ?lang=fr to pick French and set the cookie, got %v", w.Result().Cookies())
+	}
+	header := http.Header{"Accept-Language": {"en"}, "Cookie": {cookie.Name + "=" + cookie.Value}}
+	if body := home("/", header).Body.String(); !strings.Contains(body, `<html lang="fr">`) {
+		t.Errorf("Expected the cookie to keep French")
+	}
+	if w := home("/?lang=xx", nil); languageCookieOf(w) != nil {
+		t.Errorf("Expected an unknown language ignored")
+	}
+}
+
+func TestTemplateDir(t *testing.T) {
+	originalDir := templateDir
+	defer func() { templateDir = originalDir }()
+
+	dir := t.TempDir()
+	write := func(file, text string) {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair := func() string {
+		w := httptest.NewRecorder()
+		handlePair(w, httptest.NewRequest("GET", "/pair", nil))
+		return w.Body.String()
+	}
+
+	if detail, err := checkTemplates(dir); err != nil || !strings.Contains(detail, "built-in") {
+		t.Errorf("Expected an empty directory to use the built-in templates, got %q %v", detail, err)
+	}
+	if err := setupTemplates(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected a missing directory refused")
+	}
+	write("pairing.html", "typo")
+	if _, err := checkTemplates(dir); err == nil || !strings.Contains(err.Error(), "pair.html") {
+		t.Errorf("Expected a file replacing nothing refused with the list of templates, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "pairing.html"))
+	write("pair.html", "{{if}")
+	if _, err := checkTemplates(dir); err == nil {
+		t.Error("Expected a template that does not parse refused")
+	}
+
+	write("pair.html", `<h1>ACME pairing</h1>{{template "languageSelector"}}<p>{{t "pair.scan"}}</p>{{.URL}}`)
+	if err := setupTemplates(dir); err != nil {
+		t.Fatalf("Expected the directory accepted: %v", err)
+	}
+	if body := pair(); !strings.Contains(body, "ACME pairing") || !strings.Contains(body, "Scan the code") || !strings.Contains(body, `name="lang"`) {
+		t.Errorf("Expected the page from the directory, with messages and the selector, got %s", body)
+	}
+
+	// Edits show without a restart, and pages fall back while they are broken
+	write("language.html", `{{define "languageSelector"}}<nav>languages</nav>{{end}}`)
+	write("pair.html", `<h1>ACME pairing v2</h1>{{template "languageSelector"}}`)
+	if body := pair(); !strings.Contains(body, "ACME pairing v2") || !strings.Contains(body, "<nav>languages</nav>") {
+		t.Errorf("Expected the edited templates, got %s", body)
+	}
+	write("pair.html", "{{.NoSuchField")
+	if body := pair(); !strings.Contains(body, "📷 Pair a Device") || !strings.Contains(body, `name="lang"`) {
+		t.Errorf("Expected the built-in page while the edit does not parse, got %s", body)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	key := useSigningKey(t)
+	originalBackends, originalQueue := backends, retryQueue
+	originalHashKey, originalAPIKey := userHashKey, backendAPIKey
+	defer func() {
+		backends, retryQueue = originalBackends, originalQueue
+		userHashKey, backendAPIKey = originalHashKey, originalAPIKey
+	}()
+	retryQueue = &RetryQueue{}
+	setupUserHash("hash-secret", "backend-key")
+
+	// Each fake backend issues IDs of its own and owns up to the sends it gets
+	var mu sync.Mutex
+	notified := make(map[string][]string) // backend name to the opaque IDs it was asked to notify
+	fake := func(name string, userSent int) *httptest.Server {
+		n := 0
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch r.URL.Path {
+			case "/v1/register":
+				n++
+				id := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s-%d", name, n))))
+				now := time.Now().Unix()
+				json.NewEncoder(w).Encode(map[string]any{
+					"success": true, "token_id": id,
+					"issued_at": now, "signature": signRegistration(t, key, id, now),
+				})
+			case "/v1/notify":
+				var req api.NotificationRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				notified[name] = append(notified[name], req.TokenID)
+				w.Write([]byte(`{"success": true}`))
+			case "/v1/notify-user":
+				if userSent == 0 {
+					writeErrorStatus(w, http.StatusBadRequest, "NO_TOKENS", "No devices registered for this user")
+					return
+				}
+				fmt.Fprintf(w, `{"success": true, "sent_count": %d, "total_tokens": %d}`, userSent, userSent)
+			}
+		}))
+	}
+	servers := map[string]*httptest.Server{"beta": fake("beta", 0), "ios": fake("ios", 2), "pool1": fake("pool1", 1), "pool2": fake("pool2", 0)}
+	for _, s := range servers {
+		defer s.Close()
+	}
+
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "backends.json")
+		os.WriteFile(path, []byte(content), 0o600)
+		return path
+	}
+	for _, bad := range []string{
+		`[]`,
+		`{"name": "a"}`,
+		`[{"name": "Not Valid", "url": "http://localhost"}]`,
+		`[{"name": "a", "url": "http://localhost"}, {"name": "a", "url": "http://localhost"}]`,
+		`[{"name": "a", "url": "ftp://localhost"}]`,
+		`[{"name": "a"}]`,
+	} {
+		if _, err := loadBackends(write(bad)); err == nil {
+			t.Errorf("Expected backends file %s refused", bad)
+		}
+	}
+	if err := setupBackends(write(fmt.Sprintf(`[
+		{"name": "beta", "url": %q, "tags": ["beta"]},
+		{"name": "ios", "url": %q, "platforms": ["ios"]},
+		{"name": "pool1", "url": "%s/"},
+		{"name": "pool2", "url": %q}
+	]`, servers["beta"].URL, servers["ios"].URL, servers["pool1"].URL, servers["pool2"].URL))); err != nil {
+		t.Fatalf("setupBackends failed: %v", err)
+	}
+	if len(backends) != 4 || backends[2].URL != servers["pool1"].URL {
+		t.Fatalf("Unexpected backends %+v", backends)
+	}
+
+	tokenStore = NewTokenStore()
+	register := func(body string) string {
+		w := httptest.NewRecorder()
+		handleRegister(w, httptest.NewRequest("POST", "/register", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected registration %s to succeed, got %d %s", body, w.Code, w.Body.String())
+		}
+		var resp struct {
+			TokenID string `json:"token_id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return tokenStore.Backend(resp.TokenID)
+	}
+	if got := register(`{"encrypted_data": "abc", "platform": "ios", "tag": "beta"}`); got != "beta" {
+		t.Errorf("Expected a tagged registration on its tag's backend, got %q", got)
+	}
+	if got := register(`{"encrypted_data": "abc", "platform": "ios"}`); got != "ios" {
+		t.Errorf("Expected an iOS registration on the iOS backend, got %q", got)
+	}
+	if got := register(`{"encrypted_data": "abc", "platform": "android", "tag": "unknown"}`); got != "pool1" && got != "pool2" {
+		t.Errorf("Expected other registrations in the pool, got %q", got)
+	}
+	first, second := register(`{"encrypted_data": "abc", "platform": "android"}`), register(`{"encrypted_data": "abc", "platform": "android"}`)
+	if first == second {
+		t.Errorf("Expected registrations without a user to take turns, got %q twice", first)
+	}
+	alice := register(`{"encrypted_data": "abc", "platform": "android", "user_id": "alice"}`)
+	for range 3 {
+		if got := register(`{"encrypted_data": "abc", "platform": "web", "user_id": "alice"}`); got != alice {
+			t.Errorf("Expected a user's devices to stay on %q, got %q", alice, got)
+		}
+	}
+	if tokenStore.CountOn(backends[0]) != 1 || tokenStore.CountOn(backends[1]) != 1 || tokenStore.Count() != 9 {
+		t.Errorf("Unexpected counts per backend: %d tagged, %d iOS, %d in all", tokenStore.CountOn(backends[0]), tokenStore.CountOn(backends[1]), tokenStore.Count())
+	}
+
+	// Every opaque ID is sent to through the backend that issued it
+	if send := sendAll(t, "message=hi"); send.SentCount != 9 {
+		t.Fatalf("Expected all devices reached, got %+v", send)
+	}
+	mu.Lock()
+	for _, id := range tokenStore.GetTokenIDs() {
+		if name := tokenStore.Backend(id); !slices.Contains(notified[name], id) {
+			t.Errorf("Expected %s notified through %q, got %v", id, name, notified)
+		}
+	}
+	mu.Unlock()
+
+	// A user's send asks every backend and adds up the results
+	w := httptest.NewRecorder()
+	handleSendUser(w, formRequest("/send-user", "message=hi&user_id=alice"))
+	if got := w.Header().Get("Location"); got != "/?sent=3&errors=0&removed=0" {
+		t.Errorf("Expected the user send summed over the backends, got %d %q %s", w.Code, got, w.Body.String())
+	}
+
+	// A queued registration goes back to the backend it was routed to
+	op := &retryOp{Backend: "ios", Register: &api.TokenRegistration{EncryptedData: "abc", Platform: "ios"}}
+	retryQueue.Enqueue(op, fmt.Errorf("unavailable"))
+	retryQueue.retry(context.Background(), op, time.Now())
+	if retryQueue.Len() != 0 || tokenStore.Count() != 10 || tokenStore.CountOn(backends[1]) != 2 {
+		t.Errorf("Expected the retried registration stored for the iOS backend, %d queued", retryQueue.Len())
+	}
+
+	// Without a backend taking the platform, the registration is refused
+	backends = backends[:2]
+	w = httptest.NewRecorder()
+	handleRegister(w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"encrypted_data": "abc", "platform": "android"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(ErrNoBackend)) {
+		t.Errorf("Expected NO_BACKEND, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRegistrationRateLimit(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := range 3 {
+		if ok, _ := l.allow("192.0.2.1", now); !ok {
+			t.Fatalf("Expected registration %d of the burst allowed", i+1)
+		}
+	}
+	if ok, wait := l.allow("192.0.2.1", now); ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected the burst spent with a token back in 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := l.allow("192.0.2.2", now); !ok {
+		t.Error("Expected another client IP to have its own burst")
+	}
+	if ok, _ := l.allow("192.0.2.1", now.Add(500*time.Millisecond)); !ok {
+		t.Error("Expected a token back after 1/rate")
+	}
+	l.allow("192.0.2.3", now.Add(2*time.Minute))
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected the refilled buckets forgotten, got %d", len(l.buckets))
+	}
+	if newRateLimiter(0, 10) != nil {
+		t.Error("Expected a zero rate to disable limiting")
+	}
+
+	originalLimiter := registerLimiter
+	defer func() { registerLimiter = originalLimiter }()
+	registerLimiter = newRateLimiter(0.1, 1)
+	handler := limitRegistrations(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	register := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/register", strings.NewReader("{}")))
+		return w
+	}
+	if w := register(); w.Code != http.StatusTeapot {
+		t.Fatalf("Expected the first registration through, got %d", w.Code)
+	}
+	w := register()
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "RATE_LIMITED") || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("Expected 429 RATE_LIMITED with Retry-After 10, got %d %q %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var historyFile = flag.String("history-file", "", "Persist the send history to this JSON file (or HISTORY_FILE); with --redis-url it is kept in Redis instead")
+
+// maxHistory is how many sends the history keeps, dropping the oldest
+const maxHistory = 1000
+
+// SendRecord is one send as kept in the history. Per-user sends do not name
+// the user, so the history holds no more about users than the token store.
+type SendRecord struct {
+	Time         time.Time `json:"time"`
+	Target       string    `json:"target"` // "all", "user" or "csv"
+	Title        string    `json:"title"`
+	Message      string    `json:"message"`
+	TargetCount  int       `json:"target_count"`
+	SentCount    int       `json:"sent_count"`
+	ErrorCount   int       `json:"error_count"`
+	RemovedCount int       `json:"removed_count"`
+	QueuedCount  int       `json:"queued_count"`
+	Error        string    `json:"error,omitempty"` // why the send failed as a whole
+	InitiatedBy  string    `json:"initiated_by"`    // "form" or "api"
+	Admin        string    `json:"admin,omitempty"` // the admin account, if any
+	ClientIP     string    `json:"client_ip"`
+}
+
+// SendHistory keeps the most recent sends, oldest first, in memory, in a
+// file, or in a Redis list shared by the replicas
+type SendHistory struct {
+	mu      sync.Mutex
+	records []SendRecord
+	file    string
+	shared  *redisHistory
+}
+
+var sendHistory = &SendHistory{}
+
+// OpenSendHistory returns a history persisted to path, loading the sends
+// saved there by an earlier run. A missing file starts an empty history.
+func OpenSendHistory(path string) (*SendHistory, error) {
+	h := &SendHistory{file: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history file: %v", err)
+	}
+	if err := json.Unmarshal(data, &h.records); err != nil {
+		return nil, fmt.Errorf("failed to parse history file: %v", err)
+	}
+	return h, nil
+}
+
+// Add records a send. Failing to persist it is logged, as the send itself
+// has already happened.
+func (h *SendHistory) Add(ctx context.Context, record SendRecord) {
+	if h.shared != nil {
+		if err := h.shared.Add(ctx, record); err != nil {
+			loggerFromContext(ctx).Error("Failed to record send in Redis", "error", err)
+		}
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record)
+	if len(h.records) > maxHistory {
+		h.records = h.records[len(h.records)-maxHistory:]
+	}
+	if err := h.save(); err != nil {
+		loggerFromContext(ctx).Error("Failed to save send history", "file", h.file, "error", err)
+	}
+}
+
+// Recent returns up to n sends, newest first
+func (h *SendHistory) Recent(ctx context.Context, n int) ([]SendRecord, error) {
+	if h.shared != nil {
+		return h.shared.Recent(ctx, n)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := make([]SendRecord, 0, min(n, len(h.records)))
+	for i := len(h.records) - 1; i >= 0 && len(records) < n; i-- {
+		records = append(records, h.records[i])
+	}
+	return records, nil
+}
+
+// save writes the history to its file, if it has one, through a temporary
+// file like the token store. The caller holds h.mu.
+func (h *SendHistory) save() error {
+	if h.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(h.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := h.file + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, h.file)
+}
+
+// redisHistory keeps the sends in a Redis list, newest first, as JSON SendRecords
+type redisHistory struct {
+	client *redisClient
+	key    string
+}
+
+func (r *redisHistory) Add(ctx context.Context, record SendRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal send record: %v", err)
+	}
+	if _, err := r.client.do(ctx, "LPUSH", r.key, string(data)); err != nil {
+		return err
+	}
+	_, err = r.client.do(ctx, "LTRIM", r.key, "0", strconv.Itoa(maxHistory-1))
+	return err
+}
+
+func (r *redisHistory) Recent(ctx context.Context, n int) ([]SendRecord, error) {
+	reply, err := r.client.do(ctx, "LRANGE", r.key, "0", strconv.Itoa(n-1))
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected LRANGE reply %T", reply)
+	}
+	records := make([]SendRecord, len(items))
+	for i, item := range items {
+		data, _ := item.(string)
+		if err := json.Unmarshal([]byte(data), &records[i]); err != nil {
+			return nil, fmt.Errorf("failed to parse send record: %v", err)
+		}
+	}
+	return records, nil
+}
+
+// setupSendHistory persists the history to the --history-file flag or
+// HISTORY_FILE, or keeps it in Redis next to the shared opaque IDs, when set
+func setupSendHistory(path, redisURL string) error {
+	if path == "" {
+		path = os.Getenv("HISTORY_FILE")
+	}
+	if redisURL == "" {
+		redisURL = os.Getenv("REDIS_URL")
+	}
+	if path != "" && redisURL != "" {
+		return fmt.Errorf("--history-file and --redis-url cannot be combined")
+	}
+	if redisURL != "" {
+		client, err := newRedisClient(redisURL, *redisTimeout)
+		if err != nil {
+			return err
+		}
+		sendHistory = &SendHistory{shared: &redisHistory{client: client, key: *redisKey + ":history"}}
+		return nil
+	}
+	if path == "" {
+		return nil
+	}
+	h, err := OpenSendHistory(path)
+	if err != nil {
+		return err
+	}
+	sendHistory = h
+	slog.Info("Send history loaded", "file", path, "total", len(h.records))
+	return nil
+}
+
+// recordSend adds a send made by the request r to the history
+func recordSend(r *http.Request, initiatedBy string, record SendRecord) {
+	record.Time = time.Now().UTC()
+	record.InitiatedBy = initiatedBy
+	record.ClientIP = getClientIP(r)
+	if account := accountFromContext(r.Context()); account != nil {
+		record.Admin = account.Name
+	}
+	sendHistory.Add(r.Context(), record)
+}
+
+// historyLimit reads the limit query parameter, defaulting to 100
+func historyLimit(r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 100, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n > 0 && n <= maxHistory
+}
+
+// APIHistoryResponse is returned by GET /api/history
+type APIHistoryResponse struct {
+	Success bool         `json:"success"`
+	Count   int          `json:"count"`
+	Sends   []SendRecord `json:"sends"`
+}
+
+// handleAPIHistory lists the most recent sends, newest first
+func handleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	limit, ok := historyLimit(r)
+	if !ok {
+		writeError(w, ErrInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxHistory))
+		return
+	}
+	records, err := sendHistory.Recent(r.Context(), limit)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to read send history", "error", err)
+		writeError(w, ErrInternal, "Failed to read send history")
+		return
+	}
+	writeJSON(w, r, APIHistoryResponse{Success: true, Count: len(records), Sends: records})
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	limit, ok := historyLimit(r)
+	if !ok {
+		writeError(w, ErrInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxHistory))
+		return
+	}
+	records, err := sendHistory.Recent(r.Context(), limit)
+	if err != nil {
+		logger.Error("Failed to read send history", "error", err)
+		writeError(w, ErrInternal, "Failed to read send history")
+		return
+	}
+
+	t := pageTemplate(w, r, "history")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, records); err != nil {
+		logger.Error("Error executing template", "error", err)
+	}
+}
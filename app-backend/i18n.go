@@ -0,0 +1,155 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLanguage is used when nothing the browser asks for is available,
+// and for any message a catalog lacks
+const defaultLanguage = "en"
+
+// languageCookie remembers the language picked with the selector
+const languageCookie = "lang"
+
+// catalog is the web interface's text in one language, by message key.
+// Messages are fmt formats; those used with thtml may contain markup.
+type catalog struct {
+	Code     string
+	Name     string // the language's own name, for the selector
+	messages map[string]string
+}
+
+// catalogs are the languages of locales/, by code
+var catalogs = loadCatalogs()
+
+// loadCatalogs reads the embedded catalogs, named after their language code
+func loadCatalogs() map[string]*catalog {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(fmt.Sprintf("failed to list message catalogs: %v", err))
+	}
+	catalogs := make(map[string]*catalog, len(files))
+	for _, f := range files {
+		data, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(fmt.Sprintf("failed to read message catalog %s: %v", f.Name(), err))
+		}
+		c := &catalog{Code: strings.TrimSuffix(f.Name(), path.Ext(f.Name()))}
+		if err := json.Unmarshal(data, &c.messages); err != nil {
+			panic(fmt.Sprintf("failed to parse message catalog %s: %v", f.Name(), err))
+		}
+		c.Name = c.messages["language.name"]
+		catalogs[c.Code] = c
+	}
+	return catalogs
+}
+
+// languages lists the catalogs for the selector, by code
+func languages() []*catalog {
+	list := make([]*catalog, 0, len(catalogs))
+	for _, c := range catalogs {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// text formats the message for key, falling back to the default language
+// and then to the key itself
+func (c *catalog) text(key string, args ...any) string {
+	format, ok := c.messages[key]
+	if !ok {
+		format, ok = catalogs[defaultLanguage].messages[key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// html formats a message containing markup, escaping the arguments
+func (c *catalog) html(key string, args ...any) template.HTML {
+	escaped := make([]any, len(args))
+	for i, arg := range args {
+		switch arg.(type) {
+		case int, int64:
+			escaped[i] = arg
+		default:
+			escaped[i] = template.HTMLEscapeString(fmt.Sprint(arg))
+		}
+	}
+	return template.HTML(c.text(key, escaped...))
+}
+
+// preferredLanguage picks the available language the Accept-Language header
+// ranks highest, ignoring regions; "" when there is none
+func preferredLanguage(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := catalogs[base]; ok && q > bestQ {
+			best, bestQ = base, q
+		}
+	}
+	return best
+}
+
+// requestLanguage is the catalog for r: the ?lang= of the selector, which is
+// remembered in a cookie, then that cookie, then Accept-Language
+func requestLanguage(w http.ResponseWriter, r *http.Request) *catalog {
+	if c, ok := catalogs[r.URL.Query().Get("lang")]; ok {
+		http.SetCookie(w, &http.Cookie{
+			Name:     languageCookie,
+			Value:    c.Code,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return c
+	}
+	if cookie, err := r.Cookie(languageCookie); err == nil {
+		if c, ok := catalogs[cookie.Value]; ok {
+			return c
+		}
+	}
+	if c, ok := catalogs[preferredLanguage(r.Header.Get("Accept-Language"))]; ok {
+		return c
+	}
+	return catalogs[defaultLanguage]
+}
+
+// funcs are the template functions of the pages in the language: "t" and
+// "thtml" for messages, "lang" and "languages" for the selector
+func (c *catalog) funcs() template.FuncMap {
+	return template.FuncMap{
+		"t":         c.text,
+		"thtml":     c.html,
+		"lang":      func() string { return c.Code },
+		"languages": languages,
+	}
+}
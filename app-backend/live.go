@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// liveKeepAlive is how often /events sends a comment so proxies keep the
+// stream open. The token count is re-read then too, picking up the
+// registrations of other replicas.
+const liveKeepAlive = 15 * time.Second
+
+// liveEventMinInterval bounds how often /events sends during a large send
+const liveEventMinInterval = 250 * time.Millisecond
+
+// LiveStatus is what /events pushes to the home page
+type LiveStatus struct {
+	TokenCount int           `json:"token_count"`
+	Send       *sendProgress `json:"send,omitempty"` // the latest send to all devices
+}
+
+// sendProgress is how far a send to all devices has got
+type sendProgress struct {
+	sendResult
+	TotalTokens int  `json:"total_tokens"`
+	Done        bool `json:"done"`
+}
+
+// Finished counts the opaque IDs the send is through with
+func (p *sendProgress) Finished() int { return p.SentCount + p.ErrorCount + p.QueuedCount }
+
+// liveUpdates tracks what the home page shows. Watchers wait on changed,
+// which is closed and replaced on every change, like a broadcastJob in the
+// notification backend.
+type liveUpdates struct {
+	mu      sync.Mutex
+	send    *sendProgress
+	changed chan struct{}
+}
+
+var live = &liveUpdates{changed: make(chan struct{})}
+
+// notify wakes every watcher. The caller holds l.mu.
+func (l *liveUpdates) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// tokensChanged is called when an opaque ID is added or removed
+func (l *liveUpdates) tokensChanged() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notify()
+}
+
+// sendProgressed records how far the current send to all devices has got
+func (l *liveUpdates) sendProgressed(result sendResult, total int, done bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.send = &sendProgress{sendResult: result, TotalTokens: total, Done: done}
+	l.notify()
+}
+
+// snapshot returns the latest send and the channel closed on the next change
+func (l *liveUpdates) snapshot() (*sendProgress, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.send, l.changed
+}
+
+// handleEvents streams LiveStatus as server-sent events, one whenever the
+// token count or a send's progress changes
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+
+	var last []byte
+	for {
+		send, changed := live.snapshot()
+		data, _ := json.Marshal(LiveStatus{TokenCount: tokenStore.Count(), Send: send})
+		if string(data) != string(last) {
+			if !writeSSE(w, rc, fmt.Sprintf("event: status\ndata: %s\n\n", data)) {
+				return
+			}
+			last = data
+		}
+
+		// Wait for the next change, sending comments to keep the connection alive
+		throttle := time.After(liveEventMinInterval)
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			if !writeSSE(w, rc, ": keep-alive\n\n") {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-serverShutdown.stopping:
+			// The page reconnects to another replica, or to this one restarted
+			return
+		}
+		select {
+		case <-throttle:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes one chunk of the stream and flushes it, extending the write
+// deadline so --write-timeout bounds each write rather than the whole stream
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, chunk string) bool {
+	if *writeTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+	if _, err := fmt.Fprint(w, chunk); err != nil {
+		return false
+	}
+	rc.Flush()
+	return true
+}
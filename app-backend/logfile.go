@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// Log file configuration; logs go to stderr when --log-file is empty
+	logFile        = flag.String("log-file", "", "Write logs to this file instead of stderr")
+	logMaxSizeMB   = flag.Int("log-max-size", 100, "Rotate the log file when it exceeds this size in MB (0 disables)")
+	logRotateEvery = flag.Duration("log-rotate-every", 24*time.Hour, "Rotate the log file at this interval (0 disables)")
+	logMaxBackups  = flag.Int("log-max-backups", 7, "Number of rotated log files to keep (0 keeps all)")
+)
+
+// openLogOutput returns the writer logs should go to
+func openLogOutput(path string) (io.Writer, error) {
+	if path == "" {
+		return os.Stderr, nil
+	}
+	return openRotatingFile(path, int64(*logMaxSizeMB)<<20, *logRotateEvery, *logMaxBackups)
+}
+
+// rotatingFile is an io.Writer that appends to a log file and rotates it by
+// size and age. Rotated files are renamed to path.YYYYMMDD-HHMMSS.mmm.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	interval time.Duration
+	backups  int
+	now      func() time.Time
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// openRotatingFile opens (or creates) the log file, appending to existing content
+func openRotatingFile(path string, maxSize int64, interval time.Duration, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		interval: interval,
+		backups:  backups,
+		now:      time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// A failed rotation keeps the current file, and is tried again on the
+	// next write
+	var rotateErr error
+	if f.shouldRotate(len(p)) {
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Close closes the current log file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+func (f *rotatingFile) shouldRotate(next int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(next) > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && f.now().Sub(f.openedAt) >= f.interval
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = f.now()
+	return nil
+}
+
+// rotate renames the current file aside, starts a new one and prunes old
+// backups. The current file stays open until its successor is, so on error
+// logs keep going to it, under the backup name if the rename succeeded.
+func (f *rotatingFile) rotate() error {
+	backup := f.path + "." + f.now().Format("20060102-150405.000")
+	if err := os.Rename(f.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	old.Close()
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the backup limit
+func (f *rotatingFile) prune() {
+	if f.backups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil || len(matches) <= f.backups {
+		return
+	}
+	// The timestamp suffix sorts chronologically
+	sort.Strings(matches)
+	for _, old := range matches[:len(matches)-f.backups] {
+		os.Remove(old)
+	}
+}
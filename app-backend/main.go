@@ -1,20 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"remote-notification/api"
 )
 
 var (
@@ -24,45 +29,112 @@ var (
 	keyFile                = flag.String("key", "key.pem", "Path to TLS private key file")
 	publicKeyPath          = flag.String("public-key", "public_key.pem", "Path to RSA public key file")
 	notificationBackendURL = flag.String("backend-url", "http://localhost:8080", "URL of the notification backend service")
+	backendTimeout         = flag.Duration("backend-timeout", 10*time.Second, "Timeout for a single call to the notification backend")
+	sendConcurrency        = flag.Int("send-concurrency", 8, "How many notifications of a send to all devices are in flight at once")
+	otelEndpoint           = flag.String("otel-endpoint", "", "OTLP/HTTP trace collector endpoint (host:port); empty uses OTEL_EXPORTER_OTLP_ENDPOINT or disables tracing")
+	otelInsecure           = flag.Bool("otel-insecure", false, "Use plain HTTP for the OTLP trace exporter")
 	version                = "dev" // Set by build flags
 )
 
 type TokenRegistration struct {
 	EncryptedData string `json:"encrypted_data"`
 	Platform      string `json:"platform"`
+	// IntegrityToken and Challenge are forwarded for the backend's
+	// --play-integrity-package and --require-challenge
+	IntegrityToken string `json:"integrity_token,omitempty"`
+	Challenge      string `json:"challenge,omitempty"`
+	// Optional device metadata, forwarded for the backend's listings and stats
+	AppVersion  string `json:"app_version,omitempty"`
+	OSVersion   string `json:"os_version,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+	DeviceModel string `json:"device_model,omitempty"`
+	// UserID names the app user owning the device; only its keyed hash leaves this service
+	UserID string `json:"user_id,omitempty"`
+	// Tag picks the backend with --backends-file, such as a region; it is not forwarded
+	Tag string `json:"tag,omitempty"`
 }
 
-type NotificationRequest struct {
-	TokenID       string `json:"token_id"`
-	PublicKeyHash string `json:"public_key_hash,omitempty"`
-	Title         string `json:"title"`
-	Body          string `json:"body"`
-}
-
-// TokenStore holds opaque token identifiers in memory only
+// TokenStore holds opaque token identifiers in memory, optionally saved to
+// a file (see OpenTokenStore) or shared between replicas (see NewSharedTokenStore)
 // Deliberately separate from any user data for privacy
 type TokenStore struct {
 	mu       sync.RWMutex
-	tokenIDs map[string]time.Time // opaque_token_id -> registration time
+	tokenIDs map[string]storedTokenID // opaque_token_id -> registration
+	file     string                   // --token-file; empty for memory only
+	shared   SharedTokenIDs           // nil unless replicas share their IDs
+}
+
+// storedTokenID is what the app backend keeps per opaque ID
+type storedTokenID struct {
+	registeredAt time.Time
+	notifySecret string // from the backend's registration response, needed by /v1/notify
+	backend      string // the backend that issued the ID; empty for the first
+}
+
+func (s storedTokenID) record() tokenRecord {
+	return tokenRecord{RegisteredAt: s.registeredAt, NotifySecret: s.notifySecret, Backend: s.backend}
+}
+
+func (r tokenRecord) stored() storedTokenID {
+	return storedTokenID{registeredAt: r.RegisteredAt, notifySecret: r.NotifySecret, backend: r.Backend}
 }
 
 func NewTokenStore() *TokenStore {
 	return &TokenStore{
-		tokenIDs: make(map[string]time.Time),
+		tokenIDs: make(map[string]storedTokenID),
 	}
 }
 
-func (ts *TokenStore) AddTokenID(tokenID string) {
+// AddTokenID stores an opaque ID with the notify secret the backend issued for it
+func (ts *TokenStore) AddTokenID(tokenID, notifySecret string) {
+	ts.AddTokenIDAt(tokenID, notifySecret, "")
+}
+
+// AddTokenIDAt stores an opaque ID issued by the named backend, "" being the first
+func (ts *TokenStore) AddTokenIDAt(tokenID, notifySecret, backend string) {
+	stored := storedTokenID{registeredAt: time.Now(), notifySecret: notifySecret, backend: backend}
 	ts.mu.Lock()
-	defer ts.mu.Unlock()
-	ts.tokenIDs[tokenID] = time.Now()
+	ts.tokenIDs[tokenID] = stored
+	// The ID stays usable until the next restart even if it cannot be saved
+	if err := ts.save(); err != nil {
+		slog.Error("Failed to save token file", "error", err)
+	}
+	total := len(ts.tokenIDs)
+	ts.mu.Unlock()
+	if ts.shared != nil {
+		if err := ts.shared.Put(context.Background(), tokenID, stored.record()); err != nil {
+			slog.Error("Failed to share opaque token ID, only this replica can send to it", "token_id", tokenID, "error", err)
+		}
+	}
+	live.tokensChanged()
 
 	// Safe to log opaque IDs (they reveal nothing about actual tokens)
-	log.Printf("Opaque token ID stored: %s...%s (total: %d)",
-		tokenID[:8], tokenID[len(tokenID)-8:], len(ts.tokenIDs))
+	slog.Info("Opaque token ID stored", "token_id", tokenID, "total", total)
 }
 
+// RemoveTokenID forgets an opaque ID the backend reports as stale or an admin deletes
+func (ts *TokenStore) RemoveTokenID(tokenID string) {
+	ts.mu.Lock()
+	delete(ts.tokenIDs, tokenID)
+	if err := ts.save(); err != nil {
+		slog.Error("Failed to save token file", "error", err)
+	}
+	total := len(ts.tokenIDs)
+	ts.mu.Unlock()
+	if ts.shared != nil {
+		if err := ts.shared.Delete(context.Background(), tokenID); err != nil {
+			slog.Error("Failed to remove shared opaque token ID", "token_id", tokenID, "error", err)
+		}
+	}
+	live.tokensChanged()
+
+	slog.Info("Opaque token ID removed", "token_id", tokenID, "total", total)
+}
+
+// GetTokenIDs lists every opaque ID, first refreshing the local copy of a
+// shared store so that NotifySecret knows the IDs of other replicas too
 func (ts *TokenStore) GetTokenIDs() []string {
+	ts.refresh()
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 	tokenIDs := make([]string, 0, len(ts.tokenIDs))
@@ -72,41 +144,66 @@ func (ts *TokenStore) GetTokenIDs() []string {
 	return tokenIDs
 }
 
-func (ts *TokenStore) Count() int {
+// NotifySecret returns the notify secret stored with an opaque ID
+func (ts *TokenStore) NotifySecret(tokenID string) string {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
-	return len(ts.tokenIDs)
+	return ts.tokenIDs[tokenID].notifySecret
 }
 
-// RequestLog represents a structured log entry for HTTP requests
-type RequestLog struct {
-	Timestamp    time.Time `json:"timestamp"`
-	Method       string    `json:"method"`
-	Path         string    `json:"path"`
-	RemoteAddr   string    `json:"remote_addr"`
-	UserAgent    string    `json:"user_agent"`
-	StatusCode   int       `json:"status_code"`
-	ResponseTime int64     `json:"response_time_ms"`
-	BodySize     int64     `json:"body_size"`
-	Error        string    `json:"error,omitempty"`
+// Backend returns the name of the backend that issued an opaque ID
+func (ts *TokenStore) Backend(tokenID string) string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.tokenIDs[tokenID].backend
 }
 
-// ResponseWriter wrapper to capture status code and response size
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-	bodySize   int64
+// CountOn counts the opaque IDs issued by b
+func (ts *TokenStore) CountOn(b *notificationBackend) int {
+	if !multipleBackends() {
+		return ts.Count()
+	}
+	ts.refresh()
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	n := 0
+	for _, stored := range ts.tokenIDs {
+		if issuer, err := backendNamed(stored.backend); err == nil && issuer == b {
+			n++
+		}
+	}
+	return n
 }
 
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
+// Registrations lists every opaque ID with its registration time, oldest first
+func (ts *TokenStore) Registrations() []TokenInfo {
+	ts.refresh()
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	tokens := make([]TokenInfo, 0, len(ts.tokenIDs))
+	for tokenID, stored := range ts.tokenIDs {
+		tokens = append(tokens, TokenInfo{TokenID: tokenID, RegisteredAt: stored.registeredAt})
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].RegisteredAt.Equal(tokens[j].RegisteredAt) {
+			return tokens[i].RegisteredAt.Before(tokens[j].RegisteredAt)
+		}
+		return tokens[i].TokenID < tokens[j].TokenID
+	})
+	return tokens
 }
 
-func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
-	size, err := lrw.ResponseWriter.Write(b)
-	lrw.bodySize += int64(size)
-	return size, err
+func (ts *TokenStore) Count() int {
+	if ts.shared != nil {
+		n, err := ts.shared.Count(context.Background())
+		if err == nil {
+			return n
+		}
+		slog.Warn("Failed to count shared token IDs, using local copy", "error", err)
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return len(ts.tokenIDs)
 }
 
 var (
@@ -114,372 +211,676 @@ var (
 	publicKeyHash string
 )
 
-// loggingMiddleware wraps HTTP handlers to provide structured logging
-func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		// Create logging response writer
-		lrw := &loggingResponseWriter{
-			ResponseWriter: w,
-			statusCode:     200, // Default status code
-		}
-		
-		// Call the next handler
-		next(lrw, r)
-		
-		// Calculate response time
-		responseTime := time.Since(start).Milliseconds()
-		
-		// Create structured log entry
-		logEntry := RequestLog{
-			Timestamp:    start,
-			Method:       r.Method,
-			Path:         r.URL.Path,
-			RemoteAddr:   getClientIP(r),
-			UserAgent:    r.UserAgent(),
-			StatusCode:   lrw.statusCode,
-			ResponseTime: responseTime,
-			BodySize:     lrw.bodySize,
-		}
-		
-		// Add error field for non-2xx responses
-		if lrw.statusCode >= 400 {
-			logEntry.Error = http.StatusText(lrw.statusCode)
-		}
-		
-		// Log as JSON
-		logJSON, err := json.Marshal(logEntry)
-		if err != nil {
-			log.Printf("Error marshaling log entry: %v", err)
-			return
+func main() {
+	flag.Parse()
+
+	logOutput, err := openLogOutput(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening log file: %v\n", err)
+		os.Exit(2)
+	}
+	if err := setupLogging(logOutput, *logLevel, *logFormat, *logPrivacy); err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring logging: %v\n", err)
+		os.Exit(2)
+	}
+
+	slog.Info("App Backend Server starting", "version", version, "git_commit", gitCommit, "build_date", buildDate)
+	slog.Info("Configuration",
+		"port", *port,
+		"listen", *listenAddr,
+		"tls_cert", *certFile,
+		"tls_key", *keyFile,
+		"autocert_domain", *autocertDomain,
+		"public_key", *publicKeyPath,
+		"backend_url", *notificationBackendURL,
+		"backends_file", *backendsFile,
+		"backend_timeout", *backendTimeout,
+		"backend_connect_timeout", *backendConnectTimeout,
+		"backend_retries", *backendRetries,
+		"backend_ca", *backendCAFile,
+		"register_rate", *registerRate,
+		"register_burst", *registerBurst,
+		"trusted_proxies", *trustedProxiesFlag,
+		"otel_endpoint", *otelEndpoint,
+		"log_level", *logLevel,
+		"log_format", *logFormat,
+		"log_file", *logFile,
+		"log_privacy", *logPrivacy,
+		"debug_addr", *debugAddr,
+		"metrics_addr", *metricsAddr,
+		"sentry_environment", *sentryEnvironment,
+		"read_header_timeout", *readHeaderTimeout,
+		"read_timeout", *readTimeout,
+		"write_timeout", *writeTimeout,
+		"idle_timeout", *idleTimeout,
+		"token_file", *tokenFile,
+		"admins_file", *adminsFile,
+		"audit_file", *auditFile,
+		"public_url", *publicURLFlag,
+		"template_dir", *templateDirFlag,
+		"redis_key", *redisKey,
+	)
+
+	setupUserHash(*userHashKeyFlag, *backendAPIKeyFlag)
+	if err := setupBackendClient(*backendCAFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring the backend client: %v\n", err)
+		os.Exit(2)
+	}
+	if err := setupTrustedProxies(*trustedProxiesFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring trusted proxies: %v\n", err)
+		os.Exit(2)
+	}
+	setupAdminAPI(*adminAPIKeyFlag)
+	if err := setupBackends(*backendsFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading the backends file: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Error reporting is set up first so startup failures are captured too
+	flushErrors, err := setupErrorReporting(*sentryDSN, *sentryEnvironment)
+	if err != nil {
+		fatal("Error initializing error reporting", "error", err)
+	}
+	defer flushErrors()
+
+	// Preflight mode: validate everything, report and exit without serving
+	if *checkConfig {
+		if !printConfigReport(os.Stdout, runConfigChecks(context.Background())) {
+			os.Exit(1)
 		}
-		
-		log.Printf("REQUEST_LOG: %s", string(logJSON))
+		return
 	}
-}
 
-// getClientIP extracts the real client IP from request headers
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for proxies/load balancers)
-	if xForwardedFor := r.Header.Get("X-Forwarded-For"); xForwardedFor != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ifs := strings.Split(xForwardedFor, ",")
-		if len(ifs) > 0 {
-			return strings.TrimSpace(ifs[0])
+	// Initialize tracing before anything makes outbound calls
+	shutdownTracing, err := setupTracing(context.Background(), *otelEndpoint, *otelInsecure)
+	if err != nil {
+		fatal("Error initializing tracing", "error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Error shutting down tracing", "error", err)
 		}
+	}()
+
+	if err := setupTokenStore(*tokenFile, *redisURL); err != nil {
+		fatal("Error loading token IDs", "error", err)
 	}
-	
-	// Check X-Real-IP header (for nginx)
-	if xRealIP := r.Header.Get("X-Real-IP"); xRealIP != "" {
-		return xRealIP
+	if err := setupSendHistory(*historyFile, *redisURL); err != nil {
+		fatal("Error loading send history", "error", err)
 	}
-		
-	// Fall back to RemoteAddr
-	// Remove port if present
-	if idx := strings.LastIndex(r.RemoteAddr, ":"); idx != -1 {
-		return r.RemoteAddr[:idx]
+	if err := setupMessageTemplates(*messageTemplatesFile, *redisURL); err != nil {
+		fatal("Error loading message templates", "error", err)
+	}
+	if err := setupRetryQueue(*retryQueueFile); err != nil {
+		fatal("Error loading retry queue", "error", err)
+	}
+	if err := setupAdmins(*adminsFile); err != nil {
+		fatal("Error loading admin accounts", "error", err)
+	}
+	if err := setupAuditLog(*auditFile); err != nil {
+		fatal("Error opening audit log", "error", err)
+	}
+	if err := setupPairing(*publicURLFlag); err != nil {
+		fatal("Error configuring the pairing page", "error", err)
+	}
+	if err := setupTemplates(*templateDirFlag); err != nil {
+		fatal("Error loading page templates", "error", err)
 	}
-	return r.RemoteAddr
-}
-
-func main() {
-	flag.Parse()
 
-	log.Printf("App Backend Server v%s", version)
-	log.Printf("Configuration:")
-	log.Printf("  Port: %s", *port)
-	log.Printf("  TLS Cert: %s", *certFile)
-	log.Printf("  TLS Key: %s", *keyFile)
-	log.Printf("  Public Key: %s", *publicKeyPath)
-	log.Printf("  Backend URL: %s", *notificationBackendURL)
-	
 	// Load public key and compute hash
 	publicKeyPEM, err := readPublicKeyPEM(*publicKeyPath)
 	if err != nil {
-		log.Fatalf("Error loading public key: %v", err)
+		fatal("Error loading public key", "error", err)
 	}
 	publicKeyHash = computePublicKeyHash(publicKeyPEM)
-	log.Printf("Public key hash computed: %s", publicKeyHash[:16]+"...")
+	publicKey, err = parsePublicKey(publicKeyPEM)
+	if err != nil {
+		fatal("Error loading public key", "error", err)
+	}
+	slog.Info("Public key hash computed", "public_key_hash", publicKeyHash[:16]+"...")
+
+	if *debugAddr != "" {
+		startDebugServer(*debugAddr)
+	}
+	if *metricsAddr != "" {
+		startMetricsServer(*metricsAddr)
+	}
+	startBackendMonitor(*backendStatusInterval)
+	registerLimiter = newRateLimiter(*registerRate, *registerBurst)
+
+	// Public endpoints use their own mux so debug handlers registered on
+	// http.DefaultServeMux (pprof, expvar) are never exposed here
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", loggingMiddleware(limitRegistrations(handleRegister)))
+	mux.HandleFunc("/register/challenge", loggingMiddleware(limitRegistrations(handleRegisterChallenge)))
+	mux.HandleFunc("/send-all", loggingMiddleware(requireRole(RoleSender, handleSendAll)))
+	mux.HandleFunc("/preview", loggingMiddleware(requireRole(RoleSender, handlePreview)))
+	mux.HandleFunc("/send-user", loggingMiddleware(requireRole(RoleSender, handleSendUser)))
+	mux.HandleFunc("/send-csv", loggingMiddleware(requireRole(RoleSender, handleSendCSV)))
+	mux.HandleFunc("/version", loggingMiddleware(handleVersion))
+	mux.HandleFunc("/history", loggingMiddleware(requireRole(RoleViewer, handleHistory)))
+	mux.HandleFunc("/pair", loggingMiddleware(requireRole(RoleViewer, handlePair)))
+	mux.HandleFunc("/audit", loggingMiddleware(requireRole(RoleAdmin, handleAudit)))
+	mux.HandleFunc("/events", loggingMiddleware(requireRole(RoleViewer, handleEvents)))
+	mux.HandleFunc("/message-templates", loggingMiddleware(requireRole(RoleSender, handleSaveMessageTemplate)))
+	mux.HandleFunc("/message-templates/delete", loggingMiddleware(requireRole(RoleSender, handleDeleteMessageTemplate)))
+	mux.HandleFunc("/tokens", loggingMiddleware(requireRole(RoleViewer, handleTokens)))
+	mux.HandleFunc("/tokens/delete", loggingMiddleware(requireRole(RoleAdmin, handleTokenDelete)))
+	mux.HandleFunc("/tokens/remove-stale", loggingMiddleware(requireRole(RoleAdmin, handleTokenRemoveStale)))
+	mux.HandleFunc("/tokens/export", loggingMiddleware(requireRole(RoleViewer, handleTokenExport)))
+	mux.HandleFunc("/api/send", loggingMiddleware(requireAPIRole(RoleSender, requireJSON(handleAPISend))))
+	mux.HandleFunc("/api/preview", loggingMiddleware(requireAPIRole(RoleSender, requireJSON(handleAPIPreview))))
+	mux.HandleFunc("/api/send-csv", loggingMiddleware(requireAPIRole(RoleSender, handleAPISendCSV)))
+	mux.HandleFunc("/api/tokens", loggingMiddleware(requireAPIRole(RoleViewer, handleAPITokens)))
+	mux.HandleFunc("/api/tokens/{id}", loggingMiddleware(requireAPIRole(RoleAdmin, handleAPIToken)))
+	mux.HandleFunc("/api/tokens/remove-stale", loggingMiddleware(requireAPIRole(RoleAdmin, requireJSON(handleAPIRemoveStale))))
+	mux.HandleFunc("/api/tokens/export", loggingMiddleware(requireAPIRole(RoleViewer, handleTokenExport)))
+	mux.HandleFunc("/api/status", loggingMiddleware(requireAPIRole(RoleViewer, handleAPIStatus)))
+	mux.HandleFunc("/api/history", loggingMiddleware(requireAPIRole(RoleViewer, handleAPIHistory)))
+	mux.HandleFunc("/api/audit", loggingMiddleware(requireAPIRole(RoleAdmin, handleAPIAudit)))
+	mux.HandleFunc("/api/admins", loggingMiddleware(requireAPIRole(RoleAdmin, handleAPIAdmins)))
+	mux.HandleFunc("/api/admins/{name}", loggingMiddleware(requireAPIRole(RoleAdmin, requireJSON(handleAPIAdmin))))
+	mux.HandleFunc("/api/admins/{name}/api-key", loggingMiddleware(requireAPIRole(RoleAdmin, handleAPIAdminKey)))
+	mux.HandleFunc("/", loggingMiddleware(requireRole(RoleViewer, handleHome)))
+
+	domains, err := autocertDomains(*autocertDomain)
+	if err != nil {
+		fatal("Error configuring autocert", "error", err)
+	}
+	tlsConfig, err := setupAutocert(domains, *autocertCache, *autocertEmail)
+	if err != nil {
+		fatal("Error configuring autocert", "error", err)
+	}
 
-	http.HandleFunc("/register", loggingMiddleware(handleRegister))
-	http.HandleFunc("/send-all", loggingMiddleware(handleSendAll))
-	http.HandleFunc("/", loggingMiddleware(handleHome))
+	listener, err := createListener(*listenAddr, *port)
+	if err != nil {
+		fatal("Failed to open listener", "error", err)
+	}
 
-	log.Printf("App Backend Server starting on HTTPS port %s", *port)
-	log.Printf("Web interface available at: https://localhost:%s", *port)
-	log.Printf("Android emulator can access at: https://10.0.2.2:%s/", *port)
+	slog.Info("App Backend Server listening",
+		"addr", listener.Addr().String(),
+		"web_interface", "https://localhost:"+*port,
+		"android_emulator_url", "https://10.0.2.2:"+*port+"/",
+	)
 
-	if err := http.ListenAndServeTLS(":"+*port, *certFile, *keyFile, nil); err != nil {
-		log.Fatal("Server failed to start:", err)
+	server := newHTTPServer(tracingHandler(gzipHandler(mux)))
+	certPath, keyPath := *certFile, *keyFile
+	if tlsConfig != nil {
+		// Certificates come from tlsConfig.GetCertificate
+		server.TLSConfig, certPath, keyPath = tlsConfig, "", ""
+	}
+	if err := serveUntilSignal(server, func() error { return server.ServeTLS(listener, certPath, keyPath) }); err != nil {
+		fatal("Server failed to start", "error", err)
 	}
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
 		return
 	}
 
 	var reg TokenRegistration
 	if err := json.Unmarshal(body, &reg); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
 		return
 	}
 
 	if reg.EncryptedData == "" {
-		http.Error(w, "Encrypted data is required", http.StatusBadRequest)
+		writeError(w, ErrMissingField, "Encrypted data is required")
+		return
+	}
+	if reg.UserID != "" && userHashKey == "" {
+		logger.Warn("Ignoring user_id of registration: --user-hash-key is not set")
+	}
+
+	backend, err := routeRegistration(reg)
+	if err != nil {
+		logger.Warn("Registration matches no backend", "platform", reg.Platform, "tag", reg.Tag)
+		registrationsTotal.inc("refused")
+		writeError(w, ErrNoBackend, err.Error())
 		return
 	}
 
 	// Forward to notification backend first to get opaque ID
-	opaqueID, err := forwardTokenToBackend(reg)
+	registered, err := forwardTokenToBackend(r.Context(), backend, reg)
+	if err != nil && isRetryable(err) {
+		// The device cannot be handed its opaque ID now, but will be sent to
+		// once the backend takes the registration
+		forwarded := reg.toBackend()
+		if qerr := retryQueue.Enqueue(&retryOp{Backend: backend.storedName(), Register: &forwarded}, err); qerr == nil {
+			logger.Warn("Backend unavailable, registration queued for retry", "error", err)
+			registrationsTotal.inc("queued")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"queued":  true,
+				"message": "Backend unavailable; the registration will be retried",
+			})
+			return
+		}
+	}
 	if err != nil {
-		log.Printf("Failed to forward encrypted data to backend: %v", err)
-		http.Error(w, "Failed to register token with backend", http.StatusInternalServerError)
+		logger.Error("Failed to forward encrypted data to backend", "backend", backend.Name, "error", err)
+		// Relay the backend's verdict on the token itself (e.g. DECRYPT_FAILED) so
+		// the client can act on it; anything else is the backend's problem
+		var be *backendError
+		if errors.As(err, &be) && be.isClientError() {
+			registrationsTotal.inc("refused")
+			writeErrorStatus(w, be.Status, be.Code, be.Message)
+			return
+		}
+		registrationsTotal.inc("failed")
+		writeError(w, ErrBackendUnavailable, "Failed to register token with backend")
 		return
 	}
 
-	// Store opaque ID in memory (privacy: no user data association, opaque identifier)
-	tokenStore.AddTokenID(opaqueID)
+	// Store opaque ID only (privacy: no user data association, opaque identifier)
+	tokenStore.AddTokenIDAt(registered.TokenID, registered.NotifySecret, backend.storedName())
+	registrationsTotal.inc("registered")
 
+	// The signed fields are passed on so the app can verify them; the notify secret stays here
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
 		"success":      true,
 		"message":      "Encrypted token registered successfully",
 		"platform":     reg.Platform,
 		"total_tokens": tokenStore.Count(),
+		"token_id":     registered.TokenID,
+		"issued_at":    registered.IssuedAt,
+		"signature":    registered.Signature,
 	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// handleRegisterChallenge relays a challenge for the next registration from
+// the backend it will go to, picked from the platform and tag query
+// parameters as /register picks it
+func handleRegisterChallenge(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	backend, err := routeRegistration(TokenRegistration{Platform: query.Get("platform"), Tag: query.Get("tag")})
+	if err != nil {
+		writeError(w, ErrNoBackend, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *backendTimeout)
+	defer cancel()
+	challenge, err := backendAPI(ctx, backend).Challenge(ctx)
+	if err != nil {
+		err = backendCallError(err)
+		logger.Error("Failed to get a challenge from backend", "backend", backend.Name, "error", err)
+		var be *backendError
+		if errors.As(err, &be) && be.isClientError() {
+			writeErrorStatus(w, be.Status, be.Code, be.Message)
+			return
+		}
+		writeError(w, ErrBackendUnavailable, "Failed to get a challenge from backend")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(challenge); err != nil {
+		logger.Error("Error encoding response", "error", err)
 	}
 }
 
 func handleSendAll(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected send-all form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
 		return
 	}
 
 	message := r.FormValue("message")
 	if message == "" {
-		http.Error(w, "Message is required", http.StatusBadRequest)
+		writeError(w, ErrMissingField, "Message is required")
+		return
+	}
+	title, message, err := fillPlaceholders(r.FormValue("title"), message, formVariable(r))
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid message: "+err.Error())
+		return
+	}
+	title, ok := notificationTitle(title)
+	if !ok {
+		writeError(w, ErrInvalidRequest, titleTooLong)
 		return
 	}
 
 	tokenIDs := tokenStore.GetTokenIDs()
 	if len(tokenIDs) == 0 {
-		http.Error(w, "No tokens registered", http.StatusBadRequest)
+		writeError(w, ErrNoTokens, "No tokens registered")
+		return
+	}
+
+	if !sendAllRunning.CompareAndSwap(false, true) {
+		writeError(w, ErrSendInProgress, "A send to all devices is already running")
 		return
 	}
 
-	successCount := 0
-	errorCount := 0
+	recordAudit(r, auditSendAll, sendAuditDetail(title, message, len(tokenIDs)))
 
-	// Send individual notification for each token ID
-	for _, tokenID := range tokenIDs {
-		notifReq := NotificationRequest{
-			TokenID:       tokenID,
-			PublicKeyHash: publicKeyHash,
-			Title:         "App Notification",
-			Body:          message,
-		}
+	// The send outlives the request, keeping its logger and trace; the home
+	// page follows its progress
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+	serverShutdown.sends.Add(1)
+	go func() {
+		defer serverShutdown.sends.Done()
+		defer sendAllRunning.Store(false)
+		result := sendToAll(r.Context(), tokenIDs, title, message)
+		recordSend(r, "form", result.record(title, message, len(tokenIDs)))
+	}()
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sendAuditDetail describes a send to all devices in the audit log
+func sendAuditDetail(title, message string, targets int) string {
+	return fmt.Sprintf("%s: %s (%d devices)", title, message, targets)
+}
+
+// sendAllRunning is set while a send to all devices runs; a second one is
+// refused rather than sending everything twice after a double click
+var sendAllRunning atomic.Bool
+
+// sendResult counts the outcome of a send to many opaque IDs
+type sendResult struct {
+	SentCount    int `json:"sent_count"`
+	ErrorCount   int `json:"error_count"`
+	RemovedCount int `json:"removed_count"` // stale IDs dropped from the store
+	QueuedCount  int `json:"queued_count"`  // failed but queued for retry, not counted as errors
+}
+
+// record describes a send to all targetCount opaque IDs for the history
+func (res sendResult) record(title, message string, targetCount int) SendRecord {
+	return SendRecord{
+		Target:       "all",
+		Title:        title,
+		Message:      message,
+		TargetCount:  targetCount,
+		SentCount:    res.SentCount,
+		ErrorCount:   res.ErrorCount,
+		RemovedCount: res.RemovedCount,
+		QueuedCount:  res.QueuedCount,
+	}
+}
+
+// defaultTitle is used when a send leaves the title empty
+const defaultTitle = "App Notification"
+
+// maxTitleLength bounds a title in characters; trays cut them far shorter
+const maxTitleLength = 100
+
+var titleTooLong = fmt.Sprintf("Title must be at most %d characters", maxTitleLength)
+
+// notificationTitle returns the title to send for the one given, which may be
+// empty, and false when it is too long
+func notificationTitle(title string) (string, bool) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return defaultTitle, true
+	}
+	return title, utf8.RuneCountInString(title) <= maxTitleLength
+}
+
+// sendToAll sends the notification to each opaque ID, --send-concurrency at a
+// time, dropping those the backend reports as dead
+func sendToAll(ctx context.Context, tokenIDs []string, title, message string) sendResult {
+	var result sendResult
+	serverShutdown.sends.Add(1)
+	defer serverShutdown.sends.Done()
+	defer func(start time.Time) {
+		sendAllDuration.observe(time.Since(start).Seconds())
+		sendAllNotificationsTotal.add(float64(result.SentCount), "sent")
+		sendAllNotificationsTotal.add(float64(result.ErrorCount), "error")
+		sendAllNotificationsTotal.add(float64(result.RemovedCount), "removed")
+		sendAllNotificationsTotal.add(float64(result.QueuedCount), "queued")
+	}(time.Now())
+
+	live.sendProgressed(result, len(tokenIDs), false)
+
+	var mu sync.Mutex
+	forEachConcurrently(len(tokenIDs), func(i int) {
+		outcome := sendOne(ctx, tokenIDs[i], title, message)
+		mu.Lock()
+		result.add(outcome)
+		live.sendProgressed(result, len(tokenIDs), false)
+		mu.Unlock()
+	})
+
+	live.sendProgressed(result, len(tokenIDs), true)
+	return result
+}
+
+// forEachConcurrently calls fn for 0 to n-1 from a bounded pool of
+// --send-concurrency workers, and returns once every call has
+func forEachConcurrently(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for range min(max(1, *sendConcurrency), n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := range n {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// sendOutcome is what became of one notification of a send to all devices
+type sendOutcome int
+
+const (
+	outcomeSent sendOutcome = iota
+	outcomeError
+	outcomeRemoved // failed, and the stale ID was dropped
+	outcomeQueued
+)
+
+func (o sendOutcome) String() string {
+	return [...]string{"sent", "error", "removed", "queued"}[o]
+}
 
-		if err := sendNotificationToBackend(notifReq); err != nil {
-			log.Printf("Failed to send to token ID %s...%s: %v",
-				tokenID[:8], tokenID[len(tokenID)-8:], err)
-			errorCount++
-		} else {
-			successCount++
+func (res *sendResult) add(outcome sendOutcome) {
+	switch outcome {
+	case outcomeSent:
+		res.SentCount++
+	case outcomeError:
+		res.ErrorCount++
+	case outcomeRemoved:
+		res.ErrorCount++
+		res.RemovedCount++
+	case outcomeQueued:
+		res.QueuedCount++
+	}
+}
+
+// sendOne sends the notification to one opaque ID of a send to many devices
+func sendOne(ctx context.Context, tokenID, title, message string) sendOutcome {
+	notifReq := api.NotificationRequest{
+		TokenID:       tokenID,
+		PublicKeyHash: publicKeyHash,
+		Title:         title,
+		Body:          message,
+		NotifySecret:  tokenStore.NotifySecret(tokenID),
+	}
+
+	// Past the shutdown grace period, the rest is left to the retry queue
+	if serverShutdown.checkpointed() {
+		if retryQueue.Enqueue(&retryOp{Notify: &notifReq}, errShuttingDown) == nil {
+			return outcomeQueued
 		}
+		return outcomeError
 	}
 
-	// Redirect back to home with results
-	http.Redirect(w, r, fmt.Sprintf("/?sent=%d&errors=%d", successCount, errorCount), http.StatusSeeOther)
+	err := sendNotificationToBackend(ctx, notifReq)
+	if err == nil {
+		return outcomeSent
+	}
+	loggerFromContext(ctx).Warn("Failed to send notification", "token_id", tokenID, "error", err)
+	if isRetryable(err) && retryQueue.Enqueue(&retryOp{Notify: &notifReq}, err) == nil {
+		return outcomeQueued
+	}
+	// The backend says this ID can never be delivered to again
+	if isStaleToken(err) {
+		tokenStore.RemoveTokenID(tokenID)
+		return outcomeRemoved
+	}
+	return outcomeError
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
 	data := struct {
-		TokenCount  int
-		SentCount   string
-		ErrorCount  string
-		ShowResults bool
+		TokenCount   int
+		SentCount    string
+		ErrorCount   string
+		RemovedCount string
+		QueuedCount  string
+		RetryQueue   int
+		ShowResults  bool
+		UserSends    bool
+		Persistent   bool
+		CSRFToken    string
+		Templates    []MessageTemplate
+		SavedAs      string
+		Backends     []backendView
+		NameBackends bool
+		Send         *sendProgress
+		Account      *AdminAccount
+		CanSend      bool
+		CanAudit     bool
 	}{
-		TokenCount:  tokenStore.Count(),
-		SentCount:   r.URL.Query().Get("sent"),
-		ErrorCount:  r.URL.Query().Get("errors"),
-		ShowResults: r.URL.Query().Get("sent") != "",
+		TokenCount:   tokenStore.Count(),
+		SentCount:    r.URL.Query().Get("sent"),
+		ErrorCount:   r.URL.Query().Get("errors"),
+		RemovedCount: r.URL.Query().Get("removed"),
+		QueuedCount:  r.URL.Query().Get("queued"),
+		RetryQueue:   retryQueue.Len(),
+		ShowResults:  r.URL.Query().Get("sent") != "",
+		UserSends:    userHashKey != "",
+		Persistent:   tokenStore.file != "" || tokenStore.shared != nil,
+		CSRFToken:    csrfToken(w, r),
+		SavedAs:      r.URL.Query().Get("template"),
+		Backends:     backendViews(),
+		NameBackends: multipleBackends(),
+		Account:      accountFromContext(r.Context()),
+		CanSend:      may(r, RoleSender),
+		CanAudit:     may(r, RoleAdmin),
+	}
+	data.Send, _ = live.snapshot()
+	templates, err := messageTemplates.List(r.Context())
+	if err != nil {
+		// The forms still work without them
+		loggerFromContext(r.Context()).Warn("Failed to list message templates", "error", err)
 	}
+	data.Templates = templates
 
-	t := template.Must(template.New("home").Parse(homeTemplate))
+	t := pageTemplate(w, r, "home")
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := t.Execute(w, data); err != nil {
-		log.Printf("Error executing template: %v", err)
+		loggerFromContext(r.Context()).Error("Error executing template", "error", err)
 	}
 }
 
-func forwardTokenToBackend(reg TokenRegistration) (string, error) {
-	data, err := json.Marshal(reg)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal token: %v", err)
-	}
-
-	resp, err := http.Post(*notificationBackendURL+"/register", "application/json", bytes.NewBuffer(data))
-	if err != nil {
-		return "", fmt.Errorf("failed to post to backend: %v", err)
+// toBackend is the registration as forwarded, with the user ID replaced by its hash
+func (reg TokenRegistration) toBackend() api.TokenRegistration {
+	return api.TokenRegistration{
+		EncryptedData:  reg.EncryptedData,
+		Platform:       reg.Platform,
+		IntegrityToken: reg.IntegrityToken,
+		Challenge:      reg.Challenge,
+		AppVersion:     reg.AppVersion,
+		OSVersion:      reg.OSVersion,
+		Locale:         reg.Locale,
+		DeviceModel:    reg.DeviceModel,
+		UserHash:       userHash(reg.UserID),
 	}
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			log.Printf("Error closing response body: %v", closeErr)
-		}
-	}()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("backend returned %d: %s", resp.StatusCode, string(body))
-	}
+// forwardTokenToBackend registers reg with backend b and returns its
+// response once the signature over the opaque ID checks out
+func forwardTokenToBackend(ctx context.Context, b *notificationBackend, reg TokenRegistration) (*api.RegisterResponse, error) {
+	return registerOnBackend(ctx, b, reg.toBackend())
+}
 
-	// Parse response to get opaque token ID
-	var response struct {
-		Success bool   `json:"success"`
-		TokenID string `json:"token_id"`
-		Message string `json:"message"`
-	}
+// registerOnBackend is forwardTokenToBackend for a registration already
+// stripped of the user ID, as the retry queue keeps them
+func registerOnBackend(ctx context.Context, b *notificationBackend, reg api.TokenRegistration) (_ *api.RegisterResponse, err error) {
+	defer countForwardFailure("register", &err)
+	ctx, cancel := context.WithTimeout(ctx, *backendTimeout)
+	defer cancel()
 
-	body, err := io.ReadAll(resp.Body)
+	response, err := backendAPI(ctx, b).Register(ctx, reg)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
+		return nil, backendCallError(err)
 	}
 
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("failed to parse response: %v", err)
+	if !response.Success || response.TokenID == "" {
+		return nil, fmt.Errorf("backend registration failed: %s", response.Message)
+	}
+	if _, err := api.ParseOpaqueID(response.TokenID); err != nil {
+		return nil, fmt.Errorf("backend returned an unusable token ID: %v", err)
 	}
 
-	if !response.Success || response.TokenID == "" {
-		return "", fmt.Errorf("backend registration failed: %s", response.Message)
+	if err := verifyRegistration(response.TokenID, response.IssuedAt, response.Signature); err != nil {
+		return nil, fmt.Errorf("backend registration not trusted: %v", err)
 	}
 
-	return response.TokenID, nil
+	return response, nil
 }
 
-func sendNotificationToBackend(notifReq NotificationRequest) error {
-	// Create the payload that notification-backend expects on /notify endpoint
-	payload := map[string]string{
-		"token_id": notifReq.TokenID,
-		"title":    notifReq.Title,
-		"body":     notifReq.Body,
-	}
-
-	data, err := json.Marshal(payload)
+// sendNotificationToBackend notifies one opaque ID through the backend that issued it
+func sendNotificationToBackend(ctx context.Context, notifReq api.NotificationRequest) (err error) {
+	defer countForwardFailure("notify", &err)
+	b, err := backendNamed(tokenStore.Backend(notifReq.TokenID))
 	if err != nil {
-		return fmt.Errorf("failed to marshal notification: %v", err)
+		return err
 	}
+	ctx, cancel := context.WithTimeout(ctx, *backendTimeout)
+	defer cancel()
 
-	resp, err := http.Post(*notificationBackendURL+"/notify", "application/json", bytes.NewBuffer(data))
+	response, err := backendAPI(ctx, b).Notify(ctx, notifReq)
 	if err != nil {
-		return fmt.Errorf("failed to post to backend: %v", err)
+		return backendCallError(err)
 	}
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			log.Printf("Error closing response body: %v", closeErr)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("backend returned %d: %s", resp.StatusCode, string(body))
+	// Backends from before dry runs ignore the field
+	if notifReq.DryRun && !response.DryRun {
+		return errDryRunUnsupported
 	}
-
 	return nil
 }
 
-const homeTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <title>App Backend - Notification Service</title>
-    <style>
-        body { font-family: Arial, sans-serif; max-width: 800px; margin: 0 auto; padding: 20px; }
-        .header { background: #f5f5f5; padding: 20px; border-radius: 8px; margin-bottom: 20px; }
-        .stats { background: #e8f4fd; padding: 15px; border-radius: 8px; margin-bottom: 20px; }
-        .send-form { background: #f8f9fa; padding: 20px; border-radius: 8px; }
-        .results { background: #d4edda; padding: 15px; border-radius: 8px; margin-bottom: 20px; border: 1px solid #c3e6cb; }
-        .error-results { background: #f8d7da; border: 1px solid #f5c6cb; }
-        textarea { width: 100%; height: 100px; margin: 10px 0; padding: 10px; border: 1px solid #ddd; border-radius: 4px; }
-        button { background: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 4px; cursor: pointer; font-size: 16px; }
-        button:hover { background: #0056b3; }
-        button:disabled { background: #6c757d; cursor: not-allowed; }
-        .privacy-note { background: #fff3cd; padding: 15px; border-radius: 8px; margin-top: 20px; border: 1px solid #ffeaa7; }
-    </style>
-</head>
-<body>
-    <div class="header">
-        <h1>App Backend - Notification Service</h1>
-        <p>Intermediate server for privacy-separated device token management</p>
-    </div>
-
-    <div class="stats">
-        <h2>📱 Device Tokens</h2>
-        <p><strong>{{.TokenCount}}</strong> device tokens currently registered</p>
-        <p><small>Opaque token IDs stored in memory only, no user data association</small></p>
-    </div>
-
-    {{if .ShowResults}}
-    <div class="results {{if ne .ErrorCount "0"}}error-results{{end}}">
-        <h3>📤 Notification Results</h3>
-        <p>✅ Successfully sent to <strong>{{.SentCount}}</strong> devices</p>
-        {{if ne .ErrorCount "0"}}
-        <p>❌ Failed to send to <strong>{{.ErrorCount}}</strong> devices</p>
-        {{end}}
-    </div>
-    {{end}}
-
-    <div class="send-form">
-        <h2>📢 Send Notification to All Devices</h2>
-        {{if gt .TokenCount 0}}
-        <form method="post" action="/send-all">
-            <label for="message">Message:</label>
-            <textarea name="message" id="message" placeholder="Enter your notification message here..." required></textarea>
-            <button type="submit">Send to All {{.TokenCount}} Devices</button>
-        </form>
-        {{else}}
-        <p>No devices registered yet. Register some tokens first.</p>
-        <button disabled>Send to All (No Devices)</button>
-        {{end}}
-    </div>
-
-    <div class="privacy-note">
-        <h3>🔒 Privacy Design</h3>
-        <ul>
-            <li>Only opaque token IDs stored in RAM (lost on restart)</li>
-            <li>No association with user accounts or personal data</li>
-            <li>Actual encrypted tokens stored only in notification backend</li>
-            <li>App backend cannot decrypt or access actual device tokens</li>
-            <li>Individual notification requests use opaque identifiers</li>
-        </ul>
-    </div>
-
-    <script>
-        // Auto-refresh token count every 30 seconds
-        setTimeout(function() {
-            if (!window.location.search.includes('sent=')) {
-                window.location.reload();
-            }
-        }, 30000);
-    </script>
-</body>
-</html>
-`
-
 // readPublicKeyPEM reads a public key PEM file and returns its content
 func readPublicKeyPEM(keyPath string) (string, error) {
 	data, err := os.ReadFile(keyPath)
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var messageTemplatesFile = flag.String("message-templates-file", "", "Persist the saved message templates to this JSON file (or MESSAGE_TEMPLATES_FILE); with --redis-url they are kept in Redis instead")
+
+// maxMessageTemplates bounds how many message templates can be saved
+const maxMessageTemplates = 100
+
+var errTooManyTemplates = fmt.Errorf("at most %d message templates can be saved", maxMessageTemplates)
+
+var (
+	// messageTemplateNamePattern is what the send forms accept as a template name
+	messageTemplateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	// placeholderPattern is a placeholder such as {{start_time}}, as in the
+	// notification backend's templates
+	placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// MessageTemplate is a saved title and message for the send forms
+type MessageTemplate struct {
+	Name      string    `json:"name"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	Variables []string  `json:"variables"` // placeholders used, sorted
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// placeholders lists the distinct placeholders of texts, sorted. Braces that
+// do not form a placeholder are refused, so a typo cannot reach devices.
+func placeholders(texts ...string) ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, text := range texts {
+		for _, m := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+		if rest := placeholderPattern.ReplaceAllString(text, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+			return nil, fmt.Errorf("malformed placeholder; use {{name}} with letters, digits and '_'")
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// fillPlaceholders replaces the placeholders of a send's title and message
+// with the values variable returns. Every placeholder needs a value.
+func fillPlaceholders(title, message string, variable func(name string) string) (string, string, error) {
+	names, err := placeholders(title, message)
+	if err != nil {
+		return "", "", err
+	}
+	for _, name := range names {
+		if variable(name) == "" {
+			return "", "", fmt.Errorf("placeholder {{%s}} needs a value", name)
+		}
+	}
+	fill := func(text string) string {
+		return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+			return variable(placeholderPattern.FindStringSubmatch(placeholder)[1])
+		})
+	}
+	return fill(title), fill(message), nil
+}
+
+// formVariable reads placeholder values from the var_<name> fields of a send form
+func formVariable(r *http.Request) func(string) string {
+	return func(name string) string { return strings.TrimSpace(r.FormValue("var_" + name)) }
+}
+
+// newMessageTemplate checks a template to be saved and lists its placeholders
+func newMessageTemplate(name, title, message string) (MessageTemplate, error) {
+	if !messageTemplateNamePattern.MatchString(name) {
+		return MessageTemplate{}, fmt.Errorf("names are 1-64 letters, digits, '-' or '_'")
+	}
+	if message == "" {
+		return MessageTemplate{}, fmt.Errorf("message is required")
+	}
+	title = strings.TrimSpace(title)
+	if _, ok := notificationTitle(title); !ok {
+		return MessageTemplate{}, fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+	variables, err := placeholders(title, message)
+	if err != nil {
+		return MessageTemplate{}, err
+	}
+	return MessageTemplate{Name: name, Title: title, Message: message, Variables: variables, UpdatedAt: time.Now().UTC()}, nil
+}
+
+// MessageTemplates keeps the saved message templates by name, in memory, in
+// a file, or in a Redis hash shared by the replicas
+type MessageTemplates struct {
+	mu        sync.Mutex
+	templates map[string]MessageTemplate
+	file      string
+	shared    *redisMessageTemplates
+}
+
+var messageTemplates = &MessageTemplates{templates: make(map[string]MessageTemplate)}
+
+// OpenMessageTemplates returns templates persisted to path, loading those
+// saved there by an earlier run. A missing file starts with none.
+func OpenMessageTemplates(path string) (*MessageTemplates, error) {
+	mt := &MessageTemplates{templates: make(map[string]MessageTemplate), file: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mt, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message templates file: %v", err)
+	}
+	if err := json.Unmarshal(data, &mt.templates); err != nil {
+		return nil, fmt.Errorf("failed to parse message templates file: %v", err)
+	}
+	return mt, nil
+}
+
+// Put saves a template, replacing the one of the same name
+func (mt *MessageTemplates) Put(ctx context.Context, tmpl MessageTemplate) error {
+	if mt.shared != nil {
+		templates, err := mt.shared.List(ctx)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(templates, func(t MessageTemplate) bool { return t.Name == tmpl.Name }) && len(templates) >= maxMessageTemplates {
+			return errTooManyTemplates
+		}
+		return mt.shared.Put(ctx, tmpl)
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if _, ok := mt.templates[tmpl.Name]; !ok && len(mt.templates) >= maxMessageTemplates {
+		return errTooManyTemplates
+	}
+	mt.templates[tmpl.Name] = tmpl
+	return mt.save()
+}
+
+// Delete removes a template and reports whether it existed
+func (mt *MessageTemplates) Delete(ctx context.Context, name string) (bool, error) {
+	if mt.shared != nil {
+		return mt.shared.Delete(ctx, name)
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if _, ok := mt.templates[name]; !ok {
+		return false, nil
+	}
+	delete(mt.templates, name)
+	return true, mt.save()
+}
+
+// List returns every template, sorted by name
+func (mt *MessageTemplates) List(ctx context.Context) ([]MessageTemplate, error) {
+	var templates []MessageTemplate
+	if mt.shared != nil {
+		var err error
+		if templates, err = mt.shared.List(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		mt.mu.Lock()
+		for _, tmpl := range mt.templates {
+			templates = append(templates, tmpl)
+		}
+		mt.mu.Unlock()
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// save writes the templates to their file, if there is one, through a
+// temporary file like the token store. The caller holds mt.mu.
+func (mt *MessageTemplates) save() error {
+	if mt.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(mt.templates, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := mt.file + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, mt.file)
+}
+
+// redisMessageTemplates keeps the templates in one Redis hash, name -> JSON MessageTemplate
+type redisMessageTemplates struct {
+	client *redisClient
+	key    string
+}
+
+func (r *redisMessageTemplates) Put(ctx context.Context, tmpl MessageTemplate) error {
+	data, err := json.Marshal(tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message template: %v", err)
+	}
+	_, err = r.client.do(ctx, "HSET", r.key, tmpl.Name, string(data))
+	return err
+}
+
+func (r *redisMessageTemplates) Delete(ctx context.Context, name string) (bool, error) {
+	reply, err := r.client.do(ctx, "HDEL", r.key, name)
+	return reply == int64(1), err
+}
+
+func (r *redisMessageTemplates) List(ctx context.Context) ([]MessageTemplate, error) {
+	reply, err := r.client.do(ctx, "HGETALL", r.key)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("redis: unexpected HGETALL reply %T", reply)
+	}
+	templates := make([]MessageTemplate, 0, len(fields)/2)
+	for i := 1; i < len(fields); i += 2 {
+		data, _ := fields[i].(string)
+		var tmpl MessageTemplate
+		if err := json.Unmarshal([]byte(data), &tmpl); err != nil {
+			return nil, fmt.Errorf("failed to parse message template: %v", err)
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+// setupMessageTemplates persists the templates to the --message-templates-file
+// flag or MESSAGE_TEMPLATES_FILE, or keeps them in Redis next to the shared
+// opaque IDs, when set
+func setupMessageTemplates(path, redisURL string) error {
+	if path == "" {
+		path = os.Getenv("MESSAGE_TEMPLATES_FILE")
+	}
+	if redisURL == "" {
+		redisURL = os.Getenv("REDIS_URL")
+	}
+	if path != "" && redisURL != "" {
+		return fmt.Errorf("--message-templates-file and --redis-url cannot be combined")
+	}
+	if redisURL != "" {
+		client, err := newRedisClient(redisURL, *redisTimeout)
+		if err != nil {
+			return err
+		}
+		messageTemplates = &MessageTemplates{shared: &redisMessageTemplates{client: client, key: *redisKey + ":message-templates"}}
+		return nil
+	}
+	if path == "" {
+		return nil
+	}
+	mt, err := OpenMessageTemplates(path)
+	if err != nil {
+		return err
+	}
+	messageTemplates = mt
+	slog.Info("Message templates loaded", "file", path, "total", len(mt.templates))
+	return nil
+}
+
+// handleSaveMessageTemplate is the "save as template" button of the send form
+func handleSaveMessageTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected message template form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+		return
+	}
+	tmpl, err := newMessageTemplate(r.FormValue("template_name"), r.FormValue("title"), r.FormValue("message"))
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid message template: "+err.Error())
+		return
+	}
+	if err := messageTemplates.Put(r.Context(), tmpl); err == errTooManyTemplates {
+		writeError(w, ErrInvalidRequest, "Invalid message template: "+err.Error())
+		return
+	} else if err != nil {
+		logger.Error("Failed to save message template", "name", tmpl.Name, "error", err)
+		writeError(w, ErrInternal, "Failed to save message template")
+		return
+	}
+	logger.Info("Message template saved", "name", tmpl.Name, "variables", tmpl.Variables)
+	recordAudit(r, auditTemplateSave, tmpl.Name)
+	http.Redirect(w, r, "/?template="+url.QueryEscape(tmpl.Name), http.StatusSeeOther)
+}
+
+// handleDeleteMessageTemplate removes a saved template
+func handleDeleteMessageTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected message template form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+		return
+	}
+	name := r.FormValue("template_name")
+	found, err := messageTemplates.Delete(r.Context(), name)
+	if err != nil {
+		logger.Error("Failed to delete message template", "name", name, "error", err)
+		writeError(w, ErrInternal, "Failed to delete message template")
+		return
+	}
+	if !found {
+		writeError(w, ErrTemplateNotFound, "Message template not found")
+		return
+	}
+	logger.Info("Message template deleted", "name", name)
+	recordAudit(r, auditTemplateDelete, name)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricsAddr = flag.String("metrics-addr", "", "Address for a Prometheus /metrics listener (e.g. :9464); empty serves /metrics on --debug-addr only")
+
+// metric is one family in the Prometheus text exposition format
+type metric interface {
+	write(w io.Writer)
+}
+
+// metrics lists every family in the order /metrics shows them
+var metrics []metric
+
+func register[M metric](m M) M {
+	metrics = append(metrics, m)
+	return m
+}
+
+var (
+	httpRequestsTotal = register(newCounterVec("app_backend_http_requests_total",
+		"Requests served, by route pattern and status code", "route", "code"))
+	registrationsTotal = register(newCounterVec("app_backend_registrations_total",
+		"Device registrations, by outcome: registered, queued, refused, failed or rate_limited", "outcome"))
+	forwardFailuresTotal = register(newCounterVec("app_backend_forward_failures_total",
+		"Calls the notification backend did not take, by call (register, notify, notify_user) and reason (unreachable, server, client, invalid)", "call", "reason"))
+	backendRequestDuration = register(newHistogramVec("app_backend_backend_request_duration_seconds",
+		"Latency of calls to the notification backend, by path and status code",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "path", "code"))
+	sendAllDuration = register(newHistogramVec("app_backend_send_all_duration_seconds",
+		"Duration of sends to all devices", []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300}))
+	sendAllNotificationsTotal = register(newCounterVec("app_backend_send_all_notifications_total",
+		"Notifications of sends to all devices, by outcome: sent, error, removed or queued", "outcome"))
+
+	_ = register(&gaugeFunc{name: "app_backend_registered_tokens", help: "Opaque token IDs stored",
+		value: func() float64 { return float64(tokenStore.Count()) }})
+	_ = register(&gaugeFunc{name: "app_backend_retry_queue_length", help: "Registrations and notifications waiting to be retried",
+		value: func() float64 { return float64(retryQueue.Len()) }})
+)
+
+// labelEscaper escapes label values as the exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelSet renders label pairs such as route="/register",code="200"
+func labelSet(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// series formats a sample line's name and labels
+func series(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter with one value per label set
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // by rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	key := labelSet(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(values ...string) { c.add(1, values...) }
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s %s\n", series(c.name, key), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with one series per label set
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelSet(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatValue(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s %s\n", series(h.name+"_sum", key), formatValue(s.sum))
+		fmt.Fprintf(w, "%s %d\n", series(h.name+"_count", key), s.count)
+	}
+}
+
+// gaugeFunc is a gauge read when /metrics is scraped
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.value()))
+}
+
+// handleMetrics serves every metric in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// forwardFailureReason classifies a failed call to the notification backend
+func forwardFailureReason(err error) string {
+	var be *backendError
+	var ue *unreachableError
+	switch {
+	case errors.As(err, &ue):
+		return "unreachable"
+	case errors.As(err, &be) && be.isClientError():
+		return "client"
+	case errors.As(err, &be):
+		return "server"
+	default:
+		// An answer this service could not use, such as a bad signature
+		return "invalid"
+	}
+}
+
+// countForwardFailure counts *err, if set, as a failed call, for deferring
+// with a named result
+func countForwardFailure(call string, err *error) {
+	if *err != nil {
+		forwardFailuresTotal.inc(call, forwardFailureReason(*err))
+	}
+}
+
+// metricsTransport times every call to the notification backend
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	backendRequestDuration.observe(time.Since(start).Seconds(), req.URL.Path, code)
+	return resp, err
+}
+
+// startMetricsServer serves /metrics on its own listener
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	go func() {
+		slog.Info("Metrics server listening", "addr", addr)
+		server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: *readHeaderTimeout}
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+}
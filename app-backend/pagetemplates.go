@@ -0,0 +1,131 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var templateDirFlag = flag.String("template-dir", "", "Directory of page templates overriding the built-in ones by file name, re-read on every page view (or TEMPLATE_DIR)")
+
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// templateDir is resolved from the flag or environment at startup; empty
+// serves only the built-in templates
+var templateDir string
+
+// sharedTemplates are parsed into every page
+var sharedTemplates = []string{"language.html"}
+
+// setupTemplates checks the template directory, preferring the flag
+func setupTemplates(dir string) error {
+	if dir == "" {
+		dir = os.Getenv("TEMPLATE_DIR")
+	}
+	if dir == "" {
+		return nil
+	}
+	if _, err := checkTemplates(dir); err != nil {
+		return err
+	}
+	templateDir = dir
+	return nil
+}
+
+// checkTemplates parses the templates of dir, which must each replace a
+// built-in one. It is also the --check-config report.
+func checkTemplates(dir string) (string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read template directory: %v", err)
+	}
+	builtin, _ := fs.Glob(builtinTemplates, "templates/*.html")
+	var overridden []string
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".html" {
+			continue
+		}
+		file := f.Name()
+		if _, err := fs.Stat(builtinTemplates, "templates/"+file); err != nil {
+			return "", fmt.Errorf("%s does not replace any of the built-in templates (%s)", file, strings.Join(baseNames(builtin), ", "))
+		}
+		// The shared templates are checked as part of the home page
+		page := strings.TrimSuffix(file, ".html")
+		if slices.Contains(sharedTemplates, file) {
+			page = "home"
+		}
+		if _, err := parsePage(catalogs[defaultLanguage], page, dir); err != nil {
+			return "", err
+		}
+		overridden = append(overridden, file)
+	}
+	if len(overridden) == 0 {
+		return fmt.Sprintf("no templates in %s, using the built-in ones", dir), nil
+	}
+	return fmt.Sprintf("%s from %s", strings.Join(overridden, ", "), dir), nil
+}
+
+func baseNames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, p := range paths {
+		names[i] = filepath.Base(p)
+	}
+	return names
+}
+
+// readTemplate returns the text of a template file, from dir when it has it
+func readTemplate(dir, file string) (string, error) {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err == nil {
+			return string(data), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read template %s: %v", file, err)
+		}
+	}
+	data, err := builtinTemplates.ReadFile("templates/" + file)
+	if err != nil {
+		return "", fmt.Errorf("no template %s: %v", file, err)
+	}
+	return string(data), nil
+}
+
+// parsePage parses the page name.html and the shared templates in the
+// language of c, taking each from dir when it has it
+func parsePage(c *catalog, name, dir string) (*template.Template, error) {
+	t := template.New(name).Funcs(c.funcs())
+	for _, file := range append([]string{name + ".html"}, sharedTemplates...) {
+		text, err := readTemplate(dir, file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.Parse(text); err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %v", file, err)
+		}
+	}
+	return t, nil
+}
+
+// pageTemplate is the page name in the language of r. The template directory
+// is read every time, so edits show on the next page view; while an edit
+// does not parse, the page is served from the built-in templates.
+func pageTemplate(w http.ResponseWriter, r *http.Request, name string) *template.Template {
+	c := requestLanguage(w, r)
+	if templateDir != "" {
+		t, err := parsePage(c, name, templateDir)
+		if err == nil {
+			return t
+		}
+		loggerFromContext(r.Context()).Error("Failed to load page template, using the built-in one", "template", name, "error", err)
+	}
+	return template.Must(parsePage(c, name, ""))
+}
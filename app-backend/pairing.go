@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var publicURLFlag = flag.String("public-url", "", "URL devices reach this service at, shown by the /pair QR code (or PUBLIC_URL); empty uses the address the page was opened at")
+
+// publicURL is resolved from the flag or environment at startup, without a
+// trailing slash
+var publicURL string
+
+// setupPairing checks the URL of the pairing page, preferring the flag
+func setupPairing(rawURL string) error {
+	if rawURL == "" {
+		rawURL = os.Getenv("PUBLIC_URL")
+	}
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid public URL: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("public URL must be an http or https URL with a host, got %q", rawURL)
+	}
+	publicURL = strings.TrimSuffix(rawURL, "/")
+	return nil
+}
+
+// registrationURL is what the pairing QR code encodes: the URL devices post
+// their registration to, and with withKey the public key hash they should
+// find, in the fragment so it never reaches a server
+func registrationURL(r *http.Request, withKey bool) string {
+	base := publicURL
+	if base == "" {
+		// The service only speaks TLS
+		base = "https://" + r.Host
+	}
+	u := base + "/register"
+	if withKey {
+		u += "#public_key_hash=" + publicKeyHash
+	}
+	return u
+}
+
+// handlePair shows a QR code that points a device at this service, or with
+// ?format=svg serves the code alone for slides and printouts
+func handlePair(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	withKey := r.URL.Query().Get("key") == "1"
+	target := registrationURL(r, withKey)
+	code, err := encodeQR([]byte(target))
+	if err != nil {
+		logger.Error("Failed to encode pairing QR code", "url", target, "error", err)
+		writeError(w, ErrInternal, "The registration URL is too long for a QR code")
+		return
+	}
+	if r.URL.Query().Get("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(code.SVG(8)))
+		return
+	}
+
+	data := struct {
+		URL     string
+		QRCode  template.HTML
+		WithKey bool
+		KeyHash string
+	}{
+		URL: target,
+		// Drawn here from modules alone, with nothing of the request in it
+		QRCode:  template.HTML(code.SVG(8)),
+		WithKey: withKey,
+		KeyHash: publicKeyHash,
+	}
+	t := pageTemplate(w, r, "pair")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		logger.Error("Error executing template", "error", err)
+	}
+}
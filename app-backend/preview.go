@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"remote-notification/api"
+)
+
+const (
+	// maxPayloadBytes is FCM's limit on a notification message's payload
+	maxPayloadBytes = 4096
+	// trayTitleLength and trayMessageLength are about how many characters a
+	// collapsed notification shows on a phone; devices vary
+	trayTitleLength   = 40
+	trayMessageLength = 120
+	// maxPreviewDryRuns bounds the opaque IDs tried for the dry run, which
+	// moves on from those the backend no longer knows
+	maxPreviewDryRuns = 3
+)
+
+// errDryRunUnsupported means the backend ignored "dry_run" and delivered
+var errDryRunUnsupported = errors.New("the notification backend does not support dry runs and delivered the notification")
+
+// Outcomes of a preview's dry run
+const (
+	dryRunPassed  = "passed"
+	dryRunFailed  = "failed"
+	dryRunSkipped = "skipped" // no device to check it on
+)
+
+// NotificationPreview is how a send to all devices will look, and whether it
+// can go out
+type NotificationPreview struct {
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+	TrayTitle       string `json:"tray_title"` // as a collapsed notification shows it
+	TrayMessage     string `json:"tray_message"`
+	Truncated       bool   `json:"truncated"` // the tray cuts the title or message
+	PayloadBytes    int    `json:"payload_bytes"`
+	MaxPayloadBytes int    `json:"max_payload_bytes"`
+	TotalTokens     int    `json:"total_tokens"`
+	DryRun          string `json:"dry_run"` // passed, failed or skipped
+	DryRunTokenID   string `json:"dry_run_token_id,omitempty"`
+	DryRunError     string `json:"dry_run_error,omitempty"`
+	Delivered       bool   `json:"delivered,omitempty"` // a backend without dry runs sent it
+	PayloadTooLarge bool   `json:"payload_too_large"`
+	Sendable        bool   `json:"sendable"`
+}
+
+// trayText is s on one line, cut to n characters as a tray would
+func trayText(s string, n int) (string, bool) {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s, false
+	}
+	return string([]rune(s)[:n-1]) + "…", true
+}
+
+// payloadSize is the size of the notification FCM is given for a send
+func payloadSize(title, message string) int {
+	data, _ := json.Marshal(map[string]any{"notification": map[string]string{"title": title, "body": message}})
+	return len(data)
+}
+
+// previewNotification renders a send to the opaque IDs and has the backend
+// check it against one of them in a dry run
+func previewNotification(ctx context.Context, tokenIDs []string, title, message string) NotificationPreview {
+	p := NotificationPreview{
+		Title:           title,
+		Message:         message,
+		PayloadBytes:    payloadSize(title, message),
+		MaxPayloadBytes: maxPayloadBytes,
+		TotalTokens:     len(tokenIDs),
+		DryRun:          dryRunSkipped,
+	}
+	var cutTitle, cutMessage bool
+	p.TrayTitle, cutTitle = trayText(title, trayTitleLength)
+	p.TrayMessage, cutMessage = trayText(message, trayMessageLength)
+	p.Truncated = cutTitle || cutMessage
+	p.PayloadTooLarge = p.PayloadBytes > maxPayloadBytes
+
+	for _, tokenID := range tokenIDs[:min(len(tokenIDs), maxPreviewDryRuns)] {
+		err := sendNotificationToBackend(ctx, api.NotificationRequest{
+			TokenID:      tokenID,
+			Title:        title,
+			Body:         message,
+			NotifySecret: tokenStore.NotifySecret(tokenID),
+			DryRun:       true,
+		})
+		p.DryRunTokenID = tokenID
+		if err == nil {
+			p.DryRun, p.DryRunError = dryRunPassed, ""
+			break
+		}
+		loggerFromContext(ctx).Warn("Preview dry run failed", "token_id", tokenID, "error", err)
+		p.DryRun, p.DryRunError = dryRunFailed, err.Error()
+		p.Delivered = errors.Is(err, errDryRunUnsupported)
+		// A stale ID says nothing about the notification itself
+		if !isStaleToken(err) {
+			break
+		}
+	}
+	p.Sendable = p.TotalTokens > 0 && !p.PayloadTooLarge && p.DryRun == dryRunPassed
+	return p
+}
+
+// handlePreview shows the send-all form's notification before it goes out,
+// with the button that sends it
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected preview form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+		return
+	}
+
+	rawTitle, rawMessage := r.FormValue("title"), r.FormValue("message")
+	if rawMessage == "" {
+		writeError(w, ErrMissingField, "Message is required")
+		return
+	}
+	title, message, err := fillPlaceholders(rawTitle, rawMessage, formVariable(r))
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid message: "+err.Error())
+		return
+	}
+	title, ok := notificationTitle(title)
+	if !ok {
+		writeError(w, ErrInvalidRequest, titleTooLong)
+		return
+	}
+	// The send form posts the text as typed, filling the placeholders again
+	names, _ := placeholders(rawTitle, rawMessage)
+	variables := make(map[string]string, len(names))
+	for _, name := range names {
+		variables["var_"+name] = r.FormValue("var_" + name)
+	}
+
+	data := struct {
+		NotificationPreview
+		RawTitle, RawMessage string
+		Variables            map[string]string
+		CSRFToken            string
+	}{
+		NotificationPreview: previewNotification(r.Context(), tokenStore.GetTokenIDs(), title, message),
+		RawTitle:            rawTitle,
+		RawMessage:          rawMessage,
+		Variables:           variables,
+		CSRFToken:           csrfToken(w, r),
+	}
+	t := pageTemplate(w, r, "preview")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		logger.Error("Error executing template", "error", err)
+	}
+}
+
+// APIPreviewResponse is returned by POST /api/preview
+type APIPreviewResponse struct {
+	Success bool `json:"success"`
+	NotificationPreview
+}
+
+// handleAPIPreview is the JSON form of /preview, taking the body of /api/send
+func handleAPIPreview(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var req APISendRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	if req.Message == "" {
+		writeError(w, ErrMissingField, "Message is required")
+		return
+	}
+	title, message, err := fillPlaceholders(req.Title, req.Message, func(name string) string { return req.Variables[name] })
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid message: "+err.Error())
+		return
+	}
+	title, ok := notificationTitle(title)
+	if !ok {
+		writeError(w, ErrInvalidRequest, titleTooLong)
+		return
+	}
+	preview := previewNotification(r.Context(), tokenStore.GetTokenIDs(), title, message)
+	writeJSON(w, r, APIPreviewResponse{Success: true, NotificationPreview: preview})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	registerRate  = flag.Float64("register-rate", 1, "Registrations per second allowed from one client IP (0 disables rate limiting)")
+	registerBurst = flag.Int("register-burst", 20, "Registrations one client IP may make in a burst before --register-rate applies")
+)
+
+// rateLimiter is a token bucket per client IP: each holds up to burst tokens,
+// refilled at rate a second, and a request spends one
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last brought up to date
+}
+
+// registerLimiter is initialized in main from the rate flags; nil means unlimited
+var registerLimiter *rateLimiter
+
+// newRateLimiter returns a limiter, or nil when rate is not positive
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, burst: math.Max(1, float64(burst)), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow spends a token of key's bucket, or reports how long until one is back
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets, at most once a minute, the buckets that have filled up
+// again, so clients that stopped registering take no memory
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limitRegistrations wraps the register handler with the per-IP limiter,
+// answering 429 with Retry-After once a client IP has spent its burst
+func limitRegistrations(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := registerLimiter
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		ip := getClientIP(r)
+		if ok, wait := limiter.allow(ip, time.Now()); !ok {
+			loggerFromContext(r.Context()).Warn("Registration rate limit exceeded", "client_ip", ip)
+			registrationsTotal.inc("rate_limited")
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Max(1, math.Ceil(wait.Seconds())))))
+			writeError(w, ErrRateLimited, "Too many registrations, retry later")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+var logPrivacy = flag.String("log-privacy", "standard", "Log redaction level: off, standard or strict")
+
+// Privacy levels for log redaction
+const (
+	privacyOff      = "off"      // development only: IDs and IPs logged in full
+	privacyStandard = "standard" // opaque IDs shortened, IPs truncated to their network
+	privacyStrict   = "strict"   // opaque IDs hashed, IPs and user agents removed
+)
+
+// Attributes holding opaque token IDs, client addresses and secrets. Key
+// material is redacted at every privacy level.
+var (
+	opaqueIDAttrs    = map[string]bool{"token_id": true, "opaque_id": true}
+	clientAddrAttrs  = map[string]bool{"remote_addr": true, "client_ip": true}
+	keyMaterialAttrs = map[string]bool{"sos_secret_key": true, "secret": true, "password": true, "authorization": true, "encrypted_data": true, "fcm_token": true}
+)
+
+// opaqueIDPattern matches opaque IDs ("rn1_..." or legacy 64 hex chars)
+// embedded in free text such as SOS object keys inside error messages
+var opaqueIDPattern = regexp.MustCompile(`\brn[1-9][0-9]*_[a-z2-7]+|[0-9a-f]{64}`)
+
+// validatePrivacy checks a --log-privacy value
+func validatePrivacy(level string) error {
+	switch level {
+	case privacyOff, privacyStandard, privacyStrict:
+		return nil
+	}
+	return fmt.Errorf("invalid log privacy %q: must be off, standard or strict", level)
+}
+
+// redactAttr returns a slog ReplaceAttr function applying the privacy level
+// to every attribute, so call sites can log raw values and masking stays
+// consistent across the code base
+func redactAttr(level string) func(groups []string, a slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		var s string
+		switch v := a.Value.Any().(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		default:
+			if keyMaterialAttrs[a.Key] {
+				return slog.String(a.Key, "[REDACTED]")
+			}
+			return a
+		}
+
+		switch {
+		case keyMaterialAttrs[a.Key] || strings.Contains(s, "-----BEGIN"):
+			return slog.String(a.Key, "[REDACTED]")
+		case level == privacyOff:
+			return a
+		case opaqueIDAttrs[a.Key]:
+			return slog.String(a.Key, maskOpaqueID(s, level))
+		case clientAddrAttrs[a.Key]:
+			if level == privacyStrict {
+				return slog.String(a.Key, "[REDACTED]")
+			}
+			return slog.String(a.Key, maskIP(s))
+		case a.Key == "user_agent" && level == privacyStrict:
+			return slog.Attr{}
+		}
+
+		// IDs can also turn up inside messages and errors
+		if opaqueIDPattern.MatchString(s) {
+			s = opaqueIDPattern.ReplaceAllStringFunc(s, func(id string) string {
+				return maskOpaqueID(id, level)
+			})
+			return slog.String(a.Key, s)
+		}
+		return a
+	}
+}
+
+// maskOpaqueID shortens an ID to a prefix, or in strict mode replaces it with
+// a hash that still lets log lines for the same token be correlated
+func maskOpaqueID(id, level string) string {
+	if level == privacyStrict {
+		sum := sha256.Sum256([]byte(id))
+		return "h:" + hex.EncodeToString(sum[:4])
+	}
+	return tokenIDPrefix(id)
+}
+
+// maskIP truncates an address to its /24 (IPv4) or /48 (IPv6) network
+func maskIP(s string) string {
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		if ap, err := netip.ParseAddrPort(s); err == nil {
+			addr = ap.Addr()
+		} else {
+			return "[REDACTED]"
+		}
+	}
+	bits := 48
+	if addr.Is4() || addr.Is4In6() {
+		addr = addr.Unmap()
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "[REDACTED]"
+	}
+	return prefix.String()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient speaks just enough of the Redis protocol (RESP) for the shared
+// token store, over one connection that is redialled after any I/O error.
+// The stores need a handful of hash and list commands, which take less code
+// than a client library brings in with its pooling, retries and dependencies.
+type redisClient struct {
+	addr     string
+	username string // empty for the default user
+	password string
+	db       int
+	tls      *tls.Config // nil for plain TCP
+	timeout  time.Duration
+
+	mu   sync.Mutex // one command at a time on conn
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// redisError is an error reply from the server, after which the connection is still usable
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisClient parses redis://[[username]:password@]host[:port][/db], or
+// rediss:// for TLS
+func newRedisClient(rawURL string, timeout time.Duration) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	c := &redisClient{addr: u.Host, timeout: timeout}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("invalid Redis URL: scheme must be redis or rediss")
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis URL: missing host")
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid Redis URL: database must be a number")
+		}
+	}
+	return c, nil
+}
+
+// do runs one command and returns its reply: a string, int64, nil or []any
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if c.conn == nil {
+		if err := c.connect(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(deadline)
+	reply, err := c.roundTrip(args)
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials the server and authenticates. The caller holds c.mu.
+func (c *redisClient) connect(ctx context.Context, deadline time.Time) error {
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	if c.tls != nil {
+		conn = tls.Client(conn, c.tls)
+	}
+	conn.SetDeadline(deadline)
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+
+	setup := [][]string{}
+	switch {
+	case c.password == "":
+	case c.username != "": // an ACL user, from Redis 6
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	default:
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("failed to set up Redis connection: %v", err)
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command as an array of bulk strings and reads the reply
+func (c *redisClient) roundTrip(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.rd)
+}
+
+// readRedisReply reads one RESP value
+func readRedisReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$', '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if kind == '$' {
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(rd, buf); err != nil {
+				return nil, err
+			}
+			return string(buf[:n]), nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// redisTokenIDs keeps the opaque IDs in one Redis hash, opaque ID -> JSON tokenRecord
+type redisTokenIDs struct {
+	client *redisClient
+	key    string
+}
+
+func (r *redisTokenIDs) Put(ctx context.Context, tokenID string, record tokenRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token record: %v", err)
+	}
+	_, err = r.client.do(ctx, "HSET", r.key, tokenID, string(data))
+	return err
+}
+
+func (r *redisTokenIDs) Delete(ctx context.Context, tokenID string) error {
+	_, err := r.client.do(ctx, "HDEL", r.key, tokenID)
+	return err
+}
+
+func (r *redisTokenIDs) Load(ctx context.Context) (map[string]tokenRecord, error) {
+	reply, err := r.client.do(ctx, "HGETALL", r.key)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("redis: unexpected HGETALL reply %T", reply)
+	}
+	records := make(map[string]tokenRecord, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		tokenID, _ := fields[i].(string)
+		data, _ := fields[i+1].(string)
+		var record tokenRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, fmt.Errorf("failed to parse token record %s: %v", tokenID, err)
+		}
+		records[tokenID] = record
+	}
+	return records, nil
+}
+
+func (r *redisTokenIDs) Count(ctx context.Context) (int, error) {
+	reply, err := r.client.do(ctx, "HLEN", r.key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected HLEN reply %T", reply)
+	}
+	return int(n), nil
+}
+
+// Ping checks the server answers, for the preflight check
+func (r *redisTokenIDs) Ping(ctx context.Context) error {
+	_, err := r.client.do(ctx, "PING")
+	return err
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"remote-notification/api"
+)
+
+var (
+	retryQueueFile = flag.String("retry-queue-file", "", "Persist registrations and notifications waiting for the backend to this JSON file (or RETRY_QUEUE_FILE); empty keeps them in memory only")
+	retryMaxAge    = flag.Duration("retry-max-age", 24*time.Hour, "How long a registration or notification is retried while the backend is unavailable; 0 disables retries")
+)
+
+const (
+	// Retries back off exponentially between these delays
+	retryInitialBackoff = 5 * time.Second
+	retryMaxBackoff     = 10 * time.Minute
+	// maxRetryQueue bounds the queue; further operations fail as before
+	maxRetryQueue = 10000
+	// retryPollInterval is how often the worker looks for due operations
+	retryPollInterval = time.Second
+)
+
+// errRetryQueueFull is returned by Enqueue when the queue holds maxRetryQueue operations
+var errRetryQueueFull = errors.New("retry queue is full")
+
+// retryOp is a registration or notification the backend failed to take. The
+// registration is kept as forwarded, so only the user hash is ever stored.
+type retryOp struct {
+	ID          string                   `json:"id"`
+	Backend     string                   `json:"backend,omitempty"` // of a registration, as stored with its opaque ID
+	Register    *api.TokenRegistration   `json:"register,omitempty"`
+	Notify      *api.NotificationRequest `json:"notify,omitempty"`
+	QueuedAt    time.Time                `json:"queued_at"`
+	Attempts    int                      `json:"attempts"`
+	NextAttempt time.Time                `json:"next_attempt"`
+	LastError   string                   `json:"last_error"`
+	// ChallengeExpires is when the registration's challenge stops being
+	// accepted, and with it any point in retrying
+	ChallengeExpires time.Time `json:"challenge_expires,omitzero"`
+}
+
+func (op *retryOp) kind() string {
+	if op.Register != nil {
+		return "register"
+	}
+	return "notify"
+}
+
+// nextRetry returns when op is attempted again after attempts failures, and
+// false once it is older than --retry-max-age or its registration's
+// challenge expires by then
+func (op *retryOp) nextRetry(attempts int, now time.Time) (time.Time, bool) {
+	next := now.Add(retryBackoff(attempts))
+	if now.Sub(op.QueuedAt) >= *retryMaxAge || !op.ChallengeExpires.IsZero() && !next.Before(op.ChallengeExpires) {
+		return next, false
+	}
+	return next, true
+}
+
+// retryBackoff is the delay before retry number attempts+1
+func retryBackoff(attempts int) time.Duration {
+	delay := retryInitialBackoff
+	for i := 1; i < attempts && delay < retryMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxBackoff)
+}
+
+// unreachableError is a backend call that got no answer at all
+type unreachableError struct{ err error }
+
+func (e *unreachableError) Error() string { return "failed to post to backend: " + e.err.Error() }
+
+// isRetryable reports whether a failed backend call may succeed later: the
+// backend was unreachable or failed on its side, rather than refusing the
+// request or answering something this service cannot use. A dead opaque ID
+// is never retried, though the backend reports an unregistered FCM token
+// with a 500.
+func isRetryable(err error) bool {
+	if isStaleToken(err) {
+		return false
+	}
+	var be *backendError
+	var ue *unreachableError
+	return errors.As(err, &ue) || errors.As(err, &be) && !be.isClientError()
+}
+
+// RetryQueue holds the operations waiting for the backend, oldest first, in
+// memory or persisted to a file
+type RetryQueue struct {
+	mu   sync.Mutex
+	ops  []*retryOp
+	file string
+}
+
+var retryQueue = &RetryQueue{}
+
+// OpenRetryQueue returns a queue persisted to path, loading the operations
+// an earlier run left waiting. A missing file starts an empty queue.
+func OpenRetryQueue(path string) (*RetryQueue, error) {
+	q := &RetryQueue{file: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retry queue file: %v", err)
+	}
+	if err := json.Unmarshal(data, &q.ops); err != nil {
+		return nil, fmt.Errorf("failed to parse retry queue file: %v", err)
+	}
+	return q, nil
+}
+
+// Enqueue adds an operation whose first attempt failed with err. It fails
+// when retries are disabled or the queue is full, leaving the caller to
+// report the original error.
+func (q *RetryQueue) Enqueue(op *retryOp, err error) error {
+	if *retryMaxAge <= 0 {
+		return fmt.Errorf("retries are disabled")
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	now := time.Now().UTC()
+	op.ID, op.QueuedAt, op.Attempts, op.LastError = hex.EncodeToString(b), now, 1, err.Error()
+	if op.Register != nil && op.Register.Challenge != "" {
+		// A malformed challenge gets no further than the backend's refusal
+		op.ChallengeExpires, _ = api.ChallengeExpiry(op.Register.Challenge)
+	}
+	var ok bool
+	if op.NextAttempt, ok = op.nextRetry(1, now); !ok {
+		return fmt.Errorf("the registration's challenge expires before a retry")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.ops) >= maxRetryQueue {
+		return errRetryQueueFull
+	}
+	q.ops = append(q.ops, op)
+	if err := q.save(); err != nil {
+		slog.Error("Failed to save retry queue", "file", q.file, "error", err)
+	}
+	slog.Info("Queued for retry", "id", op.ID, "kind", op.kind(), "error", err, "queued", len(q.ops))
+	return nil
+}
+
+// Len returns how many operations are waiting
+func (q *RetryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ops)
+}
+
+// due returns the operations whose next attempt has come
+func (q *RetryQueue) due(now time.Time) []*retryOp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ops []*retryOp
+	for _, op := range q.ops {
+		if !op.NextAttempt.After(now) {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// finish removes op from the queue, or reschedules it after another failure
+// and reports that it stays queued
+func (q *RetryQueue) finish(op *retryOp, err error, now time.Time) (requeued bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next time.Time
+	if err != nil && isRetryable(err) {
+		next, requeued = op.nextRetry(op.Attempts+1, now)
+	}
+	if requeued {
+		op.Attempts++
+		op.NextAttempt, op.LastError = next, err.Error()
+	} else {
+		for i, queued := range q.ops {
+			if queued == op {
+				q.ops = append(q.ops[:i], q.ops[i+1:]...)
+				break
+			}
+		}
+	}
+	if err := q.save(); err != nil {
+		slog.Error("Failed to save retry queue", "file", q.file, "error", err)
+	}
+	return requeued
+}
+
+// save writes the queue to its file, if it has one, through a temporary
+// file like the token store. The caller holds q.mu.
+func (q *RetryQueue) save() error {
+	if q.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(q.ops, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Notify secrets and encrypted tokens are in here
+	tempFile := q.file + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, q.file)
+}
+
+// retry makes one more attempt at op and applies its outcome to the token store
+func (q *RetryQueue) retry(ctx context.Context, op *retryOp, now time.Time) {
+	var err error
+	switch {
+	case op.Register != nil:
+		var b *notificationBackend
+		var registered *api.RegisterResponse
+		if b, err = backendNamed(op.Backend); err != nil {
+			break
+		}
+		if registered, err = registerOnBackend(ctx, b, *op.Register); err == nil {
+			tokenStore.AddTokenIDAt(registered.TokenID, registered.NotifySecret, op.Backend)
+		}
+	case op.Notify != nil:
+		if err = sendNotificationToBackend(ctx, *op.Notify); isStaleToken(err) {
+			tokenStore.RemoveTokenID(op.Notify.TokenID)
+		}
+	}
+	requeued := q.finish(op, err, now)
+
+	switch {
+	case err == nil:
+		slog.Info("Retry succeeded", "id", op.ID, "kind", op.kind(), "attempts", op.Attempts)
+	case requeued:
+		slog.Warn("Retry failed", "id", op.ID, "kind", op.kind(), "attempts", op.Attempts, "next_attempt", op.NextAttempt, "error", err)
+	default:
+		slog.Error("Giving up on retry", "id", op.ID, "kind", op.kind(), "attempts", op.Attempts, "error", err)
+	}
+}
+
+// run retries due operations one at a time until ctx is done
+func (q *RetryQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(retryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, op := range q.due(time.Now()) {
+			q.retry(ctx, op, time.Now())
+		}
+	}
+}
+
+// setupRetryQueue loads the --retry-queue-file flag or RETRY_QUEUE_FILE, when
+// set, and starts retrying
+func setupRetryQueue(path string) error {
+	if path == "" {
+		path = os.Getenv("RETRY_QUEUE_FILE")
+	}
+	if path != "" {
+		q, err := OpenRetryQueue(path)
+		if err != nil {
+			return err
+		}
+		retryQueue = q
+		slog.Info("Retry queue loaded", "file", path, "queued", q.Len())
+	}
+	if *retryMaxAge > 0 {
+		go retryQueue.run(context.Background())
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	redisURL     = flag.String("redis-url", "", "Share opaque IDs between replicas in Redis (or REDIS_URL), e.g. redis://:password@host:6379/0; rediss:// for TLS")
+	redisKey     = flag.String("redis-key", "app-backend:token-ids", "Redis hash holding the shared opaque IDs")
+	redisTimeout = flag.Duration("redis-timeout", 5*time.Second, "Timeout for a single Redis command")
+)
+
+// SharedTokenIDs is a store of opaque IDs that several app-backend replicas
+// use together, so a device registered through one can be sent to from any.
+// Redis is the only implementation so far.
+type SharedTokenIDs interface {
+	Put(ctx context.Context, tokenID string, record tokenRecord) error
+	Delete(ctx context.Context, tokenID string) error
+	Load(ctx context.Context) (map[string]tokenRecord, error)
+	Count(ctx context.Context) (int, error)
+}
+
+// NewSharedTokenStore returns a store whose opaque IDs live in shared. The
+// local map becomes a copy, refreshed whenever all IDs are read.
+func NewSharedTokenStore(ctx context.Context, shared SharedTokenIDs) (*TokenStore, error) {
+	ts := NewTokenStore()
+	ts.shared = shared
+	records, err := shared.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ts.replace(records)
+	return ts, nil
+}
+
+// replace swaps the local copy for records from the shared store
+func (ts *TokenStore) replace(records map[string]tokenRecord) {
+	tokenIDs := make(map[string]storedTokenID, len(records))
+	for tokenID, record := range records {
+		tokenIDs[tokenID] = record.stored()
+	}
+	ts.mu.Lock()
+	ts.tokenIDs = tokenIDs
+	ts.mu.Unlock()
+}
+
+// refresh picks up the IDs other replicas registered or removed. When the
+// shared store fails the local copy, which has at least this replica's own
+// registrations, is used as it is.
+func (ts *TokenStore) refresh() {
+	if ts.shared == nil {
+		return
+	}
+	records, err := ts.shared.Load(context.Background())
+	if err != nil {
+		slog.Warn("Failed to load shared token IDs, using local copy", "error", err)
+		return
+	}
+	ts.replace(records)
+}
+
+// checkRedis verifies the Redis URL and that the server answers
+func checkRedis(ctx context.Context, rawURL string) (string, error) {
+	client, err := newRedisClient(rawURL, *redisTimeout)
+	if err != nil {
+		return "", err
+	}
+	shared := &redisTokenIDs{client: client, key: *redisKey}
+	if err := shared.Ping(ctx); err != nil {
+		return "", err
+	}
+	n, err := shared.Count(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s, %d opaque IDs in %s", client.addr, n, *redisKey), nil
+}
+
+// setupSharedTokenStore replaces the in-memory store with one shared through Redis
+func setupSharedTokenStore(rawURL string) error {
+	client, err := newRedisClient(rawURL, *redisTimeout)
+	if err != nil {
+		return err
+	}
+	store, err := NewSharedTokenStore(context.Background(), &redisTokenIDs{client: client, key: *redisKey})
+	if err != nil {
+		return err
+	}
+	tokenStore = store
+	slog.Info("Shared opaque token IDs loaded", "redis", client.addr, "key", *redisKey, "total", store.Count())
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long in-flight requests and sends to all devices may run after SIGTERM or SIGINT before the rest of their sends is queued for retry")
+
+// errShuttingDown is why the sends left over at shutdown are queued
+var errShuttingDown = errors.New("server shutting down")
+
+// shutdownState lets long-running handlers react to a shutdown
+type shutdownState struct {
+	stopping   chan struct{} // closed once shutdown starts
+	checkpoint chan struct{} // closed once the grace period is over
+	sends      sync.WaitGroup
+}
+
+func newShutdownState() *shutdownState {
+	return &shutdownState{stopping: make(chan struct{}), checkpoint: make(chan struct{})}
+}
+
+var serverShutdown = newShutdownState()
+
+// checkpointed reports whether sends should stop and queue what they have left
+func (s *shutdownState) checkpointed() bool {
+	select {
+	case <-s.checkpoint:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveUntilSignal runs serve until it fails or SIGTERM or SIGINT arrives,
+// then shuts server down
+func serveUntilSignal(server *http.Server, serve func() error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal kills the process as usual
+	stop()
+	shutdown(server, *shutdownTimeout)
+	return nil
+}
+
+// waitForSends waits until no send to all devices is running, or ctx is done
+func waitForSends(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		serverShutdown.sends.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops accepting connections and waits up to timeout for in-flight
+// requests. Sends to all devices still running then queue the opaque IDs they
+// have not reached, and are given one backend call's time to do so.
+func shutdown(server *http.Server, timeout time.Duration) {
+	slog.Info("Shutting down", "timeout", timeout)
+	close(serverShutdown.stopping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		// Sends started from the form run on after their request
+		err = waitForSends(ctx)
+	}
+	if err != nil {
+		slog.Warn("In-flight requests did not finish in time, queueing the rest of their sends", "error", err)
+		close(serverShutdown.checkpoint)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *backendTimeout+time.Second)
+		defer cancel()
+		if waitForSends(ctx) != nil {
+			slog.Error("Sends still running at exit")
+		}
+	}
+
+	if n := retryQueue.Len(); n > 0 && retryQueue.file == "" {
+		slog.Warn("Retry queue lost at exit; set --retry-queue-file to keep it", "queued", n)
+	}
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// maxRegistrationSkew bounds how far a signed registration's issued_at may be
+// from our clock, so an old response cannot be replayed indefinitely
+const maxRegistrationSkew = 5 * time.Minute
+
+// publicKey verifies the backend's registration signatures
+var publicKey *rsa.PublicKey
+
+// parsePublicKey decodes a PEM RSA public key in PKIX or PKCS#1 form
+func parsePublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	return key, nil
+}
+
+// verifyRegistration checks the backend signed this opaque ID recently: an
+// RSA-PSS SHA-256 signature over "remote-notification registration v1\n<token_id>\n<issued_at>"
+func verifyRegistration(tokenID string, issuedAt int64, signature string) error {
+	if publicKey == nil {
+		return fmt.Errorf("public key not loaded")
+	}
+	if signature == "" {
+		return fmt.Errorf("registration response is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %v", err)
+	}
+	digest := sha256.Sum256(fmt.Appendf(nil, "remote-notification registration v1\n%s\n%d", tokenID, issuedAt))
+	if err := rsa.VerifyPSS(publicKey, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+		return fmt.Errorf("invalid registration signature: %v", err)
+	}
+	if skew := time.Since(time.Unix(issuedAt, 0)).Abs(); skew > maxRegistrationSkew {
+		return fmt.Errorf("registration was signed %v away from our clock", skew.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var tokenFile = flag.String("token-file", "", "Persist opaque IDs and notify secrets to this JSON file (or TOKEN_FILE); empty keeps them in memory only")
+
+// tokenRecord is one opaque ID as written to --token-file or a shared store.
+// Nothing about the user or device is kept, only what sending to the ID needs.
+type tokenRecord struct {
+	RegisteredAt time.Time `json:"registered_at"`
+	NotifySecret string    `json:"notify_secret,omitempty"`
+	Backend      string    `json:"backend,omitempty"` // with --backends-file, the one that issued it
+}
+
+// OpenTokenStore returns a store persisted to path, loading the opaque IDs
+// saved there by an earlier run. A missing file starts an empty store.
+func OpenTokenStore(path string) (*TokenStore, error) {
+	ts := NewTokenStore()
+	ts.file = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+	var entries map[string]tokenRecord
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %v", err)
+	}
+	for tokenID, e := range entries {
+		ts.tokenIDs[tokenID] = e.stored()
+	}
+	return ts, nil
+}
+
+// save writes every opaque ID to the store's file, if it has one. It goes
+// through a temporary file so a crash never leaves a truncated file behind.
+// The caller holds ts.mu.
+func (ts *TokenStore) save() error {
+	if ts.file == "" {
+		return nil
+	}
+	entries := make(map[string]tokenRecord, len(ts.tokenIDs))
+	for tokenID, stored := range ts.tokenIDs {
+		entries[tokenID] = stored.record()
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The notify secrets let anyone holding the file send to the devices
+	tempFile := ts.file + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, ts.file)
+}
+
+// setupTokenStore replaces the in-memory store with one persisted to the
+// --token-file flag or TOKEN_FILE, or shared through Redis, when set. A
+// shared store already outlives restarts, so the two cannot be combined.
+func setupTokenStore(path, redisURL string) error {
+	if path == "" {
+		path = os.Getenv("TOKEN_FILE")
+	}
+	if redisURL == "" {
+		redisURL = os.Getenv("REDIS_URL")
+	}
+	if path != "" && redisURL != "" {
+		return fmt.Errorf("--token-file and --redis-url cannot be combined")
+	}
+	if redisURL != "" {
+		return setupSharedTokenStore(redisURL)
+	}
+	if path == "" {
+		return nil
+	}
+	store, err := OpenTokenStore(path)
+	if err != nil {
+		return err
+	}
+	tokenStore = store
+	slog.Info("Opaque token IDs loaded", "file", path, "total", store.Count())
+	return nil
+}
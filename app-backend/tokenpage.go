@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultTokensPerPage is the page size of /tokens and /api/tokens
+	defaultTokensPerPage = 50
+	// maxTokensPerPage bounds the per_page parameter
+	maxTokensPerPage = 1000
+)
+
+// Registered reports whether the store holds tokenID, as any replica sees it
+func (ts *TokenStore) Registered(tokenID string) bool {
+	ts.refresh()
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	_, ok := ts.tokenIDs[tokenID]
+	return ok
+}
+
+// RemoveRegisteredBefore forgets every opaque ID registered before cutoff and
+// returns how many there were. Devices that still use them must register again.
+func (ts *TokenStore) RemoveRegisteredBefore(cutoff time.Time) int {
+	removed := 0
+	for _, token := range ts.Registrations() {
+		if token.RegisteredAt.Before(cutoff) {
+			ts.RemoveTokenID(token.TokenID)
+			removed++
+		}
+	}
+	return removed
+}
+
+// tokenPage is one page of the registrations, oldest first
+type tokenPage struct {
+	Tokens  []TokenInfo
+	Total   int
+	Page    int
+	PerPage int
+}
+
+func (p tokenPage) Pages() int { return max(1, (p.Total+p.PerPage-1)/p.PerPage) }
+func (p tokenPage) Prev() int  { return p.Page - 1 }
+func (p tokenPage) Next() int {
+	if p.Page >= p.Pages() {
+		return 0
+	}
+	return p.Page + 1
+}
+
+// readTokenPage returns the page the page and per_page query parameters ask for
+func readTokenPage(r *http.Request) (tokenPage, error) {
+	p := tokenPage{Page: 1, PerPage: defaultTokensPerPage}
+	var err error
+	if s := r.URL.Query().Get("page"); s != "" {
+		if p.Page, err = strconv.Atoi(s); err != nil || p.Page < 1 {
+			return p, fmt.Errorf("page must be a positive number")
+		}
+	}
+	if s := r.URL.Query().Get("per_page"); s != "" {
+		if p.PerPage, err = strconv.Atoi(s); err != nil || p.PerPage < 1 || p.PerPage > maxTokensPerPage {
+			return p, fmt.Errorf("per_page must be between 1 and %d", maxTokensPerPage)
+		}
+	}
+	tokens := tokenStore.Registrations()
+	p.Total = len(tokens)
+	start := min((p.Page-1)*p.PerPage, len(tokens))
+	p.Tokens = tokens[start:min(start+p.PerPage, len(tokens))]
+	return p, nil
+}
+
+// olderThanDays returns the registration time before which IDs count as stale
+func olderThanDays(days int) (time.Time, error) {
+	if days < 1 {
+		return time.Time{}, fmt.Errorf("older_than_days must be at least 1")
+	}
+	return time.Now().AddDate(0, 0, -days), nil
+}
+
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	page, err := readTokenPage(r)
+	if err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+	data := struct {
+		tokenPage
+		Removed   string
+		CSRFToken string
+		CanManage bool
+	}{
+		tokenPage: page,
+		Removed:   r.URL.Query().Get("removed"),
+		CSRFToken: csrfToken(w, r),
+		CanManage: may(r, RoleAdmin),
+	}
+
+	t := pageTemplate(w, r, "tokens")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		logger.Error("Error executing template", "error", err)
+	}
+}
+
+// APITokensExport is the JSON export of every registration
+type APITokensExport struct {
+	Success    bool        `json:"success"`
+	ExportedAt time.Time   `json:"exported_at"`
+	Count      int         `json:"count"`
+	Tokens     []TokenInfo `json:"tokens"` // oldest first
+}
+
+// handleTokenExport downloads every opaque ID and its registration time, as
+// CSV or with ?format=json, for comparing with the notification backend
+func handleTokenExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		writeError(w, ErrInvalidRequest, "format must be csv or json")
+		return
+	}
+	tokens := tokenStore.Registrations()
+	now := time.Now().UTC()
+	recordAudit(r, auditTokensExport, fmt.Sprintf("%s, %d registrations", format, len(tokens)))
+
+	filename := fmt.Sprintf("registrations-%s.%s", now.Format("20060102-150405"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "json" {
+		writeJSON(w, r, APITokensExport{Success: true, ExportedAt: now, Count: len(tokens), Tokens: tokens})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"token_id", "registered_at"})
+	for _, token := range tokens {
+		cw.Write([]string{token.TokenID, token.RegisteredAt.UTC().Format(time.RFC3339)})
+	}
+	cw.Flush()
+}
+
+// handleTokenDelete is the delete button of /tokens
+func handleTokenDelete(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected token delete form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+		return
+	}
+	tokenID := r.FormValue("token_id")
+	if tokenID == "" {
+		writeError(w, ErrMissingField, "Token ID is required")
+		return
+	}
+	if !tokenStore.Registered(tokenID) {
+		writeError(w, ErrTokenNotFound, "Token ID not found")
+		return
+	}
+	tokenStore.RemoveTokenID(tokenID)
+	recordAudit(r, auditTokenDelete, tokenID)
+	http.Redirect(w, r, "/tokens?removed=1", http.StatusSeeOther)
+}
+
+// handleTokenRemoveStale is the bulk removal form of /tokens
+func handleTokenRemoveStale(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected stale token removal form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+		return
+	}
+	days, err := strconv.Atoi(r.FormValue("older_than_days"))
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "older_than_days must be a number")
+		return
+	}
+	cutoff, err := olderThanDays(days)
+	if err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+	removed := tokenStore.RemoveRegisteredBefore(cutoff)
+	logger.Info("Stale opaque token IDs removed", "older_than_days", days, "removed", removed)
+	recordAudit(r, auditTokensRemoveStale, fmt.Sprintf("older than %d days, %d removed", days, removed))
+	http.Redirect(w, r, fmt.Sprintf("/tokens?removed=%d", removed), http.StatusSeeOther)
+}
+
+// APIRemoveStaleRequest is the body of POST /api/tokens/remove-stale
+type APIRemoveStaleRequest struct {
+	OlderThanDays int `json:"older_than_days"`
+}
+
+// APIRemoveResponse is returned by the /api/tokens removals
+type APIRemoveResponse struct {
+	Success      bool `json:"success"`
+	RemovedCount int  `json:"removed_count"`
+}
+
+// handleAPIToken deletes one opaque ID
+func handleAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	tokenID := r.PathValue("id")
+	if !tokenStore.Registered(tokenID) {
+		writeError(w, ErrTokenNotFound, "Token ID not found")
+		return
+	}
+	tokenStore.RemoveTokenID(tokenID)
+	recordAudit(r, auditTokenDelete, tokenID)
+	writeJSON(w, r, APIRemoveResponse{Success: true, RemovedCount: 1})
+}
+
+// handleAPIRemoveStale is the JSON form of the bulk removal of /tokens
+func handleAPIRemoveStale(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var req APIRemoveStaleRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	cutoff, err := olderThanDays(req.OlderThanDays)
+	if err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+	removed := tokenStore.RemoveRegisteredBefore(cutoff)
+	logger.Info("Stale opaque token IDs removed", "older_than_days", req.OlderThanDays, "removed", removed)
+	recordAudit(r, auditTokensRemoveStale, fmt.Sprintf("older than %d days, %d removed", req.OlderThanDays, removed))
+	writeJSON(w, r, APIRemoveResponse{Success: true, RemovedCount: removed})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// backendClient is used for all calls to the notification backend. Its
+// transport creates client spans and injects the trace context headers so
+// the notification-backend continues the same trace. setupBackendClient
+// replaces it with one using the connection flags.
+var backendClient = &http.Client{
+	Transport: otelhttp.NewTransport(&metricsTransport{next: http.DefaultTransport}),
+}
+
+// tracingEnabled records whether spans are being exported
+var tracingEnabled bool
+
+// setupTracing installs the global OpenTelemetry tracer provider and W3C
+// propagators. Tracing is enabled when an OTLP endpoint is given either via
+// flag or the standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable.
+// The returned function flushes and shuts down the provider.
+func setupTracing(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	// Always propagate trace context, even when we don't export
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("app-backend"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	tracingEnabled = true
+
+	return provider.Shutdown, nil
+}
+
+// tracingHandler wraps the server mux so every request gets a server span.
+// Spans are named after the route pattern the mux matched, which also
+// replaces the recorded path, so the IDs in a URL stay out of traces.
+func tracingHandler(next http.Handler) http.Handler {
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Pattern != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(semconv.URLPath(r.Pattern))
+		}
+	})
+	// otelhttp names the span again once the request has been routed
+	return otelhttp.NewHandler(routed, "app-backend",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if r.Pattern == "" {
+				return r.Method
+			}
+			return r.Method + " " + r.Pattern
+		}),
+	)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"remote-notification/api"
+)
+
+var (
+	userHashKeyFlag   = flag.String("user-hash-key", "", "Secret for hashing the user_id of registrations (or USER_HASH_KEY); empty ignores user IDs and disables /send-user")
+	backendAPIKeyFlag = flag.String("backend-api-key", "", "The notification backend's --raw-api-key (or BACKEND_API_KEY), needed by /send-user")
+)
+
+// userHashKey and backendAPIKey are resolved from the flags or environment at startup
+var userHashKey, backendAPIKey string
+
+// setupUserHash resolves the per-user send keys, preferring the flags
+func setupUserHash(hashKey, apiKey string) {
+	if hashKey == "" {
+		hashKey = os.Getenv("USER_HASH_KEY")
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv("BACKEND_API_KEY")
+	}
+	userHashKey, backendAPIKey = hashKey, apiKey
+}
+
+// userHash keys a user ID with --user-hash-key, so the notification backend can
+// group a user's devices without learning, or being able to guess, the ID.
+// It is empty without a user ID or key.
+func userHash(userID string) string {
+	if userID == "" || userHashKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(userHashKey))
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyUser sends one notification to all of a user's devices, asking every
+// backend since platform rules may have spread them out. It fails only when
+// no backend took the send.
+func notifyUser(ctx context.Context, hash, title, body string) (*api.SendResponse, error) {
+	if !multipleBackends() {
+		return notifyUserOnBackend(ctx, backends[0], hash, title, body)
+	}
+	var total api.SendResponse
+	var failure, noTokens error
+	reached := false
+	for _, b := range backends {
+		result, err := notifyUserOnBackend(ctx, b, hash, title, body)
+		var be *backendError
+		switch {
+		case err == nil:
+			reached = true
+			total.SentCount += result.SentCount
+			total.ErrorCount += result.ErrorCount
+			total.TotalTokens += result.TotalTokens
+		case errors.As(err, &be) && be.Code == ErrNoTokens:
+			noTokens = err
+		default:
+			loggerFromContext(ctx).Warn("Failed to send user notification through a backend", "backend", b.Name, "error", err)
+			failure = err
+		}
+	}
+	switch {
+	case reached:
+		return &total, nil
+	case failure != nil:
+		return nil, failure
+	}
+	return nil, noTokens
+}
+
+// notifyUserOnBackend sends one notification to all of a user's devices on
+// backend b with a single /v1/notify-user call
+func notifyUserOnBackend(ctx context.Context, b *notificationBackend, hash, title, body string) (_ *api.SendResponse, err error) {
+	defer countForwardFailure("notify_user", &err)
+	ctx, cancel := context.WithTimeout(ctx, *backendTimeout)
+	defer cancel()
+
+	result, err := backendAPI(ctx, b).NotifyUser(ctx, api.UserNotificationRequest{UserHash: hash, Title: title, Body: body})
+	if err != nil {
+		return nil, backendCallError(err)
+	}
+	return result, nil
+}
+
+// handleSendUser sends a message to every device registered with the form's user_id
+func handleSendUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if userHashKey == "" {
+		writeError(w, ErrEndpointDisabled, "Per-user sends need --user-hash-key")
+		return
+	}
+	if err := checkCSRF(r); err != nil {
+		logger.Warn("Rejected send-user form", "error", err)
+		writeError(w, ErrCSRFFailed, "Reload the page and send the form again")
+		return
+	}
+
+	userID, message := r.FormValue("user_id"), r.FormValue("message")
+	if userID == "" || message == "" {
+		writeError(w, ErrMissingField, "User ID and message are required")
+		return
+	}
+	title, message, err := fillPlaceholders(r.FormValue("title"), message, formVariable(r))
+	if err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid message: "+err.Error())
+		return
+	}
+	title, ok := notificationTitle(title)
+	if !ok {
+		writeError(w, ErrInvalidRequest, titleTooLong)
+		return
+	}
+
+	// Like the history, the audit log does not name the user
+	recordAudit(r, auditSendUser, title+": "+message)
+	result, err := notifyUser(r.Context(), userHash(userID), title, message)
+	record := SendRecord{Target: "user", Title: title, Message: message}
+	if err != nil {
+		logger.Warn("Failed to send user notification", "error", err)
+		record.Error = err.Error()
+		recordSend(r, "form", record)
+		// A user without devices is worth telling apart; anything else, such as
+		// a wrong --backend-api-key, is the backend's problem
+		var be *backendError
+		if errors.As(err, &be) && be.Code == ErrNoTokens {
+			writeErrorStatus(w, be.Status, be.Code, be.Message)
+			return
+		}
+		writeError(w, ErrBackendUnavailable, "Failed to send notification")
+		return
+	}
+
+	record.TargetCount, record.SentCount, record.ErrorCount = result.TotalTokens, result.SentCount, result.ErrorCount
+	recordSend(r, "form", record)
+	http.Redirect(w, r, fmt.Sprintf("/?sent=%d&errors=%d&removed=0", result.SentCount, result.ErrorCount), http.StatusSeeOther)
+}
@@ -17,6 +17,7 @@ import java.security.cert.X509Certificate
 import java.security.KeyFactory
 import java.security.PublicKey
 import java.security.SecureRandom
+import java.security.Signature
 import java.security.spec.X509EncodedKeySpec
 import android.util.Base64
 import javax.crypto.Cipher
@@ -40,6 +41,8 @@ class MainActivity : AppCompatActivity() {
         // Set to true to force debug certificate behavior for testing
         // WARNING: Never set to true in production builds
         private const val FORCE_DEBUG_CERTIFICATES = false
+        // How far a signed registration's issued_at may be from the device clock
+        private const val MAX_REGISTRATION_SKEW_SECONDS = 300L
     }
     
     /**
@@ -214,8 +217,16 @@ class MainActivity : AppCompatActivity() {
                     Log.d(TAG, "Server response: ${response.code} - $responseBody")
                     
                     runOnUiThread {
-                        if (response.isSuccessful) {
-                            updateStatus(getString(R.string.status_success))
+                        if (response.code == 202) {
+                            // The notification backend is down; the app-backend retries for us
+                            updateStatus(getString(R.string.status_queued))
+                        } else if (response.isSuccessful) {
+                            val problem = verifyRegistration(responseBody)
+                            if (problem == null) {
+                                updateStatus(getString(R.string.status_success))
+                            } else {
+                                updateStatus(getString(R.string.status_unverified, problem))
+                            }
                         } else {
                             updateStatus(getString(R.string.status_server_error, response.code, responseBody))
                         }
@@ -373,6 +384,40 @@ class MainActivity : AppCompatActivity() {
         }
     }
     
+    /**
+     * Checks the notification backend signed the opaque ID we were given:
+     * RSA-PSS SHA-256 over "remote-notification registration v1\n<token_id>\n<issued_at>"
+     * with the key we encrypt to. Returns null when it verifies, else the problem.
+     */
+    private fun verifyRegistration(responseBody: String?): String? {
+        return try {
+            val json = JSONObject(responseBody ?: "")
+            val tokenId = json.optString("token_id")
+            val issuedAt = json.optLong("issued_at")
+            val signature = json.optString("signature")
+            if (tokenId.isEmpty() || signature.isEmpty()) {
+                return "response is not signed"
+            }
+
+            val verifier = Signature.getInstance("SHA256withRSA/PSS")
+            verifier.initVerify(loadPublicKey())
+            verifier.update("remote-notification registration v1\n$tokenId\n$issuedAt".toByteArray())
+            if (!verifier.verify(Base64.decode(signature, Base64.DEFAULT))) {
+                return "signature does not match"
+            }
+
+            val skewSeconds = Math.abs(System.currentTimeMillis() / 1000 - issuedAt)
+            if (skewSeconds > MAX_REGISTRATION_SKEW_SECONDS) {
+                return "signed ${skewSeconds}s away from our clock"
+            }
+            Log.d(TAG, "Registration signature verified")
+            null
+        } catch (e: Exception) {
+            Log.w(TAG, "Could not verify registration signature", e)
+            e.message ?: e.javaClass.simpleName
+        }
+    }
+    
     private fun loadPublicKey(): PublicKey {
         val publicKeyPem = assets.open("public_key.pem").bufferedReader().use { it.readText() }
         
@@ -74,8 +74,9 @@ class SettingsActivity : AppCompatActivity() {
             return
         }
         
-        // Remove trailing slash for consistency
-        val cleanUrl = url.trimEnd('/')
+        // Remove trailing slash for consistency, and take the registration URL
+        // of the app-backend's /pair QR code as its base URL
+        val cleanUrl = url.substringBefore('#').trimEnd('/').removeSuffix("/register")
         
         setBackendUrl(this, cleanUrl)
         Toast.makeText(this, getString(R.string.toast_url_saved), Toast.LENGTH_SHORT).show()
@@ -0,0 +1,128 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
+)
+
+// TestOpaqueIDFlow walks one registration and one notification through both
+// backends, logging what each side sees. Run it with -v for the walkthrough:
+//
+//	go test -v -run TestOpaqueIDFlow
+func TestOpaqueIDFlow(t *testing.T) {
+	s := startStack(t)
+	fcmToken := apitest.FCMToken(1)
+
+	t.Log("=== Opaque ID token registration ===")
+
+	t.Log("Step 1: the app encrypts its FCM token to the notification backend's key")
+	encrypted := s.encryptToken(t, fcmToken)
+	t.Logf("  FCM token: %s", fcmToken)
+	t.Logf("  encrypted_data: %s (%d characters)", abbreviate(encrypted), len(encrypted))
+
+	t.Log("Step 2: the app registers with the app backend, which forwards it to the notification backend")
+	registration := api.TokenRegistration{EncryptedData: encrypted, Platform: "android"}
+	logJSON(t, "POST /register", api.TokenRegistration{EncryptedData: abbreviate(encrypted), Platform: "android"})
+	var reg api.RegisterResponse
+	if status := s.call(t, http.MethodPost, s.appURL+"/register", "", registration, &reg); status != http.StatusOK || !reg.Success {
+		t.Fatalf("Expected the registration accepted, got %d %+v", status, reg)
+	}
+	shown := reg
+	shown.Signature = abbreviate(reg.Signature)
+	logJSON(t, "Response", shown)
+
+	t.Log("Step 3: the notification backend made up an opaque ID for the token")
+	if _, err := api.ParseOpaqueID(reg.TokenID); err != nil {
+		t.Fatalf("Expected an opaque ID, got %q: %v", reg.TokenID, err)
+	}
+	t.Logf("  %s (%d characters, 256 random bits)", reg.TokenID, len(reg.TokenID))
+
+	t.Log("Step 4: the notification backend stores the opaque ID with the encrypted token")
+	stored := storedMapping(t, s.storageFile, reg.TokenID)
+	if stored["encrypted_data"] != encrypted {
+		t.Errorf("Expected the stored encrypted_data to be what the app sent")
+	}
+	stored["encrypted_data"] = abbreviate(encrypted)
+	logJSON(t, "tokens.json", stored)
+
+	t.Log("Step 5: the app backend keeps only the opaque ID")
+	var tokens json.RawMessage
+	if status := s.call(t, http.MethodGet, s.appURL+"/api/tokens", s.adminAPIKey, nil, &tokens); status != http.StatusOK {
+		t.Fatalf("Expected the app backend's tokens, got %d", status)
+	}
+	if !strings.Contains(string(tokens), reg.TokenID) {
+		t.Errorf("Expected the app backend to list %s, got %s", reg.TokenID, tokens)
+	}
+	if strings.Contains(string(tokens), fcmToken) || strings.Contains(string(tokens), encrypted) {
+		t.Errorf("Expected the app backend to know neither the token nor its encryption, got %s", tokens)
+	}
+	logJSON(t, "GET /api/tokens", tokens)
+
+	t.Log("=== Later: sending a notification ===")
+
+	t.Log("Step 6: an admin sends through the app backend, which notifies each opaque ID")
+	send := map[string]string{"title": "App Notification", "message": "Hello from the notification system!"}
+	logJSON(t, "POST /api/send", send)
+	var sent appSendResponse
+	if status := s.call(t, http.MethodPost, s.appURL+"/api/send", s.adminAPIKey, send, &sent); status != http.StatusOK || sent.SentCount != 1 {
+		t.Fatalf("Expected the send delivered, got %d %+v", status, sent)
+	}
+	logJSON(t, "Response", sent)
+
+	t.Log("Step 7: the notification backend looks up the opaque ID, decrypts the token and sends to FCM")
+	delivered := s.fcm.Delivered()
+	if len(delivered) != 1 || delivered[0].Token != fcmToken {
+		t.Fatalf("Expected FCM to get one message for %s, got %+v", fcmToken, delivered)
+	}
+	logJSON(t, "FCM received", delivered[0])
+
+	t.Log("=== What each side knew ===")
+	t.Log("  the app backend: the opaque ID only")
+	t.Log("  the notification backend: the opaque ID and the encrypted token, which only its key opens")
+	t.Log("  FCM: the decrypted token, from the notification backend alone")
+}
+
+// storedMapping returns the entry for opaqueID in the notification backend's
+// token file
+func storedMapping(t *testing.T, path, opaqueID string) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the token file: %v", err)
+	}
+	var mappings []map[string]any
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		t.Fatalf("Failed to parse the token file: %v", err)
+	}
+	for _, m := range mappings {
+		if m["opaque_id"] == opaqueID {
+			return m
+		}
+	}
+	t.Fatalf("Expected %s in the token file, got %s", opaqueID, data)
+	return nil
+}
+
+// logJSON logs v indented under label
+func logJSON(t *testing.T, label string, v any) {
+	t.Helper()
+	data, err := json.MarshalIndent(v, "  ", "  ")
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", label, err)
+	}
+	t.Logf("  %s:\n  %s", label, data)
+}
+
+// abbreviate shortens a long encrypted value for the log
+func abbreviate(s string) string {
+	if len(s) <= 43 {
+		return s
+	}
+	return s[:20] + "..." + s[len(s)-20:]
+}
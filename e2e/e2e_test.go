@@ -0,0 +1,107 @@
+package e2e
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
+	"remote-notification/api/client"
+)
+
+// appSendResponse answers the app backend's /api/send
+type appSendResponse struct {
+	Success      bool `json:"success"`
+	SentCount    int  `json:"sent_count"`
+	ErrorCount   int  `json:"error_count"`
+	RemovedCount int  `json:"removed_count"`
+	QueuedCount  int  `json:"queued_count"`
+	TotalTokens  int  `json:"total_tokens"`
+}
+
+// deliveredTo returns the tokens, sorted, of the messages with title and body
+func deliveredTo(messages []FCMMessage, title, body string) []string {
+	var tokens []string
+	for _, m := range messages {
+		if m.Notification != nil && m.Notification.Title == title && m.Notification.Body == body {
+			tokens = append(tokens, m.Token)
+		}
+	}
+	slices.Sort(tokens)
+	return tokens
+}
+
+func TestRegisterNotifySend(t *testing.T) {
+	s := startStack(t)
+	devices := []string{apitest.FCMToken(1), apitest.FCMToken(2)}
+	slices.Sort(devices)
+
+	// The apps register through the app backend, which cannot read the tokens
+	for _, token := range devices {
+		var reg api.RegisterResponse
+		if status := s.call(t, http.MethodPost, s.appURL+"/register", "", api.TokenRegistration{EncryptedData: s.encryptToken(t, token), Platform: "android"}, &reg); status != http.StatusOK || reg.TokenID == "" {
+			t.Fatalf("Expected the registration of %s accepted, got %d %+v", token, status, reg)
+		}
+		if _, err := api.ParseOpaqueID(reg.TokenID); err != nil {
+			t.Errorf("Expected an opaque ID, got %q", reg.TokenID)
+		}
+	}
+
+	// A send on the app backend notifies each opaque ID through /v1/notify
+	var sent appSendResponse
+	if status := s.call(t, http.MethodPost, s.appURL+"/api/send", s.adminAPIKey, map[string]string{"title": "Hello", "message": "From the app backend"}, &sent); status != http.StatusOK || sent.SentCount != 2 || sent.ErrorCount != 0 {
+		t.Fatalf("Expected the send to reach both devices, got %d %+v", status, sent)
+	}
+	if got := deliveredTo(s.fcm.Delivered(), "Hello", "From the app backend"); !slices.Equal(got, devices) {
+		t.Errorf("Expected FCM to get the notification for %v, got %v", devices, got)
+	}
+
+	// A broadcast straight on the notification backend reaches every registration
+	c := client.New(s.backendURL, "")
+	resp, err := c.SendAll(context.Background(), api.SendRequest{Title: "Broadcast", Body: "To everyone"})
+	if err != nil || resp.SentCount != 2 {
+		t.Fatalf("Expected the broadcast to reach both devices, got %+v, %v", resp, err)
+	}
+	if got := deliveredTo(s.fcm.Delivered(), "Broadcast", "To everyone"); !slices.Equal(got, devices) {
+		t.Errorf("Expected FCM to get the broadcast for %v, got %v", devices, got)
+	}
+
+	status, err := c.Status(context.Background())
+	if err != nil || status.RegisteredTokens != 2 || !status.FirebaseInitialized || status.FCMMocked {
+		t.Errorf("Expected two registrations on a real FCM client, got %+v, %v", status, err)
+	}
+}
+
+func TestUnregisteredTokenDropped(t *testing.T) {
+	s := startStack(t)
+	devices := []string{apitest.FCMToken(1), apitest.FCMToken(2)}
+	for _, token := range devices {
+		if status := s.call(t, http.MethodPost, s.appURL+"/register", "", api.TokenRegistration{EncryptedData: s.encryptToken(t, token), Platform: "android"}, nil); status != http.StatusOK {
+			t.Fatalf("Expected the registration of %s accepted, got %d", token, status)
+		}
+	}
+
+	// FCM reports the second app uninstalled. A broadcast straight on the
+	// notification backend, sent as one FCM batch, fails only for it
+	s.fcm.Unregister(devices[1])
+	resp, err := client.New(s.backendURL, "").SendAll(context.Background(), api.SendRequest{Title: "Batched", Body: "Send"})
+	if err != nil || resp.SentCount != 1 || resp.ErrorCount != 1 {
+		t.Fatalf("Expected one delivery and one failure, got %+v, %v", resp, err)
+	}
+
+	// The app backend drops its ID
+	var sent appSendResponse
+	if status := s.call(t, http.MethodPost, s.appURL+"/api/send", s.adminAPIKey, map[string]string{"title": "First", "message": "Send"}, &sent); status != http.StatusOK || sent.SentCount != 1 || sent.RemovedCount != 1 {
+		t.Fatalf("Expected one delivery and one removal, got %d %+v", status, sent)
+	}
+
+	s.fcm.Reset()
+	if status := s.call(t, http.MethodPost, s.appURL+"/api/send", s.adminAPIKey, map[string]string{"title": "Second", "message": "Send"}, &sent); status != http.StatusOK || sent.TotalTokens != 1 || sent.SentCount != 1 {
+		t.Fatalf("Expected the next send to the remaining device only, got %d %+v", status, sent)
+	}
+	if got := deliveredTo(s.fcm.Delivered(), "Second", "Send"); !slices.Equal(got, devices[:1]) {
+		t.Errorf("Expected FCM to get the second send for %v, got %v", devices[:1], got)
+	}
+}
@@ -0,0 +1,129 @@
+package e2e
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
+	"remote-notification/api/client"
+)
+
+// appStatus is the part of the app backend's /api/status the tests look at
+type appStatus struct {
+	TokenCount int `json:"token_count"`
+	RetryQueue int `json:"retry_queue"`
+}
+
+// appErrorResponse is an error from the app backend
+type appErrorResponse struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *stack) appStatus(t *testing.T) appStatus {
+	t.Helper()
+	var status appStatus
+	if code := s.call(t, http.MethodGet, s.appURL+"/api/status", s.adminAPIKey, nil, &status); code != http.StatusOK {
+		t.Fatalf("Expected the app backend's status, got %d", code)
+	}
+	return status
+}
+
+func TestRegistrationRefused(t *testing.T) {
+	s := startStack(t)
+
+	// The app backend relays the notification backend's verdict on the token
+	for _, tc := range []struct {
+		name          string
+		encryptedData string
+		code          string
+	}{
+		{"too short", base64.StdEncoding.EncodeToString([]byte("not an encrypted token")), "INVALID_ENCRYPTED_DATA"},
+		{"another key", apitest.EncryptTokenTo(&apitest.OtherPrivateKey().PublicKey, apitest.FCMToken(1), nil), "DECRYPT_FAILED"},
+		{"not an FCM token", s.encryptToken(t, "e2e-device-fcm-token"), "INVALID_FCM_TOKEN"},
+	} {
+		var resp appErrorResponse
+		status := s.call(t, http.MethodPost, s.appURL+"/register", "", api.TokenRegistration{EncryptedData: tc.encryptedData, Platform: "android"}, &resp)
+		if status != http.StatusBadRequest || resp.Success || resp.Code != tc.code {
+			t.Errorf("%s: expected 400 %s from the app backend, got %d %+v", tc.name, tc.code, status, resp)
+		}
+	}
+
+	// Neither side kept anything, nor will retry it
+	if status := s.appStatus(t); status.TokenCount != 0 || status.RetryQueue != 0 {
+		t.Errorf("Expected nothing stored or queued on the app backend, got %+v", status)
+	}
+	backend, err := client.New(s.backendURL, "").Status(context.Background())
+	if err != nil || backend.RegisteredTokens != 0 {
+		t.Errorf("Expected nothing stored on the notification backend, got %+v, %v", backend, err)
+	}
+}
+
+func TestBackendDownQueuesRegistration(t *testing.T) {
+	t.Parallel() // waits for the app backend's first retry, 5s in
+	s := newStack(t)
+	s.startApp(t)
+
+	// With nothing listening at the backend URL the app backend queues the registration
+	var queued struct {
+		Success bool `json:"success"`
+		Queued  bool `json:"queued"`
+	}
+	registration := api.TokenRegistration{EncryptedData: s.encryptToken(t, apitest.FCMToken(1)), Platform: "android"}
+	if status := s.call(t, http.MethodPost, s.appURL+"/register", "", registration, &queued); status != http.StatusAccepted || !queued.Success || !queued.Queued {
+		t.Fatalf("Expected the registration queued, got %d %+v", status, queued)
+	}
+	if status := s.appStatus(t); status.RetryQueue != 1 || status.TokenCount != 0 {
+		t.Fatalf("Expected one queued registration and no opaque ID, got %+v", status)
+	}
+
+	// Once the notification backend is up the retry registers the token there
+	s.startBackend(t)
+	eventually(t, 15*time.Second, "the queued registration to reach the app backend's store", func() bool {
+		status := s.appStatus(t)
+		return status.RetryQueue == 0 && status.TokenCount == 1
+	})
+	var sent appSendResponse
+	if status := s.call(t, http.MethodPost, s.appURL+"/api/send", s.adminAPIKey, map[string]string{"title": "Late", "message": "Registered by a retry"}, &sent); status != http.StatusOK || sent.SentCount != 1 {
+		t.Fatalf("Expected the send to reach the retried registration, got %d %+v", status, sent)
+	}
+	if got := deliveredTo(s.fcm.Delivered(), "Late", "Registered by a retry"); len(got) != 1 || got[0] != apitest.FCMToken(1) {
+		t.Errorf("Expected FCM to get the send for the retried registration, got %v", got)
+	}
+}
+
+func TestFCMOutageRetried(t *testing.T) {
+	t.Parallel() // waits for the app backend's first retry, 5s in
+	s := startStack(t)
+	token := apitest.FCMToken(1)
+	if status := s.call(t, http.MethodPost, s.appURL+"/register", "", api.TokenRegistration{EncryptedData: s.encryptToken(t, token), Platform: "android"}, nil); status != http.StatusOK {
+		t.Fatalf("Expected the registration accepted, got %d", status)
+	}
+
+	// FCM failing is the notification backend's 500, which the app backend queues
+	s.fcm.FailAll()
+	var sent appSendResponse
+	if status := s.call(t, http.MethodPost, s.appURL+"/api/send", s.adminAPIKey, map[string]string{"title": "Outage", "message": "Delivered later"}, &sent); status != http.StatusOK || sent.SentCount != 0 || sent.QueuedCount != 1 || sent.RemovedCount != 0 {
+		t.Fatalf("Expected the send queued, not removed, got %d %+v", status, sent)
+	}
+	if status := s.appStatus(t); status.RetryQueue != 1 || status.TokenCount != 1 {
+		t.Errorf("Expected the notification queued and the opaque ID kept, got %+v", status)
+	}
+	if got := s.fcm.Delivered(); len(got) != 0 {
+		t.Errorf("Expected nothing delivered during the outage, got %+v", got)
+	}
+
+	// When FCM is back the retry delivers it
+	s.fcm.Recover()
+	eventually(t, 15*time.Second, "the queued notification to reach FCM", func() bool {
+		return len(deliveredTo(s.fcm.Delivered(), "Outage", "Delivered later")) == 1
+	})
+	if status := s.appStatus(t); status.RetryQueue != 0 {
+		t.Errorf("Expected the retry queue empty, got %+v", status)
+	}
+}
@@ -0,0 +1,205 @@
+// Package e2e runs the app backend and the notification backend together
+// against FakeFCM, a fake of the FCM v1 API, and checks what reaches it.
+// The tests build both servers from source and start them as they are
+// deployed; see README.md.
+package e2e
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+)
+
+// fakeAccessToken is what FakeFCM's token endpoint issues and its send endpoint requires
+const fakeAccessToken = "fake-fcm-access-token"
+
+// FCMMessage is the part of an FCM v1 message the tests look at
+type FCMMessage struct {
+	Token        string            `json:"token,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	Condition    string            `json:"condition,omitempty"`
+	Notification *FCMNotification  `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+}
+
+// FCMNotification is the notification of an FCMMessage
+type FCMNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// ReceivedMessage is one messages:send call FakeFCM answered
+type ReceivedMessage struct {
+	Project      string
+	ValidateOnly bool // a dry run, which FCM does not deliver
+	Message      FCMMessage
+}
+
+// FakeFCM answers the FCM v1 send endpoint and the OAuth token endpoint of
+// the service account key from ServiceAccountKey, keeping every message
+type FakeFCM struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []ReceivedMessage
+	failures map[string]fcmFailure // by token, "" for every token
+}
+
+// fcmFailure is the error FakeFCM answers a send with
+type fcmFailure struct {
+	status     int
+	grpcStatus string
+	fcmCode    string
+	message    string
+}
+
+// NewFakeFCM starts a FakeFCM; Close stops it
+func NewFakeFCM() *FakeFCM {
+	f := &FakeFCM{failures: make(map[string]fcmFailure)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", f.handleToken)
+	mux.HandleFunc("POST /v1/projects/{project}/messages:send", f.handleSend)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Endpoint is the base URL for the notification backend's --fcm-endpoint
+func (f *FakeFCM) Endpoint() string {
+	return f.URL + "/v1"
+}
+
+// Unregister makes later sends to token fail as FCM does for an uninstalled app
+func (f *FakeFCM) Unregister(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[token] = fcmFailure{http.StatusNotFound, "NOT_FOUND", "UNREGISTERED", "Requested entity was not found."}
+}
+
+// FailAll makes later sends to any token fail with an internal error, as
+// in an FCM outage, until Recover. The Admin SDK does not retry these.
+func (f *FakeFCM) FailAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[""] = fcmFailure{http.StatusInternalServerError, "INTERNAL", "INTERNAL", "Internal error encountered."}
+}
+
+// Recover ends a FailAll
+func (f *FakeFCM) Recover() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failures, "")
+}
+
+// Delivered returns the messages FCM would have delivered, leaving out dry runs
+func (f *FakeFCM) Delivered() []FCMMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var messages []FCMMessage
+	for _, r := range f.received {
+		if !r.ValidateOnly {
+			messages = append(messages, r.Message)
+		}
+	}
+	return messages
+}
+
+// Reset forgets the messages received so far
+func (f *FakeFCM) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.received = nil
+}
+
+// ServiceAccountKey writes a service account key file for project whose
+// token_uri is the fake, for the notification backend's --firebase-key
+func (f *FakeFCM) ServiceAccountKey(path, project string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("failed to generate service account key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode service account key: %v", err)
+	}
+	data, err := json.MarshalIndent(map[string]string{
+		"type":           "service_account",
+		"project_id":     project,
+		"private_key_id": "fake",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "e2e@" + project + ".iam.gserviceaccount.com",
+		"client_id":      "1",
+		"token_uri":      f.URL + "/token",
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write service account key: %v", err)
+	}
+	return nil
+}
+
+func (f *FakeFCM) handleToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": fakeAccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (f *FakeFCM) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeAccessToken {
+		writeFCMError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "", "Request had invalid authentication credentials.")
+		return
+	}
+	var req struct {
+		ValidateOnly bool       `json:"validate_only"`
+		Message      FCMMessage `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFCMError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT", "Invalid JSON payload received.")
+		return
+	}
+	project := r.PathValue("project")
+
+	f.mu.Lock()
+	failure, failed := f.failures[""]
+	if !failed && req.Message.Token != "" {
+		failure, failed = f.failures[req.Message.Token]
+	}
+	if !failed {
+		f.received = append(f.received, ReceivedMessage{Project: project, ValidateOnly: req.ValidateOnly, Message: req.Message})
+	}
+	n := len(f.received)
+	f.mu.Unlock()
+
+	if failed {
+		writeFCMError(w, failure.status, failure.grpcStatus, failure.fcmCode, failure.message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": fmt.Sprintf("projects/%s/messages/%d", project, n)})
+}
+
+// writeFCMError answers as FCM does, with the FcmError code the Admin SDK
+// classifies errors by
+func writeFCMError(w http.ResponseWriter, status int, grpcStatus, fcmCode, message string) {
+	body := map[string]any{"code": status, "message": message, "status": grpcStatus}
+	if fcmCode != "" {
+		body["details"] = []map[string]string{{
+			"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+			"errorCode": fcmCode,
+		}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": body})
+}
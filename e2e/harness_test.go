@@ -0,0 +1,289 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+// binDir holds the servers TestMain built
+var binDir string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		fmt.Println("e2e: skipped in -short mode")
+		os.Exit(0)
+	}
+	dir, err := os.MkdirTemp("", "e2e-bin")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2e:", err)
+		os.Exit(1)
+	}
+	binDir = dir
+	for _, server := range []string{"notification-backend", "app-backend"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, server), ".")
+		cmd.Dir = filepath.Join("..", server)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "e2e: failed to build %s: %v\n%s", server, err, out)
+			os.RemoveAll(binDir)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(binDir)
+	os.Exit(code)
+}
+
+// stack is the two backends of one test, wired to each other and to fcm
+type stack struct {
+	dir         string
+	fcm         *FakeFCM
+	key         *rsa.PrivateKey // the notification backend's
+	backendAddr string
+	backendURL  string // the notification backend
+	appAddr     string
+	appURL      string // the app backend, over TLS
+	storageFile string // the notification backend's token file
+	adminAPIKey string
+	client      *http.Client // trusts the app backend's certificate
+}
+
+// startStack starts a FakeFCM, a notification backend sending to it and an
+// app backend in front, stopping them all at the end of the test
+func startStack(t *testing.T) *stack {
+	t.Helper()
+	s := newStack(t)
+	s.startBackend(t)
+	s.startApp(t)
+	return s
+}
+
+// newStack starts the FakeFCM and writes the keys, certificate and service
+// account key of a stack, leaving the servers to startBackend and startApp
+func newStack(t *testing.T) *stack {
+	t.Helper()
+	dir := t.TempDir()
+	s := &stack{dir: dir, fcm: NewFakeFCM(), adminAPIKey: "e2e-admin-key"}
+	t.Cleanup(s.fcm.Close)
+
+	s.key = apitest.PrivateKey()
+	writeFile(t, filepath.Join(dir, "private_key.pem"), apitest.PrivateKeyPEM)
+	writeFile(t, filepath.Join(dir, "public_key.pem"), apitest.PublicKeyPEM)
+	if err := s.fcm.ServiceAccountKey(filepath.Join(dir, "firebase_key.json"), "e2e-project"); err != nil {
+		t.Fatal(err)
+	}
+	certPool := writeCertificate(t, dir)
+	s.client = &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool}}}
+
+	s.backendAddr = freeAddr(t)
+	s.backendURL = "http://" + s.backendAddr
+	s.storageFile = filepath.Join(dir, "tokens.json")
+	s.appAddr = freeAddr(t)
+	s.appURL = "https://" + s.appAddr
+	return s
+}
+
+// startBackend starts the notification backend, sending to the FakeFCM
+func (s *stack) startBackend(t *testing.T) {
+	t.Helper()
+	startServer(t, "notification-backend", s.backendURL+"/healthz", http.DefaultClient,
+		"--listen", s.backendAddr,
+		"--private-key", filepath.Join(s.dir, "private_key.pem"),
+		"--public-key", filepath.Join(s.dir, "public_key.pem"),
+		"--firebase-key", filepath.Join(s.dir, "firebase_key.json"),
+		"--fcm-endpoint", s.fcm.Endpoint(),
+		"--storage-file", s.storageFile,
+	)
+}
+
+// startApp starts the app backend in front of the notification backend,
+// which need not be up yet
+func (s *stack) startApp(t *testing.T) {
+	t.Helper()
+	startServer(t, "app-backend", s.appURL+"/version", s.client,
+		"--listen", s.appAddr,
+		"--cert", filepath.Join(s.dir, "cert.pem"),
+		"--key", filepath.Join(s.dir, "key.pem"),
+		"--public-key", filepath.Join(s.dir, "public_key.pem"),
+		"--backend-url", s.backendURL,
+		"--admin-api-key", s.adminAPIKey,
+	)
+}
+
+// startServer runs a server TestMain built until the end of the test, once
+// readyURL answers 200. Its output is logged if the test fails.
+func startServer(t *testing.T, name, readyURL string, client *http.Client, args ...string) {
+	t.Helper()
+	var out syncBuffer
+	cmd := exec.Command(filepath.Join(binDir, name), args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start %s: %v", name, err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			t.Logf("%s output:\n%s", name, out.String())
+		}
+	})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			t.Fatalf("%s exited before it was ready: %v\n%s", name, err, out.String())
+		default:
+		}
+		if resp, err := client.Get(readyURL); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s was not ready at %s within 30s\n%s", name, readyURL, out.String())
+}
+
+// freeAddr returns a loopback address with a port nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// writeCertificate writes a self-signed cert.pem and key.pem for 127.0.0.1
+// into dir and returns a pool trusting it
+func writeCertificate(t *testing.T, dir string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "e2e"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	writeFile(t, filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encryptToken hybrid-encrypts a device token to the notification backend's
+// key as the apps do
+func (s *stack) encryptToken(t *testing.T, token string) string {
+	t.Helper()
+	return apitest.EncryptTokenTo(&s.key.PublicKey, token, nil)
+}
+
+// call makes a JSON request and decodes the answer into out, returning the status
+func (s *stack) call(t *testing.T, method, url, apiKey string, body, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, _ := http.NewRequest(method, url, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && json.Unmarshal(data, out) != nil && resp.StatusCode < 300 {
+		t.Fatalf("%s %s answered %d with %s", method, url, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp.StatusCode
+}
+
+// eventually polls check every 100ms until it holds or within, failing the
+// test with what if it never does
+func eventually(t *testing.T, within time.Duration, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s within %v", what, within)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// syncBuffer collects a server's output from its two streams
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,282 @@
+// Command keygen creates and checks the RSA key pairs of the notification
+// pipeline, in exactly the formats the backends and the app read
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+const usage = `usage: keygen <command> [flags] [files]
+
+Commands:
+  generate  create a key pair and print its public key hash
+  public    write the public key of a private key
+  convert   rewrite a private key as PKCS#1 or PKCS#8
+  hash      print the public key hash of public key files
+  check     check that a private and a public key belong together
+
+Run keygen <command> -h for the flags of a command.
+`
+
+// errUsage is a command line that cannot be run; the usage was printed already
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "keygen:", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command line args, writing results to stdout and
+// warnings to stderr
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+	commands := map[string]func([]string, io.Writer, io.Writer) error{
+		"generate": runGenerate,
+		"public":   runPublic,
+		"convert":  runConvert,
+		"hash":     runHash,
+		"check":    runCheck,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "keygen: unknown command %q\n\n%s", args[0], usage)
+		return errUsage
+	}
+	return command(args[1:], stdout, stderr)
+}
+
+// newFlagSet returns the flags of a command, reporting errors to stderr
+func newFlagSet(name, synopsis string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: keygen %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses a command's flags and checks it got between min and max
+// file arguments
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func runGenerate(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("generate", "[flags]", stderr)
+	bits := fs.Int("bits", 4096, "RSA key size")
+	format := fs.String("format", formatPKCS8, "Private key encoding, pkcs8 or pkcs1")
+	privatePath := fs.String("private", "private_key.pem", "Where to write the private key, for the notification backend")
+	publicPath := fs.String("public", "public_key.pem", "Where to write the public key, for the app-backend and the app")
+	force := fs.Bool("force", false, "Overwrite existing key files")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	key, err := generateKey(*bits)
+	if err != nil {
+		return err
+	}
+	privatePEM, err := encodePrivateKey(key, *format)
+	if err != nil {
+		return err
+	}
+	publicPEM, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	// Check both paths first so a refused public key leaves no orphan private key
+	if !*force {
+		for _, path := range []string{*privatePath, *publicPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s exists; pass -force to overwrite it", path)
+			}
+		}
+	}
+	if err := writeFile(*privatePath, privatePEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFile(*publicPath, publicPEM, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Wrote %d-bit %s private key to %s\n", *bits, strings.ToUpper(*format), *privatePath)
+	fmt.Fprintf(stdout, "Wrote public key to %s\n", *publicPath)
+	fmt.Fprintf(stdout, "Public key hash: %s\n", publicKeyHash(publicPEM))
+	return nil
+}
+
+func runPublic(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("public", "[flags] private_key.pem", stderr)
+	out := fs.String("out", "", "Where to write the public key; empty writes it to standard output")
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	key, err := readPrivateKey(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	publicPEM, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err := stdout.Write(publicPEM)
+		return err
+	}
+	if err := writeFile(*out, publicPEM, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Public key hash: %s\n", publicKeyHash(publicPEM))
+	return nil
+}
+
+func runConvert(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("convert", "-to pkcs1|pkcs8 [flags] private_key.pem", stderr)
+	to := fs.String("to", "", "Private key encoding to write, pkcs8 or pkcs1")
+	out := fs.String("out", "", "Where to write the converted key; empty writes it to standard output")
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+	if *to == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	key, err := readPrivateKey(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	privatePEM, err := encodePrivateKey(key, *to)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err := stdout.Write(privatePEM)
+		return err
+	}
+	return writeFile(*out, privatePEM, 0600)
+}
+
+func runHash(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("hash", "public_key.pem...", stderr)
+	if err := parseArgs(fs, args, 1, math.MaxInt); err != nil {
+		return err
+	}
+
+	// Copies of one key that hash differently split the backends' storage
+	hashes := make(map[string]string) // by modulus
+	var split []string
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read public key file: %v", err)
+		}
+		key, _, err := parsePublicKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		hash := publicKeyHash(data)
+		fmt.Fprintf(stdout, "%s  %s\n", hash, path)
+		for _, warning := range pemWarnings(data) {
+			fmt.Fprintf(stderr, "warning: %s %s\n", path, warning)
+		}
+
+		modulus := key.N.String()
+		if first, ok := hashes[modulus]; ok && first != hash {
+			split = append(split, path)
+		} else if !ok {
+			hashes[modulus] = hash
+		}
+	}
+	if len(split) > 0 {
+		return fmt.Errorf("same key as an earlier file but a different hash: %s; backends given these copies would not find each other's tokens",
+			strings.Join(split, ", "))
+	}
+	return nil
+}
+
+func runCheck(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("check", "private_key.pem public_key.pem", stderr)
+	if err := parseArgs(fs, args, 2, 2); err != nil {
+		return err
+	}
+
+	key, err := readPrivateKey(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	publicPEM, err := os.ReadFile(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("failed to read public key file: %v", err)
+	}
+	public, pkix, err := parsePublicKey(publicPEM)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(1), err)
+	}
+	if !public.Equal(&key.PublicKey) {
+		return fmt.Errorf("%s is not the public key of %s", fs.Arg(1), fs.Arg(0))
+	}
+
+	if !pkix {
+		fmt.Fprintf(stderr, "warning: %s is a PKCS#1 public key, which the app cannot read; rewrite it with: keygen public -out %s %s\n",
+			fs.Arg(1), fs.Arg(1), fs.Arg(0))
+	}
+	if bits := key.N.BitLen(); bits < 4096 {
+		fmt.Fprintf(stderr, "warning: the key has %d bits; the backends are built for 4096\n", bits)
+	}
+	for _, warning := range pemWarnings(publicPEM) {
+		fmt.Fprintf(stderr, "warning: %s %s\n", fs.Arg(1), warning)
+	}
+	fmt.Fprintf(stdout, "%d-bit key pair OK\nPublic key hash: %s\n", key.N.BitLen(), publicKeyHash(publicPEM))
+	return nil
+}
+
+// readPrivateKey reads and parses the private key file at path
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %v", err)
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// writeFile writes data to path with perm, also tightening the mode of an
+// existing file
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("failed to set the mode of %s: %v", path, err)
+	}
+	return nil
+}
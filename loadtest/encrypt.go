@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// loadPublicKey reads the RSA public key registrations are encrypted to, as
+// PKIX or PKCS#1 PEM like the app-backend
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key file: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	return key, nil
+}
+
+// encryptToken hybrid-encrypts a device token as the apps do: a fresh
+// AES-256-GCM key, itself RSA-encrypted, in the layout IV (12 bytes) + key
+// length (4 bytes, big endian) + encrypted AES key + ciphertext
+func encryptToken(token string, publicKey *rsa.PublicKey) (string, error) {
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", fmt.Errorf("failed to generate AES key: %v", err)
+	}
+	iv := make([]byte, 12)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate IV: %v", err)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GCM: %v", err)
+	}
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, aesKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt AES key: %v", err)
+	}
+
+	combined := append([]byte{}, iv...)
+	combined = binary.BigEndian.AppendUint32(combined, uint32(len(encryptedKey)))
+	combined = append(combined, encryptedKey...)
+	combined = gcm.Seal(combined, iv, []byte(token), nil)
+	return base64.StdEncoding.EncodeToString(combined), nil
+}
+
+// syntheticToken returns a random stand-in for an FCM registration token,
+// of the length of a real one
+func syntheticToken() string {
+	raw := make([]byte, 120)
+	rand.Read(raw)
+	return "loadtest:" + base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,237 @@
+// Command loadtest registers synthetic devices with a notification backend,
+// then measures it under /v1/notify and /v1/send traffic, reporting latency
+// percentiles and error rates
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"remote-notification/api"
+	"remote-notification/api/client"
+)
+
+var (
+	backendURL    = flag.String("backend", "http://localhost:8080", "URL of the notification backend")
+	apiKeyFlag    = flag.String("api-key", "", "Bearer token sent to the backend (or BACKEND_API_KEY)")
+	publicKeyPath = flag.String("public-key", "public_key.pem", "The backend's public key, which the synthetic tokens are encrypted to")
+	tokenCount    = flag.Int("tokens", 100, "Synthetic device tokens to register")
+	duration      = flag.Duration("duration", 30*time.Second, "How long to send traffic once the tokens are registered")
+	notifyRate    = flag.Float64("notify-rate", 20, "/v1/notify calls a second, each to a random registered token")
+	sendRate      = flag.Float64("send-rate", 0, "/v1/send broadcasts a second, each to every registration on the backend")
+	concurrency   = flag.Int("concurrency", 32, "Calls in flight at most; calls due while all are busy are counted as not made")
+	callTimeout   = flag.Duration("timeout", 10*time.Second, "Timeout of each call")
+	realFCM       = flag.Bool("real-fcm", false, "Also run against a backend without --mock-fcm, which hands the synthetic tokens to FCM")
+)
+
+// config is one load test
+type config struct {
+	BackendURL  string
+	APIKey      string
+	PublicKey   *rsa.PublicKey
+	Tokens      int
+	Duration    time.Duration
+	NotifyRate  float64
+	SendRate    float64
+	Concurrency int
+	Timeout     time.Duration
+	RealFCM     bool
+}
+
+func main() {
+	flag.Parse()
+
+	publicKey, err := loadPublicKey(*publicKeyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		os.Exit(1)
+	}
+	apiKey := *apiKeyFlag
+	if apiKey == "" {
+		apiKey = os.Getenv("BACKEND_API_KEY")
+	}
+	cfg := config{
+		BackendURL:  *backendURL,
+		APIKey:      apiKey,
+		PublicKey:   publicKey,
+		Tokens:      *tokenCount,
+		Duration:    *duration,
+		NotifyRate:  *notifyRate,
+		SendRate:    *sendRate,
+		Concurrency: max(1, *concurrency),
+		Timeout:     *callTimeout,
+		RealFCM:     *realFCM,
+	}
+
+	// An interrupt ends the test early, still reporting what was measured
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, cfg, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		os.Exit(1)
+	}
+}
+
+// run carries out the load test cfg, writing progress and the report to out
+func run(ctx context.Context, cfg config, out io.Writer) error {
+	c := client.New(cfg.BackendURL, cfg.APIKey)
+	c.HTTPClient = &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        cfg.Concurrency,
+		MaxIdleConnsPerHost: cfg.Concurrency,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+	// Every call is measured as made; a retry would hide a failure
+	c.Retries = 0
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the backend status: %v", err)
+	}
+	if !status.FCMMocked && !cfg.RealFCM {
+		return fmt.Errorf("the backend at %s does not mock FCM; start it with --mock-fcm so nothing is delivered, or pass -real-fcm", cfg.BackendURL)
+	}
+	fmt.Fprintf(out, "Backend %s has %d registrations (FCM mocked: %v)\n", cfg.BackendURL, status.RegisteredTokens, status.FCMMocked)
+
+	s := newStats()
+	fmt.Fprintf(out, "Registering %d synthetic tokens...\n", cfg.Tokens)
+	registrations := register(ctx, c, cfg, s)
+	if len(registrations) == 0 && cfg.NotifyRate > 0 {
+		s.report(out)
+		return fmt.Errorf("no registration succeeded, so there is nothing to notify")
+	}
+
+	fmt.Fprintf(out, "Sending for %s: %g notify/s, %g send/s...\n", cfg.Duration, cfg.NotifyRate, cfg.SendRate)
+	sendTraffic(ctx, c, cfg, registrations, s)
+
+	fmt.Fprintln(out)
+	s.report(out)
+	return nil
+}
+
+// register registers cfg.Tokens synthetic tokens, cfg.Concurrency at a time,
+// and returns the registrations that succeeded
+func register(ctx context.Context, c *client.Client, cfg config, s *stats) []*api.RegisterResponse {
+	var (
+		mu            sync.Mutex
+		registrations []*api.RegisterResponse
+		wg            sync.WaitGroup
+	)
+	jobs := make(chan struct{})
+	start := time.Now()
+	for range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				encrypted, err := encryptToken(syntheticToken(), cfg.PublicKey)
+				if err != nil {
+					s.record("register", 0, err)
+					continue
+				}
+				reg := api.TokenRegistration{EncryptedData: encrypted, Platform: "android", AppVersion: "loadtest"}
+				callCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+				start := time.Now()
+				resp, err := c.Register(callCtx, reg)
+				d := time.Since(start)
+				cancel()
+				if err == nil && resp.TokenID == "" {
+					err = fmt.Errorf("no token_id in the response")
+				}
+				s.record("register", d, err)
+				if err == nil {
+					mu.Lock()
+					registrations = append(registrations, resp)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for range cfg.Tokens {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	s.setElapsed("register", time.Since(start))
+	return registrations
+}
+
+// sendTraffic makes /v1/notify and /v1/send calls at their rates for
+// cfg.Duration, then waits for the calls in flight
+func sendTraffic(ctx context.Context, c *client.Client, cfg config, registrations []*api.RegisterResponse, s *stats) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	// In-flight calls outlive the phase, each bounded by its own timeout
+	background := context.WithoutCancel(ctx)
+	workers := make(chan struct{}, cfg.Concurrency)
+	var calls sync.WaitGroup
+	var schedules sync.WaitGroup
+	schedule := func(kind string, rate float64, call func(ctx context.Context, n int) error) {
+		if rate <= 0 {
+			return
+		}
+		schedules.Add(1)
+		go func() {
+			defer schedules.Done()
+			start := time.Now()
+			defer func() { s.setElapsed(kind, time.Since(start)) }()
+
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer ticker.Stop()
+			for n := 0; ; n++ {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				select {
+				case workers <- struct{}{}:
+				default:
+					s.drop(kind)
+					continue
+				}
+				calls.Add(1)
+				go func() {
+					defer calls.Done()
+					defer func() { <-workers }()
+					callCtx, cancel := context.WithTimeout(background, cfg.Timeout)
+					defer cancel()
+					start := time.Now()
+					err := call(callCtx, n)
+					s.record(kind, time.Since(start), err)
+				}()
+			}
+		}()
+	}
+
+	schedule("notify", cfg.NotifyRate, func(ctx context.Context, n int) error {
+		reg := registrations[rand.IntN(len(registrations))]
+		notif := api.NotificationRequest{
+			TokenID:      reg.TokenID,
+			NotifySecret: reg.NotifySecret,
+			Title:        "Load test",
+			Body:         fmt.Sprintf("Notification %d", n),
+		}
+		_, err := c.Notify(ctx, notif)
+		return err
+	})
+	schedule("send", cfg.SendRate, func(ctx context.Context, n int) error {
+		_, err := c.SendAll(ctx, api.SendRequest{Title: "Load test", Body: fmt.Sprintf("Broadcast %d", n)})
+		return err
+	})
+	schedules.Wait()
+	calls.Wait()
+}
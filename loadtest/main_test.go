@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
+)
+
+// decryptToken reverses encryptToken as the notification backend does
+func decryptToken(t *testing.T, key *rsa.PrivateKey, encrypted string) string {
+	t.Helper()
+	combined, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Fatalf("encrypted_data is not base64: %v", err)
+	}
+	keyLength := int(binary.BigEndian.Uint32(combined[12:16]))
+	if keyLength != key.Size() {
+		t.Fatalf("Expected an AES key encrypted to %d bytes, got %d", key.Size(), keyLength)
+	}
+	aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, key, combined[16:16+keyLength])
+	if err != nil {
+		t.Fatalf("Failed to decrypt the AES key: %v", err)
+	}
+	block, _ := aes.NewCipher(aesKey)
+	gcm, _ := cipher.NewGCM(block)
+	token, err := gcm.Open(nil, combined[:12], combined[16+keyLength:], nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt the token: %v", err)
+	}
+	return string(token)
+}
+
+// fakeBackend registers every token it can decrypt and accepts every send
+type fakeBackend struct {
+	t       *testing.T
+	key     *rsa.PrivateKey
+	mocked  bool
+	mu      sync.Mutex
+	secrets map[string]string // notify secret by token ID
+	notify  atomic.Int32
+	sends   atomic.Int32
+}
+
+func (b *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/status":
+		json.NewEncoder(w).Encode(api.StatusResponse{FCMMocked: b.mocked})
+	case "/v1/register":
+		var reg api.TokenRegistration
+		json.NewDecoder(r.Body).Decode(&reg)
+		if token := decryptToken(b.t, b.key, reg.EncryptedData); !strings.HasPrefix(token, "loadtest:") || reg.Platform != "android" {
+			b.t.Errorf("Unexpected registration of %q on %q", token, reg.Platform)
+		}
+		b.mu.Lock()
+		id := fmt.Sprintf("id-%d", len(b.secrets))
+		b.secrets[id] = "secret-" + id
+		b.mu.Unlock()
+		json.NewEncoder(w).Encode(api.RegisterResponse{Success: true, TokenID: id, NotifySecret: "secret-" + id})
+	case "/v1/notify":
+		var notif api.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&notif)
+		b.mu.Lock()
+		ok := b.secrets[notif.TokenID] == notif.NotifySecret && notif.NotifySecret != ""
+		b.mu.Unlock()
+		// Every other call is refused, for the error rate
+		if !ok || b.notify.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"success":false,"code":"SERVER_BUSY","message":"busy"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(api.NotifyResponse{Success: true})
+	case "/v1/send":
+		b.sends.Add(1)
+		json.NewEncoder(w).Encode(api.SendResponse{Success: true})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLoadTest(t *testing.T) {
+	backend := &fakeBackend{t: t, key: apitest.PrivateKey(), mocked: true, secrets: make(map[string]string)}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	cfg := config{
+		BackendURL:  server.URL,
+		PublicKey:   apitest.PublicKey(),
+		Tokens:      10,
+		Duration:    300 * time.Millisecond,
+		NotifyRate:  100,
+		SendRate:    10,
+		Concurrency: 4,
+		Timeout:     time.Second,
+	}
+	var out bytes.Buffer
+	if err := run(context.Background(), cfg, &out); err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out.String())
+	}
+	report := out.String()
+	if len(backend.secrets) != 10 || backend.notify.Load() == 0 || backend.sends.Load() == 0 {
+		t.Errorf("Expected 10 registrations, notifies and sends, got %d, %d and %d", len(backend.secrets), backend.notify.Load(), backend.sends.Load())
+	}
+	for _, want := range []string{"register", "notify", "send", "p99", "notify error 429 SERVER_BUSY"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q in the report:\n%s", want, report)
+		}
+	}
+
+	// Without --mock-fcm the synthetic tokens would go to FCM
+	backend.mocked = false
+	out.Reset()
+	if err := run(context.Background(), cfg, &out); err == nil || !strings.Contains(err.Error(), "--mock-fcm") {
+		t.Errorf("Expected a backend without mocked FCM refused, got %v", err)
+	}
+	if len(backend.secrets) != 10 {
+		t.Errorf("Expected nothing registered on the refused backend, got %d registrations", len(backend.secrets))
+	}
+}
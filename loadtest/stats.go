@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"remote-notification/api/client"
+)
+
+// stats collects the outcome of every call, by kind of call
+type stats struct {
+	mu    sync.Mutex
+	ops   map[string]*opStats
+	order []string // kinds in the order first seen, for the report
+}
+
+// opStats is the outcome of the calls of one kind
+type opStats struct {
+	latencies []time.Duration // of the successful calls
+	errors    map[string]int  // by errorKey
+	dropped   int             // calls not made since every worker was busy
+	elapsed   time.Duration   // how long the phase making the calls ran
+}
+
+func newStats() *stats {
+	return &stats{ops: make(map[string]*opStats)}
+}
+
+// op returns the stats of a kind; the caller holds mu
+func (s *stats) op(kind string) *opStats {
+	o, ok := s.ops[kind]
+	if !ok {
+		o = &opStats{errors: make(map[string]int)}
+		s.ops[kind] = o
+		s.order = append(s.order, kind)
+	}
+	return o
+}
+
+// record adds a call that took d and failed with err, if set
+func (s *stats) record(kind string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.op(kind)
+	if err != nil {
+		o.errors[errorKey(err)]++
+		return
+	}
+	o.latencies = append(o.latencies, d)
+}
+
+// drop counts a call the schedule asked for but no worker was free to make
+func (s *stats) drop(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.op(kind).dropped++
+}
+
+// setElapsed records how long the calls of a kind were made for, for the rate
+func (s *stats) setElapsed(kind string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.op(kind).elapsed = d
+}
+
+// errorKey groups failures by what the backend answered
+func errorKey(err error) string {
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == "" {
+			return fmt.Sprint(apiErr.StatusCode)
+		}
+		return fmt.Sprintf("%d %s", apiErr.StatusCode, apiErr.Code)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var unreachable *client.UnreachableError
+	if errors.As(err, &unreachable) {
+		return "unreachable"
+	}
+	return err.Error()
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// report writes a table of every kind of call, then the errors and dropped calls
+func (s *stats) report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "call\tok\terrors\terror rate\tok/s\tp50\tp90\tp99\tmax\t")
+	for _, kind := range s.order {
+		o := s.ops[kind]
+		latencies := slices.Clone(o.latencies)
+		slices.Sort(latencies)
+		failed := 0
+		for _, n := range o.errors {
+			failed += n
+		}
+		errorRate, rate := 0.0, 0.0
+		if total := len(latencies) + failed; total > 0 {
+			errorRate = float64(failed) / float64(total) * 100
+		}
+		if o.elapsed > 0 {
+			rate = float64(len(latencies)) / o.elapsed.Seconds()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f%%\t%.1f\t%s\t%s\t%s\t%s\t\n", kind, len(latencies), failed, errorRate, rate,
+			round(percentile(latencies, 50)), round(percentile(latencies, 90)), round(percentile(latencies, 99)), round(percentile(latencies, 100)))
+	}
+	tw.Flush()
+
+	for _, kind := range s.order {
+		o := s.ops[kind]
+		keys := make([]string, 0, len(o.errors))
+		for key := range o.errors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s error %s: %d\n", kind, key, o.errors[key])
+		}
+		if o.dropped > 0 {
+			fmt.Fprintf(w, "%s: %d calls not made, all workers were busy (raise -concurrency or lower the rate)\n", kind, o.dropped)
+		}
+	}
+}
+
+// round shortens a latency for the report
+func round(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-notification/api/client"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{50: 50 * time.Millisecond, 90: 90 * time.Millisecond, 99: 99 * time.Millisecond, 100: 100 * time.Millisecond, 0: time.Millisecond} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%g) = %s, want %s", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing = %s, want 0", got)
+	}
+}
+
+func TestReport(t *testing.T) {
+	s := newStats()
+	for range 3 {
+		s.record("notify", 10*time.Millisecond, nil)
+	}
+	s.record("notify", 0, &client.Error{StatusCode: 429, Code: "SERVER_BUSY"})
+	s.record("notify", 0, &client.UnreachableError{Err: errors.New("connection refused")})
+	s.record("send", 0, &client.UnreachableError{Err: fmt.Errorf("Post: %w", context.DeadlineExceeded)})
+	s.drop("notify")
+	s.setElapsed("notify", time.Second)
+
+	var out bytes.Buffer
+	s.report(&out)
+	report := out.String()
+	for _, want := range []string{"40.00%", "100.00%", "3.0", "10ms", "notify error 429 SERVER_BUSY: 1", "notify error unreachable: 1", "send error timeout: 1", "1 calls not made"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q in the report:\n%s", want, report)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorCode is one of the notification backend's error codes. Only the codes
+// the mock can return are defined; names and statuses match the real server.
+type ErrorCode string
+
+const (
+	ErrMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrInvalidRequest       ErrorCode = "INVALID_REQUEST"
+	ErrInvalidJSON          ErrorCode = "INVALID_JSON"
+	ErrMissingField         ErrorCode = "MISSING_FIELD"
+	ErrInvalidEncryptedData ErrorCode = "INVALID_ENCRYPTED_DATA"
+	ErrDecryptFailed        ErrorCode = "DECRYPT_FAILED"
+	ErrInvalidFCMToken      ErrorCode = "INVALID_FCM_TOKEN"
+	ErrInvalidPlatform      ErrorCode = "INVALID_PLATFORM"
+	ErrUnauthorized         ErrorCode = "UNAUTHORIZED"
+	ErrKeyMismatch          ErrorCode = "KEY_MISMATCH"
+	ErrTokenNotFound        ErrorCode = "TOKEN_NOT_FOUND"
+	ErrTokenUnregistered    ErrorCode = "TOKEN_UNREGISTERED"
+	ErrNoTokens             ErrorCode = "NO_TOKENS"
+	ErrStorageUnavailable   ErrorCode = "STORAGE_UNAVAILABLE"
+	ErrFCMUnavailable       ErrorCode = "FCM_UNAVAILABLE"
+	ErrServerBusy           ErrorCode = "SERVER_BUSY"
+	ErrInternal             ErrorCode = "INTERNAL_ERROR"
+)
+
+// errorStatus maps each code to the HTTP status the real server sends with it
+var errorStatus = map[ErrorCode]int{
+	ErrMethodNotAllowed:     http.StatusMethodNotAllowed,
+	ErrInvalidRequest:       http.StatusBadRequest,
+	ErrInvalidJSON:          http.StatusBadRequest,
+	ErrMissingField:         http.StatusBadRequest,
+	ErrInvalidEncryptedData: http.StatusBadRequest,
+	ErrDecryptFailed:        http.StatusBadRequest,
+	ErrInvalidFCMToken:      http.StatusBadRequest,
+	ErrInvalidPlatform:      http.StatusBadRequest,
+	ErrUnauthorized:         http.StatusUnauthorized,
+	ErrKeyMismatch:          http.StatusForbidden,
+	ErrTokenNotFound:        http.StatusBadRequest,
+	ErrTokenUnregistered:    http.StatusInternalServerError,
+	ErrNoTokens:             http.StatusBadRequest,
+	ErrStorageUnavailable:   http.StatusInternalServerError,
+	ErrFCMUnavailable:       http.StatusInternalServerError,
+	ErrServerBusy:           http.StatusTooManyRequests,
+	ErrInternal:             http.StatusInternalServerError,
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// writeError sends an error response with the status belonging to code
+func writeError(w http.ResponseWriter, code ErrorCode, message string) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	if code == ErrServerBusy {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, ErrorResponse{Success: false, Code: code, Message: message})
+}
+
+// writeJSON sends v as the JSON body of a response with status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
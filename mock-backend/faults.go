@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// faultConfig is the fault injection of the API, set with flags at startup
+// and changed at run time through /mock/faults
+type faultConfig struct {
+	FailRate float64   `json:"fail_rate"` // fraction of calls answered with FailCode, 0 to 1
+	FailCode ErrorCode `json:"fail_code"`
+	Latency  string    `json:"latency,omitempty"` // added before every answer, e.g. "200ms"
+	Paths    []string  `json:"paths,omitempty"`   // API paths the faults apply to; empty is all
+	latency  time.Duration
+}
+
+// validate checks the configuration and parses its latency
+func (c *faultConfig) validate() error {
+	if c.FailRate < 0 || c.FailRate > 1 {
+		return fmt.Errorf("fail_rate must be between 0 and 1, got %g", c.FailRate)
+	}
+	if c.FailCode == "" {
+		c.FailCode = ErrFCMUnavailable
+	}
+	if _, ok := errorStatus[c.FailCode]; !ok {
+		return fmt.Errorf("unknown fail_code %q", c.FailCode)
+	}
+	c.latency = 0
+	if c.Latency != "" {
+		d, err := time.ParseDuration(c.Latency)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid latency %q", c.Latency)
+		}
+		c.latency = d
+	}
+	return nil
+}
+
+// faults holds the current fault configuration
+type faults struct {
+	mu      sync.Mutex
+	initial faultConfig // from the flags, restored by DELETE /mock/faults
+	current faultConfig
+}
+
+func newFaults(initial faultConfig) (*faults, error) {
+	if err := initial.validate(); err != nil {
+		return nil, err
+	}
+	return &faults{initial: initial, current: initial}, nil
+}
+
+func (f *faults) get() faultConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+// inject delays and fails the calls of next as configured
+func (f *faults) inject(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := f.get()
+		if len(cfg.Paths) > 0 && !slices.Contains(cfg.Paths, path) {
+			next(w, r)
+			return
+		}
+		if cfg.latency > 0 {
+			select {
+			case <-time.After(cfg.latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if cfg.FailRate > 0 && rand.Float64() < cfg.FailRate {
+			writeError(w, cfg.FailCode, "Injected fault")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleFaults shows (GET), replaces (PUT) or resets to the flags (DELETE)
+// the fault configuration
+func (f *faults) handleFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var cfg faultConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeError(w, ErrInvalidJSON, "Invalid JSON")
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			writeError(w, ErrInvalidRequest, err.Error())
+			return
+		}
+		f.mu.Lock()
+		f.current = cfg
+		f.mu.Unlock()
+	case http.MethodDelete:
+		f.mu.Lock()
+		f.current = f.initial
+		f.mu.Unlock()
+	default:
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, f.get())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-notification/api"
+	"remote-notification/api/client"
+)
+
+func TestFaultConfig(t *testing.T) {
+	for _, cfg := range []faultConfig{{FailRate: 1.5}, {FailRate: -1}, {FailCode: "NOPE"}, {Latency: "soon"}, {Latency: "-1s"}} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected %+v rejected", cfg)
+		}
+	}
+	cfg := faultConfig{Latency: "20ms"}
+	if err := cfg.validate(); err != nil || cfg.FailCode != ErrFCMUnavailable || cfg.latency != 20*time.Millisecond {
+		t.Errorf("Expected the defaults filled in, got %+v, %v", cfg, err)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	_, ts := newTestServer(t, "")
+	c := client.New(ts.URL, "")
+	c.Retries = 0
+	ctx := context.Background()
+
+	put := func(body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/mock/faults", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Every send fails, but only on the paths listed
+	if resp := put(`{"fail_rate":1,"fail_code":"SERVER_BUSY","latency":"30ms","paths":["/v1/send"]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the faults set, got %d", resp.StatusCode)
+	}
+	start := time.Now()
+	_, err := c.SendAll(ctx, api.SendRequest{Title: "a", Body: "b"})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Code != "SERVER_BUSY" || apiErr.RetryAfter != time.Second {
+		t.Errorf("Expected an injected 429 SERVER_BUSY with Retry-After, got %v", err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("Expected the latency added, answered after %s", d)
+	}
+	if _, err := c.Status(ctx); err != nil {
+		t.Errorf("Expected /v1/status spared, got %v", err)
+	}
+
+	if resp := put(`{"fail_rate":2}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid fail rate refused, got %d", resp.StatusCode)
+	}
+
+	// DELETE restores the flags' configuration, here no faults
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/mock/faults", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the faults reset, got %v, %v", resp, err)
+	}
+	_, err = c.SendAll(ctx, api.SendRequest{Title: "a", Body: "b"})
+	if !errors.As(err, &apiErr) || apiErr.Code != "NO_TOKENS" {
+		t.Errorf("Expected the real answer once the faults are reset, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+module mock-backend
+
+go 1.24.5
+
+require remote-notification/api v0.0.0
+
+replace remote-notification/api => ../api
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"remote-notification/api"
+)
+
+// apiVersion is reported by /v1/status, as the real server's
+const apiVersion = "v1"
+
+// maxBodySize bounds request bodies, as on the real server
+const maxBodySize = 64 << 10
+
+// platforms are the ones the mock accepts; it pretends to deliver through FCM
+var platforms = []string{"android", "ios"}
+
+// server is the mock notification backend: the real server's API over an
+// in-memory store, delivering nothing
+type server struct {
+	key     *rsa.PrivateKey
+	keyHash string // of the public key PEM, see publicKeyHash
+	apiKey  string // required by /v1/notify-user when set
+	store   *store
+	faults  *faults
+}
+
+func newServer(key *rsa.PrivateKey, publicPEM []byte, apiKey string, faults *faults) *server {
+	return &server{key: key, keyHash: publicKeyHash(publicPEM), apiKey: apiKey, store: newStore(), faults: faults}
+}
+
+// route is one API endpoint, relative to /v1. Legacy routes are also served
+// at their unversioned path, as on the real server.
+type route struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+	Legacy  bool
+}
+
+func (s *server) routes() []route {
+	return []route{
+		{Method: http.MethodPost, Path: "/register", Handler: s.handleRegister, Legacy: true},
+		{Method: http.MethodPost, Path: "/send", Handler: s.handleSend, Legacy: true},
+		{Method: http.MethodPost, Path: "/notify", Handler: s.handleNotify, Legacy: true},
+		{Method: http.MethodPost, Path: "/notify-user", Handler: s.requireAPIKey(s.handleNotifyUser)},
+		{Method: http.MethodGet, Path: "/status", Handler: s.handleStatus, Legacy: true},
+		{Method: http.MethodGet, Path: "/version", Handler: handleVersion, Legacy: true},
+	}
+}
+
+// handler serves the API with fault injection, and the /mock endpoints without
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range s.routes() {
+		h := s.faults.inject("/v1"+rt.Path, allowMethod(rt.Method, rt.Handler))
+		mux.HandleFunc("/v1"+rt.Path, h)
+		if rt.Legacy {
+			mux.HandleFunc(rt.Path, h)
+		}
+	}
+	mux.HandleFunc("/mock/tokens", s.handleMockTokens)
+	mux.HandleFunc("/mock/notifications", s.handleMockNotifications)
+	mux.HandleFunc("/mock/faults", s.faults.handleFaults)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return logRequests(mux)
+}
+
+// allowMethod answers METHOD_NOT_ALLOWED to other methods than method
+func allowMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, ErrMethodNotAllowed, "Method not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAPIKey checks the Bearer token when --raw-api-key is set
+func (s *server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.apiKey != "" {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(s.apiKey)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="notify-raw"`)
+				writeError(w, ErrUnauthorized, "Missing or invalid API key")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// logRequests logs every request with its method and path
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeBody reads a JSON request body into v, answering the error itself
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v); err != nil {
+		writeError(w, ErrInvalidJSON, "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var reg api.TokenRegistration
+	if !decodeBody(w, r, &reg) {
+		return
+	}
+	switch {
+	case reg.EncryptedData == "":
+		writeError(w, ErrMissingField, "Encrypted data is required")
+		return
+	case len(reg.EncryptedData) < 100:
+		writeError(w, ErrInvalidEncryptedData, "Encrypted data too short")
+		return
+	case len(reg.EncryptedData) > 10000:
+		writeError(w, ErrInvalidEncryptedData, "Encrypted data too long")
+		return
+	case reg.Platform == "":
+		writeError(w, ErrMissingField, "platform is required")
+		return
+	case !slices.Contains(platforms, reg.Platform):
+		writeError(w, ErrInvalidPlatform, fmt.Sprintf("unknown platform %q", reg.Platform))
+		return
+	}
+
+	// A challenge is the additional data of the seal; the mock does not check
+	// it was issued
+	var aad []byte
+	if reg.Challenge != "" {
+		aad = []byte(reg.Challenge)
+	}
+	token, err := decryptToken(s.key, reg.EncryptedData, aad)
+	if err != nil {
+		slog.Warn("Failed to decrypt token", "error", err)
+		writeError(w, ErrDecryptFailed, "Invalid encrypted token")
+		return
+	}
+	if err := api.ValidateFCMToken(token); err != nil {
+		writeError(w, ErrInvalidFCMToken, "Invalid device address: decrypted "+err.Error())
+		return
+	}
+
+	tokenID, secret, total, err := s.store.add(registration{
+		Platform:     reg.Platform,
+		Token:        token,
+		UserHash:     reg.UserHash,
+		AppVersion:   reg.AppVersion,
+		RegisteredAt: time.Now().UTC(),
+	}, s.keyHash)
+	if err != nil {
+		slog.Error("Failed to store token", "error", err)
+		writeError(w, ErrInternal, "Failed to store token")
+		return
+	}
+	issuedAt := time.Now().Unix()
+	signature, err := signRegistration(s.key, tokenID, issuedAt)
+	if err != nil {
+		slog.Error("Failed to sign registration", "error", err)
+		writeError(w, ErrInternal, "Failed to store token")
+		return
+	}
+	slog.Info("Token registered", "token_id", tokenID, "platform", reg.Platform)
+	writeJSON(w, http.StatusOK, api.RegisterResponse{
+		Success:      true,
+		Message:      "Token registered successfully",
+		TokenID:      tokenID,
+		Platform:     reg.Platform,
+		TotalTokens:  total,
+		NotifySecret: secret,
+		IssuedAt:     issuedAt,
+		Signature:    signature,
+	})
+}
+
+func (s *server) handleNotify(w http.ResponseWriter, r *http.Request) {
+	var notif api.NotificationRequest
+	if !decodeBody(w, r, &notif) {
+		return
+	}
+	if notif.Template != "" || len(notif.Variables) > 0 {
+		writeError(w, ErrInvalidRequest, "Templates are not supported by the mock backend")
+		return
+	}
+	if notif.Title == "" || notif.Body == "" {
+		writeError(w, ErrMissingField, "Title and body are required")
+		return
+	}
+	if notif.TokenID == "" {
+		writeError(w, ErrMissingField, "token_id is required")
+		return
+	}
+	reg := s.store.get(notif.TokenID)
+	if reg == nil {
+		writeError(w, ErrTokenNotFound, "Token ID not found")
+		return
+	}
+	if notif.PublicKeyHash != "" && notif.PublicKeyHash != reg.publicKeyHash {
+		writeError(w, ErrKeyMismatch, "Token was registered under another public key")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(notif.NotifySecret)), []byte(reg.notifySecretHash)) != 1 {
+		writeError(w, ErrUnauthorized, "Missing or invalid notify secret")
+		return
+	}
+	if notif.DryRun {
+		writeJSON(w, http.StatusOK, api.NotifyResponse{Success: true, Message: "Dry run passed; nothing was sent", DryRun: true})
+		return
+	}
+	s.store.deliver(r.URL.Path, *reg, notif.Title, notif.Body, notif.Critical)
+	writeJSON(w, http.StatusOK, api.NotifyResponse{Success: true, Message: "Notification sent successfully"})
+}
+
+func (s *server) handleSend(w http.ResponseWriter, r *http.Request) {
+	var notif api.SendRequest
+	if !decodeBody(w, r, &notif) {
+		return
+	}
+	if notif.Experiment != "" || len(notif.Variants) > 0 || notif.LocalTime != "" {
+		writeError(w, ErrInvalidRequest, "Split and local-time sends are not supported by the mock backend")
+		return
+	}
+	if notif.Title == "" || notif.Body == "" {
+		writeError(w, ErrMissingField, "Title and body are required")
+		return
+	}
+	if notif.Platform != "" && !slices.Contains(platforms, notif.Platform) {
+		writeError(w, ErrInvalidPlatform, fmt.Sprintf("unknown platform %q", notif.Platform))
+		return
+	}
+	regs := s.store.list(func(reg *registration) bool {
+		return notif.Platform == "" || reg.Platform == notif.Platform
+	})
+	if len(regs) == 0 {
+		writeError(w, ErrNoTokens, "No tokens registered")
+		return
+	}
+	s.sendToAll(w, r.URL.Path, regs, notif.Title, notif.Body, notif.Critical)
+}
+
+func (s *server) handleNotifyUser(w http.ResponseWriter, r *http.Request) {
+	var notif api.UserNotificationRequest
+	if !decodeBody(w, r, &notif) {
+		return
+	}
+	if notif.UserHash == "" || notif.Title == "" || notif.Body == "" {
+		writeError(w, ErrMissingField, "user_hash, title and body are required")
+		return
+	}
+	regs := s.store.list(func(reg *registration) bool { return reg.UserHash == notif.UserHash })
+	if len(regs) == 0 {
+		writeError(w, ErrNoTokens, "No devices registered for this user")
+		return
+	}
+	s.sendToAll(w, r.URL.Path, regs, notif.Title, notif.Body, notif.Critical)
+}
+
+// sendToAll delivers to every registration of regs; the mock never fails one
+func (s *server) sendToAll(w http.ResponseWriter, endpoint string, regs []registration, title, body string, critical bool) {
+	for _, reg := range regs {
+		s.store.deliver(endpoint, reg, title, body, critical)
+	}
+	writeJSON(w, http.StatusOK, api.SendResponse{
+		Success:     true,
+		Message:     fmt.Sprintf("Sent to %d devices, 0 failures", len(regs)),
+		SentCount:   len(regs),
+		TotalTokens: len(regs),
+	})
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	counts, total := s.store.platforms()
+	writeJSON(w, http.StatusOK, api.StatusResponse{
+		RegisteredTokens: total,
+		Platforms:        counts,
+		FCMMocked:        true,
+		APIVersion:       apiVersion,
+		StorageType:      "memory",
+		PublicKeyHash:    s.keyHash[:16] + "...",
+	})
+}
+
+// handleMockTokens lists (GET) or forgets (DELETE) the registrations
+func (s *server) handleMockTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		regs := s.store.list(nil)
+		if regs == nil {
+			regs = []registration{}
+		}
+		writeJSON(w, http.StatusOK, regs)
+	case http.MethodDelete:
+		s.store.clearRegistrations()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleMockNotifications lists (GET) or clears (DELETE) the deliveries
+func (s *server) handleMockNotifications(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		log := s.store.log()
+		if log == nil {
+			log = []delivery{}
+		}
+		writeJSON(w, http.StatusOK, log)
+	case http.MethodDelete:
+		s.store.clearDeliveries()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+	}
+}
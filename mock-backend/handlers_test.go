@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
+	"remote-notification/api/client"
+)
+
+// newTestServer starts a mock backend with a generated key and no faults
+func newTestServer(t *testing.T, apiKey string) (*server, *httptest.Server) {
+	t.Helper()
+	key, publicPEM, err := loadKeys("", filepath.Join(t.TempDir(), "public_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFaults(faultConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(key, publicPEM, apiKey, f)
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestRegisterAndNotify(t *testing.T) {
+	s, ts := newTestServer(t, "")
+	c := client.New(ts.URL, "")
+	ctx := context.Background()
+
+	reg, err := c.Register(ctx, api.TokenRegistration{
+		EncryptedData: apitest.EncryptTokenTo(&s.key.PublicKey, apitest.FCMToken(1), nil),
+		Platform:      "android",
+		UserHash:      "user-1",
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := api.ParseOpaqueID(reg.TokenID); err != nil {
+		t.Errorf("Expected an opaque ID in the real format, got %q: %v", reg.TokenID, err)
+	}
+	if reg.NotifySecret == "" || reg.TotalTokens != 1 {
+		t.Errorf("Expected a notify secret and 1 token, got %+v", reg)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(reg.Signature)
+	digest := sha256.Sum256(fmt.Appendf(nil, "remote-notification registration v1\n%s\n%d", reg.TokenID, reg.IssuedAt))
+	if err := rsa.VerifyPSS(&s.key.PublicKey, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+		t.Errorf("Registration signature does not verify: %v", err)
+	}
+
+	notif := api.NotificationRequest{TokenID: reg.TokenID, NotifySecret: reg.NotifySecret, PublicKeyHash: s.keyHash, Title: "Hello", Body: "World"}
+	if _, err := c.Notify(ctx, notif); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	dry := notif
+	dry.DryRun = true
+	if resp, err := c.Notify(ctx, dry); err != nil || !resp.DryRun {
+		t.Errorf("Expected a dry run, got %+v, %v", resp, err)
+	}
+	if resp, err := c.NotifyUser(ctx, api.UserNotificationRequest{UserHash: "user-1", Title: "Hi", Body: "User"}); err != nil || resp.SentCount != 1 {
+		t.Errorf("Expected notify-user to reach 1 device, got %+v, %v", resp, err)
+	}
+	if resp, err := c.SendAll(ctx, api.SendRequest{Title: "All", Body: "Devices", Platform: "android"}); err != nil || resp.SentCount != 1 {
+		t.Errorf("Expected the send to reach 1 device, got %+v, %v", resp, err)
+	}
+
+	log := s.store.log()
+	if len(log) != 3 {
+		t.Fatalf("Expected 3 deliveries, not the dry run, got %+v", log)
+	}
+	if log[0].Token != apitest.FCMToken(1) || log[0].Title != "Hello" || log[0].Endpoint != "/v1/notify" {
+		t.Errorf("Unexpected first delivery %+v", log[0])
+	}
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.RegisteredTokens != 1 || status.Platforms["android"] != 1 || !status.FCMMocked || status.StorageType != "memory" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, ts := newTestServer(t, "secret-key")
+	c := client.New(ts.URL, "")
+	ctx := context.Background()
+	reg, err := c.Register(ctx, api.TokenRegistration{EncryptedData: apitest.EncryptTokenTo(&s.key.PublicKey, apitest.FCMToken(1), nil), Platform: "ios"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	other := apitest.OtherPrivateKey()
+	calls := []struct {
+		name   string
+		call   func() error
+		status int
+		code   string
+	}{
+		{"wrong key", func() error {
+			_, err := c.Register(ctx, api.TokenRegistration{EncryptedData: apitest.EncryptTokenTo(&other.PublicKey, apitest.FCMToken(1), nil), Platform: "android"})
+			return err
+		}, 400, "DECRYPT_FAILED"},
+		{"unknown platform", func() error {
+			_, err := c.Register(ctx, api.TokenRegistration{EncryptedData: apitest.EncryptTokenTo(&s.key.PublicKey, apitest.FCMToken(1), nil), Platform: "pager"})
+			return err
+		}, 400, "INVALID_PLATFORM"},
+		{"unknown token", func() error {
+			_, err := c.Notify(ctx, api.NotificationRequest{TokenID: "rn1_unknown", Title: "a", Body: "b"})
+			return err
+		}, 400, "TOKEN_NOT_FOUND"},
+		{"wrong secret", func() error {
+			_, err := c.Notify(ctx, api.NotificationRequest{TokenID: reg.TokenID, NotifySecret: "guess", Title: "a", Body: "b"})
+			return err
+		}, 401, "UNAUTHORIZED"},
+		{"other public key", func() error {
+			_, err := c.Notify(ctx, api.NotificationRequest{TokenID: reg.TokenID, NotifySecret: reg.NotifySecret, PublicKeyHash: "0000", Title: "a", Body: "b"})
+			return err
+		}, 403, "KEY_MISMATCH"},
+		{"no such platform registered", func() error {
+			_, err := c.SendAll(ctx, api.SendRequest{Title: "a", Body: "b", Platform: "android"})
+			return err
+		}, 400, "NO_TOKENS"},
+		{"notify-user without API key", func() error {
+			_, err := c.NotifyUser(ctx, api.UserNotificationRequest{UserHash: "u", Title: "a", Body: "b"})
+			return err
+		}, 401, "UNAUTHORIZED"},
+	}
+	for _, tc := range calls {
+		var apiErr *client.Error
+		if err := tc.call(); !errors.As(err, &apiErr) || apiErr.StatusCode != tc.status || apiErr.Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %v", tc.name, tc.status, tc.code, err)
+		}
+	}
+	if log := s.store.log(); len(log) != 0 {
+		t.Errorf("Expected nothing delivered, got %+v", log)
+	}
+}
+
+func TestMockEndpoints(t *testing.T) {
+	s, ts := newTestServer(t, "")
+	c := client.New(ts.URL, "")
+	reg, err := c.Register(context.Background(), api.TokenRegistration{EncryptedData: apitest.EncryptTokenTo(&s.key.PublicKey, apitest.FCMToken(1), nil), Platform: "android"})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/mock/tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var regs []registration
+	json.NewDecoder(resp.Body).Decode(&regs)
+	resp.Body.Close()
+	if len(regs) != 1 || regs[0].TokenID != reg.TokenID || regs[0].Token != apitest.FCMToken(1) {
+		t.Errorf("Expected the registration with its decrypted token, got %+v", regs)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/mock/tokens", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the registrations cleared, got %v, %v", resp, err)
+	}
+	if _, err := c.Notify(context.Background(), api.NotificationRequest{TokenID: reg.TokenID, NotifySecret: reg.NotifySecret, Title: "a", Body: "b"}); err == nil {
+		t.Error("Expected a cleared registration not found")
+	}
+}
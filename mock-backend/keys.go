@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// registrationSignatureContext starts every signed registration message, as
+// on the real server
+const registrationSignatureContext = "remote-notification registration v1"
+
+// loadKeys returns the key pair registrations are encrypted to and the public
+// key PEM the app backend hashes. Without privatePath a key is generated for
+// this run and its public key written to publicPath; with it, publicPath must
+// hold the matching public key, as the real server requires.
+func loadKeys(privatePath, publicPath string) (*rsa.PrivateKey, []byte, error) {
+	if privatePath == "" {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+		}
+		publicPEM, err := encodePublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := os.WriteFile(publicPath, publicPEM, 0644); err != nil {
+			return nil, nil, fmt.Errorf("failed to write public key file: %v", err)
+		}
+		return key, publicPEM, nil
+	}
+
+	data, err := os.ReadFile(privatePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key file: %v", err)
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicPEM, err := os.ReadFile(publicPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read public key file: %v", err)
+	}
+	block, _ := pem.Decode(publicPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("failed to decode public key PEM block")
+	}
+	derived, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode public key: %v", err)
+	}
+	if !bytes.Equal(block.Bytes, derived) && !bytes.Equal(block.Bytes, x509.MarshalPKCS1PublicKey(&key.PublicKey)) {
+		return nil, nil, fmt.Errorf("%s is not the public key of %s", publicPath, privatePath)
+	}
+	return key, publicPEM, nil
+}
+
+// parsePrivateKey reads a PKCS#1 or PKCS#8 RSA private key PEM
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key (tried both PKCS#1 and PKCS#8 formats): %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+// encodePublicKey returns the PKIX PEM of a public key
+func encodePublicKey(pub *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// publicKeyHash is the hash /v1/notify's public_key_hash is compared to: the
+// SHA-256 of the public key file as the app backend reads it
+func publicKeyHash(publicPEM []byte) string {
+	hash := sha256.Sum256(publicPEM)
+	return hex.EncodeToString(hash[:])
+}
+
+// decryptToken opens a hybrid-encrypted payload in the apps' layout: IV (12
+// bytes) + key length (4 bytes, big endian) + RSA-encrypted AES-256 key +
+// AES-GCM ciphertext, sealed with aad
+func decryptToken(key *rsa.PrivateKey, encrypted string, aad []byte) (string, error) {
+	combined, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64: %v", err)
+	}
+	if len(combined) < 16 {
+		return "", errors.New("encrypted data too short")
+	}
+	keyLength := int(binary.BigEndian.Uint32(combined[12:16]))
+	if keyLength != key.Size() {
+		return "", fmt.Errorf("invalid encrypted AES key size: expected %d bytes, got %d", key.Size(), keyLength)
+	}
+	if len(combined) < 16+keyLength {
+		return "", errors.New("encrypted data malformed")
+	}
+	aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, key, combined[16:16+keyLength])
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt AES key: %v", err)
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GCM: %v", err)
+	}
+	token, err := gcm.Open(nil, combined[:12], combined[16+keyLength:], aad)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token: %v", err)
+	}
+	return string(token), nil
+}
+
+// signRegistration signs a registration response as the real server does,
+// with RSA-PSS over SHA-256, so the app backend's signature check passes
+func signRegistration(key *rsa.PrivateKey, tokenID string, issuedAt int64) (string, error) {
+	digest := sha256.Sum256(fmt.Appendf(nil, "%s\n%s\n%d", registrationSignatureContext, tokenID, issuedAt))
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign registration: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,92 @@
+// Command mock-backend serves the notification backend's API from memory,
+// without Firebase or SOS credentials, so the app backend and the apps can be
+// developed against it. It accepts real hybrid-encrypted registrations and
+// signs its answers like the real server, logs notifications instead of
+// delivering them, and can inject latency and failures.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+var version = "dev" // Set by build flags
+
+var (
+	port           = flag.String("port", "8080", "Port to listen on")
+	privateKeyPath = flag.String("private-key", "", "RSA private key registrations are encrypted to; empty generates one for this run")
+	publicKeyPath  = flag.String("public-key", "mock_public_key.pem", "Public key of --private-key, or where the generated key's public key is written for the app backend and apps")
+	rawAPIKey      = flag.String("raw-api-key", "", "Bearer token /v1/notify-user requires; empty leaves it open (or RAW_API_KEY)")
+	failRate       = flag.Float64("fail-rate", 0, "Fraction of API calls answered with --fail-code, 0 to 1")
+	failCode       = flag.String("fail-code", string(ErrFCMUnavailable), "Error code of the injected failures, e.g. SERVER_BUSY or STORAGE_UNAVAILABLE")
+	latency        = flag.Duration("latency", 0, "Delay added before answering each API call")
+)
+
+// VersionInfo answers /v1/version, in the real server's shape
+type VersionInfo struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"go_version"`
+	Features  map[string]string `json:"features"`
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, VersionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Features:  map[string]string{"storage": "memory", "fcm": "mocked"},
+	})
+}
+
+func main() {
+	flag.Parse()
+
+	apiKey := *rawAPIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("RAW_API_KEY")
+	}
+	// Listen first, so a second instance cannot replace the key file of one
+	// already running
+	ln, err := net.Listen("tcp", ":"+*port)
+	if err != nil {
+		fatal("Error listening", "error", err)
+	}
+	key, publicPEM, err := loadKeys(*privateKeyPath, *publicKeyPath)
+	if err != nil {
+		fatal("Error loading keys", "error", err)
+	}
+	if *privateKeyPath == "" {
+		slog.Info("Generated a key for this run; encrypt registrations to its public key", "public_key", *publicKeyPath)
+	}
+	f, err := newFaults(faultConfig{FailRate: *failRate, FailCode: ErrorCode(*failCode), Latency: latencyString(*latency)})
+	if err != nil {
+		fatal("Invalid fault injection", "error", err)
+	}
+
+	s := newServer(key, publicPEM, apiKey, f)
+	srv := &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Warn("Mock notification backend: registrations are kept in memory and nothing is delivered", "port", *port)
+	if err := srv.Serve(ln); err != nil {
+		fatal("Server failed", "error", err)
+	}
+}
+
+// latencyString formats a --latency for faultConfig, empty for none
+func latencyString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"remote-notification/api"
+)
+
+// maxDeliveries bounds the delivery log, dropping the oldest
+const maxDeliveries = 1000
+
+// registration is a registered device, kept in memory only
+type registration struct {
+	TokenID          string    `json:"token_id"`
+	Platform         string    `json:"platform"`
+	Token            string    `json:"token"` // decrypted, so developers can see what the app sent
+	UserHash         string    `json:"user_hash,omitempty"`
+	AppVersion       string    `json:"app_version,omitempty"`
+	RegisteredAt     time.Time `json:"registered_at"`
+	notifySecretHash string
+	publicKeyHash    string
+}
+
+// delivery is a notification the mock would have handed to FCM
+type delivery struct {
+	Endpoint    string    `json:"endpoint"` // API path the notification was sent through
+	TokenID     string    `json:"token_id"`
+	Platform    string    `json:"platform"`
+	Token       string    `json:"token"`
+	Title       string    `json:"title"`
+	Body        string    `json:"body"`
+	Critical    bool      `json:"critical,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	MessageID   string    `json:"message_id"`
+}
+
+// store holds the registrations and the log of deliveries
+type store struct {
+	mu            sync.Mutex
+	registrations map[string]*registration
+	order         []string // token IDs in registration order
+	deliveries    []delivery
+	sent          int // deliveries ever made, for message IDs
+}
+
+func newStore() *store {
+	return &store{registrations: make(map[string]*registration)}
+}
+
+// add stores a registration under a new opaque ID in the real server's format
+// and returns the ID and notify secret
+func (s *store) add(reg registration, keyHash string) (tokenID, secret string, total int, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", 0, fmt.Errorf("failed to generate opaque ID: %v", err)
+	}
+	tokenID = fmt.Sprintf("rn%d_%s", api.OpaqueIDVersion, api.OpaqueIDEncoding.EncodeToString(raw))
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", 0, fmt.Errorf("failed to generate notify secret: %v", err)
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+
+	reg.TokenID = tokenID
+	reg.notifySecretHash = hashSecret(secret)
+	reg.publicKeyHash = keyHash
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registrations[tokenID] = &reg
+	s.order = append(s.order, tokenID)
+	return tokenID, secret, len(s.order), nil
+}
+
+// get returns the registration of an opaque ID, or nil
+func (s *store) get(tokenID string) *registration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reg, ok := s.registrations[tokenID]; ok {
+		r := *reg
+		return &r
+	}
+	return nil
+}
+
+// list returns the registrations accepted by match, in registration order
+func (s *store) list(match func(*registration) bool) []registration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var regs []registration
+	for _, id := range s.order {
+		if reg := s.registrations[id]; match == nil || match(reg) {
+			regs = append(regs, *reg)
+		}
+	}
+	return regs
+}
+
+// platforms counts the registrations by platform, for /v1/status
+func (s *store) platforms() (map[string]int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int)
+	for _, reg := range s.registrations {
+		counts[reg.Platform]++
+	}
+	return counts, len(s.registrations)
+}
+
+// deliver logs a notification to reg and returns its message ID
+func (s *store) deliver(endpoint string, reg registration, title, body string, critical bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	d := delivery{
+		Endpoint:    endpoint,
+		TokenID:     reg.TokenID,
+		Platform:    reg.Platform,
+		Token:       reg.Token,
+		Title:       title,
+		Body:        body,
+		Critical:    critical,
+		DeliveredAt: time.Now().UTC(),
+		MessageID:   fmt.Sprintf("projects/mock/messages/%d", s.sent),
+	}
+	s.deliveries = append(s.deliveries, d)
+	if len(s.deliveries) > maxDeliveries {
+		s.deliveries = slices.Delete(s.deliveries, 0, len(s.deliveries)-maxDeliveries)
+	}
+	return d.MessageID
+}
+
+// log returns the deliveries, oldest first
+func (s *store) log() []delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.deliveries)
+}
+
+// clearDeliveries empties the delivery log
+func (s *store) clearDeliveries() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = nil
+}
+
+// clearRegistrations forgets every registration
+func (s *store) clearRegistrations() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registrations = make(map[string]*registration)
+	s.order = nil
+}
+
+// hashSecret is how notify secrets are kept, as on the real server
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the current API version path
+const apiPrefix = "/v1"
+
+// openAPISpec documents the /v1 API; api_test.go checks it against apiRoutes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// apiRoute is one versioned endpoint, relative to apiPrefix. Legacy routes
+// predate versioning and are also served at their unversioned path.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+	Legacy  bool
+}
+
+// apiRoutes is the single list of API endpoints. It drives both the mux and
+// the contract test against openapi.json, so the two cannot drift apart.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{Method: http.MethodPost, Path: "/register", Handler: handleRegister, Legacy: true},
+		{Method: http.MethodGet, Path: "/register/challenge", Handler: handleRegisterChallenge},
+		{Method: http.MethodPost, Path: "/send", Handler: limitSends(handleSend), Legacy: true},
+		{Method: http.MethodPost, Path: "/notify", Handler: limitSends(handleNotify), Legacy: true},
+		{Method: http.MethodPost, Path: "/send-condition", Handler: limitSends(handleSendCondition)},
+		{Method: http.MethodPost, Path: "/notify-raw", Handler: requireAPIKey(limitSends(handleNotifyRaw))},
+		{Method: http.MethodPost, Path: "/notify-user", Handler: requireAPIKey(limitSends(handleNotifyUser))},
+		{Method: http.MethodGet, Path: "/status", Handler: handleStatus, Legacy: true},
+		{Method: http.MethodGet, Path: "/tokens", Handler: requireAPIKey(handleListTokens)},
+		{Method: http.MethodGet, Path: "/groups", Handler: requireAPIKey(handleListGroups)},
+		{Method: http.MethodGet, Path: "/groups/{name}", Handler: requireAPIKey(handleGetGroup)},
+		{Method: http.MethodPut, Path: "/groups/{name}", Handler: requireAPIKey(handlePutGroup)},
+		{Method: http.MethodDelete, Path: "/groups/{name}", Handler: requireAPIKey(handleDeleteGroup)},
+		{Method: http.MethodPost, Path: "/groups/{name}/members", Handler: requireAPIKey(handleAddGroupMembers)},
+		{Method: http.MethodDelete, Path: "/groups/{name}/members/{id}", Handler: requireAPIKey(handleRemoveGroupMember)},
+		{Method: http.MethodPost, Path: "/groups/{name}/send", Handler: requireAPIKey(limitSends(handleSendGroup))},
+		{Method: http.MethodGet, Path: "/experiments/{name}", Handler: requireAPIKey(handleGetExperiment)},
+		{Method: http.MethodGet, Path: "/templates", Handler: requireAPIKey(handleListTemplates)},
+		{Method: http.MethodGet, Path: "/templates/{name}", Handler: requireAPIKey(handleGetTemplate)},
+		{Method: http.MethodPut, Path: "/templates/{name}", Handler: requireAPIKey(handlePutTemplate)},
+		{Method: http.MethodDelete, Path: "/templates/{name}", Handler: requireAPIKey(handleDeleteTemplate)},
+		{Method: http.MethodGet, Path: "/version", Handler: handleVersion, Legacy: true},
+		{Method: http.MethodGet, Path: "/jobs/{id}", Handler: handleJobStatus},
+		{Method: http.MethodGet, Path: "/jobs/{id}/events", Handler: handleJobEvents},
+		{Method: http.MethodGet, Path: "/ws", Handler: handleWebSocket},
+		{Method: http.MethodGet, Path: "/poll/{id}", Handler: handlePoll},
+	}
+}
+
+// registerAPIRoutes mounts every API endpoint under /v1 and keeps the
+// original unversioned path of legacy routes as a deprecated alias. Routes
+// sharing a path are dispatched on the method.
+func registerAPIRoutes(mux *http.ServeMux) {
+	var paths []string
+	byPath := make(map[string][]apiRoute)
+	for _, route := range apiRoutes() {
+		if byPath[route.Path] == nil {
+			paths = append(paths, route.Path)
+		}
+		byPath[route.Path] = append(byPath[route.Path], route)
+	}
+	for _, path := range paths {
+		routes := byPath[path]
+		handler := loggingMiddleware(dispatchMethod(routes))
+		mux.HandleFunc(apiPrefix+path, handler)
+		if routes[0].Legacy {
+			mux.HandleFunc(path, deprecatedAlias(apiPrefix+path, handler))
+		}
+	}
+	mux.HandleFunc(apiPrefix+"/openapi.json", handleOpenAPI)
+}
+
+// dispatchMethod picks the route for the request method. A path with a
+// single route keeps its handler, which checks the method itself.
+func dispatchMethod(routes []apiRoute) http.HandlerFunc {
+	if len(routes) == 1 {
+		return routes[0].Handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, route := range routes {
+			if r.Method == route.Method {
+				route.Handler(w, r)
+				return
+			}
+			allowed = append(allowed, route.Method)
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// deprecatedAlias serves an old path while pointing clients at its successor
+func deprecatedAlias(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		next(w, r)
+	}
+}
+
+// apiEndpoints lists the versioned endpoints for the startup log
+func apiEndpoints() []string {
+	var endpoints []string
+	for _, route := range apiRoutes() {
+		endpoints = append(endpoints, route.Method+" "+apiPrefix+route.Path)
+	}
+	return append(endpoints, "GET "+apiPrefix+"/openapi.json")
+}
+
+// handleOpenAPI serves the OpenAPI document
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
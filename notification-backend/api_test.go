@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// openAPIDoc is the subset of the spec the contract tests look at
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+			Enum       []string                   `json:"enum"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	var routes, documented []string
+	for _, route := range apiRoutes() {
+		routes = append(routes, strings.ToLower(route.Method)+" "+route.Path)
+	}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented = append(documented, method+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+
+	if !reflect.DeepEqual(routes, documented) {
+		t.Errorf("openapi.json is out of sync with apiRoutes:\n  routes:     %v\n  documented: %v", routes, documented)
+	}
+}
+
+func TestOpenAPISchemasMatchTypes(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	types := map[string]any{
+		"TokenRegistration":            TokenRegistration{},
+		"ChannelRegistration":          ChannelRegistration{},
+		"ChallengeResponse":            ChallengeResponse{},
+		"RegisterResponse":             RegisterResponse{},
+		"NotifyResponse":               NotifyResponse{},
+		"SendResponse":                 SendResponse{},
+		"JobStatus":                    JobStatus{},
+		"JobAccepted":                  JobAccepted{},
+		"RawNotificationRequest":       RawNotificationRequest{},
+		"ConditionNotificationRequest": ConditionNotificationRequest{},
+		"ConditionSendResponse":        ConditionSendResponse{},
+		"NotificationRequest":          NotificationRequest{},
+		"LocalTimeBatch":               LocalTimeBatch{},
+		"LocalTimeResponse":            LocalTimeResponse{},
+		"NotificationVariant":          NotificationVariant{},
+		"VariantStats":                 VariantStats{},
+		"Experiment":                   Experiment{},
+		"ExperimentResponse":           ExperimentResponse{},
+		"NotificationTemplate":         NotificationTemplate{},
+		"TemplateText":                 TemplateText{},
+		"TemplateRequest":              TemplateRequest{},
+		"TemplateResponse":             TemplateResponse{},
+		"TemplateListResponse":         TemplateListResponse{},
+		"SingleNotificationRequest":    SingleNotificationRequest{},
+		"UserNotificationRequest":      UserNotificationRequest{},
+		"VersionInfo":                  VersionInfo{},
+		"DeviceMetadata":               DeviceMetadata{},
+		"TokenSummary":                 TokenSummary{},
+		"TokenListResponse":            TokenListResponse{},
+		"DeviceGroup":                  DeviceGroup{},
+		"GroupMembersRequest":          GroupMembersRequest{},
+		"GroupResponse":                GroupResponse{},
+		"GroupListResponse":            GroupListResponse{},
+		"WebSocketHello":               WebSocketHello{},
+		"WebSocketMessage":             WebSocketMessage{},
+		"PollResponse":                 PollResponse{},
+		"PendingMessage":               PendingMessage{},
+		"ErrorResponse":                ErrorResponse{},
+	}
+	for name, v := range types {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("Schema %s missing from openapi.json", name)
+			continue
+		}
+		rt := reflect.TypeOf(v)
+		for i := 0; i < rt.NumField(); i++ {
+			field, _, _ := strings.Cut(rt.Field(i).Tag.Get("json"), ",")
+			if _, ok := schema.Properties[field]; !ok {
+				t.Errorf("Schema %s is missing property %q", name, field)
+			}
+		}
+		if len(schema.Properties) != rt.NumField() {
+			t.Errorf("Schema %s has %d properties, type has %d fields", name, len(schema.Properties), rt.NumField())
+		}
+	}
+}
+
+func TestOpenAPIErrorCodesMatchConstants(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	var defined []string
+	for code := range errorStatus {
+		defined = append(defined, string(code))
+	}
+	documented := append([]string(nil), doc.Components.Schemas["ErrorCode"].Enum...)
+	sort.Strings(defined)
+	sort.Strings(documented)
+
+	if !reflect.DeepEqual(defined, documented) {
+		t.Errorf("ErrorCode enum in openapi.json is out of sync:\n  defined:    %v\n  documented: %v", defined, documented)
+	}
+}
+
+func TestErrorResponsesCarryCodes(t *testing.T) {
+	originalStore, originalExoscale := tokenStore, useExoscale
+	defer func() { tokenStore, useExoscale = originalStore, originalExoscale }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	tests := []struct {
+		method string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"GET", "", http.StatusMethodNotAllowed, ErrMethodNotAllowed},
+		{"POST", "{", http.StatusBadRequest, ErrInvalidJSON},
+		{"POST", `{"title":"t","body":"b"}`, http.StatusBadRequest, ErrMissingField},
+		{"POST", `{"token_id":"unknown","title":"t","body":"b"}`, http.StatusBadRequest, ErrTokenNotFound},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest(tt.method, "/v1/notify", strings.NewReader(tt.body)))
+
+		var resp ErrorResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Errorf("%s %q: error response is not JSON: %v", tt.method, tt.body, err)
+			continue
+		}
+		if rr.Code != tt.status || resp.Code != tt.code || resp.Success {
+			t.Errorf("%s %q: expected %d %s, got %d %+v", tt.method, tt.body, tt.status, tt.code, rr.Code, resp)
+		}
+	}
+}
+
+func TestVersionedRoutesAndDeprecatedAliases(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/version", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Deprecation") != "" {
+		t.Errorf("Expected /v1/version to be served without deprecation, got %d %v", rr.Code, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected deprecated alias to keep working, got %d", rr.Code)
+	}
+	if rr.Header().Get("Deprecation") != "true" || !strings.Contains(rr.Header().Get("Link"), "</v1/version>") {
+		t.Errorf("Expected deprecation headers on alias, got %v", rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" || !json.Valid(rr.Body.Bytes()) {
+		t.Errorf("Expected OpenAPI document at /v1/openapi.json, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Send pipeline limits
+	maxInFlightSends = flag.Int("max-inflight-sends", 64, "Maximum /send and /notify requests processed concurrently (0 disables limiting)")
+	maxQueuedSends   = flag.Int("max-queued-sends", 256, "Maximum requests waiting for a send slot before returning 429")
+	sendQueueTimeout = flag.Duration("send-queue-timeout", 5*time.Second, "Maximum time a request waits for a send slot before returning 429")
+	sendConcurrency  = flag.Int("send-concurrency", 16, "Tokens a broadcast decrypts and sends to at once")
+)
+
+// Pipeline counters, published on the debug listener under /debug/vars
+var (
+	sendsInFlight = expvar.NewInt("sends_in_flight")
+	sendsQueued   = expvar.NewInt("sends_queued")
+	sendsRejected = expvar.NewInt("sends_rejected")
+)
+
+// sendLimiter bounds the number of send requests being processed and the
+// number waiting for a slot, so overload is pushed back to callers instead
+// of accumulating goroutines and memory
+type sendLimiter struct {
+	slots        chan struct{}
+	queued       atomic.Int64
+	maxQueued    int64
+	queueTimeout time.Duration
+}
+
+// sendPipeline is initialized in main from the limit flags; nil means unlimited
+var sendPipeline *sendLimiter
+
+// newSendLimiter returns a limiter, or nil when maxInFlight is not positive
+func newSendLimiter(maxInFlight, maxQueued int, queueTimeout time.Duration) *sendLimiter {
+	if maxInFlight <= 0 {
+		return nil
+	}
+	return &sendLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		maxQueued:    int64(maxQueued),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire takes a send slot, waiting in the queue if needed. It returns false
+// if the queue is full, the wait times out, or the caller gives up.
+func (l *sendLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		sendsInFlight.Add(1)
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueued {
+		l.queued.Add(-1)
+		return false
+	}
+	sendsQueued.Add(1)
+	defer func() {
+		l.queued.Add(-1)
+		sendsQueued.Add(-1)
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		sendsInFlight.Add(1)
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire
+func (l *sendLimiter) release() {
+	<-l.slots
+	sendsInFlight.Add(-1)
+}
+
+// retryAfterSeconds is the Retry-After hint given to rejected callers: the
+// time a queued request would have waited, rounded up to whole seconds
+func (l *sendLimiter) retryAfterSeconds() int {
+	return int(math.Max(1, math.Ceil(l.queueTimeout.Seconds())))
+}
+
+// limitSends wraps a send handler with the pipeline limiter, answering 429
+// with Retry-After when it is saturated
+func limitSends(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := sendPipeline
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		if !limiter.acquire(r.Context()) {
+			sendsRejected.Add(1)
+			loggerFromContext(r.Context()).Warn("Send pipeline saturated, rejecting request",
+				"in_flight", len(limiter.slots), "queued", limiter.queued.Load())
+
+			w.Header().Set("Retry-After", fmt.Sprint(limiter.retryAfterSeconds()))
+			writeError(w, ErrServerBusy, "Server is busy, retry later")
+			return
+		}
+		defer limiter.release()
+
+		next(w, r)
+	}
+}
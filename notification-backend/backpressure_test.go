@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+func TestLimitSendsRejectsWhenSaturated(t *testing.T) {
+	sendPipeline = newSendLimiter(1, 1, 2*time.Second)
+	defer func() { sendPipeline = nil }()
+
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	handler := limitSends(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	})
+
+	serve := func() chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest("POST", "/notify", nil))
+			done <- rr
+		}()
+		return done
+	}
+
+	// First request takes the only slot, second waits in the queue
+	first := serve()
+	<-started
+	second := serve()
+	for sendPipeline.queued.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Third finds the queue full and is turned away immediately
+	rr := <-serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429 when saturated, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", got)
+	}
+
+	// Once the slot frees up the queued request is served
+	close(unblock)
+	if rr := <-first; rr.Code != http.StatusOK {
+		t.Errorf("Expected first request to succeed, got %d", rr.Code)
+	}
+	if rr := <-second; rr.Code != http.StatusOK {
+		t.Errorf("Expected queued request to succeed, got %d", rr.Code)
+	}
+}
+
+func TestLimitSendsQueueTimeout(t *testing.T) {
+	sendPipeline = newSendLimiter(1, 10, 50*time.Millisecond)
+	defer func() { sendPipeline = nil }()
+
+	// Hold the only slot for the duration of the test
+	if !sendPipeline.acquire(t.Context()) {
+		t.Fatal("Expected to acquire the free slot")
+	}
+	defer sendPipeline.release()
+
+	rr := httptest.NewRecorder()
+	limitSends(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not run while the pipeline is full")
+	})(rr, httptest.NewRequest("POST", "/send", nil))
+
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1 after queue timeout, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestBroadcastConcurrency(t *testing.T) {
+	originalPrivateKey, originalConcurrency := privateKey, *sendConcurrency
+	defer func() {
+		privateKey, *sendConcurrency = originalPrivateKey, originalConcurrency
+		delete(platformTransports, "test")
+	}()
+	privateKey = apitest.PrivateKey()
+	*sendConcurrency = 4
+
+	var mu sync.Mutex
+	var inFlight, peak int
+	platformTransports["test"] = &transport{
+		name:       "test",
+		configured: func() bool { return true },
+		ready:      func() error { return nil },
+		validate:   func(string) error { return nil },
+		send: func(_ context.Context, d delivery) error {
+			mu.Lock()
+			inFlight++
+			peak = max(peak, inFlight)
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			time.Sleep(10 * time.Millisecond)
+			if strings.HasSuffix(d.Address, "7") {
+				return errors.New("refused")
+			}
+			return nil
+		},
+	}
+	var tokens []*TokenStorageInfo
+	for i := range 20 {
+		tokens = append(tokens, &TokenStorageInfo{OpaqueID: apitest.OpaqueID(i), EncryptedData: apitest.EncryptToken(fmt.Sprintf("device-%d", i)), Platform: "test"})
+	}
+
+	// onDelivery is called once per token, never two at a time
+	delivered := make(map[string]int)
+	var calls atomic.Int64
+	sent, failed := broadcastTokens(context.Background(), tokens, delivery{Title: "Hello", Body: "Everyone"}, func(opaqueID string, err error) {
+		if calls.Add(1) != 1 {
+			t.Error("Expected onDelivery calls serialized")
+		}
+		delivered[opaqueID]++
+		calls.Add(-1)
+	})
+	if sent != 18 || failed != 2 {
+		t.Errorf("Expected 18 sent and 2 failed, got %d and %d", sent, failed)
+	}
+	if len(delivered) != 20 {
+		t.Errorf("Expected onDelivery for each of the 20 tokens, got %d", len(delivered))
+	}
+	for id, n := range delivered {
+		if n != 1 {
+			t.Errorf("Expected one onDelivery for %s, got %d", id, n)
+		}
+	}
+	if peak < 2 || peak > 4 {
+		t.Errorf("Expected at most 4 sends at once, and more than 1, got %d", peak)
+	}
+}
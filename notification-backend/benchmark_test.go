@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+// The benchmarks cover what a broadcast does per recipient: decrypt the
+// token and read it from storage. Compare runs with benchstat; see README.md.
+
+// benchFCMToken is as long as a real FCM registration token
+var benchFCMToken = "fcm-token:" + strings.Repeat("A", 152)
+
+// quietLogs drops the per-token log lines for the rest of the benchmark
+func quietLogs(b *testing.B) {
+	original := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	b.Cleanup(func() { slog.SetDefault(original) })
+}
+
+func BenchmarkDecryptHybridToken(b *testing.B) {
+	original := privateKey
+	privateKey = apitest.PrivateKey()
+	defer func() { privateKey = original }()
+	encrypted := apitest.EncryptToken(benchFCMToken)
+
+	for b.Loop() {
+		if _, err := decryptHybridToken(encrypted); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchTokenStore returns a file store holding n registrations
+func benchTokenStore(b *testing.B, n int) *DurableTokenStore {
+	b.Helper()
+	ts := NewDurableTokenStore(filepath.Join(b.TempDir(), "tokens.json"))
+	encrypted := apitest.EncryptToken(benchFCMToken)
+	for i := range n {
+		ts.mappings[apitest.OpaqueID(i)] = &TokenMapping{
+			OpaqueID:      apitest.OpaqueID(i),
+			EncryptedData: encrypted,
+			Platform:      "android",
+			RegisteredAt:  time.Now(),
+		}
+	}
+	return ts
+}
+
+func BenchmarkDurableTokenStoreAddToken(b *testing.B) {
+	quietLogs(b)
+	encrypted := apitest.EncryptToken(benchFCMToken)
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("tokens=%d", n), func(b *testing.B) {
+			ts := benchTokenStore(b, n)
+			for b.Loop() {
+				if _, err := ts.AddToken(encrypted, "android"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDurableTokenStoreSaveToFile(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("tokens=%d", n), func(b *testing.B) {
+			ts := benchTokenStore(b, n)
+			for b.Loop() {
+				if err := ts.saveToFile(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchExoscaleStorage returns an ExoscaleStorage on a fakeSOS holding n
+// registrations. The fake runs over loopback HTTP, so the numbers are the
+// client's marshalling, signing and round trips, not SOS latency.
+func benchExoscaleStorage(b *testing.B, n int) *ExoscaleStorage {
+	b.Helper()
+	quietLogs(b)
+	s, _ := newFakeSOSStorage(b, nil)
+	reg := TokenRegistration{EncryptedData: apitest.EncryptToken(benchFCMToken), Platform: "android"}
+	for i := range n {
+		if err := s.StoreToken(context.Background(), apitest.OpaqueID(i), reg, ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+func BenchmarkExoscaleStoreToken(b *testing.B) {
+	s := benchExoscaleStorage(b, 0)
+	reg := TokenRegistration{EncryptedData: apitest.EncryptToken(benchFCMToken), Platform: "android"}
+	i := 0
+	for b.Loop() {
+		if err := s.StoreToken(context.Background(), apitest.OpaqueID(i), reg, ""); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
+
+func BenchmarkExoscaleGetToken(b *testing.B) {
+	s := benchExoscaleStorage(b, 1)
+	for b.Loop() {
+		if _, err := s.GetToken(context.Background(), apitest.OpaqueID(0)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExoscaleListAllTokens(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("tokens=%d", n), func(b *testing.B) {
+			s := benchExoscaleStorage(b, n)
+			for b.Loop() {
+				tokens, err := s.ListAllTokens(context.Background())
+				if err != nil || len(tokens) != n {
+					b.Fatalf("Expected %d tokens, got %d: %v", n, len(tokens), err)
+				}
+			}
+		})
+	}
+}
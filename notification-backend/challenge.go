@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	requireChallenge = flag.Bool("require-challenge", false, "Reject registrations without a challenge from GET /v1/register/challenge")
+	challengeTTL     = flag.Duration("challenge-ttl", 5*time.Minute, "How long a registration challenge stays valid")
+)
+
+// A challenge is base64url(expiry || random || HMAC(expiry || random)). The
+// HMAC key is derived from the RSA private key, so every replica sharing the
+// key accepts the others' challenges without shared state.
+const (
+	challengeRandomSize = 16
+	challengeSignedSize = 8 + challengeRandomSize
+	challengeSize       = challengeSignedSize + sha256.Size
+)
+
+// usedChallenges remembers consumed challenges until they expire, so each
+// one registers at most once on this replica
+var usedChallenges = &challengeSet{used: make(map[string]time.Time)}
+
+type challengeSet struct {
+	mu   sync.Mutex
+	used map[string]time.Time // challenge -> expiry
+}
+
+// consume marks challenge used and reports whether it was still unused.
+// Expired entries are pruned on the way, as they can no longer verify anyway.
+func (s *challengeSet) consume(challenge string, expires time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for c, exp := range s.used {
+		if now.After(exp) {
+			delete(s.used, c)
+		}
+	}
+	if _, seen := s.used[challenge]; seen {
+		return false
+	}
+	s.used[challenge] = expires
+	return true
+}
+
+// challengeKey derives the challenge signing key from the RSA private key
+func challengeKey() ([]byte, error) {
+	if privateKey == nil {
+		return nil, fmt.Errorf("private key not loaded")
+	}
+	return hkdf.Key(sha256.New, privateKey.D.Bytes(), nil, "remote-notification register challenge", sha256.Size)
+}
+
+// newChallenge issues a signed challenge valid for ttl
+func newChallenge(ttl time.Duration) (string, error) {
+	key, err := challengeKey()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, challengeSignedSize, challengeSize)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(ttl).Unix()))
+	if _, err := rand.Read(b[8:]); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b)), nil
+}
+
+// verifyChallenge checks a challenge's signature and expiry and returns when it expires
+func verifyChallenge(challenge string) (time.Time, error) {
+	key, err := challengeKey()
+	if err != nil {
+		return time.Time{}, err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(b) != challengeSize {
+		return time.Time{}, withCode(ErrInvalidChallenge, fmt.Errorf("malformed challenge"))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:challengeSignedSize])
+	if !hmac.Equal(mac.Sum(nil), b[challengeSignedSize:]) {
+		return time.Time{}, withCode(ErrInvalidChallenge, fmt.Errorf("challenge was not issued by this server"))
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if time.Now().After(expires) {
+		return time.Time{}, withCode(ErrInvalidChallenge, fmt.Errorf("challenge expired"))
+	}
+	return expires, nil
+}
+
+// handleRegisterChallenge issues a nonce for the next registration. The
+// client passes it as the AES-GCM additional data when encrypting its token
+// and sends it along as "challenge".
+func handleRegisterChallenge(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	w = negotiateEncoding(w, r)
+
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	challenge, err := newChallenge(*challengeTTL)
+	if err != nil {
+		logger.Error("Failed to issue challenge", "error", err)
+		writeError(w, ErrInternal, "Failed to issue challenge")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	response := ChallengeResponse{Success: true, Challenge: challenge, ExpiresIn: int(challengeTTL.Seconds())}
+	if err := writeResponse(w, http.StatusOK, response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
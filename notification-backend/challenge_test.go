@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remote-notification/api"
+	"remote-notification/api/apitest"
+)
+
+func TestRegisterChallenge(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalRequire := privateKey, tokenStore, useExoscale, *requireChallenge
+	defer func() {
+		privateKey, tokenStore, useExoscale, *requireChallenge = originalPrivateKey, originalStore, originalExoscale, originalRequire
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	issue := func() string {
+		rr := httptest.NewRecorder()
+		handleRegisterChallenge(rr, httptest.NewRequest("GET", "/v1/register/challenge", nil))
+		var resp ChallengeResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || !resp.Success || resp.ExpiresIn != int(challengeTTL.Seconds()) {
+			t.Fatalf("Unexpected challenge response %d %q", rr.Code, rr.Body.String())
+		}
+		return resp.Challenge
+	}
+	register := func(reg TokenRegistration) (int, RegisterResponse, ErrorCode) {
+		body, _ := json.Marshal(reg)
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		var resp RegisterResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, resp, errResp.Code
+	}
+	fcmToken := apitest.FCMToken(1)
+	bound := func(challenge string) string {
+		encrypted, err := encryptHybridToken(fcmToken, &privKey.PublicKey, []byte(challenge))
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		return encrypted
+	}
+
+	challenge := issue()
+	// The app backend reads the expiry to bound its retries
+	if expires, err := api.ChallengeExpiry(challenge); err != nil || time.Until(expires) > *challengeTTL || time.Until(expires) < *challengeTTL-time.Minute {
+		t.Errorf("Expected the challenge to expire in %v, got %v, %v", *challengeTTL, expires, err)
+	}
+	reg := TokenRegistration{EncryptedData: bound(challenge), Platform: "android", Challenge: challenge}
+	status, resp, code := register(reg)
+	if status != http.StatusOK {
+		t.Fatalf("Expected bound registration to succeed, got %d %s", status, code)
+	}
+	// The stored token no longer needs the challenge to decrypt
+	token, err := getToken(t.Context(), resp.TokenID)
+	if err != nil {
+		t.Fatalf("Registered token not found: %v", err)
+	}
+	if decrypted, err := decryptHybridToken(token.EncryptedData); err != nil || decrypted != fcmToken {
+		t.Errorf("Expected the stored token to decrypt without the challenge, got %q, %v", decrypted, err)
+	}
+
+	// The same payload cannot be registered twice
+	if status, _, code := register(reg); status != http.StatusBadRequest || code != ErrInvalidChallenge {
+		t.Errorf("Expected replay to fail with INVALID_CHALLENGE, got %d %s", status, code)
+	}
+
+	// Nor moved to another challenge, as the AAD no longer matches
+	other := issue()
+	if _, _, code := register(TokenRegistration{EncryptedData: reg.EncryptedData, Platform: "android", Challenge: other}); code != ErrDecryptFailed {
+		t.Errorf("Expected DECRYPT_FAILED for a payload bound to another challenge, got %s", code)
+	}
+
+	expired, _ := newChallenge(-time.Second)
+	// Change one character of the signature
+	flipped := "A"
+	if other[60] == 'A' {
+		flipped = "B"
+	}
+	forged := other[:60] + flipped + other[61:]
+	for name, c := range map[string]string{"expired": expired, "forged": forged, "garbage": "abc"} {
+		if _, _, code := register(TokenRegistration{EncryptedData: bound(c), Platform: "android", Challenge: c}); code != ErrInvalidChallenge {
+			t.Errorf("%s: expected INVALID_CHALLENGE, got %s", name, code)
+		}
+	}
+
+	// Unbound registrations keep working unless challenges are required
+	plain, _ := encryptHybridToken(fcmToken, &privKey.PublicKey, nil)
+	if status, _, code := register(TokenRegistration{EncryptedData: plain, Platform: "android"}); status != http.StatusOK {
+		t.Errorf("Expected unbound registration to succeed, got %d %s", status, code)
+	}
+	*requireChallenge = true
+	if _, _, code := register(TokenRegistration{EncryptedData: plain, Platform: "android"}); code != ErrMissingField {
+		t.Errorf("Expected MISSING_FIELD with --require-challenge, got %s", code)
+	}
+}
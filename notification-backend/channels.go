@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"remote-notification/api"
+)
+
+// maxChannels bounds the failover channels of one registration, so a send
+// cannot turn into an unbounded chain of RSA operations
+const maxChannels = 4
+
+// ChannelRegistration is one further way to reach a device, tried after
+// the registration's own platform and any earlier channels have failed
+type ChannelRegistration = api.ChannelRegistration
+
+// validateChannel checks a failover channel the way handleRegister checks the
+// primary registration: its transport is configured and its address decrypts
+// to something the transport accepts
+func validateChannel(ch ChannelRegistration) error {
+	if err := validatePlatform(ch.Platform); err != nil {
+		return err
+	}
+	if ch.EncryptedData == "" {
+		return withCode(ErrMissingField, fmt.Errorf("encrypted_data is required"))
+	}
+	if len(ch.EncryptedData) < 100 || len(ch.EncryptedData) > 10000 {
+		return withCode(ErrInvalidEncryptedData, fmt.Errorf("encrypted_data has an impossible length"))
+	}
+	t := transportFor(ch.Platform)
+	if !t.configured() {
+		return withCode(ErrUnsupportedPlatform, fmt.Errorf("platform %q is not enabled on this server", ch.Platform))
+	}
+	address, err := decryptHybridToken(ch.EncryptedData)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt: %v", err))
+	}
+	defer secureWipeString(&address)
+	if err := t.validate(address); err != nil {
+		return withCode(errorCodeOf(err, ErrInvalidFCMToken), err)
+	}
+	return nil
+}
+
+// tokenChannels lists a stored registration's channels in preference order,
+// starting with its own platform
+func tokenChannels(token *TokenStorageInfo) []ChannelRegistration {
+	return append([]ChannelRegistration{{Platform: token.Platform, EncryptedData: token.EncryptedData}}, token.Channels...)
+}
+
+// sendChannel decrypts one channel's address and delivers d over its transport
+func sendChannel(ctx context.Context, ch ChannelRegistration, d delivery) error {
+	t := transportFor(ch.Platform)
+	if err := t.ready(); err != nil {
+		return err
+	}
+
+	decrypt := decryptHybridToken
+	if t == fcmTransport {
+		decrypt = decryptFCMToken
+	}
+	address, err := decrypt(ch.EncryptedData)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt token: %v", err))
+	}
+	// Wipe the decrypted address once the transport is done with it
+	defer secureWipeString(&address)
+
+	d.Address = address
+	return t.send(ctx, d)
+}
+
+// failoverError picks what to report when every channel failed. The device
+// is only gone when all channels say so; otherwise the first other error is
+// returned, so callers retry rather than drop an opaque ID that can still be reached.
+func failoverError(errs []error) error {
+	for _, err := range errs {
+		if errorCodeOf(err, "") != ErrTokenUnregistered {
+			return err
+		}
+	}
+	return errs[0]
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestChannelFailover(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalAddr, originalFrom, originalSend := privateKey, *smtpAddr, *smtpFrom, sendMail
+	defer func() {
+		privateKey, *smtpAddr, *smtpFrom, sendMail = originalPrivateKey, originalAddr, originalFrom, originalSend
+		delete(platformTransports, "first")
+		delete(platformTransports, "second")
+	}()
+	privateKey = privKey
+	*smtpAddr, *smtpFrom = "smtp.example.com:587", "alerts@example.com"
+
+	var order []string
+	var firstErr, secondErr error
+	fake := func(name string, err *error) *transport {
+		return &transport{
+			name:       name,
+			configured: func() bool { return true },
+			ready:      func() error { return nil },
+			validate:   func(string) error { return nil },
+			send: func(_ context.Context, d delivery) error {
+				order = append(order, name+":"+d.Address)
+				return *err
+			},
+		}
+	}
+	platformTransports["first"] = fake("first", &firstErr)
+	platformTransports["second"] = fake("second", &secondErr)
+
+	var mailedTo string
+	sendMail = func(_ context.Context, to string, _ []byte) error {
+		mailedTo = to
+		return nil
+	}
+
+	encrypt := func(s string) string {
+		encrypted := apitest.EncryptToken(s)
+		return encrypted
+	}
+	token := &TokenStorageInfo{
+		OpaqueID:      "id",
+		EncryptedData: encrypt("primary"),
+		Platform:      "first",
+		Channels: []ChannelRegistration{
+			{Platform: "second", EncryptedData: encrypt("backup")},
+			{Platform: "email", EncryptedData: encrypt("user@example.com")},
+		},
+	}
+
+	// The preferred channel delivers, so nothing else is tried
+	if err := sendNotification(t.Context(), token, delivery{Title: "t", Body: "b"}); err != nil || len(order) != 1 || order[0] != "first:primary" {
+		t.Fatalf("Expected delivery on the first channel only, got %v after %v", err, order)
+	}
+
+	// A failing channel hands over to the next one
+	order = nil
+	firstErr = withCode(ErrTokenUnregistered, errors.New("gone"))
+	if err := sendNotification(t.Context(), token, delivery{Title: "t", Body: "b"}); err != nil || len(order) != 2 || order[1] != "second:backup" {
+		t.Fatalf("Expected failover to the second channel, got %v after %v", err, order)
+	}
+
+	// The email channel comes last
+	order = nil
+	secondErr = withCode(ErrTransportUnavailable, errors.New("down"))
+	if err := sendNotification(t.Context(), token, delivery{Title: "t", Body: "b"}); err != nil || mailedTo != "user@example.com" {
+		t.Fatalf("Expected failover to email, got %v (mailed %q)", err, mailedTo)
+	}
+
+	// When all fail, a temporary error wins over TOKEN_UNREGISTERED so the ID is kept
+	sendMail = func(context.Context, string, []byte) error { return errors.New("421 try later") }
+	if err := sendNotification(t.Context(), token, delivery{Title: "t", Body: "b"}); errorCodeOf(err, "") != ErrTransportUnavailable {
+		t.Errorf("Expected TRANSPORT_UNAVAILABLE, got %v", err)
+	}
+
+	// Only a device gone on every channel is reported as unregistered
+	token.Channels = token.Channels[:1]
+	secondErr = withCode(ErrTokenUnregistered, errors.New("gone too"))
+	if err := sendNotification(t.Context(), token, delivery{Title: "t", Body: "b"}); errorCodeOf(err, "") != ErrTokenUnregistered {
+		t.Errorf("Expected TOKEN_UNREGISTERED, got %v", err)
+	}
+}
+
+func TestRegisterChannels(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalAddr := privateKey, *smtpAddr
+	originalStore, originalExoscale := tokenStore, useExoscale
+	defer func() {
+		privateKey, *smtpAddr = originalPrivateKey, originalAddr
+		tokenStore, useExoscale = originalStore, originalExoscale
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	encrypt := func(s string) string {
+		encrypted := apitest.EncryptToken(s)
+		return encrypted
+	}
+	register := func(reg TokenRegistration) (*httptest.ResponseRecorder, RegisterResponse, ErrorResponse) {
+		body, _ := json.Marshal(reg)
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		var resp RegisterResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr, resp, errResp
+	}
+
+	primary := encrypt(apitest.FCMToken(1))
+	email := ChannelRegistration{Platform: "email", EncryptedData: encrypt("user@example.com")}
+
+	*smtpAddr = ""
+	if rr, _, errResp := register(TokenRegistration{EncryptedData: primary, Platform: "android", Channels: []ChannelRegistration{email}}); errResp.Code != ErrUnsupportedPlatform {
+		t.Errorf("Expected UNSUPPORTED_PLATFORM for email without SMTP, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	*smtpAddr = "smtp.example.com:587"
+	bad := ChannelRegistration{Platform: "email", EncryptedData: encrypt("Someone <user@example.com>")}
+	if rr, _, errResp := register(TokenRegistration{EncryptedData: primary, Platform: "android", Channels: []ChannelRegistration{email, bad}}); errResp.Code != ErrInvalidSubscription {
+		t.Errorf("Expected INVALID_SUBSCRIPTION for a bad second channel, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	tooMany := make([]ChannelRegistration, maxChannels+1)
+	for i := range tooMany {
+		tooMany[i] = email
+	}
+	if rr, _, errResp := register(TokenRegistration{EncryptedData: primary, Platform: "android", Channels: tooMany}); errResp.Code != ErrInvalidRequest {
+		t.Errorf("Expected INVALID_REQUEST for too many channels, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr, resp, _ := register(TokenRegistration{EncryptedData: primary, Platform: "android", Channels: []ChannelRegistration{email}})
+	if !resp.Success {
+		t.Fatalf("Expected registration with a channel to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	token, err := getToken(t.Context(), resp.TokenID)
+	if err != nil {
+		t.Fatalf("Registered token not found: %v", err)
+	}
+	if len(token.Channels) != 1 || token.Channels[0] != email {
+		t.Errorf("Expected the channel to be stored, got %+v", token.Channels)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// Chat webhook configuration; platforms "slack" and "discord" are disabled unless enabled here
+	chatWebhooksEnabled = flag.Bool("chat-webhooks", false, "Accept Slack and Discord incoming-webhook URLs as platforms \"slack\" and \"discord\"")
+	chatWebhookTimeout  = flag.Duration("chat-webhook-timeout", 10*time.Second, "Timeout for a single Slack or Discord webhook call")
+)
+
+// chatWebhookClient posts to Slack and Discord; tests replace it
+var chatWebhookClient = &http.Client{}
+
+// Discord's limits on embed title and description length
+const (
+	maxDiscordTitle       = 256
+	maxDiscordDescription = 4096
+)
+
+var slackTransport = &transport{
+	name:       "slack",
+	configured: func() bool { return *chatWebhooksEnabled },
+	ready:      chatWebhooksReady,
+	validate:   validateSlackWebhook,
+	send:       sendSlack,
+}
+
+var discordTransport = &transport{
+	name:       "discord",
+	configured: func() bool { return *chatWebhooksEnabled },
+	ready:      chatWebhooksReady,
+	validate:   validateDiscordWebhook,
+	send:       sendDiscord,
+}
+
+func chatWebhooksReady() error {
+	if !*chatWebhooksEnabled {
+		return withCode(ErrTransportUnavailable, fmt.Errorf("chat webhooks are not enabled (--chat-webhooks)"))
+	}
+	return nil
+}
+
+// validateWebhookURL checks a decrypted webhook URL points at one of hosts
+// under pathPrefix, so a registration cannot make the backend post elsewhere
+func validateWebhookURL(service, webhook, pathPrefix string, hosts ...string) error {
+	u, err := url.Parse(webhook)
+	if err == nil && u.Scheme == "https" && u.User == nil && u.Port() == "" && strings.HasPrefix(u.Path, pathPrefix) && len(u.Path) > len(pathPrefix) {
+		for _, host := range hosts {
+			if u.Host == host {
+				return nil
+			}
+		}
+	}
+	return withCode(ErrInvalidSubscription, fmt.Errorf("%s webhook must be an https://%s%s... URL", service, hosts[0], pathPrefix))
+}
+
+// validateSlackWebhook checks a decrypted Slack incoming-webhook URL
+func validateSlackWebhook(webhook string) error {
+	return validateWebhookURL("Slack", webhook, "/services/", "hooks.slack.com")
+}
+
+// validateDiscordWebhook checks a decrypted Discord webhook URL
+func validateDiscordWebhook(webhook string) error {
+	return validateWebhookURL("Discord", webhook, "/api/webhooks/", "discord.com", "discordapp.com")
+}
+
+// slackEscape escapes the characters Slack treats as markup, which also keeps
+// a notification from mentioning @channel
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// slackPayload renders the title in bold above the body
+func slackPayload(d delivery) any {
+	text := slackEscape(d.Body)
+	if d.Title != "" {
+		text = "*" + slackEscape(d.Title) + "*\n" + text
+	}
+	return map[string]string{"text": text}
+}
+
+// discordPayload renders the notification as an embed, with mentions disabled
+func discordPayload(d delivery) any {
+	return map[string]any{
+		"embeds": []map[string]string{{
+			"title":       truncateRunes(d.Title, maxDiscordTitle),
+			"description": truncateRunes(d.Body, maxDiscordDescription),
+		}},
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+}
+
+// sendSlack posts the notification to a Slack incoming webhook. Slack
+// answers 403, 404 or 410 once the webhook or its channel is gone.
+func sendSlack(ctx context.Context, d delivery) error {
+	return postChatWebhook(ctx, "Slack", d.Address, slackPayload(d), func(status int) bool {
+		return status == http.StatusForbidden || status == http.StatusNotFound || status == http.StatusGone
+	})
+}
+
+// sendDiscord posts the notification to a Discord webhook. Discord answers
+// 404 for a deleted webhook and 401 for a regenerated token.
+func sendDiscord(ctx context.Context, d delivery) error {
+	return postChatWebhook(ctx, "Discord", d.Address, discordPayload(d), func(status int) bool {
+		return status == http.StatusUnauthorized || status == http.StatusNotFound
+	})
+}
+
+// postChatWebhook sends payload as JSON to webhook; gone reports the statuses
+// meaning the webhook no longer exists
+func postChatWebhook(ctx context.Context, service, webhook string, payload any, gone func(status int) bool) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return withCode(ErrInvalidMessage, fmt.Errorf("failed to encode %s message: %v", service, err))
+	}
+
+	ctx, span := startSpan(ctx, strings.ToLower(service)+".send")
+	sendCtx, cancel := context.WithTimeout(ctx, *chatWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to build %s request", service))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := chatWebhookClient.Do(req)
+	if err != nil {
+		// The webhook URL is the credential, so report only the underlying cause
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to send to %s: %v", service, err))
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	err = nil
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case gone(resp.StatusCode):
+		err = withCode(ErrTokenUnregistered, fmt.Errorf("%s webhook is gone: %s", service, detail))
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("%s rejected the message: %s", service, detail))
+	default:
+		// 429 is rate limiting, 5xx are the service's problem
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("%s returned %s: %s", service, resp.Status, detail))
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateChatWebhooks(t *testing.T) {
+	for webhook, valid := range map[string]bool{
+		"https://hooks.slack.com/services/T000/B000/XXXX": true,
+		"https://hooks.slack.com/services/":               false,
+		"http://hooks.slack.com/services/T000/B000/XXXX":  false,
+		"https://hooks.slack.com:8443/services/T000/B000": false,
+		"https://evil.example/services/T000/B000/XXXX":    false,
+		"https://user@hooks.slack.com/services/T000/B000": false,
+	} {
+		if err := validateSlackWebhook(webhook); (err == nil) != valid {
+			t.Errorf("validateSlackWebhook(%q) = %v, want valid %v", webhook, err, valid)
+		}
+	}
+	for webhook, valid := range map[string]bool{
+		"https://discord.com/api/webhooks/123/abc":    true,
+		"https://discordapp.com/api/webhooks/123/abc": true,
+		"https://discord.com/api/users/@me":           false,
+		"https://hooks.slack.com/api/webhooks/123":    false,
+	} {
+		if err := validateDiscordWebhook(webhook); (err == nil) != valid {
+			t.Errorf("validateDiscordWebhook(%q) = %v, want valid %v", webhook, err, valid)
+		}
+	}
+}
+
+func TestSendChatWebhooks(t *testing.T) {
+	var path string
+	var got map[string]any
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		got = nil
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	originalClient := chatWebhookClient
+	defer func() { chatWebhookClient = originalClient }()
+	chatWebhookClient = &http.Client{Transport: redirectTransport{target}}
+
+	d := delivery{Address: "https://hooks.slack.com/services/T000/B000/XXXX", Title: "Deploy <done>", Body: "@channel build #42 & tests passed"}
+	if err := sendSlack(t.Context(), d); err != nil {
+		t.Fatalf("Expected Slack send to succeed, got %v", err)
+	}
+	if path != "/services/T000/B000/XXXX" || got["text"] != "*Deploy &lt;done&gt;*\n@channel build #42 &amp; tests passed" {
+		t.Errorf("Unexpected Slack post to %q: %v", path, got)
+	}
+
+	status = http.StatusNoContent
+	d.Address = "https://discord.com/api/webhooks/123/abc"
+	d.Title = strings.Repeat("t", 300)
+	if err := sendDiscord(t.Context(), d); err != nil {
+		t.Fatalf("Expected Discord send to succeed, got %v", err)
+	}
+	embeds, _ := got["embeds"].([]any)
+	if path != "/api/webhooks/123/abc" || len(embeds) != 1 {
+		t.Fatalf("Unexpected Discord post to %q: %v", path, got)
+	}
+	embed := embeds[0].(map[string]any)
+	if title := embed["title"].(string); len([]rune(title)) != maxDiscordTitle || embed["description"] != d.Body {
+		t.Errorf("Unexpected embed: %v", embed)
+	}
+	if mentions, _ := got["allowed_mentions"].(map[string]any); mentions == nil || len(mentions["parse"].([]any)) != 0 {
+		t.Errorf("Expected mentions to be disabled, got %v", got["allowed_mentions"])
+	}
+
+	for _, tc := range []struct {
+		send   func() error
+		status int
+		code   ErrorCode
+	}{
+		{func() error { return sendSlack(t.Context(), d) }, http.StatusNotFound, ErrTokenUnregistered},
+		{func() error { return sendSlack(t.Context(), d) }, http.StatusGone, ErrTokenUnregistered},
+		{func() error { return sendSlack(t.Context(), d) }, http.StatusBadRequest, ErrInvalidMessage},
+		{func() error { return sendDiscord(t.Context(), d) }, http.StatusUnauthorized, ErrTokenUnregistered},
+		{func() error { return sendDiscord(t.Context(), d) }, http.StatusForbidden, ErrTransportUnavailable},
+		{func() error { return sendDiscord(t.Context(), d) }, http.StatusTooManyRequests, ErrTransportUnavailable},
+	} {
+		status = tc.status
+		if err := tc.send(); errorCodeOf(err, "") != tc.code {
+			t.Errorf("Status %d: expected %s, got %v", tc.status, tc.code, err)
+		}
+	}
+
+	// Connection errors do not echo the webhook URL, which is its credential
+	chatWebhookClient = &http.Client{Transport: redirectTransport{&url.URL{Scheme: "http", Host: "127.0.0.1:1"}}}
+	if err := sendDiscord(t.Context(), d); err == nil || strings.Contains(err.Error(), "abc") {
+		t.Errorf("Expected an error without the webhook URL, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+)
+
+var checkConfig = flag.Bool("check-config", false, "Validate configuration (keys, Firebase credentials, storage connectivity), print a report and exit")
+
+// configCheck is the outcome of a single preflight check
+type configCheck struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// runConfigChecks verifies everything the server needs before it can serve
+// traffic, including live probes against Google OAuth and SOS
+func runConfigChecks(ctx context.Context) []configCheck {
+	var checks []configCheck
+	add := func(name, detail string, err error) {
+		checks = append(checks, configCheck{Name: name, Detail: detail, Err: err})
+	}
+
+	// Firebase service account key or Application Default Credentials: load,
+	// initialize the SDK, then fetch an access token to prove Google accepts them
+	name := "Firebase key"
+	if *serviceAccountKeyPath == "" {
+		name = "Firebase default credentials"
+	}
+	projectID, err := checkFirebaseProject(ctx, *serviceAccountKeyPath, *firebaseProjectID)
+	add(name, "project "+projectID, err)
+	if err == nil {
+		add("Firebase credentials", "access token obtained", probeFirebaseCredentials(ctx, *serviceAccountKeyPath, projectID))
+	}
+
+	// Further Firebase projects, each checked like the default one
+	if *firebaseProjectsFile != "" {
+		projects, err := loadFirebaseProjects(*firebaseProjectsFile)
+		add("Firebase projects", fmt.Sprintf("%d labelled", len(projects)), err)
+		labels := make([]string, 0, len(projects))
+		for label := range projects {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			projectID, err := checkFirebaseProject(ctx, projects[label], "")
+			if err == nil {
+				err = probeFirebaseCredentials(ctx, projects[label], projectID)
+			}
+			add("Firebase project "+label, "project "+projectID, err)
+		}
+	}
+
+	// Play Integrity credentials, only when Android attestation is required
+	if *playIntegrityPackage != "" {
+		err := setupPlayIntegrity(ctx, *playIntegrityPackage)
+		if err == nil {
+			_, err = playIntegrityTokens.Token()
+		}
+		add("Play Integrity", "package "+*playIntegrityPackage, err)
+	}
+
+	// RSA key pair: both must load and belong together
+	priv, err := loadPrivateKey(*privateKeyPath)
+	detail := ""
+	if err == nil {
+		detail = fmt.Sprintf("RSA-%d", priv.Size()*8)
+	}
+	add("RSA private key", detail, err)
+
+	pubPEM, err := readPublicKeyPEM(*publicKeyPath)
+	if err == nil {
+		detail = "hash " + ComputePublicKeyHash(pubPEM)[:16] + "..."
+		if priv != nil {
+			err = checkKeyPairMatches(priv, pubPEM)
+		}
+	}
+	add("RSA public key", detail, err)
+
+	// Web Push key, only when platform "web" is enabled
+	if *vapidPrivateKeyPath != "" {
+		_, err := loadVAPIDKey(*vapidPrivateKeyPath)
+		if err == nil && *vapidSubject == "" {
+			err = fmt.Errorf("--vapid-subject is required with --vapid-private-key")
+		}
+		add("VAPID key", *vapidSubject, err)
+	}
+
+	// Storage backend
+	if *sosAccessKey != "" && *sosSecretKey != "" {
+		storage, err := newExoscaleClient(*sosAccessKey, *sosSecretKey, *sosBucket, *sosZone, "", *storageTimeout)
+		if err == nil {
+			err = storage.Probe(ctx)
+		}
+		add("Exoscale SOS", fmt.Sprintf("bucket %s in %s", *sosBucket, *sosZone), err)
+	} else if *sosAccessKey != "" || *sosSecretKey != "" {
+		add("Exoscale SOS", "", fmt.Errorf("both --sos-access-key and --sos-secret-key must be set"))
+	} else {
+		add("File storage", *storageFile, checkStorageFile(*storageFile))
+	}
+
+	return checks
+}
+
+// printConfigReport writes a human-readable report and reports whether all checks passed
+func printConfigReport(w io.Writer, checks []configCheck) bool {
+	ok := true
+	fmt.Fprintln(w, "Configuration check:")
+	for _, c := range checks {
+		if c.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "  [FAIL] %s: %v\n", c.Name, c.Err)
+			continue
+		}
+		fmt.Fprintf(w, "  [OK]   %s: %s\n", c.Name, c.Detail)
+	}
+	if ok {
+		fmt.Fprintln(w, "All checks passed")
+	} else {
+		fmt.Fprintln(w, "Configuration has problems")
+	}
+	return ok
+}
+
+// checkFirebaseProject loads the credentials and resolves the project they send through
+func checkFirebaseProject(ctx context.Context, keyPath, projectID string) (string, error) {
+	creds, err := googleCredentials(ctx, keyPath, firebaseScopes...)
+	if err != nil {
+		return "", err
+	}
+	return firebaseProjectOf(creds, projectID)
+}
+
+// probeFirebaseCredentials initializes the Admin SDK and exchanges the service
+// account key, or the default credentials, for an access token
+func probeFirebaseCredentials(ctx context.Context, keyPath, projectID string) error {
+	// The token source performs its HTTP exchange under this context
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	creds, err := googleCredentials(ctx, keyPath, firebaseScopes...)
+	if err != nil {
+		return err
+	}
+
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: projectID}, firebaseOptions(creds)...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize Firebase app: %v", err)
+	}
+	if _, err := app.Messaging(ctx); err != nil {
+		return fmt.Errorf("failed to get Messaging client: %v", err)
+	}
+
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return fmt.Errorf("failed to obtain access token: %v", err)
+	}
+	return nil
+}
+
+// checkKeyPairMatches verifies the public key PEM corresponds to the private key
+func checkKeyPairMatches(priv *rsa.PrivateKey, publicKeyPEM string) error {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return fmt.Errorf("failed to decode PEM block")
+	}
+
+	var pub *rsa.PublicKey
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key is not an RSA public key")
+		}
+		pub = rsaKey
+	} else if rsaKey, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		pub = rsaKey
+	} else {
+		return fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	if !priv.PublicKey.Equal(pub) {
+		return fmt.Errorf("public key does not match private key")
+	}
+	return nil
+}
+
+// checkStorageFile verifies an existing token file parses and its directory is writable
+func checkStorageFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		store := &DurableTokenStore{mappings: make(map[string]*TokenMapping), storageFile: path}
+		if err := store.loadFromFile(); err != nil {
+			return fmt.Errorf("existing storage file is unreadable: %v", err)
+		}
+	}
+
+	probe, err := os.CreateTemp(filepath.Dir(path), ".check-config-*")
+	if err != nil {
+		return fmt.Errorf("storage directory is not writable: %v", err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func publicKeyToPEM(t *testing.T, pub any) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestCheckKeyPairMatches(t *testing.T) {
+	privKey, pubKey := apitest.PrivateKey(), apitest.PublicKey()
+	otherPubKey := &apitest.OtherPrivateKey().PublicKey
+
+	if err := checkKeyPairMatches(privKey, publicKeyToPEM(t, pubKey)); err != nil {
+		t.Errorf("Expected matching key pair to pass, got %v", err)
+	}
+	if err := checkKeyPairMatches(privKey, publicKeyToPEM(t, otherPubKey)); err == nil {
+		t.Error("Expected mismatched key pair to fail")
+	}
+	if err := checkKeyPairMatches(privKey, "not a pem"); err == nil {
+		t.Error("Expected invalid PEM to fail")
+	}
+}
+
+func TestCheckStorageFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkStorageFile(filepath.Join(dir, "tokens.json")); err != nil {
+		t.Errorf("Expected missing file in writable dir to pass, got %v", err)
+	}
+	if err := checkStorageFile(filepath.Join(dir, "missing", "tokens.json")); err == nil {
+		t.Error("Expected non-existent directory to fail")
+	}
+}
+
+func TestPrintConfigReport(t *testing.T) {
+	var out strings.Builder
+	ok := printConfigReport(&out, []configCheck{
+		{Name: "Good", Detail: "fine"},
+		{Name: "Bad", Err: errors.New("broken")},
+	})
+	if ok {
+		t.Error("Expected report with a failing check to return false")
+	}
+	if !strings.Contains(out.String(), "[FAIL] Bad: broken") || !strings.Contains(out.String(), "[OK]   Good: fine") {
+		t.Errorf("Unexpected report output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "time"
+
+// Clock tells the stores and the cleanup routine the time, so tests can set
+// it rather than wait for it
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator issues the opaque IDs of new registrations, so tests can know
+// them in advance
+type IDGenerator interface {
+	NewID() string
+}
+
+// systemClock is the real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// randomIDs issues random opaque IDs of the current version
+type randomIDs struct{}
+
+func (randomIDs) NewID() string { return generateOpaqueID() }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock stands still until a test moves it
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// sequentialIDs issues the 64-hex opaque IDs 1, 2, 3..., repeating each of
+// repeat once more so tests can force a collision
+type sequentialIDs struct {
+	n      int
+	repeat map[int]bool
+}
+
+func (g *sequentialIDs) NewID() string {
+	if g.repeat[g.n] {
+		delete(g.repeat, g.n)
+	} else {
+		g.n++
+	}
+	return fmt.Sprintf("%064x", g.n)
+}
+
+func TestStoreClockAndIDs(t *testing.T) {
+	originalStore, originalExoscale := tokenStore, useExoscale
+	defer func() { tokenStore, useExoscale = originalStore, originalExoscale }()
+	useExoscale = false
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	clock := &fakeClock{now: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	ids := &sequentialIDs{repeat: map[int]bool{1: true}}
+	tokenStore.clock, tokenStore.ids = clock, ids
+
+	first, _ := tokenStore.AddToken("encrypted", "android")
+	if first != fmt.Sprintf("%064x", 1) {
+		t.Errorf("Expected the generator's first ID, got %s", first)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	// The generator hands out 1 again, which is taken
+	second, _ := tokenStore.AddToken("encrypted", "android")
+	if second != fmt.Sprintf("%064x", 2) {
+		t.Errorf("Expected a colliding ID replaced by the next one, got %s", second)
+	}
+
+	token, err := getToken(t.Context(), second)
+	if err != nil {
+		t.Fatalf("getToken failed: %v", err)
+	}
+	if !token.RegisteredAt.Equal(clock.now) || !token.LastUsedAt.Equal(clock.now) {
+		t.Errorf("Expected the store's clock on the token, got registered %v, last used %v", token.RegisteredAt, token.LastUsedAt)
+	}
+	group, _ := tokenStore.UpdateGroup("staff", true, func(g *DeviceGroup) {})
+	if !group.CreatedAt.Equal(clock.now) || !group.UpdatedAt.Equal(clock.now) {
+		t.Errorf("Expected the store's clock on the group, got %+v", group)
+	}
+}
+
+func TestCleanupTokens(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	maxAge := 30 * 24 * time.Hour
+	cutoff := clock.Now().Add(-maxAge)
+	tokens := []*TokenStorageInfo{
+		{OpaqueID: "fresh", LastUsedAt: clock.Now().Add(-time.Hour)},
+		{OpaqueID: "at-cutoff", LastUsedAt: cutoff},
+		{OpaqueID: "stale", LastUsedAt: cutoff.Add(-time.Second)},
+		{OpaqueID: "stale-but-stuck", LastUsedAt: cutoff.Add(-24 * time.Hour)},
+		{OpaqueID: "never-used"},
+	}
+
+	var deleted []string
+	deleteToken := func(ctx context.Context, opaqueID string) error {
+		if opaqueID == "stale-but-stuck" {
+			return errors.New("storage unavailable")
+		}
+		deleted = append(deleted, opaqueID)
+		return nil
+	}
+	if n := cleanupTokens(context.Background(), tokens, cutoff, deleteToken); n != 2 {
+		t.Errorf("Expected two tokens cleaned up, got %d", n)
+	}
+	if fmt.Sprint(deleted) != "[stale never-used]" {
+		t.Errorf("Expected only tokens last used before the cutoff deleted, got %v", deleted)
+	}
+
+	// A month later the fresh token has gone stale too
+	clock.now = clock.now.Add(maxAge)
+	deleted = nil
+	cleanupTokens(context.Background(), tokens[:2], clock.Now().Add(-maxAge), deleteToken)
+	if fmt.Sprint(deleted) != "[fresh at-cutoff]" {
+		t.Errorf("Expected the cutoff to follow the clock, got %v", deleted)
+	}
+}
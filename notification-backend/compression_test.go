@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+// echoHandler returns the request body it received
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+})
+
+func TestGzipRequestAndResponse(t *testing.T) {
+	payload := []byte(`{"encrypted_data":"` + strings.Repeat("A", 2000) + `"}`)
+
+	req := httptest.NewRequest("POST", "/register", bytes.NewReader(gzipBytes(t, payload)))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rr := httptest.NewRecorder()
+	gzipHandler(echoHandler).ServeHTTP(rr, req)
+
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip response, got headers %v", rr.Header())
+	}
+	if rr.Body.Len() >= len(payload) {
+		t.Errorf("Expected compressed response smaller than %d bytes, got %d", len(payload), rr.Body.Len())
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Response is not valid gzip: %v", err)
+	}
+	got, _ := io.ReadAll(gz)
+	if !bytes.Equal(got, payload) {
+		t.Error("Round-tripped payload does not match")
+	}
+}
+
+func TestGzipOnlyWhenAccepted(t *testing.T) {
+	for _, accept := range []string{"", "identity", "gzip;q=0"} {
+		req := httptest.NewRequest("POST", "/register", strings.NewReader("hello"))
+		req.Header.Set("Accept-Encoding", accept)
+		rr := httptest.NewRecorder()
+		gzipHandler(echoHandler).ServeHTTP(rr, req)
+
+		if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "hello" {
+			t.Errorf("Accept-Encoding %q: expected uncompressed response, got %q", accept, rr.Body.String())
+		}
+	}
+}
+
+func TestGzipRejectsBadBodies(t *testing.T) {
+	// Not actually gzip
+	req := httptest.NewRequest("POST", "/register", strings.NewReader("plain"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	gzipHandler(echoHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid gzip, got %d", rr.Code)
+	}
+
+	// Unknown encodings are refused
+	req = httptest.NewRequest("POST", "/register", strings.NewReader("x"))
+	req.Header.Set("Content-Encoding", "br")
+	rr = httptest.NewRecorder()
+	gzipHandler(echoHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for unsupported encoding, got %d", rr.Code)
+	}
+
+	// A compression bomb stops at the decompressed size limit
+	bomb := gzipBytes(t, bytes.Repeat([]byte{'0'}, int(*maxDecompressedBody)+1))
+	req = httptest.NewRequest("POST", "/register", bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	gzipHandler(echoHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected oversized body to be rejected, got %d", rr.Code)
+	}
+}
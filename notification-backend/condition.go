@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// maxConditionTopics is FCM's limit on topics in one condition
+const maxConditionTopics = 5
+
+// topicNamePattern is the character set FCM allows in topic names
+var topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9\-_.~%]+$`)
+
+// ConditionNotificationRequest targets every device subscribed to a
+// combination of topics, e.g. "'news' in topics && 'eu' in topics"
+type ConditionNotificationRequest struct {
+	Condition string `json:"condition"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	// FirebaseProject picks a --firebase-projects entry, whose topics are separate
+	FirebaseProject string `json:"firebase_project,omitempty"`
+}
+
+type ConditionSendResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	MessageID string `json:"message_id"`
+}
+
+// conditionParser is a recursive-descent parser for FCM condition syntax:
+//
+//	or    = and { "||" and }
+//	and   = unary { "&&" unary }
+//	unary = "!" unary | "(" or ")" | topic "in" "topics"
+//
+// It rejects anything FCM would, so bad expressions fail fast with a
+// readable message instead of an opaque INVALID_ARGUMENT from FCM.
+type conditionParser struct {
+	tokens []string
+	pos    int
+	topics int
+}
+
+// validateCondition checks a condition expression before it is sent to FCM
+func validateCondition(condition string) error {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("condition is empty")
+	}
+
+	p := &conditionParser{tokens: tokens}
+	if err := p.parseOr(); err != nil {
+		return err
+	}
+	if p.pos < len(p.tokens) {
+		return fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if p.topics > maxConditionTopics {
+		return fmt.Errorf("condition uses %d topics, FCM allows at most %d", p.topics, maxConditionTopics)
+	}
+	return nil
+}
+
+// tokenizeCondition splits a condition into quoted topics, operators,
+// parentheses and the words "in" and "topics"
+func tokenizeCondition(condition string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(condition); {
+		switch c := condition[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(condition[i:], "&&") || strings.HasPrefix(condition[i:], "||"):
+			tokens = append(tokens, condition[i:i+2])
+			i += 2
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(condition[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated topic name at position %d", i)
+			}
+			tokens = append(tokens, condition[i:i+end+2])
+			i += end + 2
+		case c >= 'a' && c <= 'z':
+			j := i
+			for j < len(condition) && condition[j] >= 'a' && condition[j] <= 'z' {
+				j++
+			}
+			tokens = append(tokens, condition[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) expect(want string) error {
+	if got := p.peek(); got != want {
+		if got == "" {
+			return fmt.Errorf("expected %q at end of condition", want)
+		}
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *conditionParser) parseOr() error {
+	if err := p.parseAnd(); err != nil {
+		return err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		if err := p.parseAnd(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *conditionParser) parseAnd() error {
+	if err := p.parseUnary(); err != nil {
+		return err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		if err := p.parseUnary(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *conditionParser) parseUnary() error {
+	switch tok := p.peek(); {
+	case tok == "!":
+		p.pos++
+		return p.parseUnary()
+	case tok == "(":
+		p.pos++
+		if err := p.parseOr(); err != nil {
+			return err
+		}
+		return p.expect(")")
+	case strings.HasPrefix(tok, "'") || strings.HasPrefix(tok, `"`):
+		if name := tok[1 : len(tok)-1]; !topicNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid topic name %q", name)
+		}
+		p.pos++
+		p.topics++
+		if err := p.expect("in"); err != nil {
+			return err
+		}
+		return p.expect("topics")
+	case tok == "":
+		return fmt.Errorf("condition ends unexpectedly")
+	default:
+		return fmt.Errorf("expected a topic, \"!\" or \"(\", got %q", tok)
+	}
+}
+
+// handleSendCondition sends one FCM message to every device whose topic
+// subscriptions match the condition
+func handleSendCondition(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+
+	var notif ConditionNotificationRequest
+	if err := json.Unmarshal(body, &notif); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+
+	if notif.Condition == "" || notif.Title == "" || notif.Body == "" {
+		writeError(w, ErrMissingField, "Condition, title and body are required")
+		return
+	}
+	if err := validateCondition(notif.Condition); err != nil {
+		logger.Warn("Invalid condition", "condition", notif.Condition, "error", err)
+		writeError(w, ErrInvalidCondition, "Invalid condition: "+err.Error())
+		return
+	}
+
+	if err := validateFirebaseProject(notif.FirebaseProject); err != nil {
+		writeError(w, ErrUnknownProject, err.Error())
+		return
+	}
+
+	message := &messaging.Message{
+		Condition: notif.Condition,
+		Notification: &messaging.Notification{
+			Title: notif.Title,
+			Body:  notif.Body,
+		},
+		Android: &messaging.AndroidConfig{
+			Priority: "high",
+		},
+	}
+	messageID, err := deliverFCM(r.Context(), notif.FirebaseProject, message)
+	if err != nil {
+		code := errorCodeOf(err, ErrFCMUnavailable)
+		logger.Error("Failed to send condition notification", "condition", notif.Condition, "code", code, "error", err)
+		writeError(w, code, "Failed to send notification")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := ConditionSendResponse{
+		Success:   true,
+		Message:   "Notification sent to condition",
+		MessageID: messageID,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateCondition(t *testing.T) {
+	valid := []string{
+		"'news' in topics",
+		`"news" in topics`,
+		"'news' in topics && 'eu' in topics",
+		"'news' in topics && ('eu' in topics || 'uk' in topics)",
+		"!('sports' in topics) || 'a-b_c.d~e%f' in topics",
+		"'a' in topics && 'b' in topics && 'c' in topics && 'd' in topics && 'e' in topics",
+	}
+	for _, condition := range valid {
+		if err := validateCondition(condition); err != nil {
+			t.Errorf("%q: expected valid, got %v", condition, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"news in topics",
+		"'news' topics",
+		"'news' in topics &&",
+		"('news' in topics",
+		"'news' in topics)",
+		"'news' in topics & 'eu' in topics",
+		"'new s' in topics",
+		"'news in topics",
+		"'news' in topics 'eu' in topics",
+		"'a' in topics && 'b' in topics && 'c' in topics && 'd' in topics && 'e' in topics && 'f' in topics",
+	}
+	for _, condition := range invalid {
+		if err := validateCondition(condition); err == nil {
+			t.Errorf("%q: expected an error", condition)
+		}
+	}
+}
+
+func TestHandleSendCondition(t *testing.T) {
+	originalClient := messagingClient
+	defer func() { messagingClient = originalClient }()
+	messagingClient = nil
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"missing condition", `{"title":"t","body":"b"}`, http.StatusBadRequest, ErrMissingField},
+		{"bad condition", `{"condition":"'news' in topics ||","title":"t","body":"b"}`, http.StatusBadRequest, ErrInvalidCondition},
+		{"valid but no FCM client", `{"condition":"'news' in topics","title":"t","body":"b"}`, http.StatusInternalServerError, ErrFCMUnavailable},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handleSendCondition(rr, httptest.NewRequest("POST", "/v1/send-condition", strings.NewReader(tt.body)))
+
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if rr.Code != tt.status || resp.Code != tt.code {
+			t.Errorf("%s: expected %d %s, got %d %+v", tt.name, tt.status, tt.code, rr.Code, resp)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+var debugAddr = flag.String("debug-addr", "", "Address for a private pprof/expvar listener (e.g. 127.0.0.1:6060); empty disables it")
+
+// startDebugServer serves net/http/pprof and expvar on a separate listener.
+// It is meant to be bound to loopback or an internal interface only.
+func startDebugServer(addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && !ip.IsLoopback()) {
+			slog.Warn("Debug listener is not bound to loopback; make sure it is not publicly reachable", "addr", addr)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		slog.Info("Debug server listening", "addr", addr, "endpoints", []string{"/debug/pprof/", "/debug/vars"})
+		// No write timeout: CPU profiles and traces stream for as long as requested
+		server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: *readHeaderTimeout}
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("Debug server failed", "error", err)
+		}
+	}()
+}
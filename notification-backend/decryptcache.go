@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	decryptedTokenCache     = flag.Bool("decrypted-token-cache", false, "Keep decrypted FCM tokens in locked memory so repeated sends skip the RSA decryption; anyone who can read this process's memory then gets recently sent tokens in clear")
+	decryptedTokenCacheSize = flag.Int("decrypted-token-cache-size", 10000, "Decrypted FCM tokens kept with --decrypted-token-cache, 256 bytes of locked memory each")
+	decryptedTokenCacheTTL  = flag.Duration("decrypted-token-cache-ttl", 10*time.Minute, "How long a decrypted FCM token is kept with --decrypted-token-cache")
+)
+
+// Cache counters, published on the debug listener under /debug/vars
+var (
+	decryptedTokenCacheHits   = expvar.NewInt("decrypted_token_cache_hits")
+	decryptedTokenCacheMisses = expvar.NewInt("decrypted_token_cache_misses")
+)
+
+// decryptedTokenSlot is the room for one token; longer ones are not cached
+const decryptedTokenSlot = 256
+
+// decryptedTokens is initialized in main from the flags; nil means off
+var decryptedTokens *decryptedCache
+
+// decryptedCache holds decrypted FCM tokens by the SHA-256 of their
+// encrypted_data, least recently used dropped first. The tokens live in one
+// locked buffer outside the Go heap, and a slot is zeroed as soon as its
+// token expires or is dropped; callers get a copy to use and wipe as usual.
+type decryptedCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	buf     []byte // slots of decryptedTokenSlot bytes
+	free    []int  // unused slots
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type decryptedEntry struct {
+	key     [sha256.Size]byte
+	slot    int
+	n       int
+	expires time.Time
+}
+
+// newDecryptedCache locks memory for size tokens
+func newDecryptedCache(size int, ttl time.Duration) (*decryptedCache, error) {
+	if size <= 0 || ttl <= 0 {
+		return nil, fmt.Errorf("size and TTL must be positive")
+	}
+	buf, err := allocLocked(size * decryptedTokenSlot)
+	if err != nil {
+		return nil, err
+	}
+	c := &decryptedCache{ttl: ttl, buf: buf, order: list.New(), entries: make(map[[sha256.Size]byte]*list.Element, size)}
+	for i := size - 1; i >= 0; i-- {
+		c.free = append(c.free, i)
+	}
+	return c, nil
+}
+
+// decryptedCacheFromFlags returns the --decrypted-token-cache, nil when off
+func decryptedCacheFromFlags() (*decryptedCache, error) {
+	if !*decryptedTokenCache {
+		return nil, nil
+	}
+	c, err := newDecryptedCache(*decryptedTokenCacheSize, *decryptedTokenCacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --decrypted-token-cache flags: %v", err)
+	}
+	slog.Warn("Decrypted FCM tokens are cached in memory",
+		"size", *decryptedTokenCacheSize, "ttl", *decryptedTokenCacheTTL)
+	return c, nil
+}
+
+// decryptFCMToken decrypts an FCM registration's token, skipping the RSA
+// operation when the --decrypted-token-cache has it
+func decryptFCMToken(encryptedData string) (string, error) {
+	key := sha256.Sum256([]byte(encryptedData))
+	if token, ok := decryptedTokens.get(key, time.Now()); ok {
+		return token, nil
+	}
+	token, err := decryptHybridToken(encryptedData)
+	if err != nil {
+		return "", err
+	}
+	decryptedTokens.put(key, token, time.Now())
+	return token, nil
+}
+
+// get returns a copy of the token cached under key unless it has expired by now
+func (c *decryptedCache) get(key [sha256.Size]byte, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		decryptedTokenCacheMisses.Add(1)
+		return "", false
+	}
+	entry := el.Value.(*decryptedEntry)
+	if !now.Before(entry.expires) {
+		c.remove(el)
+		decryptedTokenCacheMisses.Add(1)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	decryptedTokenCacheHits.Add(1)
+	return string(c.slot(entry.slot)[:entry.n]), true
+}
+
+// put caches token under key until now plus the TTL, wiping the least
+// recently used token to make room
+func (c *decryptedCache) put(key [sha256.Size]byte, token string, now time.Time) {
+	if c == nil || len(token) > decryptedTokenSlot {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf == nil {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if len(c.free) == 0 {
+		c.remove(c.order.Back())
+	}
+	slot := c.free[len(c.free)-1]
+	c.free = c.free[:len(c.free)-1]
+	copy(c.slot(slot), token)
+	c.entries[key] = c.order.PushFront(&decryptedEntry{key: key, slot: slot, n: len(token), expires: now.Add(c.ttl)})
+}
+
+// len returns the number of tokens cached, expired ones included
+func (c *decryptedCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// close wipes every token and releases the locked memory; the cache holds
+// nothing after
+func (c *decryptedCache) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf == nil {
+		return nil
+	}
+	c.order.Init()
+	clear(c.entries)
+	c.free = nil
+	err := freeLocked(c.buf)
+	c.buf = nil
+	return err
+}
+
+func (c *decryptedCache) slot(i int) []byte {
+	return c.buf[i*decryptedTokenSlot : (i+1)*decryptedTokenSlot]
+}
+
+// remove drops an entry, zeroing its slot
+func (c *decryptedCache) remove(el *list.Element) {
+	entry := el.Value.(*decryptedEntry)
+	clear(c.slot(entry.slot))
+	c.free = append(c.free, entry.slot)
+	c.order.Remove(el)
+	delete(c.entries, entry.key)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+// newTestDecryptedCache returns a cache of size tokens, released after the test
+func newTestDecryptedCache(t *testing.T, size int) *decryptedCache {
+	t.Helper()
+	c, err := newDecryptedCache(size, time.Minute)
+	if err != nil {
+		t.Skipf("No locked memory here: %v", err)
+	}
+	t.Cleanup(func() { c.close() })
+	return c
+}
+
+func TestDecryptedCache(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestDecryptedCache(t, 2)
+	key := func(n int) [sha256.Size]byte { return sha256.Sum256([]byte(apitest.EncryptToken(apitest.FCMToken(n)))) }
+	c.put(key(0), apitest.FCMToken(0), start)
+	c.put(key(1), apitest.FCMToken(1), start)
+
+	if token, ok := c.get(key(0), start); !ok || token != apitest.FCMToken(0) {
+		t.Fatalf("Expected token 0 cached, got %q", token)
+	}
+
+	// 1 is now the least recently used, so its slot is wiped for 2
+	c.put(key(2), apitest.FCMToken(2), start)
+	if _, ok := c.get(key(1), start); ok || c.len() != 2 {
+		t.Errorf("Expected 1 evicted and 2 tokens cached, got %d", c.len())
+	}
+	if bytes.Contains(c.buf, []byte(apitest.FCMToken(1))) {
+		t.Error("Expected the evicted token wiped from the locked memory")
+	}
+
+	// Tokens expire after the TTL, and are wiped then too
+	if _, ok := c.get(key(0), start.Add(time.Minute)); ok {
+		t.Error("Expected token 0 expired")
+	}
+	if bytes.Contains(c.buf, []byte(apitest.FCMToken(0))) {
+		t.Error("Expected the expired token wiped from the locked memory")
+	}
+
+	// Tokens longer than a slot are not cached
+	long := strings.Repeat("A", decryptedTokenSlot+1)
+	c.put(key(3), long, start)
+	if _, ok := c.get(key(3), start); ok {
+		t.Error("Expected a token longer than a slot left out")
+	}
+
+	// Once closed the cache holds nothing
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+	c.put(key(2), apitest.FCMToken(2), start)
+	if _, ok := c.get(key(2), start); ok || c.len() != 0 {
+		t.Errorf("Expected nothing cached after close, got %d", c.len())
+	}
+}
+
+func TestDecryptFCMToken(t *testing.T) {
+	originalPrivateKey, originalCache, originalClient := privateKey, decryptedTokens, messagingClient
+	defer func() {
+		privateKey, decryptedTokens, messagingClient = originalPrivateKey, originalCache, originalClient
+	}()
+	privateKey = apitest.PrivateKey()
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+
+	// Off by default, so every send decrypts
+	decryptedTokens = nil
+	if c, err := decryptedCacheFromFlags(); c != nil || err != nil {
+		t.Errorf("Expected the cache off by default, got %v", err)
+	}
+	if token, err := decryptFCMToken(encrypted); err != nil || token != apitest.FCMToken(1) {
+		t.Fatalf("Expected the token decrypted, got %q, %v", token, err)
+	}
+
+	// Turned on, the second send finds the token without the private key
+	decryptedTokens = newTestDecryptedCache(t, 10)
+	for _, want := range []int{0, 1} {
+		before := decryptedTokenCacheHits.Value()
+		if token, err := decryptFCMToken(encrypted); err != nil || token != apitest.FCMToken(1) {
+			t.Fatalf("Expected the token, got %q, %v", token, err)
+		}
+		if hits := decryptedTokenCacheHits.Value() - before; hits != int64(want) {
+			t.Errorf("Expected %d cache hits, got %d", want, hits)
+		}
+	}
+
+	// Single sends take the cached token too, and clear it from the message
+	fake := &fakeMessenger{}
+	messagingClient = fake
+	before := decryptedTokenCacheHits.Value()
+	message := fcmNotificationMessage("", "Hello", "Again")
+	if err := sendFCMMessage(context.Background(), "", encrypted, message); err != nil || len(fake.sent) != 1 || message.Token != "" {
+		t.Fatalf("Expected the notification sent, got %d sends, %v", len(fake.sent), err)
+	}
+	if hits := decryptedTokenCacheHits.Value() - before; hits != 1 {
+		t.Errorf("Expected the single send to hit the cache, got %d hits", hits)
+	}
+
+	// What does not decrypt is not cached
+	other := apitest.EncryptTokenTo(&apitest.OtherPrivateKey().PublicKey, apitest.FCMToken(2), nil)
+	for range 2 {
+		if _, err := decryptFCMToken(other); err == nil {
+			t.Error("Expected the decryption error")
+		}
+	}
+	if decryptedTokens.len() != 1 {
+		t.Errorf("Expected only the first token cached, got %d", decryptedTokens.len())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// checkDelivery does everything sending d to a registration's first channel
+// would, short of delivering it: the transport must be ready and the address
+// decrypt and validate, and FCM must accept the message in a validate-only
+// send. Quiet hours and the failover and fallback channels are not consulted.
+func checkDelivery(ctx context.Context, token *TokenStorageInfo, d delivery) error {
+	t := transportFor(token.Platform)
+	if err := t.ready(); err != nil {
+		return err
+	}
+
+	address, err := decryptHybridToken(token.EncryptedData)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt token: %v", err))
+	}
+	defer secureWipeString(&address)
+
+	if err := t.validate(address); err != nil {
+		return err
+	}
+	if t != fcmTransport {
+		return nil
+	}
+	return dryRunFCM(ctx, token.FirebaseProject, fcmNotificationMessage(address, d.Title, d.Body))
+}
+
+// dryRunFCM has FCM validate an addressed message without sending it. Nothing
+// is delivered, so the outcome does not count toward the failure streak.
+func dryRunFCM(ctx context.Context, project string, message *messaging.Message) error {
+	client, err := fcmClientFor(project)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startSpan(ctx, "fcm.dry_run")
+	sendCtx, cancel := context.WithTimeout(ctx, *fcmTimeout)
+	_, err = client.SendDryRun(sendCtx, message)
+	cancel()
+	endSpan(span, err)
+
+	switch {
+	case err == nil:
+		return nil
+	case messaging.IsUnregistered(err):
+		return withCode(ErrTokenUnregistered, fmt.Errorf("FCM token is no longer registered: %v", err))
+	case messaging.IsInvalidArgument(err):
+		return withCode(ErrInvalidMessage, fmt.Errorf("FCM rejected the message: %v", err))
+	default:
+		return withCode(ErrFCMUnavailable, fmt.Errorf("failed to validate FCM message: %v", err))
+	}
+}
+
+// handleNotifyDryRun answers a /v1/notify with "dry_run" once the
+// notification to token checked out
+func handleNotifyDryRun(w http.ResponseWriter, r *http.Request, token *TokenStorageInfo, d delivery) {
+	logger := loggerFromContext(r.Context())
+
+	if err := checkDelivery(r.Context(), token, d); err != nil {
+		code := errorCodeOf(err, ErrFCMUnavailable)
+		logger.Warn("Dry run failed", "code", code, "error", err)
+		writeError(w, code, "Notification would not be delivered")
+		return
+	}
+	logger.Info("Dry run passed", "platform", token.Platform)
+	response := NotifyResponse{Success: true, Message: "Dry run passed; nothing was sent", DryRun: true}
+	if err := writeResponse(w, http.StatusOK, response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
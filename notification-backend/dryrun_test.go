@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestNotifyDryRun(t *testing.T) {
+	var published atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		published.Add(1)
+	}))
+	defer server.Close()
+
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalServer := privateKey, tokenStore, useExoscale, *ntfyServer
+	defer func() {
+		privateKey, tokenStore, useExoscale, *ntfyServer = originalPrivateKey, originalStore, originalExoscale, originalServer
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	*ntfyServer = server.URL
+
+	register := func(address, platform string) RegisterResponse {
+		encrypted := apitest.EncryptToken(address)
+		body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: platform})
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		var reg RegisterResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &reg); err != nil || !reg.Success {
+			t.Fatalf("Registration failed: %s", rr.Body.String())
+		}
+		return reg
+	}
+	// notify returns the status, and the error code or body of the response
+	notify := func(reg RegisterResponse, dryRun bool) (int, ErrorCode, string) {
+		body, _ := json.Marshal(SingleNotificationRequest{TokenID: reg.TokenID, NotifySecret: reg.NotifySecret, Title: "t", Body: "b", DryRun: dryRun})
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(body)))
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, errResp.Code, rr.Body.String()
+	}
+
+	ntfy := register("phone-123", "ntfy")
+	status, _, body := notify(ntfy, true)
+	var resp NotifyResponse
+	if json.Unmarshal([]byte(body), &resp); status != http.StatusOK || !resp.DryRun {
+		t.Fatalf("Expected the dry run to pass and say so, got %d %s", status, body)
+	}
+	if n := published.Load(); n != 0 {
+		t.Errorf("Expected a dry run to publish nothing, got %d publishes", n)
+	}
+	if status, _, body := notify(ntfy, false); status != http.StatusOK || published.Load() != 1 {
+		t.Errorf("Expected the real send to publish once, got %d %s after %d publishes", status, body, published.Load())
+	}
+
+	// The checks before delivery still apply
+	if status, code, _ := notify(RegisterResponse{TokenID: ntfy.TokenID}, true); status != http.StatusUnauthorized || code != ErrUnauthorized {
+		t.Errorf("Expected a dry run without the notify secret to be refused, got %d %s", status, code)
+	}
+	*ntfyServer = ""
+	if _, code, _ := notify(ntfy, true); code != ErrTransportUnavailable {
+		t.Errorf("Expected a dry run to an unconfigured transport to fail, got %s", code)
+	}
+
+	// FCM is not set up here, so its validate-only send cannot be made
+	fcm := register(apitest.FCMToken(1), "android")
+	if _, code, _ := notify(fcm, true); code != ErrFCMUnavailable {
+		t.Errorf("Expected a dry run to FCM to need the client, got %s", code)
+	}
+}
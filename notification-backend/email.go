@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// Email fallback configuration; disabled without an SMTP server
+	smtpAddr        = flag.String("smtp-addr", "", "SMTP server host:port for the email fallback; empty disables it (port 465 uses implicit TLS, others STARTTLS)")
+	smtpUsername    = flag.String("smtp-username", "", "SMTP username")
+	smtpPasswordArg = flag.String("smtp-password", "", "SMTP password (or SMTP_PASSWORD)")
+	smtpFrom        = flag.String("smtp-from", "", "From address of fallback emails")
+	smtpTimeout     = flag.Duration("smtp-timeout", 30*time.Second, "Timeout for sending a single email")
+	emailFallbackOn = flag.String("email-fallback", "unregistered", "When to email a registration's fallback address: unregistered (push token is gone) or failed (any failed push)")
+)
+
+// smtpPassword is resolved from the flag or environment at startup
+var smtpPassword string
+
+// sendMail delivers one message; tests replace it
+var sendMail = sendSMTP
+
+// emailTransport delivers to registrations or failover channels with platform
+// "email", whose address is the email address itself
+var emailTransport = &transport{
+	name:       "email",
+	configured: func() bool { return *smtpAddr != "" },
+	ready:      func() error { return nil },
+	validate:   validateEmailAddress,
+	send: func(ctx context.Context, d delivery) error {
+		return deliverEmail(ctx, d.Address, d)
+	},
+}
+
+var emailFallback = &fallbackChannel{
+	name:    "email",
+	applies: emailFallbackApplies,
+	send:    sendEmailFallback,
+}
+
+// setupEmail checks the SMTP settings and resolves the password, preferring the flag over SMTP_PASSWORD
+func setupEmail(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("--smtp-addr must be host:port, got %q", addr)
+	}
+	if _, err := mail.ParseAddress(*smtpFrom); err != nil {
+		return fmt.Errorf("--smtp-from must be an email address: %v", err)
+	}
+	if *emailFallbackOn != "unregistered" && *emailFallbackOn != "failed" {
+		return fmt.Errorf("--email-fallback must be unregistered or failed, got %q", *emailFallbackOn)
+	}
+	smtpPassword = *smtpPasswordArg
+	if smtpPassword == "" {
+		smtpPassword = os.Getenv("SMTP_PASSWORD")
+	}
+	return nil
+}
+
+// validateEncryptedEmail checks a registration's fallback address decrypts to
+// a plain email address. Registrations are refused an address that would never be used.
+func validateEncryptedEmail(encrypted string) error {
+	if *smtpAddr == "" {
+		return withCode(ErrUnsupportedPlatform, fmt.Errorf("email fallback is not enabled on this server"))
+	}
+	if len(encrypted) < 100 || len(encrypted) > 10000 {
+		return withCode(ErrInvalidEncryptedData, fmt.Errorf("encrypted email has an impossible length"))
+	}
+	address, err := decryptHybridToken(encrypted)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt email: %v", err))
+	}
+	defer secureWipeString(&address)
+	return validateEmailAddress(address)
+}
+
+// validateEmailAddress accepts only a bare address, without a display name
+func validateEmailAddress(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("email must be a bare address like user@example.com"))
+	}
+	return nil
+}
+
+// emailFallbackApplies follows --email-fallback: by default only a push token
+// that is permanently gone, as after the app was uninstalled, falls back
+func emailFallbackApplies(token *TokenStorageInfo, _ delivery, pushErr error) bool {
+	if *smtpAddr == "" || token.EncryptedEmail == "" {
+		return false
+	}
+	switch errorCodeOf(pushErr, ErrFCMUnavailable) {
+	case ErrTokenUnregistered:
+		return true
+	case ErrFCMUnavailable, ErrTransportUnavailable:
+		return *emailFallbackOn == "failed"
+	}
+	// Anything else (an undecryptable token, a rejected message) would fail the same way by email
+	return false
+}
+
+// sendEmailFallback emails the notification to the registration's fallback address
+func sendEmailFallback(ctx context.Context, token *TokenStorageInfo, d delivery) error {
+	to, err := decryptHybridToken(token.EncryptedEmail)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt email: %v", err))
+	}
+	defer secureWipeString(&to)
+	return deliverEmail(ctx, to, d)
+}
+
+// deliverEmail sends the notification in d to one address
+func deliverEmail(ctx context.Context, to string, d delivery) error {
+	ctx, span := startSpan(ctx, "smtp.send")
+	err := sendMail(ctx, to, emailMessage(to, d.Title, d.Body))
+	endSpan(span, err)
+	if err != nil {
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to send email: %v", err))
+	}
+	return nil
+}
+
+// emailMessage renders a plain-text message. Encoding the subject also keeps
+// a title with line breaks from injecting headers.
+func emailMessage(to, subject, body string) []byte {
+	from, _ := mail.ParseAddress(*smtpFrom)
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: <%s>\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), from.Address[strings.LastIndex(from.Address, "@")+1:])
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return msg.Bytes()
+}
+
+// sendSMTP submits msg through the configured server. Unlike smtp.SendMail
+// it honours ctx and --smtp-timeout, and uses implicit TLS on port 465.
+func sendSMTP(ctx context.Context, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, *smtpTimeout)
+	defer cancel()
+
+	host, port, _ := net.SplitHostPort(*smtpAddr)
+	tlsConfig := &tls.Config{ServerName: host}
+	var conn net.Conn
+	var err error
+	var dialer net.Dialer
+	if port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: &dialer, Config: tlsConfig}).DialContext(ctx, "tcp", *smtpAddr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", *smtpAddr)
+	}
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if *smtpUsername != "" {
+		// PlainAuth refuses to send credentials unencrypted except to localhost
+		if err := c.Auth(smtp.PlainAuth("", *smtpUsername, smtpPassword, host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(*smtpFrom)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestEmailFallback(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalAddr, originalFrom, originalPolicy, originalSend := privateKey, *smtpAddr, *smtpFrom, *emailFallbackOn, sendMail
+	defer func() {
+		privateKey, *smtpAddr, *smtpFrom, *emailFallbackOn, sendMail = originalPrivateKey, originalAddr, originalFrom, originalPolicy, originalSend
+		delete(platformTransports, "test")
+	}()
+	privateKey = privKey
+	*smtpAddr, *smtpFrom, *emailFallbackOn = "smtp.example.com:587", "Alerts <alerts@example.com>", "unregistered"
+
+	var pushErr error
+	platformTransports["test"] = &transport{
+		name:       "test",
+		configured: func() bool { return true },
+		ready:      func() error { return nil },
+		validate:   func(string) error { return nil },
+		send:       func(context.Context, delivery) error { return pushErr },
+	}
+	var sentTo string
+	var sent []byte
+	sendMail = func(_ context.Context, to string, msg []byte) error {
+		sentTo, sent = to, msg
+		return nil
+	}
+
+	encryptedToken := apitest.EncryptToken("device-address")
+	encryptedEmail := apitest.EncryptToken("user@example.com")
+	token := &TokenStorageInfo{OpaqueID: "id", EncryptedData: encryptedToken, Platform: "test", EncryptedEmail: encryptedEmail}
+	d := delivery{Title: "Door open", Body: "Front door\nopened"}
+
+	pushErr = withCode(ErrTokenUnregistered, errors.New("gone"))
+	if err := sendNotification(t.Context(), token, d); err != nil || sentTo != "user@example.com" {
+		t.Fatalf("Expected email fallback for a dead token, got %v (sent to %q)", err, sentTo)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(sent)))
+	if err != nil || msg.Header.Get("Subject") != "Door open" || msg.Header.Get("From") != `"Alerts" <alerts@example.com>` {
+		t.Errorf("Unexpected email %q: %v", sent, err)
+	}
+	if !strings.Contains(string(sent), "\r\n\r\nFront door\r\nopened\r\n") {
+		t.Errorf("Expected CRLF body, got %q", sent)
+	}
+
+	// Transient failures only fall back with --email-fallback=failed
+	sentTo = ""
+	pushErr = withCode(ErrTransportUnavailable, errors.New("down"))
+	if err := sendNotification(t.Context(), token, d); errorCodeOf(err, "") != ErrTransportUnavailable || sentTo != "" {
+		t.Errorf("Expected no fallback for a transient failure, got %v (sent to %q)", err, sentTo)
+	}
+	*emailFallbackOn = "failed"
+	if err := sendNotification(t.Context(), token, d); err != nil || sentTo == "" {
+		t.Errorf("Expected fallback with --email-fallback=failed, got %v", err)
+	}
+
+	// A failed email reports the push error
+	sendMail = func(context.Context, string, []byte) error { return errors.New("550 mailbox unavailable") }
+	pushErr = withCode(ErrTokenUnregistered, errors.New("gone"))
+	if err := sendNotification(t.Context(), token, d); errorCodeOf(err, "") != ErrTokenUnregistered {
+		t.Errorf("Expected push error after failed fallback, got %v", err)
+	}
+
+	token.EncryptedEmail = ""
+	if err := sendNotification(t.Context(), token, d); errorCodeOf(err, "") != ErrTokenUnregistered {
+		t.Errorf("Expected push error without a fallback address, got %v", err)
+	}
+
+	for address, code := range map[string]ErrorCode{
+		"user@example.com":           "",
+		"User <user@example.com>":    ErrInvalidSubscription,
+		"not an email":               ErrInvalidSubscription,
+		"user@example.com\r\nBcc: x": ErrInvalidSubscription,
+	} {
+		encrypted := apitest.EncryptToken(address)
+		if err := validateEncryptedEmail(encrypted); errorCodeOf(err, "") != code || (code == "") != (err == nil) {
+			t.Errorf("Email %q: expected %q, got %v", address, code, err)
+		}
+	}
+	*smtpAddr = ""
+	if err := validateEncryptedEmail(encryptedEmail); errorCodeOf(err, "") != ErrUnsupportedPlatform {
+		t.Errorf("Expected email to be refused with the fallback off, got %v", err)
+	}
+}
+
+func TestEmailSubjectInjection(t *testing.T) {
+	originalFrom := *smtpFrom
+	defer func() { *smtpFrom = originalFrom }()
+	*smtpFrom = "alerts@example.com"
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(emailMessage("user@example.com", "Hi\r\nBcc: victim@example.com", "body"))))
+	if err != nil {
+		t.Fatalf("Failed to parse email: %v", err)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("Title injected a header: %v", msg.Header)
+	}
+}
+
+func TestSendSMTP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// A minimal SMTP server that records the envelope and data
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var transcript strings.Builder
+		fmt.Fprint(conn, "220 test ESMTP\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO":
+				fmt.Fprint(conn, "250 test\r\n")
+			case "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				for {
+					data, _ := r.ReadString('\n')
+					transcript.WriteString(data)
+					if data == ".\r\n" {
+						break
+					}
+				}
+				fmt.Fprint(conn, "250 queued\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				received <- transcript.String()
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	originalAddr, originalFrom := *smtpAddr, *smtpFrom
+	defer func() { *smtpAddr, *smtpFrom = originalAddr, originalFrom }()
+	*smtpAddr, *smtpFrom = listener.Addr().String(), "alerts@example.com"
+
+	if err := sendSMTP(t.Context(), "user@example.com", []byte("Subject: hi\r\n\r\n.leading dot\r\n")); err != nil {
+		t.Fatalf("sendSMTP failed: %v", err)
+	}
+	transcript := <-received
+	for _, want := range []string{"MAIL FROM:<alerts@example.com>", "RCPT TO:<user@example.com>", "\r\n..leading dot\r\n"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("Expected %q in SMTP transcript:\n%s", want, transcript)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// fuzzKey is the key the fuzz targets decrypt with, made once per process.
+// 1024 bits keeps the RSA step, instrumented for coverage, fast enough to
+// fuzz; the framing is checked against whatever size the key has.
+var fuzzKey *rsa.PrivateKey
+
+// useFuzzKey loads fuzzKey as the server's private key for the fuzz target
+func useFuzzKey(f *testing.F) *rsa.PrivateKey {
+	f.Helper()
+	if fuzzKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			f.Fatalf("Failed to generate RSA key: %v", err)
+		}
+		fuzzKey = key
+	}
+	original := privateKey
+	privateKey = fuzzKey
+	f.Cleanup(func() { privateKey = original })
+	return fuzzKey
+}
+
+// fuzzSeeds are raw payloads in the client layout: valid ones of several
+// token lengths, with and without additional data, then each cut short,
+// padded, or with the key length field forged
+func fuzzSeeds(f *testing.F, key *rsa.PrivateKey) (payloads [][]byte, aads [][]byte) {
+	f.Helper()
+	for _, seed := range []struct {
+		token string
+		aad   []byte
+	}{
+		{"x", nil},
+		{"fcm-token:" + strings.Repeat("A", 152), nil},
+		{"https://push.example.com/send/abc", []byte("challenge-nonce")},
+		{strings.Repeat("t", 2000), nil},
+		{strings.Repeat("t", 2001), nil},
+	} {
+		encrypted, err := encryptHybridToken(seed.token, &key.PublicKey, seed.aad)
+		if err != nil {
+			f.Fatalf("Failed to encrypt seed: %v", err)
+		}
+		raw, _ := base64.StdEncoding.DecodeString(encrypted)
+		payloads = append(payloads, raw)
+		aads = append(aads, seed.aad)
+	}
+
+	valid := payloads[1]
+	for _, cut := range []int{0, 11, 12, 15, 16, 16 + key.Size() - 1, 16 + key.Size(), 16 + key.Size() + 15, len(valid) - 1} {
+		payloads = append(payloads, valid[:cut])
+		aads = append(aads, nil)
+	}
+	payloads = append(payloads, append(append([]byte{}, valid...), 0, 1, 2))
+	aads = append(aads, nil)
+	for _, keyLength := range []uint32{0, 1, uint32(key.Size()) - 1, uint32(key.Size()) + 1, 1 << 31, 0xffffffff} {
+		forged := append([]byte{}, valid...)
+		binary.BigEndian.PutUint32(forged[12:16], keyLength)
+		payloads = append(payloads, forged)
+		aads = append(aads, nil)
+	}
+	return payloads, aads
+}
+
+// FuzzDecryptHybridToken feeds encrypted_data strings, base64 or not, to the
+// parser. It must never panic, and may only return tokens within its limits.
+func FuzzDecryptHybridToken(f *testing.F) {
+	key := useFuzzKey(f)
+	payloads, aads := fuzzSeeds(f, key)
+	for i, raw := range payloads {
+		f.Add(base64.StdEncoding.EncodeToString(raw), aads[i])
+	}
+	f.Add("", []byte(nil))
+	f.Add(strings.Repeat("=", 200), []byte(nil))
+	f.Add(strings.Repeat("A", 10001), []byte(nil))
+	f.Add(base64.RawStdEncoding.EncodeToString(payloads[1]), []byte(nil))
+
+	f.Fuzz(func(t *testing.T, encryptedData string, aad []byte) {
+		if len(aad) == 0 {
+			aad = nil
+		}
+		token, err := decryptHybridTokenAAD(encryptedData, aad)
+		if err != nil {
+			if token != "" {
+				t.Errorf("Expected no token with an error, got %q", token)
+			}
+			return
+		}
+		if len(token) < 1 || len(token) > 2000 {
+			t.Errorf("Accepted a token of %d bytes", len(token))
+		}
+		if len(encryptedData) < 100 || len(encryptedData) > 10000 {
+			t.Errorf("Accepted encrypted_data of %d characters", len(encryptedData))
+		}
+	})
+}
+
+// FuzzHybridTokenFraming fuzzes the decoded payload, so the mutations land on
+// the IV, key length and ciphertext framing instead of on base64 syntax
+func FuzzHybridTokenFraming(f *testing.F) {
+	key := useFuzzKey(f)
+	payloads, _ := fuzzSeeds(f, key)
+	for _, raw := range payloads {
+		f.Add(raw)
+	}
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		token, err := decryptHybridToken(base64.StdEncoding.EncodeToString(raw))
+		if err != nil {
+			return
+		}
+		// Anything accepted holds an RSA-sized key and at least a GCM tag
+		if len(raw) < 16+key.Size()+16 {
+			t.Errorf("Accepted a %d byte payload, shorter than its framing", len(raw))
+		}
+		if keyLength := binary.BigEndian.Uint32(raw[12:16]); int(keyLength) != key.Size() {
+			t.Errorf("Accepted a key length of %d for a %d byte key", keyLength, key.Size())
+		}
+		if len(token) < 1 || len(token) > 2000 {
+			t.Errorf("Accepted a token of %d bytes", len(token))
+		}
+	})
+}
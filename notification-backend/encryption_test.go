@@ -1,79 +1,17 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/rsa"
 	"encoding/base64"
 	"strings"
 	"testing"
-)
-
-// Test helper to generate a test RSA key pair
-func generateTestRSAKeyPair(t *testing.T) (*rsa.PrivateKey, *rsa.PublicKey) {
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		t.Fatalf("Failed to generate RSA key pair: %v", err)
-	}
-	return privKey, &privKey.PublicKey
-}
-
-// Test helper to encrypt a token using the same hybrid encryption as Android
-func encryptTokenHybrid(token string, publicKey *rsa.PublicKey) (string, error) {
-	// Step 1: Generate random AES-256 key
-	aesKey := make([]byte, 32)
-	if _, err := rand.Read(aesKey); err != nil {
-		return "", err
-	}
-
-	// Step 2: Generate random IV for GCM
-	iv := make([]byte, 12)
-	if _, err := rand.Read(iv); err != nil {
-		return "", err
-	}
-
-	// Step 3: Encrypt token with AES-GCM
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	encryptedToken := gcm.Seal(nil, iv, []byte(token), nil)
-
-	// Step 4: Encrypt AES key with RSA
-	encryptedAESKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, aesKey)
-	if err != nil {
-		return "", err
-	}
-
-	// Step 5: Combine all parts: IV + key_length + encrypted_AES_key + encrypted_token
-	keyLength := len(encryptedAESKey)
-	keyLengthBytes := []byte{
-		byte(keyLength >> 24),
-		byte(keyLength >> 16),
-		byte(keyLength >> 8),
-		byte(keyLength),
-	}
 
-	combined := make([]byte, 0, 12+4+keyLength+len(encryptedToken))
-	combined = append(combined, iv...)
-	combined = append(combined, keyLengthBytes...)
-	combined = append(combined, encryptedAESKey...)
-	combined = append(combined, encryptedToken...)
-
-	return base64.StdEncoding.EncodeToString(combined), nil
-}
+	"remote-notification/api/apitest"
+)
 
 // Test basic encryption/decryption round-trip
 func TestHybridEncryptionRoundTrip(t *testing.T) {
-	// Generate test key pair
-	privKey, pubKey := generateTestRSAKeyPair(t)
+	// Use the shared test key pair
+	privKey := apitest.PrivateKey()
 
 	// Set global private key for decryption function
 	originalPrivateKey := privateKey
@@ -90,10 +28,7 @@ func TestHybridEncryptionRoundTrip(t *testing.T) {
 	for _, token := range testTokens {
 		t.Run("Token_"+token[:min(len(token), 20)], func(t *testing.T) {
 			// Encrypt
-			encrypted, err := encryptTokenHybrid(token, pubKey)
-			if err != nil {
-				t.Fatalf("Encryption failed: %v", err)
-			}
+			encrypted := apitest.EncryptToken(token)
 
 			// Decrypt
 			decrypted, err := decryptHybridToken(encrypted)
@@ -111,8 +46,8 @@ func TestHybridEncryptionRoundTrip(t *testing.T) {
 
 // Test AEAD corruption detection
 func TestAEADCorruptionDetection(t *testing.T) {
-	// Generate test key pair
-	privKey, pubKey := generateTestRSAKeyPair(t)
+	// Use the shared test key pair
+	privKey := apitest.PrivateKey()
 
 	// Set global private key for decryption function
 	originalPrivateKey := privateKey
@@ -122,10 +57,7 @@ func TestAEADCorruptionDetection(t *testing.T) {
 	testToken := "test_token_for_corruption"
 
 	// Encrypt token
-	encrypted, err := encryptTokenHybrid(testToken, pubKey)
-	if err != nil {
-		t.Fatalf("Encryption failed: %v", err)
-	}
+	encrypted := apitest.EncryptToken(testToken)
 
 	// Verify original decryption works
 	decrypted, err := decryptHybridToken(encrypted)
@@ -188,24 +120,20 @@ func TestAEADCorruptionDetection(t *testing.T) {
 
 // Test wrong private key
 func TestWrongPrivateKey(t *testing.T) {
-	// Generate two different key pairs
-	_, pubKey1 := generateTestRSAKeyPair(t)
-	privKey2, _ := generateTestRSAKeyPair(t)
+	// Encrypt to the test key, decrypt with the other one
+	privKey2 := apitest.OtherPrivateKey()
 
 	testToken := "test_token_for_wrong_key"
 
 	// Encrypt with first public key
-	encrypted, err := encryptTokenHybrid(testToken, pubKey1)
-	if err != nil {
-		t.Fatalf("Encryption failed: %v", err)
-	}
+	encrypted := apitest.EncryptToken(testToken)
 
 	// Try to decrypt with second private key - should fail
 	originalPrivateKey := privateKey
 	privateKey = privKey2
 	defer func() { privateKey = originalPrivateKey }()
 
-	_, err = decryptHybridToken(encrypted)
+	_, err := decryptHybridToken(encrypted)
 	if err == nil {
 		t.Error("Expected decryption to fail with wrong private key, but it succeeded")
 	} else {
@@ -215,8 +143,8 @@ func TestWrongPrivateKey(t *testing.T) {
 
 // Test malformed encrypted data
 func TestMalformedEncryptedData(t *testing.T) {
-	// Generate test key pair
-	privKey, _ := generateTestRSAKeyPair(t)
+	// Use the shared test key pair
+	privKey := apitest.PrivateKey()
 
 	// Set global private key for decryption function
 	originalPrivateKey := privateKey
@@ -271,8 +199,8 @@ func TestSecureMemoryWiping(t *testing.T) {
 
 // Test RSA key size validation
 func TestRSAKeySizeValidation(t *testing.T) {
-	// Generate test key pair
-	privKey, pubKey := generateTestRSAKeyPair(t)
+	// Use the shared test key pair
+	privKey := apitest.PrivateKey()
 
 	// Set global private key for decryption function
 	originalPrivateKey := privateKey
@@ -282,10 +210,7 @@ func TestRSAKeySizeValidation(t *testing.T) {
 	testToken := "test_token_for_key_size_validation"
 
 	// Encrypt with correct key
-	encrypted, err := encryptTokenHybrid(testToken, pubKey)
-	if err != nil {
-		t.Fatalf("Encryption failed: %v", err)
-	}
+	encrypted := apitest.EncryptToken(testToken)
 
 	// Verify original decryption works
 	decrypted, err := decryptHybridToken(encrypted)
@@ -327,8 +252,8 @@ func TestRSAKeySizeValidation(t *testing.T) {
 
 // Test input validation limits
 func TestInputValidationLimits(t *testing.T) {
-	// Generate test key pair
-	privKey, pubKey := generateTestRSAKeyPair(t)
+	// Use the shared test key pair
+	privKey := apitest.PrivateKey()
 
 	// Set global private key for decryption function
 	originalPrivateKey := privateKey
@@ -337,10 +262,7 @@ func TestInputValidationLimits(t *testing.T) {
 
 	// Test valid token first
 	validToken := "valid_test_token"
-	validEncrypted, err := encryptTokenHybrid(validToken, pubKey)
-	if err != nil {
-		t.Fatalf("Failed to encrypt valid token: %v", err)
-	}
+	validEncrypted := apitest.EncryptToken(validToken)
 
 	// Verify valid token works
 	decrypted, err := decryptHybridToken(validEncrypted)
@@ -386,8 +308,8 @@ func TestInputValidationLimits(t *testing.T) {
 
 // Test extreme token length validation
 func TestExtremeTokenLengths(t *testing.T) {
-	// Generate test key pair
-	privKey, pubKey := generateTestRSAKeyPair(t)
+	// Use the shared test key pair
+	privKey := apitest.PrivateKey()
 
 	// Set global private key for decryption function
 	originalPrivateKey := privateKey
@@ -421,10 +343,7 @@ func TestExtremeTokenLengths(t *testing.T) {
 			}
 
 			// Encrypt the test token
-			encrypted, err := encryptTokenHybrid(tc.token, pubKey)
-			if err != nil {
-				t.Fatalf("Failed to encrypt token for %s: %v", tc.name, err)
-			}
+			encrypted := apitest.EncryptToken(tc.token)
 
 			// Try to decrypt
 			decrypted, err := decryptHybridToken(encrypted)
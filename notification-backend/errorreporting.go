@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var (
+	// Error reporting configuration
+	sentryDSN           = flag.String("sentry-dsn", "", "Sentry-compatible DSN for error reporting (or SENTRY_DSN); empty disables it")
+	sentryEnvironment   = flag.String("sentry-environment", "production", "Environment name attached to reported errors")
+	fcmFailureThreshold = flag.Int("fcm-failure-threshold", 5, "Report FCM failures after this many consecutive errors")
+)
+
+// errorReportingEnabled records whether errors are being sent to Sentry
+var errorReportingEnabled bool
+
+// consecutiveFCMFailures counts FCM send errors since the last success
+var consecutiveFCMFailures atomic.Int64
+
+// setupErrorReporting initializes the Sentry client when a DSN is configured.
+// Only error messages and tags we set explicitly are sent; request bodies,
+// headers and client IPs are never attached. The returned function flushes
+// pending events before exit.
+func setupErrorReporting(dsn, environment string) (func(), error) {
+	if dsn == "" {
+		dsn = os.Getenv("SENTRY_DSN")
+	}
+	if dsn == "" {
+		return func() {}, nil
+	}
+
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		Environment:      environment,
+		Release:          "notification-backend@" + version,
+		AttachStacktrace: true,
+		SendDefaultPII:   false,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize error reporting: %v", err)
+	}
+	errorReportingEnabled = true
+
+	return func() { sentry.Flush(2 * time.Second) }, nil
+}
+
+// reportError sends err to the error reporter tagged with its kind and the
+// current request ID. Extra tags are given as key/value pairs. Errors caused
+// by the caller going away (client disconnect) are not reported.
+func reportError(ctx context.Context, kind string, err error, tags ...string) {
+	if !errorReportingEnabled || err == nil || ctx.Err() == context.Canceled {
+		return
+	}
+
+	hub := sentry.CurrentHub().Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("kind", kind)
+		if id := requestIDFromContext(ctx); id != "" {
+			scope.SetTag("request_id", id)
+		}
+		for i := 0; i+1 < len(tags); i += 2 {
+			scope.SetTag(tags[i], tags[i+1])
+		}
+		hub.CaptureException(err)
+	})
+}
+
+// reportFatal reports a startup failure and flushes, since fatal exits
+// without running deferred functions
+func reportFatal(msg string, args ...any) {
+	if !errorReportingEnabled {
+		return
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetTag("kind", "fatal")
+	hub.Scope().SetLevel(sentry.LevelFatal)
+	// Render the slog-style key/value pairs into the message
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	hub.CaptureMessage(b.String())
+	hub.Flush(2 * time.Second)
+}
+
+// recordFCMResult tracks consecutive FCM failures and reports once the
+// threshold is reached, then again every threshold failures, so an FCM outage
+// produces a handful of events instead of one per device
+func recordFCMResult(ctx context.Context, err error) {
+	if err == nil {
+		consecutiveFCMFailures.Store(0)
+		return
+	}
+
+	n := consecutiveFCMFailures.Add(1)
+	threshold := int64(*fcmFailureThreshold)
+	if threshold > 0 && n%threshold == 0 {
+		loggerFromContext(ctx).Error("Repeated FCM failures", "consecutive_failures", n, "error", err)
+		reportError(ctx, "fcm", fmt.Errorf("%d consecutive FCM failures, last: %v", n, err))
+	}
+}
+
+// serveWithRecovery runs a handler, turning a panic into a logged and reported
+// 500 instead of a stack trace on stderr and a dropped connection
+func serveWithRecovery(w *loggingResponseWriter, r *http.Request, next http.HandlerFunc) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			loggerFromContext(r.Context()).Error("Panic while handling request",
+				"panic", fmt.Sprint(rec),
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+			if errorReportingEnabled {
+				hub := sentry.CurrentHub().Clone()
+				hub.Scope().SetTag("kind", "panic")
+				hub.Scope().SetTag("path", r.URL.Path)
+				hub.Scope().SetTag("request_id", requestIDFromContext(r.Context()))
+				hub.RecoverWithContext(r.Context(), rec)
+			}
+			writeError(w, ErrInternal, "Internal server error")
+		}
+	}()
+	next(w, r)
+}
+
+// reportPanic is deferred at the top of background goroutines. It reports the
+// panic and flushes before re-panicking, since the process is about to exit.
+func reportPanic(goroutine string) {
+	if rec := recover(); rec != nil {
+		slog.Error("Panic in background goroutine", "goroutine", goroutine, "panic", fmt.Sprint(rec))
+		if errorReportingEnabled {
+			hub := sentry.CurrentHub().Clone()
+			hub.Scope().SetTag("kind", "panic")
+			hub.Scope().SetTag("goroutine", goroutine)
+			hub.Recover(rec)
+			hub.Flush(2 * time.Second)
+		}
+		panic(rec)
+	}
+}
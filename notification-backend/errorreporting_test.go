@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// recordingTransport captures events instead of sending them to Sentry
+type recordingTransport struct {
+	mu     sync.Mutex
+	events []*sentry.Event
+}
+
+func (t *recordingTransport) Configure(sentry.ClientOptions)        {}
+func (t *recordingTransport) Flush(time.Duration) bool              { return true }
+func (t *recordingTransport) FlushWithContext(context.Context) bool { return true }
+func (t *recordingTransport) Close()                                {}
+func (t *recordingTransport) SendEvent(event *sentry.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, event)
+}
+
+func (t *recordingTransport) Events() []*sentry.Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*sentry.Event(nil), t.events...)
+}
+
+// withRecordingReporter enables error reporting for the test with events captured locally
+func withRecordingReporter(t *testing.T) *recordingTransport {
+	transport := &recordingTransport{}
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:       "https://public@sentry.example.com/1",
+		Transport: transport,
+	}); err != nil {
+		t.Fatalf("Failed to initialize sentry: %v", err)
+	}
+	errorReportingEnabled = true
+	t.Cleanup(func() { errorReportingEnabled = false })
+	return transport
+}
+
+func TestPanicIsRecoveredAndReported(t *testing.T) {
+	transport := withRecordingReporter(t)
+
+	handler := loggingMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 after panic, got %d", rr.Code)
+	}
+
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 reported event, got %d", len(events))
+	}
+	if events[0].Tags["kind"] != "panic" || events[0].Tags["request_id"] != "req-123" {
+		t.Errorf("Unexpected tags on panic event: %v", events[0].Tags)
+	}
+}
+
+func TestRepeatedFCMFailuresAreReported(t *testing.T) {
+	transport := withRecordingReporter(t)
+	consecutiveFCMFailures.Store(0)
+
+	fcmErr := errors.New("unavailable")
+	for i := 0; i < *fcmFailureThreshold-1; i++ {
+		recordFCMResult(context.Background(), fcmErr)
+	}
+	if n := len(transport.Events()); n != 0 {
+		t.Fatalf("Expected no events below threshold, got %d", n)
+	}
+
+	recordFCMResult(context.Background(), fcmErr)
+	if n := len(transport.Events()); n != 1 {
+		t.Fatalf("Expected 1 event at threshold, got %d", n)
+	}
+
+	// A success resets the streak
+	recordFCMResult(context.Background(), nil)
+	recordFCMResult(context.Background(), fcmErr)
+	if n := len(transport.Events()); n != 1 {
+		t.Errorf("Expected failure count to reset after success, got %d events", n)
+	}
+}
+
+func TestReportErrorSkipsCanceledRequests(t *testing.T) {
+	transport := withRecordingReporter(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reportError(ctx, "storage", errors.New("context canceled"))
+
+	if n := len(transport.Events()); n != 0 {
+		t.Errorf("Expected canceled request not to be reported, got %d events", n)
+	}
+
+	reportError(context.Background(), "storage", errors.New("access denied"), "op", "PutObject")
+	events := transport.Events()
+	if len(events) != 1 || events[0].Tags["op"] != "PutObject" {
+		t.Errorf("Expected storage error with op tag, got %v", events)
+	}
+}
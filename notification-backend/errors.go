@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable identifier returned in every error
+// response. Clients branch on the code; the message is for humans and may change.
+type ErrorCode string
+
+const (
+	ErrMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrInvalidRequest       ErrorCode = "INVALID_REQUEST"        // body could not be read, or lists too many channels
+	ErrInvalidJSON          ErrorCode = "INVALID_JSON"           // body is not valid JSON
+	ErrInvalidProtobuf      ErrorCode = "INVALID_PROTOBUF"       // application/x-protobuf body does not decode
+	ErrMissingField         ErrorCode = "MISSING_FIELD"          // a required field is empty
+	ErrPayloadTooLarge      ErrorCode = "PAYLOAD_TOO_LARGE"      // body exceeds the size limit
+	ErrUnsupportedEncoding  ErrorCode = "UNSUPPORTED_ENCODING"   // Content-Encoding other than gzip
+	ErrInvalidEncryptedData ErrorCode = "INVALID_ENCRYPTED_DATA" // encrypted_data has an impossible length
+	ErrDecryptFailed        ErrorCode = "DECRYPT_FAILED"         // encrypted_data does not decrypt with our key
+	ErrInvalidFCMToken      ErrorCode = "INVALID_FCM_TOKEN"      // decrypted token is not a plausible FCM token
+	ErrInvalidSubscription  ErrorCode = "INVALID_SUBSCRIPTION"   // decrypted non-FCM address (Web Push subscription, ntfy topic, ...) is malformed
+	ErrInvalidPlatform      ErrorCode = "INVALID_PLATFORM"       // platform is not one this server knows
+	ErrUnsupportedPlatform  ErrorCode = "UNSUPPORTED_PLATFORM"   // platform's transport, or a fallback channel, is not configured on this server
+	ErrInvalidMessage       ErrorCode = "INVALID_MESSAGE"        // FCM message is malformed or sets its own target
+	ErrInvalidCondition     ErrorCode = "INVALID_CONDITION"      // topic condition does not parse or uses too many topics
+	ErrUnknownProject       ErrorCode = "UNKNOWN_PROJECT"        // firebase_project names no project configured on this server
+	ErrInvalidChallenge     ErrorCode = "INVALID_CHALLENGE"      // registration challenge is forged, expired or already used
+	ErrIdempotencyKeyReused ErrorCode = "IDEMPOTENCY_KEY_REUSED" // Idempotency-Key was sent with a different registration
+	ErrUnauthorized         ErrorCode = "UNAUTHORIZED"           // missing or wrong API key, device secret or notify secret
+	ErrIntegrityFailed      ErrorCode = "INTEGRITY_FAILED"       // Android registration lacks a valid Play Integrity token
+	ErrKeyMismatch          ErrorCode = "KEY_MISMATCH"           // public_key_hash names another key than the token was registered under
+	ErrEndpointDisabled     ErrorCode = "ENDPOINT_DISABLED"      // endpoint needs configuration to be enabled
+	ErrTokenNotFound        ErrorCode = "TOKEN_NOT_FOUND"        // opaque ID is unknown; callers should drop it
+	ErrTokenUnregistered    ErrorCode = "TOKEN_UNREGISTERED"     // FCM says the device token is gone; callers should drop it
+	ErrNoTokens             ErrorCode = "NO_TOKENS"              // broadcast with nothing registered
+	ErrJobNotFound          ErrorCode = "JOB_NOT_FOUND"          // broadcast job unknown or expired
+	ErrGroupNotFound        ErrorCode = "GROUP_NOT_FOUND"        // no device group by that name
+	ErrExperimentNotFound   ErrorCode = "EXPERIMENT_NOT_FOUND"   // no split send recorded under that name
+	ErrTemplateNotFound     ErrorCode = "TEMPLATE_NOT_FOUND"     // no notification template by that name
+	ErrStorageUnavailable   ErrorCode = "STORAGE_UNAVAILABLE"    // SOS or file storage failed
+	ErrFCMUnavailable       ErrorCode = "FCM_UNAVAILABLE"        // FCM rejected or did not answer the send
+	ErrTransportUnavailable ErrorCode = "TRANSPORT_UNAVAILABLE"  // a non-FCM delivery service failed or is not configured
+	ErrIntegrityUnavailable ErrorCode = "INTEGRITY_UNAVAILABLE"  // the Play Integrity API failed, so the registration could not be checked
+	ErrServerBusy           ErrorCode = "SERVER_BUSY"            // send pipeline saturated, see Retry-After
+	ErrInternal             ErrorCode = "INTERNAL_ERROR"
+)
+
+// errorStatus maps each code to its HTTP status. Statuses are the ones these
+// conditions already returned before codes existed, so older clients keep working.
+var errorStatus = map[ErrorCode]int{
+	ErrMethodNotAllowed:     http.StatusMethodNotAllowed,
+	ErrInvalidRequest:       http.StatusBadRequest,
+	ErrInvalidJSON:          http.StatusBadRequest,
+	ErrInvalidProtobuf:      http.StatusBadRequest,
+	ErrMissingField:         http.StatusBadRequest,
+	ErrPayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	ErrUnsupportedEncoding:  http.StatusUnsupportedMediaType,
+	ErrInvalidEncryptedData: http.StatusBadRequest,
+	ErrDecryptFailed:        http.StatusBadRequest,
+	ErrInvalidFCMToken:      http.StatusBadRequest,
+	ErrInvalidSubscription:  http.StatusBadRequest,
+	ErrInvalidPlatform:      http.StatusBadRequest,
+	ErrUnsupportedPlatform:  http.StatusBadRequest,
+	ErrInvalidMessage:       http.StatusBadRequest,
+	ErrInvalidCondition:     http.StatusBadRequest,
+	ErrUnknownProject:       http.StatusBadRequest,
+	ErrInvalidChallenge:     http.StatusBadRequest,
+	ErrIdempotencyKeyReused: http.StatusUnprocessableEntity,
+	ErrUnauthorized:         http.StatusUnauthorized,
+	ErrIntegrityFailed:      http.StatusForbidden,
+	ErrKeyMismatch:          http.StatusForbidden,
+	ErrEndpointDisabled:     http.StatusForbidden,
+	ErrTokenNotFound:        http.StatusBadRequest,
+	ErrTokenUnregistered:    http.StatusInternalServerError,
+	ErrNoTokens:             http.StatusBadRequest,
+	ErrJobNotFound:          http.StatusNotFound,
+	ErrGroupNotFound:        http.StatusNotFound,
+	ErrExperimentNotFound:   http.StatusNotFound,
+	ErrTemplateNotFound:     http.StatusNotFound,
+	ErrStorageUnavailable:   http.StatusInternalServerError,
+	ErrFCMUnavailable:       http.StatusInternalServerError,
+	ErrTransportUnavailable: http.StatusInternalServerError,
+	ErrIntegrityUnavailable: http.StatusInternalServerError,
+	ErrServerBusy:           http.StatusTooManyRequests,
+	ErrInternal:             http.StatusInternalServerError,
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Success bool      `json:"success" protobuf:"1"`
+	Code    ErrorCode `json:"code" protobuf:"2"`
+	Message string    `json:"message" protobuf:"3"`
+}
+
+// writeError sends an error response with the status belonging to code, in
+// protobuf when the handler negotiated it and JSON otherwise
+func writeError(w http.ResponseWriter, code ErrorCode, message string) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeResponse(w, status, ErrorResponse{Success: false, Code: code, Message: message})
+}
+
+// codedError attaches an ErrorCode to an error so handlers can report why
+// storage or FCM failed. It is returned directly rather than wrapped, since
+// the rest of the code formats causes with %v.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode tags err with code
+func withCode(code ErrorCode, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// errorCodeOf returns the code attached to err, or fallback if there is none
+func errorCodeOf(err error, fallback ErrorCode) ErrorCode {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return fallback
+}
+
+// readBodyError picks the code for a failed body read
+func readBodyError(err error) ErrorCode {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return ErrPayloadTooLarge
+	}
+	return ErrInvalidRequest
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"remote-notification/api"
+)
+
+// maxVariants bounds the buckets of one split send
+const maxVariants = 10
+
+// NotificationVariant is one bucket of a split send
+type NotificationVariant = api.NotificationVariant
+
+// VariantStats is a variant as recorded, with the outcome of its deliveries
+// summed over every send of the experiment
+type VariantStats struct {
+	Name       string `json:"name"`
+	Percent    int    `json:"percent"`
+	Title      string `json:"title"`
+	Body       string `json:"body"`
+	SentCount  int    `json:"sent_count"`
+	ErrorCount int    `json:"error_count"`
+}
+
+// Experiment records which registration received which variant of a split
+// send, for comparing open rates later
+type Experiment struct {
+	Name        string            `json:"name"`
+	Variants    []VariantStats    `json:"variants"`
+	Assignments map[string]string `json:"assignments"` // opaque ID -> variant name
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// ExperimentResponse is returned by GET /v1/experiments/{name}
+type ExperimentResponse struct {
+	Success    bool       `json:"success"`
+	Experiment Experiment `json:"experiment"`
+}
+
+func (e *Experiment) clone() Experiment {
+	c := *e
+	c.Variants = append([]VariantStats(nil), e.Variants...)
+	c.Assignments = make(map[string]string, len(e.Assignments))
+	for id, variant := range e.Assignments {
+		c.Assignments[id] = variant
+	}
+	return c
+}
+
+// validateVariants checks the buckets of a split send. Names follow the
+// group name rules, as they end up in URLs and object keys.
+func validateVariants(experiment string, variants []NotificationVariant) error {
+	if len(variants) == 0 {
+		if experiment != "" {
+			return withCode(ErrInvalidRequest, fmt.Errorf("experiment needs variants"))
+		}
+		return nil
+	}
+	if experiment == "" {
+		return withCode(ErrMissingField, fmt.Errorf("variants need an experiment name"))
+	}
+	if !namePattern.MatchString(experiment) {
+		return withCode(ErrInvalidRequest, fmt.Errorf("experiment names are 1-64 letters, digits, '.', '_' or '-'"))
+	}
+	if len(variants) < 2 || len(variants) > maxVariants {
+		return withCode(ErrInvalidRequest, fmt.Errorf("a split send has 2 to %d variants", maxVariants))
+	}
+	seen := make(map[string]bool, len(variants))
+	total := 0
+	for _, v := range variants {
+		if !namePattern.MatchString(v.Name) || seen[v.Name] {
+			return withCode(ErrInvalidRequest, fmt.Errorf("variant names must be unique letters, digits, '.', '_' or '-'"))
+		}
+		seen[v.Name] = true
+		if v.Title == "" || v.Body == "" {
+			return withCode(ErrMissingField, fmt.Errorf("variant %q needs a title and body", v.Name))
+		}
+		if v.Percent < 1 || v.Percent > 100 {
+			return withCode(ErrInvalidRequest, fmt.Errorf("variant %q must have a percent from 1 to 100", v.Name))
+		}
+		total += v.Percent
+	}
+	if total != 100 {
+		return withCode(ErrInvalidRequest, fmt.Errorf("variant percents add up to %d, not 100", total))
+	}
+	return nil
+}
+
+// variantFor picks a registration's bucket from a hash of the experiment and
+// opaque ID, so repeated sends of an experiment reach each device with the
+// same variant
+func variantFor(experiment, opaqueID string, variants []NotificationVariant) int {
+	sum := sha256.Sum256([]byte(experiment + "/" + opaqueID))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % 100)
+	for i, v := range variants {
+		if bucket < v.Percent {
+			return i
+		}
+		bucket -= v.Percent
+	}
+	return len(variants) - 1
+}
+
+// getExperiment retrieves an experiment from the appropriate storage
+func getExperiment(ctx context.Context, name string) (Experiment, error) {
+	if useExoscale {
+		return exoscaleStorage.GetExperiment(ctx, name)
+	}
+	return tokenStore.GetExperiment(name)
+}
+
+// updateExperiment applies update to an experiment in the appropriate
+// storage, creating it first when missing
+func updateExperiment(ctx context.Context, name string, update func(*Experiment)) (Experiment, error) {
+	if useExoscale {
+		return exoscaleStorage.UpdateExperiment(ctx, name, update)
+	}
+	return tokenStore.UpdateExperiment(name, update)
+}
+
+// sendSplit delivers each variant to its share of tokens and records the
+// assignments before sending, so the experiment is never missing a device
+// that was notified. It answers like a synchronous or streamed /v1/send.
+func sendSplit(w http.ResponseWriter, r *http.Request, tokens []*TokenStorageInfo, notif NotificationRequest) {
+	logger := loggerFromContext(r.Context()).With("experiment", notif.Experiment)
+	ctx := withLogger(r.Context(), logger)
+
+	buckets := make([][]*TokenStorageInfo, len(notif.Variants))
+	assignments := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		i := variantFor(notif.Experiment, token.OpaqueID, notif.Variants)
+		buckets[i] = append(buckets[i], token)
+		assignments[token.OpaqueID] = notif.Variants[i].Name
+	}
+
+	// Variants are matched by name, so a later send may change their wording or share
+	record := func(e *Experiment, sent, failed []int) {
+		for i, v := range notif.Variants {
+			j := slices.IndexFunc(e.Variants, func(s VariantStats) bool { return s.Name == v.Name })
+			if j < 0 {
+				j = len(e.Variants)
+				e.Variants = append(e.Variants, VariantStats{Name: v.Name})
+			}
+			stats := &e.Variants[j]
+			stats.Percent, stats.Title, stats.Body = v.Percent, v.Title, v.Body
+			stats.SentCount += sent[i]
+			stats.ErrorCount += failed[i]
+		}
+	}
+	sent, failed := make([]int, len(buckets)), make([]int, len(buckets))
+	if _, err := updateExperiment(ctx, notif.Experiment, func(e *Experiment) {
+		record(e, sent, failed)
+		for id, variant := range assignments {
+			e.Assignments[id] = variant
+		}
+	}); err != nil {
+		logger.Error("Failed to record experiment", "error", err)
+		writeError(w, errorCodeOf(err, ErrStorageUnavailable), "Failed to record experiment")
+		return
+	}
+
+	var progress *progressStream
+	if wantsNDJSON(r) {
+		progress = newProgressStream(w)
+	}
+	var successCount, errorCount int
+	for i, bucket := range buckets {
+		v := notif.Variants[i]
+		sent[i], failed[i] = broadcastTokens(ctx, bucket, delivery{Title: v.Title, Body: v.Body, Critical: notif.Critical}, progress.delivery)
+		successCount += sent[i]
+		errorCount += failed[i]
+		logger.Info("Variant sent", "variant", v.Name, "tokens", len(bucket), "sent", sent[i], "failed", failed[i])
+	}
+	if _, err := updateExperiment(ctx, notif.Experiment, func(e *Experiment) { record(e, sent, failed) }); err != nil {
+		logger.Error("Failed to record experiment results", "error", err)
+	}
+
+	response := SendResponse{
+		Success:     successCount > 0,
+		Message:     fmt.Sprintf("Sent %d variants to %d devices, %d failures", len(buckets), successCount, errorCount),
+		SentCount:   successCount,
+		ErrorCount:  errorCount,
+		TotalTokens: len(tokens),
+	}
+	if progress != nil {
+		progress.summary(response)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// handleGetExperiment returns an experiment with its per-device assignments.
+// It sits behind the raw API key, as it lists opaque IDs.
+func handleGetExperiment(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	name := r.PathValue("name")
+	experiment, err := getExperiment(r.Context(), name)
+	if err != nil {
+		code := errorCodeOf(err, ErrStorageUnavailable)
+		logger.Warn("Failed to get experiment", "experiment", name, "code", code, "error", err)
+		if code == ErrExperimentNotFound {
+			writeError(w, code, "Experiment not found")
+		} else {
+			writeError(w, code, "Failed to retrieve experiment")
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(ExperimentResponse{Success: true, Experiment: experiment}); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestVariantForIsStableAndProportional(t *testing.T) {
+	variants := []NotificationVariant{{Name: "a", Percent: 20}, {Name: "b", Percent: 80}}
+	counts := make([]int, len(variants))
+	for i := 0; i < 10000; i++ {
+		id := apitest.OpaqueID(i)
+		v := variantFor("exp", id, variants)
+		if again := variantFor("exp", id, variants); again != v {
+			t.Fatalf("Variant for %s changed from %d to %d", id, v, again)
+		}
+		counts[v]++
+	}
+	if counts[0] < 1800 || counts[0] > 2200 {
+		t.Errorf("Expected about 20%% in the first bucket, got %v", counts)
+	}
+}
+
+func TestSplitSend(t *testing.T) {
+	originalStore, originalExoscale, originalClient, originalKey := tokenStore, useExoscale, messagingClient, rawAPIKey
+	defer func() {
+		tokenStore, useExoscale, messagingClient, rawAPIKey = originalStore, originalExoscale, originalClient, originalKey
+	}()
+	storagePath := filepath.Join(t.TempDir(), "tokens.json")
+	tokenStore = NewDurableTokenStore(storagePath)
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+	rawAPIKey = "admin-key"
+
+	for i := 0; i < 20; i++ {
+		if _, err := tokenStore.AddToken("encrypted", "android"); err != nil {
+			t.Fatalf("AddToken failed: %v", err)
+		}
+	}
+
+	send := func(body string) (SendResponse, ErrorCode) {
+		rr := httptest.NewRecorder()
+		handleSend(rr, httptest.NewRequest("POST", "/v1/send", strings.NewReader(body)))
+		var resp SendResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return resp, errResp.Code
+	}
+	split := `{"experiment":"spring","variants":[{"name":"control","percent":50,"title":"A","body":"a"},{"name":"urgent","percent":50,"title":"B","body":"b"}]}`
+
+	for name, tc := range map[string]struct {
+		body string
+		want ErrorCode
+	}{
+		"no experiment":  {`{"variants":[{"name":"a","percent":50,"title":"A","body":"a"},{"name":"b","percent":50,"title":"B","body":"b"}]}`, ErrMissingField},
+		"bad total":      {`{"experiment":"x","variants":[{"name":"a","percent":50,"title":"A","body":"a"},{"name":"b","percent":40,"title":"B","body":"b"}]}`, ErrInvalidRequest},
+		"duplicate name": {`{"experiment":"x","variants":[{"name":"a","percent":50,"title":"A","body":"a"},{"name":"a","percent":50,"title":"B","body":"b"}]}`, ErrInvalidRequest},
+		"one variant":    {`{"experiment":"x","variants":[{"name":"a","percent":100,"title":"A","body":"a"}]}`, ErrInvalidRequest},
+		"no title":       {`{"experiment":"x","variants":[{"name":"a","percent":50,"body":"a"},{"name":"b","percent":50,"title":"B","body":"b"}]}`, ErrMissingField},
+		"local time":     {strings.Replace(split, `"experiment"`, `"local_time":"09:00","experiment"`, 1), ErrInvalidRequest},
+	} {
+		if _, code := send(tc.body); code != tc.want {
+			t.Errorf("%s: expected %s, got %s", name, tc.want, code)
+		}
+	}
+
+	if resp, code := send(split); resp.TotalTokens != 20 || resp.ErrorCount != 20 {
+		t.Fatalf("Expected all 20 devices attempted, got %+v %s", resp, code)
+	}
+	send(split)
+
+	// The record survives a restart and accumulates both sends
+	tokenStore = NewDurableTokenStore(storagePath)
+	get := func(name, key string) (int, ExperimentResponse, ErrorCode) {
+		req := httptest.NewRequest("GET", "/v1/experiments/"+name, nil)
+		req.SetPathValue("name", name)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		requireAPIKey(handleGetExperiment)(rr, req)
+		var resp ExperimentResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, resp, errResp.Code
+	}
+	if status, _, _ := get("spring", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected the experiment to need the API key, got %d", status)
+	}
+	if _, _, code := get("autumn", "admin-key"); code != ErrExperimentNotFound {
+		t.Errorf("Expected EXPERIMENT_NOT_FOUND, got %s", code)
+	}
+	_, resp, _ := get("spring", "admin-key")
+	experiment := resp.Experiment
+	if len(experiment.Assignments) != 20 || len(experiment.Variants) != 2 {
+		t.Fatalf("Expected 20 assignments over 2 variants, got %+v", experiment)
+	}
+	perVariant := make(map[string]int)
+	for id, variant := range experiment.Assignments {
+		if want := []string{"control", "urgent"}[variantFor("spring", id, []NotificationVariant{{Percent: 50}, {Percent: 50}})]; variant != want {
+			t.Errorf("Token %s recorded with %s, expected %s", id, variant, want)
+		}
+		perVariant[variant]++
+	}
+	for _, v := range experiment.Variants {
+		if v.ErrorCount != 2*perVariant[v.Name] || v.Title == "" {
+			t.Errorf("Variant %s: expected %d failures over two sends, got %+v", v.Name, 2*perVariant[v.Name], v)
+		}
+	}
+}
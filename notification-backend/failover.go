@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	sosFailoverThreshold = flag.Int("sos-failover-threshold", 3, "Register tokens in --storage-file after this many consecutive failed SOS writes, uploading them once SOS recovers (0 to fail registrations instead)")
+	sosReconcileInterval = flag.Duration("sos-reconcile-interval", 30*time.Second, "How often registrations kept in --storage-file during an SOS outage are uploaded")
+)
+
+var (
+	// consecutiveSOSFailures counts failed SOS writes since the last success
+	consecutiveSOSFailures atomic.Int64
+
+	// sosFailedOver is set while new registrations go to the file store
+	sosFailedOver atomic.Bool
+
+	// sosUploads counts registrations uploaded after an outage, published on
+	// the debug listener under /debug/vars
+	sosUploads = expvar.NewInt("sos_pending_uploads_reconciled")
+)
+
+// storeRegistration stores a new registration and returns its opaque ID. In
+// SOS mode, once --sos-failover-threshold writes in a row have failed, it is
+// kept in the file store instead until SOS takes writes again.
+func storeRegistration(ctx context.Context, reg TokenRegistration, notifySecretHash string) (string, error) {
+	if !useExoscale {
+		// Fallback to file-based storage, which assigns its own opaque ID
+		return tokenStore.AddRegistration(reg, notifySecretHash)
+	}
+
+	if !sosFailedOver.Load() {
+		opaqueID := exoscaleStorage.ids.NewID()
+		err := exoscaleStorage.StoreToken(ctx, opaqueID, reg, notifySecretHash)
+		recordSOSResult(ctx, err)
+		if err == nil {
+			return opaqueID, nil
+		}
+		if !sosFailedOver.Load() {
+			return "", err
+		}
+	}
+	return tokenStore.AddPendingUpload(reg, notifySecretHash)
+}
+
+// recordSOSResult tracks consecutive failed SOS writes, failing over to the
+// file store when they reach the threshold
+func recordSOSResult(ctx context.Context, err error) {
+	if err == nil {
+		consecutiveSOSFailures.Store(0)
+		return
+	}
+
+	n := consecutiveSOSFailures.Add(1)
+	threshold := int64(*sosFailoverThreshold)
+	if threshold > 0 && n >= threshold && sosFailedOver.CompareAndSwap(false, true) {
+		loggerFromContext(ctx).Error("SOS keeps failing, registering tokens in file storage until it recovers",
+			"consecutive_failures", n, "storage_file", *storageFile, "error", err)
+		reportError(ctx, "storage", fmt.Errorf("failed over to file storage after %d consecutive SOS failures, last: %v", n, err))
+	}
+}
+
+// withPendingUploads adds the registrations waiting for SOS to a listing of it
+func withPendingUploads(tokens []*TokenStorageInfo) []*TokenStorageInfo {
+	pending := tokenStore.PendingUploads()
+	if len(pending) == 0 {
+		return tokens
+	}
+	listed := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		listed[token.OpaqueID] = true
+	}
+	for _, mapping := range pending {
+		// An upload can land between the listing and now
+		if !listed[mapping.OpaqueID] {
+			tokens = append(tokens, mappingStorageInfo(mapping))
+		}
+	}
+	return tokens
+}
+
+// reconcilePendingUploads uploads the registrations kept in the file store
+// during an outage, and goes back to SOS for new registrations once it takes
+// writes again. It stops at the first failure, returning how many it uploaded.
+func reconcilePendingUploads(ctx context.Context) (int, error) {
+	uploaded := 0
+	for _, mapping := range tokenStore.PendingUploads() {
+		if err := exoscaleStorage.UploadToken(ctx, mappingStorageInfo(mapping)); err != nil {
+			recordSOSResult(ctx, err)
+			return uploaded, fmt.Errorf("failed to upload %s: %v", mapping.OpaqueID, err)
+		}
+		recordSOSResult(ctx, nil)
+
+		// Messages a poll device has not fetched yet follow it to SOS
+		latest, err := tokenStore.RemoveMapping(mapping.OpaqueID)
+		if err != nil {
+			slog.Warn("Failed to remove uploaded token from file storage", "token_id", mapping.OpaqueID, "error", err)
+		}
+		if latest.Pending != nil && len(latest.Pending.Messages) > 0 {
+			_, err := exoscaleStorage.UpdatePending(ctx, mapping.OpaqueID, func(q *pendingQueue) bool {
+				if q.LastSeq != 0 {
+					return false // the device already has a queue in SOS
+				}
+				*q = latest.Pending.clone()
+				return true
+			})
+			if err != nil {
+				slog.Warn("Failed to upload pending messages", "token_id", mapping.OpaqueID, "count", len(latest.Pending.Messages), "error", err)
+			}
+		}
+		sosUploads.Add(1)
+		uploaded++
+	}
+
+	// With nothing left to upload, a reachable bucket ends the failover
+	if sosFailedOver.Load() {
+		if err := exoscaleStorage.Probe(ctx); err != nil {
+			return uploaded, fmt.Errorf("SOS still unavailable: %v", err)
+		}
+		if sosFailedOver.CompareAndSwap(true, false) {
+			consecutiveSOSFailures.Store(0)
+			slog.Info("SOS recovered, registering tokens there again", "uploaded", uploaded)
+		}
+	}
+	return uploaded, nil
+}
+
+// startReconcileRoutine uploads pending registrations now, in case an outage
+// outlived the last run, and then every interval
+func startReconcileRoutine(interval time.Duration) {
+	defer reportPanic("sos reconcile")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		uploaded, err := reconcilePendingUploads(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("Pending uploads to SOS not finished", "uploaded", uploaded, "remaining", len(tokenStore.PendingUploads()), "error", err)
+		} else if uploaded > 0 {
+			slog.Info("Uploaded registrations kept during an SOS outage", "uploaded", uploaded)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+// useFailoverStorage switches the server to SOS on a fakeSOS whose writes
+// fail while the returned chaos has rate 1
+func useFailoverStorage(t *testing.T) (*storageChaos, *fakeSOS) {
+	t.Helper()
+	originalPrivateKey, originalHash, originalStore, originalExoscale, originalStorage, originalThreshold := privateKey, publicKeyHash, tokenStore, useExoscale, exoscaleStorage, *sosFailoverThreshold
+	t.Cleanup(func() {
+		privateKey, publicKeyHash, tokenStore, useExoscale, exoscaleStorage, *sosFailoverThreshold = originalPrivateKey, originalHash, originalStore, originalExoscale, originalStorage, originalThreshold
+		sosFailedOver.Store(false)
+		consecutiveSOSFailures.Store(0)
+	})
+	privateKey, publicKeyHash = apitest.PrivateKey(), apitest.PublicKeyHash()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = true
+	*sosFailoverThreshold = 3
+	sosFailedOver.Store(false)
+	consecutiveSOSFailures.Store(0)
+
+	chaos, err := newStorageChaos(1, "ServiceUnavailable", "PutObject", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sos *fakeSOS
+	exoscaleStorage, sos = newFakeSOSStorage(t, chaos)
+	return chaos, sos
+}
+
+// registerToken posts a registration, returning the status and opaque ID
+func registerToken(t *testing.T, token string) (int, string) {
+	t.Helper()
+	body, _ := json.Marshal(TokenRegistration{EncryptedData: apitest.EncryptToken(token), Platform: "android"})
+	rr := httptest.NewRecorder()
+	handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+	var reg RegisterResponse
+	json.Unmarshal(rr.Body.Bytes(), &reg)
+	return rr.Code, reg.TokenID
+}
+
+func TestSOSFailover(t *testing.T) {
+	chaos, sos := useFailoverStorage(t)
+	ctx := context.Background()
+	chaos.rate = 1
+
+	// Below the threshold a failed write fails the registration, as before
+	for i := range 2 {
+		if status, _ := registerToken(t, apitest.FCMToken(1)); status != http.StatusInternalServerError {
+			t.Fatalf("Registration %d: expected 500 while under the threshold, got %d", i+1, status)
+		}
+	}
+	if sosFailedOver.Load() {
+		t.Fatal("Expected no failover after 2 failures")
+	}
+
+	// The third failure switches to the file store, this registration included
+	var ids []string
+	for _, token := range []string{apitest.FCMToken(2), apitest.FCMToken(3)} {
+		status, id := registerToken(t, token)
+		if status != http.StatusOK || id == "" {
+			t.Fatalf("Expected the registration kept in file storage, got %d", status)
+		}
+		ids = append(ids, id)
+	}
+	if !sosFailedOver.Load() || len(tokenStore.PendingUploads()) != 2 || len(sos.objects) != 0 {
+		t.Fatalf("Expected 2 pending uploads and nothing in SOS, got %d and %d", len(tokenStore.PendingUploads()), len(sos.objects))
+	}
+
+	// Pending registrations are served from the file store
+	info, err := getToken(ctx, ids[0])
+	if err != nil || info.EncryptedData != apitest.EncryptToken(apitest.FCMToken(2)) {
+		t.Errorf("Expected the pending registration, got %+v, %v", info, err)
+	}
+	if tokens, err := getAllTokens(ctx); err != nil || len(tokens) != 2 {
+		t.Errorf("Expected the pending registrations listed, got %d: %v", len(tokens), err)
+	}
+	rr := httptest.NewRecorder()
+	handleStatus(rr, httptest.NewRequest("GET", "/v1/status", nil))
+	var status struct {
+		StorageType    string `json:"storage_type"`
+		PendingUploads int    `json:"pending_uploads"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	if status.PendingUploads != 2 || !strings.HasPrefix(status.StorageType, "Local file") {
+		t.Errorf("Expected the status to show the failover, got %+v", status)
+	}
+
+	// While SOS still fails nothing is uploaded
+	if uploaded, err := reconcilePendingUploads(ctx); err == nil || uploaded != 0 {
+		t.Errorf("Expected the upload to fail, got %d, %v", uploaded, err)
+	}
+
+	// Once it recovers the registrations move there, with their opaque IDs
+	chaos.rate = 0
+	if uploaded, err := reconcilePendingUploads(ctx); err != nil || uploaded != 2 {
+		t.Fatalf("Expected 2 uploads, got %d, %v", uploaded, err)
+	}
+	if sosFailedOver.Load() || len(tokenStore.PendingUploads()) != 0 || tokenStore.Count() != 0 {
+		t.Errorf("Expected the failover over and the file store empty, got %d left", tokenStore.Count())
+	}
+	for _, id := range ids {
+		if _, ok := sos.objects[apitest.PublicKeyHash()+"/"+id]; !ok {
+			t.Errorf("Expected %s uploaded to SOS", id)
+		}
+	}
+
+	// New registrations go to SOS again
+	if status, id := registerToken(t, apitest.FCMToken(4)); status != http.StatusOK || sos.objects[apitest.PublicKeyHash()+"/"+id] == nil {
+		t.Errorf("Expected the registration stored in SOS, got %d", status)
+	}
+}
+
+func TestSOSFailoverDisabled(t *testing.T) {
+	chaos, _ := useFailoverStorage(t)
+	*sosFailoverThreshold = 0
+	chaos.rate = 1
+
+	for i := range 5 {
+		if status, _ := registerToken(t, apitest.FCMToken(1)); status != http.StatusInternalServerError {
+			t.Fatalf("Registration %d: expected 500 with failover off, got %d", i+1, status)
+		}
+	}
+	if sosFailedOver.Load() || tokenStore.Count() != 0 {
+		t.Errorf("Expected nothing kept in file storage, got %d", tokenStore.Count())
+	}
+}
+
+func TestSOSFailoverKeepsPendingMessages(t *testing.T) {
+	chaos, _ := useFailoverStorage(t)
+	ctx := context.Background()
+	chaos.rate = 1
+	sosFailedOver.Store(true)
+
+	id, err := storeRegistration(ctx, TokenRegistration{EncryptedData: apitest.EncryptToken("poll-device"), Platform: "poll"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updatePending(ctx, id, func(q *pendingQueue) bool {
+		q.LastSeq++
+		q.Messages = append(q.Messages, PendingMessage{Seq: q.LastSeq, Title: "Queued during the outage"})
+		return true
+	}); err != nil {
+		t.Fatalf("Expected the message queued in file storage, got %v", err)
+	}
+
+	chaos.rate = 0
+	if _, err := reconcilePendingUploads(ctx); err != nil {
+		t.Fatal(err)
+	}
+	q, err := updatePending(ctx, id, func(*pendingQueue) bool { return false })
+	if err != nil || len(q.Messages) != 1 || q.Messages[0].Title != "Queued during the outage" {
+		t.Errorf("Expected the queued message in SOS, got %+v, %v", q, err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+var fcmBatchSize = flag.Int("fcm-batch-size", maxFCMBatchSize, "FCM registrations a broadcast sends with one batch call, at most 500 (1 sends to each on its own)")
+
+// maxFCMBatchSize is the most messages FCM takes in one SendEach call
+const maxFCMBatchSize = 500
+
+// broadcastBatch is the work a broadcast worker takes at a time: FCM
+// registrations of one Firebase project sent with one SendEach call, or a
+// single registration sent through sendNotification
+type broadcastBatch struct {
+	tokens []*TokenStorageInfo
+	fcm    bool
+}
+
+// broadcastBatches splits a broadcast into batches of --fcm-batch-size FCM
+// registrations per Firebase project. Registrations with failover channels
+// or in their quiet hours are sent on their own, as are all other platforms.
+func broadcastBatches(tokens []*TokenStorageInfo, d delivery) []broadcastBatch {
+	size := min(*fcmBatchSize, maxFCMBatchSize)
+	now := time.Now()
+	var batches []broadcastBatch
+	filling := make(map[string]int) // Firebase project to the index of its batch being filled
+	for _, token := range tokens {
+		if size <= 1 || !fcmBatchable(token, d, now) {
+			batches = append(batches, broadcastBatch{tokens: []*TokenStorageInfo{token}})
+			continue
+		}
+		i, ok := filling[token.FirebaseProject]
+		if !ok || len(batches[i].tokens) == size {
+			i = len(batches)
+			filling[token.FirebaseProject] = i
+			batches = append(batches, broadcastBatch{fcm: true})
+		}
+		batches[i].tokens = append(batches[i].tokens, token)
+	}
+	return batches
+}
+
+// fcmBatchable reports whether sending d to token takes nothing but one FCM message
+func fcmBatchable(token *TokenStorageInfo, d delivery, now time.Time) bool {
+	if transportFor(token.Platform) != fcmTransport || len(token.Channels) > 0 {
+		return false
+	}
+	_, quiet := token.quietUntil(now)
+	return !quiet || d.Critical || d.Released
+}
+
+// send delivers d to the batch, returning each registration's error in order.
+// An FCM registration whose message failed still gets the fallback channels.
+func (b broadcastBatch) send(ctx context.Context, d delivery) []error {
+	if !b.fcm {
+		return []error{sendNotification(ctx, b.tokens[0], d)}
+	}
+	errs := sendFCMBatch(ctx, b.tokens, d)
+	for i, token := range b.tokens {
+		if errs[i] != nil {
+			d.OpaqueID, d.FirebaseProject = token.OpaqueID, token.FirebaseProject
+			errs[i] = sendFallback(ctx, token, d, errs[i])
+		}
+	}
+	return errs
+}
+
+// sendFCMBatch decrypts the tokens of one Firebase project's registrations
+// and sends them d with one SendEach call, returning each one's error in order
+func sendFCMBatch(ctx context.Context, tokens []*TokenStorageInfo, d delivery) []error {
+	errs := make([]error, len(tokens))
+	if err := fcmTransport.ready(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	messages := make([]*messaging.Message, 0, len(tokens))
+	sent := make([]int, 0, len(tokens)) // index in tokens of each message
+	for i, token := range tokens {
+		address, err := decryptFCMToken(token.EncryptedData)
+		if err != nil {
+			errs[i] = withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt token: %v", err))
+			continue
+		}
+		// Wipe the decrypted addresses once FCM has answered for the batch
+		defer secureWipeString(&address)
+
+		message := fcmNotificationMessage(address, d.Title, d.Body)
+		if d.Priority != "" {
+			message.Android.Priority = d.Priority
+		}
+		messages = append(messages, message)
+		sent = append(sent, i)
+	}
+	if len(messages) == 0 {
+		return errs
+	}
+
+	for j, err := range deliverFCMBatch(ctx, tokens[0].FirebaseProject, messages) {
+		errs[sent[j]] = err
+	}
+	return errs
+}
+
+// deliverFCMBatch sends messages through the client for project with one
+// SendEach call, classifying each message's error as deliverFCM does
+func deliverFCMBatch(ctx context.Context, project string, messages []*messaging.Message) []error {
+	errs := make([]error, len(messages))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	client, err := fcmClientFor(project)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, span := startSpan(ctx, "fcm.send_each")
+	sendCtx, cancel := context.WithTimeout(ctx, *fcmTimeout)
+	batch, err := client.SendEach(sendCtx, messages)
+	cancel()
+	endSpan(span, err)
+	if err != nil {
+		return fail(fcmError(ctx, err))
+	}
+
+	for i := range messages {
+		switch {
+		case i >= len(batch.Responses):
+			errs[i] = withCode(ErrFCMUnavailable, fmt.Errorf("FCM answered %d of %d messages", len(batch.Responses), len(messages)))
+		case batch.Responses[i].Success:
+			recordFCMResult(ctx, nil)
+		default:
+			errs[i] = fcmError(ctx, batch.Responses[i].Error)
+		}
+	}
+	loggerFromContext(ctx).Debug("Sent FCM batch", "messages", len(messages), "success", batch.SuccessCount, "failure", batch.FailureCount)
+	return errs
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestBroadcastBatches(t *testing.T) {
+	originalSize := *fcmBatchSize
+	defer func() { *fcmBatchSize = originalSize }()
+	*fcmBatchSize = 2
+
+	token := func(n int, platform, project string) *TokenStorageInfo {
+		return &TokenStorageInfo{OpaqueID: apitest.OpaqueID(n), Platform: platform, FirebaseProject: project}
+	}
+	withChannel := token(5, "android", "")
+	withChannel.Channels = []ChannelRegistration{{Platform: "ntfy"}}
+	tokens := []*TokenStorageInfo{
+		token(0, "android", ""),
+		token(1, "ios", "eu"),
+		token(2, "ntfy", ""),
+		token(3, "ios", ""),
+		token(4, "android", ""),
+		withChannel,
+		token(6, "android", "eu"),
+	}
+
+	// Batches are per project and of at most 2; the topic and the
+	// registration with a failover channel go on their own
+	var got [][]int
+	var gotFCM []bool
+	for _, b := range broadcastBatches(tokens, delivery{}) {
+		var ns []int
+		for _, token := range b.tokens {
+			ns = append(ns, slices.Index(tokens, token))
+		}
+		got, gotFCM = append(got, ns), append(gotFCM, b.fcm)
+	}
+	want, wantFCM := [][]int{{0, 3}, {1, 6}, {2}, {4}, {5}}, []bool{true, true, false, true, false}
+	if !slices.EqualFunc(got, want, slices.Equal) || !slices.Equal(gotFCM, wantFCM) {
+		t.Errorf("Expected batches %v sent with SendEach %v, got %v and %v", want, wantFCM, got, gotFCM)
+	}
+
+	*fcmBatchSize = 1
+	if batches := broadcastBatches(tokens, delivery{}); len(batches) != len(tokens) || batches[0].fcm {
+		t.Errorf("Expected every registration sent on its own, got %d batches", len(batches))
+	}
+}
+
+func TestBroadcastThroughSendEach(t *testing.T) {
+	originalPrivateKey, originalClient, originalSize := privateKey, messagingClient, *fcmBatchSize
+	defer func() {
+		privateKey, messagingClient, *fcmBatchSize = originalPrivateKey, originalClient, originalSize
+	}()
+	privateKey = apitest.PrivateKey()
+	*fcmBatchSize = 3
+	fake := &fakeMessenger{refused: map[string]bool{apitest.FCMToken(4): true}}
+	messagingClient = fake
+
+	var tokens []*TokenStorageInfo
+	for i := range 7 {
+		tokens = append(tokens, &TokenStorageInfo{OpaqueID: apitest.OpaqueID(i), EncryptedData: apitest.EncryptToken(apitest.FCMToken(i)), Platform: "android"})
+	}
+	tokens[6].EncryptedData = apitest.EncryptTokenTo(&apitest.OtherPrivateKey().PublicKey, apitest.FCMToken(6), nil)
+
+	// Each message's outcome goes to its own opaque ID
+	codes := make(map[string]ErrorCode)
+	sent, failed := broadcastTokens(context.Background(), tokens, delivery{Title: "Hello", Body: "Everyone"}, func(opaqueID string, err error) {
+		codes[opaqueID] = errorCodeOf(err, "")
+	})
+	if sent != 5 || failed != 2 {
+		t.Errorf("Expected 5 sent and 2 failed, got %d and %d", sent, failed)
+	}
+	if codes[apitest.OpaqueID(4)] != ErrFCMUnavailable || codes[apitest.OpaqueID(6)] != ErrDecryptFailed || codes[apitest.OpaqueID(0)] != "" {
+		t.Errorf("Expected the refused and undecryptable tokens failed, got %v", codes)
+	}
+
+	// The token that does not decrypt is left out, and its batch of one never sent
+	if want := []int{3, 3}; !slices.Equal(fake.batches, want) {
+		t.Errorf("Expected SendEach calls of %v messages, got %v", want, fake.batches)
+	}
+	var delivered []string
+	for _, m := range fake.sent {
+		delivered = append(delivered, m.Token)
+		if m.Notification.Title != "Hello" || m.Android.Priority != "high" {
+			t.Errorf("Expected the broadcast notification, got %+v", m)
+		}
+	}
+	for _, i := range []int{0, 1, 2, 3, 5} {
+		if !slices.Contains(delivered, apitest.FCMToken(i)) {
+			t.Errorf("Expected a message to token %d", i)
+		}
+	}
+
+	// An FCM outage fails each registration of the batch
+	fake.refused, fake.err = nil, errors.New("unavailable")
+	codes = make(map[string]ErrorCode)
+	if sent, failed := broadcastTokens(context.Background(), tokens[:3], delivery{Title: "Hello", Body: "Everyone"}, func(opaqueID string, err error) {
+		codes[opaqueID] = errorCodeOf(err, "")
+	}); sent != 0 || failed != 3 || codes[apitest.OpaqueID(2)] != ErrFCMUnavailable {
+		t.Errorf("Expected all 3 failed as FCM_UNAVAILABLE, got %d sent, %v", sent, codes)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+var (
+	firebaseProjectsFile = flag.String("firebase-projects", "", "JSON file mapping project labels to further Firebase service account key files, picked per registration with firebase_project")
+	fcmEndpoint          = flag.String("fcm-endpoint", "", "Base URL of the FCM v1 API, such as a local fake for end-to-end tests; empty is Google's")
+	firebaseProjectID    = flag.String("firebase-project-id", "", "Firebase project ID of --firebase-key; defaults to the key's project_id, or for Application Default Credentials to their project or GOOGLE_CLOUD_PROJECT")
+)
+
+// firebaseScopes are requested for keys and user credentials; workload identity ignores them
+var firebaseScopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/firebase.messaging",
+}
+
+// Messenger is the part of the Firebase messaging client that sends go
+// through, so tests can stand in for FCM
+type Messenger interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+	SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error)
+	SendDryRun(ctx context.Context, message *messaging.Message) (string, error)
+}
+
+var _ Messenger = (*messaging.Client)(nil)
+
+// fcmProjects holds the messaging client of each labelled project from
+// --firebase-projects. Registrations without a label use messagingClient.
+var fcmProjects = map[string]Messenger{}
+
+// firebaseProjectLabelPattern keeps labels short and safe to log
+var firebaseProjectLabelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// googleCredentials loads a service account key file, or Application Default
+// Credentials when keyPath is empty: GOOGLE_APPLICATION_CREDENTIALS, gcloud's
+// login, or the GCE/GKE metadata server with workload identity
+func googleCredentials(ctx context.Context, keyPath string, scopes ...string) (*google.Credentials, error) {
+	if keyPath == "" {
+		creds, err := google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find Application Default Credentials: %v", err)
+		}
+		return creds, nil
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file: %v", err)
+	}
+	return creds, nil
+}
+
+// firebaseProjectOf picks the project to send through: projectID when set,
+// then the credentials' own project, then the environment as the SDK does
+func firebaseProjectOf(creds *google.Credentials, projectID string) (string, error) {
+	if projectID == "" {
+		projectID = creds.ProjectID
+	}
+	if projectID == "" {
+		projectID = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if projectID == "" {
+		return "", fmt.Errorf("credentials name no project; set --firebase-project-id or GOOGLE_CLOUD_PROJECT")
+	}
+	return projectID, nil
+}
+
+// newMessagingClient initializes the Admin SDK with a service account key, or
+// Application Default Credentials when keyPath is empty, and returns its
+// messaging client and project ID. projectID overrides the credentials' project.
+func newMessagingClient(ctx context.Context, keyPath, projectID string) (Messenger, string, error) {
+	creds, err := googleCredentials(ctx, keyPath, firebaseScopes...)
+	if err != nil {
+		return nil, "", err
+	}
+	projectID, err = firebaseProjectOf(creds, projectID)
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Info("Using Firebase project", "project_id", projectID, "adc", keyPath == "")
+
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: projectID}, firebaseOptions(creds)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("error initializing Firebase app: %v", err)
+	}
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting Messaging client: %v", err)
+	}
+	return client, projectID, nil
+}
+
+// firebaseOptions are the Admin SDK options for creds, sending to
+// --fcm-endpoint when set
+func firebaseOptions(creds *google.Credentials) []option.ClientOption {
+	opts := []option.ClientOption{option.WithCredentials(creds)}
+	if *fcmEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(strings.TrimSuffix(*fcmEndpoint, "/")))
+	}
+	return opts
+}
+
+// loadFirebaseProjects reads a {"label": "/path/to/key.json"} map
+func loadFirebaseProjects(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Firebase projects file: %v", err)
+	}
+	var projects map[string]string
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return nil, fmt.Errorf("failed to parse Firebase projects file: %v", err)
+	}
+	for label, keyPath := range projects {
+		if !firebaseProjectLabelPattern.MatchString(label) {
+			return nil, fmt.Errorf("Firebase project label %q must be lowercase letters, digits, '-' or '_'", label)
+		}
+		if keyPath == "" {
+			return nil, fmt.Errorf("Firebase project %q has no key file", label)
+		}
+	}
+	return projects, nil
+}
+
+// setupFirebaseProjects initializes a messaging client per labelled project
+func setupFirebaseProjects(ctx context.Context, path string) error {
+	if path == "" {
+		return nil
+	}
+	projects, err := loadFirebaseProjects(path)
+	if err != nil {
+		return err
+	}
+	clients := make(map[string]Messenger, len(projects))
+	for label, keyPath := range projects {
+		client, projectID, err := newMessagingClient(ctx, keyPath, "")
+		if err != nil {
+			return fmt.Errorf("project %q: %v", label, err)
+		}
+		clients[label] = client
+		slog.Info("Firebase project initialized", "label", label, "project_id", projectID)
+	}
+	fcmProjects = clients
+	return nil
+}
+
+// firebaseProjectLabels lists the configured labels in order, for logs and probes
+func firebaseProjectLabels() []string {
+	labels := make([]string, 0, len(fcmProjects))
+	for label := range fcmProjects {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// validateFirebaseProject checks a registration's project label is configured here
+func validateFirebaseProject(label string) error {
+	if _, ok := fcmProjects[label]; label != "" && !ok {
+		return withCode(ErrUnknownProject, fmt.Errorf("Firebase project %q is not configured on this server", label))
+	}
+	return nil
+}
+
+// fcmClientFor returns the messaging client of a project label, where ""
+// is the --firebase-key project
+func fcmClientFor(label string) (Messenger, error) {
+	if label == "" {
+		if messagingClient == nil {
+			return nil, withCode(ErrFCMUnavailable, fmt.Errorf("firebase messaging client not initialized"))
+		}
+		return messagingClient, nil
+	}
+	client, ok := fcmProjects[label]
+	if !ok {
+		return nil, withCode(ErrUnknownProject, fmt.Errorf("Firebase project %q is not configured on this server", label))
+	}
+	return client, nil
+}
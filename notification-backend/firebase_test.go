@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"remote-notification/api/apitest"
+)
+
+// writeServiceAccountKey writes a syntactically valid key for projectID; it
+// initializes the SDK but cannot obtain an access token
+func writeServiceAccountKey(t *testing.T, dir, projectID string) string {
+	privKey := apitest.PrivateKey()
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	key, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   projectID,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "sender@" + projectID + ".iam.gserviceaccount.com",
+		"token_uri":    "https://oauth2.googleapis.com/token",
+	})
+	path := filepath.Join(dir, projectID+".json")
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+func TestSetupFirebaseProjects(t *testing.T) {
+	originalProjects := fcmProjects
+	defer func() { fcmProjects = originalProjects }()
+
+	dir := t.TempDir()
+	writeProjects := func(projects map[string]string) string {
+		data, _ := json.Marshal(projects)
+		path := filepath.Join(dir, "projects.json")
+		os.WriteFile(path, data, 0600)
+		return path
+	}
+
+	for name, projects := range map[string]map[string]string{
+		"bad label":   {"Staging!": writeServiceAccountKey(t, dir, "bad-label")},
+		"missing key": {"staging": filepath.Join(dir, "missing.json")},
+		"no key":      {"staging": ""},
+	} {
+		if err := setupFirebaseProjects(t.Context(), writeProjects(projects)); err == nil {
+			t.Errorf("%s: expected setup to fail", name)
+		}
+	}
+
+	path := writeProjects(map[string]string{"staging": writeServiceAccountKey(t, dir, "app-staging")})
+	if err := setupFirebaseProjects(t.Context(), path); err != nil {
+		t.Fatalf("Expected setup to succeed, got %v", err)
+	}
+	if labels := firebaseProjectLabels(); len(labels) != 1 || labels[0] != "staging" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if client, err := fcmClientFor("staging"); err != nil || client != fcmProjects["staging"] {
+		t.Errorf("Expected the staging client, got %v", err)
+	}
+	if _, err := fcmClientFor("prod"); errorCodeOf(err, "") != ErrUnknownProject {
+		t.Errorf("Expected UNKNOWN_PROJECT, got %v", err)
+	}
+	if err := validateFirebaseProject(""); err != nil {
+		t.Errorf("Expected the default project to be valid, got %v", err)
+	}
+}
+
+func TestRegisterFirebaseProject(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalProjects := privateKey, fcmProjects
+	originalStore, originalExoscale := tokenStore, useExoscale
+	defer func() {
+		privateKey, fcmProjects = originalPrivateKey, originalProjects
+		tokenStore, useExoscale = originalStore, originalExoscale
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	fcmProjects = map[string]Messenger{"staging": nil}
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+	register := func(project string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android", FirebaseProject: project})
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		return rr
+	}
+
+	rr := register("prod")
+	var errResp ErrorResponse
+	json.Unmarshal(rr.Body.Bytes(), &errResp)
+	if rr.Code != http.StatusBadRequest || errResp.Code != ErrUnknownProject {
+		t.Errorf("Expected 400 UNKNOWN_PROJECT, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = register("staging")
+	var resp RegisterResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	token, err := getToken(t.Context(), resp.TokenID)
+	if err != nil {
+		t.Fatalf("Registered token not found (%q): %v", rr.Body.String(), err)
+	}
+	if token.FirebaseProject != "staging" {
+		t.Errorf("Expected project label to be stored, got %q", token.FirebaseProject)
+	}
+}
+
+func TestFirebaseDefaultCredentials(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := writeServiceAccountKey(t, dir, "app-prod")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyPath)
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+
+	// An empty key path falls back to Application Default Credentials
+	if _, projectID, err := newMessagingClient(t.Context(), "", ""); err != nil || projectID != "app-prod" {
+		t.Fatalf("Expected ADC for app-prod, got %q, %v", projectID, err)
+	}
+	if _, projectID, err := newMessagingClient(t.Context(), "", "app-other"); err != nil || projectID != "app-other" {
+		t.Errorf("Expected --firebase-project-id to win, got %q, %v", projectID, err)
+	}
+
+	// Credentials without a project need it from the environment
+	var key map[string]string
+	data, _ := os.ReadFile(keyPath)
+	json.Unmarshal(data, &key)
+	delete(key, "project_id")
+	data, _ = json.Marshal(key)
+	os.WriteFile(keyPath, data, 0600)
+	if _, _, err := newMessagingClient(t.Context(), "", ""); err == nil {
+		t.Error("Expected an error without any project ID")
+	}
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "app-env")
+	if _, projectID, err := newMessagingClient(t.Context(), "", ""); err != nil || projectID != "app-env" {
+		t.Errorf("Expected GOOGLE_CLOUD_PROJECT, got %q, %v", projectID, err)
+	}
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(dir, "missing.json"))
+	if _, _, err := newMessagingClient(t.Context(), "", ""); err == nil {
+		t.Error("Expected an error for missing default credentials")
+	}
+}
+
+// fakeMessenger stands in for FCM, keeping a copy of every message it takes
+// and the size of every batch, failing them all with err when set and those
+// to refused tokens
+type fakeMessenger struct {
+	mu      sync.Mutex
+	sent    []messaging.Message
+	dryRuns []messaging.Message
+	batches []int
+	err     error
+	refused map[string]bool
+}
+
+func (m *fakeMessenger) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return "", m.err
+	}
+	if m.refused[message.Token] {
+		return "", errors.New("refused")
+	}
+	m.sent = append(m.sent, *message)
+	return fmt.Sprintf("projects/test/messages/%d", len(m.sent)), nil
+}
+
+func (m *fakeMessenger) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	m.mu.Lock()
+	m.batches = append(m.batches, len(messages))
+	m.mu.Unlock()
+	batch := &messaging.BatchResponse{}
+	for _, message := range messages {
+		id, err := m.Send(ctx, message)
+		batch.Responses = append(batch.Responses, &messaging.SendResponse{Success: err == nil, MessageID: id, Error: err})
+		if err != nil {
+			batch.FailureCount++
+		} else {
+			batch.SuccessCount++
+		}
+	}
+	return batch, nil
+}
+
+func (m *fakeMessenger) SendDryRun(ctx context.Context, message *messaging.Message) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return "", m.err
+	}
+	m.dryRuns = append(m.dryRuns, *message)
+	return "projects/test/messages/dry-run", nil
+}
+
+func TestNotifyThroughMessenger(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalClient := privateKey, tokenStore, useExoscale, messagingClient
+	defer func() {
+		privateKey, tokenStore, useExoscale, messagingClient = originalPrivateKey, originalStore, originalExoscale, originalClient
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	fake := &fakeMessenger{}
+	messagingClient = fake
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(2))
+	body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android"})
+	rr := httptest.NewRecorder()
+	handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+	var reg RegisterResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &reg); err != nil || !reg.Success {
+		t.Fatalf("Registration failed: %s", rr.Body.String())
+	}
+	notify := func(dryRun bool) (int, ErrorCode) {
+		body, _ := json.Marshal(SingleNotificationRequest{TokenID: reg.TokenID, NotifySecret: reg.NotifySecret, Title: "Hello", Body: "From the fake", DryRun: dryRun})
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(body)))
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, errResp.Code
+	}
+
+	if status, code := notify(false); status != http.StatusOK {
+		t.Fatalf("Expected the send to go through the messenger, got %d %s", status, code)
+	}
+	if len(fake.sent) != 1 {
+		t.Fatalf("Expected one message sent, got %d", len(fake.sent))
+	}
+	if sent := fake.sent[0]; sent.Token != apitest.FCMToken(2) || sent.Notification == nil || sent.Notification.Title != "Hello" {
+		t.Errorf("Expected the decrypted token and the notification, got %+v", sent)
+	}
+
+	if status, code := notify(true); status != http.StatusOK || len(fake.dryRuns) != 1 || len(fake.sent) != 1 {
+		t.Errorf("Expected a dry run validated without sending, got %d %s, %d sent", status, code, len(fake.sent))
+	}
+
+	fake.err = errors.New("connection reset")
+	if _, code := notify(false); code != ErrFCMUnavailable {
+		t.Errorf("Expected an FCM failure reported as FCM_UNAVAILABLE, got %s", code)
+	}
+}
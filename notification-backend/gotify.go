@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var gotifyAppsFile = flag.String("gotify-apps", "", "JSON file of Gotify application tokens enabling the Gotify-compatible POST /message; empty disables it")
+
+// GotifyApp is one configured application. Like a Gotify application token,
+// its token can only send messages. Messages go to TokenIDs, or to every
+// registered device when it is empty.
+type GotifyApp struct {
+	Name            string   `json:"name"`
+	Token           string   `json:"token"`
+	DefaultPriority int      `json:"default_priority"`
+	TokenIDs        []string `json:"token_ids,omitempty"`
+
+	id int
+}
+
+// gotifyApps is loaded from --gotify-apps at startup
+var gotifyApps []*GotifyApp
+
+// gotifyMessageID numbers accepted messages, as Gotify's message IDs do
+var gotifyMessageID atomic.Int64
+
+// GotifyMessage is Gotify's message model, both the request and the response
+type GotifyMessage struct {
+	ID       int64          `json:"id"`
+	AppID    int            `json:"appid"`
+	Message  string         `json:"message"`
+	Title    string         `json:"title"`
+	Priority *int           `json:"priority,omitempty"`
+	Extras   map[string]any `json:"extras,omitempty"`
+	Date     time.Time      `json:"date"`
+}
+
+// gotifyError is Gotify's error body; Gotify clients expect it instead of ErrorResponse
+type gotifyError struct {
+	Error            string `json:"error"`
+	ErrorCode        int    `json:"errorCode"`
+	ErrorDescription string `json:"errorDescription"`
+}
+
+// setupGotify loads the application tokens when a file is configured
+func setupGotify(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read Gotify apps: %v", err)
+	}
+	var apps []*GotifyApp
+	if err := json.Unmarshal(data, &apps); err != nil {
+		return fmt.Errorf("failed to parse Gotify apps: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i, app := range apps {
+		if app.Name == "" || len(app.Token) < 16 {
+			return fmt.Errorf("Gotify app %d needs a name and a token of at least 16 characters", i+1)
+		}
+		if seen[app.Token] {
+			return fmt.Errorf("Gotify app %q reuses another app's token", app.Name)
+		}
+		seen[app.Token] = true
+		app.id = i + 1
+	}
+	gotifyApps = apps
+	return nil
+}
+
+// gotifyAppForToken finds the app whose token the request presents, in the
+// X-Gotify-Key header, a bearer token or the token query parameter
+func gotifyAppForToken(r *http.Request) *GotifyApp {
+	presented := r.Header.Get("X-Gotify-Key")
+	if presented == "" {
+		presented, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if presented == "" {
+		presented = r.URL.Query().Get("token")
+	}
+	var found *GotifyApp
+	for _, app := range gotifyApps {
+		// Compare against every app so timing does not reveal which matched
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(app.Token)) == 1 {
+			found = app
+		}
+	}
+	return found
+}
+
+// gotifyFCMPriority maps Gotify's 0-10 priority to FCM's. Gotify clients show
+// priorities below 4 silently, so those need not wake the device.
+func gotifyFCMPriority(priority int) string {
+	if priority < 4 {
+		return "normal"
+	}
+	return "high"
+}
+
+// writeGotifyError answers in Gotify's error format
+func writeGotifyError(w http.ResponseWriter, status int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(gotifyError{Error: http.StatusText(status), ErrorCode: status, ErrorDescription: description})
+}
+
+// decodeGotifyMessage reads a message sent as JSON or as a form, both of
+// which Gotify accepts
+func decodeGotifyMessage(r *http.Request) (GotifyMessage, error) {
+	var msg GotifyMessage
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return msg, err
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return msg, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return msg, fmt.Errorf("invalid form: %v", err)
+		}
+		msg.Title, msg.Message = r.PostFormValue("title"), r.PostFormValue("message")
+		if p := r.PostFormValue("priority"); p != "" {
+			priority, err := strconv.Atoi(p)
+			if err != nil {
+				return msg, fmt.Errorf("priority must be a number")
+			}
+			msg.Priority = &priority
+		}
+	default:
+		return msg, fmt.Errorf("unsupported Content-Type %q", mediaType)
+	}
+	return msg, nil
+}
+
+// handleGotifyMessage implements Gotify's POST /message, so Gotify scripts
+// and integrations can notify the app's devices unchanged
+func handleGotifyMessage(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeGotifyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if len(gotifyApps) == 0 {
+		writeGotifyError(w, http.StatusForbidden, "Gotify API disabled; set --gotify-apps to enable it")
+		return
+	}
+	app := gotifyAppForToken(r)
+	if app == nil {
+		writeGotifyError(w, http.StatusUnauthorized, "you need to provide a valid access token or user credentials to access this api")
+		return
+	}
+	logger = logger.With("gotify_app", app.Name)
+
+	msg, err := decodeGotifyMessage(r)
+	if err != nil {
+		logger.Warn("Error parsing Gotify message", "error", err)
+		writeGotifyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if msg.Message == "" {
+		writeGotifyError(w, http.StatusBadRequest, "Field 'message' is required")
+		return
+	}
+	// Gotify titles untitled messages with the application name
+	if msg.Title == "" {
+		msg.Title = app.Name
+	}
+	if msg.Priority == nil {
+		msg.Priority = &app.DefaultPriority
+	}
+
+	var tokens []*TokenStorageInfo
+	if len(app.TokenIDs) == 0 {
+		tokens, err = getAllTokens(r.Context())
+	} else {
+		for _, id := range app.TokenIDs {
+			token, lookupErr := getToken(r.Context(), id)
+			if lookupErr != nil {
+				logger.Warn("Gotify app target not found", "token_id", id, "error", lookupErr)
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to get tokens", "error", err)
+		writeGotifyError(w, http.StatusInternalServerError, "failed to retrieve tokens")
+		return
+	}
+
+	d := delivery{Title: msg.Title, Body: msg.Message, Priority: gotifyFCMPriority(*msg.Priority)}
+	sent, failed := broadcastTokens(r.Context(), tokens, d, func(string, error) {})
+	// Gotify accepts a message even with no clients connected, so only a
+	// message that reached nobody it was sent to is an error
+	if sent == 0 && failed > 0 {
+		writeGotifyError(w, http.StatusInternalServerError, fmt.Sprintf("delivery failed for all %d devices", failed))
+		return
+	}
+	logger.Info("Gotify message delivered", "sent", sent, "failed", failed)
+
+	response := GotifyMessage{
+		ID:       gotifyMessageID.Add(1),
+		AppID:    app.id,
+		Message:  msg.Message,
+		Title:    msg.Title,
+		Priority: msg.Priority,
+		Extras:   msg.Extras,
+		Date:     time.Now().UTC(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
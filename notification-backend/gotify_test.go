@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestGotifyMessage(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale := privateKey, tokenStore, useExoscale
+	originalApps, originalServer := gotifyApps, *ntfyServer
+	defer func() {
+		privateKey, tokenStore, useExoscale = originalPrivateKey, originalStore, originalExoscale
+		gotifyApps, *ntfyServer = originalApps, originalServer
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	var published []ntfyMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg ntfyMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		published = append(published, msg)
+	}))
+	defer server.Close()
+	*ntfyServer = server.URL
+
+	encrypted := apitest.EncryptToken("phone-123")
+	opaqueID, err := tokenStore.AddToken(encrypted, "ntfy")
+	if err != nil {
+		t.Fatalf("Failed to store token: %v", err)
+	}
+
+	appsFile := filepath.Join(t.TempDir(), "gotify.json")
+	os.WriteFile(appsFile, []byte(`[
+		{"name": "grafana", "token": "AGrafanaToken0001", "default_priority": 5},
+		{"name": "backup", "token": "ABackupToken00002", "token_ids": ["`+opaqueID+`", "gone"]}
+	]`), 0600)
+	if err := setupGotify(appsFile); err != nil {
+		t.Fatalf("setupGotify failed: %v", err)
+	}
+
+	// Gotify's CLI and scripts send forms with the token in a header or query
+	req := httptest.NewRequest("POST", "/message?token=ABackupToken00002", strings.NewReader(url.Values{"message": {"Backup done"}, "priority": {"2"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handleGotifyMessage(rr, req)
+
+	var msg GotifyMessage
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if rr.Code != http.StatusOK || msg.AppID != 2 || msg.ID == 0 || msg.Title != "backup" || msg.Priority == nil || *msg.Priority != 2 {
+		t.Fatalf("Unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(published) != 1 || published[0].Topic != "phone-123" || published[0].Title != "backup" || published[0].Message != "Backup done" {
+		t.Errorf("Unexpected deliveries: %+v", published)
+	}
+
+	req = httptest.NewRequest("POST", "/message", strings.NewReader(`{"title":"CPU","message":"High load","extras":{"client::display":{"contentType":"text/markdown"}}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", "AGrafanaToken0001")
+	rr = httptest.NewRecorder()
+	handleGotifyMessage(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if rr.Code != http.StatusOK || msg.AppID != 1 || *msg.Priority != 5 || msg.Extras == nil || len(published) != 2 {
+		t.Errorf("Unexpected JSON response %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for name, tc := range map[string]struct {
+		token, body string
+		status      int
+	}{
+		"wrong token":     {"wrong", `{"message":"x"}`, http.StatusUnauthorized},
+		"missing message": {"AGrafanaToken0001", `{"title":"x"}`, http.StatusBadRequest},
+		"invalid JSON":    {"AGrafanaToken0001", `{`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/message", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		rr := httptest.NewRecorder()
+		handleGotifyMessage(rr, req)
+		var gerr gotifyError
+		if err := json.Unmarshal(rr.Body.Bytes(), &gerr); err != nil || rr.Code != tc.status || gerr.ErrorCode != tc.status {
+			t.Errorf("%s: expected Gotify error %d, got %d: %s", name, tc.status, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestGotifyConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	for name, apps := range map[string]string{
+		"short token":     `[{"name":"a","token":"short"}]`,
+		"missing name":    `[{"token":"AGrafanaToken0001"}]`,
+		"duplicate token": `[{"name":"a","token":"AGrafanaToken0001"},{"name":"b","token":"AGrafanaToken0001"}]`,
+	} {
+		path := filepath.Join(dir, "apps.json")
+		os.WriteFile(path, []byte(apps), 0600)
+		if err := setupGotify(path); err == nil {
+			t.Errorf("%s: expected config to be rejected", name)
+		}
+	}
+
+	for priority, want := range map[int]string{0: "normal", 3: "normal", 4: "high", 10: "high"} {
+		if got := gotifyFCMPriority(priority); got != want {
+			t.Errorf("Gotify priority %d: expected FCM %q, got %q", priority, want, got)
+		}
+	}
+}
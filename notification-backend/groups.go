@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+// maxGroupMembers bounds a device group, which addresses one household or
+// user rather than an audience
+const maxGroupMembers = 100
+
+// namePattern keeps group, template and experiment names safe in URLs and object keys
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// DeviceGroup is a named set of opaque IDs addressed as one unit
+type DeviceGroup struct {
+	Name      string    `json:"name"`
+	TokenIDs  []string  `json:"token_ids"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GroupMembersRequest sets or adds group members
+type GroupMembersRequest struct {
+	TokenIDs []string `json:"token_ids"`
+}
+
+// GroupResponse is returned by the endpoints reading or changing one group
+type GroupResponse struct {
+	Success bool        `json:"success"`
+	Group   DeviceGroup `json:"group"`
+}
+
+// GroupListResponse is returned by GET /v1/groups
+type GroupListResponse struct {
+	Success bool          `json:"success"`
+	Groups  []DeviceGroup `json:"groups"`
+}
+
+func (g *DeviceGroup) clone() DeviceGroup {
+	c := *g
+	c.TokenIDs = slices.Clone(g.TokenIDs)
+	return c
+}
+
+// addMembers appends the IDs not yet in the group, keeping their order
+func (g *DeviceGroup) addMembers(ids []string) {
+	for _, id := range ids {
+		if !slices.Contains(g.TokenIDs, id) {
+			g.TokenIDs = append(g.TokenIDs, id)
+		}
+	}
+}
+
+// getGroup retrieves a device group from the appropriate storage
+func getGroup(ctx context.Context, name string) (DeviceGroup, error) {
+	if useExoscale {
+		return exoscaleStorage.GetGroup(ctx, name)
+	}
+	return tokenStore.GetGroup(name)
+}
+
+// updateGroup applies update to a device group in the appropriate storage
+func updateGroup(ctx context.Context, name string, create bool, update func(*DeviceGroup)) (DeviceGroup, error) {
+	if useExoscale {
+		return exoscaleStorage.UpdateGroup(ctx, name, create, update)
+	}
+	return tokenStore.UpdateGroup(name, create, update)
+}
+
+// deleteGroup removes a device group from the appropriate storage
+func deleteGroup(ctx context.Context, name string) error {
+	if useExoscale {
+		return exoscaleStorage.DeleteGroup(ctx, name)
+	}
+	return tokenStore.DeleteGroup(name)
+}
+
+// listGroups retrieves every device group from the appropriate storage
+func listGroups(ctx context.Context) ([]DeviceGroup, error) {
+	if useExoscale {
+		return exoscaleStorage.ListGroups(ctx)
+	}
+	return tokenStore.ListGroups(), nil
+}
+
+// pathName reads and checks the {name} path segment of a group or template
+func pathName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.PathValue("name")
+	if !namePattern.MatchString(name) {
+		writeError(w, ErrInvalidRequest, "Names are 1-64 letters, digits, '.', '_' or '-'")
+		return "", false
+	}
+	return name, true
+}
+
+// readGroupMembers decodes a GroupMembersRequest and checks every ID is registered
+func readGroupMembers(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	logger := loggerFromContext(r.Context())
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return nil, false
+	}
+	var req GroupMembersRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return nil, false
+	}
+	if len(req.TokenIDs) > maxGroupMembers {
+		writeError(w, ErrInvalidRequest, fmt.Sprintf("A group has at most %d members", maxGroupMembers))
+		return nil, false
+	}
+	for _, id := range req.TokenIDs {
+		if _, err := getToken(r.Context(), id); err != nil {
+			code := errorCodeOf(err, ErrStorageUnavailable)
+			logger.Warn("Failed to look up group member", "token_id", id, "code", code, "error", err)
+			if code == ErrTokenNotFound {
+				writeError(w, code, "Token ID not found: "+tokenIDPrefix(id))
+			} else {
+				writeError(w, code, "Failed to retrieve token")
+			}
+			return nil, false
+		}
+	}
+	return req.TokenIDs, true
+}
+
+// writeGroupError reports a failed group lookup or update
+func writeGroupError(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorCodeOf(err, ErrStorageUnavailable)
+	loggerFromContext(r.Context()).Warn("Group operation failed", "code", code, "error", err)
+	switch code {
+	case ErrGroupNotFound:
+		writeError(w, code, "Group not found")
+	case ErrInvalidRequest:
+		writeError(w, code, err.Error())
+	default:
+		writeError(w, code, "Failed to access group")
+	}
+}
+
+// writeGroup answers with the group as it now stands
+func writeGroup(w http.ResponseWriter, r *http.Request, group DeviceGroup) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(GroupResponse{Success: true, Group: group}); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
+
+// handleListGroups lists every device group by name
+func handleListGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	groups, err := listGroups(r.Context())
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(GroupListResponse{Success: true, Groups: groups}); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
+
+// handleGetGroup returns one device group
+func handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	group, err := getGroup(r.Context(), name)
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	writeGroup(w, r, group)
+}
+
+// handlePutGroup creates a group or replaces its members
+func handlePutGroup(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	members, ok := readGroupMembers(w, r)
+	if !ok {
+		return
+	}
+	group, err := updateGroup(r.Context(), name, true, func(g *DeviceGroup) {
+		g.TokenIDs = make([]string, 0, len(members))
+		g.addMembers(members)
+	})
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	loggerFromContext(r.Context()).Info("Group stored", "group", name, "members", len(group.TokenIDs))
+	writeGroup(w, r, group)
+}
+
+// handleDeleteGroup removes a group, leaving its members registered
+func handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteGroup(r.Context(), name); err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	loggerFromContext(r.Context()).Info("Group deleted", "group", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAddGroupMembers adds registered opaque IDs to an existing group
+func handleAddGroupMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	members, ok := readGroupMembers(w, r)
+	if !ok {
+		return
+	}
+	var full bool
+	group, err := updateGroup(r.Context(), name, false, func(g *DeviceGroup) {
+		before := len(g.TokenIDs)
+		g.addMembers(members)
+		if full = len(g.TokenIDs) > maxGroupMembers; full {
+			g.TokenIDs = g.TokenIDs[:before]
+		}
+	})
+	if err == nil && full {
+		err = withCode(ErrInvalidRequest, fmt.Errorf("a group has at most %d members", maxGroupMembers))
+	}
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	writeGroup(w, r, group)
+}
+
+// handleRemoveGroupMember drops one opaque ID from a group. Removing an ID
+// that is not a member succeeds, so retries are harmless.
+func handleRemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	group, err := updateGroup(r.Context(), name, false, func(g *DeviceGroup) {
+		g.TokenIDs = slices.DeleteFunc(g.TokenIDs, func(member string) bool { return member == id })
+	})
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	writeGroup(w, r, group)
+}
+
+// handleSendGroup sends one notification to every device in a group, like
+// /v1/send does to all of them. Members no longer registered are skipped.
+func handleSendGroup(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var notif NotificationRequest
+	if err := json.Unmarshal(body, &notif); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	if err := validateBroadcast(notif); err != nil {
+		writeError(w, errorCodeOf(err, ErrInvalidRequest), err.Error())
+		return
+	}
+
+	group, err := getGroup(r.Context(), name)
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	logger = logger.With("group", name)
+	tokens := make([]*TokenStorageInfo, 0, len(group.TokenIDs))
+	for _, id := range group.TokenIDs {
+		token, err := getToken(r.Context(), id)
+		if errorCodeOf(err, "") == ErrTokenNotFound {
+			logger.Warn("Group member no longer registered", "token_id", id)
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to get group member", "token_id", id, "error", err)
+			writeError(w, ErrStorageUnavailable, "Failed to retrieve tokens")
+			return
+		}
+		tokens = append(tokens, token)
+	}
+	if notif.Platform != "" {
+		tokens = filterPlatform(tokens, notif.Platform)
+	}
+	if len(tokens) == 0 {
+		writeError(w, ErrNoTokens, "Group has no registered members")
+		return
+	}
+	sendToTokens(w, r.WithContext(withLogger(r.Context(), logger)), tokens, notif)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestDeviceGroups(t *testing.T) {
+	originalStore, originalExoscale, originalClient, originalKey := tokenStore, useExoscale, messagingClient, rawAPIKey
+	defer func() {
+		tokenStore, useExoscale, messagingClient, rawAPIKey = originalStore, originalExoscale, originalClient, originalKey
+	}()
+	storagePath := filepath.Join(t.TempDir(), "tokens.json")
+	tokenStore = NewDurableTokenStore(storagePath)
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+	rawAPIKey = "admin-key"
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := tokenStore.AddToken("encrypted", "android")
+		if err != nil {
+			t.Fatalf("AddToken failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+	call := func(method, path, body string) (*httptest.ResponseRecorder, GroupResponse, ErrorCode) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		var resp GroupResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr, resp, errResp.Code
+	}
+	members := func(ids ...string) string {
+		body, _ := json.Marshal(GroupMembersRequest{TokenIDs: ids})
+		return string(body)
+	}
+
+	// Duplicates collapse, unknown IDs and bad names are refused
+	rr, resp, _ := call("PUT", "/v1/groups/household-1", members(ids[0], ids[1], ids[0]))
+	if rr.Code != http.StatusOK || len(resp.Group.TokenIDs) != 2 || resp.Group.CreatedAt.IsZero() {
+		t.Fatalf("Expected a group of two, got %d %s", rr.Code, rr.Body.String())
+	}
+	if _, _, code := call("PUT", "/v1/groups/household-1", members(ids[0], apitest.OpaqueID(0))); code != ErrTokenNotFound {
+		t.Errorf("Expected TOKEN_NOT_FOUND for an unregistered member, got %s", code)
+	}
+	if _, _, code := call("PUT", "/v1/groups/-hidden", members(ids[0])); code != ErrInvalidRequest {
+		t.Errorf("Expected INVALID_REQUEST for a bad group name, got %s", code)
+	}
+	if rr, _, code := call("PATCH", "/v1/groups/household-1", "{}"); code != ErrMethodNotAllowed || rr.Header().Get("Allow") != "GET, PUT, DELETE" {
+		t.Errorf("Expected 405 listing the allowed methods, got %s %q", code, rr.Header().Get("Allow"))
+	}
+
+	if _, resp, _ := call("POST", "/v1/groups/household-1/members", members(ids[2], ids[1])); len(resp.Group.TokenIDs) != 3 || resp.Group.TokenIDs[2] != ids[2] {
+		t.Errorf("Expected the third device appended, got %v", resp.Group.TokenIDs)
+	}
+	if _, _, code := call("POST", "/v1/groups/elsewhere/members", members(ids[2])); code != ErrGroupNotFound {
+		t.Errorf("Expected GROUP_NOT_FOUND, got %s", code)
+	}
+	if _, resp, _ := call("DELETE", "/v1/groups/household-1/members/"+ids[2], ""); len(resp.Group.TokenIDs) != 2 {
+		t.Errorf("Expected the third device removed, got %v", resp.Group.TokenIDs)
+	}
+
+	// Sending goes to the members only, through the broadcast path
+	rr, _, _ = call("POST", "/v1/groups/household-1/send", `{"title":"t","body":"b"}`)
+	var sent SendResponse
+	json.Unmarshal(rr.Body.Bytes(), &sent)
+	if sent.TotalTokens != 2 || sent.ErrorCount != 2 {
+		t.Errorf("Expected two deliveries attempted, got %s", rr.Body.String())
+	}
+
+	// Groups survive a restart
+	tokenStore = NewDurableTokenStore(storagePath)
+	rr, _, _ = call("GET", "/v1/groups", "")
+	var listed GroupListResponse
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed.Groups) != 1 || listed.Groups[0].Name != "household-1" || len(listed.Groups[0].TokenIDs) != 2 {
+		t.Errorf("Expected the group to be reloaded, got %s", rr.Body.String())
+	}
+
+	if rr, _, _ := call("DELETE", "/v1/groups/household-1", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rr.Code)
+	}
+	if rr, _, code := call("GET", "/v1/groups/household-1", ""); rr.Code != http.StatusNotFound || code != ErrGroupNotFound {
+		t.Errorf("Expected the group gone, got %d %s", rr.Code, code)
+	}
+	if n := tokenStore.Count(); n != 3 {
+		t.Errorf("Expected members to stay registered, got %d tokens", n)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// Huawei Push Kit configuration; platform "huawei" is disabled without an app ID
+	hmsAppID        = flag.String("hms-app-id", "", "Huawei AppGallery Connect app ID for platform \"huawei\"; empty disables it")
+	hmsAppSecretArg = flag.String("hms-app-secret", "", "Huawei app secret (or HMS_APP_SECRET)")
+	hmsTimeout      = flag.Duration("hms-timeout", 10*time.Second, "Timeout for a single HMS token or send request")
+)
+
+// Push Kit endpoints; tests point them at a local server
+var (
+	hmsAuthURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	hmsPushURL = "https://push-api.cloud.huawei.com/v1/%s/messages:send"
+)
+
+// hmsAppSecret is resolved from the flag or environment at startup
+var hmsAppSecret string
+
+// hmsClient talks to Huawei's OAuth and Push Kit servers; tests replace it
+var hmsClient = &http.Client{}
+
+// Push Kit result codes, see the Push Kit server API error code reference
+const (
+	hmsSuccess        = "80000000"
+	hmsParamError     = "80100001"
+	hmsTokenExpired   = "80200003"
+	hmsMessageTooBig  = "80300008"
+	hmsInvalidTokens  = "80300007"
+	hmsSomeTokensFail = "80100000"
+)
+
+var hmsTransport = &transport{
+	name:       "hms",
+	configured: func() bool { return *hmsAppID != "" },
+	ready: func() error {
+		if *hmsAppID == "" {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("HMS is not configured (--hms-app-id)"))
+		}
+		return nil
+	},
+	validate: validateHMSToken,
+	send:     sendHMS,
+}
+
+// hmsAccessToken caches the app's OAuth access token, valid for an hour
+var hmsAccessToken accessTokenCache
+
+// hmsMessage is the body of a Push Kit send request
+type hmsMessage struct {
+	ValidateOnly bool `json:"validate_only"`
+	Message      struct {
+		Notification struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		} `json:"notification"`
+		Android struct {
+			Urgency      string `json:"urgency"`
+			Notification struct {
+				// Type 3 opens the app, which Push Kit requires for notification messages
+				ClickAction struct {
+					Type int `json:"type"`
+				} `json:"click_action"`
+			} `json:"notification"`
+		} `json:"android"`
+		Token []string `json:"token"`
+	} `json:"message"`
+}
+
+// hmsResult is the body of every Push Kit response
+type hmsResult struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestID string `json:"requestId"`
+}
+
+// setupHMS resolves the app secret, preferring the flag over HMS_APP_SECRET
+func setupHMS(appID, secret string) error {
+	if appID == "" {
+		return nil
+	}
+	if secret == "" {
+		secret = os.Getenv("HMS_APP_SECRET")
+	}
+	if secret == "" {
+		return fmt.Errorf("--hms-app-id needs --hms-app-secret or HMS_APP_SECRET")
+	}
+	hmsAppSecret = secret
+	return nil
+}
+
+// validateHMSToken checks a decrypted Push Kit token looks plausible
+func validateHMSToken(token string) error {
+	if len(token) < 32 || len(token) > 512 || strings.ContainsAny(token, " \t\r\n") {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("HMS token must be 32-512 characters without whitespace"))
+	}
+	return nil
+}
+
+// hmsToken returns the app's access token, fetching a new one when it has
+// expired or refresh is set
+func hmsToken(ctx context.Context, refresh bool) (string, error) {
+	return hmsAccessToken.get(ctx, refresh, func(ctx context.Context) (string, time.Duration, error) {
+		token, lifetime, err := fetchClientCredentials(ctx, hmsClient, hmsAuthURL, url.Values{
+			"client_id":     {*hmsAppID},
+			"client_secret": {hmsAppSecret},
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("HMS: %v", err)
+		}
+		return token, lifetime, nil
+	})
+}
+
+// sendHMS delivers the notification through Push Kit. An access token that
+// Huawei reports as expired is refreshed and the send retried once.
+func sendHMS(ctx context.Context, d delivery) error {
+	var msg hmsMessage
+	msg.Message.Notification.Title = d.Title
+	msg.Message.Notification.Body = d.Body
+	msg.Message.Android.Urgency = "HIGH"
+	if d.Priority == "normal" {
+		msg.Message.Android.Urgency = "NORMAL"
+	}
+	msg.Message.Android.Notification.ClickAction.Type = 3
+	msg.Message.Token = []string{d.Address}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	ctx, span := startSpan(ctx, "hms.send")
+	sendCtx, cancel := context.WithTimeout(ctx, *hmsTimeout)
+	defer cancel()
+
+	var result hmsResult
+	var status int
+	for attempt := 0; attempt < 2; attempt++ {
+		result, status, err = postHMS(sendCtx, payload, attempt > 0)
+		if err != nil {
+			endSpan(span, err)
+			return withCode(ErrTransportUnavailable, err)
+		}
+		if status != http.StatusUnauthorized && result.Code != hmsTokenExpired {
+			break
+		}
+	}
+
+	err = nil
+	switch result.Code {
+	case hmsSuccess:
+	case hmsInvalidTokens, hmsSomeTokensFail:
+		// With a single target, a partial failure means our one token failed
+		err = withCode(ErrTokenUnregistered, fmt.Errorf("HMS rejected the token: %s %s", result.Code, result.Msg))
+	case hmsParamError, hmsMessageTooBig:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("HMS rejected the message: %s %s", result.Code, result.Msg))
+	default:
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("HMS returned %d %s %s", status, result.Code, result.Msg))
+	}
+	endSpan(span, err)
+	return err
+}
+
+// postHMS sends one Push Kit request and decodes its result
+func postHMS(ctx context.Context, payload []byte, refresh bool) (hmsResult, int, error) {
+	var result hmsResult
+	token, err := hmsToken(ctx, refresh)
+	if err != nil {
+		return result, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(hmsPushURL, url.PathEscape(*hmsAppID)), bytes.NewReader(payload))
+	if err != nil {
+		return result, 0, fmt.Errorf("failed to build HMS request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := hmsClient.Do(req)
+	if err != nil {
+		return result, 0, fmt.Errorf("failed to send to HMS: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil && resp.StatusCode != http.StatusUnauthorized {
+		return result, resp.StatusCode, fmt.Errorf("invalid HMS response (%s): %v", resp.Status, err)
+	}
+	return result, resp.StatusCode, nil
+}
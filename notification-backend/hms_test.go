@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendHMS(t *testing.T) {
+	const hmsDeviceToken = "IQAAAACy0kLhAADdqcRwlpS6hWmYv2vXeJ7kn5tY0lQ3"
+	var tokenRequests int
+	var got hmsMessage
+	var auth, sendPath string
+	resultCode := hmsSuccess
+	expireNext := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			r.ParseForm()
+			if r.Form.Get("client_id") != "10086" || r.Form.Get("client_secret") != "s3cret" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":1101,"error_description":"invalid client"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"at-` + string(rune('0'+tokenRequests)) + `","expires_in":3600}`))
+			return
+		}
+		sendPath, auth = r.URL.Path, r.Header.Get("Authorization")
+		if expireNext {
+			expireNext = false
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"code":"` + resultCode + `","msg":"x","requestId":"1"}`))
+	}))
+	defer server.Close()
+
+	originalAuth, originalPush, originalAppID, originalSecret := hmsAuthURL, hmsPushURL, *hmsAppID, hmsAppSecret
+	defer func() {
+		hmsAuthURL, hmsPushURL, *hmsAppID, hmsAppSecret = originalAuth, originalPush, originalAppID, originalSecret
+		hmsAccessToken.reset()
+	}()
+	hmsAuthURL, hmsPushURL = server.URL+"/token", server.URL+"/v1/%s/messages:send"
+	*hmsAppID = "10086"
+	if err := setupHMS(*hmsAppID, "s3cret"); err != nil {
+		t.Fatalf("setupHMS failed: %v", err)
+	}
+	hmsAccessToken.reset()
+
+	d := delivery{Address: hmsDeviceToken, Title: "Hello", Body: "World"}
+	if err := sendHMS(t.Context(), d); err != nil {
+		t.Fatalf("Expected send to succeed, got %v", err)
+	}
+	msg := got.Message
+	if sendPath != "/v1/10086/messages:send" || auth != "Bearer at-1" || len(msg.Token) != 1 || msg.Token[0] != hmsDeviceToken ||
+		msg.Notification.Title != "Hello" || msg.Notification.Body != "World" || msg.Android.Notification.ClickAction.Type != 3 {
+		t.Errorf("Unexpected send to %s (auth %q): %+v", sendPath, auth, got)
+	}
+
+	// The access token is cached, and refreshed once when Huawei rejects it
+	sendHMS(t.Context(), d)
+	if tokenRequests != 1 {
+		t.Errorf("Expected cached access token, got %d token requests", tokenRequests)
+	}
+	expireNext = true
+	if err := sendHMS(t.Context(), d); err != nil || tokenRequests != 2 || auth != "Bearer at-2" {
+		t.Errorf("Expected refresh and retry after 401, got %v (%d token requests, auth %q)", err, tokenRequests, auth)
+	}
+
+	for result, code := range map[string]ErrorCode{
+		hmsInvalidTokens: ErrTokenUnregistered,
+		hmsParamError:    ErrInvalidMessage,
+		"81000001":       ErrTransportUnavailable,
+	} {
+		resultCode = result
+		if err := sendHMS(t.Context(), d); errorCodeOf(err, "") != code {
+			t.Errorf("HMS %s: expected %s, got %v", result, code, err)
+		}
+	}
+
+	hmsAppSecret = "wrong"
+	hmsAccessToken.reset()
+	if err := sendHMS(t.Context(), d); errorCodeOf(err, "") != ErrTransportUnavailable || !strings.Contains(err.Error(), "invalid client") {
+		t.Errorf("Expected failed OAuth to be TRANSPORT_UNAVAILABLE, got %v", err)
+	}
+}
+
+func TestHMSConfiguration(t *testing.T) {
+	t.Setenv("HMS_APP_SECRET", "")
+	if err := setupHMS("10086", ""); err == nil {
+		t.Error("Expected app ID without secret to be rejected")
+	}
+
+	for token, valid := range map[string]bool{
+		strings.Repeat("a", 64):        true,
+		"short":                        false,
+		strings.Repeat("a", 600):       false,
+		strings.Repeat("a", 40) + " x": false,
+	} {
+		if err := validateHMSToken(token); (err == nil) != valid {
+			t.Errorf("Token %q: expected valid=%v, got %v", token, valid, err)
+		}
+	}
+
+	if transportFor("huawei") != hmsTransport {
+		t.Error("Expected platform routing to pick HMS for \"huawei\"")
+	}
+}
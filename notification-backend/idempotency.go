@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var idempotencyTTL = flag.Duration("idempotency-ttl", 15*time.Minute, "How long /v1/register answers a repeated Idempotency-Key with the first response; 0 ignores the header")
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// registerIdempotency remembers recent registrations by Idempotency-Key on
+// this replica
+var registerIdempotency = &idempotencyCache{entries: make(map[string]*idempotencyEntry)}
+
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+// idempotencyEntry is one key's registration, in flight until done is closed
+type idempotencyEntry struct {
+	bodyHash [sha256.Size]byte
+	done     chan struct{}
+	response *RegisterResponse // set when the registration succeeded
+	expires  time.Time
+}
+
+// idempotencyClaim is held by the request registering under a key. Its
+// methods do nothing on a nil claim, for requests without the header.
+type idempotencyClaim struct {
+	cache *idempotencyCache
+	key   string
+	entry *idempotencyEntry
+}
+
+// validateIdempotencyKey checks the header is 1-255 printable ASCII characters
+func validateIdempotencyKey(key string) error {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return withCode(ErrInvalidRequest, fmt.Errorf("Idempotency-Key must be 1-%d characters", maxIdempotencyKeyLength))
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return withCode(ErrInvalidRequest, fmt.Errorf("Idempotency-Key must be printable ASCII"))
+		}
+	}
+	return nil
+}
+
+// begin looks up key for a request with body. It returns the response of an
+// earlier successful registration, or else a claim the caller completes with
+// finish and release. A duplicate arriving while the first is in flight waits
+// for it, and takes over the key if the first one fails.
+func (c *idempotencyCache) begin(ctx context.Context, key string, body []byte) (*RegisterResponse, *idempotencyClaim, error) {
+	sum := sha256.Sum256(body)
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		for k, e := range c.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		e, ok := c.entries[key]
+		if !ok {
+			e = &idempotencyEntry{bodyHash: sum, done: make(chan struct{})}
+			c.entries[key] = e
+			c.mu.Unlock()
+			return nil, &idempotencyClaim{cache: c, key: key, entry: e}, nil
+		}
+		c.mu.Unlock()
+
+		if e.bodyHash != sum {
+			return nil, nil, withCode(ErrIdempotencyKeyReused, fmt.Errorf("Idempotency-Key was already used for another registration"))
+		}
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, nil, withCode(ErrInternal, fmt.Errorf("gave up waiting for the first registration: %v", ctx.Err()))
+		}
+		if e.response != nil {
+			return e.response, nil, nil
+		}
+	}
+}
+
+// finish records the response to replay for the claim's key
+func (cl *idempotencyClaim) finish(response RegisterResponse) {
+	if cl == nil {
+		return
+	}
+	cl.cache.mu.Lock()
+	defer cl.cache.mu.Unlock()
+	cl.entry.response = &response
+	cl.entry.expires = time.Now().Add(*idempotencyTTL)
+}
+
+// release wakes duplicates waiting on the claim, and frees the key again
+// when the registration did not finish
+func (cl *idempotencyClaim) release() {
+	if cl == nil {
+		return
+	}
+	cl.cache.mu.Lock()
+	if cl.entry.response == nil && cl.cache.entries[cl.key] == cl.entry {
+		delete(cl.cache.entries, cl.key)
+	}
+	cl.cache.mu.Unlock()
+	close(cl.entry.done)
+}
+
+// beginIdempotentRegister handles the Idempotency-Key header of a /v1/register
+// request. It writes a replayed or error response itself and then reports
+// done; otherwise the caller registers and completes the returned claim,
+// which is nil without the header.
+func beginIdempotentRegister(w http.ResponseWriter, r *http.Request, body []byte) (claim *idempotencyClaim, done bool) {
+	key, ok := r.Header["Idempotency-Key"]
+	if !ok || *idempotencyTTL <= 0 {
+		return nil, false
+	}
+	logger := loggerFromContext(r.Context())
+	if err := validateIdempotencyKey(key[0]); err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return nil, true
+	}
+
+	cached, claim, err := registerIdempotency.begin(r.Context(), key[0], body)
+	if err != nil {
+		code := errorCodeOf(err, ErrInternal)
+		logger.Warn("Idempotent registration failed", "code", code, "error", err)
+		writeError(w, code, err.Error())
+		return nil, true
+	}
+	if cached == nil {
+		return claim, false
+	}
+
+	// The same opaque ID and notify secret, signed afresh so the replay
+	// passes the app backend's freshness check
+	response := *cached
+	response.IssuedAt = time.Now().Unix()
+	if response.Signature, err = signRegistration(response.TokenID, response.IssuedAt); err != nil {
+		logger.Error("Failed to sign registration", "error", err)
+		writeError(w, ErrInternal, "Failed to sign registration")
+		return nil, true
+	}
+	response.TotalTokens = getTotalTokenCount(r.Context())
+	logger.Info("Replaying idempotent registration", "token_id", response.TokenID)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Idempotent-Replayed", "true")
+	if err := writeResponse(w, http.StatusOK, response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+	return nil, true
+}
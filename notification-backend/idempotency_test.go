@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestRegisterIdempotencyKey(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalCache := privateKey, tokenStore, useExoscale, registerIdempotency
+	defer func() {
+		privateKey, tokenStore, useExoscale, registerIdempotency = originalPrivateKey, originalStore, originalExoscale, originalCache
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	registerIdempotency = &idempotencyCache{entries: make(map[string]*idempotencyEntry)}
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+	body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android"})
+	register := func(key string, body []byte) (*httptest.ResponseRecorder, RegisterResponse) {
+		req := httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		handleRegister(rr, req)
+		var resp RegisterResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+
+	// Concurrent retries all get the one opaque ID
+	const retries = 5
+	ids := make([]string, retries)
+	var wg sync.WaitGroup
+	for i := range retries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, resp := register("retry-1", body)
+			ids[i] = resp.TokenID
+		}()
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id == "" || id != ids[0] {
+			t.Fatalf("Expected every retry to get the same opaque ID, got %v", ids)
+		}
+	}
+	if n := tokenStore.Count(); n != 1 {
+		t.Errorf("Expected one stored registration, got %d", n)
+	}
+
+	rr, replay := register("retry-1", body)
+	if rr.Header().Get("Idempotent-Replayed") != "true" || replay.NotifySecret == "" {
+		t.Errorf("Expected a replay with the notify secret, got %q", rr.Body.String())
+	}
+	if err := verifyRegistration(&privKey.PublicKey, replay.TokenID, replay.IssuedAt, replay.Signature); err != nil {
+		t.Errorf("Expected the replay to be signed, got %v", err)
+	}
+
+	// Another body under the same key is refused, even one differing only in
+	// whitespace; another key registers anew
+	rr, _ = register("retry-1", append(bytes.Clone(body), ' '))
+	var errResp ErrorResponse
+	json.Unmarshal(rr.Body.Bytes(), &errResp)
+	if rr.Code != http.StatusUnprocessableEntity || errResp.Code != ErrIdempotencyKeyReused {
+		t.Errorf("Expected 422 IDEMPOTENCY_KEY_REUSED, got %d %q", rr.Code, rr.Body.String())
+	}
+	if _, resp := register("retry-2", body); resp.TokenID == "" || resp.TokenID == ids[0] {
+		t.Errorf("Expected a new opaque ID for another key, got %q", resp.TokenID)
+	}
+	if _, resp := register("", body); resp.TokenID == "" || resp.TokenID == ids[0] {
+		t.Errorf("Expected a new opaque ID without a key, got %q", resp.TokenID)
+	}
+
+	// Failed registrations are not remembered, so a corrected retry can use the key
+	bad := []byte(`{"encrypted_data": "` + strings.Repeat("A", 200) + `", "platform": "android"}`)
+	if rr, _ := register("retry-3", bad); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the bad registration to fail, got %d", rr.Code)
+	}
+	if _, ok := registerIdempotency.entries["retry-3"]; ok {
+		t.Error("Expected a failed registration to free its key")
+	}
+
+	if rr, _ := register(strings.Repeat("k", maxIdempotencyKeyLength+1), body); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an overlong key to be refused, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	// Play Integrity configuration; attestation is not required without a package name
+	playIntegrityPackage = flag.String("play-integrity-package", "", "Android package name whose registrations must carry a Play Integrity token; empty disables the check")
+	playIntegrityVerdict = flag.String("play-integrity-verdict", "MEETS_DEVICE_INTEGRITY", "Device verdict required of Android registrations: MEETS_BASIC_INTEGRITY, MEETS_DEVICE_INTEGRITY or MEETS_STRONG_INTEGRITY")
+	playIntegrityMaxAge  = flag.Duration("play-integrity-max-age", 5*time.Minute, "How old an integrity token may be when it is presented")
+	playIntegrityTimeout = flag.Duration("play-integrity-timeout", 10*time.Second, "Timeout for decoding one integrity token")
+)
+
+// playIntegrityAPIURL is the decodeIntegrityToken endpoint without the
+// package; tests point it at a local server
+var playIntegrityAPIURL = "https://playintegrity.googleapis.com/v1/"
+
+// playIntegrityClient calls the Play Integrity API; tests replace it
+var playIntegrityClient = &http.Client{}
+
+// playIntegrityTokens authorizes decode calls; set up from the Firebase credentials
+var playIntegrityTokens oauth2.TokenSource
+
+// playIntegrityVerdicts are the device verdicts from weakest to strongest
+var playIntegrityVerdicts = []string{"MEETS_BASIC_INTEGRITY", "MEETS_DEVICE_INTEGRITY", "MEETS_STRONG_INTEGRITY"}
+
+// setupPlayIntegrity checks the verdict and obtains credentials for the
+// Play Integrity API from --firebase-key, or the default credentials
+func setupPlayIntegrity(ctx context.Context, packageName string) error {
+	if packageName == "" {
+		return nil
+	}
+	if !slices.Contains(playIntegrityVerdicts, *playIntegrityVerdict) {
+		return fmt.Errorf("--play-integrity-verdict must be one of %v, got %q", playIntegrityVerdicts, *playIntegrityVerdict)
+	}
+	creds, err := googleCredentials(ctx, *serviceAccountKeyPath, "https://www.googleapis.com/auth/playintegrity")
+	if err != nil {
+		return err
+	}
+	playIntegrityTokens = creds.TokenSource
+	return nil
+}
+
+// integrityRequired reports whether a registration for platform must be attested
+func integrityRequired(platform string) bool {
+	return *playIntegrityPackage != "" && platform == "android"
+}
+
+// integrityRequestHash is the requestHash the app binds its token to: the
+// hex SHA-256 of the encrypted_data it registers, so a token cannot be
+// replayed for another registration
+func integrityRequestHash(encryptedData string) string {
+	sum := sha256.Sum256([]byte(encryptedData))
+	return hex.EncodeToString(sum[:])
+}
+
+// integrityPayload is the part of a decoded token the checks need
+type integrityPayload struct {
+	RequestDetails struct {
+		RequestPackageName string `json:"requestPackageName"`
+		RequestHash        string `json:"requestHash"`
+		TimestampMillis    string `json:"timestampMillis"`
+	} `json:"requestDetails"`
+	AppIntegrity struct {
+		AppRecognitionVerdict string `json:"appRecognitionVerdict"`
+		PackageName           string `json:"packageName"`
+	} `json:"appIntegrity"`
+	DeviceIntegrity struct {
+		DeviceRecognitionVerdict []string `json:"deviceRecognitionVerdict"`
+	} `json:"deviceIntegrity"`
+}
+
+// verifyIntegrity decodes a Play Integrity token through Google and checks it
+// was made by the genuine app on a device meeting --play-integrity-verdict,
+// recently, for this registration
+func verifyIntegrity(ctx context.Context, integrityToken, encryptedData string) error {
+	if integrityToken == "" {
+		return withCode(ErrIntegrityFailed, fmt.Errorf("integrity_token is required for Android registrations"))
+	}
+	payload, err := decodeIntegrityToken(ctx, integrityToken)
+	if err != nil {
+		return err
+	}
+
+	details := payload.RequestDetails
+	if details.RequestPackageName != *playIntegrityPackage || payload.AppIntegrity.PackageName != *playIntegrityPackage {
+		return withCode(ErrIntegrityFailed, fmt.Errorf("integrity token is for another app"))
+	}
+	if details.RequestHash != integrityRequestHash(encryptedData) {
+		return withCode(ErrIntegrityFailed, fmt.Errorf("integrity token is bound to another request"))
+	}
+	millis, err := strconv.ParseInt(details.TimestampMillis, 10, 64)
+	if err != nil || time.Since(time.UnixMilli(millis)) > *playIntegrityMaxAge {
+		return withCode(ErrIntegrityFailed, fmt.Errorf("integrity token is too old"))
+	}
+	if payload.AppIntegrity.AppRecognitionVerdict != "PLAY_RECOGNIZED" {
+		return withCode(ErrIntegrityFailed, fmt.Errorf("app is not recognized by Google Play (%s)", payload.AppIntegrity.AppRecognitionVerdict))
+	}
+	// Each verdict implies the weaker ones, so any at or above the required level passes
+	required := slices.Index(playIntegrityVerdicts, *playIntegrityVerdict)
+	for _, verdict := range payload.DeviceIntegrity.DeviceRecognitionVerdict {
+		if slices.Index(playIntegrityVerdicts, verdict) >= required {
+			return nil
+		}
+	}
+	return withCode(ErrIntegrityFailed, fmt.Errorf("device does not meet %s", *playIntegrityVerdict))
+}
+
+// decodeIntegrityToken asks the Play Integrity API for the token's verdicts
+func decodeIntegrityToken(ctx context.Context, integrityToken string) (*integrityPayload, error) {
+	if playIntegrityTokens == nil {
+		return nil, withCode(ErrIntegrityUnavailable, fmt.Errorf("Play Integrity credentials not initialized"))
+	}
+
+	ctx, span := startSpan(ctx, "playintegrity.decode")
+	ctx, cancel := context.WithTimeout(ctx, *playIntegrityTimeout)
+	defer cancel()
+
+	access, err := playIntegrityTokens.Token()
+	if err != nil {
+		endSpan(span, err)
+		return nil, withCode(ErrIntegrityUnavailable, fmt.Errorf("failed to obtain Play Integrity access token: %v", err))
+	}
+
+	body, _ := json.Marshal(map[string]string{"integrityToken": integrityToken})
+	endpoint := playIntegrityAPIURL + url.PathEscape(*playIntegrityPackage) + ":decodeIntegrityToken"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		endSpan(span, err)
+		return nil, withCode(ErrIntegrityUnavailable, fmt.Errorf("failed to build Play Integrity request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	access.SetAuthHeader(req)
+
+	resp, err := playIntegrityClient.Do(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, withCode(ErrIntegrityUnavailable, fmt.Errorf("failed to call Play Integrity: %v", err))
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusBadRequest:
+		// The token is malformed or was not issued for this app
+		err = withCode(ErrIntegrityFailed, fmt.Errorf("Play Integrity rejected the token: %s", data))
+	default:
+		err = withCode(ErrIntegrityUnavailable, fmt.Errorf("Play Integrity returned %s: %s", resp.Status, data))
+	}
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	var decoded struct {
+		TokenPayloadExternal integrityPayload `json:"tokenPayloadExternal"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		endSpan(span, err)
+		return nil, withCode(ErrIntegrityUnavailable, fmt.Errorf("failed to parse Play Integrity response: %v", err))
+	}
+	endSpan(span, nil)
+	return &decoded.TokenPayloadExternal, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"remote-notification/api/apitest"
+)
+
+func TestRegisterWithPlayIntegrity(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale := privateKey, tokenStore, useExoscale
+	originalPackage, originalVerdict, originalURL, originalTokens := *playIntegrityPackage, *playIntegrityVerdict, playIntegrityAPIURL, playIntegrityTokens
+	defer func() {
+		privateKey, tokenStore, useExoscale = originalPrivateKey, originalStore, originalExoscale
+		*playIntegrityPackage, *playIntegrityVerdict, playIntegrityAPIURL, playIntegrityTokens = originalPackage, originalVerdict, originalURL, originalTokens
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	*playIntegrityPackage, *playIntegrityVerdict = "org.example.app", "MEETS_DEVICE_INTEGRITY"
+	playIntegrityTokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "at"})
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+
+	// Each integrity token names the verdict the fake API returns for it
+	verdicts := map[string]string{}
+	var auth, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, path = r.Header.Get("Authorization"), r.URL.Path
+		var req struct {
+			IntegrityToken string `json:"integrityToken"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		payload, ok := verdicts[req.IntegrityToken]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Integrity token cannot be decoded"}}`))
+			return
+		}
+		w.Write([]byte(`{"tokenPayloadExternal":` + payload + `}`))
+	}))
+	defer server.Close()
+	playIntegrityAPIURL = server.URL + "/v1/"
+
+	verdict := func(pkg, hash string, age time.Duration, app string, device ...string) string {
+		deviceJSON, _ := json.Marshal(device)
+		return fmt.Sprintf(`{"requestDetails":{"requestPackageName":%q,"requestHash":%q,"timestampMillis":"%d"},`+
+			`"appIntegrity":{"appRecognitionVerdict":%q,"packageName":%q},"deviceIntegrity":{"deviceRecognitionVerdict":%s}}`,
+			pkg, hash, time.Now().Add(-age).UnixMilli(), app, pkg, deviceJSON)
+	}
+	hash := integrityRequestHash(encrypted)
+	verdicts["good"] = verdict("org.example.app", hash, time.Second, "PLAY_RECOGNIZED", "MEETS_BASIC_INTEGRITY", "MEETS_DEVICE_INTEGRITY")
+	verdicts["strong"] = verdict("org.example.app", hash, time.Second, "PLAY_RECOGNIZED", "MEETS_STRONG_INTEGRITY")
+	verdicts["emulator"] = verdict("org.example.app", hash, time.Second, "PLAY_RECOGNIZED", "MEETS_BASIC_INTEGRITY")
+	verdicts["sideloaded"] = verdict("org.example.app", hash, time.Second, "UNRECOGNIZED_VERSION", "MEETS_DEVICE_INTEGRITY")
+	verdicts["other-app"] = verdict("org.example.other", hash, time.Second, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY")
+	verdicts["replayed"] = verdict("org.example.app", integrityRequestHash("other"), time.Second, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY")
+	verdicts["stale"] = verdict("org.example.app", hash, time.Hour, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY")
+
+	register := func(platform, integrityToken string) (int, ErrorCode) {
+		body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: platform, IntegrityToken: integrityToken})
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		var resp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp.Code
+	}
+
+	for _, integrityToken := range []string{"good", "strong"} {
+		if status, code := register("android", integrityToken); status != http.StatusOK {
+			t.Errorf("%s: expected registration to succeed, got %d %s", integrityToken, status, code)
+		}
+	}
+	if auth != "Bearer at" || path != "/v1/org.example.app:decodeIntegrityToken" {
+		t.Errorf("Unexpected decode call to %q with %q", path, auth)
+	}
+
+	for _, integrityToken := range []string{"", "garbage", "emulator", "sideloaded", "other-app", "replayed", "stale"} {
+		if status, code := register("android", integrityToken); status != http.StatusForbidden || code != ErrIntegrityFailed {
+			t.Errorf("%q: expected 403 INTEGRITY_FAILED, got %d %s", integrityToken, status, code)
+		}
+	}
+
+	// Other platforms are not attested
+	if status, code := register("ios", ""); status != http.StatusOK {
+		t.Errorf("Expected iOS registration without a token to succeed, got %d %s", status, code)
+	}
+
+	server.Close()
+	if status, code := register("android", "good"); status != http.StatusInternalServerError || code != ErrIntegrityUnavailable {
+		t.Errorf("Expected 500 INTEGRITY_UNAVAILABLE with the API down, got %d %s", status, code)
+	}
+}
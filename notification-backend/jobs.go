@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Asynchronous broadcast configuration
+	maxRunningJobs = flag.Int("max-running-jobs", 4, "Maximum number of asynchronous broadcast jobs running at once")
+	jobRetention   = flag.Duration("job-retention", time.Hour, "How long a finished broadcast job stays available under /v1/jobs")
+)
+
+const (
+	// jobEventMinInterval coalesces progress events so a fast broadcast does
+	// not emit one SSE message per delivery
+	jobEventMinInterval = 250 * time.Millisecond
+	// jobKeepAlive keeps idle SSE connections open through proxies
+	jobKeepAlive = 15 * time.Second
+)
+
+// JobStatus is the progress of an asynchronous broadcast
+type JobStatus struct {
+	ID          string     `json:"id"`
+	State       string     `json:"state"` // "running" or "done"
+	TotalTokens int        `json:"total_tokens"`
+	SentCount   int        `json:"sent_count"`
+	ErrorCount  int        `json:"error_count"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobAccepted is returned with 202 when /send runs asynchronously
+type JobAccepted struct {
+	JobID     string `json:"job_id"`
+	StatusURL string `json:"status_url"`
+	EventsURL string `json:"events_url"`
+}
+
+// broadcastJob tracks one background broadcast. Watchers wait on changed,
+// which is closed and replaced on every update.
+type broadcastJob struct {
+	mu      sync.Mutex
+	status  JobStatus
+	changed chan struct{}
+}
+
+// update applies fn to the status and wakes all watchers
+func (j *broadcastJob) update(fn func(*JobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// snapshot returns the current status and a channel closed on the next update
+func (j *broadcastJob) snapshot() (JobStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status, j.changed
+}
+
+// record counts one delivery attempt
+func (j *broadcastJob) record(opaqueID string, err error) {
+	j.update(func(s *JobStatus) {
+		if err != nil {
+			s.ErrorCount++
+		} else {
+			s.SentCount++
+		}
+	})
+}
+
+// jobRegistry holds running jobs and finished ones until they expire
+type jobRegistry struct {
+	mu      sync.Mutex
+	jobs    map[string]*broadcastJob
+	running int
+}
+
+var broadcastJobs = &jobRegistry{jobs: make(map[string]*broadcastJob)}
+
+// start registers a new job, or returns false when too many are running
+func (reg *jobRegistry) start(totalTokens int) (*broadcastJob, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.running >= *maxRunningJobs {
+		return nil, false
+	}
+	job := &broadcastJob{
+		status: JobStatus{
+			ID:          newRequestID(),
+			State:       "running",
+			TotalTokens: totalTokens,
+			CreatedAt:   time.Now().UTC(),
+		},
+		changed: make(chan struct{}),
+	}
+	reg.jobs[job.status.ID] = job
+	reg.running++
+	return job, true
+}
+
+// finish schedules the job's removal and marks it done. Watchers are woken
+// last, so they never observe a done job still counted as running.
+func (reg *jobRegistry) finish(job *broadcastJob) {
+	reg.mu.Lock()
+	reg.running--
+	reg.mu.Unlock()
+
+	time.AfterFunc(*jobRetention, func() {
+		reg.mu.Lock()
+		delete(reg.jobs, job.status.ID)
+		reg.mu.Unlock()
+	})
+
+	job.update(func(s *JobStatus) {
+		now := time.Now().UTC()
+		s.State = "done"
+		s.FinishedAt = &now
+	})
+}
+
+func (reg *jobRegistry) get(id string) *broadcastJob {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.jobs[id]
+}
+
+// preferAsync reports whether the client sent Prefer: respond-async (RFC 7240)
+func preferAsync(r *http.Request) bool {
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// startBroadcastJob runs a broadcast in the background and answers 202 with
+// the URLs to follow its progress
+func startBroadcastJob(w http.ResponseWriter, r *http.Request, tokens []*TokenStorageInfo, notif NotificationRequest) {
+	job, ok := broadcastJobs.start(len(tokens))
+	if !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(jobKeepAlive.Seconds())))
+		writeError(w, ErrServerBusy, "Too many broadcast jobs running")
+		return
+	}
+	id := job.status.ID
+
+	// The job outlives the request but keeps its logger and trace
+	logger := loggerFromContext(r.Context()).With("job_id", id)
+	ctx := withLogger(context.WithoutCancel(r.Context()), logger)
+	logger.Info("Broadcast job started", "total_tokens", len(tokens))
+
+	go func() {
+		defer reportPanic("broadcast job")
+		defer broadcastJobs.finish(job)
+
+		sent, failed := broadcastTokens(ctx, tokens, delivery{Title: notif.Title, Body: notif.Body, Critical: notif.Critical}, job.record)
+		logger.Info("Broadcast job finished", "sent_count", sent, "error_count", failed)
+	}()
+
+	statusURL := apiPrefix + "/jobs/" + id
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", statusURL)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.WriteHeader(http.StatusAccepted)
+	response := JobAccepted{JobID: id, StatusURL: statusURL, EventsURL: statusURL + "/events"}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// handleJobStatus serves a one-off snapshot of a broadcast job
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	job := broadcastJobs.get(r.PathValue("id"))
+	if job == nil {
+		writeError(w, ErrJobNotFound, "Job not found")
+		return
+	}
+
+	status, _ := job.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// handleJobEvents streams a job's progress as Server-Sent Events: a
+// "progress" event whenever the counts change and a final "done" event
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	job := broadcastJobs.get(r.PathValue("id"))
+	if job == nil {
+		writeError(w, ErrJobNotFound, "Job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	keepAlive := time.NewTicker(jobKeepAlive)
+	defer keepAlive.Stop()
+
+	for seq := 1; ; seq++ {
+		status, changed := job.snapshot()
+		event := "progress"
+		if status.State == "done" {
+			event = "done"
+		}
+		data, _ := json.Marshal(status)
+		if !writeSSE(w, rc, fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", seq, event, data)) || event == "done" {
+			return
+		}
+
+		// Wait for the next change, sending comments to keep the connection alive
+		throttle := time.After(jobEventMinInterval)
+		for waiting := true; waiting; {
+			select {
+			case <-changed:
+				waiting = false
+			case <-keepAlive.C:
+				if !writeSSE(w, rc, ": keep-alive\n\n") {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+		select {
+		case <-throttle:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes and flushes one chunk of the event stream, extending the
+// write deadline so the stream is not cut off by --write-timeout
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, chunk string) bool {
+	if *writeTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+	if _, err := fmt.Fprint(w, chunk); err != nil {
+		return false
+	}
+	rc.Flush()
+	return true
+}
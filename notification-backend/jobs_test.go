@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncBroadcastJobEvents(t *testing.T) {
+	originalStore, originalExoscale, originalClient := tokenStore, useExoscale, messagingClient
+	defer func() { tokenStore, useExoscale, messagingClient = originalStore, originalExoscale, originalClient }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+
+	for i := 0; i < 3; i++ {
+		if _, err := tokenStore.AddToken("encrypted", "android"); err != nil {
+			t.Fatalf("AddToken failed: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/v1/send", strings.NewReader(`{"title":"t","body":"b"}`))
+	req.Header.Set("Prefer", "respond-async")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var accepted JobAccepted
+	json.NewDecoder(resp.Body).Decode(&accepted)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted || accepted.JobID == "" || resp.Header.Get("Location") != accepted.StatusURL {
+		t.Fatalf("Expected 202 with a job, got %d %+v", resp.StatusCode, accepted)
+	}
+
+	resp, err = http.Get(server.URL + accepted.EventsURL)
+	if err != nil {
+		t.Fatalf("Events request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	// Read events until the job reports done; the server then closes the stream
+	var event string
+	var last JobStatus
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+		} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &last); err != nil {
+				t.Fatalf("Event data is not JSON: %v", err)
+			}
+		}
+	}
+
+	if event != "done" || last.State != "done" || last.ErrorCount != 3 || last.TotalTokens != 3 || last.FinishedAt == nil {
+		t.Errorf("Expected final done event with 3 failures, got %q %+v", event, last)
+	}
+
+	resp, err = http.Get(server.URL + accepted.StatusURL)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	var status JobStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.ID != accepted.JobID || status.State != "done" {
+		t.Errorf("Unexpected job status: %+v", status)
+	}
+}
+
+func TestJobNotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+
+	for _, path := range []string{"/v1/jobs/missing", "/v1/jobs/missing/events"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if rr.Code != http.StatusNotFound || resp.Code != ErrJobNotFound {
+			t.Errorf("%s: expected 404 JOB_NOT_FOUND, got %d %+v", path, rr.Code, resp)
+		}
+	}
+}
+
+func TestJobRegistryLimitsAndExpiry(t *testing.T) {
+	originalMax, originalRetention := *maxRunningJobs, *jobRetention
+	defer func() { *maxRunningJobs, *jobRetention = originalMax, originalRetention }()
+	*maxRunningJobs = 1
+	*jobRetention = 10 * time.Millisecond
+
+	reg := &jobRegistry{jobs: make(map[string]*broadcastJob)}
+	job, ok := reg.start(5)
+	if !ok {
+		t.Fatal("Expected first job to start")
+	}
+	if _, ok := reg.start(5); ok {
+		t.Error("Expected second job to be refused while the first runs")
+	}
+
+	_, changed := job.snapshot()
+	job.record("id", nil)
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected watchers to be woken by an update")
+	}
+
+	reg.finish(job)
+	if _, ok := reg.start(5); !ok {
+		t.Error("Expected a new job to start once the first finished")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for reg.get(job.status.ID) != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if reg.get(job.status.ID) != nil {
+		t.Error("Expected finished job to expire after --job-retention")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var listenAddr = flag.String("listen", "", "Listen address: host:port, unix:/path/to.sock, or systemd for socket activation (default :<port>, or the systemd socket when activated)")
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// createListener opens the server listener described by addr. An empty addr
+// uses a systemd-activated socket when one was passed, otherwise TCP on
+// fallbackPort.
+func createListener(addr, fallbackPort string) (net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		ln, err := systemdListener()
+		if err != nil {
+			return nil, err
+		}
+		if ln == nil {
+			return nil, fmt.Errorf("--listen=systemd but no socket was passed by systemd (LISTEN_FDS not set)")
+		}
+		return ln, nil
+
+	case strings.HasPrefix(addr, "unix:"):
+		return unixListener(strings.TrimPrefix(addr, "unix:"))
+
+	case addr == "":
+		ln, err := systemdListener()
+		if err != nil || ln != nil {
+			return ln, err
+		}
+		return net.Listen("tcp", ":"+fallbackPort)
+
+	default:
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+	}
+}
+
+// unixListener listens on a Unix domain socket, replacing a stale socket file
+// left behind by a previous run. The socket is made group-accessible so a
+// local reverse proxy in the service's group can connect.
+func unixListener(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("unix socket path is empty")
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return ln, nil
+}
+
+// systemdListener returns the first socket passed via systemd socket
+// activation, or nil if the process was not socket-activated
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(uintptr(listenFDsStart), "systemd-socket")
+	ln, err := net.FileListener(file)
+	file.Close() // FileListener dups the descriptor
+	if err != nil {
+		return nil, fmt.Errorf("failed to use systemd socket: %v", err)
+	}
+	return ln, nil
+}
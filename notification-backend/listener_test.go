@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateListenerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backend.sock")
+
+	ln, err := createListener("unix:"+path, "8080")
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Socket file not created: %v", err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket permissions 0660, got %v", info.Mode().Perm())
+	}
+	ln.Close()
+
+	// A stale socket from a previous run must not prevent startup
+	if _, err := net.Listen("unix", path); err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	ln, err = createListener("unix:"+path, "8080")
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+}
+
+func TestCreateListenerTCPAndSystemd(t *testing.T) {
+	ln, err := createListener("127.0.0.1:0", "8080")
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	if ln.Addr().Network() != "tcp" {
+		t.Errorf("Expected tcp listener, got %s", ln.Addr().Network())
+	}
+	ln.Close()
+
+	// Not socket-activated, so asking for systemd must fail clearly
+	t.Setenv("LISTEN_PID", "")
+	if _, err := createListener("systemd", "8080"); err == nil {
+		t.Error("Expected error when systemd socket is requested but not passed")
+	}
+}
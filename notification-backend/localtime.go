@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// LocalTimeBatch is the registrations of one time zone, delivered together
+type LocalTimeBatch struct {
+	Timezone string    `json:"timezone"`
+	SendAt   time.Time `json:"send_at"`
+	Count    int       `json:"count"`
+}
+
+// LocalTimeResponse is returned with 202 when a broadcast names a local_time
+type LocalTimeResponse struct {
+	Success        bool             `json:"success"`
+	Message        string           `json:"message"`
+	ScheduledCount int              `json:"scheduled_count"`
+	Batches        []LocalTimeBatch `json:"batches"`
+}
+
+// validateLocalTime checks the optional local_time of a broadcast
+func validateLocalTime(localTime string) error {
+	if _, ok := parseClock(localTime); localTime != "" && !ok {
+		return withCode(ErrInvalidRequest, fmt.Errorf("local_time must look like \"09:00\""))
+	}
+	return nil
+}
+
+// nextLocalTime is the next time the wall clock in loc shows minute after midnight
+func nextLocalTime(now time.Time, loc *time.Location, minute int) time.Time {
+	local := now.In(loc)
+	at := atClock(local, 0, minute)
+	if !at.After(now) {
+		at = atClock(local, 1, minute)
+	}
+	return at
+}
+
+// scheduleLocalTime queues notif for every token at the next notif.LocalTime
+// in the token's own time zone, one batch per zone, and answers with 202.
+// Registrations without a timezone are treated as UTC.
+func scheduleLocalTime(w http.ResponseWriter, r *http.Request, tokens []*TokenStorageInfo, notif NotificationRequest) {
+	logger := loggerFromContext(r.Context())
+	minute, _ := parseClock(notif.LocalTime)
+	now := time.Now()
+
+	zones := make(map[string]*LocalTimeBatch)
+	var messages []DeferredMessage
+	for _, token := range tokens {
+		zone := token.Timezone
+		loc, err := time.LoadLocation(zone)
+		if zone == "" || err != nil {
+			zone, loc = "UTC", time.UTC
+		}
+		batch, ok := zones[zone]
+		if !ok {
+			batch = &LocalTimeBatch{Timezone: zone, SendAt: nextLocalTime(now, loc, minute)}
+			zones[zone] = batch
+		}
+		batch.Count++
+		messages = append(messages, DeferredMessage{
+			TokenID:   token.OpaqueID,
+			Title:     notif.Title,
+			Body:      notif.Body,
+			Critical:  notif.Critical,
+			Reason:    deferLocalTime,
+			NotBefore: batch.SendAt,
+			CreatedAt: now,
+		})
+	}
+
+	var full bool
+	if _, err := updateDeferred(r.Context(), func(q *deferredQueue) bool {
+		if full = len(q.Messages)+len(messages) > *maxDeferred; full {
+			return false
+		}
+		q.Messages = append(q.Messages, messages...)
+		return true
+	}); err != nil {
+		logger.Error("Failed to schedule local-time send", "error", err)
+		writeError(w, errorCodeOf(err, ErrStorageUnavailable), "Failed to schedule notifications")
+		return
+	}
+	if full {
+		logger.Warn("Deferred queue full, refusing local-time send", "tokens", len(messages), "max", *maxDeferred)
+		w.Header().Set("Retry-After", fmt.Sprint(int(deferredInterval.Seconds())))
+		writeError(w, ErrServerBusy, fmt.Sprintf("Too many notifications waiting for delivery (--max-deferred %d)", *maxDeferred))
+		return
+	}
+
+	response := LocalTimeResponse{
+		Success:        true,
+		Message:        fmt.Sprintf("Scheduled for %s local time", notif.LocalTime),
+		ScheduledCount: len(messages),
+		Batches:        make([]LocalTimeBatch, 0, len(zones)),
+	}
+	for _, batch := range zones {
+		response.Batches = append(response.Batches, *batch)
+	}
+	sort.Slice(response.Batches, func(i, j int) bool {
+		if !response.Batches[i].SendAt.Equal(response.Batches[j].SendAt) {
+			return response.Batches[i].SendAt.Before(response.Batches[j].SendAt)
+		}
+		return response.Batches[i].Timezone < response.Batches[j].Timezone
+	})
+	logger.Info("Local-time send scheduled", "local_time", notif.LocalTime, "tokens", len(messages), "zones", len(zones))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextLocalTime(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+	now := time.Date(2026, time.October, 14, 8, 0, 0, 0, time.UTC) // 17:00 in Tokyo
+	if got, want := nextLocalTime(now, tokyo, 9*60), time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected tomorrow's 09:00 in Tokyo at %v, got %v", want, got)
+	}
+	if got, want := nextLocalTime(now, tokyo, 18*60), time.Date(2026, time.October, 14, 9, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected today's 18:00 in Tokyo at %v, got %v", want, got)
+	}
+	if got := nextLocalTime(now, time.UTC, 8*60); !got.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("Expected a time just reached to move to tomorrow, got %v", got)
+	}
+}
+
+func TestSendAtLocalTime(t *testing.T) {
+	if _, err := time.LoadLocation("Asia/Tokyo"); err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+	originalStore, originalExoscale, originalClient, originalMax := tokenStore, useExoscale, messagingClient, *maxDeferred
+	defer func() {
+		tokenStore, useExoscale, messagingClient, *maxDeferred = originalStore, originalExoscale, originalClient, originalMax
+	}()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+
+	for _, zone := range []string{"Asia/Tokyo", "Europe/Zurich", "Europe/Zurich", ""} {
+		if _, err := tokenStore.AddRegistration(TokenRegistration{EncryptedData: "encrypted", Platform: "android", Timezone: zone}, ""); err != nil {
+			t.Fatalf("AddRegistration failed: %v", err)
+		}
+	}
+
+	send := func(body string) (*httptest.ResponseRecorder, LocalTimeResponse, ErrorCode) {
+		rr := httptest.NewRecorder()
+		handleSend(rr, httptest.NewRequest("POST", "/v1/send", strings.NewReader(body)))
+		var resp LocalTimeResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr, resp, errResp.Code
+	}
+	if _, _, code := send(`{"title":"t","body":"b","local_time":"9am"}`); code != ErrInvalidRequest {
+		t.Errorf("Expected INVALID_REQUEST for a malformed local_time, got %s", code)
+	}
+
+	rr, resp, _ := send(`{"title":"t","body":"b","local_time":"09:00"}`)
+	if rr.Code != http.StatusAccepted || resp.ScheduledCount != 4 || len(resp.Batches) != 3 {
+		t.Fatalf("Expected four deliveries in three zones, got %d %s", rr.Code, rr.Body.String())
+	}
+	counts := make(map[string]int)
+	for i, batch := range resp.Batches {
+		counts[batch.Timezone] = batch.Count
+		if loc, _ := time.LoadLocation(batch.Timezone); batch.SendAt.In(loc).Format("15:04") != "09:00" {
+			t.Errorf("Batch %s is not sent at 09:00 local time: %v", batch.Timezone, batch.SendAt)
+		}
+		if i > 0 && batch.SendAt.Before(resp.Batches[i-1].SendAt) {
+			t.Errorf("Expected batches earliest first, got %+v", resp.Batches)
+		}
+	}
+	if counts["Asia/Tokyo"] != 1 || counts["Europe/Zurich"] != 2 || counts["UTC"] != 1 {
+		t.Errorf("Expected registrations batched by zone, got %v", counts)
+	}
+
+	// Nothing goes out before the first batch is due, then one zone at a time
+	if sent, failed := releaseDeferred(t.Context(), resp.Batches[0].SendAt.Add(-time.Second)); sent+failed != 0 {
+		t.Errorf("Expected nothing released early, got %d sent %d failed", sent, failed)
+	}
+	if _, failed := releaseDeferred(t.Context(), resp.Batches[0].SendAt); failed != resp.Batches[0].Count {
+		t.Errorf("Expected the first batch of %d attempted, got %d", resp.Batches[0].Count, failed)
+	}
+
+	*maxDeferred = 5
+	if rr, _, code := send(`{"title":"t","body":"b","local_time":"09:00"}`); code != ErrServerBusy || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected SERVER_BUSY once the queue would overflow, got %s", code)
+	}
+}
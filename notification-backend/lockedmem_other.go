@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// allocLocked is only implemented on Unix
+func allocLocked(n int) ([]byte, error) {
+	return nil, fmt.Errorf("locked memory is not supported on this platform")
+}
+
+func freeLocked(buf []byte) error {
+	clear(buf)
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocLocked maps n bytes outside the Go heap and locks them in RAM, so
+// what they hold is never swapped out nor moved by the garbage collector
+func allocLocked(n int) ([]byte, error) {
+	buf, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %d bytes: %v", n, err)
+	}
+	if err := unix.Mlock(buf); err != nil {
+		unix.Munmap(buf)
+		return nil, fmt.Errorf("failed to lock %d bytes in memory, see ulimit -l: %v", n, err)
+	}
+	return buf, nil
+}
+
+// freeLocked wipes and releases memory from allocLocked
+func freeLocked(buf []byte) error {
+	clear(buf)
+	return unix.Munmap(buf) // unmapping unlocks too
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// Logging configuration
+	logLevel  = flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logFormat = flag.String("log-format", "text", "Log format: text or json")
+)
+
+// setupLogging installs the default slog logger according to the level,
+// format and privacy flags. Output from the standard log package is routed
+// through it too.
+func setupLogging(w io.Writer, level, format, privacy string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	if err := validatePrivacy(privacy); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr(privacy)}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler).With("service", "notification-backend"))
+	return nil
+}
+
+// fatal logs at error level and exits, replacing log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	reportFatal(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID of the request being handled, if any,
+// so it can be attached to reported errors
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withLogger returns a context carrying the given request-scoped logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext returns the request-scoped logger, or the default logger
+// for background work that has no request attached
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// tokenIDPrefix shortens an opaque ID for logging
+func tokenIDPrefix(opaqueID string) string {
+	if len(opaqueID) <= 16 {
+		return opaqueID
+	}
+	return opaqueID[:16] + "..."
+}
+
+// newRequestID generates a short random identifier for correlating log lines
+func newRequestID() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// ResponseWriter wrapper to capture status code and response size
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bodySize   int64
+}
+
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
+
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	size, err := lrw.ResponseWriter.Write(b)
+	lrw.bodySize += int64(size)
+	return size, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// loggingMiddleware wraps HTTP handlers to provide structured logging. Each
+// request gets an ID (taken from X-Request-ID when the caller supplies one)
+// which is attached to every log line emitted while handling it.
+func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		r = r.WithContext(withLogger(ctx, logger))
+
+		// Create logging response writer
+		lrw := &loggingResponseWriter{
+			ResponseWriter: w,
+			statusCode:     200, // Default status code
+		}
+
+		// Call the next handler, recovering from panics
+		serveWithRecovery(lrw, r, next)
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", getClientIP(r),
+			"user_agent", r.UserAgent(),
+			"status_code", lrw.statusCode,
+			"response_time_ms", time.Since(start).Milliseconds(),
+			"body_size", lrw.bodySize,
+		}
+
+		// Add error field for non-2xx responses
+		level := slog.LevelInfo
+		if lrw.statusCode >= 400 {
+			attrs = append(attrs, "error", http.StatusText(lrw.statusCode))
+			level = slog.LevelWarn
+		}
+
+		logger.Log(r.Context(), level, "request", attrs...)
+	}
+}
+
+// getClientIP extracts the real client IP from request headers
+func getClientIP(r *http.Request) string {
+	// Check X-Forwarded-For header (for proxies/load balancers)
+	if xForwardedFor := r.Header.Get("X-Forwarded-For"); xForwardedFor != "" {
+		// X-Forwarded-For can contain multiple IPs, take the first one
+		ifs := strings.Split(xForwardedFor, ",")
+		if len(ifs) > 0 {
+			return strings.TrimSpace(ifs[0])
+		}
+	}
+
+	// Check X-Real-IP header (for nginx)
+	if xRealIP := r.Header.Get("X-Real-IP"); xRealIP != "" {
+		return xRealIP
+	}
+
+	// Fall back to RemoteAddr
+	// Remove port if present
+	if idx := strings.LastIndex(r.RemoteAddr, ":"); idx != -1 {
+		return r.RemoteAddr[:idx]
+	}
+	return r.RemoteAddr
+}
@@ -8,62 +8,79 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
-	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
-	"google.golang.org/api/option"
+
+	"remote-notification/api"
 )
 
 var (
 	// Command-line configuration
 	port                  = flag.String("port", "8080", "Port to listen on")
-	serviceAccountKeyPath = flag.String("firebase-key", "key.json", "Path to Firebase service account key file")
+	serviceAccountKeyPath = flag.String("firebase-key", "key.json", "Path to Firebase service account key file; empty uses Application Default Credentials (GOOGLE_APPLICATION_CREDENTIALS or workload identity)")
 	privateKeyPath        = flag.String("private-key", "private_key.pem", "Path to RSA private key file")
 	publicKeyPath         = flag.String("public-key", "public_key.pem", "Path to RSA public key file")
 	storageFile           = flag.String("storage-file", "tokens.json", "Path to token storage file (fallback only)")
-	
+
 	// Exoscale SOS configuration
 	sosAccessKey = flag.String("sos-access-key", "", "Exoscale SOS access key")
 	sosSecretKey = flag.String("sos-secret-key", "", "Exoscale SOS secret key")
 	sosBucket    = flag.String("sos-bucket", "notification-tokens", "Exoscale SOS bucket name")
 	sosZone      = flag.String("sos-zone", "ch-gva-2", "Exoscale SOS zone")
-	
+
+	// Deadlines for external calls
+	fcmTimeout     = flag.Duration("fcm-timeout", 10*time.Second, "Timeout for a single FCM send")
+	storageTimeout = flag.Duration("storage-timeout", 5*time.Second, "Timeout for a single SOS storage operation")
+
+	// OpenTelemetry configuration
+	otelEndpoint = flag.String("otel-endpoint", "", "OTLP/HTTP trace collector endpoint (host:port); empty uses OTEL_EXPORTER_OTLP_ENDPOINT or disables tracing")
+	otelInsecure = flag.Bool("otel-insecure", false, "Use plain HTTP for the OTLP trace exporter")
+
 	version = "dev" // Set by build flags
 )
 
-type ServiceAccountKey struct {
-	ProjectID string `json:"project_id"`
-}
-
-type TokenRegistration struct {
-	EncryptedData string `json:"encrypted_data"`
-	Platform      string `json:"platform"`
-}
+// The API's request and response shapes are shared with the app-backend and
+// Go callers through the api module
+type (
+	TokenRegistration         = api.TokenRegistration
+	RegisterResponse          = api.RegisterResponse
+	ChallengeResponse         = api.ChallengeResponse
+	SingleNotificationRequest = api.NotificationRequest
+	NotifyResponse            = api.NotifyResponse
+	NotificationRequest       = api.SendRequest
+	SendResponse              = api.SendResponse
+)
 
 // FCMMessage struct removed - now using Firebase Admin SDK messaging.Message
 
-type NotificationRequest struct {
-	Title string `json:"title"`
-	Body  string `json:"body"`
-}
-
-type SingleNotificationRequest struct {
-	TokenID       string `json:"token_id"`                   // Opaque ID field (required)
-	PublicKeyHash string `json:"public_key_hash,omitempty"` // Public key hash for storage key
-	Title         string `json:"title"`
-	Body          string `json:"body"`
+// validateBroadcast checks a notification for /v1/send or a group send
+func validateBroadcast(notif NotificationRequest) error {
+	if len(notif.Variants) == 0 && (notif.Title == "" || notif.Body == "") {
+		return withCode(ErrMissingField, fmt.Errorf("title and body are required"))
+	}
+	if notif.Platform != "" {
+		if err := validatePlatform(notif.Platform); err != nil {
+			return err
+		}
+	}
+	if err := validateLocalTime(notif.LocalTime); err != nil {
+		return err
+	}
+	if len(notif.Variants) > 0 && notif.LocalTime != "" {
+		return withCode(ErrInvalidRequest, fmt.Errorf("a split send cannot be scheduled for local_time"))
+	}
+	return validateVariants(notif.Experiment, notif.Variants)
 }
 
 // TokenMapping represents a stored token mapping
@@ -72,68 +89,146 @@ type TokenMapping struct {
 	EncryptedData string    `json:"encrypted_data"`
 	Platform      string    `json:"platform"`
 	RegisteredAt  time.Time `json:"registered_at"`
+
+	EncryptedEmail string `json:"encrypted_email,omitempty"`
+	EncryptedPhone string `json:"encrypted_phone,omitempty"`
+
+	Channels        []ChannelRegistration `json:"channels,omitempty"`
+	FirebaseProject string                `json:"firebase_project,omitempty"`
+
+	NotifySecretHash string `json:"notify_secret_hash,omitempty"`
+
+	Metadata *DeviceMetadata `json:"metadata,omitempty"`
+	UserHash string          `json:"user_hash,omitempty"`
+
+	Timezone   string `json:"timezone,omitempty"`
+	QuietHours string `json:"quiet_hours,omitempty"`
+
+	// Pending holds undelivered messages for platform "poll"
+	Pending *pendingQueue `json:"pending,omitempty"`
+
+	// PendingUpload marks a registration taken during an SOS outage, kept
+	// here until it is uploaded to SOS
+	PendingUpload bool `json:"pending_upload,omitempty"`
+
+	// InSOS marks a registration SOS also held when the server last started,
+	// so one missing there since was deleted rather than never uploaded
+	InSOS bool `json:"in_sos,omitempty"`
 }
 
 // DurableTokenStore provides persistent token storage
 type DurableTokenStore struct {
 	mu          sync.RWMutex
 	mappings    map[string]*TokenMapping // opaque_id -> TokenMapping
+	groups      map[string]*DeviceGroup  // name -> DeviceGroup
+	experiments map[string]*Experiment   // name -> Experiment
+	templates   map[string]*NotificationTemplate
+	deferred    deferredQueue
 	storageFile string
+	groupsFile  string // groups live beside the tokens, keeping the token file format unchanged
+	// deferredFile holds notifications waiting for quiet hours to end
+	deferredFile    string
+	experimentsFile string
+	templatesFile   string
+
+	clock Clock       // stamps registrations, groups, experiments and templates
+	ids   IDGenerator // issues the opaque IDs of registrations
 }
 
 func NewDurableTokenStore(storageFile string) *DurableTokenStore {
 	store := &DurableTokenStore{
-		mappings:    make(map[string]*TokenMapping),
-		storageFile: storageFile,
+		mappings:     make(map[string]*TokenMapping),
+		groups:       make(map[string]*DeviceGroup),
+		experiments:  make(map[string]*Experiment),
+		templates:    make(map[string]*NotificationTemplate),
+		storageFile:  storageFile,
+		groupsFile:   strings.TrimSuffix(storageFile, ".json") + "-groups.json",
+		deferredFile: strings.TrimSuffix(storageFile, ".json") + "-deferred.json",
+
+		experimentsFile: strings.TrimSuffix(storageFile, ".json") + "-experiments.json",
+		templatesFile:   strings.TrimSuffix(storageFile, ".json") + "-templates.json",
+
+		clock: systemClock{},
+		ids:   randomIDs{},
 	}
 
 	// Load existing tokens from file
 	if err := store.loadFromFile(); err != nil {
-		log.Printf("Warning: Could not load existing tokens: %v", err)
+		slog.Warn("Could not load existing tokens", "error", err)
+	}
+	if err := store.loadGroups(); err != nil {
+		slog.Warn("Could not load existing groups", "error", err)
+	}
+	if err := store.loadDeferred(); err != nil {
+		slog.Warn("Could not load deferred notifications", "error", err)
+	}
+	if err := store.loadExperiments(); err != nil {
+		slog.Warn("Could not load experiments", "error", err)
+	}
+	if err := store.loadTemplates(); err != nil {
+		slog.Warn("Could not load templates", "error", err)
 	}
 
 	return store
 }
 
-func (ts *DurableTokenStore) generateOpaqueID() string {
-	// Generate 32 random bytes (256 bits)
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		log.Printf("Error generating random bytes: %v", err)
-		// Fallback to timestamp + random for uniqueness
-		return fmt.Sprintf("%d_%x", time.Now().UnixNano(), bytes[:16])
-	}
-	return hex.EncodeToString(bytes)
+func (ts *DurableTokenStore) AddToken(encryptedData, platform string) (string, error) {
+	return ts.AddRegistration(TokenRegistration{EncryptedData: encryptedData, Platform: platform}, "")
 }
 
-func (ts *DurableTokenStore) AddToken(encryptedData, platform string) (string, error) {
+// AddRegistration stores a registration with its optional fallback addresses
+// and channels, and the hash of its notify secret
+func (ts *DurableTokenStore) AddRegistration(reg TokenRegistration, notifySecretHash string) (string, error) {
+	return ts.addRegistration(reg, notifySecretHash, false)
+}
+
+// AddPendingUpload stores a registration SOS could not take, to be uploaded
+// once it recovers
+func (ts *DurableTokenStore) AddPendingUpload(reg TokenRegistration, notifySecretHash string) (string, error) {
+	return ts.addRegistration(reg, notifySecretHash, true)
+}
+
+func (ts *DurableTokenStore) addRegistration(reg TokenRegistration, notifySecretHash string, pendingUpload bool) (string, error) {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
-	opaqueID := ts.generateOpaqueID()
+	opaqueID := ts.ids.NewID()
 
 	// Ensure uniqueness (extremely unlikely collision, but handle it)
 	for _, exists := ts.mappings[opaqueID]; exists; {
-		opaqueID = ts.generateOpaqueID()
+		opaqueID = ts.ids.NewID()
 		_, exists = ts.mappings[opaqueID]
 	}
 
 	mapping := &TokenMapping{
-		OpaqueID:      opaqueID,
-		EncryptedData: encryptedData,
-		Platform:      platform,
-		RegisteredAt:  time.Now(),
+		OpaqueID:        opaqueID,
+		EncryptedData:   reg.EncryptedData,
+		Platform:        reg.Platform,
+		RegisteredAt:    ts.clock.Now(),
+		EncryptedEmail:  reg.EncryptedEmail,
+		EncryptedPhone:  reg.EncryptedPhone,
+		Channels:        reg.Channels,
+		FirebaseProject: reg.FirebaseProject,
+
+		NotifySecretHash: notifySecretHash,
+		Metadata:         registrationMetadata(reg),
+		UserHash:         reg.UserHash,
+		Timezone:         reg.Timezone,
+		QuietHours:       reg.QuietHours,
+
+		PendingUpload: pendingUpload,
 	}
 
 	ts.mappings[opaqueID] = mapping
 
 	// Persist to file
 	if err := ts.saveToFile(); err != nil {
-		log.Printf("Warning: Failed to persist token to file: %v", err)
+		slog.Warn("Failed to persist token to file", "error", err)
+		reportError(context.Background(), "storage", err, "op", "saveToFile")
 	}
 
-	log.Printf("Token registered with opaque ID: %s...%s (platform: %s, total: %d)",
-		opaqueID[:8], opaqueID[len(opaqueID)-8:], platform, len(ts.mappings))
+	slog.Info("Token registered in file storage",
+		"token_id", opaqueID, "platform", reg.Platform, "total", len(ts.mappings), "pending_upload", pendingUpload)
 
 	return opaqueID, nil
 }
@@ -150,6 +245,254 @@ func (ts *DurableTokenStore) GetEncryptedToken(opaqueID string) (string, error)
 	return mapping.EncryptedData, nil
 }
 
+// GetMapping returns a copy of the stored registration, including its platform
+func (ts *DurableTokenStore) GetMapping(opaqueID string) (TokenMapping, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	mapping, exists := ts.mappings[opaqueID]
+	if !exists {
+		return TokenMapping{}, fmt.Errorf("opaque ID not found")
+	}
+
+	return *mapping, nil
+}
+
+// UpdatePending applies update to a registration's pending messages and
+// persists the result
+func (ts *DurableTokenStore) UpdatePending(opaqueID string, update func(*pendingQueue) bool) (pendingQueue, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	mapping, exists := ts.mappings[opaqueID]
+	if !exists {
+		return pendingQueue{}, withCode(ErrTokenNotFound, fmt.Errorf("opaque ID not found"))
+	}
+	if mapping.Pending == nil {
+		mapping.Pending = &pendingQueue{}
+	}
+	if update(mapping.Pending) {
+		if err := ts.saveToFile(); err != nil {
+			return pendingQueue{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist pending messages: %v", err))
+		}
+	}
+	return mapping.Pending.clone(), nil
+}
+
+// GetGroup returns the named device group
+func (ts *DurableTokenStore) GetGroup(name string) (DeviceGroup, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	group, exists := ts.groups[name]
+	if !exists {
+		return DeviceGroup{}, withCode(ErrGroupNotFound, fmt.Errorf("group %q not found", name))
+	}
+	return group.clone(), nil
+}
+
+// UpdateGroup applies update to the named group, creating it first when
+// create is set, and persists the result
+func (ts *DurableTokenStore) UpdateGroup(name string, create bool, update func(*DeviceGroup)) (DeviceGroup, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	group, exists := ts.groups[name]
+	if !exists {
+		if !create {
+			return DeviceGroup{}, withCode(ErrGroupNotFound, fmt.Errorf("group %q not found", name))
+		}
+		group = &DeviceGroup{Name: name, CreatedAt: ts.clock.Now()}
+		ts.groups[name] = group
+	}
+	update(group)
+	group.UpdatedAt = ts.clock.Now()
+	if err := ts.saveGroups(); err != nil {
+		return DeviceGroup{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist group: %v", err))
+	}
+	return group.clone(), nil
+}
+
+// DeleteGroup removes the named group; its members stay registered
+func (ts *DurableTokenStore) DeleteGroup(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, exists := ts.groups[name]; !exists {
+		return withCode(ErrGroupNotFound, fmt.Errorf("group %q not found", name))
+	}
+	delete(ts.groups, name)
+	if err := ts.saveGroups(); err != nil {
+		return withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist groups: %v", err))
+	}
+	return nil
+}
+
+// ListGroups returns every device group
+func (ts *DurableTokenStore) ListGroups() []DeviceGroup {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	groups := make([]DeviceGroup, 0, len(ts.groups))
+	for _, group := range ts.groups {
+		groups = append(groups, group.clone())
+	}
+	return groups
+}
+
+// UpdateDeferred applies update to the notifications held back by quiet
+// hours and persists the result
+func (ts *DurableTokenStore) UpdateDeferred(update func(*deferredQueue) bool) (deferredQueue, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if update(&ts.deferred) {
+		if err := writeJSONFile(ts.deferredFile, ts.deferred); err != nil {
+			return deferredQueue{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist deferred notifications: %v", err))
+		}
+	}
+	return ts.deferred.clone(), nil
+}
+
+// GetExperiment returns the named split send experiment
+func (ts *DurableTokenStore) GetExperiment(name string) (Experiment, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	experiment, exists := ts.experiments[name]
+	if !exists {
+		return Experiment{}, withCode(ErrExperimentNotFound, fmt.Errorf("experiment %q not found", name))
+	}
+	return experiment.clone(), nil
+}
+
+// UpdateExperiment applies update to the named experiment, creating it first
+// when missing, and persists the result
+func (ts *DurableTokenStore) UpdateExperiment(name string, update func(*Experiment)) (Experiment, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	experiment, exists := ts.experiments[name]
+	if !exists {
+		experiment = &Experiment{Name: name, Assignments: make(map[string]string), CreatedAt: ts.clock.Now()}
+		ts.experiments[name] = experiment
+	}
+	update(experiment)
+	experiment.UpdatedAt = ts.clock.Now()
+	if err := writeJSONFile(ts.experimentsFile, ts.experiments); err != nil {
+		return Experiment{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist experiment: %v", err))
+	}
+	return experiment.clone(), nil
+}
+
+// GetTemplate returns the named notification template
+func (ts *DurableTokenStore) GetTemplate(name string) (NotificationTemplate, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	tmpl, exists := ts.templates[name]
+	if !exists {
+		return NotificationTemplate{}, withCode(ErrTemplateNotFound, fmt.Errorf("template %q not found", name))
+	}
+	return tmpl.clone(), nil
+}
+
+// PutTemplate stores a template, keeping the creation time of the one it
+// replaces, and persists the result
+func (ts *DurableTokenStore) PutTemplate(tmpl NotificationTemplate) (NotificationTemplate, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tmpl.CreatedAt, tmpl.UpdatedAt = ts.clock.Now(), ts.clock.Now()
+	if old, exists := ts.templates[tmpl.Name]; exists {
+		tmpl.CreatedAt = old.CreatedAt
+	}
+	ts.templates[tmpl.Name] = &tmpl
+	if err := writeJSONFile(ts.templatesFile, ts.templates); err != nil {
+		return NotificationTemplate{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist template: %v", err))
+	}
+	return tmpl.clone(), nil
+}
+
+// DeleteTemplate removes the named template
+func (ts *DurableTokenStore) DeleteTemplate(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, exists := ts.templates[name]; !exists {
+		return withCode(ErrTemplateNotFound, fmt.Errorf("template %q not found", name))
+	}
+	delete(ts.templates, name)
+	if err := writeJSONFile(ts.templatesFile, ts.templates); err != nil {
+		return withCode(ErrStorageUnavailable, fmt.Errorf("failed to persist templates: %v", err))
+	}
+	return nil
+}
+
+// ListTemplates returns every notification template
+func (ts *DurableTokenStore) ListTemplates() []NotificationTemplate {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	templates := make([]NotificationTemplate, 0, len(ts.templates))
+	for _, tmpl := range ts.templates {
+		templates = append(templates, tmpl.clone())
+	}
+	return templates
+}
+
+// GetPendingUpload returns a registration waiting to be uploaded to SOS
+func (ts *DurableTokenStore) GetPendingUpload(opaqueID string) (TokenMapping, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	mapping, exists := ts.mappings[opaqueID]
+	if !exists || !mapping.PendingUpload {
+		return TokenMapping{}, false
+	}
+	return *mapping, true
+}
+
+// PendingUploads returns copies of the registrations waiting for SOS
+func (ts *DurableTokenStore) PendingUploads() []TokenMapping {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	var pending []TokenMapping
+	for _, mapping := range ts.mappings {
+		if mapping.PendingUpload {
+			pending = append(pending, *mapping)
+		}
+	}
+	return pending
+}
+
+// UpdateMappings applies update to every registration at once, under the
+// store's lock, and persists the result if update reports a change
+func (ts *DurableTokenStore) UpdateMappings(update func(mappings map[string]*TokenMapping) bool) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !update(ts.mappings) {
+		return nil
+	}
+	return ts.saveToFile()
+}
+
+// RemoveMapping drops a registration once it has been uploaded to SOS,
+// returning it as it was last
+func (ts *DurableTokenStore) RemoveMapping(opaqueID string) (TokenMapping, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	mapping, exists := ts.mappings[opaqueID]
+	if !exists {
+		return TokenMapping{}, fmt.Errorf("opaque ID not found")
+	}
+	delete(ts.mappings, opaqueID)
+	return *mapping, ts.saveToFile()
+}
+
 func (ts *DurableTokenStore) GetAllOpaqueIDs() []string {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
@@ -185,7 +528,7 @@ func (ts *DurableTokenStore) loadFromFile() error {
 		ts.mappings[mapping.OpaqueID] = mapping
 	}
 
-	log.Printf("Loaded %d tokens from storage file", len(mappings))
+	slog.Info("Loaded tokens from storage file", "count", len(mappings), "file", ts.storageFile)
 	return nil
 }
 
@@ -195,537 +538,970 @@ func (ts *DurableTokenStore) saveToFile() error {
 	for _, mapping := range ts.mappings {
 		mappings = append(mappings, mapping)
 	}
+	return writeJSONFile(ts.storageFile, mappings)
+}
 
-	data, err := json.MarshalIndent(mappings, "", "  ")
+func (ts *DurableTokenStore) loadGroups() error {
+	data, err := os.ReadFile(ts.groupsFile)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 
-	// Write to temporary file first, then rename (atomic operation)
-	tempFile := ts.storageFile + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+	var groups []*DeviceGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
 		return err
 	}
+	for _, group := range groups {
+		ts.groups[group.Name] = group
+	}
+	return nil
+}
 
-	return os.Rename(tempFile, ts.storageFile)
+func (ts *DurableTokenStore) saveGroups() error {
+	groups := make([]*DeviceGroup, 0, len(ts.groups))
+	for _, group := range ts.groups {
+		groups = append(groups, group)
+	}
+	return writeJSONFile(ts.groupsFile, groups)
 }
 
-// RequestLog represents a structured log entry for HTTP requests
-type RequestLog struct {
-	Timestamp    time.Time `json:"timestamp"`
-	Method       string    `json:"method"`
-	Path         string    `json:"path"`
-	RemoteAddr   string    `json:"remote_addr"`
-	UserAgent    string    `json:"user_agent"`
-	StatusCode   int       `json:"status_code"`
-	ResponseTime int64     `json:"response_time_ms"`
-	BodySize     int64     `json:"body_size"`
-	Error        string    `json:"error,omitempty"`
+func (ts *DurableTokenStore) loadDeferred() error {
+	data, err := os.ReadFile(ts.deferredFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &ts.deferred)
 }
 
-// ResponseWriter wrapper to capture status code and response size
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-	bodySize   int64
+func (ts *DurableTokenStore) loadExperiments() error {
+	data, err := os.ReadFile(ts.experimentsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &ts.experiments)
 }
 
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
+func (ts *DurableTokenStore) loadTemplates() error {
+	data, err := os.ReadFile(ts.templatesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &ts.templates)
 }
 
-func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
-	size, err := lrw.ResponseWriter.Write(b)
-	lrw.bodySize += int64(size)
-	return size, err
+// writeJSONFile writes v to a temporary file first, then renames it into
+// place (atomic operation)
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile, path)
 }
 
 var (
 	tokenStore      *DurableTokenStore
 	exoscaleStorage *ExoscaleStorage
-	messagingClient *messaging.Client
+	messagingClient Messenger // nil until Firebase is initialized
 	privateKey      *rsa.PrivateKey
 	publicKeyHash   string
 	useExoscale     bool
 )
 
-// loggingMiddleware wraps HTTP handlers to provide structured logging
-func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		// Create logging response writer
-		lrw := &loggingResponseWriter{
-			ResponseWriter: w,
-			statusCode:     200, // Default status code
-		}
-		
-		// Call the next handler
-		next(lrw, r)
-		
-		// Calculate response time
-		responseTime := time.Since(start).Milliseconds()
-		
-		// Create structured log entry
-		logEntry := RequestLog{
-			Timestamp:    start,
-			Method:       r.Method,
-			Path:         r.URL.Path,
-			RemoteAddr:   getClientIP(r),
-			UserAgent:    r.UserAgent(),
-			StatusCode:   lrw.statusCode,
-			ResponseTime: responseTime,
-			BodySize:     lrw.bodySize,
-		}
-		
-		// Add error field for non-2xx responses
-		if lrw.statusCode >= 400 {
-			logEntry.Error = http.StatusText(lrw.statusCode)
-		}
-		
-		// Log as JSON
-		logJSON, err := json.Marshal(logEntry)
-		if err != nil {
-			log.Printf("Error marshaling log entry: %v", err)
-			return
-		}
-		
-		log.Printf("REQUEST_LOG: %s", string(logJSON))
+func main() {
+	flag.Parse()
+
+	logOutput, err := openLogOutput(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening log file: %v\n", err)
+		os.Exit(2)
+	}
+	if err := setupLogging(logOutput, *logLevel, *logFormat, *logPrivacy); err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring logging: %v\n", err)
+		os.Exit(2)
+	}
+
+	slog.Info("Notification Backend Server starting", "version", version, "git_commit", gitCommit, "build_date", buildDate)
+	slog.Info("Configuration",
+		"port", *port,
+		"listen", *listenAddr,
+		"firebase_key", *serviceAccountKeyPath,
+		"firebase_project_id", *firebaseProjectID,
+		"fcm_endpoint", *fcmEndpoint,
+		"private_key", *privateKeyPath,
+		"public_key", *publicKeyPath,
+		"storage_file", *storageFile,
+		"sos_bucket", *sosBucket,
+		"sos_zone", *sosZone,
+		"sos_access_key", maskString(*sosAccessKey),
+		"otel_endpoint", *otelEndpoint,
+		"fcm_timeout", *fcmTimeout,
+		"storage_timeout", *storageTimeout,
+		"log_level", *logLevel,
+		"log_format", *logFormat,
+		"log_file", *logFile,
+		"log_privacy", *logPrivacy,
+		"debug_addr", *debugAddr,
+		"sentry_environment", *sentryEnvironment,
+		"fcm_failure_threshold", *fcmFailureThreshold,
+		"max_inflight_sends", *maxInFlightSends,
+		"send_concurrency", *sendConcurrency,
+		"fcm_batch_size", *fcmBatchSize,
+		"token_cache_size", *tokenCacheSize,
+		"token_cache_ttl", *tokenCacheTTL,
+		"decrypted_token_cache", *decryptedTokenCache,
+		"decrypted_token_cache_size", *decryptedTokenCacheSize,
+		"decrypted_token_cache_ttl", *decryptedTokenCacheTTL,
+		"max_queued_sends", *maxQueuedSends,
+		"send_queue_timeout", *sendQueueTimeout,
+		"read_header_timeout", *readHeaderTimeout,
+		"read_timeout", *readTimeout,
+		"write_timeout", *writeTimeout,
+		"idle_timeout", *idleTimeout,
+		"probe_interval", *probeInterval,
+		"fcm_latency_threshold", *fcmLatencyThreshold,
+		"storage_latency_threshold", *storageLatencyThreshold,
+		"storage_chaos_rate", *storageChaosRate,
+		"storage_chaos_code", *storageChaosCode,
+		"storage_chaos_ops", *storageChaosOps,
+		"storage_chaos_latency", *storageChaosLatency,
+		"sos_failover_threshold", *sosFailoverThreshold,
+		"sos_reconcile_interval", *sosReconcileInterval,
+		"sos_sync_upload", *sosSyncUpload,
+		"sos_sync_download", *sosSyncDownload,
+	)
+
+	// Error reporting is set up first so startup failures are captured too
+	flushErrors, err := setupErrorReporting(*sentryDSN, *sentryEnvironment)
+	if err != nil {
+		fatal("Error initializing error reporting", "error", err)
 	}
-}
+	defer flushErrors()
 
-// getClientIP extracts the real client IP from request headers
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for proxies/load balancers)
-	if xForwardedFor := r.Header.Get("X-Forwarded-For"); xForwardedFor != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ifs := strings.Split(xForwardedFor, ",")
-		if len(ifs) > 0 {
-			return strings.TrimSpace(ifs[0])
-		}
+	setupRawAPI(*rawAPIKeyFlag)
+	if err := setupWebPush(*vapidPrivateKeyPath); err != nil {
+		fatal("Error loading VAPID key", "error", err)
 	}
-	
-	// Check X-Real-IP header (for nginx)
-	if xRealIP := r.Header.Get("X-Real-IP"); xRealIP != "" {
-		return xRealIP
+	if err := setupNtfy(*ntfyServer, *ntfyTokenArg); err != nil {
+		fatal("Error configuring ntfy", "error", err)
 	}
-	
-	// Fall back to RemoteAddr
-	// Remove port if present
-	if idx := strings.LastIndex(r.RemoteAddr, ":"); idx != -1 {
-		return r.RemoteAddr[:idx]
+	if err := setupHMS(*hmsAppID, *hmsAppSecretArg); err != nil {
+		fatal("Error configuring HMS", "error", err)
 	}
-	return r.RemoteAddr
-}
+	if err := setupTelegram(*telegramBotTokenArg); err != nil {
+		fatal("Error configuring Telegram", "error", err)
+	}
+	if err := setupPushover(*pushoverAppTokenArg); err != nil {
+		fatal("Error configuring Pushover", "error", err)
+	}
+	if err := setupEmail(*smtpAddr); err != nil {
+		fatal("Error configuring email fallback", "error", err)
+	}
+	if err := setupSMS(*smsProviderName); err != nil {
+		fatal("Error configuring SMS fallback", "error", err)
+	}
+	if err := setupGotify(*gotifyAppsFile); err != nil {
+		fatal("Error configuring Gotify apps", "error", err)
+	}
+	if err := setupWNS(*wnsPackageSID, *wnsClientSecretArg); err != nil {
+		fatal("Error configuring WNS", "error", err)
+	}
+	closeMQTT, err := setupMQTT(*mqttBroker)
+	if err != nil {
+		fatal("Error configuring MQTT", "error", err)
+	}
+	defer closeMQTT()
 
-func main() {
-	flag.Parse()
+	// Initialize tracing before anything makes outbound calls
+	shutdownTracing, err := setupTracing(context.Background(), *otelEndpoint, *otelInsecure)
+	if err != nil {
+		fatal("Error initializing tracing", "error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Error shutting down tracing", "error", err)
+		}
+	}()
+
+	// Preflight mode: validate everything, report and exit without serving
+	if *checkConfig {
+		if !printConfigReport(os.Stdout, runConfigChecks(context.Background())) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	log.Printf("Notification Backend Server v%s", version)
-	log.Printf("Configuration:")
-	log.Printf("  Port: %s", *port)
-	log.Printf("  Firebase Key: %s", *serviceAccountKeyPath)
-	log.Printf("  Private Key: %s", *privateKeyPath)
-	log.Printf("  Public Key: %s", *publicKeyPath)
-	log.Printf("  Storage File: %s (fallback)", *storageFile)
-	log.Printf("  SOS Bucket: %s", *sosBucket)
-	log.Printf("  SOS Zone: %s", *sosZone)
-	log.Printf("  SOS Access Key: %s", maskString(*sosAccessKey))
-	
 	// Determine if we should use Exoscale SOS
 	useExoscale = *sosAccessKey != "" && *sosSecretKey != ""
 
-	// Read project ID from service account key
-	projectID, err := readProjectIDFromKey(*serviceAccountKeyPath)
-	if err != nil {
-		log.Fatalf("Error reading project ID from key file: %v", err)
-	}
-
 	// Initialize Firebase Admin SDK
 	ctx := context.Background()
-	opt := option.WithCredentialsFile(*serviceAccountKeyPath)
-	app, err := firebase.NewApp(ctx, &firebase.Config{
-		ProjectID: projectID,
-	}, opt)
-	if err != nil {
-		log.Fatalf("Error initializing Firebase app: %v", err)
+	if *mockFCM {
+		messagingClient = &mockMessenger{latency: *mockFCMLatency}
+		slog.Warn("FCM is mocked: sends are accepted but nothing is delivered", "latency", *mockFCMLatency)
+	} else {
+		messagingClient, _, err = newMessagingClient(ctx, *serviceAccountKeyPath, *firebaseProjectID)
+		if err != nil {
+			fatal("Error initializing Firebase", "error", err)
+		}
+		if err := setupFirebaseProjects(ctx, *firebaseProjectsFile); err != nil {
+			fatal("Error initializing Firebase projects", "error", err)
+		}
+		slog.Info("Firebase Admin SDK initialized successfully", "projects", firebaseProjectLabels())
 	}
-
-	messagingClient, err = app.Messaging(ctx)
-	if err != nil {
-		log.Fatalf("Error getting Messaging client: %v", err)
+	if err := setupPlayIntegrity(ctx, *playIntegrityPackage); err != nil {
+		fatal("Error configuring Play Integrity", "error", err)
 	}
 
-	log.Printf("Firebase Admin SDK initialized successfully")
-
 	// Load RSA private key for token decryption
 	privateKey, err = loadPrivateKey(*privateKeyPath)
 	if err != nil {
-		log.Fatalf("Error loading private key: %v", err)
+		fatal("Error loading private key", "error", err)
 	}
-	log.Printf("RSA private key loaded successfully")
-	
+	slog.Info("RSA private key loaded successfully")
+
 	// Load public key and compute hash
 	publicKeyPEM, err := readPublicKeyPEM(*publicKeyPath)
 	if err != nil {
-		log.Fatalf("Error loading public key: %v", err)
+		fatal("Error loading public key", "error", err)
 	}
 	publicKeyHash = ComputePublicKeyHash(publicKeyPEM)
-	log.Printf("Public key hash computed: %s", publicKeyHash[:16]+"...")
+	slog.Info("Public key hash computed", "public_key_hash", publicKeyHash[:16]+"...")
 
 	// Initialize storage layer
 	if useExoscale {
 		// Initialize Exoscale SOS storage
-		exoscaleStorage, err = NewExoscaleStorage(*sosAccessKey, *sosSecretKey, *sosBucket, *sosZone, publicKeyHash)
+		exoscaleStorage, err = NewExoscaleStorage(*sosAccessKey, *sosSecretKey, *sosBucket, *sosZone, publicKeyHash, *storageTimeout)
 		if err != nil {
-			log.Fatalf("Error initializing Exoscale SOS storage: %v", err)
+			fatal("Error initializing Exoscale SOS storage", "error", err)
 		}
-		log.Printf("Using Exoscale SOS for durable storage")
+		slog.Info("Using Exoscale SOS for durable storage")
 	} else {
-		log.Printf("Warning: No SOS credentials provided, falling back to local file storage")
-		log.Printf("         This is not recommended for production use")
+		slog.Warn("No SOS credentials provided, falling back to local file storage; this is not recommended for production use")
 	}
-	
+
 	// Initialize fallback file-based token store (always available)
 	tokenStore = NewDurableTokenStore(*storageFile)
-	
-	// Start cleanup goroutine if using Exoscale
+
+	// Settle what the file holds that SOS does not, and the reverse, before serving
+	if useExoscale {
+		report, err := syncStorageOnStart(context.Background(), *sosSyncUpload, *sosSyncDownload)
+		if err != nil {
+			slog.Warn("Could not reconcile file storage with SOS", "error", err)
+		} else {
+			logStorageSync(report)
+		}
+	}
+
+	// Start cleanup and outage reconciliation goroutines if using Exoscale
 	if useExoscale {
 		go startCleanupRoutine()
+		go startReconcileRoutine(*sosReconcileInterval)
 	}
+	go startDeferredRoutine(*deferredInterval)
 
-	http.HandleFunc("/register", loggingMiddleware(handleRegister))
-	http.HandleFunc("/send", loggingMiddleware(handleSend))
-	http.HandleFunc("/notify", loggingMiddleware(handleNotify))
-	http.HandleFunc("/status", loggingMiddleware(handleStatus))
-	http.HandleFunc("/", loggingMiddleware(handleRoot))
+	if *debugAddr != "" {
+		startDebugServer(*debugAddr)
+	}
 
-	log.Printf("FCM Notification Server starting on port %s", *port)
-	log.Printf("Storage: %s", getStorageType())
-	log.Printf("Endpoints:")
-	log.Printf("  POST /register - Register FCM token")
-	log.Printf("  POST /send     - Send notification to all registered tokens")
-	log.Printf("  POST /notify   - Send notification to specific token")
-	log.Printf("  GET  /status   - Show registered token count")
-	log.Printf("  GET  /         - Show this help")
+	// Bound concurrent sends so overload turns into 429s instead of goroutine buildup
+	sendPipeline = newSendLimiter(*maxInFlightSends, *maxQueuedSends, *sendQueueTimeout)
 
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
-		log.Fatal("Server failed to start:", err)
+	decryptedTokens, err = decryptedCacheFromFlags()
+	if err != nil {
+		fatal("Failed to set up the decrypted token cache", "error", err)
+	}
+
+	// Measure dependency latency in the background for /ready
+	go startProber(*probeInterval, defaultProbes())
+
+	// Public endpoints use their own mux so debug handlers registered on
+	// http.DefaultServeMux (pprof, expvar) are never exposed here
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+	// Probes are polled constantly, so they are not request-logged
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/ready", handleReady)
+	// Gotify's API is unversioned, so it is served at Gotify's own path
+	mux.HandleFunc("/message", loggingMiddleware(limitSends(handleGotifyMessage)))
+	mux.HandleFunc("/", loggingMiddleware(handleRoot))
+
+	listener, err := createListener(*listenAddr, *port)
+	if err != nil {
+		fatal("Failed to open listener", "error", err)
+	}
+
+	slog.Info("FCM Notification Server listening",
+		"addr", listener.Addr().String(),
+		"storage", getStorageType(),
+		"endpoints", append(apiEndpoints(), "GET /healthz", "GET /ready", "GET /"),
+	)
+
+	server := newHTTPServer(tracingHandler(gzipHandler(mux)))
+	if err := server.Serve(listener); err != nil {
+		fatal("Server failed to start", "error", err)
 	}
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	w = negotiateEncoding(w, r)
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+
+	// A retry carrying the same Idempotency-Key gets the first attempt's answer
+	claim, done := beginIdempotentRegister(w, r, body)
+	if done {
 		return
 	}
+	defer claim.release()
 
 	var reg TokenRegistration
-	if err := json.Unmarshal(body, &reg); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := decodeBody(r, body, &reg); err != nil {
+		code := errorCodeOf(err, ErrInvalidJSON)
+		logger.Warn("Error parsing request body", "code", code, "error", err)
+		writeError(w, code, "Invalid request body")
 		return
 	}
 
 	if reg.EncryptedData == "" {
-		http.Error(w, "Encrypted data is required", http.StatusBadRequest)
+		writeError(w, ErrMissingField, "Encrypted data is required")
 		return
 	}
 
 	// Validate size limits for encrypted data
 	if len(reg.EncryptedData) < 100 { // Minimum: base64(IV + key_len + min_RSA + min_token + auth_tag)
-		http.Error(w, "Encrypted data too short", http.StatusBadRequest)
+		writeError(w, ErrInvalidEncryptedData, "Encrypted data too short")
 		return
 	}
 	if len(reg.EncryptedData) > 10000 { // Maximum: reasonable limit for FCM tokens
-		http.Error(w, "Encrypted data too long", http.StatusBadRequest)
+		writeError(w, ErrInvalidEncryptedData, "Encrypted data too long")
 		return
 	}
 
-	// Validate that the token can be decrypted correctly before storing
-	decryptedToken, err := decryptHybridToken(reg.EncryptedData)
-	if err != nil {
-		log.Printf("Token validation failed: %v", err)
-		http.Error(w, "Invalid encrypted token", http.StatusBadRequest)
+	if err := validatePlatform(reg.Platform); err != nil {
+		writeError(w, errorCodeOf(err, ErrInvalidPlatform), err.Error())
+		return
+	}
+	if err := validateMetadata(registrationMetadata(reg)); err != nil {
+		writeError(w, ErrInvalidRequest, "Invalid metadata: "+err.Error())
+		return
+	}
+	if err := validateUserHash(reg.UserHash); err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validateDeliveryWindow(reg.Timezone, reg.QuietHours); err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
 		return
 	}
 
-	// Validate the decrypted token looks like a valid FCM token
-	if len(decryptedToken) < 10 {
-		http.Error(w, "Decrypted token too short", http.StatusBadRequest)
+	// The platform picks the transport, which must be configured here
+	t := transportFor(reg.Platform)
+	if !t.configured() {
+		writeError(w, ErrUnsupportedPlatform, fmt.Sprintf("Platform %q is not enabled on this server", reg.Platform))
 		return
 	}
-	if len(decryptedToken) > 1000 {
-		http.Error(w, "Decrypted token too long", http.StatusBadRequest)
+
+	// A challenge is the AES-GCM additional data of the token, so a captured
+	// payload cannot be registered again once its challenge is used
+	var aad []byte
+	var challengeExpires time.Time
+	if reg.Challenge != "" || *requireChallenge {
+		if reg.Challenge == "" {
+			writeError(w, ErrMissingField, "Challenge is required; get one from GET /v1/register/challenge")
+			return
+		}
+		if challengeExpires, err = verifyChallenge(reg.Challenge); err != nil {
+			code := errorCodeOf(err, ErrInternal)
+			logger.Warn("Challenge rejected", "code", code, "error", err)
+			writeError(w, code, "Invalid challenge: "+err.Error())
+			return
+		}
+		aad = []byte(reg.Challenge)
+	}
+
+	// Validate that the token can be decrypted correctly before storing
+	decryptedToken, err := decryptHybridTokenAAD(reg.EncryptedData, aad)
+	if err != nil {
+		logger.Warn("Token validation failed", "error", err)
+		writeError(w, ErrDecryptFailed, "Invalid encrypted token")
 		return
 	}
 
+	// Validate the decrypted address for the platform's transport
+	err = t.validate(decryptedToken)
+
+	// A token bound to a challenge is stored re-encrypted without it, so
+	// sends decrypt it like any other
+	var sealed string
+	var sealErr error
+	if err == nil && aad != nil {
+		sealed, sealErr = encryptHybridToken(decryptedToken, &privateKey.PublicKey, nil)
+	}
+
 	// Securely wipe decrypted token from memory
 	secureWipeString(&decryptedToken)
 
-	// Generate opaque ID
-	opaqueID := generateOpaqueID()
-	
-	// Store token using primary storage (Exoscale SOS if available, fallback to file)
-	if useExoscale {
-		ctx := context.Background()
-		if err := exoscaleStorage.StoreToken(ctx, opaqueID, reg.EncryptedData, reg.Platform); err != nil {
-			log.Printf("Failed to store token in Exoscale SOS: %v", err)
-			http.Error(w, "Failed to store token", http.StatusInternalServerError)
+	if err != nil {
+		logger.Warn("Decrypted token rejected", "platform", reg.Platform, "error", err)
+		writeError(w, errorCodeOf(err, ErrInvalidFCMToken), "Invalid device address: "+err.Error())
+		return
+	}
+	if sealErr != nil {
+		logger.Error("Failed to re-encrypt token", "error", sealErr)
+		writeError(w, ErrInternal, "Failed to store token")
+		return
+	}
+	if aad != nil && !usedChallenges.consume(reg.Challenge, challengeExpires) {
+		logger.Warn("Challenge replayed")
+		writeError(w, ErrInvalidChallenge, "Invalid challenge: already used")
+		return
+	}
+
+	if reg.EncryptedEmail != "" {
+		if err := validateEncryptedEmail(reg.EncryptedEmail); err != nil {
+			code := errorCodeOf(err, ErrInvalidSubscription)
+			logger.Warn("Fallback email rejected", "code", code, "error", err)
+			writeError(w, code, "Invalid fallback email: "+err.Error())
 			return
 		}
-	} else {
-		// Fallback to file-based storage
-		if _, err := tokenStore.AddToken(reg.EncryptedData, reg.Platform); err != nil {
-			log.Printf("Failed to store token in file storage: %v", err)
-			http.Error(w, "Failed to store token", http.StatusInternalServerError)
+	}
+	if reg.EncryptedPhone != "" {
+		if err := validateEncryptedPhone(reg.EncryptedPhone); err != nil {
+			code := errorCodeOf(err, ErrInvalidSubscription)
+			logger.Warn("Fallback phone number rejected", "code", code, "error", err)
+			writeError(w, code, "Invalid fallback phone number: "+err.Error())
 			return
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"success":      true,
-		"message":      "Token registered successfully",
-		"token_id":     opaqueID,
-		"platform":     reg.Platform,
-		"total_tokens": getTotalTokenCount(),
+	if err := validateFirebaseProject(reg.FirebaseProject); err != nil {
+		writeError(w, ErrUnknownProject, err.Error())
+		return
 	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+
+	if len(reg.Channels) > maxChannels {
+		writeError(w, ErrInvalidRequest, fmt.Sprintf("At most %d channels are allowed", maxChannels))
+		return
+	}
+	for i, ch := range reg.Channels {
+		if err := validateChannel(ch); err != nil {
+			code := errorCodeOf(err, ErrInvalidSubscription)
+			logger.Warn("Channel rejected", "position", i+1, "platform", ch.Platform, "code", code, "error", err)
+			writeError(w, code, fmt.Sprintf("Invalid channel %d: %v", i+1, err))
+			return
+		}
+	}
+
+	// Attestation goes last, as it costs a call to Google
+	if integrityRequired(reg.Platform) {
+		if err := verifyIntegrity(r.Context(), reg.IntegrityToken, reg.EncryptedData); err != nil {
+			code := errorCodeOf(err, ErrIntegrityUnavailable)
+			logger.Warn("Integrity check failed", "code", code, "error", err)
+			writeError(w, code, "Integrity check failed: "+err.Error())
+			return
+		}
+	}
+
+	if aad != nil {
+		reg.EncryptedData = sealed
+	}
+
+	notifySecret, notifySecretHash, err := newNotifySecret()
+	if err != nil {
+		logger.Error("Failed to generate notify secret", "error", err)
+		writeError(w, ErrInternal, "Failed to store token")
+		return
+	}
+
+	// Store token using primary storage (Exoscale SOS if available, fallback to file)
+	opaqueID, err := storeRegistration(r.Context(), reg, notifySecretHash)
+	if err != nil {
+		logger.Error("Failed to store token", "error", err)
+		writeError(w, ErrStorageUnavailable, "Failed to store token")
+		return
+	}
+
+	issuedAt := time.Now().Unix()
+	signature, err := signRegistration(opaqueID, issuedAt)
+	if err != nil {
+		logger.Error("Failed to sign registration", "error", err)
+		writeError(w, ErrInternal, "Failed to sign registration")
+		return
+	}
+
+	response := RegisterResponse{
+		Success:     true,
+		Message:     "Token registered successfully",
+		TokenID:     opaqueID,
+		Platform:    reg.Platform,
+		TotalTokens: getTotalTokenCount(r.Context()),
+
+		NotifySecret: notifySecret,
+		IssuedAt:     issuedAt,
+		Signature:    signature,
+	}
+	claim.finish(response)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeResponse(w, http.StatusOK, response); err != nil {
+		logger.Error("Error encoding response", "error", err)
 	}
 }
 
 func handleSend(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
 		return
 	}
 
 	var notif NotificationRequest
 	if err := json.Unmarshal(body, &notif); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
 		return
 	}
 
-	if notif.Title == "" || notif.Body == "" {
-		http.Error(w, "Title and body are required", http.StatusBadRequest)
+	if err := validateBroadcast(notif); err != nil {
+		writeError(w, errorCodeOf(err, ErrInvalidRequest), err.Error())
 		return
 	}
 
-	tokens, err := getAllTokens()
+	tokens, err := getAllTokens(r.Context())
 	if err != nil {
-		log.Printf("Failed to get tokens: %v", err)
-		http.Error(w, "Failed to retrieve tokens", http.StatusInternalServerError)
+		logger.Error("Failed to get tokens", "error", err)
+		writeError(w, ErrStorageUnavailable, "Failed to retrieve tokens")
 		return
 	}
-	
+
+	if notif.Platform != "" {
+		tokens = filterPlatform(tokens, notif.Platform)
+		logger = logger.With("platform", notif.Platform)
+	}
+
 	if len(tokens) == 0 {
-		http.Error(w, "No tokens registered", http.StatusBadRequest)
+		writeError(w, ErrNoTokens, "No tokens registered")
 		return
 	}
+	sendToTokens(w, r.WithContext(withLogger(r.Context(), logger)), tokens, notif)
+}
 
-	successCount := 0
-	errorCount := 0
+// sendToTokens broadcasts notif to tokens and answers the request, in the
+// background, as a progress stream or with a summary as the client asked.
+// With a local_time it schedules the broadcast instead, and with variants it
+// runs a split send.
+func sendToTokens(w http.ResponseWriter, r *http.Request, tokens []*TokenStorageInfo, notif NotificationRequest) {
+	logger := loggerFromContext(r.Context())
 
-	for _, token := range tokens {
-		if err := sendFCMNotification(token.EncryptedData, notif.Title, notif.Body); err != nil {
-			log.Printf("Failed to send to opaque ID %s...%s: %v",
-				token.OpaqueID[:8], token.OpaqueID[len(token.OpaqueID)-8:], err)
-			errorCount++
-		} else {
-			successCount++
-		}
+	// A local-time send is only queued here, and delivered zone by zone later
+	if notif.LocalTime != "" {
+		scheduleLocalTime(w, r, tokens, notif)
+		return
+	}
+	if len(notif.Variants) > 0 {
+		sendSplit(w, r, tokens, notif)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"success":      successCount > 0,
-		"message":      fmt.Sprintf("Sent to %d devices, %d failures", successCount, errorCount),
-		"sent_count":   successCount,
-		"error_count":  errorCount,
-		"total_tokens": len(tokens),
+	// Run in the background when the client prefers it, reporting progress via /v1/jobs
+	if preferAsync(r) {
+		startBroadcastJob(w, r, tokens, notif)
+		return
 	}
+
+	// Stream one line per delivery when asked, instead of a single response at the end
+	var progress *progressStream
+	if wantsNDJSON(r) {
+		progress = newProgressStream(w)
+	}
+
+	successCount, errorCount := broadcastTokens(r.Context(), tokens, delivery{Title: notif.Title, Body: notif.Body, Critical: notif.Critical}, progress.delivery)
+
+	response := SendResponse{
+		Success:     successCount > 0,
+		Message:     fmt.Sprintf("Sent to %d devices, %d failures", successCount, errorCount),
+		SentCount:   successCount,
+		ErrorCount:  errorCount,
+		TotalTokens: len(tokens),
+	}
+	if progress != nil {
+		progress.summary(response)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		logger.Error("Error encoding response", "error", err)
 	}
 }
 
+// broadcastTokens sends the notification in d to every token, in FCM batches
+// and --send-concurrency batches at a time, calling onDelivery after each
+// attempt. Registrations in their quiet hours are deferred together first.
+// The calls to onDelivery are serialized, so it needs no locking of its own.
+func broadcastTokens(ctx context.Context, tokens []*TokenStorageInfo, d delivery, onDelivery func(opaqueID string, err error)) (successCount, errorCount int) {
+	logger := loggerFromContext(ctx)
+	tokens, held, err := deferDelivery(ctx, tokens, d)
+	if err != nil {
+		logger.Warn("Failed to defer notifications for quiet hours", "tokens", len(held), "error", err)
+		errorCount += len(held)
+	} else {
+		successCount += len(held)
+	}
+	for _, token := range held {
+		onDelivery(token.OpaqueID, err)
+	}
+	// Quiet hours are settled, the rest are sent now
+	d.Released = true
+	batches := broadcastBatches(tokens, d)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan broadcastBatch)
+	for range min(max(*sendConcurrency, 1), len(batches)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range next {
+				errs := batch.send(ctx, d)
+				for i, err := range errs {
+					if err != nil {
+						logger.Warn("Failed to send notification",
+							"token_id", batch.tokens[i].OpaqueID, "error", err)
+					}
+				}
+
+				mu.Lock()
+				for i, err := range errs {
+					if err != nil {
+						errorCount++
+					} else {
+						successCount++
+					}
+					onDelivery(batch.tokens[i].OpaqueID, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, batch := range batches {
+		next <- batch
+	}
+	close(next)
+	wg.Wait()
+	return successCount, errorCount
+}
+
 func handleNotify(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	w = negotiateEncoding(w, r)
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
 		return
 	}
 
 	var notif SingleNotificationRequest
-	if err := json.Unmarshal(body, &notif); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := decodeBody(r, body, &notif); err != nil {
+		code := errorCodeOf(err, ErrInvalidJSON)
+		logger.Warn("Error parsing request body", "code", code, "error", err)
+		writeError(w, code, "Invalid request body")
 		return
 	}
 
-	if notif.Title == "" || notif.Body == "" {
-		http.Error(w, "Title and body are required", http.StatusBadRequest)
+	switch {
+	case notif.Template != "" && (notif.Title != "" || notif.Body != ""):
+		writeError(w, ErrInvalidRequest, "Send either a template or a title and body")
+		return
+	case notif.Template == "" && len(notif.Variables) > 0:
+		writeError(w, ErrInvalidRequest, "variables need a template")
+		return
+	case notif.Template == "" && (notif.Title == "" || notif.Body == ""):
+		writeError(w, ErrMissingField, "Title and body are required")
 		return
 	}
 
 	// Only accept opaque ID (no backwards compatibility)
 	if notif.TokenID == "" {
-		http.Error(w, "token_id is required", http.StatusBadRequest)
+		writeError(w, ErrMissingField, "token_id is required")
 		return
 	}
 
-	token, err := getToken(notif.TokenID)
+	logger = logger.With("token_id", notif.TokenID)
+	ctx := withLogger(r.Context(), logger)
+
+	token, err := getToken(ctx, notif.TokenID)
 	if err != nil {
-		log.Printf("Token ID not found: %s", notif.TokenID)
-		http.Error(w, "Token ID not found", http.StatusBadRequest)
+		code := errorCodeOf(err, ErrStorageUnavailable)
+		logger.Warn("Failed to look up token ID", "code", code, "error", err)
+		if code == ErrTokenNotFound {
+			writeError(w, code, "Token ID not found")
+		} else {
+			writeError(w, code, "Failed to retrieve token")
+		}
 		return
 	}
-	encryptedData := token.EncryptedData
-
-	if err := sendFCMNotification(encryptedData, notif.Title, notif.Body); err != nil {
-		log.Printf("Failed to send notification: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		response := map[string]interface{}{
-			"success": false,
-			"message": "Failed to send notification",
-			"error":   err.Error(),
+	// A caller naming its key may only reach tokens registered under that key
+	if notif.PublicKeyHash != "" && notif.PublicKeyHash != token.PublicKeyHash {
+		logger.Warn("Public key hash mismatch", "public_key_hash", notif.PublicKeyHash)
+		writeError(w, ErrKeyMismatch, "Token was registered under another public key")
+		return
+	}
+	if err := checkNotifySecret(token, notif.NotifySecret); err != nil {
+		logger.Warn("Notify secret rejected", "error", err)
+		writeError(w, ErrUnauthorized, "Missing or invalid notify secret")
+		return
+	}
+	// Templates are rendered for the locale the device registered with
+	if notif.Template != "" {
+		var locale string
+		if token.Metadata != nil {
+			locale = token.Metadata.Locale
 		}
-		if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
-			log.Printf("Error encoding error response: %v", encodeErr)
+		tmpl, err := getTemplate(ctx, notif.Template)
+		if err == nil {
+			notif.Title, notif.Body, err = tmpl.render(locale, notif.Variables)
 		}
+		if err != nil {
+			writeTemplateError(w, r, err)
+			return
+		}
+		logger.Debug("Template rendered", "template", notif.Template, "locale", locale)
+	}
+	if notif.DryRun {
+		handleNotifyDryRun(w, r, token, delivery{Title: notif.Title, Body: notif.Body, Critical: notif.Critical})
+		return
+	}
+	if err := sendNotification(ctx, token, delivery{Title: notif.Title, Body: notif.Body, Critical: notif.Critical}); err != nil {
+		code := errorCodeOf(err, ErrFCMUnavailable)
+		logger.Error("Failed to send notification", "code", code, "error", err)
+		writeError(w, code, "Failed to send notification")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"success": true,
-		"message": "Notification sent successfully",
+	response := NotifyResponse{
+		Success: true,
+		Message: "Notification sent successfully",
 	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+	if _, quiet := token.quietUntil(time.Now()); quiet && !notif.Critical {
+		response.Message = "Notification deferred until the device's quiet hours end"
+	}
+	if err := writeResponse(w, http.StatusOK, response); err != nil {
+		logger.Error("Error encoding response", "error", err)
 	}
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	// One listing serves both the total and the per-platform counts
+	tokens, err := getAllTokens(r.Context())
+	if err != nil {
+		logger.Warn("Failed to count tokens", "error", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"registered_tokens":    getTotalTokenCount(),
-		"firebase_initialized": messagingClient != nil,
-		"api_version":          "FCM v1 (Firebase Admin SDK)",
-		"storage_type":         getStorageType(),
-		"public_key_hash":      publicKeyHash[:16] + "...",
+	response := api.StatusResponse{
+		RegisteredTokens:    len(tokens),
+		Platforms:           platformCounts(tokens),
+		FirebaseInitialized: messagingClient != nil,
+		FCMMocked:           *mockFCM,
+		APIVersion:          "FCM v1 (Firebase Admin SDK)",
+		StorageType:         getStorageType(),
+		PublicKeyHash:       publicKeyHash[:16] + "...",
+		SendsInFlight:       int(sendsInFlight.Value()),
+		SendsQueued:         int(sendsQueued.Value()),
+		VAPIDPublicKey:      vapidPublicKey,
+	}
+	if useExoscale {
+		response.PendingUploads = len(tokenStore.PendingUploads())
 	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		logger.Error("Error encoding response", "error", err)
 	}
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
 	w.Header().Set("Content-Type", "text/plain")
 	if _, err := fmt.Fprintf(w, `FCM Notification Server (v1 API)
 
-Endpoints:
-  POST /register - Register FCM token
+Endpoints (the unversioned paths are deprecated aliases):
+  POST /v1/register - Register FCM token
     Body: {"encrypted_data": "base64-encrypted-token", "platform": "android"}
 
-  POST /send - Send notification to all registered tokens
+  GET /v1/register/challenge - Nonce binding the next registration
+
+  POST /v1/send - Send notification to all registered tokens
+    Body: {"title": "Hello", "body": "Test message"}
+    With "Prefer: respond-async": 202 with a job to follow under /v1/jobs/{id}
+    With "local_time": "09:00": 202, delivered at 09:00 in each device's timezone
+    With "experiment" and "variants": split send, see GET /v1/experiments/{name}
+
+  POST /v1/notify-raw - Send a full FCM message to specific token (needs --raw-api-key)
+    Body: {"token_id": "opaque-token-id", "message": {...FCM v1 message...}}
+
+  POST /v1/notify-user - Send notification to every device of a user (needs --raw-api-key)
+    Body: {"user_hash": "hex-hmac-of-user-id", "title": "Hello", "body": "Test message"}
+
+  GET /v1/jobs/{id} - Progress of an asynchronous broadcast
+
+  GET /v1/jobs/{id}/events - Server-Sent Events stream of broadcast progress
+
+  GET /v1/ws - WebSocket for platform "websocket" devices (needs --websocket)
+
+  GET /v1/poll/{token_id}?after=SEQ - Long-poll for platform "poll" devices (needs --poll)
+
+  POST /v1/send-condition - Send notification to devices matching a topic condition
+    Body: {"condition": "'news' in topics && 'eu' in topics", "title": "Hello", "body": "Test message"}
+
+  POST /v1/notify - Send notification to specific token
+    Body: {"token_id": "opaque-token-id", "notify_secret": "from-register", "title": "Hello", "body": "Test message"}
+    Or: {"token_id": "...", "template": "order_shipped", "variables": {"order_id": "42"}}
+    With "dry_run": true: checked up to FCM's validate-only send, delivered nowhere
+
+  GET /v1/tokens?platform=P - List registrations with device metadata (needs --raw-api-key)
+
+  PUT /v1/groups/{name} - Create a device group or replace its members (needs --raw-api-key)
+    Body: {"token_ids": ["opaque-token-id", ...]}
+    Also: GET and DELETE /v1/groups/{name}, GET /v1/groups,
+    POST /v1/groups/{name}/members, DELETE /v1/groups/{name}/members/{token_id}
+
+  POST /v1/groups/{name}/send - Send notification to every device in a group (needs --raw-api-key)
     Body: {"title": "Hello", "body": "Test message"}
 
-  POST /notify - Send notification to specific token
-    Body: {"token_id": "opaque-token-id", "title": "Hello", "body": "Test message"}
+  GET /v1/experiments/{name} - Variant assignments and counts of a split send (needs --raw-api-key)
+
+  PUT /v1/templates/{name} - Create or replace a notification template (needs --raw-api-key)
+    Body: {"title": "Shipped", "body": "Order {{order_id}} is on its way", "locales": {"fr": {"title": "...", "body": "..."}}}
+    Also: GET and DELETE /v1/templates/{name}, GET /v1/templates
+
+  GET /v1/status - Show server status
+    Returns: {"registered_tokens": N, "platforms": {"android": N, ...}, "firebase_initialized": true/false}
+
+  GET /v1/version - Show build and feature information
+    Returns: {"version": "...", "git_commit": "...", "build_date": "...", "go_version": "...", "features": {...}}
 
-  GET /status - Show server status
-    Returns: {"registered_tokens": N, "firebase_initialized": true/false}
+  GET /v1/openapi.json - OpenAPI document for the /v1 API
+
+  GET /healthz - Liveness probe
+
+  GET /ready - Readiness probe with FCM and storage latency (503 when not ready)
 
 Registered tokens: %d
 Firebase initialized: %v
 API Version: FCM v1 (Firebase Admin SDK)
 Storage Type: %s
 Public Key Hash: %s
-`, getTotalTokenCount(), messagingClient != nil, getStorageType(), publicKeyHash[:16]+"..."); err != nil {
-		log.Printf("Error writing response: %v", err)
+`, getTotalTokenCount(r.Context()), messagingClient != nil, getStorageType(), publicKeyHash[:16]+"..."); err != nil {
+		logger.Error("Error writing response", "error", err)
 	}
 }
 
-func sendFCMNotification(encryptedData, title, body string) error {
-	if messagingClient == nil {
-		return fmt.Errorf("firebase messaging client not initialized")
+// sendFCMMessage decrypts the token, addresses message to it and sends it
+// through the token's Firebase project. The token is cleared from message
+// again once the send returns.
+func sendFCMMessage(ctx context.Context, project, encryptedData string, message *messaging.Message) error {
+	if _, err := fcmClientFor(project); err != nil {
+		return err
 	}
 
-	// Decrypt the token using hybrid decryption
-	decryptedToken, err := decryptHybridToken(encryptedData)
+	decryptedToken, err := decryptFCMToken(encryptedData)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt token: %v", err)
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt token: %v", err))
 	}
+	message.Token = decryptedToken
 
-	// Create message using Firebase Admin SDK v1 API
-	message := &messaging.Message{
-		Token: decryptedToken,
-		Notification: &messaging.Notification{
-			Title: title,
-			Body:  body,
-		},
-		Android: &messaging.AndroidConfig{
-			Priority: "high",
-		},
-	}
-
-	ctx := context.Background()
-	response, err := messagingClient.Send(ctx, message)
+	_, err = deliverFCM(ctx, project, message)
 
 	// Immediately wipe the decrypted token from memory
+	message.Token = ""
 	secureWipeString(&decryptedToken)
-
-	if err != nil {
-		return fmt.Errorf("failed to send FCM message: %v", err)
-	}
-
-	log.Printf("Successfully sent message with ID: %s", response)
-	return nil
+	return err
 }
 
-func readProjectIDFromKey(keyPath string) (string, error) {
-	data, err := os.ReadFile(keyPath)
+// deliverFCM sends an addressed message through a Firebase project ("" for
+// --firebase-key) and classifies the outcome. Only failures that point at
+// FCM itself count toward the failure streak.
+func deliverFCM(ctx context.Context, project string, message *messaging.Message) (string, error) {
+	client, err := fcmClientFor(project)
 	if err != nil {
-		return "", fmt.Errorf("failed to read key file: %v", err)
+		return "", err
 	}
 
-	var key ServiceAccountKey
-	if err := json.Unmarshal(data, &key); err != nil {
-		return "", fmt.Errorf("failed to parse key file: %v", err)
+	ctx, span := startSpan(ctx, "fcm.send")
+	sendCtx, cancel := context.WithTimeout(ctx, *fcmTimeout)
+	response, err := client.Send(sendCtx, message)
+	cancel()
+	endSpan(span, err)
+	if err != nil {
+		return "", fcmError(ctx, err)
 	}
 
-	if key.ProjectID == "" {
-		return "", fmt.Errorf("project_id not found in key file")
-	}
+	recordFCMResult(ctx, nil)
+	loggerFromContext(ctx).Debug("Successfully sent FCM message", "message_id", response)
+	return response, nil
+}
 
-	log.Printf("Using project ID: %s", key.ProjectID)
-	return key.ProjectID, nil
+// fcmError gives a failed FCM send its code, counting it towards
+// --fcm-failure-threshold unless the device or the message is at fault
+func fcmError(ctx context.Context, err error) error {
+	// A token FCM no longer knows is the device's problem, not an FCM outage
+	if messaging.IsUnregistered(err) {
+		recordFCMResult(ctx, nil)
+		return withCode(ErrTokenUnregistered, fmt.Errorf("FCM token is no longer registered: %v", err))
+	}
+	// Likewise a message FCM rejects as malformed
+	if messaging.IsInvalidArgument(err) {
+		recordFCMResult(ctx, nil)
+		return withCode(ErrInvalidMessage, fmt.Errorf("FCM rejected the message: %v", err))
+	}
+	recordFCMResult(ctx, err)
+	return withCode(ErrFCMUnavailable, fmt.Errorf("failed to send FCM message: %v", err))
 }
 
 func loadPrivateKey(keyPath string) (*rsa.PrivateKey, error) {
@@ -760,6 +1536,12 @@ func loadPrivateKey(keyPath string) (*rsa.PrivateKey, error) {
 }
 
 func decryptHybridToken(encryptedData string) (string, error) {
+	return decryptHybridTokenAAD(encryptedData, nil)
+}
+
+// decryptHybridTokenAAD decrypts a payload whose AES-GCM seal also covers aad,
+// as registrations bound to a challenge are
+func decryptHybridTokenAAD(encryptedData string, aad []byte) (string, error) {
 	if privateKey == nil {
 		return "", fmt.Errorf("private key not loaded")
 	}
@@ -820,7 +1602,7 @@ func decryptHybridToken(encryptedData string) (string, error) {
 	}
 
 	// Decrypt token
-	decryptedBytes, err := gcm.Open(nil, iv, encryptedToken, nil)
+	decryptedBytes, err := gcm.Open(nil, iv, encryptedToken, aad)
 	if err != nil {
 		return "", fmt.Errorf("failed to decrypt token: %v", err)
 	}
@@ -836,6 +1618,42 @@ func decryptHybridToken(encryptedData string) (string, error) {
 	return string(decryptedBytes), nil
 }
 
+// encryptHybridToken is the inverse of decryptHybridTokenAAD, producing the
+// same IV + key length + RSA-encrypted AES key + AES-GCM ciphertext layout
+// as the clients
+func encryptHybridToken(plaintext string, publicKey *rsa.PublicKey, aad []byte) (string, error) {
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", fmt.Errorf("failed to generate AES key: %v", err)
+	}
+	defer secureWipeBytes(aesKey)
+	iv := make([]byte, 12)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate IV: %v", err)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GCM: %v", err)
+	}
+	encryptedAESKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, aesKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt AES key: %v", err)
+	}
+
+	keyLength := len(encryptedAESKey)
+	combined := make([]byte, 0, 16+keyLength+len(plaintext)+gcm.Overhead())
+	combined = append(combined, iv...)
+	combined = append(combined, byte(keyLength>>24), byte(keyLength>>16), byte(keyLength>>8), byte(keyLength))
+	combined = append(combined, encryptedAESKey...)
+	combined = gcm.Seal(combined, iv, []byte(plaintext), aad)
+	return base64.StdEncoding.EncodeToString(combined), nil
+}
+
 func secureWipeString(s *string) {
 	// Overwrite the string data in memory for security
 	if s != nil && *s != "" {
@@ -866,6 +1684,9 @@ func maskString(s string) string {
 
 // getStorageType returns a human-readable description of the storage type in use
 func getStorageType() string {
+	if useExoscale && sosFailedOver.Load() {
+		return fmt.Sprintf("Local file, failed over from Exoscale SOS (bucket: %s, zone: %s)", *sosBucket, *sosZone)
+	}
 	if useExoscale {
 		return fmt.Sprintf("Exoscale SOS (bucket: %s, zone: %s)", *sosBucket, *sosZone)
 	}
@@ -883,103 +1704,114 @@ func readPublicKeyPEM(keyPath string) (string, error) {
 
 // startCleanupRoutine runs a goroutine that periodically cleans up old tokens
 func startCleanupRoutine() {
+	defer reportPanic("cleanup")
+
 	ticker := time.NewTicker(24 * time.Hour) // Run cleanup once per day
 	defer ticker.Stop()
-	
-	log.Printf("Starting token cleanup routine (runs every 24 hours)")
-	
+
+	slog.Info("Starting token cleanup routine", "interval", 24*time.Hour)
+
 	// Run initial cleanup after 5 minutes to allow for startup
 	time.AfterFunc(5*time.Minute, func() {
+		defer reportPanic("cleanup")
 		ctx := context.Background()
 		deleted, err := exoscaleStorage.CleanupOldTokens(ctx, 30*24*time.Hour) // 30 days
 		if err != nil {
-			log.Printf("Error during initial token cleanup: %v", err)
+			slog.Error("Error during initial token cleanup", "error", err)
 		} else {
-			log.Printf("Initial cleanup completed: removed %d old tokens", deleted)
+			slog.Info("Initial cleanup completed", "deleted", deleted)
 		}
 	})
-	
+
 	for range ticker.C {
 		ctx := context.Background()
 		deleted, err := exoscaleStorage.CleanupOldTokens(ctx, 30*24*time.Hour) // 30 days
 		if err != nil {
-			log.Printf("Error during scheduled token cleanup: %v", err)
+			slog.Error("Error during scheduled token cleanup", "error", err)
 		} else if deleted > 0 {
-			log.Printf("Scheduled cleanup completed: removed %d old tokens", deleted)
+			slog.Info("Scheduled cleanup completed", "deleted", deleted)
 		}
 	}
 }
 
 // Helper functions for unified storage access
 
-// generateOpaqueID creates a new opaque identifier
-func generateOpaqueID() string {
-	// Generate 32 random bytes (256 bits)
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		log.Printf("Error generating random bytes: %v", err)
-		// Fallback to timestamp + random for uniqueness
-		return fmt.Sprintf("%d_%x", time.Now().UnixNano(), bytes[:16])
-	}
-	return hex.EncodeToString(bytes)
-}
-
 // getToken retrieves a token by opaque ID from the appropriate storage
-func getToken(opaqueID string) (*TokenStorageInfo, error) {
+func getToken(ctx context.Context, opaqueID string) (*TokenStorageInfo, error) {
+	if err := validateOpaqueID(opaqueID); err != nil {
+		return nil, err
+	}
 	if useExoscale {
-		ctx := context.Background()
+		// Registrations taken during an SOS outage are not there yet
+		if mapping, ok := tokenStore.GetPendingUpload(opaqueID); ok {
+			return mappingStorageInfo(mapping), nil
+		}
 		return exoscaleStorage.GetToken(ctx, opaqueID)
 	}
-	
+
 	// Fallback to file storage - need to convert format
-	encryptedData, err := tokenStore.GetEncryptedToken(opaqueID)
+	mapping, err := tokenStore.GetMapping(opaqueID)
 	if err != nil {
-		return nil, err
+		return nil, withCode(ErrTokenNotFound, err)
 	}
-	
+	return mappingStorageInfo(mapping), nil
+}
+
+// mappingStorageInfo converts a file storage registration to the SOS format
+func mappingStorageInfo(mapping TokenMapping) *TokenStorageInfo {
 	return &TokenStorageInfo{
-		OpaqueID:      opaqueID,
-		EncryptedData: encryptedData,
-		Platform:      "unknown", // File storage doesn't track platform separately
-		LastUsedAt:    time.Now(),
-	}, nil
+		OpaqueID:        mapping.OpaqueID,
+		EncryptedData:   mapping.EncryptedData,
+		Platform:        mapping.Platform,
+		RegisteredAt:    mapping.RegisteredAt,
+		LastUsedAt:      tokenStore.clock.Now(),
+		PublicKeyHash:   publicKeyHash,
+		EncryptedEmail:  mapping.EncryptedEmail,
+		EncryptedPhone:  mapping.EncryptedPhone,
+		Channels:        mapping.Channels,
+		FirebaseProject: mapping.FirebaseProject,
+
+		NotifySecretHash: mapping.NotifySecretHash,
+		Metadata:         mapping.Metadata,
+		UserHash:         mapping.UserHash,
+		Timezone:         mapping.Timezone,
+		QuietHours:       mapping.QuietHours,
+	}
 }
 
 // getAllTokens retrieves all tokens from the appropriate storage
-func getAllTokens() ([]*TokenStorageInfo, error) {
+func getAllTokens(ctx context.Context) ([]*TokenStorageInfo, error) {
 	if useExoscale {
-		ctx := context.Background()
-		return exoscaleStorage.ListAllTokens(ctx)
+		tokens, err := exoscaleStorage.ListAllTokens(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return withPendingUploads(tokens), nil
 	}
-	
+
 	// Fallback to file storage - need to convert format
 	opaqueIDs := tokenStore.GetAllOpaqueIDs()
 	tokens := make([]*TokenStorageInfo, 0, len(opaqueIDs))
-	
+
 	for _, opaqueID := range opaqueIDs {
-		encryptedData, err := tokenStore.GetEncryptedToken(opaqueID)
+		mapping, err := tokenStore.GetMapping(opaqueID)
 		if err != nil {
-			log.Printf("Warning: failed to get token for ID %s: %v", opaqueID[:16]+"...", err)
+			loggerFromContext(ctx).Warn("Failed to get token", "token_id", opaqueID, "error", err)
 			continue
 		}
-		
-		tokens = append(tokens, &TokenStorageInfo{
-			OpaqueID:      opaqueID,
-			EncryptedData: encryptedData,
-			Platform:      "unknown",
-			LastUsedAt:    time.Now(),
-		})
+
+		tokens = append(tokens, mappingStorageInfo(mapping))
 	}
-	
+
 	return tokens, nil
 }
 
 // getTotalTokenCount returns the total number of tokens in storage
-func getTotalTokenCount() int {
+func getTotalTokenCount(ctx context.Context) int {
 	if useExoscale {
-		tokens, err := getAllTokens()
+		tokens, err := getAllTokens(ctx)
 		if err != nil {
-			log.Printf("Warning: failed to count tokens: %v", err)
+			loggerFromContext(ctx).Warn("Failed to count tokens", "error", err)
 			return 0
 		}
 		return len(tokens)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// fcmPlatforms are the registration platforms delivered through FCM; every
+// other accepted platform has its own transport in platformTransports
+var fcmPlatforms = []string{"android", "ios"}
+
+// maxMetadataLength bounds each device metadata field
+const maxMetadataLength = 64
+
+// localePattern accepts BCP 47 style tags such as "en", "fr-CH" or "zh_Hant_TW"
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{1,8}){0,3}$`)
+
+// DeviceMetadata describes the registering app and device, for targeting
+// and debugging. All fields are optional and reported by the client.
+type DeviceMetadata struct {
+	AppVersion  string `json:"app_version,omitempty"`
+	OSVersion   string `json:"os_version,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+	DeviceModel string `json:"device_model,omitempty"`
+}
+
+// TokenSummary is one registration in GET /v1/tokens, without anything encrypted
+type TokenSummary struct {
+	TokenID         string          `json:"token_id"`
+	Platform        string          `json:"platform"`
+	Channels        []string        `json:"channels,omitempty"`
+	FirebaseProject string          `json:"firebase_project,omitempty"`
+	RegisteredAt    time.Time       `json:"registered_at"`
+	Metadata        *DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// TokenListResponse is returned by GET /v1/tokens
+type TokenListResponse struct {
+	Success   bool           `json:"success"`
+	Tokens    []TokenSummary `json:"tokens"`
+	Platforms map[string]int `json:"platforms"` // registrations per platform
+}
+
+// validatePlatform checks a registration names a platform this server knows.
+// Whether its transport is configured is checked separately.
+func validatePlatform(platform string) error {
+	if platform == "" {
+		return withCode(ErrMissingField, fmt.Errorf("platform is required"))
+	}
+	if _, ok := platformTransports[platform]; ok || slices.Contains(fcmPlatforms, platform) {
+		return nil
+	}
+	return withCode(ErrInvalidPlatform, fmt.Errorf("unknown platform %q", platform))
+}
+
+// registrationMetadata returns the registration's device metadata, or nil without any
+func registrationMetadata(reg TokenRegistration) *DeviceMetadata {
+	m := DeviceMetadata{AppVersion: reg.AppVersion, OSVersion: reg.OSVersion, Locale: reg.Locale, DeviceModel: reg.DeviceModel}
+	if m == (DeviceMetadata{}) {
+		return nil
+	}
+	return &m
+}
+
+// validateMetadata keeps client-reported metadata short and printable, as it
+// ends up in logs and listings
+func validateMetadata(m *DeviceMetadata) error {
+	if m == nil {
+		return nil
+	}
+	for _, f := range []struct{ name, value string }{
+		{"app_version", m.AppVersion},
+		{"os_version", m.OSVersion},
+		{"locale", m.Locale},
+		{"device_model", m.DeviceModel},
+	} {
+		if len(f.value) > maxMetadataLength {
+			return withCode(ErrInvalidRequest, fmt.Errorf("%s must be at most %d bytes", f.name, maxMetadataLength))
+		}
+		for _, r := range f.value {
+			if !strconv.IsPrint(r) {
+				return withCode(ErrInvalidRequest, fmt.Errorf("%s must be printable", f.name))
+			}
+		}
+	}
+	if m.Locale != "" && !localePattern.MatchString(m.Locale) {
+		return withCode(ErrInvalidRequest, fmt.Errorf("locale %q is not a language tag", m.Locale))
+	}
+	return nil
+}
+
+// filterPlatform keeps the registrations of one platform, for platform-specific broadcasts
+func filterPlatform(tokens []*TokenStorageInfo, platform string) []*TokenStorageInfo {
+	return slices.DeleteFunc(tokens, func(token *TokenStorageInfo) bool { return token.Platform != platform })
+}
+
+// platformCounts counts registrations per platform
+func platformCounts(tokens []*TokenStorageInfo) map[string]int {
+	counts := make(map[string]int)
+	for _, token := range tokens {
+		counts[token.Platform]++
+	}
+	return counts
+}
+
+// handleListTokens lists every registration with its platform and metadata,
+// for operators. It sits behind the raw API key, like /v1/notify-raw.
+func handleListTokens(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	tokens, err := getAllTokens(r.Context())
+	if err != nil {
+		logger.Error("Failed to get tokens", "error", err)
+		writeError(w, ErrStorageUnavailable, "Failed to retrieve tokens")
+		return
+	}
+	platform := r.URL.Query().Get("platform")
+
+	response := TokenListResponse{Success: true, Tokens: []TokenSummary{}, Platforms: platformCounts(tokens)}
+	for _, token := range tokens {
+		if platform != "" && token.Platform != platform {
+			continue
+		}
+		summary := TokenSummary{
+			TokenID:         token.OpaqueID,
+			Platform:        token.Platform,
+			FirebaseProject: token.FirebaseProject,
+			RegisteredAt:    token.RegisteredAt,
+			Metadata:        token.Metadata,
+		}
+		for _, ch := range token.Channels {
+			summary.Channels = append(summary.Channels, ch.Platform)
+		}
+		response.Tokens = append(response.Tokens, summary)
+	}
+	sort.Slice(response.Tokens, func(i, j int) bool {
+		return response.Tokens[i].RegisteredAt.Before(response.Tokens[j].RegisteredAt)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
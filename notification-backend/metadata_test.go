@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestRegisterPlatformAndMetadata(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalKey := privateKey, tokenStore, useExoscale, rawAPIKey
+	defer func() {
+		privateKey, tokenStore, useExoscale, rawAPIKey = originalPrivateKey, originalStore, originalExoscale, originalKey
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	rawAPIKey = "admin-key"
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+	register := func(reg TokenRegistration) (int, RegisterResponse, ErrorCode) {
+		reg.EncryptedData = encrypted
+		body, _ := json.Marshal(reg)
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		var resp RegisterResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, resp, errResp.Code
+	}
+
+	for platform, want := range map[string]ErrorCode{"": ErrMissingField, "unknown": ErrInvalidPlatform, "Android": ErrInvalidPlatform} {
+		if _, _, code := register(TokenRegistration{Platform: platform}); code != want {
+			t.Errorf("Platform %q: expected %s, got %s", platform, want, code)
+		}
+	}
+	for name, reg := range map[string]TokenRegistration{
+		"long app_version":     {Platform: "android", AppVersion: strings.Repeat("1", maxMetadataLength+1)},
+		"control character":    {Platform: "android", DeviceModel: "Pixel\n8"},
+		"not a language tag":   {Platform: "android", Locale: "english please"},
+		"unknown channel type": {Platform: "android", Channels: []ChannelRegistration{{Platform: "pager", EncryptedData: encrypted}}},
+	} {
+		if status, _, code := register(reg); status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d %s", name, status, code)
+		}
+	}
+
+	status, resp, code := register(TokenRegistration{Platform: "android", AppVersion: "2.3.1", OSVersion: "14", Locale: "fr-CH", DeviceModel: "Pixel 8"})
+	if status != http.StatusOK {
+		t.Fatalf("Expected registration with metadata to succeed, got %d %s", status, code)
+	}
+	token, err := getToken(t.Context(), resp.TokenID)
+	if err != nil {
+		t.Fatalf("Registered token not found: %v", err)
+	}
+	want := DeviceMetadata{AppVersion: "2.3.1", OSVersion: "14", Locale: "fr-CH", DeviceModel: "Pixel 8"}
+	if token.Metadata == nil || *token.Metadata != want {
+		t.Errorf("Expected metadata %+v to be stored, got %+v", want, token.Metadata)
+	}
+	if _, bare, _ := register(TokenRegistration{Platform: "ios"}); bare.TokenID == "" {
+		t.Fatal("Expected a registration without metadata to succeed")
+	}
+
+	list := func(query, key string) (int, TokenListResponse) {
+		req := httptest.NewRequest("GET", "/v1/tokens"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		requireAPIKey(handleListTokens)(rr, req)
+		var listed TokenListResponse
+		json.Unmarshal(rr.Body.Bytes(), &listed)
+		return rr.Code, listed
+	}
+	if status, _ := list("", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected the listing to need the API key, got %d", status)
+	}
+	status, listed := list("?platform=android", "admin-key")
+	if status != http.StatusOK || len(listed.Tokens) != 1 || listed.Tokens[0].TokenID != resp.TokenID {
+		t.Fatalf("Expected only the android registration, got %d %+v", status, listed)
+	}
+	if m := listed.Tokens[0].Metadata; m == nil || *m != want || listed.Tokens[0].RegisteredAt.IsZero() {
+		t.Errorf("Expected the listing to carry metadata and registration time, got %+v", listed.Tokens[0])
+	}
+	if listed.Platforms["android"] != 1 || listed.Platforms["ios"] != 1 {
+		t.Errorf("Expected per-platform counts, got %v", listed.Platforms)
+	}
+}
+
+func TestSendPlatformFilter(t *testing.T) {
+	originalStore, originalExoscale, originalClient := tokenStore, useExoscale, messagingClient
+	defer func() {
+		tokenStore, useExoscale, messagingClient = originalStore, originalExoscale, originalClient
+	}()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+
+	for _, platform := range []string{"android", "android", "ios"} {
+		if _, err := tokenStore.AddToken("encrypted", platform); err != nil {
+			t.Fatalf("AddToken failed: %v", err)
+		}
+	}
+
+	send := func(body string) (SendResponse, ErrorCode) {
+		rr := httptest.NewRecorder()
+		handleSend(rr, httptest.NewRequest("POST", "/v1/send", strings.NewReader(body)))
+		var resp SendResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return resp, errResp.Code
+	}
+	if resp, _ := send(`{"title":"t","body":"b"}`); resp.TotalTokens != 3 {
+		t.Errorf("Expected an unfiltered broadcast to target everything, got %+v", resp)
+	}
+	if resp, _ := send(`{"title":"t","body":"b","platform":"android"}`); resp.TotalTokens != 2 {
+		t.Errorf("Expected only the android registrations, got %+v", resp)
+	}
+	if _, code := send(`{"title":"t","body":"b","platform":"web"}`); code != ErrNoTokens {
+		t.Errorf("Expected NO_TOKENS without web registrations, got %s", code)
+	}
+	if _, code := send(`{"title":"t","body":"b","platform":"pager"}`); code != ErrInvalidPlatform {
+		t.Errorf("Expected INVALID_PLATFORM for an unknown platform, got %s", code)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+var (
+	mockFCM        = flag.Bool("mock-fcm", false, "Accept FCM sends without delivering them, for load tests; no Firebase credentials are needed and --firebase-projects is ignored")
+	mockFCMLatency = flag.Duration("mock-fcm-latency", 50*time.Millisecond, "How long each send takes with --mock-fcm, standing in for FCM's round trip")
+)
+
+// mockFCMSends counts the messages --mock-fcm accepted, published on the
+// debug listener under /debug/vars
+var mockFCMSends = expvar.NewInt("mock_fcm_sends")
+
+// mockMessenger answers like FCM after latency, delivering nothing
+type mockMessenger struct {
+	latency time.Duration
+	sent    atomic.Int64 // numbers the message IDs
+}
+
+var _ Messenger = (*mockMessenger)(nil)
+
+func (m *mockMessenger) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if err := m.wait(ctx); err != nil {
+		return "", err
+	}
+	return m.messageID(), nil
+}
+
+// SendEach takes one round trip for the batch, as FCM's batch call does
+func (m *mockMessenger) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	batch := &messaging.BatchResponse{SuccessCount: len(messages)}
+	for range messages {
+		batch.Responses = append(batch.Responses, &messaging.SendResponse{
+			Success:   true,
+			MessageID: m.messageID(),
+		})
+	}
+	return batch, nil
+}
+
+func (m *mockMessenger) SendDryRun(ctx context.Context, message *messaging.Message) (string, error) {
+	if err := m.wait(ctx); err != nil {
+		return "", err
+	}
+	return "projects/mock/messages/dry-run", nil
+}
+
+// messageID counts an accepted message and returns an ID in FCM's format
+func (m *mockMessenger) messageID() string {
+	mockFCMSends.Add(1)
+	return fmt.Sprintf("projects/mock/messages/%d", m.sent.Add(1))
+}
+
+// wait sleeps for the latency, or until ctx is done
+func (m *mockMessenger) wait(ctx context.Context) error {
+	select {
+	case <-time.After(m.latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
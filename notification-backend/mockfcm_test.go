@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+func TestMockMessenger(t *testing.T) {
+	m := &mockMessenger{latency: time.Millisecond}
+	before := mockFCMSends.Value()
+
+	if id, err := m.Send(context.Background(), &messaging.Message{Token: "t"}); err != nil || id == "" {
+		t.Fatalf("Send = %q, %v", id, err)
+	}
+	batch, err := m.SendEach(context.Background(), []*messaging.Message{{Token: "a"}, {Token: "b"}})
+	if err != nil || batch.SuccessCount != 2 || len(batch.Responses) != 2 || !batch.Responses[1].Success {
+		t.Fatalf("SendEach = %+v, %v", batch, err)
+	}
+	if _, err := m.SendDryRun(context.Background(), &messaging.Message{Token: "t"}); err != nil {
+		t.Fatalf("SendDryRun failed: %v", err)
+	}
+	if sent := mockFCMSends.Value() - before; sent != 3 {
+		t.Errorf("Expected 3 messages counted, got %d", sent)
+	}
+
+	// A send gives up with its caller
+	slow := &mockMessenger{latency: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := slow.Send(ctx, &messaging.Message{Token: "t"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled send, got %v", err)
+	}
+}
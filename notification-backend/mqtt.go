@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	// MQTT configuration; platform "mqtt" is disabled without a broker
+	mqttBroker        = flag.String("mqtt-broker", "", "MQTT broker URL for platform \"mqtt\" (tcp://, ssl:// or wss://); empty disables it")
+	mqttUsername      = flag.String("mqtt-username", "", "MQTT username")
+	mqttPasswordArg   = flag.String("mqtt-password", "", "MQTT password (or MQTT_PASSWORD)")
+	mqttClientID      = flag.String("mqtt-client-id", "notification-backend", "MQTT client ID; must be unique per replica")
+	mqttTopicPrefix   = flag.String("mqtt-topic-prefix", "notifications", "Notifications are published to <prefix>/<opaque ID>")
+	mqttQoS           = flag.Int("mqtt-qos", 1, "QoS for published notifications: 0, 1 or 2")
+	mqttPayloadFormat = flag.String("mqtt-payload-format", "json", "Payload format: json ({\"title\",\"body\"}) or text (title, newline, body)")
+	mqttRetain        = flag.Bool("mqtt-retain", false, "Publish retained messages, so a device that connects later still gets the latest notification")
+	mqttTimeout       = flag.Duration("mqtt-timeout", 10*time.Second, "Timeout for a single MQTT publish")
+)
+
+// mqttPublisher is the part of the paho client the transport uses; tests replace it
+type mqttPublisher interface {
+	IsConnectionOpen() bool
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+}
+
+// mqttClient is nil unless --mqtt-broker is set
+var mqttClient mqttPublisher
+
+var mqttTransport = &transport{
+	name:       "mqtt",
+	configured: func() bool { return mqttClient != nil },
+	ready: func() error {
+		if mqttClient == nil {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("MQTT is not configured (--mqtt-broker)"))
+		}
+		if !mqttClient.IsConnectionOpen() {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("not connected to the MQTT broker"))
+		}
+		return nil
+	},
+	validate: validateMQTTClientID,
+	send:     sendMQTT,
+}
+
+// MQTTPayload is the JSON published when --mqtt-payload-format=json
+type MQTTPayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// setupMQTT validates the MQTT settings and connects to the broker in the
+// background, reconnecting as needed. The returned function disconnects.
+func setupMQTT(broker string) (func(), error) {
+	if broker == "" {
+		return func() {}, nil
+	}
+	if *mqttQoS < 0 || *mqttQoS > 2 {
+		return nil, fmt.Errorf("--mqtt-qos must be 0, 1 or 2, got %d", *mqttQoS)
+	}
+	if *mqttPayloadFormat != "json" && *mqttPayloadFormat != "text" {
+		return nil, fmt.Errorf("--mqtt-payload-format must be json or text, got %q", *mqttPayloadFormat)
+	}
+	if *mqttTopicPrefix == "" || strings.ContainsAny(*mqttTopicPrefix, "+#\x00") {
+		return nil, fmt.Errorf("--mqtt-topic-prefix must be non-empty and free of MQTT wildcards")
+	}
+
+	password := *mqttPasswordArg
+	if password == "" {
+		password = os.Getenv("MQTT_PASSWORD")
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(*mqttClientID).
+		SetUsername(*mqttUsername).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectTimeout(*mqttTimeout).
+		SetOnConnectHandler(func(mqtt.Client) {
+			slog.Info("Connected to MQTT broker", "broker", broker)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Lost connection to MQTT broker", "broker", broker, "error", err)
+		})
+
+	client := mqtt.NewClient(opts)
+	// With ConnectRetry the token only completes once connected, so don't
+	// wait: startup must not depend on the broker being up
+	client.Connect()
+	mqttClient = client
+
+	return func() { client.Disconnect(250) }, nil
+}
+
+// validateMQTTClientID checks the decrypted registration payload, the
+// device's own MQTT client ID. Delivery does not depend on it; the topic
+// comes from the opaque ID.
+func validateMQTTClientID(clientID string) error {
+	if clientID == "" || len(clientID) > 256 || strings.ContainsAny(clientID, "+#/\x00") {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("MQTT client ID must be 1-256 characters without '+', '#', '/' or NUL"))
+	}
+	return nil
+}
+
+// mqttTopic is where a registration's notifications are published
+func mqttTopic(opaqueID string) string {
+	return *mqttTopicPrefix + "/" + opaqueID
+}
+
+// mqttPayload renders the notification in the configured format
+func mqttPayload(title, body string) ([]byte, error) {
+	if *mqttPayloadFormat == "text" {
+		return []byte(title + "\n" + body), nil
+	}
+	return json.Marshal(MQTTPayload{Title: title, Body: body})
+}
+
+// sendMQTT publishes to the registration's topic. With QoS 1 or 2 this waits
+// for the broker's acknowledgement, with QoS 0 only until the message is written.
+func sendMQTT(ctx context.Context, d delivery) error {
+	payload, err := mqttPayload(d.Title, d.Body)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	ctx, span := startSpan(ctx, "mqtt.publish")
+	sendCtx, cancel := context.WithTimeout(ctx, *mqttTimeout)
+	defer cancel()
+
+	token := mqttClient.Publish(mqttTopic(d.OpaqueID), byte(*mqttQoS), *mqttRetain, payload)
+	select {
+	case <-token.Done():
+		err = token.Error()
+	case <-sendCtx.Done():
+		err = fmt.Errorf("timed out waiting for the broker: %v", sendCtx.Err())
+	}
+	endSpan(span, err)
+
+	if err != nil {
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to publish to MQTT: %v", err))
+	}
+	return nil
+}
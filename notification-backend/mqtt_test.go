@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTTToken completes immediately with err, or never when hang is set
+type fakeMQTTToken struct {
+	done chan struct{}
+	err  error
+}
+
+func newFakeMQTTToken(err error, hang bool) *fakeMQTTToken {
+	tok := &fakeMQTTToken{done: make(chan struct{}), err: err}
+	if !hang {
+		close(tok.done)
+	}
+	return tok
+}
+
+func (t *fakeMQTTToken) Wait() bool                     { <-t.done; return true }
+func (t *fakeMQTTToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeMQTTToken) Done() <-chan struct{}          { return t.done }
+func (t *fakeMQTTToken) Error() error                   { return t.err }
+
+type mqttPublish struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+// fakeMQTTClient records publishes instead of talking to a broker
+type fakeMQTTClient struct {
+	connected bool
+	err       error
+	hang      bool
+	published []mqttPublish
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return c.connected }
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published = append(c.published, mqttPublish{topic, qos, retained, payload.([]byte)})
+	return newFakeMQTTToken(c.err, c.hang)
+}
+
+func TestSendMQTT(t *testing.T) {
+	client := &fakeMQTTClient{connected: true}
+	originalClient, originalFormat, originalQoS, originalTimeout := mqttClient, *mqttPayloadFormat, *mqttQoS, *mqttTimeout
+	defer func() {
+		mqttClient, *mqttPayloadFormat, *mqttQoS, *mqttTimeout = originalClient, originalFormat, originalQoS, originalTimeout
+	}()
+	mqttClient = client
+
+	d := delivery{OpaqueID: "abc123", Address: "sensor-1", Title: "Hello", Body: "World"}
+	if err := mqttTransport.ready(); err != nil {
+		t.Fatalf("Expected connected client to be ready, got %v", err)
+	}
+	if err := sendMQTT(t.Context(), d); err != nil {
+		t.Fatalf("Expected publish to succeed, got %v", err)
+	}
+	var payload MQTTPayload
+	got := client.published[0]
+	if err := json.Unmarshal(got.payload, &payload); err != nil || payload.Title != "Hello" || payload.Body != "World" {
+		t.Errorf("Unexpected JSON payload %q: %v", got.payload, err)
+	}
+	if got.topic != "notifications/abc123" || got.qos != 1 || got.retained {
+		t.Errorf("Unexpected publish: %+v", got)
+	}
+
+	*mqttPayloadFormat, *mqttQoS = "text", 0
+	sendMQTT(t.Context(), d)
+	if got := client.published[1]; string(got.payload) != "Hello\nWorld" || got.qos != 0 {
+		t.Errorf("Unexpected text publish: %+v", got)
+	}
+
+	client.err = errors.New("not authorized")
+	if err := sendMQTT(t.Context(), d); errorCodeOf(err, "") != ErrTransportUnavailable {
+		t.Errorf("Expected broker error to be TRANSPORT_UNAVAILABLE, got %v", err)
+	}
+
+	client.err, client.hang, *mqttTimeout = nil, true, 10*time.Millisecond
+	if err := sendMQTT(t.Context(), d); errorCodeOf(err, "") != ErrTransportUnavailable {
+		t.Errorf("Expected unacknowledged publish to time out, got %v", err)
+	}
+
+	client.connected = false
+	if err := mqttTransport.ready(); errorCodeOf(err, "") != ErrTransportUnavailable {
+		t.Errorf("Expected disconnected client to be unavailable, got %v", err)
+	}
+}
+
+func TestMQTTConfiguration(t *testing.T) {
+	originalQoS, originalFormat, originalPrefix := *mqttQoS, *mqttPayloadFormat, *mqttTopicPrefix
+	defer func() { *mqttQoS, *mqttPayloadFormat, *mqttTopicPrefix = originalQoS, originalFormat, originalPrefix }()
+
+	*mqttQoS = 3
+	if _, err := setupMQTT("tcp://localhost:1883"); err == nil {
+		t.Error("Expected QoS 3 to be rejected")
+	}
+	*mqttQoS, *mqttPayloadFormat = 1, "xml"
+	if _, err := setupMQTT("tcp://localhost:1883"); err == nil {
+		t.Error("Expected unknown payload format to be rejected")
+	}
+	*mqttPayloadFormat, *mqttTopicPrefix = "json", "devices/#"
+	if _, err := setupMQTT("tcp://localhost:1883"); err == nil {
+		t.Error("Expected wildcard topic prefix to be rejected")
+	}
+
+	for clientID, valid := range map[string]bool{
+		"sensor-1":   true,
+		"":           false,
+		"a/b":        false,
+		"sensor+":    false,
+		"sensor\x00": false,
+	} {
+		if err := validateMQTTClientID(clientID); (err == nil) != valid {
+			t.Errorf("Client ID %q: expected valid=%v, got %v", clientID, valid, err)
+		}
+	}
+
+	if transportFor("mqtt") != mqttTransport {
+		t.Error("Expected platform routing to pick MQTT for \"mqtt\"")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ndjsonContentType selects streamed per-delivery progress on /send
+const ndjsonContentType = "application/x-ndjson"
+
+// SendProgressEvent is one line of a streamed /send response: a "delivery"
+// line per attempt as it happens, then a single "summary" line
+type SendProgressEvent struct {
+	Type    string    `json:"type"`
+	TokenID string    `json:"token_id,omitempty"` // shortened opaque ID
+	Result  string    `json:"result,omitempty"`   // "sent" or "failed"
+	Code    ErrorCode `json:"code,omitempty"`     // why a delivery failed
+	*SendResponse
+}
+
+// wantsNDJSON reports whether the client listed application/x-ndjson in Accept
+func wantsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// progressStream writes NDJSON lines, flushing each one so clients see
+// progress while a broadcast is still running
+type progressStream struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	enc *json.Encoder
+}
+
+// newProgressStream commits a 200 response; errors after this point can only
+// be reported per line
+func newProgressStream(w http.ResponseWriter) *progressStream {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	return &progressStream{w: w, rc: http.NewResponseController(w), enc: json.NewEncoder(w)}
+}
+
+// delivery reports one attempt. A nil stream is a no-op so callers need not check.
+func (s *progressStream) delivery(opaqueID string, err error) {
+	if s == nil {
+		return
+	}
+	event := SendProgressEvent{Type: "delivery", TokenID: tokenIDPrefix(opaqueID), Result: "sent"}
+	if err != nil {
+		event.Result = "failed"
+		event.Code = errorCodeOf(err, ErrFCMUnavailable)
+	}
+	s.write(event)
+}
+
+// summary ends the stream with the same totals a buffered response carries
+func (s *progressStream) summary(response SendResponse) {
+	s.write(SendProgressEvent{Type: "summary", SendResponse: &response})
+}
+
+func (s *progressStream) write(event SendProgressEvent) {
+	// Each line earns a fresh write deadline, so a steadily progressing
+	// broadcast is not cut off by --write-timeout
+	if *writeTimeout > 0 {
+		s.rc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+	if err := s.enc.Encode(event); err != nil {
+		return
+	}
+	s.rc.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendStreamsNDJSONProgress(t *testing.T) {
+	originalStore, originalExoscale, originalClient := tokenStore, useExoscale, messagingClient
+	defer func() { tokenStore, useExoscale, messagingClient = originalStore, originalExoscale, originalClient }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+
+	for i := 0; i < 3; i++ {
+		if _, err := tokenStore.AddToken("encrypted", "android"); err != nil {
+			t.Fatalf("AddToken failed: %v", err)
+		}
+	}
+
+	handler := gzipHandler(loggingMiddleware(handleSend))
+	req := httptest.NewRequest("POST", "/v1/send", strings.NewReader(`{"title":"t","body":"b"}`))
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("Expected NDJSON 200, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !rr.Flushed {
+		t.Error("Expected each line to be flushed")
+	}
+
+	var events []SendProgressEvent
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var event SendProgressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Line %q is not JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 4 {
+		t.Fatalf("Expected 3 delivery lines and a summary, got %d", len(events))
+	}
+	for _, event := range events[:3] {
+		if event.Type != "delivery" || event.Result != "failed" || event.Code != ErrFCMUnavailable || !strings.HasSuffix(event.TokenID, "...") {
+			t.Errorf("Unexpected delivery line: %+v", event)
+		}
+	}
+	summary := events[3]
+	if summary.Type != "summary" || summary.SendResponse == nil || summary.ErrorCount != 3 || summary.TotalTokens != 3 {
+		t.Errorf("Unexpected summary line: %+v", summary)
+	}
+}
+
+func TestSendWithoutNDJSONIsBuffered(t *testing.T) {
+	originalStore, originalExoscale, originalClient := tokenStore, useExoscale, messagingClient
+	defer func() { tokenStore, useExoscale, messagingClient = originalStore, originalExoscale, originalClient }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil
+
+	if _, err := tokenStore.AddToken("encrypted", "android"); err != nil {
+		t.Fatalf("AddToken failed: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handleSend(rr, httptest.NewRequest("POST", "/v1/send", strings.NewReader(`{"title":"t","body":"b"}`)))
+
+	var resp SendResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Response is not JSON: %v", err)
+	}
+	if resp.Success || resp.ErrorCount != 1 || resp.TotalTokens != 1 {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestNotifySecret(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalRequire := privateKey, tokenStore, useExoscale, *requireNotifySecret
+	defer func() {
+		privateKey, tokenStore, useExoscale, *requireNotifySecret = originalPrivateKey, originalStore, originalExoscale, originalRequire
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+	body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android"})
+	rr := httptest.NewRecorder()
+	handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+	var reg RegisterResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &reg); err != nil || reg.NotifySecret == "" {
+		t.Fatalf("Expected a notify secret in the registration response, got %q", rr.Body.String())
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected the registration response not to be cached")
+	}
+	token, err := getToken(t.Context(), reg.TokenID)
+	if err != nil {
+		t.Fatalf("Registered token not found: %v", err)
+	}
+	if token.NotifySecretHash != hashNotifySecret(reg.NotifySecret) {
+		t.Errorf("Expected the secret's hash to be stored, got %q", token.NotifySecretHash)
+	}
+
+	notify := func(tokenID, secret string) (int, ErrorCode) {
+		body, _ := json.Marshal(SingleNotificationRequest{TokenID: tokenID, NotifySecret: secret, Title: "t", Body: "b"})
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(body)))
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, errResp.Code
+	}
+
+	for name, secret := range map[string]string{"missing": "", "wrong": reg.NotifySecret + "x"} {
+		if status, code := notify(reg.TokenID, secret); status != http.StatusUnauthorized || code != ErrUnauthorized {
+			t.Errorf("%s secret: expected 401 UNAUTHORIZED, got %d %s", name, status, code)
+		}
+	}
+	// The right secret gets as far as FCM, which is not set up here
+	if _, code := notify(reg.TokenID, reg.NotifySecret); code != ErrFCMUnavailable {
+		t.Errorf("Expected the right secret to reach the send, got %s", code)
+	}
+
+	// Tokens stored before notify secrets have no hash
+	legacyID, _ := tokenStore.AddToken(encrypted, "android")
+	if _, code := notify(legacyID, ""); code != ErrFCMUnavailable {
+		t.Errorf("Expected a legacy token to be sent to without a secret, got %s", code)
+	}
+	*requireNotifySecret = true
+	if status, _ := notify(legacyID, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a legacy token with --require-notify-secret, got %d", status)
+	}
+}
+
+func TestNotifyPublicKeyHashScope(t *testing.T) {
+	originalStore, originalExoscale, originalHash := tokenStore, useExoscale, publicKeyHash
+	defer func() { tokenStore, useExoscale, publicKeyHash = originalStore, originalExoscale, originalHash }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	publicKeyHash = ComputePublicKeyHash("our key")
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(2))
+	tokenID, _ := tokenStore.AddToken(encrypted, "android")
+	notify := func(hash string) (int, ErrorCode) {
+		body, _ := json.Marshal(SingleNotificationRequest{TokenID: tokenID, PublicKeyHash: hash, Title: "t", Body: "b"})
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(body)))
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, errResp.Code
+	}
+
+	if status, code := notify(ComputePublicKeyHash("their key")); status != http.StatusForbidden || code != ErrKeyMismatch {
+		t.Errorf("Expected 403 KEY_MISMATCH for another key, got %d %s", status, code)
+	}
+	// Our own key, or none, gets as far as FCM
+	for _, hash := range []string{publicKeyHash, ""} {
+		if _, code := notify(hash); code != ErrFCMUnavailable {
+			t.Errorf("Expected %q to reach the send, got %s", hash, code)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// ntfy configuration; platform "ntfy" is disabled without a server
+	ntfyServer   = flag.String("ntfy-server", "", "ntfy server URL for platform \"ntfy\", e.g. https://ntfy.sh; empty disables it")
+	ntfyTokenArg = flag.String("ntfy-token", "", "Access token for a protected ntfy server (or NTFY_TOKEN)")
+	ntfyPriority = flag.Int("ntfy-priority", 4, "ntfy message priority, 1 (min) to 5 (max)")
+	ntfyTimeout  = flag.Duration("ntfy-timeout", 10*time.Second, "Timeout for a single ntfy publish")
+)
+
+// ntfyToken is resolved from the flag or environment at startup
+var ntfyToken string
+
+// ntfyClient publishes to the ntfy server; tests replace it
+var ntfyClient = &http.Client{}
+
+// ntfyTopicPattern is the topic syntax ntfy accepts
+var ntfyTopicPattern = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+var ntfyTransport = &transport{
+	name:       "ntfy",
+	configured: func() bool { return *ntfyServer != "" },
+	ready: func() error {
+		if *ntfyServer == "" {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("ntfy is not configured (--ntfy-server)"))
+		}
+		return nil
+	},
+	validate: validateNtfyTopic,
+	send:     sendNtfy,
+}
+
+// ntfyMessage is the JSON publish format, see https://docs.ntfy.sh/publish/#publish-as-json
+type ntfyMessage struct {
+	Topic    string `json:"topic"`
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// setupNtfy checks the server URL and resolves the access token, preferring the flag over NTFY_TOKEN
+func setupNtfy(server, token string) error {
+	if server == "" {
+		return nil
+	}
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("--ntfy-server must be an http(s) URL, got %q", server)
+	}
+	if token == "" {
+		token = os.Getenv("NTFY_TOKEN")
+	}
+	ntfyToken = token
+	return nil
+}
+
+// validateNtfyTopic checks a decrypted topic name. Only the topic is stored,
+// never a server URL, so registrations cannot point the backend elsewhere.
+func validateNtfyTopic(topic string) error {
+	if !ntfyTopicPattern.MatchString(topic) {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("ntfy topic must be 1-64 letters, digits, '-' or '_'"))
+	}
+	return nil
+}
+
+// sendNtfy publishes the notification to the device's topic on the configured server
+func sendNtfy(ctx context.Context, d delivery) error {
+	payload, err := json.Marshal(ntfyMessage{Topic: d.Address, Title: d.Title, Message: d.Body, Priority: *ntfyPriority})
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	ctx, span := startSpan(ctx, "ntfy.publish")
+	sendCtx, cancel := context.WithTimeout(ctx, *ntfyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, strings.TrimRight(*ntfyServer, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to build ntfy request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ntfyToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ntfyToken)
+	}
+
+	resp, err := ntfyClient.Do(req)
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to publish to ntfy: %v", err))
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	err = nil
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("ntfy rejected the message: %s %s", resp.Status, detail))
+	default:
+		// 401/403 mean our token is wrong, 429 and 5xx are the server's problem
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("ntfy returned %s %s", resp.Status, detail))
+	}
+	endSpan(span, err)
+	return err
+}
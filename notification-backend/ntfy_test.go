@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendNtfy(t *testing.T) {
+	var got ntfyMessage
+	var auth string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	originalServer, originalToken := *ntfyServer, ntfyToken
+	defer func() { *ntfyServer, ntfyToken = originalServer, originalToken }()
+	if err := setupNtfy(server.URL, "tk_secret"); err != nil {
+		t.Fatalf("setupNtfy failed: %v", err)
+	}
+	*ntfyServer = server.URL
+
+	if err := sendNtfy(t.Context(), delivery{Address: "phone-123", Title: "Hello", Body: "World"}); err != nil {
+		t.Fatalf("Expected publish to succeed, got %v", err)
+	}
+	if got.Topic != "phone-123" || got.Title != "Hello" || got.Message != "World" || auth != "Bearer tk_secret" {
+		t.Errorf("Unexpected publish: %+v (auth %q)", got, auth)
+	}
+
+	for statusCode, code := range map[int]ErrorCode{
+		http.StatusBadRequest:          ErrInvalidMessage,
+		http.StatusForbidden:           ErrTransportUnavailable,
+		http.StatusTooManyRequests:     ErrTransportUnavailable,
+		http.StatusInternalServerError: ErrTransportUnavailable,
+	} {
+		status = statusCode
+		if err := sendNtfy(t.Context(), delivery{Address: "phone-123", Title: "Hello", Body: "World"}); errorCodeOf(err, "") != code {
+			t.Errorf("ntfy %d: expected %s, got %v", statusCode, code, err)
+		}
+	}
+}
+
+func TestNtfyConfiguration(t *testing.T) {
+	if err := setupNtfy("ftp://ntfy.example.com", ""); err == nil {
+		t.Error("Expected non-http server URL to be rejected")
+	}
+
+	for topic, valid := range map[string]bool{
+		"phone-123_abc":         true,
+		"":                      false,
+		"has space":             false,
+		"../admin":              false,
+		"https://evil.example/": false,
+	} {
+		if err := validateNtfyTopic(topic); (err == nil) != valid {
+			t.Errorf("Topic %q: expected valid=%v, got %v", topic, valid, err)
+		}
+	}
+
+	if transportFor("ntfy") != ntfyTransport || transportFor("android") != fcmTransport {
+		t.Error("Expected platform routing to pick ntfy for \"ntfy\" and FCM otherwise")
+	}
+}
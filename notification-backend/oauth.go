@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessTokenCache holds an OAuth access token for a push service that uses
+// the client credentials grant. Tokens are refreshed a minute before expiry.
+type accessTokenCache struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// get returns the cached token, calling fetch when it has expired or refresh is set
+func (c *accessTokenCache) get(ctx context.Context, refresh bool, fetch func(ctx context.Context) (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !refresh && c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	token, lifetime, err := fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.expires = time.Now().Add(lifetime - time.Minute)
+	return token, nil
+}
+
+// reset drops the cached token
+func (c *accessTokenCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+// fetchClientCredentials runs an OAuth 2.0 client credentials token request
+func fetchClientCredentials(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (string, time.Duration, error) {
+	form.Set("grant_type", "client_credentials")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to build token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to fetch access token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   int             `json:"expires_in"`
+		Error       json.RawMessage `json:"error"` // a string per RFC 6749, a number at Huawei
+		Description string          `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return "", 0, fmt.Errorf("invalid token response (%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", 0, fmt.Errorf("token request failed: %s %s %s", resp.Status, result.Error, result.Description)
+	}
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"remote-notification/api"
+)
+
+// generateOpaqueID creates a new opaque identifier of the current version,
+// see api.ParseOpaqueID for the format
+func generateOpaqueID() string {
+	// 32 random bytes (256 bits); crypto/rand does not fail since Go 1.24
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	return fmt.Sprintf("rn%d_%s", api.OpaqueIDVersion, api.OpaqueIDEncoding.EncodeToString(bytes))
+}
+
+// validateOpaqueID rejects IDs this server cannot have issued before they
+// reach storage, where they become object keys. They are unknown tokens.
+func validateOpaqueID(id string) error {
+	if _, err := api.ParseOpaqueID(id); err != nil {
+		return withCode(ErrTokenNotFound, err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"remote-notification/api"
+)
+
+func TestOpaqueIDFormat(t *testing.T) {
+	id := generateOpaqueID()
+	if !strings.HasPrefix(id, "rn1_") || len(id) != 56 {
+		t.Fatalf("Expected a 56 character rn1_ ID, got %q", id)
+	}
+	if id == generateOpaqueID() {
+		t.Error("Expected fresh IDs to differ")
+	}
+
+	valid := map[string]int{
+		id:                                1,
+		testOpaqueID:                      0,
+		"rn2_bodyofanewerformatanylength": 2,
+	}
+	for id, want := range valid {
+		if got, err := api.ParseOpaqueID(id); err != nil || got != want {
+			t.Errorf("api.ParseOpaqueID(%q) = %d, %v; want version %d", id, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "unknown", "rn1_" + id[5:], strings.ToUpper(id), "rn0_abc", "rn2_../../other-key", "rn2_" + strings.Repeat("a", api.MaxOpaqueIDLength)} {
+		if err := validateOpaqueID(bad); errorCodeOf(err, "") != ErrTokenNotFound {
+			t.Errorf("Expected %q to be TOKEN_NOT_FOUND, got %v", bad, err)
+		}
+	}
+	if _, err := getToken(t.Context(), "rn2_../../other-key"); errorCodeOf(err, "") != ErrTokenNotFound {
+		t.Errorf("Expected a malformed ID to be refused before storage, got %v", err)
+	}
+
+	// Both forms are masked in logs
+	line := logLine(privacyStandard, "error", errors.New("failed to get object abcd/"+id))
+	if strings.Contains(line, id) {
+		t.Errorf("Full opaque ID leaked with standard privacy: %s", line)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Long-poll configuration; platform "poll" is disabled by default
+	pollEnabled    = flag.Bool("poll", false, "Accept platform \"poll\" registrations and serve GET /v1/poll/{token_id}, for networks that block WebSockets; needs a single replica")
+	pollMaxWait    = flag.Duration("poll-max-wait", 55*time.Second, "Longest a poll is held open waiting for a message (capped below --write-timeout)")
+	pollMessageTTL = flag.Duration("poll-message-ttl", 24*time.Hour, "How long an unacknowledged message is kept for a polling device")
+	pollMaxPending = flag.Int("poll-max-pending", 100, "Most messages kept per polling device; the oldest are dropped beyond this")
+)
+
+// PendingMessage is a notification waiting for a polling device. Seq grows
+// with every message for the registration and is how the device acknowledges.
+type PendingMessage struct {
+	Seq       int64     `json:"seq"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// pendingQueue is a registration's undelivered messages, as stored
+type pendingQueue struct {
+	LastSeq  int64            `json:"last_seq"`
+	Messages []PendingMessage `json:"messages,omitempty"`
+}
+
+func (q *pendingQueue) clone() pendingQueue {
+	return pendingQueue{LastSeq: q.LastSeq, Messages: append([]PendingMessage(nil), q.Messages...)}
+}
+
+// release drops messages up to seq, which the device has acknowledged, and
+// expired ones. It reports whether anything changed.
+func (q *pendingQueue) release(seq int64, now time.Time) bool {
+	kept := q.Messages[:0]
+	for _, m := range q.Messages {
+		if m.Seq > seq && now.Sub(m.CreatedAt) < *pollMessageTTL {
+			kept = append(kept, m)
+		}
+	}
+	changed := len(kept) != len(q.Messages)
+	q.Messages = kept
+	return changed
+}
+
+// PollResponse is the body of a poll. Passing the highest seq back as the
+// after parameter of the next poll acknowledges every message up to it.
+type PollResponse struct {
+	Messages []PendingMessage `json:"messages"`
+}
+
+// pollWaiters wakes polls held open on this replica when a message is queued
+var pollWaiters = struct {
+	mu    sync.Mutex
+	chans map[string]chan struct{}
+}{chans: make(map[string]chan struct{})}
+
+// pollWaiter returns a channel that is closed on the next message for id
+func pollWaiter(id string) <-chan struct{} {
+	pollWaiters.mu.Lock()
+	defer pollWaiters.mu.Unlock()
+	ch, ok := pollWaiters.chans[id]
+	if !ok {
+		ch = make(chan struct{})
+		pollWaiters.chans[id] = ch
+	}
+	return ch
+}
+
+// wakePollers releases every poll waiting on id
+func wakePollers(id string) {
+	pollWaiters.mu.Lock()
+	defer pollWaiters.mu.Unlock()
+	if ch, ok := pollWaiters.chans[id]; ok {
+		close(ch)
+		delete(pollWaiters.chans, id)
+	}
+}
+
+var pollTransport = &transport{
+	name:       "poll",
+	configured: func() bool { return *pollEnabled },
+	ready: func() error {
+		if !*pollEnabled {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("long-poll delivery is not enabled (--poll)"))
+		}
+		return nil
+	},
+	validate: validateDeviceSecret,
+	send:     queuePollMessage,
+}
+
+// updatePending applies update to a registration's pending messages in the token store
+func updatePending(ctx context.Context, opaqueID string, update func(*pendingQueue) bool) (pendingQueue, error) {
+	if err := validateOpaqueID(opaqueID); err != nil {
+		return pendingQueue{}, err
+	}
+	if _, pendingUpload := tokenStore.GetPendingUpload(opaqueID); useExoscale && !pendingUpload {
+		return exoscaleStorage.UpdatePending(ctx, opaqueID, update)
+	}
+	return tokenStore.UpdatePending(opaqueID, update)
+}
+
+// queuePollMessage stores the notification until the device polls and
+// acknowledges it; a send succeeds once the message is stored
+func queuePollMessage(ctx context.Context, d delivery) error {
+	ctx, span := startSpan(ctx, "poll.queue")
+	var dropped int
+	_, err := updatePending(ctx, d.OpaqueID, func(q *pendingQueue) bool {
+		now := time.Now().UTC()
+		q.release(0, now)
+		q.LastSeq++
+		q.Messages = append(q.Messages, PendingMessage{Seq: q.LastSeq, Title: d.Title, Body: d.Body, CreatedAt: now})
+		if extra := len(q.Messages) - *pollMaxPending; extra > 0 {
+			dropped = extra
+			q.Messages = q.Messages[extra:]
+		}
+		return true
+	})
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		loggerFromContext(ctx).Warn("Polling device is not keeping up, dropped oldest messages", "token_id", d.OpaqueID, "dropped", dropped)
+	}
+	wakePollers(d.OpaqueID)
+	return nil
+}
+
+// pollWriteMargin is left of the write timeout to write a poll's answer
+const pollWriteMargin = 5 * time.Second
+
+// pollWait is how long a poll may be held: the requested wait, bounded by
+// --poll-max-wait and, when there is one, the server's write timeout. A
+// write timeout too short for the margin still leaves half of it to wait.
+func pollWait(r *http.Request) (time.Duration, error) {
+	wait := *pollMaxWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return 0, fmt.Errorf("wait must be a number of seconds")
+		}
+		if requested := time.Duration(seconds) * time.Second; requested < wait {
+			wait = requested
+		}
+	}
+	if *writeTimeout > 0 {
+		limit := *writeTimeout - pollWriteMargin
+		if limit < *writeTimeout/2 {
+			limit = *writeTimeout / 2
+		}
+		if wait > limit {
+			wait = limit
+		}
+	}
+	return wait, nil
+}
+
+// handlePoll returns a device's pending messages, holding the request open
+// until one arrives or the wait ends. Messages stay queued until a later
+// poll acknowledges them with after, so delivery is at least once.
+func handlePoll(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if !*pollEnabled {
+		writeError(w, ErrEndpointDisabled, "Endpoint disabled; set --poll to enable it")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	id := r.PathValue("id")
+	secret, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if err := authenticateDevice(r.Context(), "poll", id, secret); err != nil {
+		logger.Warn("Poll authentication failed", "error", err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="poll"`)
+		writeError(w, ErrUnauthorized, "Missing or invalid device secret")
+		return
+	}
+
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, ErrInvalidRequest, "after must be a message seq")
+			return
+		}
+	}
+	wait, err := pollWait(r)
+	if err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		// Subscribe before reading, so a message queued in between still wakes us
+		woken := pollWaiter(id)
+		queue, err := updatePending(r.Context(), id, func(q *pendingQueue) bool {
+			return q.release(after, time.Now())
+		})
+		if err != nil {
+			code := errorCodeOf(err, ErrStorageUnavailable)
+			logger.Error("Failed to read pending messages", "code", code, "error", err)
+			writeError(w, code, "Failed to read pending messages")
+			return
+		}
+		if len(queue.Messages) > 0 {
+			writePoll(w, r, queue.Messages)
+			return
+		}
+
+		select {
+		case <-woken:
+		case <-timer.C:
+			writePoll(w, r, nil)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writePoll(w http.ResponseWriter, r *http.Request, messages []PendingMessage) {
+	if messages == nil {
+		messages = []PendingMessage{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(PollResponse{Messages: messages}); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
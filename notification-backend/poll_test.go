@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+func TestLongPoll(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalEnabled := privateKey, tokenStore, useExoscale, *pollEnabled
+	originalMaxPending, originalTTL := *pollMaxPending, *pollMessageTTL
+	defer func() {
+		privateKey, tokenStore, useExoscale, *pollEnabled = originalPrivateKey, originalStore, originalExoscale, originalEnabled
+		*pollMaxPending, *pollMessageTTL = originalMaxPending, originalTTL
+	}()
+	privateKey = privKey
+	storageFile := filepath.Join(t.TempDir(), "tokens.json")
+	tokenStore = NewDurableTokenStore(storageFile)
+	useExoscale = false
+	*pollEnabled = true
+
+	const secret = "0123456789abcdef0123456789abcdef"
+	encrypted := apitest.EncryptToken(secret)
+	opaqueID, _ := tokenStore.AddToken(encrypted, "poll")
+	token, _ := getToken(t.Context(), opaqueID)
+
+	poll := func(query, presented string) (int, PollResponse) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/v1/poll/"+opaqueID+query, nil)
+		req.SetPathValue("id", opaqueID)
+		req.Header.Set("Authorization", "Bearer "+presented)
+		rr := httptest.NewRecorder()
+		handlePoll(rr, req)
+		var resp PollResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp
+	}
+
+	if code, resp := poll("?wait=0", secret); code != http.StatusOK || resp.Messages == nil || len(resp.Messages) != 0 {
+		t.Errorf("Expected an empty list, got %d %+v", code, resp)
+	}
+	if code, _ := poll("?wait=0", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong secret, got %d", code)
+	}
+
+	sendNotification(t.Context(), token, delivery{Title: "one", Body: "1"})
+	sendNotification(t.Context(), token, delivery{Title: "two", Body: "2"})
+	_, resp := poll("?wait=0", secret)
+	if len(resp.Messages) != 2 || resp.Messages[0].Title != "one" || resp.Messages[1].Seq != 2 {
+		t.Fatalf("Expected both messages, got %+v", resp)
+	}
+
+	// Unacknowledged messages come back, and survive a restart
+	tokenStore = NewDurableTokenStore(storageFile)
+	if _, resp := poll("?wait=0&after=1", secret); len(resp.Messages) != 1 || resp.Messages[0].Title != "two" {
+		t.Errorf("Expected only the unacknowledged message after a reload, got %+v", resp)
+	}
+	if _, resp := poll("?wait=0&after=2", secret); len(resp.Messages) != 0 {
+		t.Errorf("Expected acknowledged messages to be gone, got %+v", resp)
+	}
+
+	// A held poll returns as soon as a message is queued
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sendNotification(t.Context(), token, delivery{Title: "three", Body: "3"})
+	}()
+	start := time.Now()
+	if _, resp := poll("?wait=10&after=2", secret); len(resp.Messages) != 1 || resp.Messages[0].Seq != 3 || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the held poll to return the new message promptly, got %+v after %v", resp, time.Since(start))
+	}
+
+	*pollMaxPending = 2
+	for i := 0; i < 3; i++ {
+		sendNotification(t.Context(), token, delivery{Title: fmt.Sprint(i), Body: "b"})
+	}
+	if _, resp := poll("?wait=0&after=3", secret); len(resp.Messages) != 2 || resp.Messages[0].Title != "1" {
+		t.Errorf("Expected the oldest message to be dropped, got %+v", resp)
+	}
+
+	*pollMessageTTL = time.Nanosecond
+	if _, resp := poll("?wait=0", secret); len(resp.Messages) != 0 {
+		t.Errorf("Expected expired messages to be dropped, got %+v", resp)
+	}
+
+	*pollEnabled = false
+	if code, _ := poll("?wait=0", secret); code != http.StatusForbidden {
+		t.Errorf("Expected 403 when disabled, got %d", code)
+	}
+}
+
+func TestPollWait(t *testing.T) {
+	originalMaxWait, originalWriteTimeout := *pollMaxWait, *writeTimeout
+	defer func() { *pollMaxWait, *writeTimeout = originalMaxWait, originalWriteTimeout }()
+	*pollMaxWait = 55 * time.Second
+
+	for _, tc := range []struct {
+		writeTimeout time.Duration
+		query        string
+		want         time.Duration
+	}{
+		{2 * time.Minute, "", 55 * time.Second},
+		{2 * time.Minute, "?wait=10", 10 * time.Second},
+		{30 * time.Second, "", 25 * time.Second},
+		// Without a write timeout only --poll-max-wait bounds the wait
+		{0, "", 55 * time.Second},
+		{0, "?wait=120", 55 * time.Second},
+		// A write timeout shorter than the margin still lets polls wait
+		{4 * time.Second, "", 2 * time.Second},
+	} {
+		*writeTimeout = tc.writeTimeout
+		wait, err := pollWait(httptest.NewRequest("GET", "/v1/poll/id"+tc.query, nil))
+		if err != nil || wait != tc.want {
+			t.Errorf("With --write-timeout %v and %q: expected %v, got %v, %v", tc.writeTimeout, tc.query, tc.want, wait, err)
+		}
+	}
+	if _, err := pollWait(httptest.NewRequest("GET", "/v1/poll/id?wait=-1", nil)); err == nil {
+		t.Error("Expected a negative wait refused")
+	}
+}
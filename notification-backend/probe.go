@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+var (
+	// Readiness probe configuration
+	probeInterval           = flag.Duration("probe-interval", 15*time.Second, "How often dependency latency is measured for /ready")
+	fcmLatencyThreshold     = flag.Duration("fcm-latency-threshold", 2*time.Second, "FCM dry-run latency above which the server reports not ready")
+	storageLatencyThreshold = flag.Duration("storage-latency-threshold", time.Second, "Storage HEAD latency above which the server reports not ready")
+)
+
+// dependencyProbe is one lightweight call against an external dependency
+type dependencyProbe struct {
+	name      string
+	threshold time.Duration
+	timeout   time.Duration
+	check     func(ctx context.Context) error
+}
+
+// dependencyStatus is the outcome of a single probe
+type dependencyStatus struct {
+	OK          bool   `json:"ok"`
+	LatencyMS   int64  `json:"latency_ms"`
+	ThresholdMS int64  `json:"threshold_ms"`
+	Error       string `json:"error,omitempty"`
+}
+
+// readinessReport is served by /ready
+type readinessReport struct {
+	Ready        bool                        `json:"ready"`
+	CheckedAt    time.Time                   `json:"checked_at"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+// lastReadiness holds the most recent report; nil until the first probe completes
+var lastReadiness atomic.Pointer[readinessReport]
+
+// defaultProbes measures an FCM dry-run send and a storage HEAD request
+func defaultProbes() []dependencyProbe {
+	return []dependencyProbe{
+		{name: "fcm", threshold: *fcmLatencyThreshold, timeout: *fcmTimeout, check: probeFCM},
+		{name: "storage", threshold: *storageLatencyThreshold, timeout: *storageTimeout, check: probeStorage},
+	}
+}
+
+// probeFCM validates a topic message without delivering it, which exercises
+// OAuth and the FCM API without needing a device token. Every configured
+// Firebase project is checked.
+func probeFCM(ctx context.Context) error {
+	if messagingClient == nil {
+		return fmt.Errorf("firebase messaging client not initialized")
+	}
+	if _, err := messagingClient.SendDryRun(ctx, &messaging.Message{Topic: "readiness-probe"}); err != nil {
+		return err
+	}
+	for _, label := range firebaseProjectLabels() {
+		if _, err := fcmProjects[label].SendDryRun(ctx, &messaging.Message{Topic: "readiness-probe"}); err != nil {
+			return fmt.Errorf("project %q: %v", label, err)
+		}
+	}
+	return nil
+}
+
+// probeStorage issues a HEAD against the SOS bucket, or checks that the
+// storage directory is still accessible in file mode
+func probeStorage(ctx context.Context) error {
+	if useExoscale {
+		return exoscaleStorage.Probe(ctx)
+	}
+	_, err := os.Stat(filepath.Dir(*storageFile))
+	return err
+}
+
+// runProbes measures all dependencies concurrently. A dependency is healthy
+// when its call succeeds within the latency threshold.
+func runProbes(ctx context.Context, probes []dependencyProbe) *readinessReport {
+	report := &readinessReport{
+		Ready:        true,
+		CheckedAt:    time.Now().UTC(),
+		Dependencies: make(map[string]dependencyStatus, len(probes)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p dependencyProbe) {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, p.timeout)
+			start := time.Now()
+			err := p.check(probeCtx)
+			latency := time.Since(start)
+			cancel()
+
+			status := dependencyStatus{
+				OK:          err == nil && latency <= p.threshold,
+				LatencyMS:   latency.Milliseconds(),
+				ThresholdMS: p.threshold.Milliseconds(),
+			}
+			if err != nil {
+				status.Error = err.Error()
+			} else if !status.OK {
+				status.Error = "latency above threshold"
+			}
+
+			mu.Lock()
+			report.Dependencies[p.name] = status
+			if !status.OK {
+				report.Ready = false
+			}
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// startProber measures dependencies now and then every interval, logging
+// whenever readiness flips
+func startProber(interval time.Duration, probes []dependencyProbe) {
+	defer reportPanic("prober")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report := runProbes(context.Background(), probes)
+		if prev := lastReadiness.Swap(report); prev == nil || prev.Ready != report.Ready {
+			if report.Ready {
+				slog.Info("Readiness probe passing", "dependencies", report.Dependencies)
+			} else {
+				slog.Warn("Readiness probe failing", "dependencies", report.Dependencies)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// handleReady serves the latest readiness report, with 503 when a dependency
+// is failing or slow so orchestrators take the replica out of rotation
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	report := lastReadiness.Load()
+	if report == nil {
+		report = &readinessReport{Dependencies: map[string]dependencyStatus{}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// handleHealthz is the liveness probe: it only shows the process is serving
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
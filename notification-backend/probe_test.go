@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunProbesThresholds(t *testing.T) {
+	fast := func(ctx context.Context) error { return nil }
+	slow := func(ctx context.Context) error { time.Sleep(30 * time.Millisecond); return nil }
+	failing := func(ctx context.Context) error { return errors.New("access denied") }
+
+	report := runProbes(context.Background(), []dependencyProbe{
+		{name: "fcm", threshold: time.Second, timeout: time.Second, check: fast},
+		{name: "storage", threshold: time.Second, timeout: time.Second, check: fast},
+	})
+	if !report.Ready {
+		t.Errorf("Expected ready when all dependencies are fast, got %+v", report)
+	}
+
+	// A slow dependency flips readiness even though the call succeeds
+	report = runProbes(context.Background(), []dependencyProbe{
+		{name: "fcm", threshold: time.Second, timeout: time.Second, check: fast},
+		{name: "storage", threshold: 10 * time.Millisecond, timeout: time.Second, check: slow},
+	})
+	if report.Ready || report.Dependencies["storage"].OK || report.Dependencies["storage"].LatencyMS < 30 {
+		t.Errorf("Expected slow storage to fail readiness with its latency reported, got %+v", report)
+	}
+	if !report.Dependencies["fcm"].OK {
+		t.Errorf("Expected fast FCM to stay healthy, got %+v", report.Dependencies["fcm"])
+	}
+
+	report = runProbes(context.Background(), []dependencyProbe{
+		{name: "fcm", threshold: time.Second, timeout: time.Second, check: failing},
+	})
+	if report.Ready || report.Dependencies["fcm"].Error != "access denied" {
+		t.Errorf("Expected failing FCM to be reported, got %+v", report)
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	defer lastReadiness.Store(nil)
+
+	// No probe has completed yet
+	lastReadiness.Store(nil)
+	rr := httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest("GET", "/ready", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the first probe, got %d", rr.Code)
+	}
+
+	lastReadiness.Store(&readinessReport{
+		Ready:        true,
+		Dependencies: map[string]dependencyStatus{"storage": {OK: true, LatencyMS: 12, ThresholdMS: 1000}},
+	})
+	rr = httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest("GET", "/ready", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 when ready, got %d", rr.Code)
+	}
+
+	var report readinessReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Dependencies["storage"].LatencyMS != 12 {
+		t.Errorf("Expected storage latency in report, got %+v", report)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufContentType selects the protobuf encoding on /register and /notify.
+// The messages are defined in notification.proto; JSON stays the default.
+const protobufContentType = "application/x-protobuf"
+
+// isProtobufType reports whether a media type names protobuf
+func isProtobufType(mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	return err == nil && (mt == protobufContentType || mt == "application/protobuf")
+}
+
+// protobufRequest reports whether the body is protobuf; anything else is parsed as JSON
+func protobufRequest(r *http.Request) bool {
+	return isProtobufType(r.Header.Get("Content-Type"))
+}
+
+// wantsProtobuf picks the response encoding. An explicit Accept wins,
+// otherwise the response uses the encoding of the request.
+func wantsProtobuf(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if isProtobufType(mt) {
+			return true
+		}
+		if mt == "application/json" {
+			return false
+		}
+	}
+	return protobufRequest(r)
+}
+
+// protobufResponseWriter marks a response negotiated as protobuf, so that
+// writeError and writeResponse encode accordingly
+type protobufResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (p *protobufResponseWriter) Unwrap() http.ResponseWriter { return p.ResponseWriter }
+
+// negotiateEncoding wraps w when the client asked for a protobuf response
+func negotiateEncoding(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	w.Header().Add("Vary", "Accept, Content-Type")
+	if wantsProtobuf(r) {
+		return &protobufResponseWriter{w}
+	}
+	return w
+}
+
+// decodeBody parses a request body as protobuf or JSON according to its
+// Content-Type. Errors carry INVALID_PROTOBUF or INVALID_JSON.
+func decodeBody(r *http.Request, body []byte, v any) error {
+	if protobufRequest(r) {
+		if err := unmarshalProto(body, v); err != nil {
+			return withCode(ErrInvalidProtobuf, err)
+		}
+		return nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return withCode(ErrInvalidJSON, err)
+	}
+	return nil
+}
+
+// writeResponse sends v in the negotiated encoding
+func writeResponse(w http.ResponseWriter, status int, v any) error {
+	if _, ok := w.(*protobufResponseWriter); ok {
+		w.Header().Set("Content-Type", protobufContentType)
+		w.WriteHeader(status)
+		_, err := w.Write(marshalProto(v))
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// protoFieldNumber returns the field number from a protobuf:"N" struct tag
+func protoFieldNumber(field reflect.StructField) (protowire.Number, bool) {
+	n, err := strconv.Atoi(field.Tag.Get("protobuf"))
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return protowire.Number(n), true
+}
+
+// protoMapEntry is the wire form of one map<string, string> entry
+type protoMapEntry struct {
+	Key   string `protobuf:"1"`
+	Value string `protobuf:"2"`
+}
+
+// marshalProto encodes a struct whose fields carry protobuf:"N" tags. Only the
+// scalar types the API uses, repeated messages and map<string, string> are
+// supported, and zero values are omitted as in proto3.
+func marshalProto(v any) []byte {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	var b []byte
+	for i := 0; i < rv.NumField(); i++ {
+		num, ok := protoFieldNumber(rv.Type().Field(i))
+		f := rv.Field(i)
+		if !ok || f.IsZero() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, f.String())
+		case reflect.Bool:
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(f.Bool()))
+		case reflect.Int, reflect.Int64:
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(f.Int()))
+		case reflect.Slice:
+			if f.Type().Elem().Kind() != reflect.Struct {
+				panic(fmt.Sprintf("marshalProto: unsupported field type %s", f.Type()))
+			}
+			for j := 0; j < f.Len(); j++ {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, marshalProto(f.Index(j).Interface()))
+			}
+		case reflect.Map:
+			if f.Type().Key().Kind() != reflect.String || f.Type().Elem().Kind() != reflect.String {
+				panic(fmt.Sprintf("marshalProto: unsupported field type %s", f.Type()))
+			}
+			// Sorted keys keep the encoding deterministic
+			keys := make([]string, 0, f.Len())
+			for _, k := range f.MapKeys() {
+				keys = append(keys, k.String())
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				entry := protoMapEntry{Key: k, Value: f.MapIndex(reflect.ValueOf(k)).String()}
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, marshalProto(entry))
+			}
+		default:
+			panic(fmt.Sprintf("marshalProto: unsupported field type %s", f.Type()))
+		}
+	}
+	return b
+}
+
+// unmarshalProto decodes wire-format b into the struct pointed to by v.
+// Unknown fields are skipped so older servers accept newer clients.
+func unmarshalProto(b []byte, v any) error {
+	rv := reflect.ValueOf(v).Elem()
+	fields := make(map[protowire.Number]int)
+	for i := 0; i < rv.NumField(); i++ {
+		if num, ok := protoFieldNumber(rv.Type().Field(i)); ok {
+			fields[num] = i
+		}
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid field tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		i, known := fields[num]
+		if !known {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return fmt.Errorf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+			continue
+		}
+
+		f := rv.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("field %d: expected length-delimited value, got wire type %d", num, typ)
+			}
+			s, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("field %d: %v", num, protowire.ParseError(n))
+			}
+			if !utf8.ValidString(s) {
+				return fmt.Errorf("field %d: invalid UTF-8", num)
+			}
+			f.SetString(s)
+			b = b[n:]
+		case reflect.Bool, reflect.Int, reflect.Int64:
+			if typ != protowire.VarintType {
+				return fmt.Errorf("field %d: expected varint, got wire type %d", num, typ)
+			}
+			x, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("field %d: %v", num, protowire.ParseError(n))
+			}
+			if f.Kind() == reflect.Bool {
+				f.SetBool(protowire.DecodeBool(x))
+			} else {
+				f.SetInt(int64(x))
+			}
+			b = b[n:]
+		case reflect.Slice:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("field %d: expected length-delimited value, got wire type %d", num, typ)
+			}
+			m, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("field %d: %v", num, protowire.ParseError(n))
+			}
+			elem := reflect.New(f.Type().Elem())
+			if err := unmarshalProto(m, elem.Interface()); err != nil {
+				return fmt.Errorf("field %d: %v", num, err)
+			}
+			f.Set(reflect.Append(f, elem.Elem()))
+			b = b[n:]
+		case reflect.Map:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("field %d: expected length-delimited value, got wire type %d", num, typ)
+			}
+			m, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("field %d: %v", num, protowire.ParseError(n))
+			}
+			var entry protoMapEntry
+			if err := unmarshalProto(m, &entry); err != nil {
+				return fmt.Errorf("field %d: %v", num, err)
+			}
+			if f.IsNil() {
+				f.Set(reflect.MakeMap(f.Type()))
+			}
+			f.SetMapIndex(reflect.ValueOf(entry.Key), reflect.ValueOf(entry.Value))
+			b = b[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+// TestProtoFileMatchesStructTags keeps notification.proto and the protobuf
+// struct tags in sync: same fields, numbers and scalar types
+func TestProtoFileMatchesStructTags(t *testing.T) {
+	data, err := os.ReadFile("notification.proto")
+	if err != nil {
+		t.Fatalf("Failed to read notification.proto: %v", err)
+	}
+
+	messages := map[string]map[string]string{}
+	var current map[string]string
+	messageRe := regexp.MustCompile(`^message (\w+) \{`)
+	fieldRe := regexp.MustCompile(`^((?:repeated )?\w+|map<\w+, \w+>) (\w+) = (\d+);`)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if m := messageRe.FindStringSubmatch(line); m != nil {
+			current = map[string]string{}
+			messages[m[1]] = current
+		} else if m := fieldRe.FindStringSubmatch(line); m != nil && current != nil {
+			current[m[2]] = m[1] + " " + m[3]
+		}
+	}
+
+	types := map[string]any{
+		"TokenRegistration":         TokenRegistration{},
+		"ChannelRegistration":       ChannelRegistration{},
+		"ChallengeResponse":         ChallengeResponse{},
+		"RegisterResponse":          RegisterResponse{},
+		"SingleNotificationRequest": SingleNotificationRequest{},
+		"NotifyResponse":            NotifyResponse{},
+		"ErrorResponse":             ErrorResponse{},
+	}
+	protoTypes := map[reflect.Kind]string{reflect.String: "string", reflect.Bool: "bool", reflect.Int: "int64", reflect.Int64: "int64"}
+
+	for name, v := range types {
+		fields, ok := messages[name]
+		if !ok {
+			t.Errorf("Message %s missing from notification.proto", name)
+			continue
+		}
+		tagged := map[string]string{}
+		rt := reflect.TypeOf(v)
+		for i := 0; i < rt.NumField(); i++ {
+			num, ok := protoFieldNumber(rt.Field(i))
+			if !ok {
+				t.Errorf("%s.%s has no protobuf tag", name, rt.Field(i).Name)
+				continue
+			}
+			field, _, _ := strings.Cut(rt.Field(i).Tag.Get("json"), ",")
+			typ := protoTypes[rt.Field(i).Type.Kind()]
+			switch ft := rt.Field(i).Type; ft.Kind() {
+			case reflect.Slice:
+				typ = "repeated " + ft.Elem().Name()
+			case reflect.Map:
+				typ = "map<" + protoTypes[ft.Key().Kind()] + ", " + protoTypes[ft.Elem().Kind()] + ">"
+			}
+			tagged[field] = typ + " " + strconv.Itoa(int(num))
+		}
+		if !reflect.DeepEqual(fields, tagged) {
+			t.Errorf("Message %s is out of sync:\n  proto: %v\n  tags:  %v", name, fields, tagged)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	// Field 1, length-delimited, "ab": the encoding protoc-generated clients produce
+	got := marshalProto(TokenRegistration{EncryptedData: "ab"})
+	if want := []byte{0x0a, 0x02, 'a', 'b'}; !bytes.Equal(got, want) {
+		t.Errorf("Expected %x, got %x", want, got)
+	}
+
+	in := RegisterResponse{Success: true, Message: "ok", TokenID: "id", Platform: "android", TotalTokens: 300}
+	var out RegisterResponse
+	if err := unmarshalProto(marshalProto(in), &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if out != in {
+		t.Errorf("Round trip changed message: %+v != %+v", out, in)
+	}
+
+	// Repeated messages keep their order
+	reg := TokenRegistration{EncryptedData: "a", Channels: []ChannelRegistration{{Platform: "ntfy", EncryptedData: "b"}, {Platform: "email", EncryptedData: "c"}}}
+	var regOut TokenRegistration
+	if err := unmarshalProto(marshalProto(reg), &regOut); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(regOut, reg) {
+		t.Errorf("Round trip changed message: %+v != %+v", regOut, reg)
+	}
+
+	// Map entries survive in any order
+	notif := SingleNotificationRequest{TokenID: "id", Template: "order_shipped", Variables: map[string]string{"order_id": "42", "carrier": ""}}
+	var notifOut SingleNotificationRequest
+	if err := unmarshalProto(marshalProto(notif), &notifOut); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(notifOut, notif) {
+		t.Errorf("Round trip changed message: %+v != %+v", notifOut, notif)
+	}
+
+	// Unknown fields from a newer client are skipped
+	withUnknown := append(marshalProto(NotifyResponse{Message: "hi"}), 0x78, 0x01) // field 15, varint 1
+	var notify NotifyResponse
+	if err := unmarshalProto(withUnknown, &notify); err != nil || notify.Message != "hi" {
+		t.Errorf("Expected unknown field to be skipped, got %+v, %v", notify, err)
+	}
+
+	for name, b := range map[string][]byte{
+		"truncated":  {0x0a, 0x05, 'a'},
+		"wrong type": {0x08, 0x01}, // field 1 as varint, but encrypted_data is a string
+		"bad utf8":   {0x0a, 0x01, 0xff},
+	} {
+		var reg TokenRegistration
+		if err := unmarshalProto(b, &reg); err == nil {
+			t.Errorf("%s: expected decode error", name)
+		}
+	}
+}
+
+func TestRegisterAndNotifyOverProtobuf(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey := privateKey
+	privateKey = privKey
+	originalStore, originalExoscale := tokenStore, useExoscale
+	defer func() { privateKey, tokenStore, useExoscale = originalPrivateKey, originalStore, originalExoscale }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+
+	req := httptest.NewRequest("POST", "/v1/register", bytes.NewReader(marshalProto(TokenRegistration{EncryptedData: encrypted, Platform: "android"})))
+	req.Header.Set("Content-Type", protobufContentType)
+	rr := httptest.NewRecorder()
+	handleRegister(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != protobufContentType {
+		t.Fatalf("Expected protobuf 200, got %d %q: %q", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	var reg RegisterResponse
+	if err := unmarshalProto(rr.Body.Bytes(), &reg); err != nil {
+		t.Fatalf("Response is not protobuf: %v", err)
+	}
+	if !reg.Success || reg.TokenID == "" || reg.Platform != "android" || reg.TotalTokens != 1 {
+		t.Errorf("Unexpected register response: %+v", reg)
+	}
+	if _, err := tokenStore.GetEncryptedToken(reg.TokenID); err != nil {
+		t.Errorf("Returned token ID %q is not the stored one: %v", reg.TokenID, err)
+	}
+
+	// Errors follow the negotiated encoding
+	req = httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(marshalProto(SingleNotificationRequest{TokenID: "unknown", Title: "t", Body: "b"})))
+	req.Header.Set("Content-Type", protobufContentType)
+	rr = httptest.NewRecorder()
+	handleNotify(rr, req)
+
+	var errResp ErrorResponse
+	if err := unmarshalProto(rr.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("Error response is not protobuf: %v", err)
+	}
+	if rr.Code != http.StatusBadRequest || errResp.Code != ErrTokenNotFound {
+		t.Errorf("Expected 400 TOKEN_NOT_FOUND, got %d %+v", rr.Code, errResp)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/notify", strings.NewReader("\x0a\x05a"))
+	req.Header.Set("Content-Type", protobufContentType)
+	rr = httptest.NewRecorder()
+	handleNotify(rr, req)
+	if err := unmarshalProto(rr.Body.Bytes(), &errResp); err != nil || errResp.Code != ErrInvalidProtobuf {
+		t.Errorf("Expected INVALID_PROTOBUF, got %d %+v", rr.Code, errResp)
+	}
+
+	// Accept overrides the request encoding
+	req = httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(marshalProto(SingleNotificationRequest{Title: "t", Body: "b"})))
+	req.Header.Set("Content-Type", protobufContentType)
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	handleNotify(rr, req)
+
+	var jsonResp ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&jsonResp); err != nil || jsonResp.Code != ErrMissingField {
+		t.Errorf("Expected JSON MISSING_FIELD, got %d %+v (%v)", rr.Code, jsonResp, err)
+	}
+}
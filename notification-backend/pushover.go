@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// Pushover configuration; platform "pushover" is disabled without an app token
+	pushoverAppTokenArg = flag.String("pushover-app-token", "", "Pushover application API token for platform \"pushover\" (or PUSHOVER_APP_TOKEN); empty disables it")
+	pushoverTimeout     = flag.Duration("pushover-timeout", 10*time.Second, "Timeout for a single Pushover send")
+)
+
+// pushoverAPIURL is the messages endpoint; tests point it at a local server
+var pushoverAPIURL = "https://api.pushover.net/1/messages.json"
+
+// pushoverAppToken is resolved from the flag or environment at startup
+var pushoverAppToken string
+
+// pushoverClient calls the Pushover API; tests replace it
+var pushoverClient = &http.Client{}
+
+// pushoverKeyPattern matches Pushover user and group keys
+var pushoverKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]{30}$`)
+
+// Pushover's limits on title and message length
+const (
+	maxPushoverTitle   = 250
+	maxPushoverMessage = 1024
+)
+
+var pushoverTransport = &transport{
+	name:       "pushover",
+	configured: func() bool { return pushoverAppToken != "" },
+	ready: func() error {
+		if pushoverAppToken == "" {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("Pushover is not configured (--pushover-app-token)"))
+		}
+		return nil
+	},
+	validate: validatePushoverKey,
+	send:     sendPushover,
+}
+
+// setupPushover resolves the app token, preferring the flag over PUSHOVER_APP_TOKEN
+func setupPushover(token string) error {
+	if token == "" {
+		token = os.Getenv("PUSHOVER_APP_TOKEN")
+	}
+	if token != "" && !pushoverKeyPattern.MatchString(token) {
+		return fmt.Errorf("Pushover app token must be 30 letters and digits")
+	}
+	pushoverAppToken = token
+	return nil
+}
+
+// validatePushoverKey checks a decrypted user or group key
+func validatePushoverKey(key string) error {
+	if !pushoverKeyPattern.MatchString(key) {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("Pushover user key must be 30 letters and digits"))
+	}
+	return nil
+}
+
+// pushoverPriority maps a delivery to Pushover's -2..2 scale: critical
+// notifications are high priority (1, bypassing quiet hours), FCM "normal"
+// ones quiet (-1). Emergency (2) needs acknowledgement and is not used.
+func pushoverPriority(d delivery) int {
+	switch {
+	case d.Critical:
+		return 1
+	case d.Priority == "normal":
+		return -1
+	}
+	return 0
+}
+
+// truncateRunes cuts s to n characters, marking the cut
+func truncateRunes(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
+
+// sendPushover delivers the notification to the registration's user key
+func sendPushover(ctx context.Context, d delivery) error {
+	form := url.Values{
+		"token":    {pushoverAppToken},
+		"user":     {d.Address},
+		"title":    {truncateRunes(d.Title, maxPushoverTitle)},
+		"message":  {truncateRunes(d.Body, maxPushoverMessage)},
+		"priority": {fmt.Sprint(pushoverPriority(d))},
+	}
+
+	ctx, span := startSpan(ctx, "pushover.send")
+	sendCtx, cancel := context.WithTimeout(ctx, *pushoverTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, pushoverAPIURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to build Pushover request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := pushoverClient.Do(req)
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to send to Pushover: %v", err))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status int      `json:"status"`
+		User   string   `json:"user"`
+		Errors []string `json:"errors"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	detail := strings.Join(result.Errors, "; ")
+
+	err = nil
+	switch {
+	case resp.StatusCode == http.StatusOK && result.Status == 1:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && result.User == "invalid":
+		// The user key no longer exists (or the account was disabled)
+		err = withCode(ErrTokenUnregistered, fmt.Errorf("Pushover user key rejected: %s", detail))
+	case resp.StatusCode == http.StatusBadRequest:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("Pushover rejected the message: %s", detail))
+	default:
+		// 429 means the app's monthly quota is used up, 5xx are Pushover's problem
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("Pushover returned %s: %s", resp.Status, detail))
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSendPushover(t *testing.T) {
+	const userKey = "uQiRzpo4DXghDmr9QzzfQu27cmVRsG"
+	var got url.Values
+	status, reply := http.StatusOK, `{"status":1,"request":"647d2300"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+	defer server.Close()
+
+	originalURL, originalToken := pushoverAPIURL, pushoverAppToken
+	defer func() { pushoverAPIURL, pushoverAppToken = originalURL, originalToken }()
+	pushoverAPIURL = server.URL
+	if err := setupPushover("azGDORePK8gMaC0QOYAMyEEuzJnyUi"); err != nil {
+		t.Fatalf("setupPushover failed: %v", err)
+	}
+
+	d := delivery{Address: userKey, Title: "Disk", Body: strings.Repeat("x", 2000)}
+	if err := sendPushover(t.Context(), d); err != nil {
+		t.Fatalf("Expected send to succeed, got %v", err)
+	}
+	if got.Get("token") != "azGDORePK8gMaC0QOYAMyEEuzJnyUi" || got.Get("user") != userKey || got.Get("title") != "Disk" ||
+		len([]rune(got.Get("message"))) != maxPushoverMessage || got.Get("priority") != "0" {
+		t.Errorf("Unexpected Pushover request: %v", got)
+	}
+
+	for _, tc := range []struct {
+		d        delivery
+		priority string
+	}{
+		{delivery{Critical: true}, "1"},
+		{delivery{Priority: "normal"}, "-1"},
+		{delivery{Priority: "high"}, "0"},
+	} {
+		tc.d.Address, tc.d.Title, tc.d.Body = userKey, "t", "b"
+		sendPushover(t.Context(), tc.d)
+		if got.Get("priority") != tc.priority {
+			t.Errorf("Delivery %+v: expected Pushover priority %s, got %s", tc.d, tc.priority, got.Get("priority"))
+		}
+	}
+
+	for _, tc := range []struct {
+		status int
+		reply  string
+		code   ErrorCode
+	}{
+		{http.StatusBadRequest, `{"user":"invalid","errors":["user identifier is not a valid user, group, or subscribed user key"],"status":0}`, ErrTokenUnregistered},
+		{http.StatusBadRequest, `{"message":"cannot be blank","errors":["message cannot be blank"],"status":0}`, ErrInvalidMessage},
+		{http.StatusTooManyRequests, `{"errors":["application has exceeded its monthly limit"],"status":0}`, ErrTransportUnavailable},
+	} {
+		status, reply = tc.status, tc.reply
+		if err := sendPushover(t.Context(), d); errorCodeOf(err, "") != tc.code {
+			t.Errorf("Pushover %d %s: expected %s, got %v", tc.status, tc.reply, tc.code, err)
+		}
+	}
+}
+
+func TestPushoverConfiguration(t *testing.T) {
+	originalToken := pushoverAppToken
+	defer func() { pushoverAppToken = originalToken }()
+	if err := setupPushover("short"); err == nil {
+		t.Error("Expected malformed app token to be rejected")
+	}
+
+	for key, valid := range map[string]bool{
+		"uQiRzpo4DXghDmr9QzzfQu27cmVRsG":  true,
+		"uQiRzpo4DXghDmr9QzzfQu27cmVRs":   false,
+		"uQiRzpo4DXghDmr9QzzfQu27cmVRs!":  false,
+		"uQiRzpo4DXghDmr9QzzfQu27cmVRsGx": false,
+	} {
+		if err := validatePushoverKey(key); (err == nil) != valid {
+			t.Errorf("Key %q: expected valid=%v, got %v", key, valid, err)
+		}
+	}
+
+	if transportFor("pushover") != pushoverTransport {
+		t.Error("Expected platform routing to pick Pushover for \"pushover\"")
+	}
+}
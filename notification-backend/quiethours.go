@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	deferredInterval = flag.Duration("deferred-interval", time.Minute, "How often notifications held back by quiet hours are checked for delivery")
+	maxDeferred      = flag.Int("max-deferred", 10000, "Most notifications held back by quiet hours; beyond this they are delivered right away")
+)
+
+// clockPattern is a local wall-clock time such as "07:00"
+var clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):([0-5][0-9])$`)
+
+// Why a notification was held back, which decides whether quiet hours still
+// apply when it is released
+const (
+	deferQuietHours = "quiet_hours"
+	deferLocalTime  = "local_time"
+)
+
+// DeferredMessage is a non-critical notification held until the
+// registration's quiet hours end. Only what is needed to send it again is
+// kept; the device address is decrypted at delivery as usual.
+type DeferredMessage struct {
+	TokenID   string    `json:"token_id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Priority  string    `json:"priority,omitempty"`
+	Critical  bool      `json:"critical,omitempty"`
+	Reason    string    `json:"reason,omitempty"` // deferQuietHours when empty
+	NotBefore time.Time `json:"not_before"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// deferredQueue is every held-back notification, as stored
+type deferredQueue struct {
+	Messages []DeferredMessage `json:"messages,omitempty"`
+}
+
+func (q *deferredQueue) clone() deferredQueue {
+	return deferredQueue{Messages: append([]DeferredMessage(nil), q.Messages...)}
+}
+
+// parseClock returns a wall-clock time in minutes after midnight
+func parseClock(clock string) (int, bool) {
+	m := clockPattern.FindStringSubmatch(clock)
+	if m == nil {
+		return 0, false
+	}
+	hours, _ := strconv.Atoi(m[1])
+	minutes, _ := strconv.Atoi(m[2])
+	return hours*60 + minutes, true
+}
+
+// atClock returns the time at minute after local midnight on the day of local
+func atClock(local time.Time, days, minute int) time.Time {
+	return time.Date(local.Year(), local.Month(), local.Day()+days, minute/60, minute%60, 0, 0, local.Location())
+}
+
+// parseQuietHours returns the start and end of a window in minutes after midnight
+func parseQuietHours(window string) (start, end int, err error) {
+	from, to, _ := strings.Cut(window, "-")
+	start, okStart := parseClock(from)
+	end, okEnd := parseClock(to)
+	if !okStart || !okEnd {
+		return 0, 0, fmt.Errorf("quiet_hours must look like \"22:00-07:00\"")
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("quiet_hours must not start and end at the same time")
+	}
+	return start, end, nil
+}
+
+// validateDeliveryWindow checks a registration's optional timezone and quiet
+// hours. Quiet hours are local time, so they need the timezone.
+func validateDeliveryWindow(timezone, quietHours string) error {
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			return withCode(ErrInvalidRequest, fmt.Errorf("timezone %q is not an IANA time zone", timezone))
+		}
+	}
+	if quietHours == "" {
+		return nil
+	}
+	if timezone == "" {
+		return withCode(ErrInvalidRequest, fmt.Errorf("quiet_hours needs a timezone"))
+	}
+	if _, _, err := parseQuietHours(quietHours); err != nil {
+		return withCode(ErrInvalidRequest, err)
+	}
+	return nil
+}
+
+// quietUntil reports whether now falls in the registration's quiet hours and,
+// if so, when they end. Invalid stored values never hold anything back.
+func (t *TokenStorageInfo) quietUntil(now time.Time) (time.Time, bool) {
+	if t.QuietHours == "" {
+		return time.Time{}, false
+	}
+	loc, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	start, end, err := parseQuietHours(t.QuietHours)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	quiet := start <= minute && minute < end
+	if start > end { // the window spans midnight
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	until := atClock(local, 0, end)
+	if !until.After(now) {
+		until = atClock(local, 1, end)
+	}
+	return until, true
+}
+
+// updateDeferred applies update to the held-back notifications in the appropriate storage
+func updateDeferred(ctx context.Context, update func(*deferredQueue) bool) (deferredQueue, error) {
+	if useExoscale {
+		return exoscaleStorage.UpdateDeferred(ctx, update)
+	}
+	return tokenStore.UpdateDeferred(update)
+}
+
+// deferDelivery holds d back for each of tokens in its quiet hours until
+// they end, with one write to the queue. It returns the tokens to send now,
+// and those held back or, on error, failed. Once the queue is full the rest
+// are sent now.
+func deferDelivery(ctx context.Context, tokens []*TokenStorageInfo, d delivery) (send, held []*TokenStorageInfo, err error) {
+	now := time.Now()
+	var messages []DeferredMessage
+	for _, token := range tokens {
+		until, quiet := token.quietUntil(now)
+		if !quiet || d.Critical || d.Released {
+			send = append(send, token)
+			continue
+		}
+		held = append(held, token)
+		messages = append(messages, DeferredMessage{
+			TokenID:   token.OpaqueID,
+			Title:     d.Title,
+			Body:      d.Body,
+			Priority:  d.Priority,
+			Reason:    deferQuietHours,
+			NotBefore: until,
+			CreatedAt: now,
+		})
+	}
+	if len(messages) == 0 {
+		return send, nil, nil
+	}
+
+	var room int
+	if _, err := updateDeferred(ctx, func(q *deferredQueue) bool {
+		room = min(max(*maxDeferred-len(q.Messages), 0), len(messages))
+		q.Messages = append(q.Messages, messages[:room]...)
+		return room > 0
+	}); err != nil {
+		return send, held, err
+	}
+	if room < len(held) {
+		loggerFromContext(ctx).Warn("Deferred queue full, ignoring quiet hours", "tokens", len(held)-room, "max", *maxDeferred)
+		send, held = append(send, held[room:]...), held[:room]
+	}
+	switch {
+	case len(held) == 1:
+		loggerFromContext(ctx).Info("Notification deferred for quiet hours", "token_id", held[0].OpaqueID, "until", messages[0].NotBefore)
+	case len(held) > 1:
+		loggerFromContext(ctx).Info("Notifications deferred for quiet hours", "tokens", len(held))
+	}
+	return send, held, nil
+}
+
+// releaseDeferred sends every held-back notification due by now. Messages are
+// taken off the queue before sending, so a failed send is not retried, as
+// with any other delivery.
+func releaseDeferred(ctx context.Context, now time.Time) (sent, failed int) {
+	logger := loggerFromContext(ctx)
+
+	var due []DeferredMessage
+	if _, err := updateDeferred(ctx, func(q *deferredQueue) bool {
+		kept := q.Messages[:0]
+		for _, m := range q.Messages {
+			if m.NotBefore.After(now) {
+				kept = append(kept, m)
+			} else {
+				due = append(due, m)
+			}
+		}
+		q.Messages = kept
+		return len(due) > 0
+	}); err != nil {
+		logger.Error("Failed to read deferred notifications", "error", err)
+		return 0, 0
+	}
+
+	for _, m := range due {
+		token, err := getToken(ctx, m.TokenID)
+		if err == nil {
+			// A local-time send may still land in the device's quiet hours
+			err = sendNotification(ctx, token, delivery{
+				Title: m.Title, Body: m.Body, Priority: m.Priority, Critical: m.Critical,
+				Released: m.Reason != deferLocalTime,
+			})
+		}
+		if err != nil {
+			logger.Warn("Failed to deliver deferred notification", "token_id", m.TokenID, "error", err)
+			failed++
+			continue
+		}
+		sent++
+	}
+	return sent, failed
+}
+
+// startDeferredRoutine delivers held-back notifications as quiet hours end
+func startDeferredRoutine(interval time.Duration) {
+	defer reportPanic("deferred")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if sent, failed := releaseDeferred(context.Background(), time.Now()); sent+failed > 0 {
+			slog.Info("Delivered deferred notifications", "sent", sent, "failed", failed)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+func TestQuietUntil(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.March, day, hour, minute, 0, 0, zurich)
+	}
+
+	for _, tc := range []struct {
+		window string
+		now    time.Time
+		until  time.Time // zero when not quiet
+	}{
+		{"22:00-07:00", at(10, 23, 30), at(11, 7, 0)},
+		{"22:00-07:00", at(10, 3, 0), at(10, 7, 0)},
+		{"22:00-07:00", at(10, 7, 0), time.Time{}},
+		{"22:00-07:00", at(10, 12, 0), time.Time{}},
+		{"12:00-14:00", at(10, 13, 59), at(10, 14, 0)},
+		{"12:00-14:00", at(10, 11, 59), time.Time{}},
+		{"22:00-07:00", at(28, 23, 0), at(29, 7, 0)}, // across the switch to summer time
+	} {
+		token := &TokenStorageInfo{Timezone: "Europe/Zurich", QuietHours: tc.window}
+		until, quiet := token.quietUntil(tc.now.UTC())
+		if quiet != !tc.until.IsZero() || !until.Equal(tc.until) {
+			t.Errorf("%s at %v: expected quiet until %v, got %v %v", tc.window, tc.now, tc.until, quiet, until)
+		}
+	}
+
+	for name, err := range map[string]error{
+		"unknown zone":     validateDeliveryWindow("Mars/Olympus", ""),
+		"server zone":      validateDeliveryWindow("Local", ""),
+		"no timezone":      validateDeliveryWindow("", "22:00-07:00"),
+		"malformed window": validateDeliveryWindow("UTC", "10pm-7am"),
+		"empty window":     validateDeliveryWindow("UTC", "07:00-07:00"),
+	} {
+		if errorCodeOf(err, "") != ErrInvalidRequest {
+			t.Errorf("%s: expected INVALID_REQUEST, got %v", name, err)
+		}
+	}
+	if err := validateDeliveryWindow("Europe/Zurich", "22:00-07:00"); err != nil {
+		t.Errorf("Expected a valid window to pass, got %v", err)
+	}
+}
+
+func TestQuietHoursDeferDelivery(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalClient := privateKey, tokenStore, useExoscale, messagingClient
+	defer func() {
+		privateKey, tokenStore, useExoscale, messagingClient = originalPrivateKey, originalStore, originalExoscale, originalClient
+	}()
+	privateKey = privKey
+	storagePath := filepath.Join(t.TempDir(), "tokens.json")
+	tokenStore = NewDurableTokenStore(storagePath)
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+
+	// A short window around now keeps the test independent of the time of day
+	now := time.Now().UTC()
+	window := now.Add(-time.Minute).Format("15:04") + "-" + now.Add(2*time.Minute).Format("15:04")
+	if now.Add(-time.Minute).Format("15:04") > now.Add(2*time.Minute).Format("15:04") {
+		t.Skip("Too close to midnight")
+	}
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+	body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android", Timezone: "UTC", QuietHours: window})
+	rr := httptest.NewRecorder()
+	handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+	var reg RegisterResponse
+	json.Unmarshal(rr.Body.Bytes(), &reg)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Registration failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	notify := func(critical bool) NotifyResponse {
+		body, _ := json.Marshal(SingleNotificationRequest{TokenID: reg.TokenID, NotifySecret: reg.NotifySecret, Title: "t", Body: "b", Critical: critical})
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest("POST", "/v1/notify", bytes.NewReader(body)))
+		var resp NotifyResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+	if resp := notify(false); !resp.Success || !strings.Contains(resp.Message, "deferred") {
+		t.Fatalf("Expected the notification to be deferred, got %+v", resp)
+	}
+	if resp := notify(true); resp.Success {
+		t.Errorf("Expected a critical notification to be sent right away and fail, got %+v", resp)
+	}
+
+	// The queue survives a restart and is released once the window ends
+	tokenStore = NewDurableTokenStore(storagePath)
+	queue, _ := updateDeferred(t.Context(), func(*deferredQueue) bool { return false })
+	if len(queue.Messages) != 1 || queue.Messages[0].TokenID != reg.TokenID || queue.Messages[0].Title != "t" {
+		t.Fatalf("Expected one persisted deferred notification, got %+v", queue.Messages)
+	}
+	if sent, failed := releaseDeferred(t.Context(), now); sent+failed != 0 {
+		t.Errorf("Expected nothing released before the window ends, got %d sent %d failed", sent, failed)
+	}
+	if sent, failed := releaseDeferred(t.Context(), queue.Messages[0].NotBefore); sent != 0 || failed != 1 {
+		t.Errorf("Expected the deferred notification attempted, not deferred again, got %d sent %d failed", sent, failed)
+	}
+	if queue, _ := updateDeferred(t.Context(), func(*deferredQueue) bool { return false }); len(queue.Messages) != 0 {
+		t.Errorf("Expected the queue emptied, got %+v", queue.Messages)
+	}
+
+	// A full queue ignores quiet hours rather than dropping notifications
+	originalMax := *maxDeferred
+	defer func() { *maxDeferred = originalMax }()
+	*maxDeferred = 0
+	token, _ := getToken(t.Context(), reg.TokenID)
+	if err := sendNotification(t.Context(), token, delivery{Title: "t", Body: "b"}); errorCodeOf(err, "") != ErrFCMUnavailable {
+		t.Errorf("Expected a direct send with a full queue, got %v", err)
+	}
+}
+
+func TestQuietHoursBroadcastDefersTogether(t *testing.T) {
+	originalPrivateKey, originalExoscale, originalStorage, originalClient, originalMax := privateKey, useExoscale, exoscaleStorage, messagingClient, *maxDeferred
+	defer func() {
+		privateKey, useExoscale, exoscaleStorage, messagingClient, *maxDeferred = originalPrivateKey, originalExoscale, originalStorage, originalClient, originalMax
+	}()
+	privateKey = apitest.PrivateKey()
+	useExoscale = true
+	var sos *fakeSOS
+	exoscaleStorage, sos = newFakeSOSStorage(t, nil)
+	fake := &fakeMessenger{}
+	messagingClient = fake
+	*maxDeferred = 3
+
+	now := time.Now().UTC()
+	window := now.Add(-time.Minute).Format("15:04") + "-" + now.Add(2*time.Minute).Format("15:04")
+	if now.Add(-time.Minute).Format("15:04") > now.Add(2*time.Minute).Format("15:04") {
+		t.Skip("Too close to midnight")
+	}
+	var tokens []*TokenStorageInfo
+	for i := range 6 {
+		token := &TokenStorageInfo{OpaqueID: apitest.OpaqueID(i), EncryptedData: apitest.EncryptToken(apitest.FCMToken(i)), Platform: "android"}
+		if i > 0 {
+			token.Timezone, token.QuietHours = "UTC", window
+		}
+		tokens = append(tokens, token)
+	}
+
+	// One read and write of the queue takes the 3 deferrals it has room for,
+	// and the other 2 quiet registrations are sent with the awake one
+	delivered := make(map[string]bool)
+	sent, failed := broadcastTokens(t.Context(), tokens, delivery{Title: "t", Body: "b"}, func(opaqueID string, err error) {
+		delivered[opaqueID] = err == nil
+	})
+	if sent != 6 || failed != 0 || len(delivered) != 6 {
+		t.Errorf("Expected all 6 delivered or deferred, got %d sent %d failed %v", sent, failed, delivered)
+	}
+	if sos.gets() != 1 {
+		t.Errorf("Expected the deferred queue read once, got %d reads", sos.gets())
+	}
+	if len(fake.sent) != 3 {
+		t.Errorf("Expected 3 sent now, got %d", len(fake.sent))
+	}
+	queue, err := updateDeferred(t.Context(), func(*deferredQueue) bool { return false })
+	if err != nil || len(queue.Messages) != 3 || queue.Messages[0].TokenID != apitest.OpaqueID(1) {
+		t.Errorf("Expected the first 3 quiet registrations deferred, got %+v %v", queue.Messages, err)
+	}
+}
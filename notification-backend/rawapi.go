@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+var rawAPIKeyFlag = flag.String("raw-api-key", "", "Bearer key required by /v1/notify-raw (or RAW_API_KEY); empty disables the endpoint")
+
+// rawAPIKey is resolved from the flag or environment at startup
+var rawAPIKey string
+
+// RawNotificationRequest carries a complete FCM message for one opaque ID.
+// The message uses the FCM v1 JSON shape; the server fills in the token.
+type RawNotificationRequest struct {
+	TokenID string             `json:"token_id"`
+	Message *messaging.Message `json:"message"`
+}
+
+// setupRawAPI resolves the /notify-raw key, preferring the flag over RAW_API_KEY
+func setupRawAPI(key string) {
+	if key == "" {
+		key = os.Getenv("RAW_API_KEY")
+	}
+	rawAPIKey = key
+}
+
+// requireAPIKey rejects requests without the raw API bearer key. The
+// endpoint is disabled outright when no key is configured.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rawAPIKey == "" {
+			writeError(w, ErrEndpointDisabled, "Endpoint disabled; set --raw-api-key to enable it")
+			return
+		}
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(rawAPIKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="notify-raw"`)
+			writeError(w, ErrUnauthorized, "Missing or invalid API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleNotifyRaw sends a caller-built FCM message to one opaque ID, for
+// fields the title/body API cannot express
+func handleNotifyRaw(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+
+	// Reject unknown keys so a misspelt field is not silently dropped
+	var req RawNotificationRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if req.TokenID == "" || req.Message == nil {
+		writeError(w, ErrMissingField, "token_id and message are required")
+		return
+	}
+	if req.Message.Token != "" || req.Message.Topic != "" || req.Message.Condition != "" {
+		writeError(w, ErrInvalidMessage, "message must not set token, topic or condition; the target is token_id")
+		return
+	}
+
+	logger = logger.With("token_id", req.TokenID)
+	ctx := withLogger(r.Context(), logger)
+
+	token, err := getToken(ctx, req.TokenID)
+	if err != nil {
+		code := errorCodeOf(err, ErrStorageUnavailable)
+		logger.Warn("Failed to look up token ID", "code", code, "error", err)
+		if code == ErrTokenNotFound {
+			writeError(w, code, "Token ID not found")
+		} else {
+			writeError(w, code, "Failed to retrieve token")
+		}
+		return
+	}
+
+	if transportFor(token.Platform) != fcmTransport {
+		writeError(w, ErrInvalidMessage, fmt.Sprintf("Raw FCM messages cannot be sent to platform %q", token.Platform))
+		return
+	}
+
+	if err := sendFCMMessage(ctx, token.FirebaseProject, token.EncryptedData, req.Message); err != nil {
+		code := errorCodeOf(err, ErrFCMUnavailable)
+		logger.Error("Failed to send raw notification", "code", code, "error", err)
+		writeError(w, code, "Failed to send notification")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := NotifyResponse{
+		Success: true,
+		Message: "Notification sent successfully",
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding response", "error", err)
+	}
+}
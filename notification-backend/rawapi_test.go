@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyRawRequiresAPIKey(t *testing.T) {
+	originalKey := rawAPIKey
+	defer func() { rawAPIKey = originalKey }()
+
+	handler := requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name          string
+		configured    string
+		authorization string
+		status        int
+	}{
+		{"disabled without a key", "", "Bearer anything", http.StatusForbidden},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong scheme", "secret", "Basic secret", http.StatusUnauthorized},
+		{"wrong key", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"correct key", "secret", "Bearer secret", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		rawAPIKey = tt.configured
+		req := httptest.NewRequest("POST", "/v1/notify-raw", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, rr.Code)
+		}
+	}
+}
+
+func TestNotifyRawValidatesMessage(t *testing.T) {
+	originalStore, originalExoscale, originalClient := tokenStore, useExoscale, messagingClient
+	defer func() { tokenStore, useExoscale, messagingClient = originalStore, originalExoscale, originalClient }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil
+
+	opaqueID, err := tokenStore.AddToken("encrypted", "android")
+	if err != nil {
+		t.Fatalf("AddToken failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"unknown field", `{"token_id":"x","message":{},"extra":1}`, http.StatusBadRequest, ErrInvalidJSON},
+		{"missing message", `{"token_id":"x"}`, http.StatusBadRequest, ErrMissingField},
+		{"own target", `{"token_id":"x","message":{"topic":"news"}}`, http.StatusBadRequest, ErrInvalidMessage},
+		{"unknown token", `{"token_id":"x","message":{"data":{"k":"v"}}}`, http.StatusBadRequest, ErrTokenNotFound},
+		{"no FCM client", `{"token_id":"` + opaqueID + `","message":{"data":{"k":"v"}}}`, http.StatusInternalServerError, ErrFCMUnavailable},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handleNotifyRaw(rr, httptest.NewRequest("POST", "/v1/notify-raw", strings.NewReader(tt.body)))
+
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if rr.Code != tt.status || resp.Code != tt.code {
+			t.Errorf("%s: expected %d %s, got %d %+v", tt.name, tt.status, tt.code, rr.Code, resp)
+		}
+	}
+}
+
+func TestRawNotificationRequestParsesFCMFields(t *testing.T) {
+	body := `{"token_id":"x","message":{"data":{"order":"42"},"android":{"ttl":"90s","collapse_key":"orders"},"apns":{"payload":{"aps":{"content-available":1}}}}}`
+
+	var req RawNotificationRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("Failed to parse raw request: %v", err)
+	}
+	msg := req.Message
+	if msg.Data["order"] != "42" || msg.Android == nil || msg.Android.CollapseKey != "orders" {
+		t.Errorf("FCM fields not parsed: %+v", msg)
+	}
+	if msg.Android.TTL == nil || *msg.Android.TTL != 90*time.Second {
+		t.Errorf("Expected Android TTL of 90s, got %v", msg.Android.TTL)
+	}
+	if msg.APNS == nil || msg.APNS.Payload == nil || !msg.APNS.Payload.Aps.ContentAvailable {
+		t.Errorf("Expected APNS content-available, got %+v", msg.APNS)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	// HTTP server tuning; the defaults protect against slowloris-style clients
+	readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Maximum time to read request headers")
+	readTimeout       = flag.Duration("read-timeout", 30*time.Second, "Maximum time to read an entire request, including the body")
+	writeTimeout      = flag.Duration("write-timeout", 2*time.Minute, "Maximum time to handle a request and write the response (must cover a full /send broadcast)")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "Maximum time an idle keep-alive connection is kept open")
+	maxHeaderBytes    = flag.Int("max-header-bytes", 64<<10, "Maximum size of request headers in bytes")
+)
+
+// newHTTPServer builds the public server with explicit timeouts and limits.
+// Connection-level errors (TLS handshakes, header parsing) are logged via slog.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
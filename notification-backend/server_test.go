@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerDropsSlowHeaderClients(t *testing.T) {
+	old := *readHeaderTimeout
+	*readHeaderTimeout = 100 * time.Millisecond
+	defer func() { *readHeaderTimeout = old }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	go server.Serve(ln)
+	defer server.Close()
+
+	// Send an incomplete request and never finish the headers
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+
+	// The server should give up on us well before our own deadline
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Expected server to close the connection after the header timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected slow client to be dropped quickly, took %v", elapsed)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// registrationSignatureContext starts every signed registration message, so
+// the signature cannot be passed off as one over anything else
+const registrationSignatureContext = "remote-notification registration v1"
+
+// registrationMessage is what a registration response signs: the context,
+// the opaque ID and the issue time in Unix seconds, one per line
+func registrationMessage(tokenID string, issuedAt int64) []byte {
+	return fmt.Appendf(nil, "%s\n%s\n%d", registrationSignatureContext, tokenID, issuedAt)
+}
+
+// signRegistration signs a registration response with the RSA private key,
+// using RSA-PSS with SHA-256 and a salt as long as the hash (Java's
+// "SHA256withRSA/PSS"), so the app backend and the app can check the opaque
+// ID came from this server with the public key they already hold
+func signRegistration(tokenID string, issuedAt int64) (string, error) {
+	if privateKey == nil {
+		return "", fmt.Errorf("private key not loaded")
+	}
+	digest := sha256.Sum256(registrationMessage(tokenID, issuedAt))
+	sig, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign registration: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyRegistration checks a signature made by signRegistration
+func verifyRegistration(pub *rsa.PublicKey, tokenID string, issuedAt int64, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %v", err)
+	}
+	digest := sha256.Sum256(registrationMessage(tokenID, issuedAt))
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+		return fmt.Errorf("invalid registration signature: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+func TestSignedRegistrationResponse(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale := privateKey, tokenStore, useExoscale
+	defer func() { privateKey, tokenStore, useExoscale = originalPrivateKey, originalStore, originalExoscale }()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+	body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android"})
+	rr := httptest.NewRecorder()
+	handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+	var resp RegisterResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Signature == "" {
+		t.Fatalf("Expected a signed registration response, got %q", rr.Body.String())
+	}
+	if age := time.Since(time.Unix(resp.IssuedAt, 0)); age < 0 || age > time.Minute {
+		t.Errorf("Expected issued_at to be now, got %d", resp.IssuedAt)
+	}
+
+	if err := verifyRegistration(&privKey.PublicKey, resp.TokenID, resp.IssuedAt, resp.Signature); err != nil {
+		t.Errorf("Expected the signature to verify, got %v", err)
+	}
+	if err := verifyRegistration(&privKey.PublicKey, resp.TokenID+"0", resp.IssuedAt, resp.Signature); err == nil {
+		t.Error("Expected another token ID not to verify")
+	}
+	if err := verifyRegistration(&privKey.PublicKey, resp.TokenID, resp.IssuedAt+1, resp.Signature); err == nil {
+		t.Error("Expected another timestamp not to verify")
+	}
+	otherKey := apitest.OtherPrivateKey()
+	if err := verifyRegistration(&otherKey.PublicKey, resp.TokenID, resp.IssuedAt, resp.Signature); err == nil {
+		t.Error("Expected another key not to verify")
+	}
+}
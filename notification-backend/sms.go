@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// SMS fallback configuration; disabled without a provider
+	smsProviderName = flag.String("sms-provider", "", "SMS provider for the critical-notification fallback: twilio (or any Twilio-compatible API); empty disables it")
+	smsSender       = flag.String("sms-sender", "", "Sender ID: an E.164 number, alphanumeric sender or Twilio messaging service SID (MG...)")
+	smsTimeout      = flag.Duration("sms-timeout", 10*time.Second, "Timeout for sending a single SMS")
+
+	twilioAccountSID   = flag.String("twilio-account-sid", "", "Twilio account SID")
+	twilioAuthTokenArg = flag.String("twilio-auth-token", "", "Twilio auth token (or TWILIO_AUTH_TOKEN)")
+	twilioAPIURL       = flag.String("twilio-api-url", "https://api.twilio.com", "Base URL of the Twilio-compatible Messages API")
+)
+
+// maxSMSLength is the longest body Twilio accepts; longer texts are cut
+const maxSMSLength = 1600
+
+// smsProvider sends one text message. Providers are registered in
+// smsProviders and picked with --sms-provider.
+type smsProvider interface {
+	SendSMS(ctx context.Context, to, text string) error
+}
+
+// smsProviders builds the configured provider by name
+var smsProviders = map[string]func() (smsProvider, error){
+	"twilio": newTwilioProvider,
+}
+
+// activeSMSProvider is nil unless --sms-provider is set; tests replace it
+var activeSMSProvider smsProvider
+
+// e164Pattern is the phone number format registrations must use
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+var smsFallback = &fallbackChannel{
+	name: "sms",
+	// Texts cost money and interrupt, so only critical notifications to a
+	// device that is gone for good fall back to SMS
+	applies: func(token *TokenStorageInfo, d delivery, pushErr error) bool {
+		return activeSMSProvider != nil && token.EncryptedPhone != "" && d.Critical && errorCodeOf(pushErr, "") == ErrTokenUnregistered
+	},
+	send: sendSMSFallback,
+}
+
+// setupSMS builds the provider named by --sms-provider
+func setupSMS(name string) error {
+	if name == "" {
+		return nil
+	}
+	newProvider, ok := smsProviders[name]
+	if !ok {
+		return fmt.Errorf("unknown --sms-provider %q", name)
+	}
+	if *smsSender == "" {
+		return fmt.Errorf("--sms-provider needs --sms-sender")
+	}
+	provider, err := newProvider()
+	if err != nil {
+		return err
+	}
+	activeSMSProvider = provider
+	return nil
+}
+
+// validateEncryptedPhone checks a registration's fallback number decrypts to an E.164 number
+func validateEncryptedPhone(encrypted string) error {
+	if activeSMSProvider == nil {
+		return withCode(ErrUnsupportedPlatform, fmt.Errorf("SMS fallback is not enabled on this server"))
+	}
+	if len(encrypted) < 100 || len(encrypted) > 10000 {
+		return withCode(ErrInvalidEncryptedData, fmt.Errorf("encrypted phone number has an impossible length"))
+	}
+	phone, err := decryptHybridToken(encrypted)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt phone number: %v", err))
+	}
+	defer secureWipeString(&phone)
+
+	if !e164Pattern.MatchString(phone) {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("phone number must be in E.164 format, like +41791234567"))
+	}
+	return nil
+}
+
+// smsText renders the notification as a single text message
+func smsText(title, body string) string {
+	return truncateRunes(title+": "+body, maxSMSLength)
+}
+
+// sendSMSFallback texts the notification to the registration's fallback number
+func sendSMSFallback(ctx context.Context, token *TokenStorageInfo, d delivery) error {
+	phone, err := decryptHybridToken(token.EncryptedPhone)
+	if err != nil {
+		return withCode(ErrDecryptFailed, fmt.Errorf("failed to decrypt phone number: %v", err))
+	}
+	defer secureWipeString(&phone)
+
+	ctx, span := startSpan(ctx, "sms.send")
+	sendCtx, cancel := context.WithTimeout(ctx, *smsTimeout)
+	defer cancel()
+	err = activeSMSProvider.SendSMS(sendCtx, phone, smsText(d.Title, d.Body))
+	endSpan(span, err)
+	if err != nil {
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to send SMS: %v", err))
+	}
+	return nil
+}
+
+// twilioProvider sends through Twilio's Messages API, which several other
+// providers also implement
+type twilioProvider struct {
+	client     *http.Client
+	baseURL    string
+	accountSID string
+	authToken  string
+	sender     string
+}
+
+// newTwilioProvider reads the Twilio settings, preferring --twilio-auth-token over TWILIO_AUTH_TOKEN
+func newTwilioProvider() (smsProvider, error) {
+	token := *twilioAuthTokenArg
+	if token == "" {
+		token = os.Getenv("TWILIO_AUTH_TOKEN")
+	}
+	if *twilioAccountSID == "" || token == "" {
+		return nil, fmt.Errorf("--sms-provider=twilio needs --twilio-account-sid and --twilio-auth-token or TWILIO_AUTH_TOKEN")
+	}
+	u, err := url.Parse(*twilioAPIURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("--twilio-api-url must be an http(s) URL, got %q", *twilioAPIURL)
+	}
+	return &twilioProvider{
+		client:     &http.Client{},
+		baseURL:    strings.TrimRight(*twilioAPIURL, "/"),
+		accountSID: *twilioAccountSID,
+		authToken:  token,
+		sender:     *smsSender,
+	}, nil
+}
+
+func (p *twilioProvider) SendSMS(ctx context.Context, to, text string) error {
+	form := url.Values{"To": {to}, "Body": {text}}
+	// Messaging service SIDs pick a sender from the service's pool
+	if strings.HasPrefix(p.sender, "MG") {
+		form.Set("MessagingServiceSid", p.sender)
+	} else {
+		form.Set("From", p.sender)
+	}
+
+	endpoint := p.baseURL + "/2010-04-01/Accounts/" + url.PathEscape(p.accountSID) + "/Messages.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.accountSID, p.authToken)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var result struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	return fmt.Errorf("provider returned %s: %d %s", resp.Status, result.Code, result.Message)
+}
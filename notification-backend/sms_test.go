@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+// fakeSMSProvider records texts instead of sending them
+type fakeSMSProvider struct{ to, text string }
+
+func (p *fakeSMSProvider) SendSMS(_ context.Context, to, text string) error {
+	p.to, p.text = to, text
+	return nil
+}
+
+func TestSMSFallback(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalProvider, originalAddr := privateKey, activeSMSProvider, *smtpAddr
+	defer func() {
+		privateKey, activeSMSProvider, *smtpAddr = originalPrivateKey, originalProvider, originalAddr
+		delete(platformTransports, "test")
+	}()
+	privateKey = privKey
+	*smtpAddr = ""
+	provider := &fakeSMSProvider{}
+	activeSMSProvider = provider
+
+	pushErr := withCode(ErrTokenUnregistered, errors.New("gone"))
+	platformTransports["test"] = &transport{
+		name:       "test",
+		configured: func() bool { return true },
+		ready:      func() error { return nil },
+		validate:   func(string) error { return nil },
+		send:       func(context.Context, delivery) error { return pushErr },
+	}
+
+	encryptedToken := apitest.EncryptToken("device-address")
+	encryptedPhone := apitest.EncryptToken("+41791234567")
+	token := &TokenStorageInfo{OpaqueID: "id", EncryptedData: encryptedToken, Platform: "test", EncryptedPhone: encryptedPhone}
+
+	if err := sendNotification(t.Context(), token, delivery{Title: "Alarm", Body: "Smoke detected"}); errorCodeOf(err, "") != ErrTokenUnregistered || provider.to != "" {
+		t.Errorf("Expected no SMS for a non-critical notification, got %v (texted %q)", err, provider.to)
+	}
+	if err := sendNotification(t.Context(), token, delivery{Title: "Alarm", Body: "Smoke detected", Critical: true}); err != nil {
+		t.Fatalf("Expected SMS fallback for a critical notification, got %v", err)
+	}
+	if provider.to != "+41791234567" || provider.text != "Alarm: Smoke detected" {
+		t.Errorf("Unexpected SMS to %q: %q", provider.to, provider.text)
+	}
+
+	for phone, code := range map[string]ErrorCode{
+		"+41791234567": "",
+		"0791234567":   ErrInvalidSubscription,
+		"+41 79 123":   ErrInvalidSubscription,
+	} {
+		encrypted := apitest.EncryptToken(phone)
+		if err := validateEncryptedPhone(encrypted); errorCodeOf(err, "") != code || (code == "") != (err == nil) {
+			t.Errorf("Phone %q: expected %q, got %v", phone, code, err)
+		}
+	}
+
+	if text := smsText("T", strings.Repeat("é", 2000)); len([]rune(text)) != maxSMSLength {
+		t.Errorf("Expected long text to be cut to %d characters, got %d", maxSMSLength, len([]rune(text)))
+	}
+}
+
+func TestTwilioProvider(t *testing.T) {
+	var path, user, pass, form string
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		user, pass, _ = r.BasicAuth()
+		r.ParseForm()
+		form = r.PostForm.Encode()
+		w.WriteHeader(status)
+		w.Write([]byte(`{"code":21211,"message":"Invalid 'To' Phone Number"}`))
+	}))
+	defer server.Close()
+
+	originalSID, originalToken, originalURL, originalSender, originalProvider := *twilioAccountSID, *twilioAuthTokenArg, *twilioAPIURL, *smsSender, activeSMSProvider
+	defer func() {
+		*twilioAccountSID, *twilioAuthTokenArg, *twilioAPIURL, *smsSender, activeSMSProvider = originalSID, originalToken, originalURL, originalSender, originalProvider
+	}()
+	*twilioAccountSID, *twilioAuthTokenArg, *twilioAPIURL, *smsSender = "AC123", "secret", server.URL, "+15005550006"
+
+	if err := setupSMS("carrier-pigeon"); err == nil {
+		t.Error("Expected unknown provider to be rejected")
+	}
+	if err := setupSMS("twilio"); err != nil {
+		t.Fatalf("setupSMS failed: %v", err)
+	}
+	if err := activeSMSProvider.SendSMS(t.Context(), "+41791234567", "Alarm: Smoke"); err != nil {
+		t.Fatalf("Expected SMS to be accepted, got %v", err)
+	}
+	if path != "/2010-04-01/Accounts/AC123/Messages.json" || user != "AC123" || pass != "secret" || form != "Body=Alarm%3A+Smoke&From=%2B15005550006&To=%2B41791234567" {
+		t.Errorf("Unexpected request to %s as %s:%s: %s", path, user, pass, form)
+	}
+
+	status = http.StatusBadRequest
+	if err := activeSMSProvider.SendSMS(t.Context(), "+4", "x"); err == nil || !strings.Contains(err.Error(), "21211") {
+		t.Errorf("Expected provider error with its code, got %v", err)
+	}
+
+	*twilioAuthTokenArg = ""
+	t.Setenv("TWILIO_AUTH_TOKEN", "")
+	if err := setupSMS("twilio"); err == nil {
+		t.Error("Expected Twilio without auth token to be rejected")
+	}
+}
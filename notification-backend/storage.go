@@ -5,37 +5,86 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // TokenStorageInfo represents the data stored for each token
 type TokenStorageInfo struct {
-	OpaqueID        string    `json:"opaque_id"`
-	EncryptedData   string    `json:"encrypted_data"`
-	Platform        string    `json:"platform"`
-	RegisteredAt    time.Time `json:"registered_at"`
-	LastUsedAt      time.Time `json:"last_used_at"`
-	PublicKeyHash   string    `json:"public_key_hash"`
+	OpaqueID      string    `json:"opaque_id"`
+	EncryptedData string    `json:"encrypted_data"`
+	Platform      string    `json:"platform"`
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+	PublicKeyHash string    `json:"public_key_hash"`
+
+	EncryptedEmail string `json:"encrypted_email,omitempty"`
+	EncryptedPhone string `json:"encrypted_phone,omitempty"`
+
+	Channels        []ChannelRegistration `json:"channels,omitempty"`
+	FirebaseProject string                `json:"firebase_project,omitempty"`
+
+	// NotifySecretHash is the SHA-256 of the secret /v1/notify requires; empty for older tokens
+	NotifySecretHash string `json:"notify_secret_hash,omitempty"`
+
+	Metadata *DeviceMetadata `json:"metadata,omitempty"`
+
+	// UserHash groups the devices of one app user, see TokenRegistration
+	UserHash string `json:"user_hash,omitempty"`
+
+	// Timezone and QuietHours hold back non-critical notifications, see TokenRegistration
+	Timezone   string `json:"timezone,omitempty"`
+	QuietHours string `json:"quiet_hours,omitempty"`
 }
 
 // ExoscaleStorage provides S3-compatible storage using Exoscale SOS
 type ExoscaleStorage struct {
-	client       *s3.Client
-	bucketName   string
+	client        *s3.Client
+	bucketName    string
 	publicKeyHash string
+	opTimeout     time.Duration // Deadline applied to each individual SOS call
+
+	pendingMu  sync.Mutex // serializes UpdatePending
+	groupsMu   sync.Mutex // serializes UpdateGroup and DeleteGroup
+	deferredMu sync.Mutex // serializes UpdateDeferred
+
+	experimentsMu sync.Mutex // serializes UpdateExperiment
+	templatesMu   sync.Mutex // serializes PutTemplate and DeleteTemplate
+
+	clock Clock       // stamps tokens, groups, experiments and templates, and dates cleanups
+	ids   IDGenerator // issues the opaque IDs of registrations
+	cache *tokenCache // registrations GetToken read, nil when disabled
 }
 
 // NewExoscaleStorage creates a new storage instance configured for Exoscale SOS
-func NewExoscaleStorage(accessKey, secretKey, bucketName, zone, publicKeyHash string) (*ExoscaleStorage, error) {
+func NewExoscaleStorage(accessKey, secretKey, bucketName, zone, publicKeyHash string, opTimeout time.Duration) (*ExoscaleStorage, error) {
+	storage, err := newExoscaleClient(accessKey, secretKey, bucketName, zone, publicKeyHash, opTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify bucket exists and is accessible
+	if err := storage.ensureBucket(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to ensure bucket exists: %v", err)
+	}
+
+	slog.Info("Exoscale SOS storage initialized", "bucket", bucketName, "zone", zone, "endpoint", sosEndpoint(zone))
+	return storage, nil
+}
+
+// newExoscaleClient configures the S3 client without touching the network
+func newExoscaleClient(accessKey, secretKey, bucketName, zone, publicKeyHash string, opTimeout time.Duration) (*ExoscaleStorage, error) {
 	// Configure AWS SDK for Exoscale SOS
 	sosCfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
@@ -45,91 +94,147 @@ func NewExoscaleStorage(accessKey, secretKey, bucketName, zone, publicKeyHash st
 		return nil, fmt.Errorf("failed to load SOS configuration: %v", err)
 	}
 
+	chaos, err := storageChaosFromFlags()
+	if err != nil {
+		return nil, err
+	}
+
 	// Create S3 client with custom endpoint for Exoscale SOS
-	sosEndpoint := fmt.Sprintf("https://sos-%s.exo.io", zone)
 	client := s3.NewFromConfig(sosCfg, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String(sosEndpoint)
+		o.BaseEndpoint = aws.String(sosEndpoint(zone))
 		o.UsePathStyle = true // Required for Exoscale SOS
+		chaos.wrap(o)
 	})
 
-	storage := &ExoscaleStorage{
+	return &ExoscaleStorage{
 		client:        client,
 		bucketName:    bucketName,
 		publicKeyHash: publicKeyHash,
-	}
+		opTimeout:     opTimeout,
+		clock:         systemClock{},
+		ids:           randomIDs{},
+		cache:         newTokenCache(*tokenCacheSize, *tokenCacheTTL),
+	}, nil
+}
 
-	// Verify bucket exists and is accessible
-	if err := storage.ensureBucket(context.Background()); err != nil {
-		return nil, fmt.Errorf("failed to ensure bucket exists: %v", err)
-	}
+// sosEndpoint returns the S3 endpoint URL for an Exoscale zone
+func sosEndpoint(zone string) string {
+	return fmt.Sprintf("https://sos-%s.exo.io", zone)
+}
 
-	log.Printf("Exoscale SOS storage initialized: bucket=%s, zone=%s, endpoint=%s", bucketName, zone, sosEndpoint)
-	return storage, nil
+// Probe checks that the bucket is reachable with the configured credentials,
+// without creating it
+func (s *ExoscaleStorage) Probe(ctx context.Context) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucketName),
+	})
+	return err
 }
 
 // ensureBucket checks if the bucket exists and creates it if necessary
 func (s *ExoscaleStorage) ensureBucket(ctx context.Context) error {
 	// Check if bucket exists
-	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+	headCtx, cancel := s.opContext(ctx)
+	defer cancel()
+	_, err := s.client.HeadBucket(headCtx, &s3.HeadBucketInput{
 		Bucket: aws.String(s.bucketName),
 	})
 
 	if err != nil {
 		// Try to create the bucket
-		_, createErr := s.client.CreateBucket(ctx, &s3.CreateBucketInput{
+		createCtx, cancel := s.opContext(ctx)
+		defer cancel()
+		_, createErr := s.client.CreateBucket(createCtx, &s3.CreateBucketInput{
 			Bucket: aws.String(s.bucketName),
 		})
 		if createErr != nil {
 			return fmt.Errorf("bucket does not exist and cannot be created: %v (original error: %v)", createErr, err)
 		}
-		log.Printf("Created new SOS bucket: %s", s.bucketName)
+		loggerFromContext(ctx).Info("Created new SOS bucket", "bucket", s.bucketName)
 	}
 
 	return nil
 }
 
 // StoreToken stores a token in SOS with the key format: public-key-hash/opaque-token-id
-func (s *ExoscaleStorage) StoreToken(ctx context.Context, opaqueID, encryptedData, platform string) error {
+func (s *ExoscaleStorage) StoreToken(ctx context.Context, opaqueID string, reg TokenRegistration, notifySecretHash string) error {
 	info := TokenStorageInfo{
-		OpaqueID:      opaqueID,
-		EncryptedData: encryptedData,
-		Platform:      platform,
-		RegisteredAt:  time.Now(),
-		LastUsedAt:    time.Now(),
-		PublicKeyHash: s.publicKeyHash,
+		OpaqueID:        opaqueID,
+		EncryptedData:   reg.EncryptedData,
+		Platform:        reg.Platform,
+		RegisteredAt:    s.clock.Now(),
+		LastUsedAt:      s.clock.Now(),
+		PublicKeyHash:   s.publicKeyHash,
+		EncryptedEmail:  reg.EncryptedEmail,
+		EncryptedPhone:  reg.EncryptedPhone,
+		Channels:        reg.Channels,
+		FirebaseProject: reg.FirebaseProject,
+
+		NotifySecretHash: notifySecretHash,
+		Metadata:         registrationMetadata(reg),
+		UserHash:         reg.UserHash,
+		Timezone:         reg.Timezone,
+		QuietHours:       reg.QuietHours,
 	}
+	return s.UploadToken(ctx, &info)
+}
 
+// UploadToken writes a registration as it is, keeping its timestamps
+func (s *ExoscaleStorage) UploadToken(ctx context.Context, info *TokenStorageInfo) error {
+	defer s.cache.invalidate(info.OpaqueID)
 	data, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("failed to marshal token info: %v", err)
 	}
 
-	key := s.buildObjectKey(opaqueID)
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+	key := s.buildObjectKey(info.OpaqueID)
+	spanCtx, span := startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
 		Bucket:      aws.String(s.bucketName),
 		Key:         aws.String(key),
 		Body:        strings.NewReader(string(data)),
 		ContentType: aws.String("application/json"),
 	})
+	endSpan(span, err)
 
 	if err != nil {
+		reportError(ctx, "storage", err, "op", "PutObject")
 		return fmt.Errorf("failed to store token in SOS: %v", err)
 	}
 
-	log.Printf("Token stored in SOS: %s (key: %s)", opaqueID[:16]+"...", key)
+	loggerFromContext(ctx).Info("Token stored in SOS", "token_id", info.OpaqueID)
 	return nil
 }
 
-// GetToken retrieves a token from SOS and updates its last used time
+// GetToken retrieves a token from SOS and updates its last used time. A
+// cached registration is returned without either, so its last used time is up
+// to --token-cache-ttl old.
 func (s *ExoscaleStorage) GetToken(ctx context.Context, opaqueID string) (*TokenStorageInfo, error) {
+	if info, ok := s.cache.get(opaqueID, s.clock.Now()); ok {
+		return info, nil
+	}
+
 	key := s.buildObjectKey(opaqueID)
-	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+	spanCtx, span := startSpan(ctx, "sos.GetObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel() // Body is read below, so keep the deadline until we return
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
+	endSpan(span, err)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to get token from SOS: %v", err)
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, withCode(ErrTokenNotFound, fmt.Errorf("token not found in SOS: %v", err))
+		}
+		reportError(ctx, "storage", err, "op", "GetObject")
+		return nil, withCode(ErrStorageUnavailable, fmt.Errorf("failed to get token from SOS: %v", err))
 	}
 	defer resp.Body.Close()
 
@@ -139,12 +244,13 @@ func (s *ExoscaleStorage) GetToken(ctx context.Context, opaqueID string) (*Token
 	}
 
 	// Update last used time
-	info.LastUsedAt = time.Now()
+	info.LastUsedAt = s.clock.Now()
 	if err := s.updateLastUsed(ctx, opaqueID, &info); err != nil {
-		log.Printf("Warning: failed to update last used time for %s: %v", opaqueID[:16]+"...", err)
+		loggerFromContext(ctx).Warn("Failed to update last used time", "token_id", opaqueID, "error", err)
 		// Don't fail the get operation if we can't update the timestamp
 	}
 
+	s.cache.put(&info, s.clock.Now())
 	return &info, nil
 }
 
@@ -156,67 +262,133 @@ func (s *ExoscaleStorage) updateLastUsed(ctx context.Context, opaqueID string, i
 	}
 
 	key := s.buildObjectKey(opaqueID)
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+	spanCtx, span := startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
 		Bucket:      aws.String(s.bucketName),
 		Key:         aws.String(key),
 		Body:        strings.NewReader(string(data)),
 		ContentType: aws.String("application/json"),
 	})
+	endSpan(span, err)
 
 	return err
 }
 
 // ListAllTokens returns all tokens (used for broadcast and cleanup)
 func (s *ExoscaleStorage) ListAllTokens(ctx context.Context) ([]*TokenStorageInfo, error) {
-	prefix := s.publicKeyHash + "/"
-	resp, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+	ctx, listSpan := startSpan(ctx, "sos.ListAllTokens", s.spanAttrs()...)
+	// SOS lists at most 1000 keys per call
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucketName),
-		Prefix: aws.String(prefix),
+		Prefix: aws.String(s.publicKeyHash + "/"),
 	})
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to list objects: %v", err)
-	}
-
 	var tokens []*TokenStorageInfo
-	for _, obj := range resp.Contents {
-		// Get each object
-		getResp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(s.bucketName),
-			Key:    obj.Key,
-		})
+	objects := 0
+	for paginator.HasMorePages() {
+		listCtx, cancel := s.opContext(ctx)
+		page, err := paginator.NextPage(listCtx)
+		cancel()
 		if err != nil {
-			log.Printf("Warning: failed to get object %s: %v", *obj.Key, err)
-			continue
+			endSpan(listSpan, err)
+			reportError(ctx, "storage", err, "op", "ListObjectsV2")
+			return nil, fmt.Errorf("failed to list objects: %v", err)
 		}
+		objects += len(page.Contents)
 
-		var info TokenStorageInfo
-		if err := json.NewDecoder(getResp.Body).Decode(&info); err != nil {
-			log.Printf("Warning: failed to decode object %s: %v", *obj.Key, err)
-			getResp.Body.Close()
-			continue
-		}
-		getResp.Body.Close()
+		for _, obj := range page.Contents {
+			// Stop early if the caller gave up (client disconnect or deadline)
+			if err := ctx.Err(); err != nil {
+				endSpan(listSpan, err)
+				return nil, fmt.Errorf("listing tokens aborted: %v", err)
+			}
+
+			// Get each object
+			info, err := s.getObject(ctx, *obj.Key)
+			if err != nil {
+				loggerFromContext(ctx).Warn("Failed to get object", "token_id", objectOpaqueID(*obj.Key), "error", err)
+				continue
+			}
 
-		tokens = append(tokens, &info)
+			tokens = append(tokens, info)
+		}
 	}
 
+	listSpan.SetAttributes(attribute.Int("sos.object_count", objects))
+	endSpan(listSpan, nil)
 	return tokens, nil
 }
 
+// getObject fetches and decodes a single token object under the per-operation deadline
+func (s *ExoscaleStorage) getObject(ctx context.Context, key string) (*TokenStorageInfo, error) {
+	opCtx, cancel := s.opContext(ctx)
+	defer cancel()
+
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info TokenStorageInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode object: %v", err)
+	}
+	return &info, nil
+}
+
+// ListTokenIDs returns the opaque ID of every stored token, page by page,
+// without reading the tokens
+func (s *ExoscaleStorage) ListTokenIDs(ctx context.Context) ([]string, error) {
+	ctx, span := startSpan(ctx, "sos.ListTokenIDs", s.spanAttrs()...)
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.publicKeyHash + "/"),
+	})
+
+	var ids []string
+	for paginator.HasMorePages() {
+		opCtx, cancel := s.opContext(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			endSpan(span, err)
+			reportError(ctx, "storage", err, "op", "ListObjectsV2")
+			return nil, fmt.Errorf("failed to list objects: %v", err)
+		}
+		for _, obj := range page.Contents {
+			ids = append(ids, objectOpaqueID(*obj.Key))
+		}
+	}
+	span.SetAttributes(attribute.Int("sos.object_count", len(ids)))
+	endSpan(span, nil)
+	return ids, nil
+}
+
 // DeleteToken removes a token from storage
 func (s *ExoscaleStorage) DeleteToken(ctx context.Context, opaqueID string) error {
+	defer s.cache.invalidate(opaqueID)
 	key := s.buildObjectKey(opaqueID)
-	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+	spanCtx, span := startSpan(ctx, "sos.DeleteObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err := s.client.DeleteObject(opCtx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
+	endSpan(span, err)
 
 	if err != nil {
+		reportError(ctx, "storage", err, "op", "DeleteObject")
 		return fmt.Errorf("failed to delete token from SOS: %v", err)
 	}
 
-	log.Printf("Token deleted from SOS: %s", opaqueID[:16]+"...")
+	loggerFromContext(ctx).Info("Token deleted from SOS", "token_id", opaqueID)
 	return nil
 }
 
@@ -226,23 +398,43 @@ func (s *ExoscaleStorage) CleanupOldTokens(ctx context.Context, maxAge time.Dura
 	if err != nil {
 		return 0, fmt.Errorf("failed to list tokens for cleanup: %v", err)
 	}
+	deleted := cleanupTokens(ctx, tokens, s.clock.Now().Add(-maxAge), s.DeleteToken)
+	loggerFromContext(ctx).Info("Cleanup completed", "deleted", deleted, "max_age", maxAge)
+	return deleted, nil
+}
 
-	cutoff := time.Now().Add(-maxAge)
+// cleanupTokens deletes the tokens last used before cutoff and counts them.
+// A token that fails to delete is left for the next cleanup.
+func cleanupTokens(ctx context.Context, tokens []*TokenStorageInfo, cutoff time.Time, deleteToken func(context.Context, string) error) int {
 	deleted := 0
-
 	for _, token := range tokens {
 		if token.LastUsedAt.Before(cutoff) {
-			if err := s.DeleteToken(ctx, token.OpaqueID); err != nil {
-				log.Printf("Warning: failed to delete old token %s: %v", token.OpaqueID[:16]+"...", err)
+			if err := deleteToken(ctx, token.OpaqueID); err != nil {
+				loggerFromContext(ctx).Warn("Failed to delete old token", "token_id", token.OpaqueID, "error", err)
 				continue
 			}
 			deleted++
-			log.Printf("Cleaned up token %s (last used: %s)", token.OpaqueID[:16]+"...", token.LastUsedAt.Format("2006-01-02 15:04:05"))
+			loggerFromContext(ctx).Info("Cleaned up token", "token_id", token.OpaqueID, "last_used_at", token.LastUsedAt)
 		}
 	}
+	return deleted
+}
+
+// opContext bounds a single SOS call by the configured operation timeout so a
+// hung endpoint cannot block the calling handler indefinitely
+func (s *ExoscaleStorage) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.opTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.opTimeout)
+}
 
-	log.Printf("Cleanup completed: deleted %d tokens older than %v", deleted, maxAge)
-	return deleted, nil
+// spanAttrs returns the common trace attributes for SOS operations
+func (s *ExoscaleStorage) spanAttrs() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("aws.s3.bucket", s.bucketName),
+	}
 }
 
 // buildObjectKey constructs the S3 object key in the format: public-key-hash/opaque-token-id
@@ -250,6 +442,449 @@ func (s *ExoscaleStorage) buildObjectKey(opaqueID string) string {
 	return fmt.Sprintf("%s/%s", s.publicKeyHash, opaqueID)
 }
 
+// objectOpaqueID extracts the opaque ID from an object key built by buildObjectKey
+func objectOpaqueID(key string) string {
+	if idx := strings.LastIndex(key, "/"); idx != -1 {
+		return key[idx+1:]
+	}
+	return key
+}
+
+// pendingKey is where a registration's pending messages live. It is outside
+// the token prefix so listing tokens never sees it.
+func (s *ExoscaleStorage) pendingKey(opaqueID string) string {
+	return fmt.Sprintf("pending/%s/%s", s.publicKeyHash, opaqueID)
+}
+
+// UpdatePending applies update to a registration's pending messages and
+// writes the result back. Updates are serialized within this replica only;
+// another replica's write in between is lost, so polling takes one replica.
+func (s *ExoscaleStorage) UpdatePending(ctx context.Context, opaqueID string, update func(*pendingQueue) bool) (pendingQueue, error) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	var queue pendingQueue
+	key := s.pendingKey(opaqueID)
+	spanCtx, span := startSpan(ctx, "sos.GetObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	endSpan(span, err)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&queue)
+		resp.Body.Close()
+	} else {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			err = nil
+		}
+	}
+	cancel()
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "GetObject")
+		return pendingQueue{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to read pending messages: %v", err))
+	}
+
+	if !update(&queue) {
+		return queue, nil
+	}
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return pendingQueue{}, fmt.Errorf("failed to marshal pending messages: %v", err)
+	}
+	spanCtx, span = startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel = s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "PutObject")
+		return pendingQueue{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to store pending messages: %v", err))
+	}
+	return queue, nil
+}
+
+// deferredKey is where notifications held back by quiet hours live, one
+// object for the whole queue
+func (s *ExoscaleStorage) deferredKey() string {
+	return fmt.Sprintf("deferred/%s", s.publicKeyHash)
+}
+
+// UpdateDeferred applies update to the notifications held back by quiet
+// hours and writes the result back. Updates are serialized within this
+// replica only: the last write wins, so a deferral or release by another
+// replica sharing the bucket is lost.
+func (s *ExoscaleStorage) UpdateDeferred(ctx context.Context, update func(*deferredQueue) bool) (deferredQueue, error) {
+	s.deferredMu.Lock()
+	defer s.deferredMu.Unlock()
+
+	var queue deferredQueue
+	spanCtx, span := startSpan(ctx, "sos.GetObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.deferredKey()),
+	})
+	endSpan(span, err)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&queue)
+		resp.Body.Close()
+	} else {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			err = nil
+		}
+	}
+	cancel()
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "GetObject")
+		return deferredQueue{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to read deferred notifications: %v", err))
+	}
+
+	if !update(&queue) {
+		return queue, nil
+	}
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return deferredQueue{}, fmt.Errorf("failed to marshal deferred notifications: %v", err)
+	}
+	spanCtx, span = startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel = s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.deferredKey()),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "PutObject")
+		return deferredQueue{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to store deferred notifications: %v", err))
+	}
+	return queue, nil
+}
+
+// groupKey is where a device group lives, outside the token prefix like
+// pending messages
+func (s *ExoscaleStorage) groupKey(name string) string {
+	return fmt.Sprintf("groups/%s/%s", s.publicKeyHash, name)
+}
+
+// GetGroup fetches the named device group
+func (s *ExoscaleStorage) GetGroup(ctx context.Context, name string) (DeviceGroup, error) {
+	var group DeviceGroup
+	spanCtx, span := startSpan(ctx, "sos.GetObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.groupKey(name)),
+	})
+	endSpan(span, err)
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return DeviceGroup{}, withCode(ErrGroupNotFound, fmt.Errorf("group %q not found", name))
+		}
+		reportError(ctx, "storage", err, "op", "GetObject")
+		return DeviceGroup{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to read group: %v", err))
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		return DeviceGroup{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to decode group: %v", err))
+	}
+	return group, nil
+}
+
+// UpdateGroup applies update to the named group, creating it first when
+// create is set, and writes the result back. Updates are serialized within
+// this replica only.
+func (s *ExoscaleStorage) UpdateGroup(ctx context.Context, name string, create bool, update func(*DeviceGroup)) (DeviceGroup, error) {
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+
+	group, err := s.GetGroup(ctx, name)
+	if errorCodeOf(err, "") == ErrGroupNotFound && create {
+		group, err = DeviceGroup{Name: name, CreatedAt: s.clock.Now()}, nil
+	}
+	if err != nil {
+		return DeviceGroup{}, err
+	}
+	update(&group)
+	group.UpdatedAt = s.clock.Now()
+
+	data, err := json.Marshal(group)
+	if err != nil {
+		return DeviceGroup{}, fmt.Errorf("failed to marshal group: %v", err)
+	}
+	spanCtx, span := startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.groupKey(name)),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "PutObject")
+		return DeviceGroup{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to store group: %v", err))
+	}
+	return group, nil
+}
+
+// DeleteGroup removes the named group; its members stay registered
+func (s *ExoscaleStorage) DeleteGroup(ctx context.Context, name string) error {
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+
+	// DeleteObject succeeds for missing keys, so look first to report them
+	if _, err := s.GetGroup(ctx, name); err != nil {
+		return err
+	}
+	spanCtx, span := startSpan(ctx, "sos.DeleteObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err := s.client.DeleteObject(opCtx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.groupKey(name)),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "DeleteObject")
+		return withCode(ErrStorageUnavailable, fmt.Errorf("failed to delete group: %v", err))
+	}
+	return nil
+}
+
+// ListGroups returns every device group
+func (s *ExoscaleStorage) ListGroups(ctx context.Context) ([]DeviceGroup, error) {
+	prefix := fmt.Sprintf("groups/%s/", s.publicKeyHash)
+	spanCtx, span := startSpan(ctx, "sos.ListObjectsV2", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	resp, err := s.client.ListObjectsV2(opCtx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	cancel()
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "ListObjectsV2")
+		return nil, withCode(ErrStorageUnavailable, fmt.Errorf("failed to list groups: %v", err))
+	}
+
+	groups := make([]DeviceGroup, 0, len(resp.Contents))
+	for _, obj := range resp.Contents {
+		group, err := s.GetGroup(ctx, strings.TrimPrefix(*obj.Key, prefix))
+		if err != nil {
+			loggerFromContext(ctx).Warn("Failed to get group", "key", *obj.Key, "error", err)
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// experimentKey is where a split send experiment lives, outside the token prefix
+func (s *ExoscaleStorage) experimentKey(name string) string {
+	return fmt.Sprintf("experiments/%s/%s", s.publicKeyHash, name)
+}
+
+// GetExperiment fetches the named split send experiment
+func (s *ExoscaleStorage) GetExperiment(ctx context.Context, name string) (Experiment, error) {
+	var experiment Experiment
+	spanCtx, span := startSpan(ctx, "sos.GetObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.experimentKey(name)),
+	})
+	endSpan(span, err)
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return Experiment{}, withCode(ErrExperimentNotFound, fmt.Errorf("experiment %q not found", name))
+		}
+		reportError(ctx, "storage", err, "op", "GetObject")
+		return Experiment{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to read experiment: %v", err))
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&experiment); err != nil {
+		return Experiment{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to decode experiment: %v", err))
+	}
+	return experiment, nil
+}
+
+// UpdateExperiment applies update to the named experiment, creating it first
+// when missing, and writes the result back. Updates are serialized within
+// this replica only.
+func (s *ExoscaleStorage) UpdateExperiment(ctx context.Context, name string, update func(*Experiment)) (Experiment, error) {
+	s.experimentsMu.Lock()
+	defer s.experimentsMu.Unlock()
+
+	experiment, err := s.GetExperiment(ctx, name)
+	if errorCodeOf(err, "") == ErrExperimentNotFound {
+		experiment, err = Experiment{Name: name, CreatedAt: s.clock.Now()}, nil
+	}
+	if err != nil {
+		return Experiment{}, err
+	}
+	if experiment.Assignments == nil {
+		experiment.Assignments = make(map[string]string)
+	}
+	update(&experiment)
+	experiment.UpdatedAt = s.clock.Now()
+
+	data, err := json.Marshal(experiment)
+	if err != nil {
+		return Experiment{}, fmt.Errorf("failed to marshal experiment: %v", err)
+	}
+	spanCtx, span := startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.experimentKey(name)),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "PutObject")
+		return Experiment{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to store experiment: %v", err))
+	}
+	return experiment, nil
+}
+
+// templateKey is where a notification template lives, outside the token prefix
+func (s *ExoscaleStorage) templateKey(name string) string {
+	return fmt.Sprintf("templates/%s/%s", s.publicKeyHash, name)
+}
+
+// GetTemplate fetches the named notification template
+func (s *ExoscaleStorage) GetTemplate(ctx context.Context, name string) (NotificationTemplate, error) {
+	var tmpl NotificationTemplate
+	spanCtx, span := startSpan(ctx, "sos.GetObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	resp, err := s.client.GetObject(opCtx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.templateKey(name)),
+	})
+	endSpan(span, err)
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return NotificationTemplate{}, withCode(ErrTemplateNotFound, fmt.Errorf("template %q not found", name))
+		}
+		reportError(ctx, "storage", err, "op", "GetObject")
+		return NotificationTemplate{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to read template: %v", err))
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&tmpl); err != nil {
+		return NotificationTemplate{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to decode template: %v", err))
+	}
+	return tmpl, nil
+}
+
+// PutTemplate stores a template, keeping the creation time of the one it
+// replaces. Updates are serialized within this replica only.
+func (s *ExoscaleStorage) PutTemplate(ctx context.Context, tmpl NotificationTemplate) (NotificationTemplate, error) {
+	s.templatesMu.Lock()
+	defer s.templatesMu.Unlock()
+
+	tmpl.CreatedAt, tmpl.UpdatedAt = s.clock.Now(), s.clock.Now()
+	old, err := s.GetTemplate(ctx, tmpl.Name)
+	switch {
+	case err == nil:
+		tmpl.CreatedAt = old.CreatedAt
+	case errorCodeOf(err, "") != ErrTemplateNotFound:
+		return NotificationTemplate{}, err
+	}
+
+	data, err := json.Marshal(tmpl)
+	if err != nil {
+		return NotificationTemplate{}, fmt.Errorf("failed to marshal template: %v", err)
+	}
+	spanCtx, span := startSpan(ctx, "sos.PutObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err = s.client.PutObject(opCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.templateKey(tmpl.Name)),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "PutObject")
+		return NotificationTemplate{}, withCode(ErrStorageUnavailable, fmt.Errorf("failed to store template: %v", err))
+	}
+	return tmpl, nil
+}
+
+// DeleteTemplate removes the named template
+func (s *ExoscaleStorage) DeleteTemplate(ctx context.Context, name string) error {
+	s.templatesMu.Lock()
+	defer s.templatesMu.Unlock()
+
+	// DeleteObject succeeds for missing keys, so look first to report them
+	if _, err := s.GetTemplate(ctx, name); err != nil {
+		return err
+	}
+	spanCtx, span := startSpan(ctx, "sos.DeleteObject", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	defer cancel()
+	_, err := s.client.DeleteObject(opCtx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.templateKey(name)),
+	})
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "DeleteObject")
+		return withCode(ErrStorageUnavailable, fmt.Errorf("failed to delete template: %v", err))
+	}
+	return nil
+}
+
+// ListTemplates returns every notification template
+func (s *ExoscaleStorage) ListTemplates(ctx context.Context) ([]NotificationTemplate, error) {
+	prefix := fmt.Sprintf("templates/%s/", s.publicKeyHash)
+	spanCtx, span := startSpan(ctx, "sos.ListObjectsV2", s.spanAttrs()...)
+	opCtx, cancel := s.opContext(spanCtx)
+	resp, err := s.client.ListObjectsV2(opCtx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	cancel()
+	endSpan(span, err)
+	if err != nil {
+		reportError(ctx, "storage", err, "op", "ListObjectsV2")
+		return nil, withCode(ErrStorageUnavailable, fmt.Errorf("failed to list templates: %v", err))
+	}
+
+	templates := make([]NotificationTemplate, 0, len(resp.Contents))
+	for _, obj := range resp.Contents {
+		tmpl, err := s.GetTemplate(ctx, strings.TrimPrefix(*obj.Key, prefix))
+		if err != nil {
+			loggerFromContext(ctx).Warn("Failed to get template", "key", *obj.Key, "error", err)
+			continue
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
 // ComputePublicKeyHash computes a SHA256 hash of the public key for use in storage keys
 func ComputePublicKeyHash(publicKeyPEM string) string {
 	hash := sha256.Sum256([]byte(publicKeyPEM))
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"remote-notification/api/apitest"
+)
+
+// fakeSOS is an in-memory bucket answering the S3 calls ExoscaleStorage
+// makes for tokens, path style: HeadBucket, PutObject, GetObject,
+// DeleteObject and ListObjectsV2
+type fakeSOS struct {
+	mu         sync.Mutex
+	objects    map[string][]byte // by key
+	objectGets int
+}
+
+func (f *fakeSOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodHead && key == "":
+	case r.Method == http.MethodPut && key != "":
+		data, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.objects[key] = data
+		f.mu.Unlock()
+	case r.Method == http.MethodGet && key != "":
+		f.mu.Lock()
+		data, ok := f.objects[key]
+		f.objectGets++
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case r.Method == http.MethodDelete && key != "":
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+	default:
+		http.Error(w, "not implemented by fakeSOS", http.StatusNotImplemented)
+	}
+}
+
+// gets counts the GetObject calls answered so far
+func (f *fakeSOS) gets() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objectGets
+}
+
+// list answers ListObjectsV2 with up to 1000 keys, as S3 does, continuing
+// after the key in the continuation token
+func (f *fakeSOS) list(w http.ResponseWriter, prefix, after string) {
+	type object struct {
+		Key  string
+		Size int
+	}
+	var result struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []object
+
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	result.Prefix, result.MaxKeys = prefix, 1000
+	f.mu.Lock()
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			result.Contents = append(result.Contents, object{key, len(data)})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	if len(result.Contents) > result.MaxKeys {
+		result.Contents, result.IsTruncated = result.Contents[:result.MaxKeys], true
+		result.NextContinuationToken = result.Contents[result.MaxKeys-1].Key
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// newFakeSOSStorage returns an ExoscaleStorage on an empty fakeSOS, with
+// chaos (nil for none) in front of it. The SDK retries as it does against
+// SOS, only without waiting between attempts.
+func newFakeSOSStorage(tb testing.TB, chaos *storageChaos) (*ExoscaleStorage, *fakeSOS) {
+	tb.Helper()
+	sos := &fakeSOS{objects: make(map[string][]byte)}
+	server := httptest.NewServer(sos)
+	tb.Cleanup(server.Close)
+	options := s3.Options{
+		Region:       "ch-gva-2",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test-key", "test-secret", ""),
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			o.RateLimiter = ratelimit.None
+		}),
+	}
+	s := &ExoscaleStorage{
+		client:        s3.New(options, chaos.wrap),
+		bucketName:    "test",
+		publicKeyHash: apitest.PublicKeyHash(),
+		opTimeout:     10 * time.Second,
+		clock:         systemClock{},
+		ids:           randomIDs{},
+	}
+	return s, sos
+}
+
+// storeFakeTokens registers apitest.OpaqueID(0) to OpaqueID(n-1)
+func storeFakeTokens(tb testing.TB, s *ExoscaleStorage, n int) {
+	tb.Helper()
+	reg := TokenRegistration{EncryptedData: apitest.EncryptToken("fcm-token"), Platform: "android"}
+	for i := range n {
+		if err := s.StoreToken(context.Background(), apitest.OpaqueID(i), reg, ""); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestExoscaleStorageTokens(t *testing.T) {
+	s, sos := newFakeSOSStorage(t, nil)
+	ctx := context.Background()
+	storeFakeTokens(t, s, 3)
+	if _, ok := sos.objects[apitest.PublicKeyHash()+"/"+apitest.OpaqueID(0)]; !ok {
+		t.Errorf("Expected the token under the public key hash, got %d other objects", len(sos.objects))
+	}
+
+	info, err := s.GetToken(ctx, apitest.OpaqueID(1))
+	if err != nil || info.EncryptedData != apitest.EncryptToken("fcm-token") || info.Platform != "android" {
+		t.Fatalf("Expected the stored registration, got %+v, %v", info, err)
+	}
+	tokens, err := s.ListAllTokens(ctx)
+	if err != nil || len(tokens) != 3 {
+		t.Fatalf("Expected 3 tokens, got %d: %v", len(tokens), err)
+	}
+
+	if ids, err := s.ListTokenIDs(ctx); err != nil || len(ids) != 3 || ids[0] == "" {
+		t.Errorf("Expected the 3 opaque IDs, got %v, %v", ids, err)
+	}
+
+	if err := s.DeleteToken(ctx, apitest.OpaqueID(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetToken(ctx, apitest.OpaqueID(1)); errorCodeOf(err, "") != ErrTokenNotFound {
+		t.Errorf("Expected %s after the delete, got %v", ErrTokenNotFound, err)
+	}
+}
+
+func TestExoscaleStorageListAllTokensPages(t *testing.T) {
+	s, sos := newFakeSOSStorage(t, nil)
+	for i := range 1500 {
+		data, _ := json.Marshal(TokenStorageInfo{OpaqueID: apitest.OpaqueID(i), Platform: "android"})
+		sos.objects[s.buildObjectKey(apitest.OpaqueID(i))] = data
+	}
+
+	tokens, err := s.ListAllTokens(context.Background())
+	if err != nil || len(tokens) != 1500 {
+		t.Fatalf("Expected 1500 tokens over 2 pages, got %d: %v", len(tokens), err)
+	}
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		seen[token.OpaqueID] = true
+	}
+	if len(seen) != 1500 {
+		t.Errorf("Expected every token once, got %d distinct", len(seen))
+	}
+}
+
+func TestExoscaleStorageListTokenIDsPages(t *testing.T) {
+	s, sos := newFakeSOSStorage(t, nil)
+	want := make(map[string]bool)
+	for i := range 2500 {
+		sos.objects[s.buildObjectKey(apitest.OpaqueID(i))] = []byte("{}")
+		want[apitest.OpaqueID(i)] = true
+	}
+	sos.objects[s.pendingKey(apitest.OpaqueID(0))] = []byte("{}")
+
+	ids, err := s.ListTokenIDs(context.Background())
+	if err != nil || len(ids) != 2500 {
+		t.Fatalf("Expected 2500 IDs over 3 pages, got %d: %v", len(ids), err)
+	}
+	for _, id := range ids {
+		if !want[id] {
+			t.Fatalf("Expected only token IDs, got %q", id)
+		}
+		delete(want, id)
+	}
+}
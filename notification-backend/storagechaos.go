@@ -0,0 +1,165 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	storageChaosRate    = flag.Float64("storage-chaos-rate", 0, "Fail this fraction (0-1) of SOS requests, to see how the server degrades when SOS misbehaves; for tests and development only")
+	storageChaosCode    = flag.String("storage-chaos-code", "ServiceUnavailable", "S3 error code of the --storage-chaos-rate failures: "+strings.Join(storageChaosCodeNames(), ", "))
+	storageChaosOps     = flag.String("storage-chaos-ops", "", "Comma-separated S3 operations --storage-chaos-rate fails, such as GetObject to drop tokens from broadcasts; empty fails them all")
+	storageChaosLatency = flag.Duration("storage-chaos-latency", 0, "Delay added to every SOS request; for tests and development only")
+)
+
+// storageChaosCodes are the S3 errors a fault can answer with, and their
+// statuses. The SDK retries the 500s and 503s itself, so at a low rate many
+// of those faults never reach the server; the 403 and 404 always do.
+var storageChaosCodes = map[string]int{
+	"ServiceUnavailable": http.StatusServiceUnavailable,
+	"SlowDown":           http.StatusServiceUnavailable,
+	"InternalError":      http.StatusInternalServerError,
+	"AccessDenied":       http.StatusForbidden,
+	"NoSuchKey":          http.StatusNotFound,
+}
+
+// storageChaosOperations are the S3 operations ExoscaleStorage calls
+var storageChaosOperations = []string{"CreateBucket", "DeleteObject", "GetObject", "HeadBucket", "ListObjectsV2", "PutObject"}
+
+func storageChaosCodeNames() []string {
+	names := make([]string, 0, len(storageChaosCodes))
+	for code := range storageChaosCodes {
+		names = append(names, code)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// storageChaosFaults counts the injected failures, published on the debug
+// listener under /debug/vars
+var storageChaosFaults = expvar.NewInt("storage_chaos_faults")
+
+// storageChaos sits between the SOS client and the network, delaying every
+// request and failing some with an S3 error response. The SDK parses and
+// retries those as it would real ones, so every storage call and its error
+// handling runs as in an outage.
+type storageChaos struct {
+	rate    float64
+	code    string
+	ops     map[string]bool // nil fails every operation
+	latency time.Duration
+	next    s3.HTTPClient
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newStorageChaos checks the fault configuration, returning nil when it
+// injects nothing
+func newStorageChaos(rate float64, code, ops string, latency time.Duration) (*storageChaos, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("failure rate %v is not between 0 and 1", rate)
+	}
+	if _, ok := storageChaosCodes[code]; !ok {
+		return nil, fmt.Errorf("unknown S3 error code %q, expected one of %s", code, strings.Join(storageChaosCodeNames(), ", "))
+	}
+	if latency < 0 {
+		return nil, fmt.Errorf("negative latency %v", latency)
+	}
+	c := &storageChaos{rate: rate, code: code, latency: latency, rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}
+	for _, op := range strings.Split(ops, ",") {
+		if op = strings.TrimSpace(op); op == "" {
+			continue
+		}
+		if !slices.Contains(storageChaosOperations, op) {
+			return nil, fmt.Errorf("unknown S3 operation %q, expected one of %s", op, strings.Join(storageChaosOperations, ", "))
+		}
+		if c.ops == nil {
+			c.ops = make(map[string]bool)
+		}
+		c.ops[op] = true
+	}
+	if rate == 0 && latency == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// storageChaosFromFlags returns the --storage-chaos-* faults, nil if none
+func storageChaosFromFlags() (*storageChaos, error) {
+	c, err := newStorageChaos(*storageChaosRate, *storageChaosCode, *storageChaosOps, *storageChaosLatency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --storage-chaos flags: %v", err)
+	}
+	if c != nil {
+		slog.Warn("SOS faults are injected: storage calls fail or slow down on purpose",
+			"rate", c.rate, "code", c.code, "ops", *storageChaosOps, "latency", c.latency)
+	}
+	return c, nil
+}
+
+// wrap puts the faults in front of the client's transport; a nil
+// storageChaos leaves the client alone
+func (c *storageChaos) wrap(o *s3.Options) {
+	if c == nil {
+		return
+	}
+	c.next = o.HTTPClient
+	o.HTTPClient = c
+}
+
+func (c *storageChaos) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if c.latency > 0 {
+		select {
+		case <-time.After(c.latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !c.fails(awsmiddleware.GetOperationName(ctx)) {
+		return c.next.Do(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	storageChaosFaults.Add(1)
+	status := storageChaosCodes[c.code]
+	body := ""
+	if req.Method != http.MethodHead {
+		body = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>Injected by --storage-chaos-rate</Message><RequestId>storage-chaos</RequestId></Error>`, c.code)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/xml"}, "X-Amz-Request-Id": {"storage-chaos"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// fails draws whether a request of the operation fails
+func (c *storageChaos) fails(op string) bool {
+	if c.rate == 0 || c.ops != nil && !c.ops[op] {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.Float64() < c.rate
+}
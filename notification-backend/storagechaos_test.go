@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+// newTestChaos returns faults drawn from a fixed seed, so a test fails the
+// same requests on every run
+func newTestChaos(t *testing.T, rate float64, code, ops string, latency time.Duration) *storageChaos {
+	t.Helper()
+	c, err := newStorageChaos(rate, code, ops, latency)
+	if err != nil || c == nil {
+		t.Fatalf("Expected faults, got %v, %v", c, err)
+	}
+	c.rand = rand.New(rand.NewPCG(1, 2))
+	return c
+}
+
+func TestStorageChaosConfig(t *testing.T) {
+	for _, tc := range []struct {
+		rate    float64
+		code    string
+		ops     string
+		latency time.Duration
+		wantErr string
+	}{
+		{rate: -0.1, code: "ServiceUnavailable", wantErr: "not between 0 and 1"},
+		{rate: 1.5, code: "ServiceUnavailable", wantErr: "not between 0 and 1"},
+		{rate: 0.1, code: "Teapot", wantErr: "unknown S3 error code"},
+		{rate: 0.1, code: "ServiceUnavailable", ops: "GetObject,PutObjects", wantErr: `unknown S3 operation "PutObjects"`},
+		{code: "ServiceUnavailable", latency: -time.Second, wantErr: "negative latency"},
+	} {
+		if _, err := newStorageChaos(tc.rate, tc.code, tc.ops, tc.latency); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%+v: expected an error containing %q, got %v", tc, tc.wantErr, err)
+		}
+	}
+
+	// The defaults inject nothing, and leave the client as it is
+	c, err := newStorageChaos(0, "ServiceUnavailable", "", 0)
+	if err != nil || c != nil {
+		t.Errorf("Expected no faults by default, got %+v, %v", c, err)
+	}
+	c.wrap(nil)
+
+	c, err = newStorageChaos(0.5, "NoSuchKey", " GetObject, ListObjectsV2 ", 0)
+	if err != nil || len(c.ops) != 2 || !c.ops["GetObject"] || !c.ops["ListObjectsV2"] {
+		t.Errorf("Expected two operations, got %+v, %v", c, err)
+	}
+	if c.fails("PutObject") {
+		t.Error("Expected an operation not listed never to fail")
+	}
+}
+
+func TestStorageChaosPartialListing(t *testing.T) {
+	s, _ := newFakeSOSStorage(t, newTestChaos(t, 0.5, "AccessDenied", "GetObject", 0))
+	storeFakeTokens(t, s, 40)
+
+	// Each object that fails to load is left out, and the rest still listed
+	tokens, err := s.ListAllTokens(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the listing to carry on past failed objects, got %v", err)
+	}
+	if len(tokens) == 0 || len(tokens) == 40 {
+		t.Errorf("Expected some of the 40 tokens, got %d", len(tokens))
+	}
+
+	// When no object loads it is an empty listing rather than an error
+	s, _ = newFakeSOSStorage(t, newTestChaos(t, 1, "AccessDenied", "GetObject", 0))
+	storeFakeTokens(t, s, 5)
+	if tokens, err := s.ListAllTokens(context.Background()); err != nil || len(tokens) != 0 {
+		t.Errorf("Expected no tokens and no error, got %d, %v", len(tokens), err)
+	}
+
+	// Failing the listing itself fails the call
+	s, _ = newFakeSOSStorage(t, newTestChaos(t, 1, "InternalError", "ListObjectsV2", 0))
+	storeFakeTokens(t, s, 5)
+	if _, err := s.ListAllTokens(context.Background()); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("Expected the listing error, got %v", err)
+	}
+}
+
+func TestStorageChaosGetToken(t *testing.T) {
+	// The SDK retries a 503 before GetToken reports the storage unavailable
+	s, _ := newFakeSOSStorage(t, newTestChaos(t, 1, "ServiceUnavailable", "GetObject", 0))
+	storeFakeTokens(t, s, 1)
+	before := storageChaosFaults.Value()
+	if _, err := s.GetToken(context.Background(), apitest.OpaqueID(0)); errorCodeOf(err, "") != ErrStorageUnavailable {
+		t.Errorf("Expected %s, got %v", ErrStorageUnavailable, err)
+	}
+	if faults := storageChaosFaults.Value() - before; faults != 3 {
+		t.Errorf("Expected the SDK's 3 attempts, got %d faults", faults)
+	}
+
+	// A 404 is not retried, and reads as the token being gone
+	s, _ = newFakeSOSStorage(t, newTestChaos(t, 1, "NoSuchKey", "GetObject", 0))
+	storeFakeTokens(t, s, 1)
+	before = storageChaosFaults.Value()
+	if _, err := s.GetToken(context.Background(), apitest.OpaqueID(0)); errorCodeOf(err, "") != ErrTokenNotFound {
+		t.Errorf("Expected %s, got %v", ErrTokenNotFound, err)
+	}
+	if faults := storageChaosFaults.Value() - before; faults != 1 {
+		t.Errorf("Expected a single attempt, got %d faults", faults)
+	}
+}
+
+func TestStorageChaosLatency(t *testing.T) {
+	c, err := newStorageChaos(0, "ServiceUnavailable", "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newFakeSOSStorage(t, c)
+	storeFakeTokens(t, s, 1)
+
+	start := time.Now()
+	if err := s.DeleteToken(context.Background(), apitest.OpaqueID(0)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the request delayed, took %v", elapsed)
+	}
+
+	// The delay gives way to the operation's deadline
+	s.opTimeout = 10 * time.Millisecond
+	c.latency = time.Minute
+	start = time.Now()
+	if err := s.DeleteToken(context.Background(), apitest.OpaqueID(0)); err == nil {
+		t.Error("Expected the deadline to fail the request")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the deadline to cut the delay short, took %v", elapsed)
+	}
+}
+
+func TestStorageChaosBroadcast(t *testing.T) {
+	originalPrivateKey, originalStore, originalExoscale, originalStorage, originalClient := privateKey, tokenStore, useExoscale, exoscaleStorage, messagingClient
+	defer func() {
+		privateKey, tokenStore, useExoscale, exoscaleStorage, messagingClient = originalPrivateKey, originalStore, originalExoscale, originalStorage, originalClient
+	}()
+	privateKey = apitest.PrivateKey()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = true
+	fake := &fakeMessenger{}
+	messagingClient = fake
+	chaos := newTestChaos(t, 0.5, "AccessDenied", "GetObject", 0)
+	var sos *fakeSOS
+	exoscaleStorage, sos = newFakeSOSStorage(t, chaos)
+	for i := range 20 {
+		reg := TokenRegistration{EncryptedData: apitest.EncryptToken(fmt.Sprintf("fcm-token-%d", i)), Platform: "android"}
+		if err := exoscaleStorage.StoreToken(context.Background(), apitest.OpaqueID(i), reg, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A broadcast goes to the tokens that could be read, and counts only those
+	rr := httptest.NewRecorder()
+	handleSend(rr, httptest.NewRequest("POST", "/v1/send", strings.NewReader(`{"title":"t","body":"b"}`)))
+	var resp SendResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Expected a summary, got %d: %v", rr.Code, err)
+	}
+	if resp.TotalTokens == 0 || resp.TotalTokens == 20 || resp.SentCount != resp.TotalTokens || len(fake.sent) != resp.SentCount {
+		t.Errorf("Expected a partial broadcast without failures, got %+v, %d sent", resp, len(fake.sent))
+	}
+	if len(sos.objects) != 20 {
+		t.Errorf("Expected the unread tokens kept, got %d left", len(sos.objects))
+	}
+
+	// With the listing failing there is nothing to send to
+	chaos.ops = map[string]bool{"ListObjectsV2": true}
+	chaos.rate = 1
+	rr = httptest.NewRecorder()
+	handleSend(rr, httptest.NewRequest("POST", "/v1/send", strings.NewReader(`{"title":"t","body":"b"}`)))
+	var errResp ErrorResponse
+	json.NewDecoder(rr.Body).Decode(&errResp)
+	if rr.Code != http.StatusInternalServerError || errResp.Code != ErrStorageUnavailable {
+		t.Errorf("Expected %s, got %d %+v", ErrStorageUnavailable, rr.Code, errResp)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	sosSyncUpload   = flag.Bool("sos-sync-upload", true, "At startup, upload the registrations found only in --storage-file to SOS")
+	sosSyncDownload = flag.Bool("sos-sync-download", false, "At startup, make the registrations in --storage-file a copy of those in SOS, to fall back on without SOS credentials")
+)
+
+// storageSyncReport is what comparing the file store with SOS at startup found
+type storageSyncReport struct {
+	InBoth     int // registrations in both
+	FileOnly   int // registrations in the file store only
+	Uploading  int // of FileOnly, those to be uploaded
+	Deleted    int // copies of registrations SOS no longer has
+	SOSOnly    int // registrations in SOS only
+	Downloaded int // registrations copied from SOS into the file store
+	Differing  int // of InBoth, copies whose token no longer matches SOS
+}
+
+// syncStorageOnStart reconciles the file store with SOS, which a server that
+// started with file storage and later got SOS credentials needs to do
+// before it serves. Registrations only in the file are marked for upload,
+// which startReconcileRoutine then does and retries, and with download the
+// file becomes a copy of SOS. SOS is only ever written for a registration
+// it lacks, so it stays the canonical set.
+func syncStorageOnStart(ctx context.Context, upload, download bool) (storageSyncReport, error) {
+	var report storageSyncReport
+	ids, err := exoscaleStorage.ListTokenIDs(ctx)
+	if err != nil {
+		return report, err
+	}
+	inSOS := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		inSOS[id] = true
+	}
+
+	// Copies are read before taking the store's lock; one that cannot be
+	// read leaves the file's version as it is
+	var copies map[string]*TokenStorageInfo
+	if download {
+		copies = make(map[string]*TokenStorageInfo, len(ids))
+		for _, id := range ids {
+			info, err := exoscaleStorage.getObject(ctx, exoscaleStorage.buildObjectKey(id))
+			if err != nil {
+				slog.Warn("Failed to download token from SOS", "token_id", id, "error", err)
+				continue
+			}
+			copies[id] = info
+		}
+	}
+
+	err = tokenStore.UpdateMappings(func(mappings map[string]*TokenMapping) bool {
+		changed := false
+		for id, mapping := range mappings {
+			switch {
+			case inSOS[id]:
+				report.InBoth++
+				if info := copies[id]; info != nil {
+					if info.EncryptedData != mapping.EncryptedData {
+						report.Differing++
+						slog.Debug("File storage copy differs from SOS, replacing it", "token_id", id)
+					}
+					mappings[id] = sosMapping(info)
+					report.Downloaded++
+					changed = true
+				} else if !mapping.InSOS || mapping.PendingUpload {
+					// An upload that landed before the server stopped
+					mapping.InSOS, mapping.PendingUpload = true, false
+					changed = true
+				}
+			case mapping.PendingUpload:
+				report.FileOnly++
+				report.Uploading++
+			case mapping.InSOS:
+				report.Deleted++
+				slog.Debug("Token deleted from SOS since the last start", "token_id", id)
+				if download {
+					delete(mappings, id)
+					changed = true
+				}
+			default:
+				report.FileOnly++
+				slog.Debug("Token only in file storage", "token_id", id, "upload", upload)
+				if upload {
+					mapping.PendingUpload = true
+					report.Uploading++
+					changed = true
+				}
+			}
+		}
+		for _, id := range ids {
+			if mappings[id] != nil {
+				continue
+			}
+			report.SOSOnly++
+			if info := copies[id]; info != nil {
+				mappings[id] = sosMapping(info)
+				report.Downloaded++
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to save file storage: %v", err)
+	}
+	return report, nil
+}
+
+// sosMapping converts an SOS registration to the file storage format, as a
+// copy of SOS
+func sosMapping(info *TokenStorageInfo) *TokenMapping {
+	return &TokenMapping{
+		OpaqueID:        info.OpaqueID,
+		EncryptedData:   info.EncryptedData,
+		Platform:        info.Platform,
+		RegisteredAt:    info.RegisteredAt,
+		EncryptedEmail:  info.EncryptedEmail,
+		EncryptedPhone:  info.EncryptedPhone,
+		Channels:        info.Channels,
+		FirebaseProject: info.FirebaseProject,
+
+		NotifySecretHash: info.NotifySecretHash,
+		Metadata:         info.Metadata,
+		UserHash:         info.UserHash,
+		Timezone:         info.Timezone,
+		QuietHours:       info.QuietHours,
+
+		InSOS: true,
+	}
+}
+
+// logStorageSync reports the startup comparison, warning about what is left
+// split between the two
+func logStorageSync(report storageSyncReport) {
+	args := []any{
+		"in_both", report.InBoth,
+		"file_only", report.FileOnly,
+		"uploading", report.Uploading,
+		"deleted_from_sos", report.Deleted,
+		"sos_only", report.SOSOnly,
+		"downloaded", report.Downloaded,
+		"differing", report.Differing,
+	}
+	if report.FileOnly > report.Uploading {
+		slog.Warn("Registrations in --storage-file are missing from SOS and not uploaded; set --sos-sync-upload to upload them", args...)
+		return
+	}
+	slog.Info("File storage reconciled with SOS", args...)
+}
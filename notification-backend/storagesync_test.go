@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+func TestSyncStorageOnStart(t *testing.T) {
+	chaos, sos := useFailoverStorage(t)
+	chaos.rate = 0
+	ctx := context.Background()
+
+	// SOS holds 1 and 2, while the file has 0 and 3 of its own, an older copy
+	// of 1, and 4, which SOS had at the last start but has deleted since
+	storeFakeTokens(t, exoscaleStorage, 3)
+	if err := exoscaleStorage.DeleteToken(ctx, apitest.OpaqueID(0)); err != nil {
+		t.Fatal(err)
+	}
+	mapping := func(n int, token string) *TokenMapping {
+		return &TokenMapping{OpaqueID: apitest.OpaqueID(n), EncryptedData: apitest.EncryptToken(token), Platform: "android", RegisteredAt: time.Now()}
+	}
+	tokenStore.mappings[apitest.OpaqueID(0)] = mapping(0, "file-only")
+	tokenStore.mappings[apitest.OpaqueID(1)] = mapping(1, "older-copy")
+	tokenStore.mappings[apitest.OpaqueID(3)] = mapping(3, "pending-upload")
+	tokenStore.mappings[apitest.OpaqueID(3)].PendingUpload = true
+	tokenStore.mappings[apitest.OpaqueID(4)] = mapping(4, "deleted-from-sos")
+	tokenStore.mappings[apitest.OpaqueID(4)].InSOS = true
+
+	report, err := syncStorageOnStart(ctx, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := storageSyncReport{InBoth: 1, FileOnly: 2, Uploading: 2, Deleted: 1, SOSOnly: 1}
+	if report != want {
+		t.Errorf("Expected %+v, got %+v", want, report)
+	}
+	if m, _ := tokenStore.GetMapping(apitest.OpaqueID(1)); !m.InSOS || m.PendingUpload {
+		t.Errorf("Expected the copy of 1 marked as in SOS, got %+v", m)
+	}
+	if _, ok := tokenStore.GetPendingUpload(apitest.OpaqueID(0)); !ok {
+		t.Error("Expected the file-only registration queued for upload")
+	}
+	if _, ok := tokenStore.GetPendingUpload(apitest.OpaqueID(4)); ok {
+		t.Error("Expected a registration deleted from SOS not to be uploaded again")
+	}
+	if _, ok := sos.objects[apitest.PublicKeyHash()+"/"+apitest.OpaqueID(1)]; !ok || len(sos.objects) != 2 {
+		t.Errorf("Expected SOS untouched until the upload, got %d objects", len(sos.objects))
+	}
+
+	// Until they are uploaded the file-only registrations are served from the file
+	if info, err := getToken(ctx, apitest.OpaqueID(0)); err != nil || info.EncryptedData != apitest.EncryptToken("file-only") {
+		t.Errorf("Expected the file-only registration, got %+v, %v", info, err)
+	}
+	if uploaded, err := reconcilePendingUploads(ctx); err != nil || uploaded != 2 {
+		t.Fatalf("Expected 2 uploads, got %d, %v", uploaded, err)
+	}
+	if len(sos.objects) != 4 {
+		t.Errorf("Expected 0 to 3 in SOS, got %d objects", len(sos.objects))
+	}
+
+	// Downloading makes the file a copy of SOS
+	report, err = syncStorageOnStart(ctx, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = storageSyncReport{InBoth: 1, Deleted: 1, SOSOnly: 3, Downloaded: 4, Differing: 1}
+	if report != want {
+		t.Errorf("Expected %+v, got %+v", want, report)
+	}
+	if tokenStore.Count() != 4 || len(tokenStore.PendingUploads()) != 0 {
+		t.Errorf("Expected 4 copies and nothing to upload, got %d and %d", tokenStore.Count(), len(tokenStore.PendingUploads()))
+	}
+	if m, _ := tokenStore.GetMapping(apitest.OpaqueID(1)); m.EncryptedData != apitest.EncryptToken("fcm-token") || !m.InSOS {
+		t.Errorf("Expected SOS's version of 1, got %+v", m)
+	}
+	if _, err := tokenStore.GetMapping(apitest.OpaqueID(4)); err == nil {
+		t.Error("Expected the copy of a deleted registration dropped")
+	}
+
+	// Nothing is split any more
+	report, err = syncStorageOnStart(ctx, true, false)
+	if want := (storageSyncReport{InBoth: 4}); err != nil || report != want {
+		t.Errorf("Expected %+v, got %+v, %v", want, report, err)
+	}
+}
+
+func TestSyncStorageOnStartWithoutUpload(t *testing.T) {
+	chaos, sos := useFailoverStorage(t)
+	chaos.rate = 0
+	ctx := context.Background()
+	id, err := tokenStore.AddRegistration(TokenRegistration{EncryptedData: apitest.EncryptToken("file-only"), Platform: "android"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := syncStorageOnStart(ctx, false, false)
+	if want := (storageSyncReport{FileOnly: 1}); err != nil || report != want {
+		t.Errorf("Expected %+v, got %+v, %v", want, report, err)
+	}
+	if _, ok := tokenStore.GetPendingUpload(id); ok {
+		t.Error("Expected the registration left alone")
+	}
+	if uploaded, _ := reconcilePendingUploads(ctx); uploaded != 0 || len(sos.objects) != 0 {
+		t.Errorf("Expected nothing uploaded, got %d", uploaded)
+	}
+
+	// A listing that fails changes nothing
+	chaos.ops, chaos.rate = map[string]bool{"ListObjectsV2": true}, 1
+	if _, err := syncStorageOnStart(ctx, true, true); err == nil {
+		t.Error("Expected the listing error")
+	}
+	if _, ok := tokenStore.GetPendingUpload(id); ok || tokenStore.Count() != 1 {
+		t.Errorf("Expected the file store as it was, got %d registrations", tokenStore.Count())
+	}
+}
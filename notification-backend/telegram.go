@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// Telegram configuration; platform "telegram" is disabled without a bot token
+	telegramBotTokenArg = flag.String("telegram-bot-token", "", "Telegram bot token for platform \"telegram\" (or TELEGRAM_BOT_TOKEN); empty disables it")
+	telegramAPIURL      = flag.String("telegram-api-url", "https://api.telegram.org", "Telegram Bot API server, for a self-hosted telegram-bot-api")
+	telegramTimeout     = flag.Duration("telegram-timeout", 10*time.Second, "Timeout for a single Telegram send")
+)
+
+// telegramBotToken is resolved from the flag or environment at startup
+var telegramBotToken string
+
+// telegramClient calls the Bot API; tests replace it
+var telegramClient = &http.Client{}
+
+// telegramChatPattern matches numeric chat IDs (negative for groups) and @channel usernames
+var telegramChatPattern = regexp.MustCompile(`^(-?[0-9]{1,20}|@[A-Za-z][A-Za-z0-9_]{4,31})$`)
+
+// maxTelegramLength is the longest text sendMessage accepts
+const maxTelegramLength = 4096
+
+var telegramTransport = &transport{
+	name:       "telegram",
+	configured: func() bool { return telegramBotToken != "" },
+	ready: func() error {
+		if telegramBotToken == "" {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("Telegram is not configured (--telegram-bot-token)"))
+		}
+		return nil
+	},
+	validate: validateTelegramChat,
+	send:     sendTelegram,
+}
+
+// telegramMessage is the body of a sendMessage call
+type telegramMessage struct {
+	ChatID    string `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode"`
+}
+
+// telegramResult is the envelope of every Bot API response
+type telegramResult struct {
+	OK          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+// setupTelegram resolves the bot token, preferring the flag over TELEGRAM_BOT_TOKEN
+func setupTelegram(token string) error {
+	if token == "" {
+		token = os.Getenv("TELEGRAM_BOT_TOKEN")
+	}
+	if token == "" {
+		return nil
+	}
+	if id, secret, ok := strings.Cut(token, ":"); !ok || id == "" || secret == "" {
+		return fmt.Errorf("Telegram bot token must look like 123456:ABC-DEF..., as issued by @BotFather")
+	}
+	telegramBotToken = token
+	return nil
+}
+
+// validateTelegramChat checks a decrypted chat ID
+func validateTelegramChat(chatID string) error {
+	if !telegramChatPattern.MatchString(chatID) {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("Telegram chat must be a numeric chat ID or an @channel username"))
+	}
+	return nil
+}
+
+// telegramText renders the title in bold above the body. Telegram counts the
+// limit after parsing the markup, so the body is cut on the plain text.
+func telegramText(title, body string) string {
+	body = truncateRunes(body, max(1, maxTelegramLength-len([]rune(title))-1))
+	return "<b>" + html.EscapeString(title) + "</b>\n" + html.EscapeString(body)
+}
+
+// sendTelegram posts the notification to the registration's chat as the bot
+func sendTelegram(ctx context.Context, d delivery) error {
+	payload, err := json.Marshal(telegramMessage{ChatID: d.Address, Text: telegramText(d.Title, d.Body), ParseMode: "HTML"})
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	ctx, span := startSpan(ctx, "telegram.sendMessage")
+	sendCtx, cancel := context.WithTimeout(ctx, *telegramTimeout)
+	defer cancel()
+
+	endpoint := strings.TrimRight(*telegramAPIURL, "/") + "/bot" + telegramBotToken + "/sendMessage"
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to build Telegram request"))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		// The URL carries the bot token, so report only the underlying cause
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to send to Telegram: %v", err))
+	}
+	defer resp.Body.Close()
+
+	var result telegramResult
+	if decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); decodeErr != nil {
+		result.Description = resp.Status
+	}
+
+	err = nil
+	switch {
+	case result.OK:
+	case resp.StatusCode == http.StatusForbidden, strings.Contains(result.Description, "chat not found"):
+		// The user blocked the bot, left the group or the chat is gone
+		err = withCode(ErrTokenUnregistered, fmt.Errorf("Telegram chat unreachable: %d %s", result.ErrorCode, result.Description))
+	case resp.StatusCode == http.StatusBadRequest:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("Telegram rejected the message: %s", result.Description))
+	default:
+		// 401 means our bot token is wrong, 429 and 5xx are Telegram's problem
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("Telegram returned %s: %s", resp.Status, result.Description))
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendTelegram(t *testing.T) {
+	var got telegramMessage
+	var path string
+	status, reply := http.StatusOK, `{"ok":true,"result":{}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+	defer server.Close()
+
+	originalURL, originalToken := *telegramAPIURL, telegramBotToken
+	defer func() { *telegramAPIURL, telegramBotToken = originalURL, originalToken }()
+	*telegramAPIURL = server.URL
+	if err := setupTelegram("123456:ABC-secret"); err != nil {
+		t.Fatalf("setupTelegram failed: %v", err)
+	}
+
+	d := delivery{Address: "-1001234567890", Title: "Deploy <prod>", Body: "Done & dusted"}
+	if err := sendTelegram(t.Context(), d); err != nil {
+		t.Fatalf("Expected send to succeed, got %v", err)
+	}
+	if path != "/bot123456:ABC-secret/sendMessage" || got.ChatID != "-1001234567890" || got.ParseMode != "HTML" ||
+		got.Text != "<b>Deploy &lt;prod&gt;</b>\nDone &amp; dusted" {
+		t.Errorf("Unexpected send to %s: %+v", path, got)
+	}
+
+	for _, tc := range []struct {
+		status int
+		reply  string
+		code   ErrorCode
+	}{
+		{http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`, ErrTokenUnregistered},
+		{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`, ErrTokenUnregistered},
+		{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: message is too long"}`, ErrInvalidMessage},
+		{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5"}`, ErrTransportUnavailable},
+	} {
+		status, reply = tc.status, tc.reply
+		if err := sendTelegram(t.Context(), d); errorCodeOf(err, "") != tc.code {
+			t.Errorf("Telegram %q: expected %s, got %v", tc.reply, tc.code, err)
+		}
+	}
+
+	// Connection errors must not leak the bot token from the URL
+	*telegramAPIURL = "http://127.0.0.1:1"
+	if err := sendTelegram(t.Context(), d); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected connection error without the bot token, got %v", err)
+	}
+}
+
+func TestTelegramConfiguration(t *testing.T) {
+	originalToken := telegramBotToken
+	defer func() { telegramBotToken = originalToken }()
+	if err := setupTelegram("not-a-token"); err == nil {
+		t.Error("Expected malformed bot token to be rejected")
+	}
+
+	for chat, valid := range map[string]bool{
+		"123456789":      true,
+		"-1001234567890": true,
+		"@ops_alerts":    true,
+		"@ab":            false,
+		"":               false,
+		"12 34":          false,
+	} {
+		if err := validateTelegramChat(chat); (err == nil) != valid {
+			t.Errorf("Chat %q: expected valid=%v, got %v", chat, valid, err)
+		}
+	}
+
+	if text := telegramText("T", strings.Repeat("é", 5000)); len([]rune(text)) != maxTelegramLength+len("<b></b>") {
+		t.Errorf("Expected text cut to the Telegram limit, got %d characters", len([]rune(text)))
+	}
+
+	if transportFor("telegram") != telegramTransport {
+		t.Error("Expected platform routing to pick Telegram for \"telegram\"")
+	}
+}
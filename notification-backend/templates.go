@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxTemplateLength bounds a template's title and body
+	maxTemplateLength = 4096
+	// maxVariableLength bounds each variable substituted into a template
+	maxVariableLength = 256
+	// maxTemplateLocales bounds the translations of one template
+	maxTemplateLocales = 100
+)
+
+// templateVariablePattern is a placeholder such as {{order_id}}
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// NotificationTemplate is the named copy of a notification, with
+// placeholders filled from the variables of each /v1/notify
+type NotificationTemplate struct {
+	Name      string                  `json:"name"`
+	Title     string                  `json:"title"`
+	Body      string                  `json:"body"`
+	Locales   map[string]TemplateText `json:"locales,omitempty"` // normalized locale -> translation
+	Variables []string                `json:"variables"`         // placeholders used, sorted
+	CreatedAt time.Time               `json:"created_at"`
+	UpdatedAt time.Time               `json:"updated_at"`
+}
+
+// TemplateText is the translation of a template into one locale
+type TemplateText struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// TemplateRequest creates or replaces a template. Title and body are the
+// text for devices whose locale has no translation.
+type TemplateRequest struct {
+	Title   string                  `json:"title"`
+	Body    string                  `json:"body"`
+	Locales map[string]TemplateText `json:"locales,omitempty"`
+}
+
+// TemplateResponse is returned by the endpoints reading or changing one template
+type TemplateResponse struct {
+	Success  bool                 `json:"success"`
+	Template NotificationTemplate `json:"template"`
+}
+
+// TemplateListResponse is returned by GET /v1/templates
+type TemplateListResponse struct {
+	Success   bool                   `json:"success"`
+	Templates []NotificationTemplate `json:"templates"`
+}
+
+func (t *NotificationTemplate) clone() NotificationTemplate {
+	c := *t
+	c.Variables = slices.Clone(t.Variables)
+	c.Locales = maps.Clone(t.Locales)
+	return c
+}
+
+// normalizeLocale folds "fr_CH" and "FR-ch" into "fr-ch"
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
+
+// templateVariables lists the placeholders of a template text. Braces that
+// do not form a placeholder are refused, so a typo cannot reach devices.
+func templateVariables(text string) ([]string, error) {
+	var names []string
+	for _, m := range templateVariablePattern.FindAllStringSubmatch(text, -1) {
+		names = append(names, m[1])
+	}
+	if rest := templateVariablePattern.ReplaceAllString(text, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return nil, withCode(ErrInvalidRequest, fmt.Errorf("malformed placeholder; use {{name}} with letters, digits and '_'"))
+	}
+	return names, nil
+}
+
+// textVariables checks one title and body and lists their placeholders
+func textVariables(text TemplateText) ([]string, error) {
+	if text.Title == "" || text.Body == "" {
+		return nil, withCode(ErrMissingField, fmt.Errorf("title and body are required"))
+	}
+	if len(text.Title) > maxTemplateLength || len(text.Body) > maxTemplateLength {
+		return nil, withCode(ErrInvalidRequest, fmt.Errorf("title and body must be at most %d bytes", maxTemplateLength))
+	}
+	variables := []string{}
+	for _, s := range []string{text.Title, text.Body} {
+		names, err := templateVariables(s)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, names...)
+	}
+	slices.Sort(variables)
+	return slices.Compact(variables), nil
+}
+
+// newTemplate checks a template request and lists its placeholders. A
+// translation may leave out placeholders but not add any, so the variables
+// a caller sends do not depend on the device's locale.
+func newTemplate(name string, req TemplateRequest) (NotificationTemplate, error) {
+	variables, err := textVariables(TemplateText{Title: req.Title, Body: req.Body})
+	if err != nil {
+		return NotificationTemplate{}, err
+	}
+	if len(req.Locales) > maxTemplateLocales {
+		return NotificationTemplate{}, withCode(ErrInvalidRequest, fmt.Errorf("a template has at most %d locales", maxTemplateLocales))
+	}
+	tmpl := NotificationTemplate{Name: name, Title: req.Title, Body: req.Body, Variables: variables}
+	for locale, text := range req.Locales {
+		if !localePattern.MatchString(locale) {
+			return NotificationTemplate{}, withCode(ErrInvalidRequest, fmt.Errorf("locale %q is not a language tag", locale))
+		}
+		key := normalizeLocale(locale)
+		if _, dup := tmpl.Locales[key]; dup {
+			return NotificationTemplate{}, withCode(ErrInvalidRequest, fmt.Errorf("locale %q is given twice", locale))
+		}
+		names, err := textVariables(text)
+		if err != nil {
+			return NotificationTemplate{}, withCode(errorCodeOf(err, ErrInvalidRequest), fmt.Errorf("locale %q: %v", locale, err))
+		}
+		for _, n := range names {
+			if !slices.Contains(variables, n) {
+				return NotificationTemplate{}, withCode(ErrInvalidRequest, fmt.Errorf("locale %q uses {{%s}}, which the default text does not", locale, n))
+			}
+		}
+		if tmpl.Locales == nil {
+			tmpl.Locales = make(map[string]TemplateText, len(req.Locales))
+		}
+		tmpl.Locales[key] = text
+	}
+	return tmpl, nil
+}
+
+// localized picks the translation for a device locale, dropping subtags
+// until one matches ("zh-Hant-TW", then "zh-hant", then "zh"), and falls back
+// to the default text
+func (t *NotificationTemplate) localized(locale string) TemplateText {
+	for key := normalizeLocale(locale); key != ""; {
+		if text, ok := t.Locales[key]; ok {
+			return text
+		}
+		i := strings.LastIndex(key, "-")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return TemplateText{Title: t.Title, Body: t.Body}
+}
+
+// render fills the placeholders of the template's text for locale. Every
+// placeholder needs a variable and every variable a placeholder, which
+// catches callers and templates drifting apart.
+func (t *NotificationTemplate) render(locale string, variables map[string]string) (title, body string, err error) {
+	for _, name := range t.Variables {
+		if _, ok := variables[name]; !ok {
+			return "", "", withCode(ErrMissingField, fmt.Errorf("template %q needs variable %q", t.Name, name))
+		}
+	}
+	for name, value := range variables {
+		if !slices.Contains(t.Variables, name) {
+			return "", "", withCode(ErrInvalidRequest, fmt.Errorf("template %q has no variable %q", t.Name, name))
+		}
+		if len(value) > maxVariableLength || !utf8.ValidString(value) {
+			return "", "", withCode(ErrInvalidRequest, fmt.Errorf("variable %q must be valid UTF-8 of at most %d bytes", name, maxVariableLength))
+		}
+	}
+	fill := func(text string) string {
+		return templateVariablePattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+			return variables[templateVariablePattern.FindStringSubmatch(placeholder)[1]]
+		})
+	}
+	text := t.localized(locale)
+	return fill(text.Title), fill(text.Body), nil
+}
+
+// getTemplate retrieves a template from the appropriate storage
+func getTemplate(ctx context.Context, name string) (NotificationTemplate, error) {
+	if useExoscale {
+		return exoscaleStorage.GetTemplate(ctx, name)
+	}
+	return tokenStore.GetTemplate(name)
+}
+
+// putTemplate stores a template in the appropriate storage, keeping the
+// creation time of the one it replaces
+func putTemplate(ctx context.Context, tmpl NotificationTemplate) (NotificationTemplate, error) {
+	if useExoscale {
+		return exoscaleStorage.PutTemplate(ctx, tmpl)
+	}
+	return tokenStore.PutTemplate(tmpl)
+}
+
+// deleteTemplate removes a template from the appropriate storage
+func deleteTemplate(ctx context.Context, name string) error {
+	if useExoscale {
+		return exoscaleStorage.DeleteTemplate(ctx, name)
+	}
+	return tokenStore.DeleteTemplate(name)
+}
+
+// listTemplates retrieves every template from the appropriate storage
+func listTemplates(ctx context.Context) ([]NotificationTemplate, error) {
+	if useExoscale {
+		return exoscaleStorage.ListTemplates(ctx)
+	}
+	return tokenStore.ListTemplates(), nil
+}
+
+// writeTemplateError reports a failed template lookup or update
+func writeTemplateError(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorCodeOf(err, ErrStorageUnavailable)
+	loggerFromContext(r.Context()).Warn("Template operation failed", "code", code, "error", err)
+	switch code {
+	case ErrTemplateNotFound:
+		writeError(w, code, "Template not found")
+	case ErrInvalidRequest, ErrMissingField:
+		writeError(w, code, err.Error())
+	default:
+		writeError(w, code, "Failed to access template")
+	}
+}
+
+// writeTemplate answers with the template as it now stands
+func writeTemplate(w http.ResponseWriter, r *http.Request, tmpl NotificationTemplate) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(TemplateResponse{Success: true, Template: tmpl}); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
+
+// handleListTemplates lists every template by name
+func handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	templates, err := listTemplates(r.Context())
+	if err != nil {
+		writeTemplateError(w, r, err)
+		return
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(TemplateListResponse{Success: true, Templates: templates}); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
+
+// handleGetTemplate returns one template
+func handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	tmpl, err := getTemplate(r.Context(), name)
+	if err != nil {
+		writeTemplateError(w, r, err)
+		return
+	}
+	writeTemplate(w, r, tmpl)
+}
+
+// handlePutTemplate creates a template or replaces its copy
+func handlePutTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var req TemplateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	tmpl, err := newTemplate(name, req)
+	if err == nil {
+		tmpl, err = putTemplate(r.Context(), tmpl)
+	}
+	if err != nil {
+		writeTemplateError(w, r, err)
+		return
+	}
+	logger.Info("Template stored", "template", name, "variables", tmpl.Variables, "locales", len(tmpl.Locales))
+	writeTemplate(w, r, tmpl)
+}
+
+// handleDeleteTemplate removes a template
+func handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathName(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteTemplate(r.Context(), name); err != nil {
+		writeTemplateError(w, r, err)
+		return
+	}
+	loggerFromContext(r.Context()).Info("Template deleted", "template", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl, err := newTemplate("order_shipped", TemplateRequest{Title: "Order {{ order_id }} shipped", Body: "{{carrier}} has order {{order_id}}"})
+	if err != nil {
+		t.Fatalf("newTemplate failed: %v", err)
+	}
+	if want := []string{"carrier", "order_id"}; !reflect.DeepEqual(tmpl.Variables, want) {
+		t.Errorf("Expected variables %v, got %v", want, tmpl.Variables)
+	}
+	title, body, err := tmpl.render("", map[string]string{"order_id": "42", "carrier": "{{x}}"})
+	if err != nil || title != "Order 42 shipped" || body != "{{x}} has order 42" {
+		t.Errorf("Unexpected rendering %q %q %v", title, body, err)
+	}
+	if _, _, err := tmpl.render("", map[string]string{"order_id": "42"}); errorCodeOf(err, "") != ErrMissingField {
+		t.Errorf("Expected MISSING_FIELD for a missing variable, got %v", err)
+	}
+	if _, _, err := tmpl.render("", map[string]string{"order_id": "42", "carrier": "c", "eta": "soon"}); errorCodeOf(err, "") != ErrInvalidRequest {
+		t.Errorf("Expected INVALID_REQUEST for an unused variable, got %v", err)
+	}
+
+	for _, text := range []string{"Order {{order-id}}", "Order {{order_id}", "Order }}"} {
+		if _, err := newTemplate("bad", TemplateRequest{Title: text, Body: "b"}); errorCodeOf(err, "") != ErrInvalidRequest {
+			t.Errorf("Expected %q to be refused, got %v", text, err)
+		}
+	}
+}
+
+func TestTemplateLocales(t *testing.T) {
+	tmpl, err := newTemplate("order_shipped", TemplateRequest{Title: "Shipped", Body: "Order {{order_id}} is on its way", Locales: map[string]TemplateText{
+		"fr":         {Title: "Expédiée", Body: "La commande {{order_id}} est en route"},
+		"de_CH":      {Title: "Versandt", Body: "Bestellung {{order_id}} ist unterwegs"},
+		"zh-Hant-TW": {Title: "已出貨", Body: "訂單已出貨"},
+	}})
+	if err != nil {
+		t.Fatalf("newTemplate failed: %v", err)
+	}
+	vars := map[string]string{"order_id": "42"}
+	for locale, want := range map[string]string{
+		"fr-CH":      "La commande 42 est en route",
+		"de-ch":      "Bestellung 42 ist unterwegs",
+		"de":         "Order 42 is on its way",
+		"zh_Hant_TW": "訂單已出貨",
+		"":           "Order 42 is on its way",
+	} {
+		if _, body, err := tmpl.render(locale, vars); err != nil || body != want {
+			t.Errorf("Locale %q: expected %q, got %q %v", locale, want, body, err)
+		}
+	}
+	// A translation without a placeholder still needs the variable from the caller
+	if _, _, err := tmpl.render("zh-Hant-TW", nil); errorCodeOf(err, "") != ErrMissingField {
+		t.Errorf("Expected MISSING_FIELD whatever the locale, got %v", err)
+	}
+
+	for name, locales := range map[string]map[string]TemplateText{
+		"not a tag":       {"french": {Title: "t", Body: "b"}},
+		"twice":           {"fr_CH": {Title: "t", Body: "b"}, "fr-ch": {Title: "t", Body: "b"}},
+		"new placeholder": {"fr": {Title: "t", Body: "{{order_id}} {{carrier}}"}},
+		"no body":         {"fr": {Title: "t"}},
+	} {
+		if _, err := newTemplate("bad", TemplateRequest{Title: "t", Body: "{{order_id}}", Locales: locales}); err == nil {
+			t.Errorf("%s: expected the translation refused", name)
+		}
+	}
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalKey, originalEnabled := privateKey, tokenStore, useExoscale, rawAPIKey, *pollEnabled
+	defer func() {
+		privateKey, tokenStore, useExoscale, rawAPIKey, *pollEnabled = originalPrivateKey, originalStore, originalExoscale, originalKey, originalEnabled
+	}()
+	privateKey = privKey
+	storagePath := filepath.Join(t.TempDir(), "tokens.json")
+	tokenStore = NewDurableTokenStore(storagePath)
+	useExoscale = false
+	rawAPIKey = "admin-key"
+	*pollEnabled = true
+
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+	call := func(method, path, body string) (*httptest.ResponseRecorder, TemplateResponse, ErrorCode) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		var resp TemplateResponse
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr, resp, errResp.Code
+	}
+
+	rr, resp, _ := call("PUT", "/v1/templates/order_shipped", `{"title":"Shipped","body":"Order {{order_id}} is on its way"}`)
+	if rr.Code != http.StatusOK || !reflect.DeepEqual(resp.Template.Variables, []string{"order_id"}) {
+		t.Fatalf("Expected the template stored, got %d %s", rr.Code, rr.Body.String())
+	}
+	created := resp.Template.CreatedAt
+	if _, _, code := call("PUT", "/v1/templates/order_shipped", `{"title":"Shipped"}`); code != ErrMissingField {
+		t.Errorf("Expected MISSING_FIELD without a body, got %s", code)
+	}
+	if _, _, code := call("GET", "/v1/templates/order_lost", ""); code != ErrTemplateNotFound {
+		t.Errorf("Expected TEMPLATE_NOT_FOUND, got %s", code)
+	}
+	req := httptest.NewRequest("GET", "/v1/templates", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected templates to need the API key, got %d", rr.Code)
+	}
+
+	// Replacing keeps the creation time, and both survive a restart
+	call("PUT", "/v1/templates/order_shipped", `{"title":"Shipped","body":"Order {{order_id}} left with {{carrier}}"}`)
+	call("PUT", "/v1/templates/welcome", `{"title":"Welcome","body":"Hello","locales":{"fr":{"title":"Bienvenue","body":"Bonjour"}}}`)
+	tokenStore = NewDurableTokenStore(storagePath)
+	_, resp, _ = call("GET", "/v1/templates/order_shipped", "")
+	if !resp.Template.CreatedAt.Equal(created) || len(resp.Template.Variables) != 2 {
+		t.Errorf("Expected the replaced template with its creation time, got %+v", resp.Template)
+	}
+
+	// A poll registration keeps what it was sent, so the rendering can be read back
+	encrypted := apitest.EncryptToken("0123456789abcdef0123456789abcdef")
+	opaqueID, _ := tokenStore.AddToken(encrypted, "poll")
+	notify := func(body string) (int, ErrorCode) {
+		rr := httptest.NewRecorder()
+		handleNotify(rr, httptest.NewRequest("POST", "/v1/notify", strings.NewReader(body)))
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr.Code, errResp.Code
+	}
+	for name, tc := range map[string]struct {
+		body string
+		want ErrorCode
+	}{
+		"unknown template": {`{"token_id":"` + opaqueID + `","template":"order_lost"}`, ErrTemplateNotFound},
+		"missing variable": {`{"token_id":"` + opaqueID + `","template":"order_shipped","variables":{"order_id":"42"}}`, ErrMissingField},
+		"title as well":    {`{"token_id":"` + opaqueID + `","template":"welcome","title":"t"}`, ErrInvalidRequest},
+		"no template":      {`{"token_id":"` + opaqueID + `","title":"t","body":"b","variables":{"order_id":"42"}}`, ErrInvalidRequest},
+	} {
+		if _, code := notify(tc.body); code != tc.want {
+			t.Errorf("%s: expected %s, got %s", name, tc.want, code)
+		}
+	}
+	if status, code := notify(`{"token_id":"` + opaqueID + `","template":"order_shipped","variables":{"order_id":"42","carrier":"Swiss Post"}}`); status != http.StatusOK {
+		t.Fatalf("Expected the templated notification sent, got %d %s", status, code)
+	}
+	queue, _ := updatePending(t.Context(), opaqueID, func(*pendingQueue) bool { return false })
+	if len(queue.Messages) != 1 || queue.Messages[0].Title != "Shipped" || queue.Messages[0].Body != "Order 42 left with Swiss Post" {
+		t.Errorf("Expected the rendered notification queued, got %+v", queue.Messages)
+	}
+
+	// The device's registered locale picks the translation
+	frenchID, _ := tokenStore.AddRegistration(TokenRegistration{EncryptedData: encrypted, Platform: "poll", Locale: "fr-CH"}, "")
+	if status, code := notify(`{"token_id":"` + frenchID + `","template":"welcome"}`); status != http.StatusOK {
+		t.Fatalf("Expected the templated notification sent, got %d %s", status, code)
+	}
+	queue, _ = updatePending(t.Context(), frenchID, func(*pendingQueue) bool { return false })
+	if len(queue.Messages) != 1 || queue.Messages[0].Title != "Bienvenue" {
+		t.Errorf("Expected the French translation queued, got %+v", queue.Messages)
+	}
+
+	if rr, _, _ := call("DELETE", "/v1/templates/welcome", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rr.Code)
+	}
+	if _, _, code := call("DELETE", "/v1/templates/welcome", ""); code != ErrTemplateNotFound {
+		t.Errorf("Expected TEMPLATE_NOT_FOUND on a second delete, got %s", code)
+	}
+	rr, _, _ = call("GET", "/v1/templates", "")
+	var list TemplateListResponse
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list.Templates) != 1 || list.Templates[0].Name != "order_shipped" {
+		t.Errorf("Expected one template left, got %s", rr.Body.String())
+	}
+}
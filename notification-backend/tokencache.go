@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"flag"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	tokenCacheSize = flag.Int("token-cache-size", 10000, "Registrations read from SOS kept in memory, least recently used dropped first (0 disables the cache)")
+	tokenCacheTTL  = flag.Duration("token-cache-ttl", time.Minute, "How long a cached registration is served before it is read from SOS again (0 disables the cache)")
+)
+
+// Cache counters, published on the debug listener under /debug/vars
+var (
+	tokenCacheHits   = expvar.NewInt("token_cache_hits")
+	tokenCacheMisses = expvar.NewInt("token_cache_misses")
+)
+
+// tokenCache keeps the registrations GetToken read from SOS, so a device
+// notified again and again costs one SOS read per TTL. It only holds what
+// the encrypted object holds, never a decrypted token. Writes through this
+// server invalidate their entry; those of other replicas show once it expires.
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *tokenCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type tokenCacheEntry struct {
+	info    TokenStorageInfo
+	expires time.Time
+}
+
+// newTokenCache returns a cache of size registrations, or nil when size or
+// ttl is not positive. A nil cache holds nothing.
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &tokenCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns a copy of the registration cached for opaqueID unless it has expired by now
+func (c *tokenCache) get(opaqueID string, now time.Time) (*TokenStorageInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[opaqueID]
+	if !ok {
+		tokenCacheMisses.Add(1)
+		return nil, false
+	}
+	entry := el.Value.(*tokenCacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(el)
+		tokenCacheMisses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	tokenCacheHits.Add(1)
+	info := copyTokenInfo(&entry.info)
+	return &info, true
+}
+
+// put caches a copy of info until now plus the TTL, dropping the least
+// recently used registration when full
+func (c *tokenCache) put(info *TokenStorageInfo, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &tokenCacheEntry{info: copyTokenInfo(info), expires: now.Add(c.ttl)}
+	if el, ok := c.entries[info.OpaqueID]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[info.OpaqueID] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops the registration cached for opaqueID, if any
+func (c *tokenCache) invalidate(opaqueID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[opaqueID]; ok {
+		c.remove(el)
+	}
+}
+
+// len returns the number of registrations cached, expired ones included
+func (c *tokenCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// copyTokenInfo copies info along with its channels and metadata, so the
+// copy shares nothing with it
+func copyTokenInfo(info *TokenStorageInfo) TokenStorageInfo {
+	copied := *info
+	copied.Channels = slices.Clone(info.Channels)
+	if info.Metadata != nil {
+		metadata := *info.Metadata
+		copied.Metadata = &metadata
+	}
+	return copied
+}
+
+func (c *tokenCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*tokenCacheEntry).info.OpaqueID)
+}
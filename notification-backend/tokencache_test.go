@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"remote-notification/api/apitest"
+)
+
+func TestTokenCache(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newTokenCache(2, time.Minute)
+	info := func(n int) *TokenStorageInfo {
+		return &TokenStorageInfo{
+			OpaqueID: apitest.OpaqueID(n), Platform: "android",
+			Channels: []ChannelRegistration{{Platform: "webpush", EncryptedData: "subscription"}},
+			Metadata: &DeviceMetadata{Locale: "de-CH"},
+		}
+	}
+	stored := info(0)
+	c.put(stored, start)
+	c.put(info(1), start)
+
+	// Entries and hits are copies, so neither the caller that stored a
+	// registration nor those reading it can change what is cached
+	stored.Channels[0].Platform, stored.Metadata.Locale = "changed", "changed"
+	got, ok := c.get(apitest.OpaqueID(0), start)
+	if !ok || got.OpaqueID != apitest.OpaqueID(0) {
+		t.Fatalf("Expected 0 cached, got %+v", got)
+	}
+	if got.Channels[0].Platform != "webpush" || got.Metadata.Locale != "de-CH" {
+		t.Errorf("Expected the cached copy unchanged by the caller that stored it, got %+v %+v", got.Channels, got.Metadata)
+	}
+	got.Platform, got.Channels[0].Platform, got.Metadata.Locale = "changed", "changed", "changed"
+	if got, _ := c.get(apitest.OpaqueID(0), start); got.Platform != "android" || got.Channels[0].Platform != "webpush" || got.Metadata.Locale != "de-CH" {
+		t.Errorf("Expected the cached copy unchanged, got %q %+v %+v", got.Platform, got.Channels, got.Metadata)
+	}
+
+	// 1 is now the least recently used, so it goes first
+	c.put(info(2), start)
+	if _, ok := c.get(apitest.OpaqueID(1), start); ok || c.len() != 2 {
+		t.Errorf("Expected 1 evicted and 2 registrations cached, got %d", c.len())
+	}
+	c.invalidate(apitest.OpaqueID(2))
+	if _, ok := c.get(apitest.OpaqueID(2), start); ok {
+		t.Error("Expected 2 invalidated")
+	}
+
+	// Entries expire after the TTL
+	if _, ok := c.get(apitest.OpaqueID(0), start.Add(time.Minute-time.Second)); !ok {
+		t.Error("Expected 0 still cached just before the TTL")
+	}
+	if _, ok := c.get(apitest.OpaqueID(0), start.Add(time.Minute)); ok || c.len() != 0 {
+		t.Errorf("Expected 0 expired and dropped, got %d cached", c.len())
+	}
+
+	// Disabled caches hold nothing
+	for _, c := range []*tokenCache{newTokenCache(0, time.Minute), newTokenCache(10, 0)} {
+		c.put(info(0), start)
+		if _, ok := c.get(apitest.OpaqueID(0), start); ok || c != nil {
+			t.Error("Expected no cache")
+		}
+	}
+}
+
+func TestExoscaleStorageTokenCache(t *testing.T) {
+	s, sos := newFakeSOSStorage(t, nil)
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	s.clock, s.cache = clock, newTokenCache(10, time.Minute)
+	ctx := context.Background()
+	storeFakeTokens(t, s, 2)
+	id := apitest.OpaqueID(0)
+
+	// Only the first read goes to SOS, and with it the last used time
+	for range 3 {
+		if info, err := s.GetToken(ctx, id); err != nil || info.OpaqueID != id {
+			t.Fatalf("Expected the registration, got %+v, %v", info, err)
+		}
+	}
+	if gets := sos.gets(); gets != 1 {
+		t.Errorf("Expected one SOS read for 3 lookups, got %d", gets)
+	}
+
+	// A write or a delete through this server is read back at once
+	reg := TokenRegistration{EncryptedData: apitest.EncryptToken("re-registered"), Platform: "ios"}
+	if err := s.StoreToken(ctx, id, reg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.GetToken(ctx, id); err != nil || info.Platform != "ios" {
+		t.Errorf("Expected the new registration, got %+v, %v", info, err)
+	}
+	if err := s.DeleteToken(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetToken(ctx, id); errorCodeOf(err, "") != ErrTokenNotFound {
+		t.Errorf("Expected TOKEN_NOT_FOUND after the delete, got %v", err)
+	}
+
+	// Once the TTL is over SOS is read again, so changes by other replicas show
+	before := sos.gets()
+	s.GetToken(ctx, apitest.OpaqueID(1))
+	clock.now = clock.now.Add(time.Minute)
+	s.GetToken(ctx, apitest.OpaqueID(1))
+	if gets := sos.gets() - before; gets != 2 {
+		t.Errorf("Expected the expired registration read again, got %d reads", gets)
+	}
+}
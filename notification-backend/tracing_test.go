@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestTracingSpanNamedAfterRoute(t *testing.T) {
+	originalProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(originalProvider)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/poll/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := tracingHandler(mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/poll/secret-opaque-id", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/elsewhere/secret-opaque-id", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 server spans, got %d", len(spans))
+	}
+	for i, want := range []string{"GET /v1/poll/{id}", "GET"} {
+		if spans[i].Name() != want {
+			t.Errorf("Expected span %q, got %q", want, spans[i].Name())
+		}
+	}
+	var paths []string
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == semconv.URLPathKey {
+			paths = append(paths, attr.Value.AsString())
+		}
+	}
+	if len(paths) != 1 || paths[0] != "/v1/poll/{id}" {
+		t.Errorf("Expected the route recorded as the path, got %q", paths)
+	}
+}
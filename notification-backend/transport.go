@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"remote-notification/api"
+)
+
+// transport delivers title/body notifications for one family of platforms.
+// The device address it receives is the decrypted registration payload: an
+// FCM token, a Web Push subscription, and so on.
+type transport struct {
+	name string
+	// configured reports whether registrations for the platform are accepted
+	configured func() bool
+	// ready is checked before decrypting, so an outage does not cost an RSA
+	// operation per token; its error carries the code to report
+	ready func() error
+	// validate checks a decrypted address at registration
+	validate func(address string) error
+	send     func(ctx context.Context, d delivery) error
+}
+
+// delivery is one notification addressed to one registration
+type delivery struct {
+	OpaqueID string
+	Address  string // decrypted registration payload
+	Title    string
+	Body     string
+	// Priority is the FCM Android priority, "high" when empty. "normal"
+	// messages may be delayed until the device wakes.
+	Priority string
+	// Critical notifications may fall back to SMS
+	Critical bool
+	// FirebaseProject is the registration's project label for FCM sends
+	FirebaseProject string
+	// Released notifications were already held back for quiet hours
+	Released bool
+}
+
+var fcmTransport = &transport{
+	name:       "fcm",
+	configured: func() bool { return true },
+	ready: func() error {
+		if messagingClient == nil {
+			return withCode(ErrFCMUnavailable, fmt.Errorf("firebase messaging client not initialized"))
+		}
+		return nil
+	},
+	validate: validateFCMToken,
+	send: func(ctx context.Context, d delivery) error {
+		message := fcmNotificationMessage(d.Address, d.Title, d.Body)
+		if d.Priority != "" {
+			message.Android.Priority = d.Priority
+		}
+		_, err := deliverFCM(ctx, d.FirebaseProject, message)
+		return err
+	},
+}
+
+// platformTransports maps a registration platform to its transport. Any
+// other platform, including the existing "android" and "ios", goes to FCM.
+var platformTransports = map[string]*transport{
+	"web":       webPushTransport,
+	"ntfy":      ntfyTransport,
+	"mqtt":      mqttTransport,
+	"huawei":    hmsTransport,
+	"windows":   wnsTransport,
+	"telegram":  telegramTransport,
+	"websocket": websocketTransport,
+	"poll":      pollTransport,
+	"pushover":  pushoverTransport,
+	"email":     emailTransport,
+	"slack":     slackTransport,
+	"discord":   discordTransport,
+}
+
+// transportFor picks the transport for a stored platform
+func transportFor(platform string) *transport {
+	if t, ok := platformTransports[platform]; ok {
+		return t
+	}
+	return fcmTransport
+}
+
+// sendNotification delivers the notification in d to a stored registration,
+// failing over through its channels in preference order and then to the
+// fallback channels
+func sendNotification(ctx context.Context, token *TokenStorageInfo, d delivery) error {
+	d.OpaqueID, d.FirebaseProject = token.OpaqueID, token.FirebaseProject
+
+	// Only critical notifications may wake the user during quiet hours
+	if send, _, err := deferDelivery(ctx, []*TokenStorageInfo{token}, d); len(send) == 0 || err != nil {
+		return err
+	}
+
+	channels := tokenChannels(token)
+	errs := make([]error, 0, len(channels))
+	for i, ch := range channels {
+		err := sendChannel(ctx, ch, d)
+		if err == nil {
+			if i > 0 {
+				loggerFromContext(ctx).Info("Delivered through failover channel", "token_id", token.OpaqueID, "platform", ch.Platform, "position", i)
+			}
+			return nil
+		}
+		if i < len(channels)-1 {
+			loggerFromContext(ctx).Warn("Channel failed, trying next", "token_id", token.OpaqueID, "platform", ch.Platform, "error", err)
+		}
+		errs = append(errs, err)
+	}
+	return sendFallback(ctx, token, d, failoverError(errs))
+}
+
+// fallbackChannel reaches a registration outside push, through an address
+// stored alongside the device token
+type fallbackChannel struct {
+	name string
+	// applies reports whether the channel should try after push failed with pushErr
+	applies func(token *TokenStorageInfo, d delivery, pushErr error) bool
+	send    func(ctx context.Context, token *TokenStorageInfo, d delivery) error
+}
+
+// fallbackChannels are tried in order until one delivers
+var fallbackChannels = []*fallbackChannel{emailFallback, smsFallback}
+
+// sendFallback tries the fallback channels after a failed push. The push
+// error is returned when none applies or all fail.
+func sendFallback(ctx context.Context, token *TokenStorageInfo, d delivery, pushErr error) error {
+	logger := loggerFromContext(ctx)
+	for _, f := range fallbackChannels {
+		if !f.applies(token, d, pushErr) {
+			continue
+		}
+		if err := f.send(ctx, token, d); err != nil {
+			logger.Warn("Fallback delivery failed", "channel", f.name, "token_id", token.OpaqueID, "push_error", pushErr, "error", err)
+			continue
+		}
+		logger.Info("Delivered through fallback", "channel", f.name, "token_id", token.OpaqueID, "push_error", pushErr)
+		return nil
+	}
+	return pushErr
+}
+
+// validateFCMToken checks the decrypted token has the shape of an FCM token
+func validateFCMToken(token string) error {
+	if err := api.ValidateFCMToken(token); err != nil {
+		return withCode(ErrInvalidFCMToken, fmt.Errorf("decrypted %v", err))
+	}
+	return nil
+}
+
+// fcmNotificationMessage builds the title/body message sent to FCM devices
+func fcmNotificationMessage(token, title, body string) *messaging.Message {
+	return &messaging.Message{
+		Token: token,
+		Notification: &messaging.Notification{
+			Title: title,
+			Body:  body,
+		},
+		Android: &messaging.AndroidConfig{
+			Priority: "high",
+		},
+	}
+}
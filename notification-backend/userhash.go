@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"remote-notification/api"
+)
+
+// userHashPattern is a hex HMAC-SHA256, the form the app backend sends
+var userHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// UserNotificationRequest sends to every device registered with a user hash
+type UserNotificationRequest = api.UserNotificationRequest
+
+// validateUserHash checks an optional registration user hash. Only the app
+// backend holds the HMAC key, so we can group devices by the hash but never
+// recover or guess the user ID behind it.
+func validateUserHash(userHash string) error {
+	if userHash != "" && !userHashPattern.MatchString(userHash) {
+		return withCode(ErrInvalidRequest, fmt.Errorf("user_hash must be 64 lowercase hex characters (HMAC-SHA256)"))
+	}
+	return nil
+}
+
+// handleNotifyUser sends one notification to all devices of a user in a
+// single call, so the app backend no longer issues one /v1/notify per device
+func handleNotifyUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeError(w, readBodyError(err), "Failed to read request body")
+		return
+	}
+	var notif UserNotificationRequest
+	if err := json.Unmarshal(body, &notif); err != nil {
+		logger.Warn("Error parsing JSON", "error", err)
+		writeError(w, ErrInvalidJSON, "Invalid JSON")
+		return
+	}
+	if notif.UserHash == "" || notif.Title == "" || notif.Body == "" {
+		writeError(w, ErrMissingField, "user_hash, title and body are required")
+		return
+	}
+	if err := validateUserHash(notif.UserHash); err != nil {
+		writeError(w, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	all, err := getAllTokens(r.Context())
+	if err != nil {
+		logger.Error("Failed to get tokens", "error", err)
+		writeError(w, ErrStorageUnavailable, "Failed to retrieve tokens")
+		return
+	}
+	var tokens []*TokenStorageInfo
+	for _, token := range all {
+		if token.UserHash == notif.UserHash {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		writeError(w, ErrNoTokens, "No devices registered for this user")
+		return
+	}
+
+	logger = logger.With("user_hash", notif.UserHash)
+	sendToTokens(w, r.WithContext(withLogger(r.Context(), logger)), tokens,
+		NotificationRequest{Title: notif.Title, Body: notif.Body, Critical: notif.Critical})
+}
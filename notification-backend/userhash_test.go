@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+func TestNotifyUserByHash(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalClient, originalKey := privateKey, tokenStore, useExoscale, messagingClient, rawAPIKey
+	defer func() {
+		privateKey, tokenStore, useExoscale, messagingClient, rawAPIKey = originalPrivateKey, originalStore, originalExoscale, originalClient, originalKey
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	messagingClient = nil // every delivery fails with FCM_UNAVAILABLE
+	rawAPIKey = "admin-key"
+
+	alice := strings.Repeat("a1", 32)
+	register := func(userHash string) int {
+		encrypted := apitest.EncryptToken(apitest.FCMToken(1))
+		body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "android", UserHash: userHash})
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		return rr.Code
+	}
+	for _, userHash := range []string{alice, alice, strings.Repeat("b2", 32), ""} {
+		if status := register(userHash); status != http.StatusOK {
+			t.Fatalf("Registration with user hash %q failed: %d", userHash, status)
+		}
+	}
+	if status := register("alice@example.com"); status != http.StatusBadRequest {
+		t.Errorf("Expected a plain user ID to be refused as user_hash, got %d", status)
+	}
+
+	notify := func(body string) (*httptest.ResponseRecorder, ErrorCode) {
+		req := httptest.NewRequest("POST", "/v1/notify-user", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		requireAPIKey(handleNotifyUser)(rr, req)
+		var errResp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &errResp)
+		return rr, errResp.Code
+	}
+	rr, _ := notify(`{"user_hash":"` + alice + `","title":"t","body":"b"}`)
+	var sent SendResponse
+	json.Unmarshal(rr.Body.Bytes(), &sent)
+	if rr.Code != http.StatusOK || sent.TotalTokens != 2 {
+		t.Errorf("Expected both of the user's devices targeted, got %d %s", rr.Code, rr.Body.String())
+	}
+	if _, code := notify(`{"user_hash":"` + strings.Repeat("c3", 32) + `","title":"t","body":"b"}`); code != ErrNoTokens {
+		t.Errorf("Expected NO_TOKENS for an unknown user, got %s", code)
+	}
+	if _, code := notify(`{"user_hash":"ALICE","title":"t","body":"b"}`); code != ErrInvalidRequest {
+		t.Errorf("Expected INVALID_REQUEST for a malformed hash, got %s", code)
+	}
+	if _, code := notify(`{"title":"t","body":"b"}`); code != ErrMissingField {
+		t.Errorf("Expected MISSING_FIELD without a hash, got %s", code)
+	}
+
+	// The hash is shortened in logs like an opaque ID
+	if line := logLine(privacyStandard, "user_hash", alice); strings.Contains(line, alice) {
+		t.Errorf("Full user hash leaked with standard privacy: %s", line)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	gitCommit = "" // Set by build flags
+	buildDate = "" // Set by build flags
+)
+
+// VersionInfo describes the running build and its enabled features
+type VersionInfo struct {
+	Version   string            `json:"version"`
+	GitCommit string            `json:"git_commit"`
+	BuildDate string            `json:"build_date"`
+	GoVersion string            `json:"go_version"`
+	Features  map[string]string `json:"features"`
+}
+
+// buildVersionInfo collects version details, falling back to the VCS stamp
+// embedded by the Go toolchain when the build flags were not set
+func buildVersionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Features:  enabledFeatures(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.GitCommit == "":
+				info.GitCommit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	return info
+}
+
+// enabledFeatures reports which optional subsystems this notification-backend is running with
+func enabledFeatures() map[string]string {
+	storage := "file"
+	if useExoscale {
+		storage = "exoscale-sos"
+	}
+	return map[string]string{
+		"storage":           storage,
+		"auth":              "none",
+		"tracing":           enabledString(tracingEnabled),
+		"error_reporting":   enabledString(errorReportingEnabled),
+		"raw_api":           enabledString(rawAPIKey != ""),
+		"webpush":           enabledString(vapidPrivateKey != ""),
+		"ntfy":              enabledString(*ntfyServer != ""),
+		"mqtt":              enabledString(*mqttBroker != ""),
+		"hms":               enabledString(*hmsAppID != ""),
+		"wns":               enabledString(*wnsPackageSID != ""),
+		"gotify":            enabledString(len(gotifyApps) > 0),
+		"email_fallback":    enabledString(*smtpAddr != ""),
+		"sms_fallback":      enabledString(activeSMSProvider != nil),
+		"telegram":          enabledString(telegramBotToken != ""),
+		"websocket":         enabledString(*websocketEnabled),
+		"poll":              enabledString(*pollEnabled),
+		"pushover":          enabledString(pushoverAppToken != ""),
+		"chat_webhooks":     enabledString(*chatWebhooksEnabled),
+		"firebase_projects": enabledString(len(fcmProjects) > 0),
+		"play_integrity":    enabledString(*playIntegrityPackage != ""),
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(buildVersionInfo()); err != nil {
+		loggerFromContext(r.Context()).Error("Error encoding response", "error", err)
+	}
+}
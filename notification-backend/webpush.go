@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+var (
+	// Web Push (VAPID) configuration; platform "web" is disabled without a key
+	vapidPrivateKeyPath = flag.String("vapid-private-key", "", "PEM or base64url P-256 private key file for Web Push (VAPID); empty disables platform \"web\"")
+	vapidSubject        = flag.String("vapid-subject", "", "Contact for push services in the VAPID claim, a mailto: address or https: URL")
+	webPushTTL          = flag.Duration("webpush-ttl", 24*time.Hour, "How long push services keep an undelivered Web Push message")
+	webPushTimeout      = flag.Duration("webpush-timeout", 10*time.Second, "Timeout for a single Web Push delivery")
+)
+
+// VAPID key pair in the base64url form webpush-go expects; empty when Web Push is off
+var vapidPublicKey, vapidPrivateKey string
+
+// webPushClient sends requests to push services; tests replace it
+var webPushClient webpush.HTTPClient = &http.Client{}
+
+var webPushTransport = &transport{
+	name:       "webpush",
+	configured: func() bool { return vapidPrivateKey != "" },
+	ready: func() error {
+		if vapidPrivateKey == "" {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("web push is not configured (--vapid-private-key)"))
+		}
+		return nil
+	},
+	validate: validateWebPushSubscription,
+	send:     sendWebPush,
+}
+
+// WebPushPayload is the JSON a service worker receives in its push event
+type WebPushPayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// setupWebPush loads the VAPID key when one is configured
+func setupWebPush(path string) error {
+	if path == "" {
+		return nil
+	}
+	key, err := loadVAPIDKey(path)
+	if err != nil {
+		return err
+	}
+	vapidPrivateKey = base64.RawURLEncoding.EncodeToString(key.Bytes())
+	vapidPublicKey = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	return nil
+}
+
+// loadVAPIDKey reads a P-256 private key, either PEM (SEC 1 or PKCS #8, as
+// written by openssl) or the base64url scalar used by most Web Push libraries
+func loadVAPIDKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VAPID key: %v", err)
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		var key *ecdsa.PrivateKey
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if pkcs8Err != nil {
+				return nil, fmt.Errorf("failed to parse VAPID key: %v", err)
+			}
+			var ok bool
+			if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+				return nil, fmt.Errorf("VAPID key is not an EC key")
+			}
+		}
+		ecdhKey, err := key.ECDH()
+		if err != nil || ecdhKey.Curve() != ecdh.P256() {
+			return nil, fmt.Errorf("VAPID key must be on the P-256 curve")
+		}
+		return ecdhKey, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(string(data)), "="))
+	if err != nil {
+		return nil, fmt.Errorf("VAPID key is neither PEM nor base64url: %v", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID key: %v", err)
+	}
+	return key, nil
+}
+
+// decodeWebPushKey accepts the padded or unpadded base64url keys browsers produce
+func decodeWebPushKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// validateWebPushSubscription checks a decrypted PushSubscription.toJSON() value
+func validateWebPushSubscription(address string) error {
+	invalid := func(format string, args ...any) error {
+		return withCode(ErrInvalidSubscription, fmt.Errorf(format, args...))
+	}
+
+	var sub webpush.Subscription
+	if err := json.Unmarshal([]byte(address), &sub); err != nil {
+		return invalid("subscription is not JSON: %v", err)
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return invalid("subscription endpoint must be an https URL")
+	}
+	if key, err := decodeWebPushKey(sub.Keys.P256dh); err != nil || len(key) != 65 || key[0] != 0x04 {
+		return invalid("subscription p256dh must be an uncompressed P-256 public key")
+	}
+	if auth, err := decodeWebPushKey(sub.Keys.Auth); err != nil || len(auth) != 16 {
+		return invalid("subscription auth secret must be 16 bytes")
+	}
+	return nil
+}
+
+// sendWebPush encrypts the notification for the subscription (RFC 8291) and
+// posts it to the browser's push service with a VAPID signature (RFC 8292)
+func sendWebPush(ctx context.Context, d delivery) error {
+	var sub webpush.Subscription
+	if err := json.Unmarshal([]byte(d.Address), &sub); err != nil {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("stored subscription is not JSON: %v", err))
+	}
+	payload, err := json.Marshal(WebPushPayload{Title: d.Title, Body: d.Body})
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	ctx, span := startSpan(ctx, "webpush.send")
+	sendCtx, cancel := context.WithTimeout(ctx, *webPushTimeout)
+	defer cancel()
+	resp, err := webpush.SendNotificationWithContext(sendCtx, payload, &sub, &webpush.Options{
+		HTTPClient:      webPushClient,
+		Subscriber:      strings.TrimPrefix(*vapidSubject, "mailto:"),
+		TTL:             int(webPushTTL.Seconds()),
+		Urgency:         webpush.UrgencyHigh,
+		VAPIDPublicKey:  vapidPublicKey,
+		VAPIDPrivateKey: vapidPrivateKey,
+	})
+	if err != nil {
+		endSpan(span, err)
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to send web push: %v", err))
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	err = nil
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The browser unsubscribed; the opaque ID will never work again
+		err = withCode(ErrTokenUnregistered, fmt.Errorf("web push subscription expired: %s", resp.Status))
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("push service rejected the message: %s %s", resp.Status, detail))
+	default:
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("push service returned %s %s", resp.Status, detail))
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remote-notification/api/apitest"
+)
+
+// testVAPIDKey enables Web Push with a fresh key for the duration of a test
+func testVAPIDKey(t *testing.T) {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate VAPID key: %v", err)
+	}
+	originalPrivate, originalPublic := vapidPrivateKey, vapidPublicKey
+	t.Cleanup(func() { vapidPrivateKey, vapidPublicKey = originalPrivate, originalPublic })
+	vapidPrivateKey = base64.RawURLEncoding.EncodeToString(key.Bytes())
+	vapidPublicKey = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+// testSubscription builds a subscription JSON for a browser at endpoint
+func testSubscription(t *testing.T, endpoint string) string {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate subscription key: %v", err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	sub, _ := json.Marshal(map[string]any{
+		"endpoint":       endpoint,
+		"expirationTime": nil,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(auth),
+		},
+	})
+	return string(sub)
+}
+
+func TestLoadVAPIDKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+		return path
+	}
+
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	sec1, _ := x509.MarshalECPrivateKey(p256)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(p256)
+	p256ECDH, _ := p256.ECDH()
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	sec1P384, _ := x509.MarshalECPrivateKey(p384)
+
+	valid := map[string]string{
+		"sec1":      write("sec1.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})),
+		"pkcs8":     write("pkcs8.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		"base64url": write("key.txt", []byte(base64.RawURLEncoding.EncodeToString(p256ECDH.Bytes())+"\n")),
+	}
+	for name, path := range valid {
+		key, err := loadVAPIDKey(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !key.Equal(p256ECDH) {
+			t.Errorf("%s: loaded a different key", name)
+		}
+	}
+
+	invalid := map[string]string{
+		"P-384":   write("p384.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1P384})),
+		"garbage": write("garbage.txt", []byte("not a key")),
+		"missing": filepath.Join(dir, "missing"),
+	}
+	for name, path := range invalid {
+		if _, err := loadVAPIDKey(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidateWebPushSubscription(t *testing.T) {
+	good := testSubscription(t, "https://push.example.com/send/abc")
+	if err := validateWebPushSubscription(good); err != nil {
+		t.Errorf("Expected valid subscription, got %v", err)
+	}
+
+	var sub map[string]any
+	json.Unmarshal([]byte(good), &sub)
+	keys := sub["keys"].(map[string]any)
+	variants := map[string]func(){
+		"http endpoint": func() { sub["endpoint"] = "http://push.example.com/x" },
+		"short p256dh":  func() { keys["p256dh"] = "BAAA" },
+		"short auth":    func() { keys["auth"] = "AAAA" },
+	}
+	for name, mutate := range variants {
+		json.Unmarshal([]byte(good), &sub)
+		keys = sub["keys"].(map[string]any)
+		mutate()
+		data, _ := json.Marshal(sub)
+		if err := validateWebPushSubscription(string(data)); errorCodeOf(err, "") != ErrInvalidSubscription {
+			t.Errorf("%s: expected INVALID_SUBSCRIPTION, got %v", name, err)
+		}
+	}
+	if err := validateWebPushSubscription("fcm-token"); err == nil {
+		t.Error("Expected a plain FCM token to be rejected")
+	}
+}
+
+func TestSendWebPush(t *testing.T) {
+	testVAPIDKey(t)
+
+	var status int
+	var got *http.Request
+	var body []byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = readAllAndClose(r)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	originalClient := webPushClient
+	defer func() { webPushClient = originalClient }()
+	webPushClient = server.Client()
+
+	sub := testSubscription(t, server.URL+"/push/abc")
+
+	status = http.StatusCreated
+	if err := sendWebPush(t.Context(), delivery{Address: sub, Title: "Hello", Body: "World"}); err != nil {
+		t.Fatalf("Expected delivery to succeed, got %v", err)
+	}
+	if got.Header.Get("Content-Encoding") != "aes128gcm" || !strings.HasPrefix(got.Header.Get("Authorization"), "vapid t=") || got.Header.Get("TTL") == "" {
+		t.Errorf("Missing Web Push headers: %v", got.Header)
+	}
+	if bytes.Contains(body, []byte("Hello")) {
+		t.Error("Payload was sent unencrypted")
+	}
+
+	for status, code := range map[int]ErrorCode{
+		http.StatusGone:                  ErrTokenUnregistered,
+		http.StatusNotFound:              ErrTokenUnregistered,
+		http.StatusRequestEntityTooLarge: ErrInvalidMessage,
+		http.StatusTooManyRequests:       ErrTransportUnavailable,
+	} {
+		statusCode := status
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(statusCode) })
+		if err := sendWebPush(t.Context(), delivery{Address: sub, Title: "Hello", Body: "World"}); errorCodeOf(err, "") != code {
+			t.Errorf("Push service %d: expected %s, got %v", status, code, err)
+		}
+	}
+}
+
+func readAllAndClose(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(r.Body)
+	return buf.Bytes(), err
+}
+
+func TestRegisterWebPlatform(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey := privateKey
+	privateKey = privKey
+	originalStore, originalExoscale := tokenStore, useExoscale
+	defer func() { privateKey, tokenStore, useExoscale = originalPrivateKey, originalStore, originalExoscale }()
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+
+	register := func(address string) (int, ErrorCode) {
+		encrypted := apitest.EncryptToken(address)
+		body, _ := json.Marshal(TokenRegistration{EncryptedData: encrypted, Platform: "web"})
+		rr := httptest.NewRecorder()
+		handleRegister(rr, httptest.NewRequest("POST", "/v1/register", bytes.NewReader(body)))
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return rr.Code, resp.Code
+	}
+
+	sub := testSubscription(t, "https://push.example.com/send/abc")
+	if status, code := register(sub); status != http.StatusBadRequest || code != ErrUnsupportedPlatform {
+		t.Errorf("Expected UNSUPPORTED_PLATFORM without a VAPID key, got %d %s", status, code)
+	}
+
+	testVAPIDKey(t)
+	if status, _ := register(sub); status != http.StatusOK {
+		t.Errorf("Expected web subscription to register, got %d", status)
+	}
+	if status, code := register("just-an-fcm-token-not-a-subscription"); status != http.StatusBadRequest || code != ErrInvalidSubscription {
+		t.Errorf("Expected INVALID_SUBSCRIPTION, got %d %s", status, code)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var websocketEnabled = flag.Bool("websocket", false, "Accept platform \"websocket\" registrations and serve /v1/ws, for deployments without any third-party push service")
+
+const (
+	wsHelloTimeout = 10 * time.Second // time a new socket has to identify itself
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 2 * wsPingInterval // a socket without a pong for this long is dropped
+	wsWriteTimeout = 10 * time.Second
+	wsMaxMessage   = 4096 // clients only send the hello, so keep reads small
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Sockets authenticate with their registration secret, not cookies, so
+	// cross-origin pages gain nothing and self-hosted web apps may live anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHello is the first message a device sends: its opaque ID and the
+// secret it registered (encrypted) with platform "websocket"
+type WebSocketHello struct {
+	TokenID string `json:"token_id"`
+	Secret  string `json:"secret"`
+}
+
+// WebSocketMessage is every message the server sends
+type WebSocketMessage struct {
+	Type  string `json:"type"` // "ready", "notification" or "error"
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// wsConn is one connected device; writes are serialized
+type wsConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// write sends msg, giving up at the earlier of ctx's deadline and wsWriteTimeout
+func (c *wsConn) write(ctx context.Context, msg WebSocketMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline := time.Now().Add(wsWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetWriteDeadline(deadline)
+	return c.conn.WriteJSON(msg)
+}
+
+// wsHub tracks the connected sockets of this replica by opaque ID
+type wsHub struct {
+	mu    sync.Mutex
+	conns map[string]*wsConn
+}
+
+var websockets = &wsHub{conns: make(map[string]*wsConn)}
+
+// add makes c the socket for id, closing one the device left behind
+func (h *wsHub) add(id string, c *wsConn) {
+	h.mu.Lock()
+	old := h.conns[id]
+	h.conns[id] = c
+	h.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+	}
+}
+
+// remove forgets c, unless it was already replaced by a newer socket
+func (h *wsHub) remove(id string, c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[id] == c {
+		delete(h.conns, id)
+	}
+}
+
+func (h *wsHub) get(id string) *wsConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conns[id]
+}
+
+func (h *wsHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+var websocketTransport = &transport{
+	name:       "websocket",
+	configured: func() bool { return *websocketEnabled },
+	ready: func() error {
+		if !*websocketEnabled {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("WebSocket delivery is not enabled (--websocket)"))
+		}
+		return nil
+	},
+	validate: validateDeviceSecret,
+	send:     sendWebSocket,
+}
+
+// validateDeviceSecret checks the secret a device registers for platforms it
+// connects to us on ("websocket", "poll"). It is generated on the device and
+// only ever sent to us, encrypted or over TLS.
+func validateDeviceSecret(secret string) error {
+	if len(secret) < 32 || len(secret) > 256 {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("device secret must be 32-256 characters"))
+	}
+	return nil
+}
+
+// sendWebSocket writes the notification to the device's socket, which must be
+// connected to this replica
+func sendWebSocket(ctx context.Context, d delivery) error {
+	c := websockets.get(d.OpaqueID)
+	if c == nil {
+		return withCode(ErrTransportUnavailable, fmt.Errorf("device is not connected"))
+	}
+
+	ctx, span := startSpan(ctx, "websocket.send")
+	err := c.write(ctx, WebSocketMessage{Type: "notification", Title: d.Title, Body: d.Body})
+	endSpan(span, err)
+	if err != nil {
+		c.conn.Close()
+		return withCode(ErrTransportUnavailable, fmt.Errorf("failed to write to socket: %v", err))
+	}
+	return nil
+}
+
+// authenticateDevice checks a connecting device's secret against its stored
+// registration, which must be for platform
+func authenticateDevice(ctx context.Context, platform, tokenID, presented string) error {
+	if tokenID == "" || presented == "" {
+		return fmt.Errorf("token_id and secret are required")
+	}
+	token, err := getToken(ctx, tokenID)
+	if err != nil {
+		return fmt.Errorf("unknown token_id or wrong secret")
+	}
+	// The platform may be the registration's own or one of its failover channels
+	for _, ch := range tokenChannels(token) {
+		if ch.Platform != platform {
+			continue
+		}
+		secret, err := decryptHybridToken(ch.EncryptedData)
+		if err != nil {
+			break
+		}
+		ok := subtle.ConstantTimeCompare([]byte(secret), []byte(presented)) == 1
+		secureWipeString(&secret)
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown token_id or wrong secret")
+}
+
+// hijackable finds the connection's own writer below the logging and
+// compression wrappers, which do not implement http.Hijacker
+func hijackable(w http.ResponseWriter) http.ResponseWriter {
+	for {
+		if _, ok := w.(http.Hijacker); ok {
+			return w
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return w
+		}
+		w = u.Unwrap()
+	}
+}
+
+// handleWebSocket upgrades to a WebSocket, waits for the device's hello and
+// then holds the socket open for deliveries until either side closes it
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	if !*websocketEnabled {
+		writeError(w, ErrEndpointDisabled, "Endpoint disabled; set --websocket to enable it")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(hijackable(w), r, nil)
+	if err != nil {
+		// Upgrade has already answered with an HTTP error
+		logger.Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	// The server's read and write timeouts still apply to the hijacked
+	// connection; from here on the socket manages its own deadlines
+	conn.NetConn().SetDeadline(time.Time{})
+	conn.SetReadLimit(wsMaxMessage)
+
+	c := &wsConn{conn: conn}
+	var hello WebSocketHello
+	conn.SetReadDeadline(time.Now().Add(wsHelloTimeout))
+	if err := conn.ReadJSON(&hello); err != nil {
+		logger.Warn("WebSocket hello failed", "error", err)
+		return
+	}
+	if err := authenticateDevice(r.Context(), "websocket", hello.TokenID, hello.Secret); err != nil {
+		logger.Warn("WebSocket authentication failed", "error", err)
+		c.write(r.Context(), WebSocketMessage{Type: "error", Error: err.Error()})
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed"), time.Now().Add(time.Second))
+		return
+	}
+
+	logger = logger.With("token_id", hello.TokenID)
+	websockets.add(hello.TokenID, c)
+	defer websockets.remove(hello.TokenID, c)
+	if err := c.write(r.Context(), WebSocketMessage{Type: "ready"}); err != nil {
+		return
+	}
+	logger.Info("WebSocket connected", "connections", websockets.count())
+
+	// Keep the socket alive: ping regularly and drop it when pongs stop
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Devices have nothing further to say; reading processes pongs and closes
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			logger.Info("WebSocket disconnected", "reason", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"remote-notification/api/apitest"
+)
+
+func TestWebSocketDelivery(t *testing.T) {
+	privKey := apitest.PrivateKey()
+	originalPrivateKey, originalStore, originalExoscale, originalEnabled := privateKey, tokenStore, useExoscale, *websocketEnabled
+	defer func() {
+		privateKey, tokenStore, useExoscale, *websocketEnabled = originalPrivateKey, originalStore, originalExoscale, originalEnabled
+	}()
+	privateKey = privKey
+	tokenStore = NewDurableTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	useExoscale = false
+	*websocketEnabled = true
+
+	const secret = "0123456789abcdef0123456789abcdef"
+	encrypted := apitest.EncryptToken(secret)
+	opaqueID, _ := tokenStore.AddToken(encrypted, "websocket")
+	token, _ := getToken(t.Context(), opaqueID)
+
+	// Route through the usual wrappers to check the upgrade gets past them
+	server := httptest.NewServer(gzipHandler(loggingMiddleware(handleWebSocket)))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(hello WebSocketHello) (*websocket.Conn, WebSocketMessage) {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Accept-Encoding": {"gzip"}})
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.WriteJSON(hello)
+		var msg WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Expected a reply to the hello: %v", err)
+		}
+		return conn, msg
+	}
+
+	if err := sendNotification(t.Context(), token, delivery{Title: "Hi", Body: "there"}); errorCodeOf(err, "") != ErrTransportUnavailable {
+		t.Errorf("Expected TRANSPORT_UNAVAILABLE while disconnected, got %v", err)
+	}
+
+	conn, msg := dial(WebSocketHello{TokenID: opaqueID, Secret: "wrong-secret-wrong-secret-wrong!!"})
+	if msg.Type != "error" {
+		t.Errorf("Expected wrong secret to be refused, got %+v", msg)
+	}
+	conn.Close()
+
+	conn, msg = dial(WebSocketHello{TokenID: opaqueID, Secret: secret})
+	defer conn.Close()
+	if msg.Type != "ready" {
+		t.Fatalf("Expected ready, got %+v", msg)
+	}
+	if err := sendNotification(t.Context(), token, delivery{Title: "Hi", Body: "there"}); err != nil {
+		t.Fatalf("Expected delivery over the socket, got %v", err)
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "notification" || msg.Title != "Hi" || msg.Body != "there" {
+		t.Errorf("Unexpected notification %+v: %v", msg, err)
+	}
+
+	// A reconnecting device replaces its old socket
+	second, msg := dial(WebSocketHello{TokenID: opaqueID, Secret: secret})
+	defer second.Close()
+	if msg.Type != "ready" || websockets.get(opaqueID) == nil || websockets.count() != 1 {
+		t.Errorf("Expected the new socket to replace the old one, got %+v with %d sockets", msg, websockets.count())
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("Expected the old socket to be closed")
+	}
+
+	*websocketEnabled = false
+	rr := httptest.NewRecorder()
+	handleWebSocket(rr, httptest.NewRequest("GET", "/v1/ws", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 when disabled, got %d", rr.Code)
+	}
+}
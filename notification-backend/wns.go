@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// Windows Push Notification Services configuration; platform "windows" is disabled without a package SID
+	wnsPackageSID      = flag.String("wns-package-sid", "", "Package SID (ms-app://...) of the Windows app for platform \"windows\"; empty disables it")
+	wnsClientSecretArg = flag.String("wns-client-secret", "", "WNS client secret from Partner Center (or WNS_CLIENT_SECRET)")
+	wnsTimeout         = flag.Duration("wns-timeout", 10*time.Second, "Timeout for a single WNS token or send request")
+)
+
+// wnsAuthURL issues WNS access tokens; tests point it at a local server
+var wnsAuthURL = "https://login.live.com/accesstoken.srf"
+
+// wnsClientSecret is resolved from the flag or environment at startup
+var wnsClientSecret string
+
+// wnsClient talks to the Live login and WNS servers; tests replace it
+var wnsClient = &http.Client{}
+
+// wnsAccessToken caches the app's WNS access token
+var wnsAccessToken accessTokenCache
+
+// wnsChannelHostSuffix is the domain every WNS channel URI lives under. The
+// channel URI comes from the device, so anything else is refused rather than
+// sent our access token.
+const wnsChannelHostSuffix = ".notify.windows.com"
+
+var wnsTransport = &transport{
+	name:       "wns",
+	configured: func() bool { return *wnsPackageSID != "" },
+	ready: func() error {
+		if *wnsPackageSID == "" {
+			return withCode(ErrTransportUnavailable, fmt.Errorf("WNS is not configured (--wns-package-sid)"))
+		}
+		return nil
+	},
+	validate: validateWNSChannel,
+	send:     sendWNS,
+}
+
+// wnsToast is the ToastGeneric payload shown by Windows
+type wnsToast struct {
+	XMLName xml.Name `xml:"toast"`
+	Visual  struct {
+		Binding struct {
+			Template string   `xml:"template,attr"`
+			Text     []string `xml:"text"`
+		} `xml:"binding"`
+	} `xml:"visual"`
+}
+
+// setupWNS checks the package SID and resolves the client secret, preferring the flag over WNS_CLIENT_SECRET
+func setupWNS(packageSID, secret string) error {
+	if packageSID == "" {
+		return nil
+	}
+	if !strings.HasPrefix(packageSID, "ms-app://") {
+		return fmt.Errorf("--wns-package-sid must start with ms-app://, got %q", packageSID)
+	}
+	if secret == "" {
+		secret = os.Getenv("WNS_CLIENT_SECRET")
+	}
+	if secret == "" {
+		return fmt.Errorf("--wns-package-sid needs --wns-client-secret or WNS_CLIENT_SECRET")
+	}
+	wnsClientSecret = secret
+	return nil
+}
+
+// validateWNSChannel checks a decrypted channel URI points at WNS
+func validateWNSChannel(channel string) error {
+	u, err := url.Parse(channel)
+	if err != nil || u.Scheme != "https" || u.User != nil || !strings.HasSuffix(u.Hostname(), wnsChannelHostSuffix) {
+		return withCode(ErrInvalidSubscription, fmt.Errorf("WNS channel must be an https URI under %s", wnsChannelHostSuffix[1:]))
+	}
+	return nil
+}
+
+// wnsToken returns the app's access token, fetching a new one when it has
+// expired or refresh is set
+func wnsToken(ctx context.Context, refresh bool) (string, error) {
+	return wnsAccessToken.get(ctx, refresh, func(ctx context.Context) (string, time.Duration, error) {
+		token, lifetime, err := fetchClientCredentials(ctx, wnsClient, wnsAuthURL, url.Values{
+			"client_id":     {*wnsPackageSID},
+			"client_secret": {wnsClientSecret},
+			"scope":         {"notify.windows.com"},
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("WNS: %v", err)
+		}
+		return token, lifetime, nil
+	})
+}
+
+// wnsToastPayload renders the title and body as a toast
+func wnsToastPayload(title, body string) ([]byte, error) {
+	var toast wnsToast
+	toast.Visual.Binding.Template = "ToastGeneric"
+	toast.Visual.Binding.Text = []string{title, body}
+	return xml.Marshal(toast)
+}
+
+// sendWNS posts a toast to the device's channel URI. An access token WNS
+// reports as expired is refreshed and the send retried once.
+func sendWNS(ctx context.Context, d delivery) error {
+	// Registration validated the channel, but check again before it gets our token
+	if err := validateWNSChannel(d.Address); err != nil {
+		return err
+	}
+	payload, err := wnsToastPayload(d.Title, d.Body)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	ctx, span := startSpan(ctx, "wns.send")
+	sendCtx, cancel := context.WithTimeout(ctx, *wnsTimeout)
+	defer cancel()
+
+	var resp *http.Response
+	for attempt := 0; attempt < 2; attempt++ {
+		if resp, err = postWNS(sendCtx, d.Address, payload, attempt > 0); err != nil {
+			endSpan(span, err)
+			return withCode(ErrTransportUnavailable, err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			break
+		}
+		resp.Body.Close()
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	status := resp.Status + " " + resp.Header.Get("X-WNS-Status") + " " + resp.Header.Get("X-WNS-Error-Description") + string(detail)
+
+	err = nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		// The channel is invalid or expired; the app has to request a new one
+		err = withCode(ErrTokenUnregistered, fmt.Errorf("WNS channel is gone: %s", status))
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		err = withCode(ErrInvalidMessage, fmt.Errorf("WNS rejected the toast: %s", status))
+	default:
+		// 401 after a refresh or 403 mean our credentials are wrong, 406 is
+		// throttling and 5xx are WNS's problem
+		err = withCode(ErrTransportUnavailable, fmt.Errorf("WNS returned %s", status))
+	}
+	endSpan(span, err)
+	return err
+}
+
+// postWNS sends one toast request
+func postWNS(ctx context.Context, channel string, payload []byte, refresh bool) (*http.Response, error) {
+	token, err := wnsToken(ctx, refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, channel, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build WNS request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("X-WNS-Type", "wns/toast")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := wnsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send to WNS: %v", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// redirectTransport sends every request to target, keeping the path
+type redirectTransport struct{ target *url.URL }
+
+func (rt redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestSendWNS(t *testing.T) {
+	const channel = "https://wns2-db5p.notify.windows.com/w/?token=AwYAAAB"
+	var tokenRequests int
+	var got wnsToast
+	var auth, wnsType string
+	status := http.StatusOK
+	expireNext := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/accesstoken.srf" {
+			tokenRequests++
+			r.ParseForm()
+			if r.Form.Get("client_id") != "ms-app://s-1-15-2-1" || r.Form.Get("scope") != "notify.windows.com" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_client"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"at-` + string(rune('0'+tokenRequests)) + `","expires_in":86400}`))
+			return
+		}
+		auth, wnsType = r.Header.Get("Authorization"), r.Header.Get("X-WNS-Type")
+		if expireNext {
+			expireNext = false
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		xml.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	originalClient, originalAuth, originalSID, originalSecret := wnsClient, wnsAuthURL, *wnsPackageSID, wnsClientSecret
+	defer func() {
+		wnsClient, wnsAuthURL, *wnsPackageSID, wnsClientSecret = originalClient, originalAuth, originalSID, originalSecret
+		wnsAccessToken.reset()
+	}()
+	wnsClient = &http.Client{Transport: redirectTransport{target}}
+	*wnsPackageSID = "ms-app://s-1-15-2-1"
+	if err := setupWNS(*wnsPackageSID, "s3cret"); err != nil {
+		t.Fatalf("setupWNS failed: %v", err)
+	}
+	wnsAccessToken.reset()
+
+	d := delivery{Address: channel, Title: "Hello", Body: "World"}
+	if err := sendWNS(t.Context(), d); err != nil {
+		t.Fatalf("Expected send to succeed, got %v", err)
+	}
+	text := got.Visual.Binding.Text
+	if auth != "Bearer at-1" || wnsType != "wns/toast" || got.Visual.Binding.Template != "ToastGeneric" || len(text) != 2 || text[0] != "Hello" || text[1] != "World" {
+		t.Errorf("Unexpected toast (auth %q, type %q): %+v", auth, wnsType, got)
+	}
+
+	expireNext = true
+	if err := sendWNS(t.Context(), d); err != nil || tokenRequests != 2 || auth != "Bearer at-2" {
+		t.Errorf("Expected refresh and retry after 401, got %v (%d token requests, auth %q)", err, tokenRequests, auth)
+	}
+
+	for statusCode, code := range map[int]ErrorCode{
+		http.StatusGone:                  ErrTokenUnregistered,
+		http.StatusNotFound:              ErrTokenUnregistered,
+		http.StatusRequestEntityTooLarge: ErrInvalidMessage,
+		http.StatusNotAcceptable:         ErrTransportUnavailable,
+		http.StatusForbidden:             ErrTransportUnavailable,
+	} {
+		status = statusCode
+		if err := sendWNS(t.Context(), d); errorCodeOf(err, "") != code {
+			t.Errorf("WNS %d: expected %s, got %v", statusCode, code, err)
+		}
+	}
+}
+
+func TestWNSConfiguration(t *testing.T) {
+	t.Setenv("WNS_CLIENT_SECRET", "")
+	if err := setupWNS("s-1-15-2-1", "s3cret"); err == nil {
+		t.Error("Expected package SID without ms-app:// to be rejected")
+	}
+	if err := setupWNS("ms-app://s-1-15-2-1", ""); err == nil {
+		t.Error("Expected package SID without secret to be rejected")
+	}
+
+	for channel, valid := range map[string]bool{
+		"https://wns2-db5p.notify.windows.com/w/?token=abc": true,
+		"http://wns2-db5p.notify.windows.com/w/":            false,
+		"https://notify.windows.com.evil.example/w/":        false,
+		"https://user@db5p.notify.windows.com/w/":           false,
+		"not a url": false,
+	} {
+		if err := validateWNSChannel(channel); (err == nil) != valid {
+			t.Errorf("Channel %q: expected valid=%v, got %v", channel, valid, err)
+		}
+	}
+
+	payload, _ := wnsToastPayload("<b>Hi</b>", "a & b")
+	if string(payload) != `<toast><visual><binding template="ToastGeneric"><text>&lt;b&gt;Hi&lt;/b&gt;</text><text>a &amp; b</text></binding></visual></toast>` {
+		t.Errorf("Unexpected toast XML: %s", payload)
+	}
+
+	if transportFor("windows") != wnsTransport {
+		t.Error("Expected platform routing to pick WNS for \"windows\"")
+	}
+}